@@ -0,0 +1,331 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Audit states reported in AuditEntry.State.
+const (
+	AuditOK          = "ok"               // stored body matches its recorded checksum
+	AuditMismatch    = "mismatch"         // body no longer matches: bit-rot or tampering
+	AuditNoChecksum  = "missing-checksum" // object predates checksum metadata
+	AuditArchived    = "archived"         // skipped: needs a thaw before it can be read
+	AuditReadFailure = "error"            // the object could not be read
+	AuditTruncated   = "truncated"        // ranged check: the dump's completion footer is missing
+)
+
+// Verification methods reported in AuditEntry.Method.
+const (
+	AuditMethodFull   = "full"   // whole body downloaded and hashed
+	AuditMethodRanged = "ranged" // only the dump's header and footer fetched
+)
+
+// auditChunkSample is how many chunks a ranged audit verifies against the
+// manifest in addition to the first and last.
+const auditChunkSample = 4
+
+// auditProbeSize is how many bytes a ranged audit reads from each end of a
+// backup; enough to hold pg_dump's header and completion footer.
+const auditProbeSize = 4096
+
+// auditLogPrefix is where each Audit call records its outcome, so Report can
+// show when every backup was verified and how it fared.
+const auditLogPrefix = "audit-log/"
+
+// auditRecord is the object an Audit call stores under auditLogPrefix.
+type auditRecord struct {
+	RunID   string       `json:"run_id"`
+	At      time.Time    `json:"at"` // when the audit started
+	Entries []AuditEntry `json:"entries"`
+}
+
+// pg_dump header and footer lines checked by a ranged audit.
+var (
+	dumpHeader = []byte("-- PostgreSQL database dump")
+	dumpFooter = []byte("-- PostgreSQL database dump complete")
+)
+
+// AuditEntry is the verification outcome for one stored backup.
+type AuditEntry struct {
+	Key      string `json:"key"`
+	State    string `json:"state"`              // one of the Audit* states
+	Method   string `json:"method,omitempty"`   // AuditMethodFull or AuditMethodRanged
+	Expected string `json:"expected,omitempty"` // checksum recorded at upload time
+	Actual   string `json:"actual,omitempty"`   // checksum of the body as stored today
+	Error    string `json:"error,omitempty"`    // read failure, when State is "error"
+
+	// Chunk-level results, for backups with a Manifest.
+	ChunksChecked int   `json:"chunks_checked,omitempty"` // manifest chunks compared
+	BadChunks     []int `json:"bad_chunks,omitempty"`     // indexes of chunks that no longer match
+}
+
+// AuditResult summarizes an Audit call.
+type AuditResult struct {
+	Status     string       `json:"status"`      // "ok", or "failed" when any entry mismatched
+	RunID      string       `json:"run_id"`      // run identifier, also prefixed to log lines
+	Action     string       `json:"action"`      // always "audit"
+	Sampled    int          `json:"sampled"`     // number of backups examined
+	Failed     int          `json:"failed"`      // entries in the "mismatch" or "truncated" state
+	Entries    []AuditEntry `json:"entries"`     // per-backup outcomes
+	DurationMs int64        `json:"duration_ms"` // wall-clock time of the call
+}
+
+// Audit re-verifies a random sample of stored backups across all tiers and
+// profiles by downloading each one and comparing its SHA-256 with the checksum
+// recorded when it was uploaded. sample <= 0 means the Handler's configured sample size.
+// Backups larger than the configured full-audit limit are instead checked with
+// ranged GETs of their first and last bytes, which must hold pg_dump's header
+// and completion footer, so a truncated upload is caught without downloading
+// the whole object; compressed backups are always downloaded. When the backup
+// has a Manifest, a ranged audit instead verifies the first, last and a random
+// sample of chunks against their recorded checksums, and a full audit reports
+// which chunks of a mismatching body are corrupt.
+// Archived objects without a restored copy are skipped rather than failing the
+// audit. Any mismatch is reported through a notification; the audit itself
+// only returns an error when listing the bucket fails. Each call's entries are
+// recorded under "audit-log/" as the verification history shown by Report.
+func (h *Handler) Audit(ctx context.Context, sample int) (*AuditResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	if sample <= 0 {
+		sample = h.auditSample
+	}
+
+	objects, err := h.listBackups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = aws.ToString(obj.Key)
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	if len(keys) > sample {
+		keys = keys[:sample]
+	}
+
+	result := &AuditResult{Status: "ok", RunID: runID, Action: "audit", Sampled: len(keys), Entries: []AuditEntry{}}
+	var failed []string
+	for _, key := range keys {
+		entry := h.auditObject(ctx, key)
+		logf(ctx, "Audit %s: %s", key, entry.State)
+		if entry.State == AuditMismatch || entry.State == AuditTruncated {
+			failed = append(failed, key)
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+	if err := h.writeAuditRecord(ctx, auditRecord{RunID: runID, At: start.UTC(), Entries: result.Entries}); err != nil {
+		logf(ctx, "Warning: failed to record audit: %v", err)
+	}
+
+	if len(failed) > 0 {
+		result.Status = "failed"
+		result.Failed = len(failed)
+		h.notify(ctx, Notification{
+			Event:   "audit.failed",
+			Message: fmt.Sprintf("Integrity audit found %d backup(s) that are corrupt or truncated: %s", len(failed), strings.Join(failed, ", ")),
+			Fields:  map[string]string{"failed": strconv.Itoa(len(failed)), "keys": strings.Join(failed, ",")},
+		})
+	}
+	result.DurationMs = h.elapsed(start)
+	return result, nil
+}
+
+// auditRecordKey returns the key of the record of the audit run runID started
+// at, e.g. "audit-log/2026-05-27T030000Z-<run>.json"; keys sort by time.
+func auditRecordKey(at time.Time, runID string) string {
+	return auditLogPrefix + at.UTC().Format("2006-01-02T150405Z") + "-" + runID + ".json"
+}
+
+// writeAuditRecord stores rec under auditLogPrefix, encrypted like backups.
+func (h *Handler) writeAuditRecord(ctx context.Context, rec auditRecord) error {
+	body, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(h.bucket),
+		Key:         aws.String(auditRecordKey(rec.At, rec.RunID)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+		Metadata:    map[string]string{"sha256": checksum(body)},
+	}
+	h.encryption.addMetadata(input.Metadata)
+	h.encryption.applyToPut(input)
+	_, err = h.s3.PutObject(ctx, input)
+	return err
+}
+
+// readAuditRecords returns every audit record in the bucket, oldest first.
+// Unreadable records are logged and skipped.
+func (h *Handler) readAuditRecords(ctx context.Context) ([]auditRecord, error) {
+	objects, err := h.listObjects(ctx, auditLogPrefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = aws.ToString(obj.Key)
+	}
+	sort.Strings(keys)
+
+	records := make([]auditRecord, 0, len(keys))
+	for _, key := range keys {
+		body, err := h.openObject(ctx, key)
+		if err != nil {
+			logf(ctx, "Warning: skipping audit record %s: %v", key, err)
+			continue
+		}
+		var rec auditRecord
+		err = json.NewDecoder(body).Decode(&rec)
+		_ = body.Close()
+		if err != nil {
+			logf(ctx, "Warning: skipping audit record %s: %v", key, err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// auditObject verifies a single stored backup.
+func (h *Handler) auditObject(ctx context.Context, key string) AuditEntry {
+	entry := AuditEntry{Key: key}
+	head, err := h.headObject(ctx, key)
+	if err != nil {
+		entry.State, entry.Error = AuditReadFailure, err.Error()
+		return entry
+	}
+	if state, _ := parseRestoreHeader(head.Restore); isArchivedClass(head.StorageClass) && state != ThawAvailable {
+		entry.State = AuditArchived
+		return entry
+	}
+
+	// Manifest offsets and the dump's footer refer to the uncompressed dump,
+	// so compressed backups are always verified in full, as are archives of
+	// other formats than plain without a manifest: they have no footer.
+	compressed := compressionFromMetadata(head.Metadata).enabled()
+	size := uncompressedSize(head.Metadata, aws.ToInt64(head.ContentLength))
+	manifest := h.auditManifest(ctx, key, size)
+	probed := manifest != nil || head.Metadata["format"] == FormatPlain
+	if size > h.auditFullMax && !compressed && probed {
+		return h.auditRanged(ctx, key, size, manifest)
+	}
+
+	entry.Method = AuditMethodFull
+	entry.Expected = head.Metadata["sha256"]
+	if manifest == nil {
+		entry.Actual, err = h.downloadChecksum(ctx, key)
+	} else {
+		var chunks []string
+		entry.Actual, chunks, err = h.downloadChunkSums(ctx, key, manifest.ChunkSize)
+		entry.ChunksChecked = len(manifest.Chunks)
+		for i, want := range manifest.Chunks {
+			if i >= len(chunks) || chunks[i] != want {
+				entry.BadChunks = append(entry.BadChunks, i)
+			}
+		}
+	}
+	switch {
+	case err != nil:
+		entry.State, entry.Error = AuditReadFailure, err.Error()
+	case entry.Expected == "":
+		entry.State = AuditNoChecksum
+	case entry.Expected != entry.Actual:
+		entry.State = AuditMismatch
+	default:
+		entry.State = AuditOK
+	}
+	return entry
+}
+
+// auditManifest returns the Manifest of the backup at key when it can be used
+// to verify a body of the given size, or nil.
+func (h *Handler) auditManifest(ctx context.Context, key string, size int64) *Manifest {
+	if isSidecarKey(key) {
+		return nil
+	}
+	m, err := h.readManifest(ctx, key)
+	if err != nil {
+		logf(ctx, "Warning: ignoring manifest of %s: %v", key, err)
+		return nil
+	}
+	if m == nil || m.Size != size || m.ChunkSize <= 0 || len(m.Chunks) == 0 {
+		return nil
+	}
+	return m
+}
+
+// auditRanged verifies the backup at key, of the given size, without
+// downloading it: against sampled manifest chunks when manifest is set, or by
+// fetching its first and last auditProbeSize bytes otherwise.
+func (h *Handler) auditRanged(ctx context.Context, key string, size int64, manifest *Manifest) AuditEntry {
+	entry := AuditEntry{Key: key, Method: AuditMethodRanged}
+	if manifest != nil {
+		return h.auditChunks(ctx, entry, manifest)
+	}
+	probe := min(int64(auditProbeSize), size)
+	first, err := h.readRange(ctx, key, 0, probe)
+	if err != nil {
+		entry.State, entry.Error = AuditReadFailure, err.Error()
+		return entry
+	}
+	last, err := h.readRange(ctx, key, size-probe, probe)
+	if err != nil {
+		entry.State, entry.Error = AuditReadFailure, err.Error()
+		return entry
+	}
+	switch {
+	case !bytes.Contains(first, dumpHeader):
+		entry.State = AuditMismatch
+	case !bytes.Contains(last, dumpFooter):
+		entry.State = AuditTruncated
+	default:
+		entry.State = AuditOK
+	}
+	return entry
+}
+
+// auditChunks verifies the first, last and auditChunkSample random chunks of
+// the backup described by m with ranged GETs.
+func (h *Handler) auditChunks(ctx context.Context, entry AuditEntry, m *Manifest) AuditEntry {
+	last := len(m.Chunks) - 1
+	picked := map[int]bool{0: true, last: true}
+	for _, i := range rand.Perm(len(m.Chunks))[:min(auditChunkSample, len(m.Chunks))] {
+		picked[i] = true
+	}
+	indexes := make([]int, 0, len(picked))
+	for i := range picked {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	for _, i := range indexes {
+		offset, length := m.chunk(i)
+		data, err := h.readRange(ctx, entry.Key, offset, length)
+		if err != nil {
+			entry.State, entry.Error = AuditReadFailure, err.Error()
+			return entry
+		}
+		entry.ChunksChecked++
+		if checksum(data) != m.Chunks[i] {
+			entry.BadChunks = append(entry.BadChunks, i)
+		}
+	}
+	entry.State = AuditOK
+	if len(entry.BadChunks) > 0 {
+		entry.State = AuditMismatch
+	}
+	return entry
+}
@@ -0,0 +1,156 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestAuditDetectsMismatch(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-26-backup.sql", []byte("good"), testNow)
+	f.seed("monthly/2026-05-backup.sql", []byte("original"), testNow)
+	f.objects["monthly/2026-05-backup.sql"].body = []byte("bit-rotted") // checksum now stale
+	h := newTestHandler(f, 7)
+	var notified []Notification
+	h.notifier = func(_ context.Context, n Notification) error {
+		notified = append(notified, n)
+		return nil
+	}
+
+	res, err := h.Audit(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Status != "failed" || res.Failed != 1 || res.Sampled != 2 {
+		t.Errorf("status=%q failed=%d sampled=%d, want failed/1/2", res.Status, res.Failed, res.Sampled)
+	}
+	states := map[string]string{}
+	for _, e := range res.Entries {
+		states[e.Key] = e.State
+	}
+	if states["daily/2026-05-26-backup.sql"] != AuditOK || states["monthly/2026-05-backup.sql"] != AuditMismatch {
+		t.Errorf("unexpected states: %v", states)
+	}
+	if len(notified) != 1 || notified[0].Event != "audit.failed" {
+		t.Errorf("expected one audit.failed notification, got %+v", notified)
+	}
+}
+
+func TestAuditSkipsArchivedAndLegacy(t *testing.T) {
+	f := newFakeS3()
+	f.objects["yearly/2025-backup.sql"] = archivedObject(types.StorageClassDeepArchive, nil)
+	f.objects["daily/2026-05-20-backup.sql"] = &fakeObject{body: []byte("legacy"), metadata: map[string]string{}, modified: time.Now()}
+	h := newTestHandler(f, 7)
+
+	res, err := h.Audit(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Status != "ok" {
+		t.Errorf("status = %q, want ok", res.Status)
+	}
+	for _, e := range res.Entries {
+		want := map[string]string{
+			"yearly/2025-backup.sql":      AuditArchived,
+			"daily/2026-05-20-backup.sql": AuditNoChecksum,
+		}[e.Key]
+		if e.State != want {
+			t.Errorf("%s: state = %q, want %q", e.Key, e.State, want)
+		}
+	}
+}
+
+func TestAuditSampleSize(t *testing.T) {
+	f := newFakeS3()
+	for _, key := range []string{"daily/a.sql", "daily/b.sql", "daily/c.sql", "daily/d.sql"} {
+		f.seed(key, []byte(key), testNow)
+	}
+	h := newTestHandler(f, 7)
+
+	res, err := h.Audit(context.Background(), 0) // default sample of 3
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Sampled != 3 || len(res.Entries) != 3 {
+		t.Errorf("sampled=%d entries=%d, want 3", res.Sampled, len(res.Entries))
+	}
+}
+
+func TestAuditListError(t *testing.T) {
+	f := newFakeS3()
+	f.listErr = errors.New("list failed")
+	if _, err := newTestHandler(f, 7).Audit(context.Background(), 1); err == nil {
+		t.Fatal("expected error when listing fails, got nil")
+	}
+}
+
+func TestAuditReadFailure(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/a.sql", []byte("a"), testNow)
+	f.getErr = errors.New("download failed")
+
+	res, err := newTestHandler(f, 7).Audit(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Entries[0].State != AuditReadFailure || res.Entries[0].Error == "" {
+		t.Errorf("entry = %+v, want error state", res.Entries[0])
+	}
+}
+
+func TestAuditRangedForLargeBackups(t *testing.T) {
+	f := newFakeS3()
+	filler := strings.Repeat("INSERT INTO t VALUES (1);\n", 1000)
+	complete := "--\n-- PostgreSQL database dump\n--\n" + filler + "--\n-- PostgreSQL database dump complete\n--\n"
+	f.seed("daily/2026-05-26-backup.sql", []byte(complete), testNow)
+	f.seed("daily/2026-05-25-backup.sql", []byte(complete[:len(complete)-200]), testNow) // cut off mid-upload
+	h := newTestHandler(f, 7)
+	h.auditFullMax = 1024
+
+	res, err := h.Audit(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	states := map[string]string{}
+	for _, e := range res.Entries {
+		if e.Method != AuditMethodRanged {
+			t.Errorf("%s: method = %q, want ranged", e.Key, e.Method)
+		}
+		states[e.Key] = e.State
+	}
+	if states["daily/2026-05-26-backup.sql"] != AuditOK || states["daily/2026-05-25-backup.sql"] != AuditTruncated {
+		t.Errorf("unexpected states: %v", states)
+	}
+	if res.Status != "failed" || res.Failed != 1 {
+		t.Errorf("status=%q failed=%d, want failed/1", res.Status, res.Failed)
+	}
+	if f.fullGets != 0 || f.rangedGets != 4 {
+		t.Errorf("gets: full=%d ranged=%d, want 0 full and 4 ranged", f.fullGets, f.rangedGets)
+	}
+}
+
+func TestAuditRecordsHistory(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-26-backup.sql", []byte("good"), testNow)
+	h := newTestHandler(f, 7)
+
+	res, err := h.Audit(WithRunID(context.Background(), "audit-run"), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	records, err := h.readAuditRecords(context.Background())
+	if err != nil {
+		t.Fatalf("readAuditRecords: %v", err)
+	}
+	if len(records) != 1 || records[0].RunID != "audit-run" || !records[0].At.Equal(testNow) || len(records[0].Entries) != len(res.Entries) {
+		t.Fatalf("records = %+v, want one for run audit-run", records)
+	}
+	if _, ok := f.objects["audit-log/2026-05-27T120000Z-audit-run.json"]; !ok {
+		t.Error("audit record not stored under its time-sorted key")
+	}
+}
@@ -0,0 +1,187 @@
+package backup
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Backfill states reported in BackfillEntry.State.
+const (
+	BackfillDone     = "backfilled" // checksum computed and recorded in the object's metadata
+	BackfillCurrent  = "current"    // the object already records its checksum
+	BackfillArchived = "archived"   // skipped: archived objects can be neither read nor copied in place
+	BackfillFailed   = "error"      // hashing or the copy failed
+)
+
+// How a BackfillEntry's checksum was obtained.
+const (
+	BackfillFromS3       = "s3-checksum" // the SHA-256 checksum S3 stored at upload
+	BackfillFromDownload = "download"    // the object was downloaded and hashed
+)
+
+// BackfillEntry is the outcome for one stored backup.
+type BackfillEntry struct {
+	Key    string `json:"key"`
+	State  string `json:"state"`            // one of the Backfill* states
+	Method string `json:"method,omitempty"` // BackfillFromS3 or BackfillFromDownload, once hashed
+	SHA256 string `json:"sha256,omitempty"` // checksum recorded
+	Error  string `json:"error,omitempty"`
+}
+
+// BackfillResult summarizes a BackfillChecksums call.
+type BackfillResult struct {
+	Status     string          `json:"status"`      // "ok", or "partial" when any object failed
+	RunID      string          `json:"run_id"`      // run identifier, also prefixed to log lines
+	Action     string          `json:"action"`      // always "backfill-checksums"
+	Backfilled int             `json:"backfilled"`  // objects given their checksum by this call
+	Failed     int             `json:"failed"`      // objects that could not be
+	Entries    []BackfillEntry `json:"entries"`     // per-object outcomes
+	DurationMs int64           `json:"duration_ms"` // wall-clock time of the call
+}
+
+// BackfillChecksums records the SHA-256 in the metadata of stored backups
+// written before checksums were, so deduplication and audits never fall back
+// to downloading them. A backup uploaded with an S3 SHA-256 checksum of the
+// whole object is hashed by S3 itself; others are downloaded and hashed. The
+// checksum is then written by copying the object onto itself (CopyObject)
+// with its metadata, content type, storage class and encryption kept. Objects
+// that already record their checksum are left alone, archived ones are
+// skipped, and ones over CopyObject's 5 GB limit fail. An empty prefix covers
+// every tier and profile.
+//
+// Like Rekey, objects are processed oldest first so their relative
+// LastModified order survives the copy.
+func (h *Handler) BackfillChecksums(ctx context.Context, prefix string) (*BackfillResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	var objects []types.Object
+	var err error
+	if prefix == "" {
+		objects, err = h.listBackups(ctx)
+	} else {
+		objects, err = h.listObjects(ctx, prefix)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		return aws.ToTime(objects[i].LastModified).Before(aws.ToTime(objects[j].LastModified))
+	})
+
+	result := &BackfillResult{Status: "ok", RunID: runID, Action: "backfill-checksums", Entries: []BackfillEntry{}}
+	for _, obj := range objects {
+		key := aws.ToString(obj.Key)
+		if isSidecarKey(key) || !isBackupKey(key) {
+			continue
+		}
+		entry := h.backfillObject(ctx, key)
+		if entry.State == BackfillCurrent {
+			continue
+		}
+		logf(ctx, "Backfill %s: %s", entry.Key, entry.State)
+		switch entry.State {
+		case BackfillDone:
+			result.Backfilled++
+		case BackfillFailed:
+			result.Failed++
+			result.Status = "partial"
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+	logf(ctx, "Backfilled the checksums of %d backup(s), %d failed", result.Backfilled, result.Failed)
+	result.DurationMs = h.elapsed(start)
+	return result, nil
+}
+
+// backfillObject records the checksum of a single object in place.
+func (h *Handler) backfillObject(ctx context.Context, key string) BackfillEntry {
+	entry := BackfillEntry{Key: key}
+	head, err := h.headObjectInput(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(h.bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		entry.State, entry.Error = BackfillFailed, err.Error()
+		return entry
+	}
+	if _, ok := head.Metadata["sha256"]; ok {
+		entry.State = BackfillCurrent
+		return entry
+	}
+	if isArchivedClass(head.StorageClass) {
+		entry.State = BackfillArchived
+		return entry
+	}
+
+	if sum, ok := s3Checksum(head); ok {
+		entry.SHA256, entry.Method = sum, BackfillFromS3
+	} else if entry.SHA256, err = h.downloadChecksum(ctx, key); err != nil {
+		entry.State, entry.Error = BackfillFailed, err.Error()
+		return entry
+	} else {
+		entry.Method = BackfillFromDownload
+	}
+
+	metadata := make(map[string]string, len(head.Metadata)+1)
+	for k, v := range head.Metadata {
+		metadata[k] = v
+	}
+	metadata["sha256"] = entry.SHA256
+	input := &s3.CopyObjectInput{
+		Bucket:             aws.String(h.bucket),
+		Key:                aws.String(key),
+		CopySource:         h.copySource(key),
+		ContentType:        head.ContentType,
+		ContentEncoding:    head.ContentEncoding,
+		ContentDisposition: head.ContentDisposition,
+		CacheControl:       head.CacheControl,
+		Metadata:           metadata,
+		MetadataDirective:  types.MetadataDirectiveReplace,
+		StorageClass:       types.StorageClass(head.StorageClass),
+	}
+	h.keepEncryption(input, head)
+	if _, err := h.s3.CopyObject(ctx, input); err != nil {
+		entry.State, entry.Error = BackfillFailed, err.Error()
+		return entry
+	}
+	entry.State = BackfillDone
+	return entry
+}
+
+// keepEncryption sets input, a copy of the object described by head, to keep
+// that object's encryption rather than take the bucket default or the
+// configured one (which Rekey is for).
+func (h *Handler) keepEncryption(input *s3.CopyObjectInput, head *s3.HeadObjectOutput) {
+	switch {
+	case head.SSECustomerKeyMD5 != nil:
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = h.encryption.customerKeyParams()
+		input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5 = h.encryption.customerKeyParams()
+	case head.ServerSideEncryption == types.ServerSideEncryptionAwsKms:
+		input.ServerSideEncryption, input.SSEKMSKeyId = head.ServerSideEncryption, head.SSEKMSKeyId
+	}
+}
+
+// s3Checksum returns, as hex, the SHA-256 S3 stored for the object described
+// by head, if it has one for the whole object as read back: multipart uploads
+// have a checksum of their parts' checksums instead, and the checksum of a
+// compressed object is not that of the dump.
+func s3Checksum(head *s3.HeadObjectOutput) (string, bool) {
+	encoded := aws.ToString(head.ChecksumSHA256)
+	if encoded == "" || strings.Contains(encoded, "-") || compressionFromMetadata(head.Metadata).enabled() {
+		return "", false
+	}
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sum) != 32 {
+		return "", false
+	}
+	return hex.EncodeToString(sum), true
+}
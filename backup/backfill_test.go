@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestBackfillChecksums(t *testing.T) {
+	f := newFakeS3()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f.seed("daily/2024-01-03-backup.sql", []byte("current"), base.Add(2*time.Hour))
+	f.objects["daily/2024-01-01-backup.sql"] = &fakeObject{body: []byte("legacy"), metadata: map[string]string{}, modified: base}
+	uploaded := []byte("uploaded with a checksum")
+	s3sum := sha256.Sum256(uploaded)
+	f.objects["monthly/2024-01-backup.sql"] = &fakeObject{
+		body: uploaded, metadata: map[string]string{"cipher": CipherAWSKMS, "key-id": "k1"}, modified: base.Add(time.Hour),
+		sse: types.ServerSideEncryptionAwsKms, checksum: base64.StdEncoding.EncodeToString(s3sum[:]),
+	}
+	f.objects["yearly/2023-backup.sql"] = &fakeObject{body: []byte("frozen"), metadata: map[string]string{}, storageClass: types.StorageClassDeepArchive}
+	h := newTestHandler(f, 7)
+
+	res, err := h.BackfillChecksums(context.Background(), "")
+	if err != nil {
+		t.Fatalf("BackfillChecksums: %v", err)
+	}
+	if res.Status != "ok" || res.Backfilled != 2 || len(res.Entries) != 3 {
+		t.Fatalf("result = %+v", res)
+	}
+	// Oldest first, so the copies keep the backups' order.
+	if e := res.Entries[1]; e.Key != "daily/2024-01-01-backup.sql" || e.Method != BackfillFromDownload || e.SHA256 != checksum([]byte("legacy")) {
+		t.Errorf("legacy entry = %+v", e)
+	}
+	if e := res.Entries[2]; e.Method != BackfillFromS3 || e.SHA256 != checksum(uploaded) {
+		t.Errorf("entry with an S3 checksum = %+v", e)
+	}
+	if e := res.Entries[0]; e.State != BackfillArchived {
+		t.Errorf("archived entry = %+v", e)
+	}
+	if f.fullGets != 1 {
+		t.Errorf("%d downloads, want only the backup without an S3 checksum", f.fullGets)
+	}
+	monthly := f.objects["monthly/2024-01-backup.sql"]
+	if monthly.metadata["sha256"] != checksum(uploaded) || monthly.metadata["key-id"] != "k1" || monthly.sse != types.ServerSideEncryptionAwsKms {
+		t.Errorf("monthly backup after the copy = %+v, want its checksum added and its encryption kept", monthly)
+	}
+
+	if res, err := h.BackfillChecksums(context.Background(), ""); err != nil || res.Backfilled != 0 || len(res.Entries) != 1 {
+		t.Errorf("second backfill = %+v, %v; want only the archived backup left", res, err)
+	}
+}
+
+func TestBackfillChecksumsCopyFails(t *testing.T) {
+	f := newFakeS3()
+	f.objects["daily/2024-01-01-backup.sql"] = &fakeObject{body: []byte("legacy"), metadata: map[string]string{}}
+	f.copyErr = errors.New("EntityTooLarge")
+	h := newTestHandler(f, 7)
+
+	res, err := h.BackfillChecksums(context.Background(), "daily/")
+	if err != nil {
+		t.Fatalf("BackfillChecksums: %v", err)
+	}
+	if res.Status != "partial" || res.Failed != 1 || res.Entries[0].Error == "" {
+		t.Errorf("result = %+v", res)
+	}
+}
+
+func TestS3Checksum(t *testing.T) {
+	for _, tc := range []struct {
+		encoded  string
+		metadata map[string]string
+		ok       bool
+	}{
+		{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", nil, true},
+		{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=-3", nil, false}, // multipart
+		{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", map[string]string{"compression": "gzip"}, false},
+		{"", nil, false},
+	} {
+		head := &s3.HeadObjectOutput{ChecksumSHA256: aws.String(tc.encoded), Metadata: tc.metadata}
+		if sum, ok := s3Checksum(head); ok != tc.ok || (ok && sum != checksum(nil)) {
+			t.Errorf("s3Checksum(%q, %v) = %q, %v", tc.encoded, tc.metadata, sum, ok)
+		}
+	}
+}
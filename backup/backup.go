@@ -1,167 +1,941 @@
 // Package backup creates PostgreSQL dumps with pg_dump and stores them in S3
 // on a daily/monthly/yearly rotation. It deduplicates unchanged dumps by
-// SHA-256, prunes daily backups past a retention window, and can be driven
+// SHA-256, prunes each tier past its retention window, and can be driven
 // either on a schedule or on demand through an authenticated HTTP endpoint.
 package backup
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-// Dumper produces a SQL dump of the given database. The default implementation
-// is PgDump; tests inject their own.
-type Dumper func(ctx context.Context, db DatabaseConfig) ([]byte, error)
+// Dumper produces a SQL dump of the given database, honoring opts. The default
+// implementation is PgDump; tests inject their own. Like a StreamDumper, a
+// Dumper strips timestamp comments and applies opts.Filters itself; Run only
+// clears the creation time of an archive. The caller owns the returned
+// slice: Run recycles its memory for later runs, so a Dumper must not
+// return, or keep using, memory it shares.
+type Dumper func(ctx context.Context, db DatabaseConfig, opts DumpOptions) ([]byte, error)
+
+// StreamDumper writes a SQL dump of the given database to w, honoring opts,
+// for runs that stream their backup (see Config.StreamUploads). Unlike a
+// Dumper's output, it is stored as written: a StreamDumper strips timestamp
+// comments and applies opts.Filters itself, as PgDumpTo does with FilterDump.
+type StreamDumper func(ctx context.Context, db DatabaseConfig, opts DumpOptions, w io.Writer) error
 
 // Config configures a Handler.
 type Config struct {
-	S3            S3API          // S3 client (required)
-	Bucket        string         // destination bucket (required)
-	Database      DatabaseConfig // database to dump (required)
-	RetentionDays int            // daily backups to keep; <= 0 means 7
-	Dump          Dumper         // dump implementation; nil means PgDump
+	S3             S3API                  // S3 client (required)
+	Bucket         string                 // destination bucket (required)
+	Database       DatabaseConfig         // database to dump (required, unless DatabaseSource is set)
+	DatabaseSource DatabaseSource         // reads Database at invocation time (see RefreshDatabase); nil uses Database as is
+	RetentionDays  int                    // daily backups to keep; <= 0 means 7
+	Dump           Dumper                 // dump implementation; nil means PgDump
+	Query          Querier                // catalog query implementation; nil means Psql
+	Copy           TableCopier            // table slice export implementation; nil means PsqlCopy
+	Restore        Restorer               // restore implementation (see Handler.Restore); nil means PgRestore
+	DumpOptions    DumpOptions            // what the dump includes
+	Notify         Notifier               // notification sink; nil disables notifications
+	AuditSample    int                    // backups re-verified per audit; <= 0 means 3
+	AuditFullMax   int64                  // largest backup an audit downloads in full; <= 0 means 1 GiB
+	KMSKeyID       string                 // SSE-KMS key for new backups; "" keeps the bucket default
+	SSECustomerKey []byte                 // 256-bit SSE-C key for new backups; takes precedence over KMSKeyID
+	Profile        string                 // profile for runs that name none; "" means DefaultProfile
+	Version        string                 // build version, used in the default application_name; "" means "dev"
+	ConflictPolicy string                 // ConflictIgnore (default), ConflictSkip or ConflictDelay
+	ConflictDelay  time.Duration          // longest wait under ConflictDelay; <= 0 means 2 minutes
+	Replicas       []Replica              // secondary destinations that receive a copy of each stored backup
+	Snapshot       Snapshotter            // storage-level snapshot requested when a run stores a backup; nil disables
+	Compression    Compression            // how backups are compressed; the zero value stores them uncompressed
+	ProfileDump    map[string]DumpOptions // merged into the DumpOptions of the named profile, after its own
+	Plans          map[string]Plan        // named action sequences an invocation can run (see Plan)
+	Tenants        TenantRegistry         // tenants backed up by RunTenants; the zero value has none
+	Throttle       DumpThrottle           // limits concurrent dumps per database server; nil admits every dump
+	// CompressionReferenceDays, when positive and backups are compressed with
+	// zstd, compresses each daily backup against a reference dump stored in
+	// the bucket, replaced by that day's dump after this many days, so a
+	// slowly-changing database uploads little more than its changes.
+	CompressionReferenceDays int
+	// LatestPointer, LatestCopy or LatestJSON, keeps a pointer at the newest
+	// daily backup of each profile, under "latest/"; LatestNone keeps none.
+	LatestPointer string
+	// KeyLayout, LayoutTiers (the default) or LayoutHive, is how the keys of
+	// new backups are laid out within each tier.
+	KeyLayout string
+	// CacheControl is the Cache-Control header of stored backups, such as
+	// "private, no-store" to keep downloads through presigned URLs out of
+	// shared caches; "" sets none.
+	CacheControl string
+	// StreamUploads streams each dump to S3 as pg_dump produces it, with
+	// StreamDump, instead of holding it in memory (see runStreamed). Runs
+	// with table slices or replicas hold it in memory regardless.
+	StreamUploads bool
+	StreamDump    StreamDumper // streamed dump implementation; nil means PgDumpTo
+	// StreamFallbackMax, when positive, retries a run whose streamed upload
+	// failed on the buffered path within the same invocation, for dumps of at
+	// most this many bytes (judged by the previous backup and what was dumped
+	// before the failure); larger dumps, and those of a database without a
+	// previous backup, fail the run as before.
+	StreamFallbackMax int64
+	// RetentionMonths and RetentionYears, when positive, bound how many
+	// monthly and yearly backups are kept, the current month or year
+	// counting as one; otherwise every one is kept (see RetentionPolicy).
+	RetentionMonths int
+	RetentionYears  int
+	// RetentionExemptions keep labeled backups past the retention policy
+	// (see RetentionExemption).
+	RetentionExemptions []RetentionExemption
+	// NotifyDedupWindow, when positive, sends at most one failure notification
+	// per window for each database and class of failure, the next one
+	// counting those suppressed (see suppressRepeat).
+	NotifyDedupWindow time.Duration
+	// ServerID names the database server in the identity recorded with each
+	// backup, which a run checks before overwriting one (see
+	// checkCollision); "" means its host and port. Set it to keep the
+	// identity when the server's endpoint changes.
+	ServerID string
+	// HourlyBackups stores a backup under "hourly/" on every run, for
+	// functions scheduled more than once a day; the daily backup is then
+	// created when missing, like the monthly and yearly ones.
+	HourlyBackups bool
+	// RetentionHours is how many hours of hourly backups are kept; <= 0
+	// means 48.
+	RetentionHours int
+	// ManifestSigner signs the manifest of each stored backup, and verifies
+	// those read back; nil leaves manifests unsigned.
+	ManifestSigner ManifestSigner
+	// MemoryBudget, when positive, is the memory in bytes a run should fit
+	// in. It lowers the part size and caps the concurrent part uploads of
+	// streamed runs, holds zstd windows and compression references to it,
+	// and has runs that hold a dump too large for it in memory warn (see
+	// limitsFor).
+	MemoryBudget int64
+	// MigrationTables are the "schema.table" tables whose rows are stored
+	// next to each backup (see MigrationState), or MigrationTablesAuto for
+	// those of known migration tools; nil stores none.
+	MigrationTables []string
+	// ScratchSchemas are globs ("tmp_*") of schemas for temporary or
+	// scratch data, which runs leave out of the dump (see scratchSchemas).
+	ScratchSchemas []string
+	// BackupGlobals also stores the roles and tablespaces of the server after
+	// each run, dumped by DumpGlobals, under "globals/" (see backupGlobals).
+	BackupGlobals bool
+	// GlobalsRolePasswords keeps the password hashes of roles in the globals
+	// dump. Managed servers such as RDS refuse to dump them but to
+	// superusers.
+	GlobalsRolePasswords bool
+	DumpGlobals          GlobalsDumper // globals dump implementation; nil means PgDumpAllGlobals
+	// Databases are backed up by RunDatabases, each under "<name>/", as
+	// are, with DiscoverDatabases, the other databases on the server of
+	// Database.
+	Databases         []DatabaseConfig
+	DiscoverDatabases bool
+	// DatabaseOrder orders the databases of RunDatabases and bounds the
+	// time each backup may take.
+	DatabaseOrder DatabaseOrder
+	// RTOObjective, when positive, is the recovery time objective each
+	// Restore is measured against (see recordRestore); one that takes
+	// longer sends a restore.rto_exceeded notification.
+	RTOObjective time.Duration
+	// RestoreProgressInterval is how often a Restore logs how far it is
+	// through the dump (see RestoreProgress); <= 0 means every minute.
+	RestoreProgressInterval time.Duration
+	// RestoreTargets, when set, matches the names of the databases a
+	// Restore may load into; restoring into another needs
+	// RestoreOptions.Confirm.
+	RestoreTargets *regexp.Regexp
+	// RestoreChecks are run against the target after each Restore (see
+	// RestoreCheck); one that fails makes the restore partial.
+	RestoreChecks []RestoreCheck
+	// RestoreJobs is the RestoreOptions.Jobs of restores that do not set
+	// it; 0 loads one table at a time.
+	RestoreJobs int
+	// RestoreAliases names the databases restores load into, so a restore
+	// can give the name as its target instead of a connection string (see
+	// ResolveTarget). Each is a connection string, or the name or ARN of a
+	// Secrets Manager secret holding one, read with Secrets.
+	RestoreAliases map[string]string
+	// Secrets reads the restore targets kept in Secrets Manager; nil means
+	// they cannot be.
+	Secrets SecretFetcher
+	// StagingTarget is the database RefreshStaging replaces with the latest
+	// backup of StagingTier ("" means any tier), named as ResolveTarget
+	// takes it, once restored next to it and anonymized with MaskRules.
+	StagingTarget string
+	StagingTier   string
+	MaskRules     []MaskRule
 }
 
 // Handler runs backups against a bucket and database.
 type Handler struct {
-	s3            S3API
-	bucket        string
-	db            DatabaseConfig
-	retentionDays int
-	dump          Dumper
-	now           func() time.Time
+	s3             S3API
+	bucket         string
+	db             DatabaseConfig
+	dbSource       DatabaseSource
+	retention      RetentionPolicy
+	dump           Dumper
+	query          Querier
+	copyTable      TableCopier
+	restore        Restorer
+	dumpOpts       DumpOptions
+	notifier       Notifier
+	auditSample    int
+	auditFullMax   int64
+	encryption     EncryptionInfo
+	profile        string
+	conflictPolicy string
+	conflictDelay  time.Duration
+	conflictPoll   time.Duration
+	replicas       []Replica
+	snapshot       Snapshotter
+	compression    Compression
+	profileDump    map[string]DumpOptions
+	plans          map[string]Plan
+	tenants        TenantRegistry
+	throttle       DumpThrottle
+	referenceDays  int
+	latestPointer  string
+	cacheControl   string
+	keyLayout      string
+	streamUploads  bool
+	streamFallback int64
+	streamDump     StreamDumper
+	exemptions     []RetentionExemption
+	notifyWindow   time.Duration
+	serverID       string
+	hourly         bool
+	signer         ManifestSigner
+	limits         memoryLimits
+	migrations     []string
+	scratch        []string
+	globals        bool
+	rolePasswords  bool
+	dumpGlobals    GlobalsDumper
+	databases      []DatabaseConfig
+	discover       bool
+	databaseOrder  DatabaseOrder
+	rtoObjective   time.Duration
+	progressEvery  time.Duration
+	restoreTargets *regexp.Regexp
+	restoreChecks  []RestoreCheck
+	restoreJobs    int
+	restoreAliases map[string]string
+	secrets        SecretFetcher
+	stagingTarget  string
+	stagingTier    string
+	maskRules      []MaskRule
+	now            func() time.Time
 }
 
-// New builds a Handler from cfg, applying defaults for RetentionDays (7) and
-// Dump (PgDump).
+// New builds a Handler from cfg, applying defaults for RetentionDays (7),
+// RetentionHours (48), AuditSample (3), AuditFullMax (1 GiB), Dump (PgDump),
+// StreamDump (PgDumpTo), Query (Psql), Copy (PsqlCopy), Restore (PgRestore),
+// ConflictDelay (2 minutes), the tenant registry's Database (the database
+// backed up) and, when PGAPPNAME is unset, the database ApplicationName
+// ("go-postgres-s3-backup/<version>").
 func New(cfg Config) *Handler {
 	dump := cfg.Dump
 	if dump == nil {
 		dump = PgDump
 	}
+	query := cfg.Query
+	if query == nil {
+		query = Psql
+	}
+	streamDump := cfg.StreamDump
+	if streamDump == nil {
+		streamDump = PgDumpTo
+	}
+	dumpGlobals := cfg.DumpGlobals
+	if dumpGlobals == nil {
+		dumpGlobals = PgDumpAllGlobals
+	}
+	copyTable := cfg.Copy
+	if copyTable == nil {
+		copyTable = PsqlCopy
+	}
+	restore := cfg.Restore
+	if restore == nil {
+		restore = PgRestore
+	}
 	retention := cfg.RetentionDays
 	if retention <= 0 {
 		retention = 7
 	}
+	hourlyRetention := cfg.RetentionHours
+	if hourlyRetention <= 0 {
+		hourlyRetention = 48
+	}
+	auditSample := cfg.AuditSample
+	if auditSample <= 0 {
+		auditSample = 3
+	}
+	auditFullMax := cfg.AuditFullMax
+	if auditFullMax <= 0 {
+		auditFullMax = 1 << 30
+	}
+	conflictDelay := cfg.ConflictDelay
+	if conflictDelay <= 0 {
+		conflictDelay = 2 * time.Minute
+	}
+	progressEvery := cfg.RestoreProgressInterval
+	if progressEvery <= 0 {
+		progressEvery = defaultProgressInterval
+	}
+	db := cfg.Database
+	if _, set := os.LookupEnv("PGAPPNAME"); db.ApplicationName == "" && !set {
+		db.ApplicationName = DefaultApplicationName(cfg.Version)
+	}
+	tenants := cfg.Tenants
+	if tenants.Database.Host == "" {
+		tenants.Database = db
+	}
+	encryption := encryptionFor(cfg.KMSKeyID, cfg.SSECustomerKey)
+	RegisterSecret(db.Password, tenants.Database.Password, encryption.customerKey)
+	for _, other := range cfg.Databases {
+		RegisterSecret(other.Password)
+	}
 	return &Handler{
-		s3:            cfg.S3,
-		bucket:        cfg.Bucket,
-		db:            cfg.Database,
-		retentionDays: retention,
-		dump:          dump,
-		now:           time.Now,
+		s3:             cfg.S3,
+		bucket:         cfg.Bucket,
+		db:             db,
+		dbSource:       cfg.DatabaseSource,
+		retention:      RetentionPolicy{Hourly: hourlyRetention, Daily: retention, Monthly: cfg.RetentionMonths, Yearly: cfg.RetentionYears},
+		dump:           dump,
+		query:          query,
+		copyTable:      copyTable,
+		restore:        restore,
+		dumpOpts:       cfg.DumpOptions,
+		notifier:       cfg.Notify,
+		auditSample:    auditSample,
+		auditFullMax:   auditFullMax,
+		encryption:     encryption,
+		profile:        cfg.Profile,
+		conflictPolicy: cfg.ConflictPolicy,
+		conflictDelay:  conflictDelay,
+		conflictPoll:   15 * time.Second,
+		replicas:       cfg.Replicas,
+		snapshot:       cfg.Snapshot,
+		compression:    cfg.Compression,
+		profileDump:    cfg.ProfileDump,
+		plans:          cfg.Plans,
+		tenants:        tenants,
+		throttle:       cfg.Throttle,
+		referenceDays:  cfg.CompressionReferenceDays,
+		latestPointer:  cfg.LatestPointer,
+		cacheControl:   cfg.CacheControl,
+		keyLayout:      cfg.KeyLayout,
+		streamUploads:  cfg.StreamUploads,
+		streamFallback: cfg.StreamFallbackMax,
+		streamDump:     streamDump,
+		exemptions:     cfg.RetentionExemptions,
+		notifyWindow:   cfg.NotifyDedupWindow,
+		serverID:       cfg.ServerID,
+		hourly:         cfg.HourlyBackups,
+		signer:         cfg.ManifestSigner,
+		limits:         limitsFor(cfg.MemoryBudget),
+		migrations:     cfg.MigrationTables,
+		scratch:        cfg.ScratchSchemas,
+		globals:        cfg.BackupGlobals,
+		rolePasswords:  cfg.GlobalsRolePasswords,
+		dumpGlobals:    dumpGlobals,
+		databases:      cfg.Databases,
+		discover:       cfg.DiscoverDatabases,
+		databaseOrder:  cfg.DatabaseOrder,
+		rtoObjective:   cfg.RTOObjective,
+		progressEvery:  progressEvery,
+		restoreTargets: cfg.RestoreTargets,
+		restoreChecks:  cfg.RestoreChecks,
+		restoreJobs:    cfg.RestoreJobs,
+		restoreAliases: cfg.RestoreAliases,
+		secrets:        cfg.Secrets,
+		stagingTarget:  cfg.StagingTarget,
+		stagingTier:    cfg.StagingTier,
+		maskRules:      cfg.MaskRules,
+		now:            time.Now,
+	}
+}
+
+// tierPrefixes lists the key prefix of every backup tier.
+var tierPrefixes = []string{"hourly/", "daily/", "monthly/", "yearly/"}
+
+// isBackupKey reports whether key is a backup in some tier, at the bucket root
+// or under a profile prefix.
+func isBackupKey(key string) bool {
+	for _, tier := range tierPrefixes {
+		if strings.HasPrefix(key, tier) || strings.Contains(key, "/"+tier) {
+			return true
+		}
 	}
+	return false
+}
+
+// RunOptions configures a single backup run.
+type RunOptions struct {
+	Force           bool   // store today's backup even if it matches an older one
+	Profile         string // profile to run; "" means the Handler's default profile
+	ReplacePeriodic bool   // with Force, also overwrite this period's monthly and yearly backups
+	Prefix          string // prepended to the profile's key prefix, e.g. "databases/orders/"
+	// Labels are recorded in the Result and in the manifest of every backup
+	// the run stores (see Job).
+	Labels map[string]string
+	// ExcludeSchemas are left out of the dump in addition to those of the
+	// configuration and the profile.
+	ExcludeSchemas []string
 }
 
 // Result summarizes a single backup run.
 type Result struct {
-	Status     string `json:"status"`      // always "ok" on success
-	Action     string `json:"action"`      // "created" or "skipped"
-	Reason     string `json:"reason"`      // why the daily backup was created/skipped
-	Key        string `json:"key"`         // today's daily backup S3 key
-	Size       string `json:"size"`        // human-readable dump size (e.g. "12.34 MB")
-	SizeBytes  int    `json:"size_bytes"`  // size of the dump in bytes
-	DurationMs int64  `json:"duration_ms"` // wall-clock time of the run
+	Status      string              `json:"status"`                          // "ok", or "partial" when a replica or the snapshot failed
+	RunID       string              `json:"run_id"`                          // run identifier, also recorded in logs and object metadata
+	Profile     string              `json:"profile"`                         // profile the run used
+	Database    string              `json:"database,omitempty"`              // database named by the Job or RunDatabases, if the run was one
+	Labels      map[string]string   `json:"labels,omitempty"`                // labels of the run (see RunOptions)
+	Action      string              `json:"action"`                          // "created" or "skipped"
+	Reason      string              `json:"reason"`                          // why the daily backup was created/skipped
+	Key         string              `json:"key"`                             // S3 key of today's daily backup, or of this hour's with HourlyBackups
+	ManifestKey string              `json:"manifest_key,omitempty"`          // manifest of the daily backup (see Manifest)
+	Latest      string              `json:"latest,omitempty"`                // latest pointer updated to the daily backup (see Config.LatestPointer)
+	LatestErr   string              `json:"latest_error,omitempty"`          // why the latest pointer could not be updated
+	RefreshKey  string              `json:"refresh_key,omitempty"`           // materialized view refresh script, when view data was skipped
+	Migrations  string              `json:"migrations_key,omitempty"`        // migration state of the daily backup (see MigrationState)
+	Globals     string              `json:"globals_key,omitempty"`           // globals dump stored or matched by the run (see Config.BackupGlobals)
+	GlobalsErr  string              `json:"globals_error,omitempty"`         // why the globals could not be stored
+	Conflicts   []Conflict          `json:"conflicts,omitempty"`             // operations that made the run skip
+	Changed     string              `json:"source_changed,omitempty"`        // fingerprint of the previous backup, when taken from another database (see Fingerprint)
+	Replicas    []ReplicaResult     `json:"replicas,omitempty"`              // per-replica outcome, when backups were stored
+	Snapshot    string              `json:"snapshot,omitempty"`              // storage-level snapshot requested with the backups (see Snapshotter)
+	SnapshotErr string              `json:"snapshot_error,omitempty"`        // why the snapshot could not be requested
+	Compression string              `json:"compression,omitempty"`           // codec and level the backups were stored with, e.g. "zstd:3"
+	Reference   string              `json:"compression_reference,omitempty"` // dump the daily backup was compressed against
+	Size        string              `json:"size"`                            // human-readable dump size (e.g. "12.34 MB")
+	SizeBytes   int                 `json:"size_bytes"`                      // size of the dump in bytes
+	Phases      Phases              `json:"phases"`                          // where the run spent its time
+	S3          map[string]S3Counts `json:"s3,omitempty"`                    // S3 requests, retries and throttles by operation (see S3Tuning)
+	DurationMs  int64               `json:"duration_ms"`                     // wall-clock time of the run
 }
 
-// Run produces a dump and stores it. A normal run stores the daily backup only
-// when the dump differs from the most recent daily backup. When force is true
-// (a manual invocation) it stores today's backup even if it matches an older
-// one, but still skips rewriting today's file when that file is already
-// identical. Monthly and yearly backups are created when missing, and daily
-// backups older than the retention window are pruned.
-func (h *Handler) Run(ctx context.Context, force bool) (*Result, error) {
+// Run produces a dump and stores it under the selected profile. A normal run
+// stores the daily backup only when the dump differs from the most recent
+// daily backup. When opts.Force is true (a manual invocation) it stores
+// today's backup even if it matches an older one, but still skips rewriting
+// today's file when that file is already identical. With HourlyBackups what
+// is said here of the daily backup holds for this hour's backup, and the daily
+// one is created when missing.
+//
+// Monthly and yearly backups are created when missing, and backups older than
+// their tier's retention window are pruned (see RetentionPolicy). Monthly and
+// yearly backups are written once per period and never overwritten, unless
+// opts.ReplacePeriodic is set together with opts.Force; they are then
+// replaced even when today's daily backup is unchanged.
+//
+// Under a conflict policy the run is skipped, before dumping, while
+// conflicting operations such as migrations or VACUUM FULL are in progress.
+// With a DumpThrottle, the dump waits for a token of the database server
+// first. With a Snapshotter, a run that stores backups first requests a
+// database snapshot and records its identifier in their metadata and
+// manifests.
+//
+// When the dump skips materialized view data, a script that refreshes the
+// views is stored next to each backup (see refreshKey). Tables listed in the
+// dump's Slices are dumped in ranges after the main dump, each stored next to
+// every backup and listed in its manifest; a backup whose main dump and
+// slices all match the previous one is skipped like any other. Backups are
+// stored with the configured Compression, which under CompressionAuto is
+// chosen per run from what fits the time left. With CompressionReferenceDays
+// and zstd, the daily backup is compressed against a reference dump (see
+// useReference); should the reference fail, it is compressed on its own. With
+// StreamUploads the dump is streamed to S3 rather than held in memory (see
+// runStreamed), unless the run has table slices or replicas to write, which
+// need it in memory; under StreamFallbackMax, a small dump whose streamed
+// upload fails is dumped again and uploaded buffered.
+//
+// Every backup stored is also copied to the configured replicas. With a
+// LatestPointer, the pointer is moved to a newly stored daily backup. With
+// BackupGlobals, a run that is not skipped for a conflict then stores the
+// server's globals (see backupGlobals). A failed replica, snapshot, pointer
+// or globals backup makes the result "partial" without failing the run.
+//
+// The time of each phase of the run is logged and returned (see Phases), as
+// are the retries of its S3 requests (see S3Stats). A failed run is notified
+// as backup.failed, with the class and stage of the failure (see Failure).
+func (h *Handler) Run(ctx context.Context, opts RunOptions) (*Result, error) {
+	ctx, runID := startRun(ctx)
+	result, err := h.run(ctx, runID, opts)
+	if err != nil && h.retryRotated(ctx, err) {
+		result, err = h.run(ctx, runID, opts)
+	}
+	if err == nil && h.globals && len(result.Conflicts) == 0 {
+		h.storeGlobals(ctx, opts.Prefix, result)
+	}
+	if err != nil {
+		profile := cmp.Or(opts.Profile, h.profile, DefaultProfile)
+		fields := map[string]string{"profile": profile, "database": h.db.Database, "class": failureClass(err), "error": err.Error()}
+		if stage := failureStage(err); stage != "" {
+			fields["stage"] = stage
+		}
+		h.notify(ctx, Notification{
+			Event:   "backup.failed",
+			Message: fmt.Sprintf("Backup (profile %s) of database %s failed: %v", profile, h.db.Database, err),
+			Fields:  fields,
+		})
+	}
+	return result, err
+}
+
+// run is Run once the run has its identifier.
+func (h *Handler) run(ctx context.Context, runID string, opts RunOptions) (*Result, error) {
+	ctx, stats := withS3Stats(ctx)
 	start := h.now()
-	log.Println("Starting database backup...")
+	timer := h.startPhases(start)
+	if opts.ReplacePeriodic && !opts.Force {
+		return nil, invalidInput(errors.New("replacing monthly and yearly backups requires a forced run"))
+	}
+	name := opts.Profile
+	if name == "" {
+		name = h.profile
+	}
+	profile, err := LookupProfile(name)
+	if err != nil {
+		return nil, invalidInput(err)
+	}
+	profile.Prefix = opts.Prefix + profile.Prefix
+	if len(opts.Labels) > 0 {
+		ctx = withLabels(ctx, opts.Labels)
+	}
+	logf(ctx, "Starting database backup (profile %s)...", profile.Name)
+
+	if conflicts := h.awaitNoConflicts(ctx); len(conflicts) > 0 {
+		result := &Result{
+			Status:    "ok",
+			RunID:     runID,
+			Profile:   profile.Name,
+			Labels:    opts.Labels,
+			Action:    "skipped",
+			Reason:    "conflicting operation in progress",
+			Conflicts: conflicts,
+		}
+		h.notify(ctx, Notification{
+			Event:   "backup.skipped",
+			Message: fmt.Sprintf("Backup (profile %s) skipped: %d conflicting operation(s), first %s", profile.Name, len(conflicts), conflicts[0]),
+			Fields:  map[string]string{"profile": profile.Name, "reason": result.Reason},
+		})
+		timer.done(phaseConnect)
+		result.Phases = timer.finish(ctx)
+		result.S3 = stats.counts(ctx)
+		result.DurationMs = h.elapsed(start)
+		return result, nil
+	}
+
+	ctx, changed := h.checkFingerprint(ctx, profile)
+	dumpOpts := h.dumpOpts.merge(profile.Dump).merge(h.profileDump[profile.Name]).merge(DumpOptions{ExcludeSchemas: opts.ExcludeSchemas})
+	scratch, err := h.scratchSchemas(ctx)
+	if err != nil {
+		return nil, failedIn(phaseConnect, fmt.Errorf("failed to list scratch schemas: %w", err))
+	}
+	if len(scratch) > 0 {
+		logf(ctx, "Skipping scratch schemas: %s", strings.Join(scratch, ", "))
+		dumpOpts.ExcludeSchemas = append(dumpOpts.ExcludeSchemas, scratch...)
+	}
+	var refresh []byte
+	if dumpOpts.SkipMatviewData && !dumpOpts.SchemaOnly {
+		views, err := h.materializedViews(ctx, dumpOpts.ExcludeSchemas)
+		if err != nil {
+			return nil, failedIn(phaseConnect, fmt.Errorf("failed to list materialized views: %w", err))
+		}
+		if len(views) > 0 {
+			logf(ctx, "Skipping data of %d materialized views", len(views))
+			dumpOpts.ExcludeTableData = append(dumpOpts.ExcludeTableData, views...)
+			refresh = refreshScript(views)
+		}
+	}
+
+	var plans []slicePlan
+	if len(dumpOpts.Slices) > 0 && !dumpOpts.SchemaOnly {
+		if plans, err = h.planSlices(ctx, dumpOpts); err != nil {
+			return nil, failedIn(phaseConnect, fmt.Errorf("failed to plan table slices: %w", err))
+		}
+		for _, p := range plans {
+			dumpOpts.ExcludeTableData = append(dumpOpts.ExcludeTableData, p.table)
+		}
+	}
+
+	if state, err := h.readMigrations(ctx); err != nil {
+		logf(ctx, "Warning: %v; storing backups without their migration state", err)
+	} else if state != nil {
+		ctx = withMigrations(ctx, state)
+	}
 
-	raw, err := h.dump(ctx, h.db)
+	// The dump and the slices are read under one token of the throttle.
+	release := func() {}
+	if h.throttle != nil {
+		if release, err = h.throttle(ctx, throttleHost(h.db)); err != nil {
+			return nil, failedIn(phaseConnect, err)
+		}
+	}
+	release = sync.OnceFunc(release)
+	defer release()
+	timer.done(phaseConnect)
+	stream := h.streamUploads
+	switch {
+	case stream && len(plans) > 0:
+		logf(ctx, "Table slices need the dump in memory; uploading this run's dump buffered")
+		stream = false
+	case stream && len(h.replicas) > 0:
+		logf(ctx, "Replicas need the dump in memory; uploading this run's dump buffered")
+		stream = false
+	}
+	if stream {
+		result, err := h.runStreamed(ctx, runID, streamedRun{
+			profile:  profile,
+			opts:     opts,
+			dumpOpts: dumpOpts,
+			refresh:  refresh,
+			changed:  changed,
+			plans:    plans,
+			timer:    timer,
+			stats:    stats,
+			start:    start,
+			release:  release,
+		})
+		if !errors.Is(err, errStreamFallback) {
+			return result, err
+		}
+		logf(ctx, "Warning: %v; retrying with a buffered upload", err)
+	}
+
+	var filtered time.Duration
+	data, err := h.dump(withFilterTime(ctx, &filtered), h.db, dumpOpts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create backup: %w", err)
+		return nil, failedIn(phaseDump, fmt.Errorf("failed to create backup: %w", err))
+	}
+	defer putBuffer(data)
+	timer.done(phaseDump)
+	timer.move(filtered, phaseDump, phaseFilter)
+	if isArchive(data) {
+		clearArchiveTimestamp(data)
+	}
+	timer.done(phaseFilter)
+	if !dumpOpts.SchemaOnly && definesForeignTables(data) {
+		h.reportForeignTables(ctx, dumpOpts)
 	}
-	data := removeTimestampComments(raw)
 	sum := checksum(data)
-	log.Printf("Backup created, size: %d bytes", len(data))
+	timer.done(phaseHash)
+	logf(ctx, "Backup created, size: %d bytes", len(data))
+	if share := h.limits.inMemoryShare(); share > 0 && int64(len(data)) > share {
+		logf(ctx, "Warning: the dump (%s) takes more than a third of the memory budget (%s); set STREAM_UPLOADS to keep it out of memory", HumanizeSize(len(data)), HumanizeSize(int(h.limits.budget)))
+	}
 
 	now := h.now()
-	dailyKey := fmt.Sprintf("daily/%s-backup.sql", now.Format("2006-01-02"))
+	dailyKey := h.backupKey(profile.Prefix, h.runTier(), now)
 	result := &Result{
 		Status:    "ok",
+		RunID:     runID,
+		Profile:   profile.Name,
+		Labels:    opts.Labels,
+		Changed:   changed,
 		Key:       dailyKey,
 		Size:      HumanizeSize(len(data)),
 		SizeBytes: len(data),
 	}
 
-	upload, reason := h.decideDailyUpload(ctx, dailyKey, sum, force)
+	// Slices are stored next to today's backup as they are dumped, before
+	// it is known whether the backup itself is.
+	var slices []Slice
+	if len(plans) > 0 {
+		if slices, err = h.dumpSlices(ctx, dailyKey, plans, dumpOpts.SliceJobs); err != nil {
+			return nil, failedIn(phaseDump, err)
+		}
+	}
+	release()
+	timer.done(phaseDump)
+
+	upload, reason, matched := h.decideDailyUpload(ctx, profile.Prefix, dailyKey, data, sum, slices, opts.Force)
 	result.Reason = reason
+	timer.done(phaseHash)
+	// Unless they overwrote today's identical ones, skipped slices duplicate
+	// an older backup's and are removed once monthly and yearly copies exist.
+	redundant := !upload && plainKey(matched) != dailyKey
 	if !upload {
-		log.Printf("Skipping daily backup upload: %s", reason)
+		logf(ctx, "Skipping %s backup upload: %s", h.runTier(), reason)
 		result.Action = "skipped"
-		result.DurationMs = h.elapsed(start)
-		return result, nil
+		if !opts.ReplacePeriodic {
+			// A new month or year still gets its backup, copied from
+			// the identical one.
+			periodic, err := h.copyPeriodicBackups(ctx, profile, now, matched, data, sum, refresh, slices)
+			if err != nil {
+				return nil, failedIn(phaseUpload, err)
+			}
+			timer.done(phaseUpload)
+			if redundant {
+				h.deleteSlices(ctx, slices)
+			}
+			if len(periodic) > 0 && len(h.replicas) > 0 {
+				result.Replicas = h.replicate(ctx, periodic, profile.Name, data, sum, refresh, slicesFor(periodic[0], slices))
+				for _, r := range result.Replicas {
+					if r.Status != ReplicaOK {
+						result.Status = "partial"
+					}
+				}
+				timer.done(phaseUpload)
+			}
+			timer.done(phaseCleanup)
+			result.Phases = timer.finish(ctx)
+			result.S3 = stats.counts(ctx)
+			result.DurationMs = h.elapsed(start)
+			return result, nil
+		}
+	}
+
+	if h.snapshot != nil {
+		if id, err := h.takeSnapshot(ctx, profile.Name, now); err != nil {
+			result.Status, result.SnapshotErr = "partial", err.Error()
+		} else {
+			result.Snapshot = id
+			ctx = withSnapshotID(ctx, id)
+		}
+	}
+	timer.done(phaseUpload)
+
+	var compressed *compressedDump
+	if c := h.chooseCompression(ctx, data); c.enabled() {
+		result.Compression = c.String()
+		compressed = &compressedDump{Compression: c, window: h.limits.zstdWindow, data: data, now: h.now}
+		defer compressed.release()
+		ctx = withCompressedDump(ctx, compressed)
+		if upload && h.referenceDays > 0 && c.Codec == CompressionZstd && len(data) <= h.limits.maxReference() {
+			if err := h.useReference(ctx, compressed, profile.Prefix, dailyKey, data, sum); err != nil {
+				logf(ctx, "Warning: compressing without a reference: %v", err)
+			} else {
+				result.Reference = compressed.ref.key
+			}
+		}
+		// A gzip-compressed backup is named "*.sql.gz".
+		dailyKey = storedKey(dailyKey, c)
+		result.Key = dailyKey
 	}
+	timer.done(phaseCompress)
 
-	if err := h.upload(ctx, dailyKey, data, sum); err != nil {
-		return nil, fmt.Errorf("failed to upload daily backup: %w", err)
+	var written []string
+	if upload {
+		if err := h.checkCollision(ctx, dailyKey, sum); err != nil {
+			return nil, failedIn(phaseUpload, err)
+		}
+		if err := h.upload(ctx, dailyKey, data, sum); err != nil {
+			return nil, failedIn(phaseUpload, fmt.Errorf("failed to upload %s backup: %w", h.runTier(), err))
+		}
+		logf(ctx, "%s backup uploaded: %s", tierTitle(h.runTier()), dailyKey)
+		h.removeRenamed(ctx, dailyKey)
+		result.Action = "created"
+		if err := h.storeSidecars(ctx, dailyKey, profile.Name, data, sum, refresh, slices); err != nil {
+			return nil, failedIn(phaseUpload, err)
+		}
+		result.ManifestKey = manifestKey(dailyKey)
+		if refresh != nil {
+			result.RefreshKey = refreshKey(dailyKey)
+		}
+		if migrationsFrom(ctx) != nil {
+			result.Migrations = migrationsKey(dailyKey)
+		}
+		if pointer, err := h.updateLatest(ctx, profile.Prefix, dailyKey, int64(len(data)), sum); err != nil {
+			logf(ctx, "Warning: %v", err)
+			result.Status, result.LatestErr = "partial", err.Error()
+		} else {
+			result.Latest = pointer
+		}
+		written = append(written, dailyKey)
 	}
-	log.Printf("Daily backup uploaded: %s", dailyKey)
-	result.Action = "created"
 
-	if err := h.createPeriodicBackups(ctx, now, data, sum); err != nil {
-		return nil, err
+	periodic, err := h.createPeriodicBackups(ctx, profile, now, data, sum, refresh, slices, opts.ReplacePeriodic)
+	if err != nil {
+		return nil, failedIn(phaseUpload, err)
+	}
+	if redundant && len(periodic) > 0 {
+		timer.done(phaseUpload)
+		h.deleteSlices(ctx, slices)
+		slices = slicesFor(periodic[0], slices) // the copies to replicate from
+		timer.done(phaseCleanup)
+	}
+	written = append(written, periodic...)
+	if len(h.replicas) > 0 {
+		result.Replicas = h.replicate(ctx, written, profile.Name, data, sum, refresh, slices)
+		for _, r := range result.Replicas {
+			if r.Status != ReplicaOK {
+				result.Status = "partial"
+			}
+		}
+	}
+	timer.done(phaseUpload)
+	if compressed != nil {
+		timer.move(compressed.took, phaseUpload, phaseCompress)
 	}
 
-	if err := h.cleanupOldDailyBackups(ctx); err != nil {
-		log.Printf("Warning: failed to clean up old daily backups: %v", err)
+	if _, err := h.applyRetention(ctx, profile.Prefix, h.profileRetention(profile), now, false); err != nil {
+		logf(ctx, "Warning: failed to clean up old backups: %v", err)
 	}
+	timer.done(phaseCleanup)
 
-	log.Println("Backup process completed successfully")
+	logf(ctx, "Backup process completed successfully")
+	result.Phases = timer.finish(ctx)
+	result.S3 = stats.counts(ctx)
 	result.DurationMs = h.elapsed(start)
 	return result, nil
 }
 
 // decideDailyUpload determines whether today's daily backup should be written
-// and why. A normal run stores it only when the dump differs from the most
-// recent daily backup; a forced run stores it unless today's file is already
-// identical.
-func (h *Handler) decideDailyUpload(ctx context.Context, dailyKey, sum string, force bool) (upload bool, reason string) {
-	mostRecent, err := h.mostRecentBackup(ctx, "daily/")
+// and why. A normal run stores it only when the dump or its slices differ from
+// the most recent daily backup under prefix; a forced run stores it unless
+// today's file, under either name (see findBackup), is already identical.
+// When it is not written, matched is the key of the identical backup.
+func (h *Handler) decideDailyUpload(ctx context.Context, prefix, dailyKey string, data []byte, sum string, slices []Slice, force bool) (upload bool, reason, matched string) {
+	mostRecent, err := h.mostRecentBackup(ctx, h.runTierPrefix(prefix))
 	if err != nil {
-		log.Printf("Warning: couldn't find most recent backup: %v", err)
+		logf(ctx, "Warning: couldn't find most recent backup: %v", err)
 	}
 
-	contentChanged := mostRecent == "" || !h.objectMatches(ctx, mostRecent, sum)
+	contentChanged := mostRecent == "" || !h.objectMatches(ctx, mostRecent, data, sum) || !h.slicesMatch(ctx, mostRecent, slices)
 	if contentChanged {
-		return true, "content changed"
+		return true, "content changed", ""
 	}
+	if !force {
+		return false, "unchanged", mostRecent
+	}
+	today, err := h.findBackup(ctx, dailyKey)
 	switch {
-	case !force:
-		return false, "unchanged"
-	case h.objectMatches(ctx, dailyKey, sum):
-		return false, "today's backup already identical"
-	default:
-		return true, "forced; matched an older backup"
+	case err != nil:
+		logf(ctx, "Warning: couldn't find today's backup: %v", err)
+	case today != "" && h.objectMatches(ctx, today, data, sum) && h.slicesMatch(ctx, today, slices):
+		return false, "today's backup already identical", today
 	}
+	return true, "forced; matched an older backup", ""
 }
 
-// createPeriodicBackups creates the monthly and yearly backups for now if they
-// do not already exist.
-func (h *Handler) createPeriodicBackups(ctx context.Context, now time.Time, data []byte, sum string) error {
-	monthlyKey := fmt.Sprintf("monthly/%s-backup.sql", now.Format("2006-01"))
-	if created, err := h.uploadIfMissing(ctx, monthlyKey, data, sum); err != nil {
-		return err
-	} else if created {
-		log.Printf("Monthly backup created: %s", monthlyKey)
+// createPeriodicBackups creates the monthly and yearly backups of profile for
+// now if they do not already exist, or overwrites them when replace is set,
+// each with its sidecars (see storeSidecars) and copies of slices. It returns
+// the keys it wrote.
+func (h *Handler) createPeriodicBackups(ctx context.Context, profile Profile, now time.Time, data []byte, sum string, refresh []byte, slices []Slice, replace bool) ([]string, error) {
+	var c Compression // of the run's dump, which names the keys
+	if d := compressedDumpFrom(ctx); d != nil {
+		c = d.Compression
+	}
+	var written []string
+	for _, tier := range h.periodicTiers() {
+		key := storedKey(h.backupKey(profile.Prefix, strings.ToLower(tier), now), c)
+		if replace {
+			if err := h.checkCollision(ctx, key, sum); err != nil {
+				return nil, err
+			}
+			if err := h.upload(ctx, key, data, sum); err != nil {
+				return nil, fmt.Errorf("failed to upload %s: %w", key, err)
+			}
+			logf(ctx, "%s backup replaced: %s", tier, key)
+			h.removeRenamed(ctx, key)
+		} else {
+			created, err := h.uploadIfMissing(ctx, key, data, sum)
+			if err != nil {
+				return nil, err
+			}
+			if !created {
+				continue
+			}
+			logf(ctx, "%s backup created: %s", tier, key)
+		}
+		copied, err := h.copySlices(ctx, key, slices)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.storeSidecars(ctx, key, profile.Name, data, sum, refresh, copied); err != nil {
+			return nil, err
+		}
+		written = append(written, key)
 	}
+	return written, nil
+}
 
-	yearlyKey := fmt.Sprintf("yearly/%s-backup.sql", now.Format("2006"))
-	if created, err := h.uploadIfMissing(ctx, yearlyKey, data, sum); err != nil {
+// copyPeriodicBackups creates the monthly and yearly backups of profile for
+// now that do not exist yet as server-side copies of source, the stored
+// backup found identical to the run's dump data, rather than uploading data
+// again; each gets its sidecars and copies of slices, as with
+// createPeriodicBackups. A source compressed against a reference is not
+// copied, since the reference is deleted once no daily backup uses it: data
+// is uploaded instead, compressed on its own. It returns the keys it wrote.
+func (h *Handler) copyPeriodicBackups(ctx context.Context, profile Profile, now time.Time, source string, data []byte, sum string, refresh []byte, slices []Slice) ([]string, error) {
+	var head *s3.HeadObjectOutput
+	var written []string
+	for _, tier := range h.periodicTiers() {
+		key := h.backupKey(profile.Prefix, strings.ToLower(tier), now)
+		existing, err := h.findBackup(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %w", key, err)
+		}
+		if existing != "" {
+			continue
+		}
+		if head == nil {
+			if head, err = h.headObject(ctx, source); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", source, err)
+			}
+		}
+		// A copy is named for the compression of its source.
+		key = storedKey(key, compressionFromMetadata(head.Metadata))
+		if err := h.checkCollision(ctx, key, sum); err != nil {
+			return nil, err
+		}
+		// Each tier's compressed dump is released before the next one's.
+		store := func() error {
+			storeCtx := ctx
+			if head.Metadata["compression-reference"] != "" {
+				d := &compressedDump{Compression: referenceCompression, window: h.limits.zstdWindow, data: data}
+				defer d.release()
+				storeCtx = withCompressedDump(ctx, d)
+				if err := h.upload(storeCtx, key, data, sum); err != nil {
+					return fmt.Errorf("failed to upload %s: %w", key, err)
+				}
+				logf(ctx, "%s backup created: %s", tier, key)
+			} else {
+				if err := h.copyBackup(ctx, source, key, head); err != nil {
+					return fmt.Errorf("failed to copy %s to %s: %w", source, key, err)
+				}
+				// The manifest records the compression of the copy.
+				storeCtx = withCompressedDump(ctx, &compressedDump{Compression: compressionFromMetadata(head.Metadata), data: data})
+				logf(ctx, "%s backup copied from %s: %s", tier, source, key)
+			}
+			copied, err := h.copySlices(ctx, key, slices)
+			if err != nil {
+				return err
+			}
+			return h.storeSidecars(storeCtx, key, profile.Name, data, sum, refresh, copied)
+		}
+		if err := store(); err != nil {
+			return nil, err
+		}
+		written = append(written, key)
+	}
+	return written, nil
+}
+
+// storeSidecars writes the files kept next to the backup just uploaded to key:
+// its manifest, listing the slices already stored with it, when refresh is
+// set its materialized view refresh script, and the run's migration state.
+func (h *Handler) storeSidecars(ctx context.Context, key, profile string, data []byte, sum string, refresh []byte, slices []Slice) error {
+	if err := h.writeManifest(ctx, key, profile, data, sum, slices); err != nil {
+		return err
+	}
+	if err := h.uploadRefresh(ctx, key, refresh); err != nil {
 		return err
-	} else if created {
-		log.Printf("Yearly backup created: %s", yearlyKey)
 	}
-	return nil
+	return h.uploadMigrations(ctx, key)
 }
 
 func (h *Handler) elapsed(start time.Time) int64 {
@@ -1,10 +1,13 @@
 package backup
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"testing"
 	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
 )
 
 const testDate = "2026-05-27"
@@ -19,6 +22,7 @@ func runHandler(t *testing.T, f *fakeS3, dump Dumper, retention int) *Handler {
 		Database:      DatabaseConfig{Host: "localhost"},
 		RetentionDays: retention,
 		Dump:          dump,
+		Query:         staticQuery(nil),
 	})
 	h.now = fixedClock(testNow)
 	return h
@@ -28,7 +32,7 @@ func TestRunCreatesAllBackups(t *testing.T) {
 	f := newFakeS3()
 	h := runHandler(t, f, staticDump([]byte("CREATE TABLE foo;")), 7)
 
-	res, err := h.Run(context.Background(), false)
+	res, err := h.Run(context.Background(), RunOptions{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -55,12 +59,15 @@ func TestRunCreatesAllBackups(t *testing.T) {
 func TestRunScheduledSkipsUnchanged(t *testing.T) {
 	body := []byte("unchanged")
 	f := newFakeS3()
-	// Seed today's daily with identical content as the most recent backup.
+	// Seed today's daily with identical content as the most recent backup,
+	// and this period's monthly and yearly backups.
 	f.seed("daily/"+testDate+"-backup.sql", body, testNow.Add(-time.Hour))
+	f.seed("monthly/2026-05-backup.sql", body, testNow.Add(-time.Hour))
+	f.seed("yearly/2026-backup.sql", body, testNow.Add(-time.Hour))
 	h := runHandler(t, f, staticDump(body), 7)
 	before := f.puts
 
-	res, err := h.Run(context.Background(), false)
+	res, err := h.Run(context.Background(), RunOptions{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -72,6 +79,44 @@ func TestRunScheduledSkipsUnchanged(t *testing.T) {
 	}
 }
 
+func TestRunUnchangedCopiesNewPeriod(t *testing.T) {
+	body := []byte("unchanged since last month")
+	f := newFakeS3()
+	// The dump matches April's last daily backup; May has no monthly yet.
+	old := "daily/2026-04-30-backup.sql"
+	f.seed(old, body, testNow.Add(-27*24*time.Hour))
+	f.objects[old].metadata = map[string]string{"sha256": checksum(body), "compression": "gzip", "run-id": "april"}
+	f.seed("yearly/2026-backup.sql", body, testNow.Add(-27*24*time.Hour))
+	h := runHandler(t, f, staticDump(body), 30)
+	before := f.puts
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Action != "skipped" || res.Reason != "unchanged" {
+		t.Errorf("action=%q reason=%q, want skipped/unchanged", res.Action, res.Reason)
+	}
+	// Copied from a gzip-compressed backup, it is named "*.sql.gz".
+	monthly := f.objects["monthly/2026-05-backup.sql.gz"]
+	if monthly == nil || !bytes.Equal(monthly.body, body) {
+		t.Fatal("expected May's monthly backup to be created")
+	}
+	if f.copies != 1 || aws.ToString(f.lastCopy.CopySource) != "test-bucket/"+old {
+		t.Errorf("%d copies, last from %v; want the monthly copied from %s", f.copies, f.lastCopy, old)
+	}
+	if monthly.metadata["compression"] != "gzip" || monthly.metadata["run-id"] != res.RunID {
+		t.Errorf("monthly metadata = %v, want the source's compression and this run", monthly.metadata)
+	}
+	// Only its manifest is uploaded.
+	if f.puts-before != 1 || f.objects["monthly/2026-05-backup.manifest.json"] == nil {
+		t.Errorf("%d uploads, want only the monthly manifest", f.puts-before)
+	}
+	if _, ok := f.objects["daily/"+testDate+"-backup.sql"]; ok {
+		t.Error("an unchanged dump should not store today's daily backup")
+	}
+}
+
 func TestRunForcedStoresWhenTodayMissing(t *testing.T) {
 	body := []byte("same-as-old")
 	f := newFakeS3()
@@ -79,7 +124,7 @@ func TestRunForcedStoresWhenTodayMissing(t *testing.T) {
 	f.seed("daily/2026-05-20-backup.sql", body, testNow.Add(-72*time.Hour))
 	h := runHandler(t, f, staticDump(body), 30)
 
-	res, err := h.Run(context.Background(), true)
+	res, err := h.Run(context.Background(), RunOptions{Force: true})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -95,10 +140,12 @@ func TestRunForcedSkipsWhenTodayIdentical(t *testing.T) {
 	body := []byte("identical-today")
 	f := newFakeS3()
 	f.seed("daily/"+testDate+"-backup.sql", body, testNow)
+	f.seed("monthly/2026-05-backup.sql", body, testNow)
+	f.seed("yearly/2026-backup.sql", body, testNow)
 	h := runHandler(t, f, staticDump(body), 7)
 	before := f.puts
 
-	res, err := h.Run(context.Background(), true)
+	res, err := h.Run(context.Background(), RunOptions{Force: true})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -116,7 +163,7 @@ func TestRunForcedContentChanged(t *testing.T) {
 	f.seed("daily/"+testDate+"-backup.sql", []byte("old-content"), testNow.Add(-time.Hour))
 	h := runHandler(t, f, staticDump([]byte("new-content")), 7)
 
-	res, err := h.Run(context.Background(), true)
+	res, err := h.Run(context.Background(), RunOptions{Force: true})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -132,7 +179,7 @@ func TestRunDoesNotRecreatePeriodicBackups(t *testing.T) {
 	f.seed("yearly/2026-backup.sql", []byte("OLD-YEARLY"), testNow.Add(-time.Hour))
 	h := runHandler(t, f, staticDump([]byte("fresh-daily")), 7)
 
-	if _, err := h.Run(context.Background(), false); err != nil {
+	if _, err := h.Run(context.Background(), RunOptions{}); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if got := string(f.objects["monthly/2026-05-backup.sql"].body); got != "OLD-MONTHLY" {
@@ -143,6 +190,36 @@ func TestRunDoesNotRecreatePeriodicBackups(t *testing.T) {
 	}
 }
 
+func TestRunReplacesPeriodicBackupsOnlyWhenAsked(t *testing.T) {
+	f := newFakeS3()
+	f.seed("monthly/2026-05-backup.sql", []byte("OLD-MONTHLY"), testNow.Add(-time.Hour))
+	f.seed("yearly/2026-backup.sql", []byte("OLD-YEARLY"), testNow.Add(-time.Hour))
+	h := runHandler(t, f, staticDump([]byte("fresh-daily")), 7)
+	ctx := context.Background()
+
+	if _, err := h.Run(ctx, RunOptions{ReplacePeriodic: true}); err == nil {
+		t.Fatal("expected ReplacePeriodic without Force to be refused")
+	}
+	if _, err := h.Run(ctx, RunOptions{Force: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := string(f.objects["monthly/2026-05-backup.sql"].body); got != "OLD-MONTHLY" {
+		t.Errorf("forced run overwrote the monthly backup: %q", got)
+	}
+
+	if _, err := h.Run(ctx, RunOptions{Force: true, ReplacePeriodic: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, key := range []string{"monthly/2026-05-backup.sql", "yearly/2026-backup.sql"} {
+		if got := string(f.objects[key].body); got != "fresh-daily" {
+			t.Errorf("%s = %q, want the replacement", key, got)
+		}
+		if _, ok := f.objects[manifestKey(key)]; !ok {
+			t.Errorf("%s: manifest not rewritten", key)
+		}
+	}
+}
+
 func TestRunCleansUpOldDailyBackups(t *testing.T) {
 	f := newFakeS3()
 	f.seed("daily/2026-05-01-backup.sql", []byte("old"), testNow.Add(-100*time.Hour))   // before cutoff -> deleted
@@ -150,7 +227,7 @@ func TestRunCleansUpOldDailyBackups(t *testing.T) {
 	f.seed("daily/not-a-date-backup.sql", []byte("weird"), testNow.Add(-24*time.Hour))  // unparseable -> kept
 	h := runHandler(t, f, staticDump([]byte("fresh")), 7)
 
-	if _, err := h.Run(context.Background(), false); err != nil {
+	if _, err := h.Run(context.Background(), RunOptions{}); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if _, ok := f.objects["daily/2026-05-01-backup.sql"]; ok {
@@ -164,9 +241,47 @@ func TestRunCleansUpOldDailyBackups(t *testing.T) {
 	}
 }
 
+func TestRunHourly(t *testing.T) {
+	f := newFakeS3()
+	f.seed("hourly/2026-05-25T09-backup.sql", []byte("old"), testNow.Add(-51*time.Hour))    // before cutoff -> deleted
+	f.seed("hourly/2026-05-25T13-backup.sql", []byte("recent"), testNow.Add(-47*time.Hour)) // within 48 hours -> kept
+	h := runHandler(t, f, staticDump([]byte("noon")), 7)
+	h.hourly = true
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Key != "hourly/2026-05-27T12-backup.sql" || res.Action != "created" {
+		t.Errorf("key=%q action=%q, want this hour's backup created", res.Key, res.Action)
+	}
+	for _, key := range []string{res.Key, "daily/" + testDate + "-backup.sql", "monthly/2026-05-backup.sql", "yearly/2026-backup.sql", manifestKey("daily/" + testDate + "-backup.sql")} {
+		if _, ok := f.objects[key]; !ok {
+			t.Errorf("expected object %q to be created", key)
+		}
+	}
+	if _, ok := f.objects["hourly/2026-05-25T09-backup.sql"]; ok {
+		t.Error("expected the hourly backup older than 48 hours to be deleted")
+	}
+	if _, ok := f.objects["hourly/2026-05-25T13-backup.sql"]; !ok {
+		t.Error("expected the recent hourly backup to be kept")
+	}
+
+	// An hour later a changed dump gets its own key; today's daily backup
+	// keeps the first one.
+	h.now = fixedClock(testNow.Add(time.Hour))
+	h.dump = staticDump([]byte("one o'clock"))
+	if res, err = h.Run(context.Background(), RunOptions{}); err != nil || res.Key != "hourly/2026-05-27T13-backup.sql" {
+		t.Fatalf("second run = %+v, %v", res, err)
+	}
+	if got := string(f.objects["daily/"+testDate+"-backup.sql"].body); got != "noon" {
+		t.Errorf("daily backup = %q, want the first run's", got)
+	}
+}
+
 func TestRunDumpError(t *testing.T) {
 	h := runHandler(t, newFakeS3(), failingDump(errors.New("pg_dump exploded")), 7)
-	if _, err := h.Run(context.Background(), false); err == nil {
+	if _, err := h.Run(context.Background(), RunOptions{}); err == nil {
 		t.Fatal("expected error when dump fails, got nil")
 	}
 }
@@ -175,7 +290,7 @@ func TestRunUploadError(t *testing.T) {
 	f := newFakeS3()
 	f.putErr = errors.New("S3 down")
 	h := runHandler(t, f, staticDump([]byte("data")), 7)
-	if _, err := h.Run(context.Background(), false); err == nil {
+	if _, err := h.Run(context.Background(), RunOptions{}); err == nil {
 		t.Fatal("expected error when upload fails, got nil")
 	}
 }
@@ -186,7 +301,7 @@ func TestRunListErrorStillUploads(t *testing.T) {
 	h := runHandler(t, f, staticDump([]byte("data")), 7)
 
 	// A failing list is treated as "no prior backup", so the run proceeds.
-	res, err := h.Run(context.Background(), false)
+	res, err := h.Run(context.Background(), RunOptions{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -202,7 +317,7 @@ func TestRunPeriodicCheckError(t *testing.T) {
 	f.headErr = errors.New("AccessDenied")
 	h := runHandler(t, f, staticDump([]byte("data")), 7)
 
-	if _, err := h.Run(context.Background(), false); err == nil {
+	if _, err := h.Run(context.Background(), RunOptions{}); err == nil {
 		t.Fatal("expected error from periodic backup check, got nil")
 	}
 }
@@ -214,7 +329,7 @@ func TestRunCleanupDeleteErrorIsNonFatal(t *testing.T) {
 	h := runHandler(t, f, staticDump([]byte("fresh")), 7)
 
 	// A delete failure during cleanup is logged but must not fail the run.
-	res, err := h.Run(context.Background(), false)
+	res, err := h.Run(context.Background(), RunOptions{})
 	if err != nil {
 		t.Fatalf("cleanup delete error should be non-fatal, got: %v", err)
 	}
@@ -228,8 +343,8 @@ func TestRunCleanupDeleteErrorIsNonFatal(t *testing.T) {
 
 func TestNewAppliesDefaults(t *testing.T) {
 	h := New(Config{S3: newFakeS3(), Bucket: "b"})
-	if h.retentionDays != 7 {
-		t.Errorf("retentionDays = %d, want default 7", h.retentionDays)
+	if h.retention.Daily != 7 {
+		t.Errorf("daily retention = %d, want default 7", h.retention.Daily)
 	}
 	if h.dump == nil {
 		t.Error("dump should default to PgDump, got nil")
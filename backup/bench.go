@@ -0,0 +1,184 @@
+package backup
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// benchSchema is the schema Bench fills with synthetic data. Bench owns it:
+// its table is dropped and recreated by every benchmark.
+const benchSchema = "backup_bench"
+
+// benchPrefix holds the backups of benchmarks, one directory per run ID.
+const benchPrefix = "bench/"
+
+// benchRowSize is about what a row of the synthetic table takes in a plain
+// dump, from which Bench derives the row count of a size.
+const benchRowSize = 170
+
+// benchSize is the size of a benchmark that names none.
+const benchSize = 100 << 20
+
+// benchBatchRows is how many rows one INSERT of Bench generates.
+const benchBatchRows = 500_000
+
+// benchCreate creates the synthetic table; benchInsert fills rows %d to %d
+// of it. Each row holds an ID, a timestamp and 128 hex digits, about as
+// compressible as typical table data.
+const (
+	benchCreate = `CREATE SCHEMA IF NOT EXISTS ` + benchSchema + `;
+DROP TABLE IF EXISTS ` + benchSchema + `.events;
+CREATE TABLE ` + benchSchema + `.events (id bigint PRIMARY KEY, created_at timestamptz NOT NULL, payload text NOT NULL)`
+	benchInsert = `INSERT INTO ` + benchSchema + `.events
+SELECT g, timestamptz '2026-01-01' + g * interval '1 second',
+       md5(g::text) || md5((g + 1)::text) || md5((g + 2)::text) || md5((g + 3)::text)
+FROM generate_series(%d, %d) g`
+)
+
+// BenchOptions controls a benchmark (see Handler.Bench).
+type BenchOptions struct {
+	Size int64 // approximate size of the synthetic data, as dumped, in bytes; 0 means 100 MiB
+	Keep bool  // keep the synthetic schema and the backups of the benchmark
+}
+
+// BenchResult reports a benchmark.
+type BenchResult struct {
+	RunID      string       `json:"run_id"`
+	Schema     string       `json:"schema"`                  // schema holding the synthetic data
+	Rows       int64        `json:"rows"`                    // rows generated
+	GenerateMs int64        `json:"generate_ms"`             // time spent generating them, not part of the run
+	Run        *Result      `json:"run"`                     // the backup run of the synthetic data
+	Throughput []BenchPhase `json:"throughput"`              // each phase of the run that took time, in run order, then the whole run
+	PeakMemory int64        `json:"peak_memory_bytes"`       // peak resident memory of the process, where the OS reports it
+	Kept       bool         `json:"kept,omitempty"`          // the schema and backups were kept (see BenchOptions)
+	CleanupErr string       `json:"cleanup_error,omitempty"` // why the schema or backups could not all be deleted
+}
+
+// BenchPhase is the throughput of a phase of a benchmarked run (see Phases),
+// or of the whole run as "total": the dump's megabytes per second of it.
+type BenchPhase struct {
+	Phase    string  `json:"phase"`
+	Ms       int64   `json:"ms"`
+	MBPerSec float64 `json:"mb_per_s"`
+}
+
+// Bench measures the pipeline of a backup run against synthetic data, to size
+// the memory and timeout of a deployment before it backs up a real database.
+// It fills a table in benchSchema of the configured database with about
+// opts.Size bytes of generated rows, runs a forced backup of that schema
+// alone under benchPrefix and the run ID, and reports the throughput of each
+// phase of the run. The run is the configured one, with its compression,
+// encryption, streaming and memory budget, but without notifications,
+// replicas, snapshots, conflict checks, globals or compression references.
+// The database must accept writes, so point it at a scratch database. Unless
+// opts.Keep is set, the schema and the backups are deleted afterwards.
+func (h *Handler) Bench(ctx context.Context, opts BenchOptions) (*BenchResult, error) {
+	if opts.Size < 0 {
+		return nil, invalidInput(fmt.Errorf("invalid benchmark size %d", opts.Size))
+	}
+	opts.Size = cmp.Or(opts.Size, benchSize)
+	runID := RunID(ctx)
+	res := &BenchResult{RunID: runID, Schema: benchSchema, Rows: max(opts.Size/benchRowSize, 1), Kept: opts.Keep}
+
+	start := time.Now()
+	if _, err := h.query(ctx, h.db, benchCreate); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", benchSchema, err)
+	}
+	for first := int64(1); first <= res.Rows; first += benchBatchRows {
+		last := min(first+benchBatchRows-1, res.Rows)
+		if _, err := h.query(ctx, h.db, fmt.Sprintf(benchInsert, first, last)); err != nil {
+			return nil, fmt.Errorf("failed to generate rows %d to %d: %w", first, last, err)
+		}
+		logf(ctx, "Generated %d of %d rows", last, res.Rows)
+	}
+	res.GenerateMs = time.Since(start).Milliseconds()
+
+	b := *h
+	b.dumpOpts = h.dumpOpts.merge(DumpOptions{Schemas: []string{benchSchema}})
+	b.profileDump = nil
+	b.notifier = nil
+	b.replicas = nil
+	b.snapshot = nil
+	b.conflictPolicy = ConflictIgnore
+	b.referenceDays = 0
+	b.globals = false
+	prefix := benchPrefix + runID + "/"
+	run, err := b.Run(ctx, RunOptions{Force: true, Prefix: prefix})
+	if err == nil {
+		res.Run = run
+		res.Throughput = benchThroughput(run)
+		res.PeakMemory = peakMemory()
+	}
+	if !opts.Keep {
+		if cerr := h.benchCleanup(ctx, prefix); cerr != nil {
+			logf(ctx, "Warning: %v", cerr)
+			res.CleanupErr = cerr.Error()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// benchThroughput returns the BenchPhases of run.
+func benchThroughput(run *Result) []BenchPhase {
+	mb := float64(run.SizeBytes) / (1 << 20)
+	var out []BenchPhase
+	add := func(name string, ms int64) {
+		if ms > 0 {
+			out = append(out, BenchPhase{Phase: name, Ms: ms, MBPerSec: mb / (float64(ms) / 1000)})
+		}
+	}
+	run.Phases.each(add)
+	add("total", run.DurationMs)
+	return out
+}
+
+// benchCleanup drops benchSchema and deletes the objects under prefix.
+func (h *Handler) benchCleanup(ctx context.Context, prefix string) error {
+	var errs []string
+	if _, err := h.query(ctx, h.db, "DROP SCHEMA IF EXISTS "+benchSchema+" CASCADE"); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to drop %s: %v", benchSchema, err))
+	}
+	objects, err := h.listObjects(ctx, prefix)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("failed to list %s: %v", prefix, err))
+	}
+	for _, obj := range objects {
+		if _, err := h.s3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(h.bucket), Key: obj.Key}); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to delete %s: %v", aws.ToString(obj.Key), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("benchmark cleanup: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// peakMemory returns the peak resident memory of the process (VmHWM), or 0
+// where /proc does not report it.
+func peakMemory() int64 {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "VmHWM:"); ok {
+			kb, _ := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "kB")), 10, 64)
+			return kb << 10
+		}
+	}
+	return 0
+}
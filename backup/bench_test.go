@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBench(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	var queries []string
+	h.query = func(_ context.Context, _ DatabaseConfig, q string) ([][]string, error) {
+		queries = append(queries, q)
+		return nil, nil
+	}
+	var dumped DumpOptions
+	h.dump = func(_ context.Context, _ DatabaseConfig, opts DumpOptions) ([]byte, error) {
+		dumped = opts
+		return []byte(strings.Repeat("1\t2026-01-01\tabc\n", 1000)), nil
+	}
+	ctx := WithRunID(context.Background(), "bench-run")
+
+	res, err := h.Bench(ctx, BenchOptions{Size: 3 * benchBatchRows * benchRowSize / 2})
+	if err != nil {
+		t.Fatalf("Bench: %v", err)
+	}
+	if res.Rows != 3*benchBatchRows/2 || res.Run == nil || res.Run.Action != "created" {
+		t.Fatalf("result = %+v", res)
+	}
+	if !strings.HasPrefix(res.Run.Key, benchPrefix+"bench-run/") {
+		t.Errorf("backup stored at %s, want under %s", res.Run.Key, benchPrefix)
+	}
+	if !slices.Equal(dumped.Schemas, []string{benchSchema}) {
+		t.Errorf("dumped schemas %q, want only %s", dumped.Schemas, benchSchema)
+	}
+	var inserts int
+	for _, q := range queries {
+		if strings.HasPrefix(q, "INSERT INTO "+benchSchema) {
+			inserts++
+		}
+	}
+	if inserts != 2 || !strings.HasPrefix(queries[len(queries)-1], "DROP SCHEMA IF EXISTS "+benchSchema) {
+		t.Errorf("queries = %q, want two batches of rows and the schema dropped", queries)
+	}
+	if n := len(res.Throughput); res.Run.DurationMs > 0 && (n == 0 || res.Throughput[n-1].Phase != "total") {
+		t.Errorf("throughput = %+v, want the total last", res.Throughput)
+	}
+	for key := range f.objects {
+		if strings.HasPrefix(key, benchPrefix) {
+			t.Errorf("benchmark backup %s left behind", key)
+		}
+	}
+}
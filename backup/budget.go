@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"math/bits"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// minPartSize is the smallest part S3 accepts in a multipart upload, but for
+// the last.
+const minPartSize = 5 << 20
+
+// maxPartUploads bounds the parts of a streamed upload uploading at once.
+const maxPartUploads = 4
+
+// memoryLimits are the sizes a Handler's buffers are held to, derived from
+// Config.MemoryBudget by limitsFor. The zero value keeps the defaults.
+type memoryLimits struct {
+	budget       int64 // Config.MemoryBudget; 0 when unset
+	partSize     int   // part size of a streamed upload; 0 means streamPartSize
+	partUploads  int   // parts of a streamed upload uploading at once; 0 means 1
+	zstdWindow   int   // window of zstd encoders; 0 means the encoder's default
+	referenceMax int   // largest dump compressed against a reference; 0 means referenceMaxSize
+}
+
+// limitsFor returns the memoryLimits of a memory budget of budget bytes; <= 0
+// means none. Of the budget, a quarter is left to the parts of a streamed
+// upload, each a sixteenth (at least minPartSize and at most streamPartSize),
+// with as many uploading at once as fit beside the one filling, up to
+// maxPartUploads. zstd windows are held to a thirty-second of it; a window
+// is what a zstd encoder and decoder keep of the stream, and what most of
+// their memory is for. References are only compressed against by dumps of
+// up to a sixteenth, since the window then spans both.
+func limitsFor(budget int64) memoryLimits {
+	if budget <= 0 {
+		return memoryLimits{}
+	}
+	part := int(min(max(budget/16, minPartSize), int64(streamPartSize)))
+	uploads := int(min(max(budget/4/int64(part)-1, 1), maxPartUploads))
+	window := 1 << (bits.Len64(uint64(max(budget/32, zstd.MinWindowSize))) - 1)
+	return memoryLimits{
+		budget:       budget,
+		partSize:     part,
+		partUploads:  uploads,
+		zstdWindow:   min(window, 8<<20),
+		referenceMax: int(min(budget/16, referenceMaxSize)),
+	}
+}
+
+// part returns the part size of streamed uploads. streamPartSize still
+// bounds it, as tests shrink it to exercise multipart uploads.
+func (l memoryLimits) part() int {
+	if l.partSize == 0 {
+		return streamPartSize
+	}
+	return min(l.partSize, streamPartSize)
+}
+
+// uploads returns how many parts of a streamed upload may upload at once.
+func (l memoryLimits) uploads() int {
+	return max(l.partUploads, 1)
+}
+
+// maxReference returns the largest dump compressed against a reference.
+func (l memoryLimits) maxReference() int {
+	if l.referenceMax == 0 {
+		return referenceMaxSize
+	}
+	return l.referenceMax
+}
+
+// inMemoryShare is the largest dump a run holds in memory without a warning
+// under a memory budget: besides the dump it holds its compressed form and,
+// while filtering, a second copy.
+func (l memoryLimits) inMemoryShare() int64 {
+	return l.budget / 3
+}
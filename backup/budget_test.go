@@ -0,0 +1,23 @@
+package backup
+
+import "testing"
+
+func TestLimitsFor(t *testing.T) {
+	for _, tc := range []struct {
+		budget                int64
+		part, uploads, window int
+		referenceMax          int
+	}{
+		{0, 32 << 20, 1, 0, referenceMaxSize},
+		{512 << 20, 32 << 20, 3, 8 << 20, 32 << 20},
+		{128 << 20, 8 << 20, 3, 4 << 20, 8 << 20},
+		{48 << 20, 5 << 20, 1, 1 << 20, 3 << 20},
+		{4 << 30, 32 << 20, maxPartUploads, 8 << 20, 256 << 20},
+	} {
+		l := limitsFor(tc.budget)
+		if l.part() != tc.part || l.uploads() != tc.uploads || l.zstdWindow != tc.window || l.maxReference() != tc.referenceMax {
+			t.Errorf("limitsFor(%d MiB) = part %d, %d uploads, window %d, reference %d; want %d, %d, %d, %d", tc.budget>>20,
+				l.part(), l.uploads(), l.zstdWindow, l.maxReference(), tc.part, tc.uploads, tc.window, tc.referenceMax)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package backup
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// A warm Lambda runs many backups in one process. The pools below let each
+// run reuse the memory of the previous one instead of growing fresh buffers
+// for every dump, compressed copy and stream.
+
+// dumpBuffers recycles the large buffers dumps and their compressed forms
+// are held in for the length of a run.
+var dumpBuffers sync.Pool
+
+// getBuffer returns an empty buffer, with the capacity of an earlier run's
+// when one is available.
+func getBuffer() []byte {
+	if b, ok := dumpBuffers.Get().(*[]byte); ok {
+		return (*b)[:0]
+	}
+	return nil
+}
+
+// putBuffer hands b back for reuse; nothing may use it afterwards.
+func putBuffer(b []byte) {
+	if cap(b) > 0 {
+		dumpBuffers.Put(&b)
+	}
+}
+
+// copyBuffers holds the buffers streamed downloads are hashed through.
+var copyBuffers = sync.Pool{New: func() any {
+	b := make([]byte, 256<<10)
+	return &b
+}}
+
+// copyPooled is io.Copy through a pooled buffer.
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	b := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(b)
+	return io.CopyBuffer(dst, src, *b)
+}
+
+// gzipWriters pools gzip writers by level (1-9).
+var gzipWriters [gzip.BestCompression + 1]sync.Pool
+
+// getGzipWriter returns a gzip writer at level writing to w; level 0 means
+// the default. Return it with gzipWriters[level].Put once closed.
+func getGzipWriter(w io.Writer, level int) (*gzip.Writer, int, error) {
+	if level == 0 {
+		level = 6
+	}
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return nil, 0, fmt.Errorf("invalid gzip level %d", level)
+	}
+	if zw, ok := gzipWriters[level].Get().(*gzip.Writer); ok {
+		zw.Reset(w)
+		return zw, level, nil
+	}
+	zw, err := gzip.NewWriterLevel(w, level)
+	return zw, level, err
+}
+
+// zstdEncoders pools zstd encoders by zstdEncoderKey. Encoders allocate
+// their tables up front, so building one per upload is the costly part of
+// compressing small dumps.
+var zstdEncoders sync.Map
+
+// zstdEncoderKey is the level and window size (0 for the default) an
+// encoder was built with.
+type zstdEncoderKey struct {
+	level  zstd.EncoderLevel
+	window int
+}
+
+// getZstdEncoder returns an encoder for the zstd level (1-22; 0 means 3) with
+// the window size window, a power of two; 0 keeps the default. Return it
+// with pool.Put.
+func getZstdEncoder(level, window int) (enc *zstd.Encoder, pool *sync.Pool, err error) {
+	if level == 0 {
+		level = 3
+	}
+	key := zstdEncoderKey{zstd.EncoderLevelFromZstd(level), window}
+	p, _ := zstdEncoders.LoadOrStore(key, &sync.Pool{})
+	pool = p.(*sync.Pool)
+	if enc, ok := pool.Get().(*zstd.Encoder); ok {
+		return enc, pool, nil
+	}
+	opts := []zstd.EOption{zstd.WithEncoderLevel(key.level), zstd.WithEncoderConcurrency(1)}
+	if window > 0 {
+		opts = append(opts, zstd.WithWindowSize(window))
+	}
+	enc, err = zstd.NewWriter(nil, opts...)
+	return enc, pool, err
+}
+
+// gzipReaders and zstdDecoders pool the decompressors of openObject.
+var (
+	gzipReaders  sync.Pool
+	zstdDecoders sync.Pool
+)
+
+// pooledGzipReader returns its gzip.Reader to gzipReaders on Close.
+type pooledGzipReader struct{ *gzip.Reader }
+
+func (r pooledGzipReader) Close() error {
+	err := r.Reader.Close()
+	gzipReaders.Put(r.Reader)
+	return err
+}
+
+func getGzipReader(r io.Reader) (io.ReadCloser, error) {
+	if zr, ok := gzipReaders.Get().(*gzip.Reader); ok {
+		if err := zr.Reset(r); err != nil {
+			gzipReaders.Put(zr)
+			return nil, err
+		}
+		return pooledGzipReader{zr}, nil
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return pooledGzipReader{zr}, nil
+}
+
+// pooledZstdDecoder returns its zstd.Decoder to zstdDecoders on Close,
+// detached from the stream it read.
+type pooledZstdDecoder struct{ *zstd.Decoder }
+
+func (d pooledZstdDecoder) Close() error {
+	if err := d.Reset(nil); err == nil {
+		zstdDecoders.Put(d.Decoder)
+	}
+	return nil
+}
+
+func getZstdDecoder(r io.Reader) (io.ReadCloser, error) {
+	if dec, ok := zstdDecoders.Get().(*zstd.Decoder); ok {
+		if err := dec.Reset(r); err != nil {
+			zstdDecoders.Put(dec)
+			return nil, err
+		}
+		return pooledZstdDecoder{dec}, nil
+	}
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return pooledZstdDecoder{dec}, nil
+}
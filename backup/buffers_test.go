@@ -0,0 +1,51 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestPooledCodecsRoundTrip(t *testing.T) {
+	for _, c := range []Compression{{CompressionGzip, 1}, {CompressionGzip, 0}, {CompressionZstd, 0}, {CompressionZstd, 19}} {
+		var wg sync.WaitGroup
+		for i := range 4 { // concurrent uses share the pools
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range 3 {
+					data := append(bytes.Clone(compressibleDump), byte(i), byte(j))
+					out, err := c.compress(getBuffer(), data, 0)
+					if err != nil {
+						t.Errorf("%s: compress: %v", c, err)
+						return
+					}
+					r, err := decompressBody(bytes.NewReader(out), map[string]string{"compression": c.Codec})
+					if err != nil {
+						t.Errorf("%s: decompress: %v", c, err)
+						return
+					}
+					got, err := io.ReadAll(r)
+					_ = r.Close()
+					putBuffer(out)
+					if err != nil || !bytes.Equal(got, data) {
+						t.Errorf("%s: round trip lost data (%v)", c, err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestCompressAppendsToBuffer(t *testing.T) {
+	prefix := []byte("kept")
+	out, err := (Compression{Codec: CompressionZstd}).compress(prefix, []byte("dump"), 0)
+	if err != nil || !bytes.HasPrefix(out, prefix) {
+		t.Errorf("compress = %q, %v; want it appended to the buffer", out, err)
+	}
+	if _, err := (Compression{CompressionGzip, 12}).compress(nil, []byte("dump"), 0); err == nil {
+		t.Error("an invalid gzip level should fail")
+	}
+}
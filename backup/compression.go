@@ -0,0 +1,347 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Compression codecs. CompressionAuto is not a codec: it has each run pick
+// one of the others, see chooseCompression.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionAuto = "auto"
+)
+
+// compressionSampleSize is how much of a dump chooseCompression compresses
+// with each candidate to measure its throughput and ratio.
+const compressionSampleSize = 1 << 20
+
+// compressionBudgetShare is the part of a run's remaining time that
+// compression may take; the rest is left for uploads, copies and retention.
+const compressionBudgetShare = 0.5
+
+// compressionCandidates are the settings CompressionAuto chooses from.
+var compressionCandidates = []Compression{
+	{CompressionZstd, 1}, {CompressionZstd, 3}, {CompressionZstd, 7}, {CompressionZstd, 11},
+	{CompressionGzip, 1}, {CompressionGzip, 6}, {CompressionGzip, 9},
+}
+
+// Compression selects how backups are compressed before they are uploaded.
+// The choice is recorded in each object's metadata ("compression" and
+// "compression-level") and Content-Encoding, and reversed transparently when
+// the backup is read back; checksums, manifests and deduplication are all
+// over the uncompressed dump, so changing codecs never makes a backup look
+// changed. A gzip-compressed backup is named "*.sql.gz" and stored with
+// Content-Encoding gzip (see storedKey and contentHeaders); a zstd one keeps
+// its ".sql" suffix: decompress it with zstd -d when downloading it by hand.
+type Compression struct {
+	Codec string // CompressionNone (the zero value), CompressionGzip, CompressionZstd or CompressionAuto
+	Level int    // codec level (gzip 1-9, zstd 1-22); 0 means the codec's default
+}
+
+// ParseCompression parses a COMPRESSION setting: "none", "auto", or a codec
+// with an optional level such as "gzip", "zstd:3" or "gzip:9".
+func ParseCompression(s string) (Compression, error) {
+	codec, level, hasLevel := strings.Cut(strings.ToLower(strings.TrimSpace(s)), ":")
+	c := Compression{Codec: codec}
+	switch codec {
+	case "", CompressionNone:
+		c.Codec = CompressionNone
+	case CompressionAuto, CompressionGzip, CompressionZstd:
+	default:
+		return Compression{}, fmt.Errorf("unknown compression %q (want none, auto, gzip or zstd)", s)
+	}
+	if !hasLevel {
+		return c, nil
+	}
+	n, err := strconv.Atoi(level)
+	if err != nil || c.Codec == CompressionNone || c.Codec == CompressionAuto ||
+		c.Codec == CompressionGzip && (n < 1 || n > 9) || c.Codec == CompressionZstd && (n < 1 || n > 22) {
+		return Compression{}, fmt.Errorf("invalid compression level in %q", s)
+	}
+	c.Level = n
+	return c, nil
+}
+
+// String returns c in the format read by ParseCompression, e.g. "zstd:3".
+func (c Compression) String() string {
+	switch {
+	case c.Codec == "":
+		return CompressionNone
+	case c.Level == 0:
+		return c.Codec
+	default:
+		return c.Codec + ":" + strconv.Itoa(c.Level)
+	}
+}
+
+// enabled reports whether c compresses anything.
+func (c Compression) enabled() bool {
+	return c.Codec != "" && c.Codec != CompressionNone
+}
+
+// compress appends data compressed with c to dst, using pooled encoders;
+// zstd ones keep a window of window bytes, 0 meaning the default.
+func (c Compression) compress(dst, data []byte, window int) ([]byte, error) {
+	switch c.Codec {
+	case CompressionGzip:
+		buf := bytes.NewBuffer(dst)
+		zw, level, err := getGzipWriter(buf, c.Level)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipWriters[level].Put(zw)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		enc, pool, err := getZstdEncoder(c.Level, window)
+		if err != nil {
+			return nil, err
+		}
+		defer pool.Put(enc)
+		return enc.EncodeAll(data, dst), nil
+	default:
+		return append(dst, data...), nil
+	}
+}
+
+// writer returns an io.WriteCloser compressing what is written to it with c
+// into w, using pooled encoders with the window of compress. Closing it
+// flushes the compressed stream without closing w.
+func (c Compression) writer(w io.Writer, window int) (io.WriteCloser, error) {
+	switch c.Codec {
+	case CompressionGzip:
+		zw, level, err := getGzipWriter(w, c.Level)
+		if err != nil {
+			return nil, err
+		}
+		return writeCloser{zw, closerFunc(func() error {
+			defer gzipWriters[level].Put(zw)
+			return zw.Close()
+		})}, nil
+	case CompressionZstd:
+		enc, pool, err := getZstdEncoder(c.Level, window)
+		if err != nil {
+			return nil, err
+		}
+		enc.Reset(w)
+		return writeCloser{enc, closerFunc(func() error {
+			err := enc.Close()
+			enc.Reset(nil)
+			pool.Put(enc)
+			return err
+		})}, nil
+	default:
+		return writeCloser{w, closerFunc(func() error { return nil })}, nil
+	}
+}
+
+// writeCloser combines an io.Writer with the io.Closer that finishes it.
+type writeCloser struct {
+	io.Writer
+	io.Closer
+}
+
+// addMetadata records c, and the size of the uncompressed body, in the object
+// metadata md.
+func (c Compression) addMetadata(md map[string]string, size int) {
+	md["compression"] = c.Codec
+	if c.Level != 0 {
+		md["compression-level"] = strconv.Itoa(c.Level)
+	}
+	md["uncompressed-size"] = strconv.Itoa(size)
+}
+
+// compressionFromMetadata returns the Compression recorded in md; objects
+// without one are uncompressed.
+func compressionFromMetadata(md map[string]string) Compression {
+	c := Compression{Codec: md["compression"]}
+	if c.Codec == "" {
+		c.Codec = CompressionNone
+	}
+	c.Level, _ = strconv.Atoi(md["compression-level"])
+	return c
+}
+
+// uncompressedSize returns the size of the dump stored in an object of the
+// given size with metadata md.
+func uncompressedSize(md map[string]string, size int64) int64 {
+	if n, err := strconv.ParseInt(md["uncompressed-size"], 10, 64); err == nil && compressionFromMetadata(md).enabled() {
+		return n
+	}
+	return size
+}
+
+// decompressBody wraps body with the decompressor for the Compression
+// recorded in md. Closing the result releases the decompressor, not body.
+func decompressBody(body io.Reader, md map[string]string) (io.ReadCloser, error) {
+	switch c := compressionFromMetadata(md); c.Codec {
+	case CompressionNone:
+		return io.NopCloser(body), nil
+	case CompressionGzip:
+		return getGzipReader(body)
+	case CompressionZstd:
+		return getZstdDecoder(body)
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", c.Codec)
+	}
+}
+
+// closerFunc adapts a function to io.Closer.
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// chooseCompression resolves the configured compression for a dump of data.
+// A fixed codec is used as is. Under CompressionAuto every candidate
+// compresses a sample of data; the one with the best ratio whose projected
+// time for the whole dump fits in compressionBudgetShare of the time left
+// before ctx's deadline (the Lambda timeout) is chosen, or no compression when
+// none fits or saves space. Without a deadline the best ratio wins.
+func (h *Handler) chooseCompression(ctx context.Context, data []byte) Compression {
+	return h.chooseCompressionSized(ctx, data, len(data))
+}
+
+// chooseCompressionSized is chooseCompression for a dump of size bytes that
+// starts with data, of which it compresses at most compressionSampleSize.
+func (h *Handler) chooseCompressionSized(ctx context.Context, data []byte, size int) Compression {
+	if h.compression.Codec != CompressionAuto {
+		return h.compression
+	}
+	budget := time.Duration(-1)
+	if deadline, ok := ctx.Deadline(); ok {
+		budget = time.Duration(float64(deadline.Sub(h.now())) * compressionBudgetShare)
+	}
+
+	sample := data[:min(len(data), compressionSampleSize)]
+	best, bestRatio := Compression{Codec: CompressionNone}, 1.0
+	buf := getBuffer()
+	defer func() { putBuffer(buf) }()
+	for _, c := range compressionCandidates {
+		start := h.now()
+		out, err := c.compress(buf[:0], sample, h.limits.zstdWindow)
+		took := h.now().Sub(start)
+		if err != nil || len(sample) == 0 {
+			continue
+		}
+		buf = out
+		projected := time.Duration(float64(took) * float64(size) / float64(len(sample)))
+		if budget >= 0 && projected > budget {
+			continue
+		}
+		if ratio := float64(len(out)) / float64(len(sample)); ratio < bestRatio {
+			best, bestRatio = c, ratio
+		}
+	}
+	logf(ctx, "Chose compression %s (sample ratio %.2f)", best, bestRatio)
+	return best
+}
+
+// compressedDump is a run's dump compressed once with the chosen Compression
+// and reused for each upload of the same dump: the daily, monthly and yearly
+// backups and their replicas. The daily backup set up with a reference (see
+// useReference) is compressed against it instead. The compressed bytes live
+// in pooled buffers until release.
+type compressedDump struct {
+	Compression
+	window int // zstd window size; 0 keeps the default (see memoryLimits)
+	data   []byte
+	now    func() time.Time // clock timing the compression; nil leaves it untimed
+
+	ref       *compressionRef // reference the upload to refFor in refBucket is compressed against, if any
+	refBucket string
+	refFor    string
+
+	once    sync.Once
+	body    []byte
+	err     error
+	refOnce sync.Once
+	refBody []byte
+	refErr  error
+	took    time.Duration // how long compressing took
+}
+
+// bodyFor returns the bytes to upload to key in bucket for data, and their
+// compression: data compressed against the reference when the upload is the
+// one d.ref is for, its compressed form for any other upload of the run's
+// dump, or nil when data is some other object, which is stored uncompressed.
+func (d *compressedDump) bodyFor(bucket, key string, data []byte) ([]byte, Compression, error) {
+	if len(data) == 0 || len(data) != len(d.data) || &data[0] != &d.data[0] {
+		return nil, Compression{}, nil
+	}
+	if d.referenced(bucket, key) {
+		d.refOnce.Do(func() {
+			d.refBody, d.refErr = d.timed(func() ([]byte, error) { return d.ref.compress(getBuffer(), d.data) })
+		})
+		return d.refBody, referenceCompression, d.refErr
+	}
+	d.once.Do(func() {
+		d.body, d.err = d.timed(func() ([]byte, error) { return d.compress(getBuffer(), d.data, d.window) })
+	})
+	return d.body, d.Compression, d.err
+}
+
+// referenced reports whether the upload to key in bucket is compressed
+// against d's reference.
+func (d *compressedDump) referenced(bucket, key string) bool {
+	return d.ref != nil && bucket == d.refBucket && key == d.refFor
+}
+
+// timed runs compress, adding its duration to d.took.
+func (d *compressedDump) timed(compress func() ([]byte, error)) ([]byte, error) {
+	if d.now == nil {
+		return compress()
+	}
+	start := d.now()
+	out, err := compress()
+	d.took += d.now().Sub(start)
+	return out, err
+}
+
+// release hands the compressed bytes back for reuse by a later run.
+func (d *compressedDump) release() {
+	putBuffer(d.body)
+	putBuffer(d.refBody)
+	d.body, d.refBody = nil, nil
+}
+
+// compressedDumpKey is the context key under which a run's compressedDump is
+// stored, so uploads of the dump use it.
+type compressedDumpKey struct{}
+
+func withCompressedDump(ctx context.Context, d *compressedDump) context.Context {
+	return context.WithValue(ctx, compressedDumpKey{}, d)
+}
+
+// compressedDumpFrom returns the compressedDump stored in ctx, or nil.
+func compressedDumpFrom(ctx context.Context) *compressedDump {
+	d, _ := ctx.Value(compressedDumpKey{}).(*compressedDump)
+	return d
+}
+
+// compressionOf returns how the run's dump in ctx is stored at key in bucket,
+// and the reference it is compressed against, if any.
+func compressionOf(ctx context.Context, bucket, key string) (Compression, string) {
+	d := compressedDumpFrom(ctx)
+	switch {
+	case d == nil:
+		return Compression{Codec: CompressionNone}, ""
+	case d.referenced(bucket, key):
+		return referenceCompression, d.ref.key
+	default:
+		return d.Compression, ""
+	}
+}
@@ -0,0 +1,151 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// compressibleDump is a pg_dump-like body larger than compressionSampleSize.
+var compressibleDump = append(append([]byte("-- PostgreSQL database dump\n"),
+	bytes.Repeat([]byte("INSERT INTO public.events VALUES (1, 'click', '2026-05-27');\n"), 40000)...),
+	"-- PostgreSQL database dump complete\n"...)
+
+func TestParseCompression(t *testing.T) {
+	for in, want := range map[string]Compression{
+		"":        {CompressionNone, 0},
+		"none":    {CompressionNone, 0},
+		"auto":    {CompressionAuto, 0},
+		"gzip":    {CompressionGzip, 0},
+		"GZIP:9":  {CompressionGzip, 9},
+		"zstd:19": {CompressionZstd, 19},
+	} {
+		if got, err := ParseCompression(in); err != nil || got != want {
+			t.Errorf("ParseCompression(%q) = %+v, %v; want %+v", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"lz4", "gzip:10", "zstd:0", "auto:3", "none:1", "zstd:x"} {
+		if _, err := ParseCompression(bad); err == nil {
+			t.Errorf("ParseCompression(%q) should fail", bad)
+		}
+	}
+	if s := (Compression{CompressionZstd, 3}).String(); s != "zstd:3" {
+		t.Errorf("String = %q", s)
+	}
+}
+
+func TestRunCompressesBackups(t *testing.T) {
+	for _, c := range []Compression{{CompressionGzip, 6}, {CompressionZstd, 3}} {
+		t.Run(c.Codec, func(t *testing.T) {
+			f := newFakeS3()
+			h := newTestHandler(f, 7)
+			h.dump = staticDump(compressibleDump)
+			h.compression = c
+			h.auditFullMax = 1 // compressed backups are still audited in full
+
+			res, err := h.Run(context.Background(), RunOptions{})
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if res.Compression != c.String() {
+				t.Errorf("result compression = %q, want %q", res.Compression, c)
+			}
+			if want := storedKey("daily/2026-05-27-backup.sql", c); res.Key != want {
+				t.Errorf("key = %q, want %q", res.Key, want)
+			}
+			for _, key := range []string{res.Key, storedKey("monthly/2026-05-backup.sql", c), storedKey("yearly/2026-backup.sql", c)} {
+				obj := f.objects[key]
+				if len(obj.body) >= len(compressibleDump) || obj.metadata["compression"] != c.Codec || obj.metadata["sha256"] != checksum(compressibleDump) {
+					t.Errorf("%s stored %d bytes with metadata %v", key, len(obj.body), obj.metadata)
+				}
+			}
+			if m, _ := h.readManifest(context.Background(), res.Key); m == nil || m.Compression != c.String() || m.Size != int64(len(compressibleDump)) {
+				t.Errorf("manifest = %+v", m)
+			}
+
+			body, err := h.openObject(context.Background(), res.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain, _ := io.ReadAll(body)
+			_ = body.Close()
+			if !bytes.Equal(plain, compressibleDump) {
+				t.Error("openObject did not return the uncompressed dump")
+			}
+			if entry := h.auditObject(context.Background(), res.Key); entry.State != AuditOK || entry.Method != AuditMethodFull || entry.ChunksChecked == 0 {
+				t.Errorf("audit = %+v, want a full ok audit against the manifest", entry)
+			}
+
+			h.now = fixedClock(testNow.AddDate(0, 0, 1))
+			if res, _ := h.Run(context.Background(), RunOptions{}); res == nil || res.Action != "skipped" {
+				t.Errorf("unchanged dump under compression: %+v, want skipped", res)
+			}
+		})
+	}
+}
+
+func TestRunRenamesGzipBackups(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.dump = staticDump(compressibleDump)
+	h.compression = Compression{CompressionGzip, 6}
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil || res.Key != "daily/2026-05-27-backup.sql.gz" {
+		t.Fatalf("Run = %+v, %v; want a .sql.gz backup", res, err)
+	}
+	if _, ok := f.objects[manifestKey(res.Key)]; !ok || manifestKey(res.Key) != "daily/2026-05-27-backup.manifest.json" {
+		t.Errorf("manifest %s not stored", manifestKey(res.Key))
+	}
+	if res, _ := h.Run(context.Background(), RunOptions{Force: true}); res == nil || res.Action != "skipped" {
+		t.Errorf("forced rerun: %+v, want today's .sql.gz backup found identical", res)
+	}
+
+	h.compression = Compression{}
+	h.dump = staticDump(append([]byte("-- changed\n"), compressibleDump...))
+	if res, err = h.Run(context.Background(), RunOptions{Force: true, ReplacePeriodic: true}); err != nil || res.Key != "daily/2026-05-27-backup.sql" {
+		t.Fatalf("Run = %+v, %v; want an uncompressed .sql backup", res, err)
+	}
+	for _, key := range []string{"daily/2026-05-27-backup.sql", "monthly/2026-05-backup.sql", "yearly/2026-backup.sql"} {
+		if _, ok := f.objects[key]; !ok {
+			t.Errorf("%s not stored", key)
+		}
+		if _, ok := f.objects[key+gzipSuffix]; ok {
+			t.Errorf("%s kept after the backup was stored uncompressed", key+gzipSuffix)
+		}
+	}
+}
+
+func TestChooseCompression(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.compression = Compression{Codec: CompressionAuto}
+	// Every reading of the clock advances it by a second, so each candidate
+	// takes a second on the sample and about len/sample seconds on the dump.
+	clock := testNow
+	h.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	projected := time.Duration(len(compressibleDump)/compressionSampleSize+1) * time.Second
+
+	if c := h.chooseCompression(context.Background(), compressibleDump); !c.enabled() {
+		t.Errorf("without a deadline: %s, want the best ratio", c)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Add(4*projected))
+	defer cancel()
+	if c := h.chooseCompression(ctx, compressibleDump); !c.enabled() {
+		t.Errorf("with time to spare: %s, want compression", c)
+	}
+	ctx, cancel = context.WithDeadline(context.Background(), clock.Add(projected))
+	defer cancel()
+	if c := h.chooseCompression(ctx, compressibleDump); c.enabled() {
+		t.Errorf("short on time: %s, want none", c)
+	}
+
+	h.compression = Compression{Codec: CompressionZstd, Level: 1}
+	if c := h.chooseCompression(context.Background(), compressibleDump); c != h.compression {
+		t.Errorf("fixed codec: %s, want %s", c, h.compression)
+	}
+}
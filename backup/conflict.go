@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conflict policies for Config.ConflictPolicy.
+const (
+	ConflictIgnore = ""      // dump without checking for conflicting operations
+	ConflictSkip   = "skip"  // skip the run when a conflicting operation is in progress
+	ConflictDelay  = "delay" // wait for conflicting operations to finish, then skip if they don't
+)
+
+// conflictQuery finds other sessions in the database whose work conflicts with
+// pg_dump's ACCESS SHARE locks: rewrites and DDL such as VACUUM FULL, CLUSTER,
+// REINDEX and ALTER TABLE, or anything holding or awaiting an ACCESS EXCLUSIVE
+// relation lock (which migrations typically take).
+const conflictQuery = `SELECT a.pid,
+       coalesce(a.application_name, ''),
+       coalesce(extract(epoch FROM now() - a.query_start)::bigint, 0),
+       left(regexp_replace(a.query, '\s+', ' ', 'g'), 200)
+FROM pg_catalog.pg_stat_activity a
+WHERE a.datname = current_database()
+  AND a.pid <> pg_backend_pid()
+  AND a.state <> 'idle'
+  AND (a.query ~* '^\s*(vacuum\s+(\(.*)?full|cluster|reindex|alter\s+table|lock\s+table)'
+       OR EXISTS (SELECT 1 FROM pg_catalog.pg_locks l
+                  WHERE l.pid = a.pid AND l.locktype = 'relation' AND l.mode = 'AccessExclusiveLock'))
+ORDER BY a.query_start`
+
+// Conflict is a database session whose work would block, or be blocked by,
+// the dump.
+type Conflict struct {
+	PID             int    `json:"pid"`
+	ApplicationName string `json:"application_name,omitempty"`
+	RunningSeconds  int64  `json:"running_seconds"` // how long its current query has been running
+	Query           string `json:"query"`           // current query, whitespace-collapsed and truncated
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("pid %d running %ds: %s", c.PID, c.RunningSeconds, c.Query)
+}
+
+// conflicts returns the sessions currently conflicting with a dump.
+func (h *Handler) conflicts(ctx context.Context) ([]Conflict, error) {
+	rows, err := h.query(ctx, h.db, conflictQuery)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]Conflict, 0, len(rows))
+	for _, row := range rows {
+		if len(row) != 4 {
+			return nil, fmt.Errorf("unexpected pg_stat_activity row %q", row)
+		}
+		pid, err := strconv.Atoi(row[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid %q: %w", row[0], err)
+		}
+		secs, _ := strconv.ParseInt(row[2], 10, 64)
+		found = append(found, Conflict{PID: pid, ApplicationName: row[1], RunningSeconds: secs, Query: row[3]})
+	}
+	return found, nil
+}
+
+// awaitNoConflicts applies the conflict policy before a dump. It returns the
+// conflicts that should stop the run, or nil when the dump may proceed. Under
+// ConflictDelay it polls until the conflicts clear, the configured delay
+// elapses, or ctx is done. A failing check is logged and does not stop the run.
+func (h *Handler) awaitNoConflicts(ctx context.Context) []Conflict {
+	if h.conflictPolicy == ConflictIgnore {
+		return nil
+	}
+	deadline := h.now().Add(h.conflictDelay)
+	for {
+		found, err := h.conflicts(ctx)
+		if err != nil {
+			logf(ctx, "Warning: failed to check for conflicting operations, dumping anyway: %v", err)
+			return nil
+		}
+		if len(found) == 0 {
+			return nil
+		}
+		descs := make([]string, len(found))
+		for i, c := range found {
+			descs[i] = c.String()
+		}
+		logf(ctx, "Conflicting operations in progress: %s", strings.Join(descs, "; "))
+
+		if h.conflictPolicy != ConflictDelay || !h.now().Before(deadline) {
+			return found
+		}
+		select {
+		case <-ctx.Done():
+			return found
+		case <-time.After(h.conflictPoll):
+		}
+	}
+}
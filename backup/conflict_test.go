@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var vacuumRow = []string{"4242", "psql", "95", "VACUUM FULL public.events"}
+
+// sequenceQuery returns a Querier that yields results[i] on the i-th call and
+// the last entry thereafter.
+func sequenceQuery(results ...[][]string) Querier {
+	calls := 0
+	return func(context.Context, DatabaseConfig, string) ([][]string, error) {
+		r := results[min(calls, len(results)-1)]
+		calls++
+		return r, nil
+	}
+}
+
+func TestRunSkipsOnConflict(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.conflictPolicy = ConflictSkip
+	h.query = staticQuery([][]string{vacuumRow})
+	var notified []Notification
+	h.notifier = func(_ context.Context, n Notification) error {
+		notified = append(notified, n)
+		return nil
+	}
+	dumped := false
+	h.dump = func(context.Context, DatabaseConfig, DumpOptions) ([]byte, error) {
+		dumped = true
+		return []byte("x"), nil
+	}
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Action != "skipped" || len(res.Conflicts) != 1 || res.Conflicts[0].PID != 4242 {
+		t.Errorf("result = %+v, want skipped with the VACUUM FULL conflict", res)
+	}
+	if dumped || len(f.objects) != 0 {
+		t.Error("a skipped run must not dump or upload")
+	}
+	if len(notified) != 1 || notified[0].Event != "backup.skipped" {
+		t.Errorf("notifications = %+v, want one backup.skipped", notified)
+	}
+}
+
+func TestRunDelaysUntilConflictClears(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.conflictPolicy = ConflictDelay
+	h.conflictPoll = time.Millisecond
+	h.query = sequenceQuery([][]string{vacuumRow}, [][]string{vacuumRow}, nil)
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Action != "created" {
+		t.Errorf("action = %q, want created once the conflict cleared", res.Action)
+	}
+}
+
+func TestRunDelayGivesUp(t *testing.T) {
+	h := newTestHandler(newFakeS3(), 7)
+	h.conflictPolicy = ConflictDelay
+	h.conflictDelay = time.Minute
+	h.conflictPoll = time.Millisecond
+	h.query = staticQuery([][]string{vacuumRow})
+	clock := testNow
+	h.now = func() time.Time {
+		clock = clock.Add(20 * time.Second)
+		return clock
+	}
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Action != "skipped" {
+		t.Errorf("action = %q, want skipped after the delay elapsed", res.Action)
+	}
+}
+
+func TestRunConflictCheckErrorDumpsAnyway(t *testing.T) {
+	h := newTestHandler(newFakeS3(), 7)
+	h.conflictPolicy = ConflictSkip
+	h.query = func(context.Context, DatabaseConfig, string) ([][]string, error) {
+		return nil, errors.New("permission denied")
+	}
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Action != "created" {
+		t.Errorf("action = %q, want created despite the failed check", res.Action)
+	}
+}
+
+func TestConflictsRejectsMalformedRows(t *testing.T) {
+	h := newTestHandler(newFakeS3(), 7)
+	h.query = staticQuery([][]string{{"not-a-pid", "", "0", "ALTER TABLE t"}})
+	if _, err := h.conflicts(context.Background()); err == nil {
+		t.Fatal("expected an error for a non-numeric pid")
+	}
+}
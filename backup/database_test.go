@@ -1,6 +1,9 @@
 package backup
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestParseDatabaseURL(t *testing.T) {
 	tests := []struct {
@@ -43,3 +46,50 @@ func TestParseDatabaseURLError(t *testing.T) {
 		t.Fatal("expected error for malformed URL, got nil")
 	}
 }
+
+func TestParseDatabaseURLSessionParameters(t *testing.T) {
+	got, err := ParseDatabaseURL("postgresql://u@h/db?application_name=nightly&options=-c%20work_mem%3D64MB")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.ApplicationName != "nightly" || got.Options != "-c work_mem=64MB" {
+		t.Errorf("ApplicationName = %q, Options = %q", got.ApplicationName, got.Options)
+	}
+}
+
+func TestSessionOptions(t *testing.T) {
+	got := SessionOptions(map[string]string{"work_mem": "64MB", "backend_flush_after": "0", "search_path": `a b\c`})
+	want := `-c backend_flush_after=0 -c search_path=a\ b\\c -c work_mem=64MB`
+	if got != want {
+		t.Errorf("SessionOptions = %q, want %q", got, want)
+	}
+	if got := SessionOptions(nil); got != "" {
+		t.Errorf("SessionOptions(nil) = %q, want empty", got)
+	}
+}
+
+func TestDefaultApplicationName(t *testing.T) {
+	if got := New(Config{Version: "1.4.0"}).db.ApplicationName; got != "go-postgres-s3-backup/1.4.0" {
+		t.Errorf("default application_name = %q", got)
+	}
+	if got := New(Config{}).db.ApplicationName; got != "go-postgres-s3-backup/dev" {
+		t.Errorf("unversioned application_name = %q", got)
+	}
+	cfg := Config{Database: DatabaseConfig{ApplicationName: "nightly"}, Version: "1.4.0"}
+	if got := New(cfg).db.ApplicationName; got != "nightly" {
+		t.Errorf("configured application_name overridden: %q", got)
+	}
+}
+
+func TestParseDatabaseURLConnectTimeout(t *testing.T) {
+	got, err := ParseDatabaseURL("postgres://u:p@h/d?connect_timeout=5")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.ConnectTimeout != 5*time.Second {
+		t.Errorf("ConnectTimeout = %v, want 5s", got.ConnectTimeout)
+	}
+	if _, err := ParseDatabaseURL("postgres://u:p@h/d?connect_timeout=soon"); err == nil {
+		t.Error("expected an error for a non-numeric connect_timeout")
+	}
+}
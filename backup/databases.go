@@ -0,0 +1,302 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// databaseListQuery lists the databases of a server that accept
+// connections, leaving out the templates.
+const databaseListQuery = `SELECT datname FROM pg_catalog.pg_database
+WHERE NOT datistemplate AND datallowconn
+ORDER BY datname`
+
+// DatabaseOrder sets the order in which RunDatabases backs up its databases
+// and how long each may take, by database name. Names of databases that are
+// not backed up are ignored.
+type DatabaseOrder struct {
+	First   []string                 // databases backed up first, in this order; the others follow in list order
+	After   map[string][]string      // databases each one is backed up after, wherever First puts it
+	Budgets map[string]time.Duration // time limit per database; "" is the default, else none
+}
+
+// ParseDatabaseOrder parses the DATABASE_ORDER, DATABASE_DEPENDENCIES and
+// DATABASE_TIME_BUDGETS settings: a comma-separated list of names, such as
+// "accounts,billing"; comma-separated "database=dependency" pairs, such as
+// "dashboards=billing,dashboards=accounts"; and comma-separated durations, each
+// either bare, the default, or "database=duration", such as "10m,analytics=30m".
+func ParseDatabaseOrder(order, dependencies, budgets string) (DatabaseOrder, error) {
+	var o DatabaseOrder
+	for _, name := range strings.Split(order, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if slices.Contains(o.First, name) {
+				return o, fmt.Errorf("database %s is ordered twice", name)
+			}
+			o.First = append(o.First, name)
+		}
+	}
+	for _, entry := range strings.Split(dependencies, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		db, dep, ok := strings.Cut(entry, "=")
+		db, dep = strings.TrimSpace(db), strings.TrimSpace(dep)
+		if !ok || db == "" || dep == "" || db == dep {
+			return o, fmt.Errorf("invalid dependency %q: want database=dependency", entry)
+		}
+		if o.After == nil {
+			o.After = map[string][]string{}
+		}
+		o.After[db] = append(o.After[db], dep)
+	}
+	err := parseOperationValues(budgets, func(db, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid time budget %q for %s: want a positive duration such as 10m", v, databaseLabel(db))
+		}
+		if o.Budgets == nil {
+			o.Budgets = map[string]time.Duration{}
+		}
+		o.Budgets[db] = d
+		return nil
+	})
+	return o, err
+}
+
+func databaseLabel(db string) string {
+	if db == "" {
+		return "the default"
+	}
+	return "database " + db
+}
+
+// sort returns dbs in the order o sets: those of First in that order, then
+// the others as listed, each database moved after the ones it depends on. A
+// cycle of dependencies is an error naming the databases in it.
+func (o DatabaseOrder) sort(dbs []DatabaseConfig) ([]DatabaseConfig, error) {
+	rank := func(db DatabaseConfig) int {
+		if i := slices.Index(o.First, db.Database); i >= 0 {
+			return i
+		}
+		return len(o.First)
+	}
+	pending := slices.Clone(dbs)
+	slices.SortStableFunc(pending, func(a, b DatabaseConfig) int { return cmp.Compare(rank(a), rank(b)) })
+	done := map[string]bool{}
+	waits := func(db DatabaseConfig) bool {
+		for _, dep := range o.After[db.Database] {
+			if !done[dep] && slices.ContainsFunc(pending, func(p DatabaseConfig) bool { return p.Database == dep }) {
+				return true
+			}
+		}
+		return false
+	}
+	sorted := make([]DatabaseConfig, 0, len(dbs))
+	for len(pending) > 0 {
+		i := slices.IndexFunc(pending, func(db DatabaseConfig) bool { return !waits(db) })
+		if i < 0 {
+			names := make([]string, len(pending))
+			for j, db := range pending {
+				names[j] = db.Database
+			}
+			return nil, fmt.Errorf("databases %s depend on each other (DATABASE_DEPENDENCIES)", strings.Join(names, ", "))
+		}
+		done[pending[i].Database] = true
+		sorted = append(sorted, pending[i])
+		pending = slices.Delete(pending, i, i+1)
+	}
+	return sorted, nil
+}
+
+// DatabaseResult is the outcome of one database's backup in RunDatabases.
+type DatabaseResult struct {
+	Database string  `json:"database"`
+	Server   string  `json:"server"`           // host:port of the database
+	Prefix   string  `json:"prefix"`           // key prefix of its backups
+	Result   *Result `json:"result,omitempty"` // the database's backup run, unless it failed
+	Error    string  `json:"error,omitempty"`  // why the database's backup failed
+	// BudgetMs is the time the database's backup was allowed (see
+	// DatabaseOrder.Budgets), when it had a limit.
+	BudgetMs int64 `json:"time_budget_ms,omitempty"`
+}
+
+// DatabasesResult summarizes a RunDatabases call.
+type DatabasesResult struct {
+	Status     string           `json:"status"`      // "ok", "partial" when some databases failed, or "failed" when all did
+	RunID      string           `json:"run_id"`      // run identifier, shared by every database's backup
+	Action     string           `json:"action"`      // always "databases"
+	Databases  []DatabaseResult `json:"databases"`   // per-database outcomes, in the order they were backed up
+	Failed     int              `json:"failed"`      // databases whose backup failed
+	DurationMs int64            `json:"duration_ms"` // wall-clock time of the call
+}
+
+// multiDatabase reports whether the Handler backs up several databases per
+// invocation (see RunDatabases).
+func (h *Handler) multiDatabase() bool {
+	return len(h.databases) > 0 || h.discover
+}
+
+// RunDatabases backs up, in turn and with opts like Run, each database of
+// Config.Databases and, with DiscoverDatabases, every other database on the
+// server of Config.Database that accepts connections, templates aside. Each
+// is stored under "<name>/", where it keeps its own tiers, retention and
+// manifests. Config.DatabaseOrder sets the order, configured databases
+// first otherwise, and the time budget of each backup, which fails once its
+// budget is spent so that the next gets its turn. A database whose backup
+// fails does not stop the others, and dependencies only order backups; the
+// failures are collected in the result and sent in one databases.failed
+// notification once every database has been tried.
+func (h *Handler) RunDatabases(ctx context.Context, opts RunOptions) (*DatabasesResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	if !h.multiDatabase() {
+		return nil, errors.New("no databases are configured")
+	}
+	dbs, err := h.listDatabases(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	if dbs, err = h.databaseOrder.sort(dbs); err != nil {
+		return nil, invalidInput(err)
+	}
+	logf(ctx, "Backing up %d databases", len(dbs))
+
+	result := &DatabasesResult{Status: "ok", RunID: runID, Action: "databases", Databases: []DatabaseResult{}}
+	var failed []string
+	for _, db := range dbs {
+		entry := DatabaseResult{Database: db.Database, Server: serverName(db), Prefix: opts.Prefix + db.Database + "/"}
+		budget, _ := lookup(h.databaseOrder.Budgets, db.Database)
+		entry.BudgetMs = budget.Milliseconds()
+		if entry.Result, err = h.runDatabaseWithin(ctx, db, opts, budget); err != nil {
+			entry.Error = err.Error()
+			failed = append(failed, db.Database)
+			logf(ctx, "Database %s failed: %v", db.Database, err)
+		}
+		result.Databases = append(result.Databases, entry)
+	}
+	if len(failed) > 0 {
+		result.Failed = len(failed)
+		result.Status = "partial"
+		if len(failed) == len(dbs) {
+			result.Status = "failed"
+		}
+		h.notify(ctx, Notification{
+			Event:   "databases.failed",
+			Message: fmt.Sprintf("Backups of %d of %d database(s) failed: %s", len(failed), len(dbs), strings.Join(failed, ", ")),
+			Fields:  map[string]string{"failed": strconv.Itoa(len(failed)), "databases": strings.Join(failed, ",")},
+		})
+	}
+	result.DurationMs = h.elapsed(start)
+	return result, nil
+}
+
+// listDatabases returns the databases RunDatabases backs up: the configured
+// ones, then those discovered on the server of h.db that are not among
+// them. Their names become key prefixes, so each must be a plain name
+// (see databaseName) other than one of the bucket's own top-level prefixes,
+// and no two may share one.
+func (h *Handler) listDatabases(ctx context.Context) ([]DatabaseConfig, error) {
+	dbs := append([]DatabaseConfig(nil), h.databases...)
+	if h.discover {
+		rows, err := h.query(ctx, h.db, databaseListQuery)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if len(row) != 1 {
+				return nil, fmt.Errorf("unexpected database row %q", row)
+			}
+			db := h.db
+			db.Database = row[0]
+			dbs = append(dbs, db)
+		}
+	}
+	var out []DatabaseConfig
+	seen := map[string]DatabaseConfig{}
+	for _, db := range dbs {
+		name := db.Database
+		if prev, ok := seen[name]; ok {
+			if sameServer(prev, db) {
+				continue // discovered, and configured already
+			}
+			return nil, fmt.Errorf("databases %s and %s would share the prefix %s/", connName(prev), connName(db), name)
+		}
+		switch {
+		case !databaseName.MatchString(name):
+			return nil, fmt.Errorf("invalid database name %q", name)
+		case reservedPrefix(name + "/"):
+			return nil, fmt.Errorf("database %s would be stored under the bucket's own %s/ prefix", name, name)
+		}
+		seen[name] = db
+		out = append(out, db)
+	}
+	return out, nil
+}
+
+// reservedPrefix reports whether prefix is one the bucket keeps backups or
+// state under, outside the databases of RunDatabases.
+func reservedPrefix(prefix string) bool {
+	for _, p := range tierPrefixes {
+		if p == prefix {
+			return true
+		}
+	}
+	for _, p := range Profiles {
+		if p.Prefix == prefix {
+			return true
+		}
+	}
+	switch prefix {
+	case statePrefix, globalsPrefix, benchPrefix, "reports/", auditLogPrefix, restoreLogPrefix, "latest/", "tenants/", "databases/":
+		return true
+	}
+	return false
+}
+
+// runDatabase backs up db with opts from a copy of h pointed at it, under
+// the prefix of its name. A database on another server than h's drops the
+// configured server identifier, as backupRun does. A failure is left to the
+// databases.failed notification of RunDatabases.
+func (h *Handler) runDatabase(ctx context.Context, db DatabaseConfig, opts RunOptions) (*Result, error) {
+	other := *h
+	if !sameServer(db, h.db) {
+		other.serverID = ""
+	}
+	other.db = db
+	labels := map[string]string{"database": db.Database}
+	for k, v := range opts.Labels {
+		labels[k] = v
+	}
+	opts.Prefix, opts.Labels = opts.Prefix+db.Database+"/", labels
+	res, err := other.run(ctx, RunID(ctx), opts)
+	if res != nil {
+		res.Database = db.Database
+	}
+	return res, err
+}
+
+// runDatabaseWithin is runDatabase bounded by budget, when positive: a backup
+// still running once it is spent is cancelled and fails, saying so.
+func (h *Handler) runDatabaseWithin(ctx context.Context, db DatabaseConfig, opts RunOptions, budget time.Duration) (*Result, error) {
+	if budget <= 0 {
+		return h.runDatabase(ctx, db, opts)
+	}
+	dbCtx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+	res, err := h.runDatabase(dbCtx, db, opts)
+	if err != nil && ctx.Err() == nil && errors.Is(dbCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("exceeded its time budget of %s: %w", budget, err)
+	}
+	return res, err
+}
+
+// serverName returns db's server as host:port.
+func serverName(db DatabaseConfig) string {
+	return db.Host + ":" + cmp.Or(db.Port, "5432")
+}
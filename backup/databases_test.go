@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunDatabases(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.db.Database = "app"
+	h.databases = []DatabaseConfig{{Host: "other", Database: "billing"}}
+	h.discover = true
+	h.query = fingerprinted(func(_ context.Context, db DatabaseConfig, query string) ([][]string, error) {
+		if query == databaseListQuery {
+			if db.Host != "localhost" {
+				t.Errorf("databases listed on %s", db.Host)
+			}
+			return [][]string{{"app"}, {"broken"}, {"postgres"}}, nil
+		}
+		return nil, nil
+	})
+	var dumped []string
+	h.dump = func(_ context.Context, db DatabaseConfig, _ DumpOptions) ([]byte, error) {
+		dumped = append(dumped, db.Host+"/"+db.Database)
+		if db.Database == "broken" {
+			return nil, errors.New("pg_dump: error: permission denied for database broken")
+		}
+		return []byte("-- dump of " + db.Database + "\n"), nil
+	}
+	var notified []Notification
+	h.notifier = func(_ context.Context, n Notification) error {
+		notified = append(notified, n)
+		return nil
+	}
+
+	res, err := h.RunDatabases(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("RunDatabases: %v", err)
+	}
+	if strings.Join(dumped, " ") != "other/billing localhost/app localhost/broken localhost/postgres" {
+		t.Errorf("dumped %v", dumped)
+	}
+	if res.Status != "partial" || res.Failed != 1 || len(res.Databases) != 4 || res.Databases[2].Error == "" {
+		t.Fatalf("result = %+v", res)
+	}
+	if len(notified) != 1 || notified[0].Event != "databases.failed" || notified[0].Fields["databases"] != "broken" {
+		t.Errorf("notifications = %+v", notified)
+	}
+	for _, name := range []string{"billing", "app", "postgres"} {
+		key := name + "/daily/2026-05-27-backup.sql"
+		if _, ok := f.objects[key]; !ok {
+			t.Errorf("%s not stored", key)
+		}
+		if m, err := h.readManifest(context.Background(), key); err != nil || m.Labels["database"] != name {
+			t.Errorf("%s manifest = %+v, %v; want it labelled with the database", key, m, err)
+		}
+	}
+	if res.Databases[0].Server != "other:5432" || res.Databases[0].Result.Database != "billing" {
+		t.Errorf("billing = %+v", res.Databases[0])
+	}
+}
+
+func TestRunDatabasesOrderAndBudgets(t *testing.T) {
+	h := newTestHandler(newFakeS3(), 7)
+	h.db.Database = "app"
+	for _, name := range []string{"analytics", "dashboards", "billing", "accounts"} {
+		h.databases = append(h.databases, DatabaseConfig{Host: "localhost", Database: name})
+	}
+	h.query = fingerprinted(func(context.Context, DatabaseConfig, string) ([][]string, error) { return nil, nil })
+	var dumped []string
+	h.dump = func(ctx context.Context, db DatabaseConfig, _ DumpOptions) ([]byte, error) {
+		dumped = append(dumped, db.Database)
+		if db.Database == "analytics" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return []byte("-- dump of " + db.Database + "\n"), nil
+	}
+	var err error
+	h.databaseOrder, err = ParseDatabaseOrder("accounts, missing", "dashboards=billing,dashboards=accounts,billing=gone", "analytics=20ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := h.RunDatabases(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("RunDatabases: %v", err)
+	}
+	if strings.Join(dumped, " ") != "accounts analytics billing dashboards" {
+		t.Errorf("dumped %v, want accounts first and dashboards after billing", dumped)
+	}
+	if res.Failed != 1 || !strings.Contains(res.Databases[1].Error, "exceeded its time budget of 20ms") || res.Databases[1].BudgetMs != 20 {
+		t.Errorf("result = %+v, want analytics stopped by its budget", res)
+	}
+	if res.Databases[3].Result == nil || res.Databases[3].BudgetMs != 0 {
+		t.Errorf("dashboards = %+v, want it backed up without a budget", res.Databases[3])
+	}
+
+	h.databaseOrder.After["accounts"] = []string{"dashboards"}
+	if _, err := h.RunDatabases(context.Background(), RunOptions{}); err == nil || !strings.Contains(err.Error(), "depend on each other") {
+		t.Errorf("cycle: err = %v", err)
+	}
+}
+
+func TestParseDatabaseOrder(t *testing.T) {
+	o, err := ParseDatabaseOrder("a,b", "c=a", "5m,big=1h")
+	if err != nil || len(o.First) != 2 || o.After["c"][0] != "a" || o.Budgets[""] != 5*time.Minute || o.Budgets["big"] != time.Hour {
+		t.Errorf("ParseDatabaseOrder = %+v, %v", o, err)
+	}
+	for _, args := range [][3]string{{"a,a", "", ""}, {"", "c", ""}, {"", "c=c", ""}, {"", "", "big=soon"}, {"", "", "-1m"}} {
+		if _, err := ParseDatabaseOrder(args[0], args[1], args[2]); err == nil {
+			t.Errorf("ParseDatabaseOrder%q should fail", args)
+		}
+	}
+}
+
+func TestListDatabasesRejectsPrefixes(t *testing.T) {
+	for _, dbs := range [][]DatabaseConfig{
+		{{Host: "a", Database: "daily"}},
+		{{Host: "a", Database: "state"}},
+		{{Host: "a", Database: "bad/name"}},
+		{{Host: "a", Database: "orders"}, {Host: "b", Database: "orders"}},
+	} {
+		h := newTestHandler(newFakeS3(), 7)
+		h.databases = dbs
+		if _, err := h.listDatabases(context.Background()); err == nil {
+			t.Errorf("listDatabases(%+v) succeeded", dbs)
+		}
+	}
+}
+
+func TestDispatchRunsDatabases(t *testing.T) {
+	f := newFakeS3()
+	e := eventHandler(f, "", staticDump([]byte("dump")))
+	e.handler.databases = []DatabaseConfig{{Host: "a", Database: "broken"}, {Host: "a", Database: "orders"}}
+	e.handler.dump = func(_ context.Context, db DatabaseConfig, _ DumpOptions) ([]byte, error) {
+		if db.Database == "broken" {
+			return nil, errors.New("connection refused")
+		}
+		return []byte("dump"), nil
+	}
+
+	_, err := e.dispatch(context.Background(), json.RawMessage(`{}`))
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 database backup(s) failed: broken: ") {
+		t.Errorf("dispatch error = %v", err)
+	}
+	if _, ok := f.objects["orders/daily/2026-05-27-backup.sql"]; !ok {
+		t.Error("orders not backed up past the failed database")
+	}
+}
@@ -0,0 +1,157 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DatabaseSource returns the database the Handler connects to, read at
+// invocation time instead of from its configuration (see
+// SecretsManagerDatabase). refresh asks for the source to be read again
+// rather than from a cache, after the database rejected the credentials.
+type DatabaseSource func(ctx context.Context, refresh bool) (DatabaseConfig, error)
+
+// SecretsManagerDatabase returns a DatabaseSource reading the database from
+// the secret secretID with fetch, so DATABASE_URL, or its password, need not
+// be kept in the function's environment. The secret is either a connection
+// string or a JSON object as RDS and Secrets Manager rotation write it,
+// {"username", "password", "host", "port", "dbname", ...}; what it leaves
+// out, such as the host of an RDS-managed secret holding only the username
+// and password, comes from base, as do the session settings. The secret is
+// read on first use, again once refresh has passed (never, when refresh is
+// 0), and at once when asked to, so a rotated password is picked up without
+// a redeploy. A failed refresh keeps the previous value. Passwords read are
+// registered with RegisterSecret.
+func SecretsManagerDatabase(fetch SecretFetcher, secretID string, refresh time.Duration, base DatabaseConfig) DatabaseSource {
+	var (
+		mu      sync.Mutex
+		current DatabaseConfig
+		fetched time.Time
+	)
+	return func(ctx context.Context, force bool) (DatabaseConfig, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		stale := refresh > 0 && time.Since(fetched) >= refresh
+		if !fetched.IsZero() && !stale && !force {
+			return current, nil
+		}
+		value, err := fetch(ctx, secretID)
+		if err == nil {
+			var db DatabaseConfig
+			db, err = parseDatabaseSecret(value, base)
+			if err == nil {
+				RegisterSecret(db.Password)
+				current, fetched = db, time.Now()
+				return current, nil
+			}
+		}
+		if fetched.IsZero() {
+			return DatabaseConfig{}, fmt.Errorf("failed to read database secret: %w", err)
+		}
+		logf(ctx, "Warning: failed to refresh database secret, keeping the previous value: %v", err)
+		return current, nil
+	}
+}
+
+// parseDatabaseSecret parses the value of a database secret (see
+// SecretsManagerDatabase) over base.
+func parseDatabaseSecret(value string, base DatabaseConfig) (DatabaseConfig, error) {
+	value = strings.TrimSpace(value)
+	db := base
+	if !strings.HasPrefix(value, "{") {
+		if value == "" {
+			return DatabaseConfig{}, errors.New("database secret is empty")
+		}
+		parsed, err := ParseDatabaseURL(value)
+		if err != nil {
+			return DatabaseConfig{}, fmt.Errorf("invalid database secret: %w", err)
+		}
+		db.Host, db.Port, db.User, db.Password, db.Database = parsed.Host, parsed.Port, parsed.User, parsed.Password, parsed.Database
+		db.ApplicationName = cmp.Or(parsed.ApplicationName, db.ApplicationName)
+		db.Options = cmp.Or(parsed.Options, db.Options)
+		db.ConnectTimeout = cmp.Or(parsed.ConnectTimeout, db.ConnectTimeout)
+		return db, nil
+	}
+	var s struct {
+		Username string          `json:"username"`
+		Password string          `json:"password"`
+		Host     string          `json:"host"`
+		Port     json.RawMessage `json:"port"` // a number as RDS writes it, or a string
+		DBName   string          `json:"dbname"`
+		Database string          `json:"database"`
+	}
+	if err := json.Unmarshal([]byte(value), &s); err != nil {
+		return DatabaseConfig{}, fmt.Errorf("invalid database secret: %w", err)
+	}
+	var port string
+	if len(s.Port) > 0 && string(s.Port) != "null" {
+		if err := json.Unmarshal(s.Port, &port); err != nil {
+			var n int
+			if err := json.Unmarshal(s.Port, &n); err != nil {
+				return DatabaseConfig{}, fmt.Errorf("invalid port %s in database secret", s.Port)
+			}
+			port = strconv.Itoa(n)
+		}
+	}
+	db.User = cmp.Or(s.Username, db.User)
+	db.Password = cmp.Or(s.Password, db.Password)
+	db.Host = cmp.Or(s.Host, db.Host)
+	db.Port = cmp.Or(port, db.Port, "5432")
+	db.Database = cmp.Or(s.DBName, s.Database, db.Database, "postgres")
+	switch {
+	case db.Host == "":
+		return DatabaseConfig{}, errors.New(`database secret has no "host" and DATABASE_URL names none`)
+	case db.User == "":
+		return DatabaseConfig{}, errors.New(`database secret has no "username"`)
+	}
+	return db, nil
+}
+
+// RefreshDatabase reads the database of Config.DatabaseSource, when set, into
+// the Handler, as Dispatch does for every invocation; callers of the other
+// methods call it once before. A tenant registry that defaulted to the
+// database follows it.
+func (h *Handler) RefreshDatabase(ctx context.Context) error {
+	return h.loadDatabase(ctx, false)
+}
+
+// loadDatabase is RefreshDatabase, reading the source again when refresh is
+// set. The default application name of New is kept.
+func (h *Handler) loadDatabase(ctx context.Context, refresh bool) error {
+	if h.dbSource == nil {
+		return nil
+	}
+	db, err := h.dbSource(ctx, refresh)
+	if err != nil {
+		return err
+	}
+	db.ApplicationName = cmp.Or(db.ApplicationName, h.db.ApplicationName)
+	if h.tenants.Database == h.db {
+		h.tenants.Database = db
+	}
+	h.db = db
+	return nil
+}
+
+// retryRotated reports whether a run that failed with err should be retried:
+// the database rejected the credentials, and those read again from
+// Config.DatabaseSource differ, as when the password was rotated since the
+// secret was cached.
+func (h *Handler) retryRotated(ctx context.Context, err error) bool {
+	if h.dbSource == nil || failureClass(err) != ClassAuth {
+		return false
+	}
+	before := h.db
+	if err := h.loadDatabase(ctx, true); err != nil || h.db == before {
+		return false
+	}
+	logf(ctx, "Database credentials rotated; retrying the run")
+	return true
+}
@@ -0,0 +1,206 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DiffObject identifies a dump object by its TOC header.
+type DiffObject struct {
+	Schema string `json:"schema"` // "-" for objects outside a schema
+	Type   string `json:"type"`   // e.g. "TABLE", "INDEX", "TABLE DATA"
+	Name   string `json:"name"`
+}
+
+func (o DiffObject) String() string {
+	return fmt.Sprintf("%s %s.%s", o.Type, o.Schema, o.Name)
+}
+
+// TableDelta is the change in a table's data between two backups.
+type TableDelta struct {
+	Table string `json:"table"`  // schema-qualified table name
+	RowsA int64  `json:"rows_a"` // COPY rows in the first backup
+	RowsB int64  `json:"rows_b"` // COPY rows in the second backup
+	Delta int64  `json:"delta"`  // RowsB - RowsA
+}
+
+// DiffResult summarizes a Diff call.
+type DiffResult struct {
+	Status     string       `json:"status"`      // always "ok" on success
+	RunID      string       `json:"run_id"`      // run identifier, also prefixed to log lines
+	Action     string       `json:"action"`      // always "diff"
+	KeyA       string       `json:"key_a"`       // first backup (the baseline)
+	KeyB       string       `json:"key_b"`       // second backup
+	SizeA      int64        `json:"size_a"`      // bytes read from the first backup
+	SizeB      int64        `json:"size_b"`      // bytes read from the second backup
+	Added      []DiffObject `json:"added"`       // objects only in the second backup
+	Removed    []DiffObject `json:"removed"`     // objects only in the first backup
+	Changed    []DiffObject `json:"changed"`     // objects whose definition or data differs
+	Tables     []TableDelta `json:"tables"`      // tables whose data differs, largest row change first
+	DurationMs int64        `json:"duration_ms"` // wall-clock time of the call
+}
+
+// Diff streams the plain-format backups at keyA and keyB and summarizes how
+// they differ: dump objects added, removed and changed, and per-table row
+// counts, to explain for example an unexpected jump in backup size. Objects
+// are matched by their pg_dump TOC headers and compared by content hash, so
+// a changed owner or privilege counts as a change.
+func (h *Handler) Diff(ctx context.Context, keyA, keyB string) (*DiffResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	a, sizeA, err := h.summarizeBackup(ctx, keyA)
+	if err != nil {
+		return nil, err
+	}
+	b, sizeB, err := h.summarizeBackup(ctx, keyB)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DiffResult{
+		Status:  "ok",
+		RunID:   runID,
+		Action:  "diff",
+		KeyA:    keyA,
+		KeyB:    keyB,
+		SizeA:   sizeA,
+		SizeB:   sizeB,
+		Added:   []DiffObject{},
+		Removed: []DiffObject{},
+		Changed: []DiffObject{},
+		Tables:  []TableDelta{},
+	}
+	for id, objA := range a {
+		objB, ok := b[id]
+		switch {
+		case !ok:
+			result.Removed = append(result.Removed, id)
+		case objA.sum != objB.sum:
+			result.Changed = append(result.Changed, id)
+		default:
+			continue
+		}
+		if id.Type == "TABLE DATA" {
+			result.Tables = append(result.Tables, TableDelta{Table: id.Schema + "." + id.Name, RowsA: objA.rows, RowsB: objB.rows, Delta: objB.rows - objA.rows})
+		}
+	}
+	for id, objB := range b {
+		if _, ok := a[id]; ok {
+			continue
+		}
+		result.Added = append(result.Added, id)
+		if id.Type == "TABLE DATA" {
+			result.Tables = append(result.Tables, TableDelta{Table: id.Schema + "." + id.Name, RowsB: objB.rows, Delta: objB.rows})
+		}
+	}
+	for _, objs := range [][]DiffObject{result.Added, result.Removed, result.Changed} {
+		sort.Slice(objs, func(i, j int) bool { return objs[i].String() < objs[j].String() })
+	}
+	sort.Slice(result.Tables, func(i, j int) bool {
+		di, dj := abs(result.Tables[i].Delta), abs(result.Tables[j].Delta)
+		if di != dj {
+			return di > dj
+		}
+		return result.Tables[i].Table < result.Tables[j].Table
+	})
+	logf(ctx, "Diff %s..%s: %d added, %d removed, %d changed", keyA, keyB, len(result.Added), len(result.Removed), len(result.Changed))
+	result.DurationMs = h.elapsed(start)
+	return result, nil
+}
+
+// dumpObjectSummary is what Diff keeps per dump object.
+type dumpObjectSummary struct {
+	sum  string // SHA-256 of the object's lines
+	rows int64  // COPY data rows
+}
+
+// summarizeBackup streams the backup at key through summarizeDump, returning
+// its summary and the number of bytes read.
+func (h *Handler) summarizeBackup(ctx context.Context, key string) (map[DiffObject]dumpObjectSummary, int64, error) {
+	body, err := h.openScript(ctx, key)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer func() { _ = body.Close() }()
+	counter := &countingReader{r: body}
+	objects, err := summarizeDump(ctx, counter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return objects, counter.n, nil
+}
+
+// summarizeDump hashes every object of a plain-format dump and counts the rows
+// of each table's COPY data. Lines before the first object (session settings)
+// are ignored.
+func summarizeDump(ctx context.Context, r io.Reader) (map[DiffObject]dumpObjectSummary, error) {
+	objects := map[DiffObject]dumpObjectSummary{}
+	var cur DiffObject
+	var sum hash.Hash
+	var rows int64
+	var inCopy bool
+	finish := func() {
+		if sum != nil {
+			objects[cur] = dumpObjectSummary{sum: fmt.Sprintf("%x", sum.Sum(nil)), rows: rows}
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), grepLineLimit)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		line := scanner.Text()
+		switch {
+		case inCopy:
+			if line == `\.` {
+				inCopy = false
+			} else {
+				rows++
+			}
+		case strings.HasPrefix(line, "COPY ") && strings.HasSuffix(line, "FROM stdin;"):
+			inCopy = true
+		default:
+			if m := tocHeader.FindStringSubmatch(line); m != nil {
+				finish()
+				cur = DiffObject{Schema: m[3], Type: m[2], Name: m[1]}
+				sum, rows = sha256.New(), 0
+			}
+		}
+		if sum != nil {
+			_, _ = io.WriteString(sum, line)
+			_, _ = sum.Write([]byte{'\n'})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	finish()
+	return objects, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,68 @@
+package backup
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-25-backup.sql", []byte(extractDump), testNow)
+	changed := strings.Replace(extractDump, "2\tbob@example.com\n", "2\tbob@example.com\n3\tcarol@example.com\n4\tdan@example.com\n", 1)
+	changed = strings.Replace(changed, `--
+-- Name: orders_user_idx; Type: INDEX; Schema: public; Owner: app
+--
+
+CREATE INDEX orders_user_idx ON public.orders USING btree (user_id);
+`, `--
+-- Name: users_created_idx; Type: INDEX; Schema: public; Owner: app
+--
+
+CREATE INDEX users_created_idx ON public.users USING btree (id);
+`, 1)
+	f.seed("daily/2026-05-26-backup.sql", []byte(changed), testNow)
+
+	res, err := newTestHandler(f, 7).Diff(context.Background(), "daily/2026-05-25-backup.sql", "daily/2026-05-26-backup.sql")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Added) != 1 || res.Added[0] != (DiffObject{Schema: "public", Type: "INDEX", Name: "users_created_idx"}) {
+		t.Errorf("added = %v", res.Added)
+	}
+	if len(res.Removed) != 1 || res.Removed[0].Name != "orders_user_idx" {
+		t.Errorf("removed = %v", res.Removed)
+	}
+	if len(res.Changed) != 1 || res.Changed[0] != (DiffObject{Schema: "public", Type: "TABLE DATA", Name: "users"}) {
+		t.Errorf("changed = %v", res.Changed)
+	}
+	want := TableDelta{Table: "public.users", RowsA: 3, RowsB: 5, Delta: 2}
+	if len(res.Tables) != 1 || res.Tables[0] != want {
+		t.Errorf("tables = %+v, want [%+v]", res.Tables, want)
+	}
+	if res.SizeA != int64(len(extractDump)) || res.SizeB != int64(len(changed)) {
+		t.Errorf("sizes = %d/%d", res.SizeA, res.SizeB)
+	}
+}
+
+func TestDiffIdenticalBackups(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/a.sql", []byte(extractDump), testNow)
+	f.seed("daily/b.sql", []byte(strings.Replace(extractDump, "SET statement_timeout = 0;", "SET statement_timeout = 5;", 1)), testNow)
+
+	res, err := newTestHandler(f, 7).Diff(context.Background(), "daily/a.sql", "daily/b.sql")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Added)+len(res.Removed)+len(res.Changed)+len(res.Tables) != 0 {
+		t.Errorf("expected no object differences (preamble is ignored), got %+v", res)
+	}
+}
+
+func TestDiffMissingBackup(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/a.sql", []byte(extractDump), testNow)
+	if _, err := newTestHandler(f, 7).Diff(context.Background(), "daily/a.sql", "daily/missing.sql"); err == nil {
+		t.Fatal("expected error for a missing backup")
+	}
+}
@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// maxDryRunObjects bounds RestoreResult.Objects; ObjectCount has them all.
+const maxDryRunObjects = 1000
+
+// estimateSample is how many of the latest RestoreRecords a dry run's
+// duration is estimated from.
+const estimateSample = 5
+
+// scanScript is what PgRestore runs instead of psql with opts.DryRun: it
+// reads the script r through, passing its TOC entries to opts.onEntry and
+// counting the tables whose data it holds, without connecting to db.
+func scanScript(_ context.Context, _ DatabaseConfig, r io.Reader, opts RestoreOptions) (RestoreStats, error) {
+	var stats RestoreStats
+	w := &tocWatcher{fn: func(entry string) {
+		if strings.HasPrefix(entry, "TABLE DATA ") {
+			stats.Tables++
+		}
+		if opts.onEntry != nil {
+			opts.onEntry(entry)
+		}
+	}}
+	if _, err := io.Copy(w, r); err != nil {
+		return stats, fmt.Errorf("failed to read the script: %w", err)
+	}
+	return stats, nil
+}
+
+// tailWriter is an io.Writer keeping the last bytes written to it, enough to
+// hold pg_dump's completion footer and the lines after it.
+type tailWriter struct {
+	tail []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	const keep = 256
+	w.tail = append(w.tail, p[max(len(p)-keep, 0):]...)
+	if len(w.tail) > keep {
+		w.tail = append(w.tail[:0], w.tail[len(w.tail)-keep:]...)
+	}
+	return len(p), nil
+}
+
+// complete reports whether the script written ends with pg_dump's completion
+// footer, as one that was not truncated does.
+func (w *tailWriter) complete() bool {
+	return bytes.Contains(w.tail, dumpFooter)
+}
+
+// estimateRestore returns how long loading size bytes would take at the rate
+// of the latest restores recorded under restoreLogPrefix, or 0 when none is
+// recorded; records that cannot be read are skipped.
+func (h *Handler) estimateRestore(ctx context.Context, size int64) time.Duration {
+	objects, err := h.listObjects(ctx, restoreLogPrefix)
+	if err != nil {
+		logf(ctx, "Warning: not estimating the restore time: %v", err)
+		return 0
+	}
+	keys := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		keys = append(keys, aws.ToString(obj.Key))
+	}
+	sort.Strings(keys)
+	var bytes, ms int64
+	for _, key := range keys[max(len(keys)-estimateSample, 0):] {
+		var rec RestoreRecord
+		if err := h.readJSON(ctx, key, &rec); err != nil || rec.Bytes <= 0 || rec.DurationMs <= 0 {
+			continue
+		}
+		bytes += rec.Bytes
+		ms += rec.DurationMs
+	}
+	if bytes == 0 {
+		return 0
+	}
+	return (time.Duration(float64(size)*float64(ms)/float64(bytes)) * time.Millisecond).Round(time.Second)
+}
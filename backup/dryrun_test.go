@@ -0,0 +1,57 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreDryRun(t *testing.T) {
+	f := newFakeS3()
+	key := "daily/2026-05-27-backup.sql"
+	dump := "--\n-- PostgreSQL database dump\n--\n" +
+		"--\n-- Name: users; Type: TABLE; Schema: public; Owner: app\n--\n\nCREATE TABLE public.users ();\n" +
+		"--\n-- Name: pgcrypto; Type: EXTENSION; Schema: -; Owner: -\n--\n\nCREATE EXTENSION pgcrypto;\n" +
+		"--\n-- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: app\n--\n\nCOPY public.users FROM stdin;\n1\talice\n\\.\n" +
+		"--\n-- PostgreSQL database dump complete\n--\n\n"
+	f.seed(key, []byte(dump), time.Time{})
+	for i, rec := range []RestoreRecord{{Bytes: 100, DurationMs: 1000}, {Bytes: 300, DurationMs: 3000}} {
+		body, _ := json.Marshal(rec)
+		f.seed(restoreRecordKey(testNow.AddDate(0, 0, -i-1), "r"), body, time.Time{})
+	}
+	h := newTestHandler(f, 7)
+	h.restore = PgRestore
+	h.query = func(context.Context, DatabaseConfig, string) ([][]string, error) {
+		t.Error("a dry run should not query the target")
+		return nil, nil
+	}
+	h.restoreChecks = []RestoreCheck{{Name: "users", SQL: "SELECT count(*) FROM users"}}
+
+	res, err := h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget, DryRun: true, CreateTarget: true})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	want := []string{"TABLE public.users", "EXTENSION pgcrypto", "TABLE DATA public.users"}
+	if !res.DryRun || res.ObjectCount != 3 || strings.Join(res.Objects, "|") != strings.Join(want, "|") || res.Tables != 1 {
+		t.Errorf("result = %+v, want objects %q", res, want)
+	}
+	// 10ms a byte, as the recorded restores went.
+	if want := (time.Duration(len(dump)) * 10 * time.Millisecond).Round(time.Second); res.EstimatedMs != want.Milliseconds() {
+		t.Errorf("estimated %dms for %d bytes, want %s", res.EstimatedMs, len(dump), want)
+	}
+	if res.Created || res.Record != "" || len(res.Checks) != 0 {
+		t.Errorf("a dry run should create, record and check nothing: %+v", res)
+	}
+	for k := range f.objects {
+		if strings.HasPrefix(k, restoreLogPrefix) && !strings.HasSuffix(k, "-r.json") {
+			t.Errorf("dry run recorded %s", k)
+		}
+	}
+
+	f.seed(key, []byte(dump[:len(dump)/2]), time.Time{})
+	if _, err := h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget, DryRun: true}); err == nil || !strings.Contains(err.Error(), "incomplete") {
+		t.Errorf("truncated dump: err = %v, want it reported incomplete", err)
+	}
+}
@@ -2,71 +2,361 @@ package backup
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// PgDump produces a SQL dump of the given database by invoking the pg_dump
-// binary. It is the default Dumper used by New. On AWS Lambda the binary ships
-// in a layer mounted at /opt/opt/bin; elsewhere it is resolved from PATH.
-func PgDump(ctx context.Context, db DatabaseConfig) ([]byte, error) {
-	// The PostgreSQL layer mounts its tools under /opt/opt on Lambda.
-	_ = os.Setenv("PATH", "/opt/opt/bin:"+os.Getenv("PATH"))
-	_ = os.Setenv("LD_LIBRARY_PATH", "/opt/opt/lib:"+os.Getenv("LD_LIBRARY_PATH"))
-	_ = os.Setenv("PGPASSWORD", db.Password)
-
-	pgDumpPath := "/opt/opt/bin/pg_dump"
-	if _, err := os.Stat(pgDumpPath); os.IsNotExist(err) {
+// DumpOptions controls what a Dumper includes in the dump.
+type DumpOptions struct {
+	Schemas          []string // only these schemas, named exactly, when any are listed (--schema)
+	ExcludeSchemas   []string // schemas skipped entirely (--exclude-schema)
+	Tables           []string // only these tables, as pg_dump patterns, when any are listed (--table)
+	ExcludeTables    []string // tables skipped entirely, as pg_dump patterns (--exclude-table)
+	ExcludeTableData []string // tables whose definition is dumped without data (--exclude-table-data)
+	SchemaOnly       bool     // dump definitions only, no data (--schema-only)
+	DataOnly         bool     // dump data only, no definitions (--data-only)
+	SkipMatviewData  bool     // leave materialized views unpopulated and store a refresh script
+	SkipUnlogged     bool     // dump unlogged tables without their data (--no-unlogged-table-data)
+	ForeignData      []string // foreign servers, as pg_dump patterns, whose tables are dumped with their data (--include-foreign-data)
+
+	// Format is FormatPlain, FormatCustom (--format=custom) or
+	// FormatDirectory (--format=directory). Filters need the plain format.
+	Format string
+	// Jobs is the number of tables a directory-format dump reads at once
+	// (--jobs), each over its own connection; 0 or 1 reads one at a time.
+	Jobs int
+	// WorkDir is where a directory-format dump is written before it is
+	// stored, such as an EFS mount for dumps larger than the function's
+	// ephemeral storage; "" means os.TempDir().
+	WorkDir string
+
+	// LockWaitTimeout makes pg_dump fail instead of queueing behind a
+	// conflicting lock for longer than this (--lock-wait-timeout); 0 waits
+	// indefinitely.
+	LockWaitTimeout time.Duration
+
+	// Slices lists large tables whose data is dumped in ranges, each stored
+	// as its own object, instead of in the main dump (see SliceSpec). Only
+	// tables of at least SliceMinSize bytes are sliced; 0 slices them all.
+	// SliceJobs slices are dumped and stored at once, each over its own
+	// connection and held in memory until stored; 0 or 1 dumps one at a time.
+	Slices       []SliceSpec
+	SliceMinSize int64
+	SliceJobs    int
+
+	// Filters post-process the plain-format dump line by line as it is
+	// read, in order (see DumpFilter); a Dumper applies them with
+	// FilterDump.
+	Filters []DumpFilter
+}
+
+// merge returns o extended by other: lists are concatenated, flags set in
+// either are set in the result, and a non-zero timeout, size, format, job
+// count or directory in other wins.
+func (o DumpOptions) merge(other DumpOptions) DumpOptions {
+	return DumpOptions{
+		Schemas:          append(append([]string(nil), o.Schemas...), other.Schemas...),
+		ExcludeSchemas:   append(append([]string(nil), o.ExcludeSchemas...), other.ExcludeSchemas...),
+		Tables:           append(append([]string(nil), o.Tables...), other.Tables...),
+		ExcludeTables:    append(append([]string(nil), o.ExcludeTables...), other.ExcludeTables...),
+		ExcludeTableData: append(append([]string(nil), o.ExcludeTableData...), other.ExcludeTableData...),
+		SchemaOnly:       o.SchemaOnly || other.SchemaOnly,
+		DataOnly:         o.DataOnly || other.DataOnly,
+		SkipMatviewData:  o.SkipMatviewData || other.SkipMatviewData,
+		SkipUnlogged:     o.SkipUnlogged || other.SkipUnlogged,
+		ForeignData:      append(append([]string(nil), o.ForeignData...), other.ForeignData...),
+		Format:           cmp.Or(other.Format, o.Format),
+		Jobs:             cmp.Or(other.Jobs, o.Jobs),
+		WorkDir:          cmp.Or(other.WorkDir, o.WorkDir),
+		LockWaitTimeout:  cmp.Or(other.LockWaitTimeout, o.LockWaitTimeout),
+		Slices:           append(append([]SliceSpec(nil), o.Slices...), other.Slices...),
+		SliceMinSize:     cmp.Or(other.SliceMinSize, o.SliceMinSize),
+		SliceJobs:        cmp.Or(other.SliceJobs, o.SliceJobs),
+		Filters:          append(append([]DumpFilter(nil), o.Filters...), other.Filters...),
+	}
+}
+
+// PgDump produces a dump of the given database by invoking the pg_dump
+// binary, stripping its timestamp comments and applying opts.Filters on the
+// fly (see FilterDump); a custom-format archive has its creation time cleared
+// instead (see clearArchiveTimestamp). It is the default Dumper used by New.
+// On AWS Lambda the binary ships in a layer mounted at /opt/opt/bin;
+// elsewhere it is resolved from PATH.
+func PgDump(ctx context.Context, db DatabaseConfig, opts DumpOptions) ([]byte, error) {
+	// The dump is filtered as it streams in, into a buffer recycled from
+	// earlier runs (see Dumper) so a warm Lambda does not regrow it from
+	// scratch every time.
+	stdout := bytes.NewBuffer(getBuffer())
+	if err := PgDumpTo(ctx, db, opts, stdout); err != nil {
+		putBuffer(stdout.Bytes())
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// PgDumpTo is PgDump writing the dump to w as pg_dump produces it, rather
+// than returning it. It is the default StreamDumper used by New. A
+// directory-format dump is written to disk first (see pgDumpDirectory).
+func PgDumpTo(ctx context.Context, db DatabaseConfig, opts DumpOptions, w io.Writer) error {
+	if opts.Format != FormatPlain && len(opts.Filters) > 0 {
+		return errors.New("dump filters need the plain dump format")
+	}
+	if len(opts.ForeignData) > 0 && opts.Format == FormatDirectory && opts.Jobs > 1 {
+		return errors.New("foreign table data cannot be dumped by parallel jobs")
+	}
+	pgDumpPath, env, err := pgTool("pg_dump", db)
+	if err != nil {
+		return err
+	}
+	if opts.Format == FormatDirectory {
+		return pgDumpDirectory(ctx, pgDumpPath, env, db, opts, w)
+	}
+
+	cmd := exec.CommandContext(ctx, pgDumpPath, pgDumpArgs(db, opts)...)
+	cmd.Env = env
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	pipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	logf(ctx, "Executing pg_dump...")
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("pg_dump failed: %w", err)
+	}
+	var src io.Reader = filterDump(pipe, opts.Filters, filterTimeFrom(ctx))
+	if opts.Format != FormatPlain {
+		src, err = stripArchiveTimestamp(pipe)
+	}
+	copyErr := err
+	if copyErr == nil {
+		_, copyErr = io.Copy(w, src)
+	}
+	if copyErr != nil {
+		// Stop pg_dump rather than wait for it to fill a pipe nobody reads.
+		_ = cmd.Process.Kill()
+	}
+	if err := cmd.Wait(); err != nil && copyErr == nil {
+		return fmt.Errorf("pg_dump failed: %w\nstderr: %s", err, Redact(stderr.String()))
+	}
+	if copyErr != nil {
+		return fmt.Errorf("failed to copy pg_dump output: %w", copyErr)
+	}
+	if stderr.Len() > 0 {
+		logf(ctx, "pg_dump stderr: %s", stderr.String())
+	}
+	return nil
+}
+
+// pgDumpDirectory runs the pg_dump at path with env to dump db in the
+// directory format, opts.Jobs tables at a time, into a temporary directory
+// under opts.WorkDir, and writes the directory to w as a tar (see
+// writeDirectoryTar). The directory is removed afterwards; it needs room for
+// the whole dump, compressed by pg_dump.
+func pgDumpDirectory(ctx context.Context, path string, env []string, db DatabaseConfig, opts DumpOptions, w io.Writer) error {
+	dir, err := os.MkdirTemp(opts.WorkDir, "pg_dump-")
+	if err != nil {
+		return fmt.Errorf("failed to create dump directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cmd := exec.CommandContext(ctx, path, append(pgDumpArgs(db, opts), "--file="+dir)...)
+	cmd.Env = env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	logf(ctx, "Executing pg_dump into %s (%d jobs)...", dir, max(opts.Jobs, 1))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_dump failed: %w\nstderr: %s", err, Redact(stderr.String()))
+	}
+	if stderr.Len() > 0 {
+		logf(ctx, "pg_dump stderr: %s", stderr.String())
+	}
+	if err := writeDirectoryTar(w, dir); err != nil {
+		return fmt.Errorf("failed to store dump directory: %w", err)
+	}
+	return nil
+}
+
+// pgTool returns the path of the named PostgreSQL client binary and the
+// environment to run it with against db (see pgEnv). The PostgreSQL layer
+// mounts its tools under /opt/opt on Lambda; elsewhere they come from PATH.
+func pgTool(name string, db DatabaseConfig) (string, []string, error) {
+	env, err := pgEnv(db)
+	if err != nil {
+		return "", nil, err
+	}
+	path := "/opt/opt/bin/" + name
+	if _, err := os.Stat(path); os.IsNotExist(err) {
 		var lookupErr error
-		pgDumpPath, lookupErr = exec.LookPath("pg_dump")
+		path, lookupErr = exec.LookPath(name)
 		if lookupErr != nil {
-			return nil, fmt.Errorf("pg_dump binary not found in /opt/opt/bin or PATH: %w", lookupErr)
+			return "", nil, fmt.Errorf("%s binary not found in /opt/opt/bin or PATH: %w", name, lookupErr)
+		}
+	}
+	return path, env, nil
+}
+
+// pgEnv returns the process environment merged with db's settings. libpq
+// variables the operator set (PGSSLMODE, PGCONNECT_TIMEOUT, PGOPTIONS, ...)
+// are kept unless db sets the same thing: PGOPTIONS is extended with
+// db.Options, whose settings win over earlier ones, and PGPASSWORD,
+// PGPASSFILE, PGAPPNAME and PGCONNECT_TIMEOUT are only replaced when db has a
+// value for them.
+func pgEnv(db DatabaseConfig) ([]string, error) {
+	env := envMap(os.Environ())
+	env["PATH"] = "/opt/opt/bin:" + env["PATH"]
+	env["LD_LIBRARY_PATH"] = "/opt/opt/lib:" + env["LD_LIBRARY_PATH"]
+	switch {
+	case db.Password == "":
+	case db.PassFile != "":
+		if err := writePgpass(db); err != nil {
+			return nil, err
+		}
+		env["PGPASSFILE"] = db.PassFile
+		delete(env, "PGPASSWORD") // it would take precedence over the file
+	default:
+		env["PGPASSWORD"] = db.Password
+	}
+	if db.ApplicationName != "" {
+		env["PGAPPNAME"] = db.ApplicationName
+	}
+	if db.Options != "" {
+		env["PGOPTIONS"] = strings.TrimSpace(env["PGOPTIONS"] + " " + db.Options)
+	}
+	if db.ConnectTimeout > 0 {
+		// libpq takes whole seconds; round up so a sub-second timeout is not 0 (no limit).
+		env["PGCONNECT_TIMEOUT"] = strconv.Itoa(int((db.ConnectTimeout + time.Second - 1) / time.Second))
+	}
+
+	out := make([]string, 0, len(env))
+	for k, v := range env {
+		out = append(out, k+"="+v)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// envMap splits KEY=VALUE entries into a map.
+func envMap(entries []string) map[string]string {
+	m := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if k, v, ok := strings.Cut(entry, "="); ok {
+			m[k] = v
 		}
 	}
+	return m
+}
+
+// writePgpass writes db.PassFile as a pgpass file holding db's password for
+// its host, port, database and user. The file is replaced on every call and
+// its mode forced to 0600, without which libpq ignores it.
+func writePgpass(db DatabaseConfig) error {
+	escape := strings.NewReplacer(`\`, `\\`, ":", `\:`)
+	field := func(v string) string {
+		if v == "" {
+			return "*" // matches anything, as libpq does for a missing value
+		}
+		return escape.Replace(v)
+	}
+	line := strings.Join([]string{field(db.Host), field(db.Port), field(db.Database), field(db.User), escape.Replace(db.Password)}, ":") + "\n"
+	if err := os.WriteFile(db.PassFile, []byte(line), 0o600); err != nil {
+		return fmt.Errorf("failed to write pgpass file: %w", err)
+	}
+	if err := os.Chmod(db.PassFile, 0o600); err != nil {
+		return fmt.Errorf("failed to write pgpass file: %w", err)
+	}
+	return nil
+}
 
-	cmd := exec.CommandContext(ctx, pgDumpPath,
-		"-h", db.Host,
-		"-p", db.Port,
-		"-U", db.User,
-		"-d", db.Database,
+// pgDumpArgs builds the pg_dump command line for db and opts.
+func pgDumpArgs(db DatabaseConfig, opts DumpOptions) []string {
+	args := append(connArgs(db),
 		"--verbose",
 		"--no-owner",
 		"--no-privileges",
-		"--clean",
-		"--if-exists",
-		"--exclude-schema=supabase_migrations",
 		"--no-comments",
 	)
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	log.Println("Executing pg_dump...")
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("pg_dump failed: %w\nstderr: %s", err, stderr.String())
+	switch opts.Format {
+	case FormatCustom:
+		args = append(args, "--format=custom")
+	case FormatDirectory:
+		args = append(args, "--format=directory")
+		if opts.Jobs > 1 {
+			args = append(args, fmt.Sprintf("--jobs=%d", opts.Jobs))
+		}
 	}
-	if stderr.Len() > 0 {
-		log.Printf("pg_dump stderr: %s", stderr.String())
+	switch {
+	case opts.DataOnly:
+		// --clean would emit DROP statements, which pg_dump rejects without
+		// the definitions they refer to.
+		args = append(args, "--data-only")
+	case opts.SchemaOnly:
+		args = append(args, "--schema-only", "--clean", "--if-exists")
+	default:
+		args = append(args, "--clean", "--if-exists")
+	}
+	// Quoted, schema names are matched literally and keep their case; excluded
+	// schemas may also be pg_dump patterns (see schemaPattern).
+	for _, schema := range opts.Schemas {
+		args = append(args, "--schema="+quoteIdent(schema))
+	}
+	for _, schema := range opts.ExcludeSchemas {
+		args = append(args, "--exclude-schema="+schemaPattern(schema))
 	}
+	for _, table := range opts.Tables {
+		args = append(args, "--table="+table)
+	}
+	for _, table := range opts.ExcludeTables {
+		args = append(args, "--exclude-table="+table)
+	}
+	if opts.LockWaitTimeout > 0 {
+		args = append(args, fmt.Sprintf("--lock-wait-timeout=%d", opts.LockWaitTimeout.Milliseconds()))
+	}
+	for _, table := range opts.ExcludeTableData {
+		args = append(args, "--exclude-table-data="+table)
+	}
+	if opts.SkipUnlogged {
+		args = append(args, "--no-unlogged-table-data")
+	}
+	if !opts.SchemaOnly {
+		// pg_dump dumps no foreign table data but for the servers named.
+		for _, server := range opts.ForeignData {
+			args = append(args, "--include-foreign-data="+server)
+		}
+	}
+	return args
+}
 
-	return stdout.Bytes(), nil
+// schemaPattern returns the --exclude-schema value of schema: quoted, so it
+// is matched literally, unless it holds pg_dump pattern characters, as in
+// pg_*, which are then left to pg_dump.
+func schemaPattern(schema string) string {
+	if strings.ContainsAny(schema, `*?[]"`) {
+		return schema
+	}
+	return quoteIdent(schema)
 }
 
-// removeTimestampComments strips the "-- Started on" / "-- Completed on" lines
-// pg_dump emits, which otherwise make byte-identical dumps appear to differ.
-func removeTimestampComments(data []byte) []byte {
-	lines := bytes.Split(data, []byte("\n"))
-	filtered := lines[:0]
-	for _, line := range lines {
-		if bytes.HasPrefix(line, []byte("-- Started on ")) ||
-			bytes.HasPrefix(line, []byte("-- Completed on ")) {
-			continue
+// connArgs returns the connection flags for db's host, port, user and
+// database, leaving out empty ones so PGHOST, PGPORT, PGUSER and PGDATABASE
+// apply.
+func connArgs(db DatabaseConfig) []string {
+	var args []string
+	for _, f := range []struct{ flag, value string }{{"-h", db.Host}, {"-p", db.Port}, {"-U", db.User}, {"-d", db.Database}} {
+		if f.value != "" {
+			args = append(args, f.flag, f.value)
 		}
-		filtered = append(filtered, line)
 	}
-	return bytes.Join(filtered, []byte("\n"))
+	return args
 }
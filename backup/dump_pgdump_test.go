@@ -10,7 +10,7 @@ func TestPgDumpBinaryNotFound(t *testing.T) {
 	// deterministically regardless of what's installed on the host.
 	t.Setenv("PATH", "/nonexistent-dir-for-test")
 
-	_, err := PgDump(context.Background(), DatabaseConfig{Host: "localhost", Database: "x"})
+	_, err := PgDump(context.Background(), DatabaseConfig{Host: "localhost", Database: "x"}, DumpOptions{})
 	if err == nil {
 		t.Fatal("expected error when pg_dump is not found, got nil")
 	}
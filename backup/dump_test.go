@@ -1,22 +1,196 @@
 package backup
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
 
-func TestRemoveTimestampComments(t *testing.T) {
-	in := []byte("-- Started on 2026-05-27 10:00:00\n" +
-		"CREATE TABLE foo (id int);\n" +
-		"-- Completed on 2026-05-27 10:00:01\n" +
-		"INSERT INTO foo VALUES (1);")
-	want := "CREATE TABLE foo (id int);\nINSERT INTO foo VALUES (1);"
+func TestPgDumpArgsExcludeSchemas(t *testing.T) {
+	db := DatabaseConfig{Host: "h", Port: "5432", User: "u", Database: "d"}
 
-	if got := string(removeTimestampComments(in)); got != want {
-		t.Errorf("removeTimestampComments() = %q, want %q", got, want)
+	args := strings.Join(pgDumpArgs(db, DumpOptions{}), " ")
+	if strings.Contains(args, "--exclude-schema") {
+		t.Errorf("default args should not exclude any schema: %s", args)
 	}
+
+	args = strings.Join(pgDumpArgs(db, DumpOptions{ExcludeSchemas: []string{"auth", "storage"}}), " ")
+	if !strings.Contains(args, `--exclude-schema="auth" --exclude-schema="storage"`) {
+		t.Errorf("exclude flags missing: %s", args)
+	}
+
+	args = strings.Join(pgDumpArgs(db, DumpOptions{ExcludeSchemas: []string{"pg_*", "tmp_?", "Audit"}}), " ")
+	if !strings.Contains(args, `--exclude-schema=pg_* --exclude-schema=tmp_? --exclude-schema="Audit"`) {
+		t.Errorf("patterns should be left unquoted: %s", args)
+	}
+}
+
+func TestPgDumpArgsSchemas(t *testing.T) {
+	db := DatabaseConfig{Host: "h", Port: "5432", User: "u", Database: "d"}
+	args := strings.Join(pgDumpArgs(db, DumpOptions{Schemas: []string{"tenant_a"}, ExcludeSchemas: []string{"auth"}}), " ")
+	if !strings.Contains(args, `--schema="tenant_a" --exclude-schema="auth"`) {
+		t.Errorf("schema flags missing: %s", args)
+	}
+}
+
+func TestPgDumpArgsTables(t *testing.T) {
+	db := DatabaseConfig{Host: "h", Port: "5432", User: "u", Database: "d"}
+	args := strings.Join(pgDumpArgs(db, DumpOptions{Tables: []string{"public.users", "public.orders"}, ExcludeTables: []string{"public.*_log"}}), " ")
+	if !strings.Contains(args, "--table=public.users --table=public.orders --exclude-table=public.*_log") {
+		t.Errorf("table flags missing: %s", args)
+	}
+}
+
+func TestPgDumpArgsExcludeTableData(t *testing.T) {
+	db := DatabaseConfig{Host: "h", Port: "5432", User: "u", Database: "d"}
+	args := pgDumpArgs(db, DumpOptions{ExcludeTableData: []string{`"public"."mv"`}})
+	if got := args[len(args)-1]; got != `--exclude-table-data="public"."mv"` {
+		t.Errorf("last arg = %s, want the exclude-table-data flag", got)
+	}
+}
+
+func TestPgDumpArgsSkipUnlogged(t *testing.T) {
+	db := DatabaseConfig{Host: "h", Port: "5432", User: "u", Database: "d"}
+	if args := strings.Join(pgDumpArgs(db, DumpOptions{}), " "); strings.Contains(args, "--no-unlogged-table-data") {
+		t.Errorf("default args should dump unlogged data: %s", args)
+	}
+	if args := strings.Join(pgDumpArgs(db, DumpOptions{SkipUnlogged: true}), " "); !strings.Contains(args, "--no-unlogged-table-data") {
+		t.Errorf("unlogged flag missing: %s", args)
+	}
+}
+
+func TestPgDumpArgsForeignData(t *testing.T) {
+	db := DatabaseConfig{Host: "h", Port: "5432", User: "u", Database: "d"}
+	args := pgDumpArgs(db, DumpOptions{ForeignData: []string{"warehouse"}})
+	if got := args[len(args)-1]; got != "--include-foreign-data=warehouse" {
+		t.Errorf("last arg = %s, want the include-foreign-data flag", got)
+	}
+	// pg_dump rejects the flag in a dump without data.
+	if args := strings.Join(pgDumpArgs(db, DumpOptions{ForeignData: []string{"warehouse"}, SchemaOnly: true}), " "); strings.Contains(args, "--include-foreign-data") {
+		t.Errorf("schema-only args = %s", args)
+	}
+}
+
+func TestPgDumpArgsLockWaitTimeout(t *testing.T) {
+	db := DatabaseConfig{Host: "h", Port: "5432", User: "u", Database: "d"}
+	if args := strings.Join(pgDumpArgs(db, DumpOptions{}), " "); strings.Contains(args, "--lock-wait-timeout") {
+		t.Errorf("default args should not set a lock wait timeout: %s", args)
+	}
+	args := strings.Join(pgDumpArgs(db, DumpOptions{LockWaitTimeout: 30 * time.Second}), " ")
+	if !strings.Contains(args, "--lock-wait-timeout=30000") {
+		t.Errorf("lock wait timeout missing: %s", args)
+	}
+}
+
+func TestPgDumpArgsFormat(t *testing.T) {
+	db := DatabaseConfig{Host: "h", Port: "5432", User: "u", Database: "d"}
+	if args := strings.Join(pgDumpArgs(db, DumpOptions{}), " "); strings.Contains(args, "--format") {
+		t.Errorf("default args should dump a plain script: %s", args)
+	}
+	if args := strings.Join(pgDumpArgs(db, DumpOptions{Format: FormatCustom}), " "); !strings.Contains(args, "--format=custom") {
+		t.Errorf("custom format missing: %s", args)
+	}
+	if args := strings.Join(pgDumpArgs(db, DumpOptions{Format: FormatDirectory, Jobs: 4}), " "); !strings.Contains(args, "--format=directory --jobs=4") {
+		t.Errorf("directory format or jobs missing: %s", args)
+	}
+}
+
+func TestDumpOptionsMergeLockWaitTimeout(t *testing.T) {
+	base := DumpOptions{LockWaitTimeout: time.Minute}
+	if got := base.merge(DumpOptions{}).LockWaitTimeout; got != time.Minute {
+		t.Errorf("merge kept %v, want the base timeout", got)
+	}
+	if got := base.merge(DumpOptions{LockWaitTimeout: time.Second}).LockWaitTimeout; got != time.Second {
+		t.Errorf("merge kept %v, want the overriding timeout", got)
+	}
+}
+
+func TestSupabaseExcludeSchemas(t *testing.T) {
+	names := SupabaseExcludeSchemas()
+	if len(names) != len(SupabaseSchemas) {
+		t.Fatalf("got %d names, want %d", len(names), len(SupabaseSchemas))
+	}
+	for _, want := range []string{"auth", "storage", "realtime", "supabase_migrations"} {
+		found := false
+		for _, n := range names {
+			found = found || n == want
+		}
+		if !found {
+			t.Errorf("%q missing from Supabase excludes", want)
+		}
+	}
+}
+
+func TestPgEnvWritesPassFile(t *testing.T) {
+	t.Setenv("PGPASSWORD", "stale")
+	path := filepath.Join(t.TempDir(), ".pgpass")
+	db := DatabaseConfig{Host: "db.example.com", Port: "5432", User: "app", Password: `p:a\ss`, Database: "app", PassFile: path}
+
+	env, err := pgEnv(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := envMap(env)
+	if v, ok := got["PGPASSWORD"]; ok {
+		t.Errorf("PGPASSWORD = %q, want it unset", v)
+	}
+	if got["PGPASSFILE"] != path {
+		t.Errorf("PGPASSFILE = %q, want %q", got["PGPASSFILE"], path)
+	}
+	if os.Getenv("PGPASSWORD") != "stale" {
+		t.Error("pgEnv should not modify the process environment")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "db.example.com:5432:app:app:p\\:a\\\\ss\n"; string(data) != want {
+		t.Errorf("pgpass = %q, want %q", data, want)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("pgpass mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestPgEnvMergesOperatorSettings(t *testing.T) {
+	t.Setenv("PGSSLMODE", "verify-full")
+	t.Setenv("PGOPTIONS", "-c statement_timeout=0")
+	t.Setenv("PGCONNECT_TIMEOUT", "30")
+	t.Setenv("PGPASSWORD", "from-env")
+
+	got := envMap(mustPgEnv(t, DatabaseConfig{Options: "-c work_mem=64MB"}))
+	want := map[string]string{
+		"PGSSLMODE":         "verify-full",
+		"PGOPTIONS":         "-c statement_timeout=0 -c work_mem=64MB",
+		"PGCONNECT_TIMEOUT": "30",
+		"PGPASSWORD":        "from-env",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+
+	got = envMap(mustPgEnv(t, DatabaseConfig{Password: "pw", ConnectTimeout: 2500 * time.Millisecond}))
+	if got["PGCONNECT_TIMEOUT"] != "3" || got["PGPASSWORD"] != "pw" {
+		t.Errorf("PGCONNECT_TIMEOUT = %q, PGPASSWORD = %q, want 3 and pw", got["PGCONNECT_TIMEOUT"], got["PGPASSWORD"])
+	}
+}
+
+func mustPgEnv(t *testing.T, db DatabaseConfig) []string {
+	t.Helper()
+	env, err := pgEnv(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
 }
 
-func TestRemoveTimestampCommentsNoComments(t *testing.T) {
-	in := []byte("line one\nline two")
-	if got := string(removeTimestampComments(in)); got != "line one\nline two" {
-		t.Errorf("removeTimestampComments() altered content without timestamps: %q", got)
+func TestConnArgsOmitsEmpty(t *testing.T) {
+	got := connArgs(DatabaseConfig{Port: "5432", Database: "app"})
+	if want := []string{"-p", "5432", "-d", "app"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("connArgs = %v, want %v", got, want)
 	}
 }
@@ -0,0 +1,219 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxExtensionsMetadata bounds the "extensions" metadata value; S3 limits all
+// user metadata on an object to 2 KB.
+const maxExtensionsMetadata = 1024
+
+// DumpInfo describes the server a dump was taken from, as far as the dump
+// itself records it. It is stored with every backup so the target of a
+// restore can be checked for compatibility.
+type DumpInfo struct {
+	ServerVersion string   `json:"server_version,omitempty"`  // "Dumped from database version" header, e.g. "15.4"
+	DumpVersion   string   `json:"pg_dump_version,omitempty"` // "Dumped by pg_dump version" header, e.g. "16.1"
+	Extensions    []string `json:"extensions,omitempty"`      // extensions created by the dump, sorted
+}
+
+// parseDumpInfo extracts a DumpInfo from a plain-format pg_dump script, or
+// from the header of an archive of another format (see archiveInfo). Fields the
+// dump does not contain are left empty.
+func parseDumpInfo(data []byte) DumpInfo {
+	var s dumpInfoScanner
+	_, _ = s.Write(data)
+	return s.result()
+}
+
+// maxDumpInfoLine is the longest line dumpInfoScanner looks at; the lines it
+// reads are short, and longer ones, like COPY rows, are skipped unbuffered.
+const maxDumpInfoLine = 4096
+
+// dumpInfoScanner is an io.Writer that collects the DumpInfo of the dump
+// written to it, for dumps that are streamed rather than held in memory.
+type dumpInfoScanner struct {
+	info    DumpInfo
+	seen    map[string]bool
+	partial []byte // start of a line not yet ended
+	long    bool   // in a line longer than maxDumpInfoLine
+	head    []byte // first archiveHeaderSize bytes, to tell the format
+}
+
+func (s *dumpInfoScanner) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(s.head) < archiveHeaderSize {
+		s.head = append(s.head, p[:min(len(p), archiveHeaderSize-len(s.head))]...)
+	}
+	if s.format() != FormatPlain {
+		return n, nil // not lines; archiveInfo reads the header
+	}
+	for len(p) > 0 {
+		line, rest, ended := bytes.Cut(p, []byte("\n"))
+		p = rest
+		switch {
+		case s.long:
+		case len(s.partial)+len(line) > maxDumpInfoLine:
+			s.long, s.partial = true, s.partial[:0]
+		case !ended:
+			s.partial = append(s.partial, line...)
+		case len(s.partial) > 0:
+			s.line(string(append(s.partial, line...)))
+			s.partial = s.partial[:0]
+		default:
+			s.line(string(line))
+		}
+		if ended {
+			s.long = false
+		}
+	}
+	return n, nil
+}
+
+// line records what the dump line holds, if anything.
+func (s *dumpInfoScanner) line(line string) {
+	switch {
+	case strings.HasPrefix(line, "-- Dumped from database version "):
+		s.info.ServerVersion = strings.TrimSpace(strings.TrimPrefix(line, "-- Dumped from database version "))
+	case strings.HasPrefix(line, "-- Dumped by pg_dump version "):
+		s.info.DumpVersion = strings.TrimSpace(strings.TrimPrefix(line, "-- Dumped by pg_dump version "))
+	case strings.HasPrefix(line, "CREATE EXTENSION IF NOT EXISTS "):
+		fields := strings.Fields(strings.TrimPrefix(line, "CREATE EXTENSION IF NOT EXISTS "))
+		if len(fields) > 0 {
+			name := strings.Trim(strings.TrimSuffix(fields[0], ";"), `"`)
+			if s.seen == nil {
+				s.seen = map[string]bool{}
+			}
+			if !s.seen[name] {
+				s.seen[name] = true
+				s.info.Extensions = append(s.info.Extensions, name)
+			}
+		}
+	}
+}
+
+// result returns the DumpInfo of what was written, including a last line
+// without a newline.
+func (s *dumpInfoScanner) result() DumpInfo {
+	if s.format() != FormatPlain {
+		return archiveInfo(s.head)
+	}
+	if len(s.partial) > 0 && !s.long {
+		s.line(string(s.partial))
+		s.partial = s.partial[:0]
+	}
+	sort.Strings(s.info.Extensions)
+	return s.info
+}
+
+// format returns the format of what was written (see dumpFormat).
+func (s *dumpInfoScanner) format() string {
+	return dumpFormat(s.head)
+}
+
+// addMetadata records info in S3 object metadata. The extension list is
+// omitted when it would not fit.
+func (info DumpInfo) addMetadata(metadata map[string]string) {
+	if info.ServerVersion != "" {
+		metadata["server-version"] = info.ServerVersion
+	}
+	if info.DumpVersion != "" {
+		metadata["pg-dump-version"] = info.DumpVersion
+	}
+	if exts := strings.Join(info.Extensions, ","); exts != "" && len(exts) <= maxExtensionsMetadata {
+		metadata["extensions"] = exts
+	}
+}
+
+// dumpInfoFromMetadata reads back a DumpInfo recorded by addMetadata.
+func dumpInfoFromMetadata(metadata map[string]string) DumpInfo {
+	info := DumpInfo{
+		ServerVersion: metadata["server-version"],
+		DumpVersion:   metadata["pg-dump-version"],
+	}
+	if exts := metadata["extensions"]; exts != "" {
+		info.Extensions = strings.Split(exts, ",")
+	}
+	return info
+}
+
+// BackupInfo returns the DumpInfo recorded on the backup stored at key. Backups
+// written before this information was recorded yield an empty DumpInfo.
+func (h *Handler) BackupInfo(ctx context.Context, key string) (DumpInfo, error) {
+	resp, err := h.headObject(ctx, key)
+	if err != nil {
+		return DumpInfo{}, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return dumpInfoFromMetadata(resp.Metadata), nil
+}
+
+// CompatibilityIssue is one reason a backup may not restore cleanly into a
+// target database.
+type CompatibilityIssue struct {
+	Blocking bool   // known to break the restore; restoring anyway requires force
+	Message  string // operator-facing description
+}
+
+// CheckCompatibility compares the DumpInfo recorded with a backup against a
+// target database, whose Extensions lists the extensions available there. A
+// restore into an older major version is blocking, since the dump may use
+// syntax or catalog features the older server lacks; missing extensions and
+// unknown versions only warn, as do extensions that need SQL run around the
+// restore (see ExtensionSteps).
+func CheckCompatibility(recorded, target DumpInfo) []CompatibilityIssue {
+	var issues []CompatibilityIssue
+	from, to := majorVersion(recorded.ServerVersion), majorVersion(target.ServerVersion)
+	switch {
+	case from == 0 || to == 0:
+		issues = append(issues, CompatibilityIssue{
+			Message: "server version unknown; cannot check version compatibility",
+		})
+	case to < from:
+		issues = append(issues, CompatibilityIssue{
+			Blocking: true,
+			Message:  fmt.Sprintf("backup is from PostgreSQL %d but the target runs %d; restoring into an older major version is not supported", from, to),
+		})
+	}
+
+	available := map[string]bool{}
+	for _, ext := range target.Extensions {
+		available[ext] = true
+	}
+	for _, ext := range recorded.Extensions {
+		steps, special := extensionSteps[ext]
+		switch {
+		case !available[ext] && special:
+			issues = append(issues, CompatibilityIssue{
+				Message: fmt.Sprintf("extension %s is used by the backup but not available on the target; %s", ext, steps.Note),
+			})
+		case !available[ext]:
+			issues = append(issues, CompatibilityIssue{
+				Message: fmt.Sprintf("extension %s is used by the backup but not available on the target", ext),
+			})
+		case len(steps.PreRestore) > 0 || len(steps.PostRestore) > 0:
+			issues = append(issues, CompatibilityIssue{
+				Message: fmt.Sprintf("extension %s needs SQL run around the restore (see extension_steps in the manifest): before %q, after %q", ext, steps.PreRestore, steps.PostRestore),
+			})
+		}
+	}
+	return issues
+}
+
+// majorVersion returns the major version of a PostgreSQL version string such
+// as "15.4" or "16.1 (Debian 16.1-1.pgdg120+1)", or 0 when it cannot be parsed.
+func majorVersion(version string) int {
+	end := strings.IndexFunc(version, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(version)
+	}
+	major, err := strconv.Atoi(version[:end])
+	if err != nil {
+		return 0
+	}
+	return major
+}
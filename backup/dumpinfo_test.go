@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sampleDump = `--
+-- PostgreSQL database dump
+--
+
+-- Dumped from database version 15.4 (Debian 15.4-1.pgdg120+1)
+-- Dumped by pg_dump version 16.1
+
+CREATE EXTENSION IF NOT EXISTS pgcrypto WITH SCHEMA public;
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp" WITH SCHEMA extensions;
+CREATE EXTENSION IF NOT EXISTS pgcrypto WITH SCHEMA public;
+CREATE TABLE public.users (id integer);
+`
+
+func TestParseDumpInfo(t *testing.T) {
+	got := parseDumpInfo([]byte(sampleDump))
+	want := DumpInfo{
+		ServerVersion: "15.4 (Debian 15.4-1.pgdg120+1)",
+		DumpVersion:   "16.1",
+		Extensions:    []string{"pgcrypto", "uuid-ossp"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDumpInfo = %+v, want %+v", got, want)
+	}
+	if info := parseDumpInfo([]byte("SELECT 1;")); !reflect.DeepEqual(info, DumpInfo{}) {
+		t.Errorf("dump without headers = %+v, want empty", info)
+	}
+}
+
+func TestDumpInfoScannerPieces(t *testing.T) {
+	// A streamed dump arrives in writes that split lines anywhere, with long
+	// COPY rows in between.
+	dump := strings.Replace(sampleDump, "CREATE TABLE", strings.Repeat("x", 2*maxDumpInfoLine)+"\nCREATE TABLE", 1)
+	want := parseDumpInfo([]byte(sampleDump))
+	for _, size := range []int{1, 7, 100, len(dump)} {
+		var s dumpInfoScanner
+		for off := 0; off < len(dump); off += size {
+			_, _ = s.Write([]byte(dump[off:min(off+size, len(dump))]))
+		}
+		if got := s.result(); !reflect.DeepEqual(got, want) {
+			t.Errorf("writes of %d bytes: %+v, want %+v", size, got, want)
+		}
+	}
+}
+
+func TestDumpInfoMetadataRoundTrip(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.dump = staticDump([]byte(sampleDump))
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	info, err := h.BackupInfo(context.Background(), res.Key)
+	if err != nil {
+		t.Fatalf("BackupInfo: %v", err)
+	}
+	if info.ServerVersion != "15.4 (Debian 15.4-1.pgdg120+1)" || len(info.Extensions) != 2 {
+		t.Errorf("BackupInfo = %+v, want the versions and extensions of the dump", info)
+	}
+}
+
+func TestDumpInfoOmitsOversizedExtensions(t *testing.T) {
+	md := map[string]string{}
+	DumpInfo{Extensions: []string{strings.Repeat("x", maxExtensionsMetadata+1)}}.addMetadata(md)
+	if _, ok := md["extensions"]; ok {
+		t.Error("an extension list over the limit should not be recorded")
+	}
+}
+
+func TestCheckCompatibility(t *testing.T) {
+	recorded := DumpInfo{ServerVersion: "16.1", Extensions: []string{"pgcrypto", "postgis"}}
+
+	issues := CheckCompatibility(recorded, DumpInfo{ServerVersion: "17.0", Extensions: []string{"pgcrypto", "postgis"}})
+	if len(issues) != 0 {
+		t.Errorf("newer target with all extensions: issues = %+v, want none", issues)
+	}
+
+	issues = CheckCompatibility(recorded, DumpInfo{ServerVersion: "15.4", Extensions: []string{"pgcrypto"}})
+	if len(issues) != 2 || !issues[0].Blocking || issues[1].Blocking {
+		t.Errorf("older target missing postgis: issues = %+v, want a blocking version issue and an extension warning", issues)
+	}
+
+	issues = CheckCompatibility(DumpInfo{}, DumpInfo{ServerVersion: "16.1"})
+	if len(issues) != 1 || issues[0].Blocking {
+		t.Errorf("unknown backup version: issues = %+v, want one non-blocking warning", issues)
+	}
+}
+
+func TestMajorVersion(t *testing.T) {
+	for in, want := range map[string]int{"15.4": 15, "16.1 (Debian 16.1-1)": 16, "9.6.24": 9, "": 0, "beta": 0} {
+		if got := majorVersion(in); got != want {
+			t.Errorf("majorVersion(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestCheckCompatibilityExtensionSteps(t *testing.T) {
+	recorded := DumpInfo{ServerVersion: "16.1", Extensions: []string{"pg_cron", "timescaledb"}}
+	issues := CheckCompatibility(recorded, DumpInfo{ServerVersion: "16.1", Extensions: []string{"timescaledb"}})
+	if len(issues) != 2 || issues[0].Blocking || issues[1].Blocking {
+		t.Fatalf("issues = %+v, want two warnings", issues)
+	}
+	if !strings.Contains(issues[0].Message, "cron.database_name") {
+		t.Errorf("missing pg_cron: %q, want its requirements", issues[0].Message)
+	}
+	if !strings.Contains(issues[1].Message, "timescaledb_pre_restore") {
+		t.Errorf("timescaledb: %q, want its restore SQL", issues[1].Message)
+	}
+}
@@ -0,0 +1,277 @@
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Ciphers recorded in the "cipher" object metadata entry.
+const (
+	CipherNone   = "none"    // stored with the bucket's default encryption only
+	CipherAWSKMS = "aws:kms" // SSE-KMS with the key recorded in "key-id"
+	CipherSSEC   = "sse-c"   // SSE-C with a customer key whose MD5 is recorded in "key-id"
+)
+
+// sseCustomerAlgorithm is the only algorithm S3 accepts for SSE-C.
+const sseCustomerAlgorithm = "AES256"
+
+// encryptionFormatVersion is the version of the encryption metadata layout
+// written by this package. Readers refuse newer versions rather than guessing.
+const encryptionFormatVersion = 1
+
+// EncryptionInfo describes how a stored backup body is encrypted. It is
+// recorded in object metadata on upload so that every backup can be read back
+// with the scheme it was written with, even after the configured scheme
+// changes.
+type EncryptionInfo struct {
+	Cipher        string // one of the Cipher* constants
+	KeyID         string // key that protects the object, when Cipher uses one
+	FormatVersion int    // encryptionFormatVersion at write time
+
+	// customerKey is the base64 SSE-C key. It is sent with every request for
+	// an SSE-C object and never recorded anywhere.
+	customerKey string
+}
+
+// encryptionFor returns the EncryptionInfo for new uploads: SSE-C with
+// customerKey when set, SSE-KMS with kmsKeyID when set, otherwise the bucket
+// default.
+func encryptionFor(kmsKeyID string, customerKey []byte) EncryptionInfo {
+	switch {
+	case len(customerKey) > 0:
+		sum := md5.Sum(customerKey)
+		return EncryptionInfo{
+			Cipher:        CipherSSEC,
+			KeyID:         base64.StdEncoding.EncodeToString(sum[:]),
+			FormatVersion: encryptionFormatVersion,
+			customerKey:   base64.StdEncoding.EncodeToString(customerKey),
+		}
+	case kmsKeyID != "":
+		return EncryptionInfo{Cipher: CipherAWSKMS, KeyID: kmsKeyID, FormatVersion: encryptionFormatVersion}
+	default:
+		return EncryptionInfo{Cipher: CipherNone, FormatVersion: encryptionFormatVersion}
+	}
+}
+
+// ParseCustomerKey decodes a base64 SSE-C key, which S3 requires to be 256
+// bits long.
+func ParseCustomerKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSE-C key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid SSE-C key: got %d bytes, want 32", len(key))
+	}
+	return key, nil
+}
+
+// addMetadata records e in the object metadata map md.
+func (e EncryptionInfo) addMetadata(md map[string]string) {
+	md["cipher"] = e.Cipher
+	md["format-version"] = strconv.Itoa(e.FormatVersion)
+	if e.KeyID != "" {
+		md["key-id"] = e.KeyID
+	}
+}
+
+// applyToPut sets the server-side encryption parameters for e on in.
+func (e EncryptionInfo) applyToPut(in *s3.PutObjectInput) {
+	switch e.Cipher {
+	case CipherAWSKMS:
+		in.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		in.SSEKMSKeyId = aws.String(e.KeyID)
+	case CipherSSEC:
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = e.customerKeyParams()
+	}
+}
+
+// applyToCopy sets the server-side encryption parameters for e on in.
+func (e EncryptionInfo) applyToCopy(in *s3.CopyObjectInput) {
+	switch e.Cipher {
+	case CipherAWSKMS:
+		in.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		in.SSEKMSKeyId = aws.String(e.KeyID)
+	case CipherSSEC:
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = e.customerKeyParams()
+	}
+}
+
+// applyToCreate sets the server-side encryption parameters for e on in. The
+// parts of an SSE-C upload each need the key as well.
+func (e EncryptionInfo) applyToCreate(in *s3.CreateMultipartUploadInput) {
+	switch e.Cipher {
+	case CipherAWSKMS:
+		in.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		in.SSEKMSKeyId = aws.String(e.KeyID)
+	case CipherSSEC:
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = e.customerKeyParams()
+	}
+}
+
+// customerKeyParams returns the SSE-C algorithm, key and key MD5 request
+// parameters for e.
+func (e EncryptionInfo) customerKeyParams() (algorithm, key, keyMD5 *string) {
+	return aws.String(sseCustomerAlgorithm), aws.String(e.customerKey), aws.String(e.KeyID)
+}
+
+// current reports whether the object described by head is already encrypted
+// the way e encrypts new uploads.
+func (e EncryptionInfo) current(head *s3.HeadObjectOutput) bool {
+	switch e.Cipher {
+	case CipherAWSKMS:
+		return head.ServerSideEncryption == types.ServerSideEncryptionAwsKms && head.Metadata["key-id"] == e.KeyID
+	case CipherSSEC:
+		return aws.ToString(head.SSECustomerKeyMD5) == e.KeyID
+	default:
+		return false
+	}
+}
+
+// encryptionFromMetadata reads the EncryptionInfo recorded in md. Objects
+// written before encryption metadata existed have no entries and are treated
+// as CipherNone, format version 0.
+func encryptionFromMetadata(md map[string]string) (EncryptionInfo, error) {
+	info := EncryptionInfo{Cipher: md["cipher"], KeyID: md["key-id"]}
+	if info.Cipher == "" {
+		info.Cipher = CipherNone
+	}
+	if v, ok := md["format-version"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return EncryptionInfo{}, fmt.Errorf("invalid format-version %q", v)
+		}
+		info.FormatVersion = n
+	}
+	return info, nil
+}
+
+// decrypter turns a stored object body into plaintext.
+type decrypter func(body io.Reader) (io.Reader, error)
+
+// passthrough is the decrypter for schemes S3 reverses server-side.
+func passthrough(body io.Reader) (io.Reader, error) { return body, nil }
+
+// decrypters maps each supported cipher to its decrypter. Adding a client-side
+// scheme means registering it here and bumping encryptionFormatVersion.
+var decrypters = map[string]decrypter{
+	CipherNone:   passthrough,
+	CipherAWSKMS: passthrough,
+	CipherSSEC:   passthrough,
+}
+
+// decrypter selects the decrypter for e, refusing unknown ciphers and format
+// versions newer than this package understands.
+func (e EncryptionInfo) decrypter() (decrypter, error) {
+	if e.FormatVersion > encryptionFormatVersion {
+		return nil, fmt.Errorf("unsupported encryption format version %d (max %d)", e.FormatVersion, encryptionFormatVersion)
+	}
+	d, ok := decrypters[e.Cipher]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher %q", e.Cipher)
+	}
+	return d, nil
+}
+
+// openObject downloads the object at key and returns its plaintext body,
+// choosing the decryption from the object's recorded EncryptionInfo and
+// decompressing it per its recorded Compression and compression reference.
+// The caller must close the returned reader.
+func (h *Handler) openObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := h.getObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(h.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, archivedError(key, err)
+	}
+	plain, err := decryptBody(resp.Body, resp.Metadata)
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("cannot decrypt %s: %w", key, err)
+	}
+	body, err := h.decompressObject(ctx, plain, resp.Metadata)
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("cannot decompress %s: %w", key, err)
+	}
+	return readCloser{body, closerFunc(func() error {
+		_ = body.Close()
+		return resp.Body.Close()
+	})}, nil
+}
+
+// decryptBody wraps body with the decrypter selected by the EncryptionInfo
+// recorded in md.
+func decryptBody(body io.Reader, md map[string]string) (io.Reader, error) {
+	info, err := encryptionFromMetadata(md)
+	if err != nil {
+		return nil, err
+	}
+	decrypt, err := info.decrypter()
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(body)
+}
+
+// readCloser pairs a (possibly wrapping) reader with the closer of the
+// underlying stream.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// headObject is HeadObject for key, supplying the configured SSE-C key when the
+// object needs it.
+func (h *Handler) headObject(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
+	return h.headObjectInput(ctx, &s3.HeadObjectInput{Bucket: aws.String(h.bucket), Key: aws.String(key)})
+}
+
+// headObjectInput is headObject for a request with other parameters set.
+func (h *Handler) headObjectInput(ctx context.Context, in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if h.encryption.Cipher != CipherSSEC {
+		return h.s3.HeadObject(ctx, in)
+	}
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = h.encryption.customerKeyParams()
+	out, err := h.s3.HeadObject(ctx, in)
+	if isBadRequest(err) {
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = nil, nil, nil
+		return h.s3.HeadObject(ctx, in)
+	}
+	return out, err
+}
+
+// getObject is GetObject with the configured SSE-C key supplied when the
+// object needs it. With SSE-C configured the key is sent first, since new
+// backups need it; S3 rejects it with 400 Bad Request on objects written
+// without it (before SSE-C was enabled), which are then read plainly.
+func (h *Handler) getObject(ctx context.Context, in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if h.encryption.Cipher != CipherSSEC {
+		return h.s3.GetObject(ctx, in)
+	}
+	keyed := *in
+	keyed.SSECustomerAlgorithm, keyed.SSECustomerKey, keyed.SSECustomerKeyMD5 = h.encryption.customerKeyParams()
+	out, err := h.s3.GetObject(ctx, &keyed)
+	if isBadRequest(err) {
+		return h.s3.GetObject(ctx, in)
+	}
+	return out, err
+}
+
+// isBadRequest reports whether err is an HTTP 400 response, which is how S3
+// rejects mismatched SSE-C parameters.
+func isBadRequest(err error) bool {
+	var status interface{ HTTPStatusCode() int }
+	return errors.As(err, &status) && status.HTTPStatusCode() == http.StatusBadRequest
+}
@@ -0,0 +1,151 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestUploadRecordsKMSEncryption(t *testing.T) {
+	f := newFakeS3()
+	h := New(Config{S3: f, Bucket: "b", KMSKeyID: "arn:aws:kms:us-west-1:123:key/abc", Dump: staticDump([]byte("x"))})
+
+	if err := h.upload(context.Background(), "daily/x.sql", []byte("x"), checksum([]byte("x"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.lastPut.ServerSideEncryption != types.ServerSideEncryptionAwsKms || aws.ToString(f.lastPut.SSEKMSKeyId) != "arn:aws:kms:us-west-1:123:key/abc" {
+		t.Errorf("SSE params = %q/%q", f.lastPut.ServerSideEncryption, aws.ToString(f.lastPut.SSEKMSKeyId))
+	}
+	md := f.objects["daily/x.sql"].metadata
+	if md["cipher"] != CipherAWSKMS || md["key-id"] != "arn:aws:kms:us-west-1:123:key/abc" || md["format-version"] != "1" {
+		t.Errorf("metadata = %v", md)
+	}
+}
+
+func TestUploadWithoutKMS(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+
+	if err := h.upload(context.Background(), "daily/x.sql", []byte("x"), checksum([]byte("x"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.lastPut.ServerSideEncryption != "" || f.lastPut.SSEKMSKeyId != nil {
+		t.Errorf("unexpected SSE params on default upload: %+v", f.lastPut)
+	}
+	if md := f.objects["daily/x.sql"].metadata; md["cipher"] != CipherNone {
+		t.Errorf("cipher = %q, want none", md["cipher"])
+	}
+}
+
+func TestEncryptionFromMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		md      map[string]string
+		want    EncryptionInfo
+		wantErr bool
+	}{
+		{"legacy object", map[string]string{"sha256": "x"}, EncryptionInfo{Cipher: CipherNone}, false},
+		{"kms", map[string]string{"cipher": "aws:kms", "key-id": "k", "format-version": "1"}, EncryptionInfo{Cipher: CipherAWSKMS, KeyID: "k", FormatVersion: 1}, false},
+		{"bad version", map[string]string{"cipher": "none", "format-version": "v2"}, EncryptionInfo{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encryptionFromMetadata(tt.md)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecrypterSelection(t *testing.T) {
+	for _, info := range []EncryptionInfo{
+		{Cipher: CipherNone},
+		{Cipher: CipherAWSKMS, KeyID: "k", FormatVersion: 1},
+	} {
+		if _, err := info.decrypter(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", info, err)
+		}
+	}
+	for _, info := range []EncryptionInfo{
+		{Cipher: "age", FormatVersion: 1},
+		{Cipher: CipherNone, FormatVersion: encryptionFormatVersion + 1},
+	} {
+		if _, err := info.decrypter(); err == nil {
+			t.Errorf("%+v: expected error, got nil", info)
+		}
+	}
+}
+
+func TestOpenObjectRejectsUnknownCipher(t *testing.T) {
+	f := newFakeS3()
+	f.objects["daily/x.sql"] = &fakeObject{body: []byte("?"), metadata: map[string]string{"cipher": "rot13"}}
+	h := newTestHandler(f, 7)
+
+	if _, err := h.openObject(context.Background(), "daily/x.sql"); err == nil {
+		t.Fatal("expected error for unknown cipher, got nil")
+	}
+}
+
+// testCustomerKey is a 256-bit SSE-C key.
+var testCustomerKey = bytes.Repeat([]byte{7}, 32)
+
+func TestSSECRoundTrip(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-25-backup.sql", []byte("legacy"), testNow)
+	h := New(Config{S3: f, Bucket: "b", SSECustomerKey: testCustomerKey, Dump: staticDump([]byte("x"))})
+	ctx := context.Background()
+
+	if err := h.upload(ctx, "daily/x.sql", []byte("secret"), checksum([]byte("secret"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if aws.ToString(f.lastPut.SSECustomerAlgorithm) != "AES256" || f.lastPut.SSECustomerKey == nil {
+		t.Errorf("SSE-C params missing on put: %+v", f.lastPut)
+	}
+	md := f.objects["daily/x.sql"].metadata
+	if md["cipher"] != CipherSSEC || md["key-id"] != aws.ToString(f.lastPut.SSECustomerKeyMD5) {
+		t.Errorf("metadata = %v", md)
+	}
+	for k, v := range md {
+		if v == aws.ToString(f.lastPut.SSECustomerKey) {
+			t.Errorf("customer key leaked into metadata entry %q", k)
+		}
+	}
+
+	for key, want := range map[string]string{"daily/x.sql": "secret", "daily/2026-05-25-backup.sql": "legacy"} {
+		body, err := h.openObject(ctx, key)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", key, err)
+		}
+		got, _ := io.ReadAll(body)
+		if string(got) != want {
+			t.Errorf("%s: body = %q, want %q", key, got, want)
+		}
+		if _, err := h.objectChecksum(ctx, key); err != nil {
+			t.Errorf("%s: checksum: %v", key, err)
+		}
+	}
+
+	if _, err := newTestHandler(f, 7).openObject(ctx, "daily/x.sql"); err == nil {
+		t.Error("expected SSE-C object to be unreadable without the key")
+	}
+}
+
+func TestParseCustomerKey(t *testing.T) {
+	if key, err := ParseCustomerKey(base64.StdEncoding.EncodeToString(testCustomerKey)); err != nil || !bytes.Equal(key, testCustomerKey) {
+		t.Errorf("ParseCustomerKey = %v, %v", key, err)
+	}
+	for _, s := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseCustomerKey(s); err == nil {
+			t.Errorf("ParseCustomerKey(%q): expected error, got nil", s)
+		}
+	}
+}
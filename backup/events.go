@@ -1,52 +1,356 @@
 package backup
 
 import (
+	"cmp"
 	"context"
 	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 )
 
 // EventHandler adapts a Handler to AWS Lambda invocations: EventBridge
-// schedules (and direct invokes) run a deduplicated backup, while API Gateway
-// v2 HTTP requests to /run run an authenticated, forced backup.
+// schedules (and direct invokes) run a deduplicated backup or the action named
+// in the payload, API Gateway v2 HTTP requests to /run run an authenticated,
+// forced backup, and SQS messages run the backup Job they describe.
 type EventHandler struct {
 	handler *Handler
 	apiKey  string
 }
 
-// NewEventHandler wraps h, authenticating HTTP requests against apiKey.
+// NewEventHandler wraps h, authenticating HTTP requests against apiKey, which
+// is registered with RegisterSecret.
 func NewEventHandler(h *Handler, apiKey string) *EventHandler {
+	RegisterSecret(apiKey)
 	return &EventHandler{handler: h, apiKey: apiKey}
 }
 
+// Invocation is the payload of a scheduled or direct Lambda invoke. Payloads
+// without an action (such as EventBridge scheduled events) run a backup, of
+// every database when several are configured (see Handler.RunDatabases);
+// payloads naming a plan run its steps instead (see Plan).
+type Invocation struct {
+	Action string `json:"action,omitempty"` // "" or "backup" (default), "tenants", "databases", "thaw", "audit", "rekey", "prune", "reconcile", "migrate-layout", "growth", "restore", "refresh-staging" or "bench"
+	Plan   string `json:"plan,omitempty"`   // configured plan to run; excludes Action
+	// Pprof profiles the invocation, storing CPU and heap profiles under
+	// state/profiles/<run ID>/ (see Handler.startProfiles).
+	Pprof bool `json:"pprof,omitempty"`
+
+	// backup, tenants, databases, prune
+	Profile string `json:"profile,omitempty"` // backup profile; "" means the configured default
+
+	// backup, tenants, databases
+	Force bool `json:"force,omitempty"` // store the backup even if it matches an older one
+
+	// backup: one-off overrides of the configuration (see backupRun)
+	DatabaseURL    string            `json:"database_url,omitempty"`    // connection string of the database to back up instead
+	Labels         map[string]string `json:"labels,omitempty"`          // recorded in the result and the manifests, as for a Job
+	ExcludeSchemas []string          `json:"exclude_schemas,omitempty"` // schemas left out of the dump, besides the configured ones
+
+	// thaw, restore
+	Key string `json:"key,omitempty"` // archived object to thaw, or backup to restore
+
+	// thaw
+	Days int    `json:"days,omitempty"` // days to keep the restored copy
+	Tier string `json:"tier,omitempty"` // retrieval tier (Standard, Bulk, Expedited)
+	Wait bool   `json:"wait,omitempty"` // poll until available within this invocation
+
+	// restore
+	Target      string `json:"target,omitempty"`        // database to restore into: a connection string, a secret ARN or a RESTORE_TARGET_ALIASES name
+	Jobs        int    `json:"jobs,omitempty"`          // tables loaded at once from a directory- or custom-format backup; 0 means RESTORE_JOBS
+	ExitOnError bool   `json:"exit_on_error,omitempty"` // stop at the first failing statement
+	// SingleTransaction loads each script or archive in one transaction,
+	// and DisableTriggers keeps triggers from firing as data is loaded
+	// (see RestoreOptions).
+	SingleTransaction bool `json:"single_transaction,omitempty"`
+	DisableTriggers   bool `json:"disable_triggers,omitempty"`
+	// AllowDifferentSource restores a backup of another database than the
+	// target's or the configured one (see RestoreOptions).
+	AllowDifferentSource bool `json:"allow_different_source,omitempty"`
+	// AllowUnsigned restores a backup whose manifest is unsigned while
+	// manifests are signed (see RestoreOptions).
+	AllowUnsigned bool `json:"allow_unsigned,omitempty"`
+	// Confirm is the target database's name, typed back to restore into
+	// one RESTORE_TARGETS does not match (see RestoreOptions).
+	Confirm string `json:"confirm,omitempty"`
+	// CreateTarget creates the target database first, from Template and
+	// owned by Owner when set (see RestoreOptions).
+	CreateTarget bool   `json:"create_target,omitempty"`
+	Template     string `json:"template,omitempty"`
+	Owner        string `json:"owner,omitempty"`
+	// Schema restores only that schema, from a backup of it alone (see
+	// RestoreOptions).
+	Schema string `json:"schema,omitempty"`
+	// Latest, LatestTier or an AsOf time (YYYY-MM-DD or RFC 3339) restore
+	// the newest backup, of LatestTier if set and stored by AsOf if set,
+	// under Prefix, instead of naming its Key (see ResolveBackup).
+	Latest     bool   `json:"latest,omitempty"`
+	LatestTier string `json:"latest_tier,omitempty"`
+	// DryRun reads and checks the backup without restoring it (see
+	// RestoreOptions).
+	DryRun bool `json:"dry_run,omitempty"`
+	// Sections restores an archive section by section, and Resume goes
+	// on after the sections and slices an earlier one restored (see
+	// RestoreOptions).
+	Sections bool `json:"sections,omitempty"`
+	Resume   bool `json:"resume,omitempty"`
+
+	// audit
+	Sample int `json:"sample,omitempty"` // backups to re-verify; 0 means the configured default
+
+	// backup, rekey, reconcile, migrate-layout
+	Prefix string `json:"prefix,omitempty"` // store the backup under this prefix; limit rekey, reconcile or migrate-layout to one prefix ("" means every tier, the whole bucket for reconcile); resolve a latest restore under it
+
+	// reconcile
+	DeleteOrphans bool `json:"delete_orphans,omitempty"` // delete sidecars whose backup is gone
+
+	// migrate-layout
+	Database string `json:"database,omitempty"` // database whose partition the backups move to; "" means the configured one
+
+	// bench
+	SizeMB int  `json:"size_mb,omitempty"` // size of the synthetic data; 0 means 100
+	Keep   bool `json:"keep,omitempty"`    // keep the synthetic schema and backups
+
+	// prune
+	Simulate bool   `json:"simulate,omitempty"` // report decisions without deleting
+	AsOf     string `json:"as_of,omitempty"`    // evaluate retention at this date (YYYY-MM-DD); for restore, see Latest
+}
+
 // Dispatch routes a raw Lambda event to the HTTP handler when it is an API
-// Gateway v2 request, or to a scheduled (deduplicated) backup otherwise.
+// Gateway v2 request, to the queued jobs when it is an SQS batch, or to the
+// action named in the Invocation payload otherwise; with no action it runs a
+// scheduled (deduplicated) backup.
+//
+// Each invocation gets a fresh run identifier (see RunID), as does each job of
+// an SQS batch; errors returned to
+// Lambda carry it so a failed run can be matched with its logs, and have
+// secrets redacted since Lambda logs them. A failed invocation returns a
+// *Failure. The database is read afresh from Config.DatabaseSource, if set,
+// before each invocation (see RefreshDatabase).
 func (e *EventHandler) Dispatch(ctx context.Context, raw json.RawMessage) (any, error) {
+	ctx, runID := startRun(ctx)
+	err := e.handler.RefreshDatabase(ctx)
+	var out any
+	if err == nil {
+		out, err = e.dispatch(ctx, raw)
+	}
+	if err != nil {
+		return nil, e.failure(runID, raw, redactError(fmt.Errorf("run %s: %w", runID, err)))
+	}
+	return out, nil
+}
+
+// Handle is Dispatch for the Lambda runtime: a Failure is returned with its
+// Class as the error type and the Failure as JSON as the error message, so
+// the failure destination of an asynchronous invocation (see
+// FailedInvocationQueue in the CloudFormation template) gets it whole.
+func (e *EventHandler) Handle(ctx context.Context, raw json.RawMessage) (any, error) {
+	out, err := e.Dispatch(ctx, raw)
+	var f *Failure
+	if errors.As(err, &f) {
+		return nil, f.response()
+	}
+	return out, err
+}
+
+func (e *EventHandler) dispatch(ctx context.Context, raw json.RawMessage) (any, error) {
 	var req events.APIGatewayV2HTTPRequest
 	if err := json.Unmarshal(raw, &req); err == nil && req.RequestContext.HTTP.Method != "" {
 		return e.handleHTTP(ctx, req), nil
 	}
 
-	// Scheduled or direct invocation: no HTTP response expected, dedupe applies.
-	_, err := e.handler.Run(ctx, false)
-	return nil, err
+	var sqs events.SQSEvent
+	if err := json.Unmarshal(raw, &sqs); err == nil && isSQSEvent(sqs) {
+		return e.handleSQS(ctx, sqs), nil
+	}
+
+	var inv Invocation
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &inv); err != nil {
+			return nil, invalidInput(fmt.Errorf("invalid invocation payload: %w", err))
+		}
+	}
+	if inv.Pprof {
+		defer e.handler.startProfiles(ctx)()
+	}
+	if inv.Plan != "" {
+		if inv.Action != "" {
+			return nil, invalidInput(fmt.Errorf("invocation names both plan %q and action %q", inv.Plan, inv.Action))
+		}
+		return e.runPlan(ctx, inv.Plan)
+	}
+	out, err := e.invoke(ctx, inv)
+	if inv.Action == "" || inv.Action == "backup" {
+		// Scheduled or direct invocation: no HTTP response expected, dedupe applies.
+		return nil, err
+	}
+	return out, err
+}
+
+// invoke runs the action named by inv and returns its result.
+func (e *EventHandler) invoke(ctx context.Context, inv Invocation) (any, error) {
+	switch inv.Action {
+	case "", "backup":
+		if e.handler.multiDatabase() && inv.DatabaseURL == "" && inv.Prefix == "" {
+			return e.runDatabases(ctx, RunOptions{Profile: inv.Profile, Force: inv.Force, Labels: inv.Labels, ExcludeSchemas: inv.ExcludeSchemas})
+		}
+		h, opts, err := e.backupRun(inv)
+		if err != nil {
+			return nil, invalidInput(err)
+		}
+		return h.Run(ctx, opts)
+	case "tenants":
+		return e.handler.RunTenants(ctx, RunOptions{Profile: inv.Profile, Force: inv.Force})
+	case "databases":
+		return e.runDatabases(ctx, RunOptions{Profile: inv.Profile, Force: inv.Force, Labels: inv.Labels, ExcludeSchemas: inv.ExcludeSchemas})
+	case "thaw":
+		return e.handler.Thaw(ctx, inv.Key, ThawOptions{Days: inv.Days, Tier: inv.Tier, Wait: inv.Wait})
+	case "audit":
+		return e.handler.Audit(ctx, inv.Sample)
+	case "rekey":
+		return e.handler.Rekey(ctx, inv.Prefix)
+	case "reconcile":
+		return e.handler.Reconcile(ctx, ReconcileOptions{Prefix: inv.Prefix, DeleteOrphans: inv.DeleteOrphans})
+	case "migrate-layout":
+		return e.handler.MigrateLayout(ctx, MigrateLayoutOptions{Prefix: inv.Prefix, Database: inv.Database})
+	case "growth":
+		return e.handler.GrowthReport(ctx)
+	case "prune":
+		opts := PruneOptions{Profile: inv.Profile, Simulate: inv.Simulate}
+		if inv.AsOf != "" {
+			asOf, err := time.Parse("2006-01-02", inv.AsOf)
+			if err != nil {
+				return nil, invalidInput(fmt.Errorf("invalid as_of %q: %w", inv.AsOf, err))
+			}
+			opts.AsOf = asOf
+		}
+		return e.handler.Prune(ctx, opts)
+	case "restore":
+		target, err := e.handler.ResolveTarget(ctx, inv.Target)
+		if err != nil {
+			return nil, err
+		}
+		key := inv.Key
+		if inv.Latest || inv.LatestTier != "" || inv.AsOf != "" {
+			if key != "" {
+				return nil, invalidInput(errors.New("give a key or latest, latest_tier and as_of, not both"))
+			}
+			q := BackupQuery{Prefix: inv.Prefix, Tier: inv.LatestTier}
+			if inv.AsOf != "" {
+				if q.AsOf, err = ParseAsOf(inv.AsOf); err != nil {
+					return nil, invalidInput(fmt.Errorf("invalid as_of: %w", err))
+				}
+			}
+			if key, err = e.handler.ResolveBackup(ctx, q); err != nil {
+				return nil, err
+			}
+		}
+		return e.handler.Restore(ctx, key, RestoreOptions{Target: target, Jobs: inv.Jobs, ExitOnError: inv.ExitOnError, SingleTransaction: inv.SingleTransaction, DisableTriggers: inv.DisableTriggers, AllowDifferentSource: inv.AllowDifferentSource, AllowUnsigned: inv.AllowUnsigned, Confirm: inv.Confirm, CreateTarget: inv.CreateTarget, CreateTemplate: inv.Template, CreateOwner: inv.Owner, Schema: inv.Schema, DryRun: inv.DryRun, Sections: inv.Sections, Resume: inv.Resume})
+	case "refresh-staging":
+		return e.handler.RefreshStaging(ctx)
+	case "bench":
+		return e.handler.Bench(ctx, BenchOptions{Size: int64(inv.SizeMB) << 20, Keep: inv.Keep})
+	default:
+		return nil, invalidInput(fmt.Errorf("unknown action %q", inv.Action))
+	}
+}
+
+// runDatabases runs RunDatabases with opts. Once every database has been
+// tried, failed ones fail the invocation, as a failed backup does, with the
+// result still returned.
+func (e *EventHandler) runDatabases(ctx context.Context, opts RunOptions) (any, error) {
+	res, err := e.handler.RunDatabases(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if res.Failed > 0 {
+		var failed []string
+		for _, d := range res.Databases {
+			if d.Error != "" {
+				failed = append(failed, d.Database+": "+d.Error)
+			}
+		}
+		return res, fmt.Errorf("%d of %d database backup(s) failed: %s", res.Failed, len(res.Databases), strings.Join(failed, "; "))
+	}
+	return res, nil
+}
+
+// runPrefix matches the prefixes a backup invocation may store its backups
+// under: slash-terminated paths of plain names.
+var runPrefix = regexp.MustCompile(`^([A-Za-z0-9_=-][A-Za-z0-9_.=-]*/)+$`)
+
+// backupRun returns the Handler and options of the backup inv asks for, so a
+// manual invocation can back up another database, under another prefix, with
+// labels or fewer schemas, without a redeploy. A database_url naming another
+// database stores its backups under its databasePrefix unless inv.Prefix says
+// otherwise, as RunJob does; one on another server also drops the configured
+// server identifier (see Config.ServerID), so checkCollision tells the two
+// apart. The other connection settings are inherited.
+func (e *EventHandler) backupRun(inv Invocation) (*Handler, RunOptions, error) {
+	h := e.handler
+	opts := RunOptions{Profile: inv.Profile, Force: inv.Force, Prefix: inv.Prefix, Labels: inv.Labels, ExcludeSchemas: inv.ExcludeSchemas}
+	if inv.Prefix != "" && !runPrefix.MatchString(inv.Prefix) {
+		return nil, opts, fmt.Errorf("invalid prefix %q: want a path ending in /", inv.Prefix)
+	}
+	if err := validateLabels(inv.Labels); err != nil {
+		return nil, opts, err
+	}
+	for _, schema := range inv.ExcludeSchemas {
+		if schema == "" {
+			return nil, opts, errors.New("empty schema in exclude_schemas")
+		}
+	}
+	if inv.DatabaseURL == "" {
+		return h, opts, nil
+	}
+	db, err := ParseDatabaseURL(inv.DatabaseURL)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid database_url: %w", err)
+	}
+	if db.Host == "" {
+		return nil, opts, errors.New("database_url names no host")
+	}
+	RegisterSecret(db.Password)
+	if sameDatabase(db, h.db) {
+		return h, opts, nil
+	}
+	if opts.Prefix == "" {
+		if !databaseName.MatchString(db.Database) {
+			return nil, opts, fmt.Errorf("database %q cannot name a prefix; set prefix", db.Database)
+		}
+		opts.Prefix = databasePrefix(db.Database)
+	}
+	db.ApplicationName = cmp.Or(db.ApplicationName, h.db.ApplicationName)
+	db.PassFile = cmp.Or(db.PassFile, h.db.PassFile)
+	db.ConnectTimeout = cmp.Or(db.ConnectTimeout, h.db.ConnectTimeout)
+	db.Options = cmp.Or(db.Options, h.db.Options)
+	other := *h
+	if !sameServer(db, h.db) {
+		other.serverID = ""
+	}
+	other.db = db
+	return &other, opts, nil
 }
 
-// handleHTTP authenticates the request, runs a forced backup, and returns an
-// HTTP response. It never returns an error so failures surface as HTTP status
-// codes rather than Lambda errors.
+// handleHTTP authenticates the request, runs a forced backup (with the profile
+// named by the optional profile query parameter), and returns an HTTP response.
+// It never returns an error so failures surface as HTTP status codes rather
+// than Lambda errors; error bodies include the run identifier.
 func (e *EventHandler) handleHTTP(ctx context.Context, req events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPResponse {
 	if !e.authorized(req) {
 		return jsonResponse(401, map[string]string{"status": "error", "error": "unauthorized"})
 	}
 
-	result, err := e.handler.Run(ctx, true)
+	result, err := e.handler.Run(ctx, RunOptions{Force: true, Profile: req.QueryStringParameters["profile"]})
 	if err != nil {
-		log.Printf("backup failed: %v", err)
-		return jsonResponse(500, map[string]string{"status": "error", "error": err.Error()})
+		logf(ctx, "backup failed: %v", err)
+		return jsonResponse(500, map[string]string{"status": "error", "error": Redact(err.Error()), "run_id": RunID(ctx)})
 	}
 	return jsonResponse(200, result)
 }
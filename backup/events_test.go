@@ -12,7 +12,7 @@ import (
 )
 
 func eventHandler(f *fakeS3, apiKey string, dump Dumper) *EventHandler {
-	h := New(Config{S3: f, Bucket: "b", Dump: dump})
+	h := New(Config{S3: f, Bucket: "b", Dump: dump, Query: staticQuery(nil)})
 	h.now = fixedClock(time.Date(2026, 5, 27, 12, 0, 0, 0, time.UTC))
 	return NewEventHandler(h, apiKey)
 }
@@ -109,6 +109,92 @@ func TestDispatchScheduled(t *testing.T) {
 	}
 }
 
+func TestDispatchThaw(t *testing.T) {
+	f := newFakeS3()
+	f.objects["monthly/2026-01-backup.sql"] = archivedObject("GLACIER", nil)
+	e := eventHandler(f, "secret", staticDump([]byte("x")))
+	raw := json.RawMessage(`{"action":"thaw","key":"monthly/2026-01-backup.sql","tier":"Bulk"}`)
+
+	out, err := e.Dispatch(context.Background(), raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res := out.(*ThawResult); res.State != ThawRequested {
+		t.Errorf("state = %q, want requested", res.State)
+	}
+}
+
+func TestDispatchUnknownAction(t *testing.T) {
+	e := eventHandler(newFakeS3(), "secret", staticDump([]byte("x")))
+	if _, err := e.Dispatch(context.Background(), json.RawMessage(`{"action":"explode"}`)); err == nil {
+		t.Fatal("expected error for unknown action, got nil")
+	}
+}
+
+func TestDispatchBackupOverrides(t *testing.T) {
+	f := newFakeS3()
+	var db DatabaseConfig
+	var opts DumpOptions
+	e := eventHandler(f, "", func(_ context.Context, d DatabaseConfig, o DumpOptions) ([]byte, error) {
+		db, opts = d, o
+		return []byte("orders"), nil
+	})
+	e.handler.db = DatabaseConfig{Host: "main", Database: "app", ApplicationName: "backup"}
+	e.handler.serverID = "main-cluster"
+	raw := json.RawMessage(`{"database_url":"postgres://u:pw@other/orders","labels":{"reason":"migration"},"exclude_schemas":["audit"],"force":true}`)
+
+	if _, err := e.Dispatch(context.Background(), raw); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	if db.Host != "other" || db.Database != "orders" || db.ApplicationName != "backup" {
+		t.Errorf("dumped %+v, want orders on other with the configured application name", db)
+	}
+	if len(opts.ExcludeSchemas) != 1 || opts.ExcludeSchemas[0] != "audit" {
+		t.Errorf("excluded schemas = %q, want [audit]", opts.ExcludeSchemas)
+	}
+	key := "databases/orders/daily/2026-05-27-backup.sql"
+	obj, ok := f.objects[key]
+	if !ok {
+		t.Fatalf("no backup at %s", key)
+	}
+	if got := obj.metadata["source-id"]; got != "other:5432/orders" {
+		t.Errorf("source-id = %q, want the other server's", got)
+	}
+	if e.handler.db.Database != "app" || e.handler.serverID != "main-cluster" {
+		t.Error("an override must not change the configured handler")
+	}
+
+	raw = json.RawMessage(`{"prefix":"manual/","labels":{"reason":"test"}}`)
+	if _, err := e.Dispatch(context.Background(), raw); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	if db.Database != "app" || len(opts.ExcludeSchemas) != 0 {
+		t.Errorf("dumped %s excluding %q, want the configured database", db.Database, opts.ExcludeSchemas)
+	}
+	if _, ok := f.objects["manual/daily/2026-05-27-backup.sql"]; !ok {
+		t.Error("expected the backup under the given prefix")
+	}
+}
+
+func TestDispatchBackupOverridesInvalid(t *testing.T) {
+	e := eventHandler(newFakeS3(), "", staticDump([]byte("x")))
+	for _, payload := range []string{
+		`{"prefix":"../escape/"}`,
+		`{"prefix":"no-slash"}`,
+		`{"labels":{"Bad Name":"x"}}`,
+		`{"exclude_schemas":[""]}`,
+		`{"database_url":"::not a url"}`,
+		`{"database_url":"postgres:///orders"}`,
+		`{"database_url":"postgres://other/has%20space"}`,
+	} {
+		_, err := e.Dispatch(context.Background(), json.RawMessage(payload))
+		var f *Failure
+		if !errors.As(err, &f) || f.Class != ClassInvalid {
+			t.Errorf("%s: error = %v, want an invalid invocation", payload, err)
+		}
+	}
+}
+
 func TestJSONResponse(t *testing.T) {
 	resp := jsonResponse(201, map[string]string{"hello": "world"})
 	if resp.StatusCode != 201 {
@@ -121,3 +207,46 @@ func TestJSONResponse(t *testing.T) {
 		t.Errorf("body = %q", resp.Body)
 	}
 }
+
+func TestDispatchPruneSimulate(t *testing.T) {
+	f := newFakeS3()
+	seedRetentionFixture(f)
+	e := NewEventHandler(newTestHandler(f, 7), "")
+
+	out, err := e.Dispatch(context.Background(), json.RawMessage(`{"action":"prune","simulate":true,"as_of":"2026-06-10"}`))
+	if err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	res, ok := out.(*PruneResult)
+	if !ok {
+		t.Fatalf("output = %T, want *PruneResult", out)
+	}
+	if !res.Simulated || res.Deleted != 3 || len(f.objects) != 4 {
+		t.Errorf("result = %+v with %d objects left, want 3 simulated deletions and nothing removed", res, len(f.objects))
+	}
+}
+
+func TestDispatchPruneInvalidAsOf(t *testing.T) {
+	e := NewEventHandler(newTestHandler(newFakeS3(), 7), "")
+	if _, err := e.Dispatch(context.Background(), json.RawMessage(`{"action":"prune","as_of":"yesterday"}`)); err == nil {
+		t.Fatal("expected an error for an invalid as_of date")
+	}
+}
+
+func TestDispatchReconcile(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-20-backup.manifest.json", []byte("{}"), time.Now())
+	e := NewEventHandler(newTestHandler(f, 7), "")
+
+	out, err := e.Dispatch(context.Background(), json.RawMessage(`{"action":"reconcile","prefix":"daily/","delete_orphans":true}`))
+	if err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	res, ok := out.(*ReconcileResult)
+	if !ok {
+		t.Fatalf("output = %T, want *ReconcileResult", out)
+	}
+	if len(res.Findings) != 1 || !res.Findings[0].Deleted || len(f.objects) != 0 {
+		t.Errorf("result = %+v with %d objects left, want the orphan deleted", res, len(f.objects))
+	}
+}
@@ -0,0 +1,47 @@
+package backup
+
+// ExtensionSteps is what restoring a backup needs for one of the extensions it
+// creates, beyond running the dump: SQL to run in the restore session before
+// and after the dump, and what the target server must provide.
+type ExtensionSteps struct {
+	Extension   string   `json:"extension"`
+	PreRestore  []string `json:"pre_restore,omitempty"`  // run in the restore session before the dump
+	PostRestore []string `json:"post_restore,omitempty"` // run in the restore session after it
+	Note        string   `json:"note"`                   // requirements of the target server
+}
+
+// extensionSteps are the ExtensionSteps of extensions a plain dump does not
+// restore correctly on its own. Others need only be installable on the target.
+var extensionSteps = map[string]ExtensionSteps{
+	"timescaledb": {
+		PreRestore:  []string{"SELECT timescaledb_pre_restore();"},
+		PostRestore: []string{"SELECT timescaledb_post_restore();"},
+		Note:        "the target needs timescaledb in shared_preload_libraries, at the version the backup was taken with",
+	},
+	"pg_cron": {
+		Note: "the target needs pg_cron in shared_preload_libraries with cron.database_name set to the restored database; restored jobs start running on their schedule once loaded",
+	},
+	"postgis": {
+		Note: "the target needs the PostGIS libraries installed, at the same major version",
+	},
+	"postgis_topology": {
+		Note: "topology data is restored with the postgis_topology tables; the target needs the same PostGIS major version",
+	},
+	"vector": {
+		PreRestore: []string{"SET maintenance_work_mem = '1GB';"},
+		Note:       "HNSW and IVFFlat indexes are rebuilt after their data is loaded; a larger maintenance_work_mem keeps the builds in memory",
+	},
+}
+
+// restoreSteps returns the ExtensionSteps of those of extensions that need
+// any, in the order of extensions.
+func restoreSteps(extensions []string) []ExtensionSteps {
+	var steps []ExtensionSteps
+	for _, name := range extensions {
+		if s, ok := extensionSteps[name]; ok {
+			s.Extension = name
+			steps = append(steps, s)
+		}
+	}
+	return steps
+}
@@ -0,0 +1,23 @@
+package backup
+
+import (
+	"context"
+	"testing"
+)
+
+func TestManifestRecordsExtensionSteps(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.dump = staticDump([]byte("CREATE EXTENSION IF NOT EXISTS vector WITH SCHEMA public;\nCREATE EXTENSION IF NOT EXISTS pgcrypto WITH SCHEMA public;\n"))
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := h.readManifest(context.Background(), res.Key)
+	if err != nil || m == nil {
+		t.Fatalf("manifest = %v, %v", m, err)
+	}
+	if len(m.ExtensionSteps) != 1 || m.ExtensionSteps[0].Extension != "vector" || len(m.ExtensionSteps[0].PreRestore) != 1 {
+		t.Errorf("extension steps = %+v, want vector's only", m.ExtensionSteps)
+	}
+}
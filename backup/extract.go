@@ -0,0 +1,286 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// tocHeader matches the comment pg_dump writes at the start of every object in
+// a plain-format dump, e.g.
+// "-- Name: users; Type: TABLE; Schema: public; Owner: app".
+var tocHeader = regexp.MustCompile(`^-- (?:Data for )?Name: (.*); Type: (.*); Schema: (.*); Owner: (.*)$`)
+
+// simpleIdent matches identifiers pg_dump writes without quotes.
+var simpleIdent = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+// ExtractResult summarizes an ExtractTable call.
+type ExtractResult struct {
+	Status     string `json:"status"`      // always "ok" on success
+	RunID      string `json:"run_id"`      // run identifier, also prefixed to log lines
+	Action     string `json:"action"`      // always "extract-table"
+	Key        string `json:"key"`         // backup the table was extracted from
+	Table      string `json:"table"`       // schema-qualified table name
+	Entries    int    `json:"entries"`     // dump objects written (table, data, indexes, ...)
+	Rows       int64  `json:"rows"`        // COPY data rows written
+	DurationMs int64  `json:"duration_ms"` // wall-clock time of the call
+}
+
+// ExtractTable streams the plain-format backup stored at key and writes to w
+// a script holding only table: the dump's session settings, the table's
+// definition, defaults, constraints, indexes, triggers, policies, comments and
+// grants, its COPY data, and the sequences it owns. table is "schema.name" or
+// a name in the public schema, unquoted as in the dump's "Name:" headers.
+// Foreign keys to other tables are kept, so restoring the script into a
+// database without them fails at those statements.
+func (h *Handler) ExtractTable(ctx context.Context, key, table string, w io.Writer) (*ExtractResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	schema, name, ok := strings.Cut(table, ".")
+	if !ok {
+		schema, name = "public", table
+	}
+
+	body, err := h.openScript(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer func() { _ = body.Close() }()
+
+	x := newTableExtractor(schema, name, w)
+	if err := x.run(ctx, body); err != nil {
+		return nil, fmt.Errorf("failed to extract %s from %s: %w", table, key, err)
+	}
+	if x.entries == 0 {
+		return nil, fmt.Errorf("table %s.%s not found in %s", schema, name, key)
+	}
+	logf(ctx, "Extracted %s.%s from %s: %d entries, %d rows", schema, name, key, x.entries, x.rows)
+	return &ExtractResult{
+		Status:     "ok",
+		RunID:      runID,
+		Action:     "extract-table",
+		Key:        key,
+		Table:      schema + "." + name,
+		Entries:    x.entries,
+		Rows:       x.rows,
+		DurationMs: h.elapsed(start),
+	}, nil
+}
+
+// tocEntry is one object of a plain-format dump, from its header comment to
+// the next one.
+type tocEntry struct {
+	name, typ, schema string
+	lines             []string
+}
+
+// Ways a tableExtractor handles the lines of the current entry.
+const (
+	entryBuffer  = iota // kept until the entry ends, then inspected
+	entryStream         // the table's data, written as it is read
+	entryDiscard        // another table's data, dropped as it is read
+)
+
+// tableExtractor selects the entries of a plain-format dump that belong to one
+// table. Data entries are streamed or dropped as they are read; all other
+// entries are small and buffered until they end, so their bodies can be
+// inspected.
+type tableExtractor struct {
+	schema, name string
+	qualified    string // the table as written in statements, e.g. public."Users"
+	w            *bufio.Writer
+
+	cur     *tocEntry // entry being read; nil before the first header
+	mode    int       // one of the entry* modes for cur
+	inCopy  bool      // inside COPY data, where no headers are recognized
+	pending bool      // a "--" line is held back: it may open the next entry
+
+	sequences map[string]*tocEntry // unclaimed sequence definitions by name
+	owned     map[string]bool      // sequences owned by the table
+	entries   int
+	rows      int64
+}
+
+func newTableExtractor(schema, name string, w io.Writer) *tableExtractor {
+	return &tableExtractor{
+		schema:    schema,
+		name:      name,
+		qualified: dumpIdent(schema) + "." + dumpIdent(name),
+		w:         bufio.NewWriter(w),
+		sequences: map[string]*tocEntry{},
+		owned:     map[string]bool{},
+	}
+}
+
+// run reads the dump from r, writing the selected entries.
+func (x *tableExtractor) run(ctx context.Context, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), grepLineLimit)
+	preamble := true
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line := scanner.Text()
+		if x.inCopy {
+			if line == `\.` {
+				x.inCopy = false
+			} else if x.mode == entryStream {
+				x.rows++
+			}
+			x.add(line)
+			continue
+		}
+		if m := tocHeader.FindStringSubmatch(line); m != nil && x.pending {
+			x.pending = false
+			if preamble {
+				// Session settings (SET ..., search_path) precede the first entry.
+				preamble = false
+				x.flushPreamble()
+			} else {
+				x.finish()
+			}
+			x.start(tocEntry{name: m[1], typ: m[2], schema: m[3], lines: []string{"--", line}})
+			continue
+		}
+		x.releasePending()
+		if line == "--" {
+			x.pending = true
+			continue
+		}
+		if strings.HasPrefix(line, "COPY ") && strings.HasSuffix(line, "FROM stdin;") {
+			x.inCopy = true
+		}
+		x.add(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	x.releasePending()
+	x.finish()
+	return x.w.Flush()
+}
+
+// releasePending appends a held-back "--" line to the current entry.
+func (x *tableExtractor) releasePending() {
+	if x.pending {
+		x.pending = false
+		x.add("--")
+	}
+}
+
+// add handles line according to the current entry's mode.
+func (x *tableExtractor) add(line string) {
+	switch {
+	case x.mode == entryStream:
+		x.writeLine(line)
+	case x.mode == entryDiscard:
+	case x.cur != nil:
+		x.cur.lines = append(x.cur.lines, line)
+	default:
+		// Preamble, buffered in an unnamed entry.
+		x.cur = &tocEntry{lines: []string{line}}
+	}
+}
+
+// flushPreamble writes the lines read before the first entry.
+func (x *tableExtractor) flushPreamble() {
+	if x.cur != nil {
+		x.write(x.cur.lines)
+	}
+	x.cur = nil
+}
+
+// start begins entry e, streaming it when it is the table's data and
+// dropping other tables' data.
+func (x *tableExtractor) start(e tocEntry) {
+	x.cur, x.mode = &e, entryBuffer
+	switch {
+	case e.typ != "TABLE DATA":
+	case e.schema == x.schema && e.name == x.name:
+		x.mode = entryStream
+		x.emit(&e)
+	default:
+		x.mode = entryDiscard
+	}
+}
+
+// finish decides on the buffered current entry once it is complete.
+func (x *tableExtractor) finish() {
+	e, mode := x.cur, x.mode
+	x.cur, x.mode = nil, entryBuffer
+	if e == nil || mode != entryBuffer || e.schema != x.schema {
+		return
+	}
+	body := strings.Join(e.lines, "\n")
+	switch e.typ {
+	case "SEQUENCE":
+		if strings.Contains(body, "ALTER TABLE "+x.qualified+" ") {
+			// Identity column: the sequence is created by altering the table.
+			x.owned[e.name] = true
+			x.emit(e)
+		} else {
+			x.sequences[e.name] = e
+		}
+		return
+	case "SEQUENCE OWNED BY":
+		if strings.Contains(body, "OWNED BY "+x.qualified+".") {
+			x.owned[e.name] = true
+			if seq, ok := x.sequences[e.name]; ok {
+				x.emit(seq)
+				delete(x.sequences, e.name)
+			}
+			x.emit(e)
+		}
+		return
+	case "SEQUENCE SET":
+		if x.owned[e.name] {
+			x.emit(e)
+		}
+		return
+	}
+	if x.ownsName(e.name) || strings.Contains(body, " ON "+x.qualified+" ") || strings.Contains(body, " ON ONLY "+x.qualified+" ") {
+		x.emit(e)
+	}
+}
+
+// ownsName reports whether a header name belongs to the table: the table
+// itself, "<table> <object>" (constraints, defaults, triggers, policies), or
+// the "TABLE <table>"/"COLUMN <table>.<column>" names of comments and grants.
+func (x *tableExtractor) ownsName(name string) bool {
+	return name == x.name ||
+		strings.HasPrefix(name, x.name+" ") ||
+		name == "TABLE "+x.name ||
+		strings.HasPrefix(name, "COLUMN "+x.name+".")
+}
+
+func (x *tableExtractor) emit(e *tocEntry) {
+	x.entries++
+	x.write(e.lines)
+}
+
+func (x *tableExtractor) write(lines []string) {
+	for _, line := range lines {
+		x.writeLine(line)
+	}
+}
+
+// writeLine writes line to the output. Write errors are reported by the final
+// Flush.
+func (x *tableExtractor) writeLine(line string) {
+	_, _ = x.w.WriteString(line)
+	_ = x.w.WriteByte('\n')
+}
+
+// dumpIdent quotes an identifier the way pg_dump does, leaving simple
+// lower-case names bare. Reserved words, which pg_dump also quotes, are not
+// recognized.
+func dumpIdent(name string) string {
+	if simpleIdent.MatchString(name) {
+		return name
+	}
+	return quoteIdent(name)
+}
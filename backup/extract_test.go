@@ -0,0 +1,166 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+const extractDump = `--
+-- PostgreSQL database dump
+--
+
+SET statement_timeout = 0;
+SELECT pg_catalog.set_config('search_path', '', false);
+
+--
+-- Name: users; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE TABLE public.users (
+    id integer NOT NULL,
+    email text
+);
+
+--
+-- Name: users_id_seq; Type: SEQUENCE; Schema: public; Owner: app
+--
+
+CREATE SEQUENCE public.users_id_seq AS integer;
+
+--
+-- Name: users_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: app
+--
+
+ALTER SEQUENCE public.users_id_seq OWNED BY public.users.id;
+
+--
+-- Name: orders; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE TABLE public.orders (id integer, user_id integer);
+
+--
+-- Name: users id; Type: DEFAULT; Schema: public; Owner: app
+--
+
+ALTER TABLE ONLY public.users ALTER COLUMN id SET DEFAULT nextval('public.users_id_seq'::regclass);
+
+--
+-- Data for Name: orders; Type: TABLE DATA; Schema: public; Owner: app
+--
+
+COPY public.orders (id, user_id) FROM stdin;
+10	1
+\.
+
+--
+-- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: app
+--
+
+COPY public.users (id, email) FROM stdin;
+1	alice@example.com
+--
+2	bob@example.com
+\.
+
+--
+-- Name: users_id_seq; Type: SEQUENCE SET; Schema: public; Owner: app
+--
+
+SELECT pg_catalog.setval('public.users_id_seq', 2, true);
+
+--
+-- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: app
+--
+
+ALTER TABLE ONLY public.users
+    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+
+--
+-- Name: users_email_idx; Type: INDEX; Schema: public; Owner: app
+--
+
+CREATE INDEX users_email_idx ON public.users USING btree (email);
+
+--
+-- Name: orders_user_idx; Type: INDEX; Schema: public; Owner: app
+--
+
+CREATE INDEX orders_user_idx ON public.orders USING btree (user_id);
+
+--
+-- Name: orders orders_user_fkey; Type: FK CONSTRAINT; Schema: public; Owner: app
+--
+
+ALTER TABLE ONLY public.orders
+    ADD CONSTRAINT orders_user_fkey FOREIGN KEY (user_id) REFERENCES public.users(id);
+
+--
+-- Name: TABLE users; Type: ACL; Schema: public; Owner: app
+--
+
+GRANT SELECT ON TABLE public.users TO reader;
+
+--
+-- PostgreSQL database dump complete
+--
+`
+
+func TestExtractTable(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-26-backup.sql", []byte(extractDump), testNow)
+	var out bytes.Buffer
+
+	res, err := newTestHandler(f, 7).ExtractTable(context.Background(), "daily/2026-05-26-backup.sql", "users", &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Table != "public.users" || res.Entries != 9 || res.Rows != 3 {
+		t.Errorf("table=%q entries=%d rows=%d, want public.users/9/3", res.Table, res.Entries, res.Rows)
+	}
+	script := out.String()
+	for _, want := range []string{
+		"SET statement_timeout = 0;",
+		"CREATE TABLE public.users (",
+		"CREATE SEQUENCE public.users_id_seq",
+		"OWNED BY public.users.id",
+		"SET DEFAULT nextval",
+		"1\talice@example.com\n--\n2\tbob@example.com\n\\.\n",
+		"setval('public.users_id_seq'",
+		"ADD CONSTRAINT users_pkey",
+		"CREATE INDEX users_email_idx",
+		"GRANT SELECT ON TABLE public.users",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script is missing %q", want)
+		}
+	}
+	for _, unwanted := range []string{"public.orders", "10\t1"} {
+		if strings.Contains(script, unwanted) {
+			t.Errorf("script contains %q:\n%s", unwanted, script)
+		}
+	}
+	if strings.Index(script, "CREATE TABLE public.users") > strings.Index(script, "CREATE SEQUENCE") {
+		t.Error("sequence written before its table")
+	}
+}
+
+func TestExtractTableNotFound(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/x.sql", []byte(extractDump), testNow)
+	var out bytes.Buffer
+
+	if _, err := newTestHandler(f, 7).ExtractTable(context.Background(), "daily/x.sql", "audit.users", &out); err == nil {
+		t.Fatal("expected error for a table in another schema")
+	}
+}
+
+func TestDumpIdent(t *testing.T) {
+	for in, want := range map[string]string{"users": "users", "Users": `"Users"`, "order items": `"order items"`} {
+		if got := dumpIdent(in); got != want {
+			t.Errorf("dumpIdent(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/smithy-go"
+)
+
+// Failure classes (see Failure.Class).
+const (
+	ClassInvalid    = "invalid"    // the invocation, plan or profile is wrong; retrying will not help
+	ClassTimeout    = "timeout"    // the run ran out of time
+	ClassAuth       = "auth"       // the database rejected the credentials
+	ClassConnection = "connection" // the database could not be reached
+	ClassVersion    = "version"    // pg_dump is older than the server
+	ClassPermission = "permission" // AWS or the database denied an operation
+	ClassAWS        = "aws"        // another AWS error, such as a missing bucket
+	ClassDump       = "dump"       // pg_dump failed otherwise
+	ClassUnknown    = "unknown"
+)
+
+// Failure is the error Dispatch returns for a failed invocation. It describes
+// the failure well enough to act on without the logs: what was invoked, on
+// which database, in which stage of a backup run (a phase name, see Phases)
+// and of what class. Handle returns it to Lambda as JSON, which is what an
+// asynchronous invocation's failure destination receives.
+type Failure struct {
+	RunID    string `json:"run_id"`
+	Action   string `json:"action"`             // invoked action, or "plan"
+	Plan     string `json:"plan,omitempty"`     // plan that was running
+	Profile  string `json:"profile,omitempty"`  // backup profile, for the actions that take one
+	Database string `json:"database,omitempty"` // database backed up, or restored into
+	Stage    string `json:"stage,omitempty"`    // phase the backup failed in; "" outside backup runs
+	Class    string `json:"class"`
+	Message  string `json:"error"` // redacted error message, prefixed with the run identifier
+
+	err error
+}
+
+func (f *Failure) Error() string { return f.Message }
+func (f *Failure) Unwrap() error { return f.err }
+
+// response returns f as the Lambda error response whose type is f's Class and
+// whose message is f as JSON. The Lambda runtime uses a
+// messages.InvokeResponse_Error as it is, rather than naming the error's Go
+// type.
+func (f *Failure) response() messages.InvokeResponse_Error {
+	body, _ := json.Marshal(f)
+	return messages.InvokeResponse_Error{Message: string(body), Type: f.Class}
+}
+
+// failure describes err, the redacted error of invocation raw for run runID.
+func (e *EventHandler) failure(runID string, raw json.RawMessage, err error) *Failure {
+	var inv Invocation
+	_ = json.Unmarshal(raw, &inv)
+	action := cmp.Or(inv.Action, "backup")
+	if inv.Plan != "" {
+		action = "plan"
+	}
+	f := &Failure{
+		RunID:    runID,
+		Action:   action,
+		Plan:     inv.Plan,
+		Database: e.handler.db.Database,
+		Stage:    failureStage(err),
+		Class:    failureClass(err),
+		Message:  err.Error(),
+		err:      err,
+	}
+	switch action {
+	case "backup", "tenants", "prune":
+		f.Profile = cmp.Or(inv.Profile, e.handler.profile, DefaultProfile)
+		if db, err := ParseDatabaseURL(inv.DatabaseURL); action == "backup" && inv.DatabaseURL != "" && err == nil {
+			f.Database = db.Database
+		}
+	case "restore":
+		if target, err := ParseDatabaseURL(inv.Target); err == nil {
+			f.Database = target.Database
+		}
+	}
+	return f
+}
+
+// failureTag marks an error with the stage it happened in, or as invalid
+// input, without changing its message.
+type failureTag struct {
+	stage   string
+	invalid bool
+	err     error
+}
+
+func (e failureTag) Error() string { return e.err.Error() }
+func (e failureTag) Unwrap() error { return e.err }
+
+// failedIn tags err, if non-nil, as failing in phase p.
+func failedIn(p phase, err error) error {
+	if err == nil {
+		return nil
+	}
+	return failureTag{stage: phaseNames[p], err: err}
+}
+
+// invalidInput tags err, if non-nil, as caused by the invocation or the
+// configuration rather than by the run.
+func invalidInput(err error) error {
+	if err == nil {
+		return nil
+	}
+	return failureTag{invalid: true, err: err}
+}
+
+// failureStage returns the stage err is tagged with, if any.
+func failureStage(err error) string {
+	var tag failureTag
+	for e := err; errors.As(e, &tag); e = tag.err {
+		if tag.stage != "" {
+			return tag.stage
+		}
+	}
+	return ""
+}
+
+// deniedCodes are the AWS error codes of a request the credentials may not
+// make.
+var deniedCodes = map[string]bool{
+	"AccessDenied":                true,
+	"AccessDeniedException":       true,
+	"Forbidden":                   true,
+	"InvalidAccessKeyId":          true,
+	"SignatureDoesNotMatch":       true,
+	"ExpiredToken":                true,
+	"ExpiredTokenException":       true,
+	"UnrecognizedClientException": true,
+}
+
+// databaseMessages map what libpq and pg_dump print for the failures they
+// tell apart to their class, first match winning.
+var databaseMessages = []struct{ text, class string }{
+	{"password authentication failed", ClassAuth},
+	{"no pg_hba.conf entry", ClassAuth},
+	{"server version mismatch", ClassVersion},
+	{"could not connect", ClassConnection},
+	{"connection refused", ClassConnection},
+	{"could not translate host name", ClassConnection},
+	{"timeout expired", ClassConnection},
+	{"server closed the connection", ClassConnection},
+	{"permission denied", ClassPermission},
+	{"must be owner", ClassPermission},
+	{"pg_dump failed", ClassDump},
+}
+
+// failureClass returns the class of err (see the Class constants).
+func failureClass(err error) string {
+	var tag failureTag
+	for e := err; errors.As(e, &tag); e = tag.err {
+		if tag.invalid {
+			return ClassInvalid
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return ClassTimeout
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if deniedCodes[apiErr.ErrorCode()] {
+			return ClassPermission
+		}
+		return ClassAWS
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range databaseMessages {
+		if strings.Contains(msg, m.text) {
+			return m.class
+		}
+	}
+	return ClassUnknown
+}
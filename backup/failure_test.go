@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/smithy-go"
+)
+
+func TestDispatchFailure(t *testing.T) {
+	dumpErr := errors.New(`pg_dump failed: exit status 1
+stderr: pg_dump: error: connection to server failed: FATAL:  password authentication failed for user "app"`)
+	e := eventHandler(newFakeS3(), "", failingDump(dumpErr))
+	e.handler.db.Database = "app"
+
+	_, err := e.Dispatch(context.Background(), json.RawMessage(`{}`))
+	var f *Failure
+	if !errors.As(err, &f) {
+		t.Fatalf("Dispatch error = %T %v, want a *Failure", err, err)
+	}
+	if f.Action != "backup" || f.Profile != DefaultProfile || f.Database != "app" || f.Stage != "dump" || f.Class != ClassAuth {
+		t.Errorf("failure = %+v", f)
+	}
+	if f.RunID == "" || !strings.HasPrefix(f.Message, "run "+f.RunID+": ") {
+		t.Errorf("message %q does not carry run %q", f.Message, f.RunID)
+	}
+	if !errors.Is(err, dumpErr) {
+		t.Error("the failure should wrap the dump error")
+	}
+}
+
+func TestDispatchFailureInvalid(t *testing.T) {
+	e := eventHandler(newFakeS3(), "", staticDump([]byte("dump")))
+	for _, payload := range []string{`{"action":"explode"}`, `{"profile":"nope"}`, `{"plan":"nightly"}`, `not json`} {
+		_, err := e.Dispatch(context.Background(), json.RawMessage(payload))
+		var f *Failure
+		if !errors.As(err, &f) || f.Class != ClassInvalid || f.Stage != "" {
+			t.Errorf("%s: failure = %+v, want class invalid without a stage", payload, f)
+		}
+	}
+}
+
+func TestHandleFailure(t *testing.T) {
+	e := eventHandler(newFakeS3(), "", failingDump(errors.New("pg_dump failed: boom")))
+
+	_, err := e.Handle(context.Background(), json.RawMessage(`{}`))
+	resp, ok := err.(messages.InvokeResponse_Error)
+	if !ok {
+		t.Fatalf("Handle error = %T, want a messages.InvokeResponse_Error", err)
+	}
+	if resp.Type != ClassDump {
+		t.Errorf("error type = %q, want %q", resp.Type, ClassDump)
+	}
+	var f Failure
+	if err := json.Unmarshal([]byte(resp.Message), &f); err != nil {
+		t.Fatalf("error message %q is not JSON: %v", resp.Message, err)
+	}
+	if f.Class != ClassDump || f.Stage != "dump" || f.Action != "backup" || !strings.Contains(f.Message, "boom") {
+		t.Errorf("payload = %+v", f)
+	}
+
+	if _, err := e.Handle(context.Background(), json.RawMessage(`{"action":"reconcile"}`)); err != nil {
+		t.Errorf("successful invocation: %v", err)
+	}
+}
+
+func TestFailureClass(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{invalidInput(errors.New("unknown action")), ClassInvalid},
+		{failedIn(phaseDump, invalidInput(errors.New("no profile"))), ClassInvalid},
+		{fmt.Errorf("failed to upload: %w", context.DeadlineExceeded), ClassTimeout},
+		{&smithy.GenericAPIError{Code: "AccessDenied"}, ClassPermission},
+		{fmt.Errorf("failed to upload: %w", &smithy.GenericAPIError{Code: "NoSuchBucket"}), ClassAWS},
+		{errors.New(`pg_dump: error: could not translate host name "db" to address`), ClassConnection},
+		{errors.New("pg_dump: error: aborting because of server version mismatch"), ClassVersion},
+		{errors.New("pg_dump: error: query failed: ERROR:  permission denied for table secrets"), ClassPermission},
+		{errors.New("pg_dump failed: signal: killed"), ClassDump},
+		{errors.New("something else"), ClassUnknown},
+	}
+	for _, c := range cases {
+		if got := failureClass(c.err); got != c.want {
+			t.Errorf("failureClass(%v) = %q, want %q", c.err, got, c.want)
+		}
+	}
+	if got := failureStage(fmt.Errorf("wrapped: %w", failedIn(phaseUpload, errors.New("x")))); got != "upload" {
+		t.Errorf("failureStage = %q, want upload", got)
+	}
+}
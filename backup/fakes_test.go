@@ -3,9 +3,14 @@ package backup
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"fmt"
 	"io"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -15,28 +20,98 @@ import (
 
 // fakeObject is an in-memory S3 object.
 type fakeObject struct {
-	body     []byte
-	metadata map[string]string
-	modified time.Time
+	body         []byte
+	metadata     map[string]string
+	modified     time.Time
+	storageClass types.StorageClass
+	restore      *string // x-amz-restore header value, nil when never restored
+	sse          types.ServerSideEncryption
+	customerKey  string // SSE-C key MD5, "" when not SSE-C
+	versionID    string // "" when the bucket is unversioned
+	lockMode     types.ObjectLockMode
+	retainUntil  *time.Time
+	legalHold    types.ObjectLockLegalHoldStatus
+	checksum     string // base64 x-amz-checksum-sha256, "" when uploaded without one
+	etag         string // ETag of a multipart upload, "" for the MD5 of body
+}
+
+// checkCustomerKey mimics S3's SSE-C checks: SSE-C objects need their key and
+// other objects reject one.
+func (o *fakeObject) checkCustomerKey(keyMD5 *string) error {
+	if aws.ToString(keyMD5) != o.customerKey {
+		return fakeStatusError{status: 400}
+	}
+	return nil
+}
+
+// eTag returns the object's ETag as S3 reports it.
+func (o *fakeObject) eTag() string {
+	if o.etag != "" {
+		return o.etag
+	}
+	return fmt.Sprintf(`"%x"`, md5.Sum(o.body))
+}
+
+// fakeUpload is a multipart upload in progress.
+type fakeUpload struct {
+	key         string
+	metadata    map[string]string
+	sse         types.ServerSideEncryption
+	customerKey string
+	parts       map[int32][]byte
+}
+
+// fakeStatusError is an S3 error response with an HTTP status code.
+type fakeStatusError struct{ status int }
+
+func (e fakeStatusError) Error() string       { return fmt.Sprintf("api error: StatusCode: %d", e.status) }
+func (e fakeStatusError) HTTPStatusCode() int { return e.status }
+
+// frozen reports whether the object is archived without a readable restored
+// copy, in which case S3 rejects reads with InvalidObjectState.
+func (o *fakeObject) frozen() bool {
+	if o.storageClass != types.StorageClassGlacier && o.storageClass != types.StorageClassDeepArchive {
+		return false
+	}
+	return o.restore == nil || strings.Contains(*o.restore, `ongoing-request="true"`)
 }
 
 // fakeS3 is an in-memory implementation of S3API for tests.
 type fakeS3 struct {
-	objects map[string]*fakeObject
-	clock   time.Time
-	puts    int // number of successful PutObject calls
+	objects    map[string]*fakeObject
+	clock      time.Time
+	puts       int // number of successful PutObject calls
+	restores   int // number of successful RestoreObject calls
+	lastPut    *s3.PutObjectInput
+	copies     int // number of successful CopyObject calls
+	lastCopy   *s3.CopyObjectInput
+	fullGets   int                    // GetObject calls without a Range
+	rangedGets int                    // GetObject calls with a Range
+	uploads    map[string]*fakeUpload // multipart uploads in progress, by upload ID
+	nextUpload int
+	parts      int        // number of successful UploadPart and UploadPartCopy calls
+	completes  int        // number of successful CompleteMultipartUpload calls
+	aborts     int        // number of successful AbortMultipartUpload calls
+	partMu     sync.Mutex // held by PutObject and UploadPart, called from several goroutines
+	maxParts   int        // most UploadPart calls in progress at once
+	partsNow   int
+	pageSize   int // keys per ListObjectsV2 page, in key order; 0 lists all at once
 
 	// error injection
-	listErr   error
-	putErr    error
-	deleteErr error
-	headErr   error
-	getErr    error
+	listErr    error
+	putErr     error
+	deleteErr  error
+	headErr    error
+	getErr     error
+	restoreErr error
+	copyErr    error
+	partErr    error // fails UploadPart and UploadPartCopy
 }
 
 func newFakeS3() *fakeS3 {
 	return &fakeS3{
 		objects: map[string]*fakeObject{},
+		uploads: map[string]*fakeUpload{},
 		clock:   time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
 	}
 }
@@ -58,7 +133,30 @@ func (f *fakeS3) HeadObject(_ context.Context, params *s3.HeadObjectInput, _ ...
 	if !ok {
 		return nil, fmt.Errorf("NotFound: %s", *params.Key)
 	}
-	return &s3.HeadObjectOutput{Metadata: obj.metadata}, nil
+	if err := obj.checkCustomerKey(params.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	head := &s3.HeadObjectOutput{
+		ContentLength:             aws.Int64(int64(len(obj.body))),
+		ETag:                      aws.String(obj.eTag()),
+		Metadata:                  obj.metadata,
+		StorageClass:              obj.storageClass,
+		Restore:                   obj.restore,
+		ServerSideEncryption:      obj.sse,
+		ObjectLockMode:            obj.lockMode,
+		ObjectLockRetainUntilDate: obj.retainUntil,
+		ObjectLockLegalHoldStatus: obj.legalHold,
+	}
+	if obj.versionID != "" {
+		head.VersionId = aws.String(obj.versionID)
+	}
+	if obj.checksum != "" && params.ChecksumMode == types.ChecksumModeEnabled {
+		head.ChecksumSHA256 = aws.String(obj.checksum)
+	}
+	if obj.customerKey != "" {
+		head.SSECustomerKeyMD5 = aws.String(obj.customerKey)
+	}
+	return head, nil
 }
 
 func (f *fakeS3) GetObject(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
@@ -69,10 +167,32 @@ func (f *fakeS3) GetObject(_ context.Context, params *s3.GetObjectInput, _ ...fu
 	if !ok {
 		return nil, fmt.Errorf("NoSuchKey: %s", *params.Key)
 	}
-	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(obj.body))}, nil
+	if obj.frozen() {
+		return nil, &types.InvalidObjectState{Message: aws.String("The operation is not valid for the object's storage class")}
+	}
+	if err := obj.checkCustomerKey(params.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	body := obj.body
+	if params.Range != nil {
+		var first, last int
+		if _, err := fmt.Sscanf(*params.Range, "bytes=%d-%d", &first, &last); err != nil {
+			return nil, fmt.Errorf("InvalidRange: %s", *params.Range)
+		}
+		body = body[first:min(last+1, len(body))]
+		f.rangedGets++
+	} else {
+		f.fullGets++
+	}
+	return &s3.GetObjectOutput{
+		Body:     io.NopCloser(bytes.NewReader(body)),
+		Metadata: obj.metadata,
+	}, nil
 }
 
 func (f *fakeS3) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.partMu.Lock()
+	defer f.partMu.Unlock()
 	if f.putErr != nil {
 		return nil, f.putErr
 	}
@@ -81,12 +201,15 @@ func (f *fakeS3) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...fu
 		return nil, err
 	}
 	f.objects[*params.Key] = &fakeObject{
-		body:     body,
-		metadata: params.Metadata,
-		modified: f.clock,
+		body:        body,
+		metadata:    params.Metadata,
+		modified:    f.clock,
+		sse:         params.ServerSideEncryption,
+		customerKey: aws.ToString(params.SSECustomerKeyMD5),
 	}
 	f.clock = f.clock.Add(time.Second)
 	f.puts++
+	f.lastPut = params
 	return &s3.PutObjectOutput{}, nil
 }
 
@@ -103,11 +226,22 @@ func (f *fakeS3) ListObjectsV2(_ context.Context, params *s3.ListObjectsV2Input,
 		if strings.HasPrefix(key, prefix) {
 			contents = append(contents, types.Object{
 				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(obj.body))),
 				LastModified: aws.Time(obj.modified),
 			})
 		}
 	}
-	return &s3.ListObjectsV2Output{Contents: contents}, nil
+	if f.pageSize == 0 {
+		return &s3.ListObjectsV2Output{Contents: contents}, nil
+	}
+	slices.SortFunc(contents, func(a, b types.Object) int { return strings.Compare(*a.Key, *b.Key) })
+	start, _ := strconv.Atoi(aws.ToString(params.ContinuationToken))
+	end := min(start+f.pageSize, len(contents))
+	out := &s3.ListObjectsV2Output{Contents: contents[start:end]}
+	if end < len(contents) {
+		out.IsTruncated, out.NextContinuationToken = aws.Bool(true), aws.String(strconv.Itoa(end))
+	}
+	return out, nil
 }
 
 func (f *fakeS3) DeleteObject(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
@@ -118,16 +252,185 @@ func (f *fakeS3) DeleteObject(_ context.Context, params *s3.DeleteObjectInput, _
 	return &s3.DeleteObjectOutput{}, nil
 }
 
+func (f *fakeS3) CopyObject(_ context.Context, params *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	if f.copyErr != nil {
+		return nil, f.copyErr
+	}
+	srcKey, err := url.PathUnescape(strings.TrimPrefix(*params.CopySource, *params.Bucket+"/"))
+	if err != nil {
+		return nil, fmt.Errorf("InvalidArgument: %w", err)
+	}
+	src, ok := f.objects[srcKey]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchKey: %s", srcKey)
+	}
+	if src.frozen() {
+		return nil, &types.InvalidObjectState{Message: aws.String("Object is archived")}
+	}
+	if err := src.checkCustomerKey(params.CopySourceSSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	metadata := src.metadata
+	if params.MetadataDirective == types.MetadataDirectiveReplace {
+		metadata = params.Metadata
+	}
+	f.objects[*params.Key] = &fakeObject{
+		body:        append([]byte(nil), src.body...),
+		metadata:    metadata,
+		modified:    f.clock,
+		sse:         params.ServerSideEncryption,
+		customerKey: aws.ToString(params.SSECustomerKeyMD5),
+	}
+	f.clock = f.clock.Add(time.Second)
+	f.copies++
+	f.lastCopy = params
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeS3) RestoreObject(_ context.Context, params *s3.RestoreObjectInput, _ ...func(*s3.Options)) (*s3.RestoreObjectOutput, error) {
+	if f.restoreErr != nil {
+		return nil, f.restoreErr
+	}
+	obj, ok := f.objects[*params.Key]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchKey: %s", *params.Key)
+	}
+	obj.restore = aws.String(`ongoing-request="true"`)
+	f.restores++
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(_ context.Context, params *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	if f.putErr != nil {
+		return nil, f.putErr
+	}
+	f.nextUpload++
+	id := fmt.Sprintf("upload-%d", f.nextUpload)
+	f.uploads[id] = &fakeUpload{
+		key:         *params.Key,
+		metadata:    params.Metadata,
+		sse:         params.ServerSideEncryption,
+		customerKey: aws.ToString(params.SSECustomerKeyMD5),
+		parts:       map[int32][]byte{},
+	}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+// upload returns the upload id of key, checking its SSE-C key like S3.
+func (f *fakeS3) upload(id, key *string, keyMD5 *string) (*fakeUpload, error) {
+	u, ok := f.uploads[aws.ToString(id)]
+	if !ok || u.key != aws.ToString(key) {
+		return nil, fmt.Errorf("NoSuchUpload: %s", aws.ToString(id))
+	}
+	if aws.ToString(keyMD5) != u.customerKey {
+		return nil, fakeStatusError{status: 400}
+	}
+	return u, nil
+}
+
+func (f *fakeS3) UploadPart(_ context.Context, params *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	f.partMu.Lock()
+	f.partsNow++
+	f.maxParts = max(f.maxParts, f.partsNow)
+	f.partMu.Unlock()
+	// Let the other parts of the upload start before this one is stored.
+	time.Sleep(time.Millisecond)
+	f.partMu.Lock()
+	defer f.partMu.Unlock()
+	f.partsNow--
+	if f.partErr != nil {
+		return nil, f.partErr
+	}
+	u, err := f.upload(params.UploadId, params.Key, params.SSECustomerKeyMD5)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	u.parts[*params.PartNumber] = body
+	f.parts++
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf(`"%x"`, md5.Sum(body)))}, nil
+}
+
+func (f *fakeS3) UploadPartCopy(_ context.Context, params *s3.UploadPartCopyInput, _ ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	if f.partErr != nil {
+		return nil, f.partErr
+	}
+	u, err := f.upload(params.UploadId, params.Key, params.SSECustomerKeyMD5)
+	if err != nil {
+		return nil, err
+	}
+	srcKey, err := url.PathUnescape(strings.TrimPrefix(*params.CopySource, *params.Bucket+"/"))
+	if err != nil {
+		return nil, fmt.Errorf("InvalidArgument: %w", err)
+	}
+	src, ok := f.objects[srcKey]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchKey: %s", srcKey)
+	}
+	if err := src.checkCustomerKey(params.CopySourceSSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	var first, last int
+	if _, err := fmt.Sscanf(aws.ToString(params.CopySourceRange), "bytes=%d-%d", &first, &last); err != nil || last >= len(src.body) {
+		return nil, fmt.Errorf("InvalidRange: %s", aws.ToString(params.CopySourceRange))
+	}
+	body := append([]byte(nil), src.body[first:last+1]...)
+	u.parts[*params.PartNumber] = body
+	f.parts++
+	return &s3.UploadPartCopyOutput{CopyPartResult: &types.CopyPartResult{ETag: aws.String(fmt.Sprintf(`"%x"`, md5.Sum(body)))}}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(_ context.Context, params *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	u, err := f.upload(params.UploadId, params.Key, params.SSECustomerKeyMD5)
+	if err != nil {
+		return nil, err
+	}
+	var body, sums []byte
+	for i, part := range params.MultipartUpload.Parts {
+		data, ok := u.parts[*part.PartNumber]
+		if !ok || *part.PartNumber != int32(i+1) || aws.ToString(part.ETag) != fmt.Sprintf(`"%x"`, md5.Sum(data)) {
+			return nil, fmt.Errorf("InvalidPart: %d", *part.PartNumber)
+		}
+		body = append(body, data...)
+		sum := md5.Sum(data)
+		sums = append(sums, sum[:]...)
+	}
+	f.objects[u.key] = &fakeObject{
+		body:        body,
+		metadata:    u.metadata,
+		modified:    f.clock,
+		sse:         u.sse,
+		customerKey: u.customerKey,
+		etag:        fmt.Sprintf(`"%x-%d"`, md5.Sum(sums), len(params.MultipartUpload.Parts)),
+	}
+	f.clock = f.clock.Add(time.Second)
+	delete(f.uploads, *params.UploadId)
+	f.completes++
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(_ context.Context, params *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	if _, ok := f.uploads[aws.ToString(params.UploadId)]; !ok {
+		return nil, fmt.Errorf("NoSuchUpload: %s", aws.ToString(params.UploadId))
+	}
+	delete(f.uploads, *params.UploadId)
+	f.aborts++
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
 // staticDump returns a Dumper that always yields body.
 func staticDump(body []byte) Dumper {
-	return func(context.Context, DatabaseConfig) ([]byte, error) {
-		return body, nil
+	return func(context.Context, DatabaseConfig, DumpOptions) ([]byte, error) {
+		return bytes.Clone(body), nil // Run takes ownership of the dump
 	}
 }
 
 // failingDump returns a Dumper that always errors.
 func failingDump(err error) Dumper {
-	return func(context.Context, DatabaseConfig) ([]byte, error) {
+	return func(context.Context, DatabaseConfig, DumpOptions) ([]byte, error) {
 		return nil, err
 	}
 }
@@ -136,3 +439,24 @@ func failingDump(err error) Dumper {
 func fixedClock(t time.Time) func() time.Time {
 	return func() time.Time { return t }
 }
+
+// staticQuery returns a Querier that always yields rows.
+func staticQuery(rows [][]string) Querier {
+	return func(context.Context, DatabaseConfig, string) ([][]string, error) {
+		return rows, nil
+	}
+}
+
+// testFingerprint is the row fingerprinted answers the fingerprint query with.
+var testFingerprint = []string{"7301234567890123456", "16384", "app", "main"}
+
+// fingerprinted returns a Querier that answers the fingerprint query of a run
+// itself, with testFingerprint, and passes every other query to q.
+func fingerprinted(q Querier) Querier {
+	return func(ctx context.Context, db DatabaseConfig, query string) ([][]string, error) {
+		if query == fingerprintQuery {
+			return [][]string{testFingerprint}, nil
+		}
+		return q(ctx, db, query)
+	}
+}
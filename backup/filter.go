@@ -0,0 +1,371 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Timestamp comment prefixes stripped from dumps.
+var (
+	startedOnPrefix   = []byte("-- Started on ")
+	completedOnPrefix = []byte("-- Completed on ")
+)
+
+// timestampPrefixLen is the number of bytes of a line needed to tell whether
+// it is a timestamp comment.
+var timestampPrefixLen = max(len(startedOnPrefix), len(completedOnPrefix))
+
+// isTimestampComment reports whether line, or its first timestampPrefixLen
+// bytes, is one of pg_dump's "-- Started on" / "-- Completed on" lines, which
+// otherwise make byte-identical dumps appear to differ.
+func isTimestampComment(line []byte) bool {
+	return bytes.HasPrefix(line, startedOnPrefix) || bytes.HasPrefix(line, completedOnPrefix)
+}
+
+// removeTimestampComments strips the timestamp comments from a dump already
+// in memory, such as the globals of pg_dumpall; PgDump strips them as the
+// dump is read (see FilterDump). It filters data in place, without
+// allocating, and returns the shortened slice; the bytes of data beyond it
+// are left undefined.
+func removeTimestampComments(data []byte) []byte {
+	if !bytes.Contains(data, startedOnPrefix) && !bytes.Contains(data, completedOnPrefix) {
+		return data
+	}
+	// Kept lines are copied down over the ones dropped; the write position
+	// never passes the read position, so nothing is overwritten unread.
+	out, kept := data[:0], false
+	for rest := data; ; {
+		line, next, more := bytes.Cut(rest, []byte("\n"))
+		if !isTimestampComment(line) {
+			if kept {
+				out = append(out, '\n')
+			}
+			out, kept = append(out, line...), true
+		}
+		if !more {
+			return out
+		}
+		rest = next
+	}
+}
+
+// DumpFilter transforms one line of a plain-format dump, given without its
+// "\n". It returns the line to write in its place, which may be line itself
+// or a rewritten copy, and whether to keep the line at all. Filters see only
+// SQL: rows of COPY data, and lines longer than filterBufferSize, pass
+// through unexamined.
+type DumpFilter func(line []byte) (out []byte, keep bool)
+
+// filterBufferSize is the longest line a filter is given.
+const filterBufferSize = 64 << 10
+
+// Lines StripComments keeps because this package reads them back: the dump's
+// header and footer (audit), server versions (DumpInfo) and object headers
+// (ExtractTable, DiffBackups, restore progress).
+var keptComments = [][]byte{
+	[]byte("-- PostgreSQL database dump"),
+	[]byte("-- Dumped from "),
+	[]byte("-- Dumped by "),
+	[]byte("-- Name: "),
+	[]byte("-- Data for Name: "),
+}
+
+// StripComments drops SQL comment lines, other than those this package reads
+// back from a stored backup (pg_dump's header and footer, version lines and
+// "-- Name:" object headers).
+func StripComments(line []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(line, []byte("--")) {
+		return line, true
+	}
+	for _, prefix := range keptComments {
+		if bytes.HasPrefix(line, prefix) {
+			return line, true
+		}
+	}
+	return nil, false
+}
+
+// StripSetLines drops the session settings pg_dump writes as SET statements,
+// such as "SET statement_timeout = 0;", leaving the restoring session's own.
+func StripSetLines(line []byte) ([]byte, bool) {
+	return line, !bytes.HasPrefix(line, []byte("SET "))
+}
+
+// searchPathLine matches the statements with which pg_dump sets the
+// search_path: set_config calls, and SET in older versions.
+var searchPathLine = regexp.MustCompile(`^(?:SELECT pg_catalog\.set_config\('search_path', '[^']*', false\);|SET search_path = .*;)$`)
+
+// RewriteSearchPath returns a DumpFilter that replaces pg_dump's search_path
+// settings with path, a comma-separated schema list such as "app, public",
+// so unqualified names in the restored functions and defaults resolve
+// against it.
+func RewriteSearchPath(path string) DumpFilter {
+	repl := []byte("SELECT pg_catalog.set_config('search_path', " + quoteLiteral(path) + ", false);")
+	return func(line []byte) ([]byte, bool) {
+		if searchPathLine.Match(line) {
+			return repl, true
+		}
+		return line, true
+	}
+}
+
+// DropMatching returns a DumpFilter that drops every line matching re.
+func DropMatching(re *regexp.Regexp) DumpFilter {
+	return func(line []byte) ([]byte, bool) {
+		return line, !re.Match(line)
+	}
+}
+
+// ReplaceMatching returns a DumpFilter that replaces every match of re in a
+// line with repl, which may refer to submatches as in regexp.Expand ($1).
+func ReplaceMatching(re *regexp.Regexp, repl string) DumpFilter {
+	return func(line []byte) ([]byte, bool) {
+		if !re.Match(line) {
+			return line, true
+		}
+		return re.ReplaceAll(line, []byte(repl)), true
+	}
+}
+
+// ParseDumpFilters parses a list of filters separated by ";", each written as
+//
+//	strip-comments            StripComments
+//	strip-set                 StripSetLines
+//	search-path=<schemas>     RewriteSearchPath
+//	drop=/<regex>/            DropMatching
+//	replace=/<regex>/<repl>/  ReplaceMatching
+//
+// The regex delimiter may be any character other than a space, as in sed
+// ("replace=|OWNER TO \w+;|OWNER TO app;|"), and anything between delimiters,
+// ";" included, belongs to the filter. A filter prefixed with a profile name
+// and ":" ("schema-only:strip-comments") applies to that profile only. It
+// returns the filters applying to every profile and those of each profile.
+func ParseDumpFilters(s string) (all []DumpFilter, byProfile map[string][]DumpFilter, err error) {
+	byProfile = map[string][]DumpFilter{}
+	for rest := strings.TrimSpace(s); rest != ""; rest = strings.TrimSpace(rest) {
+		var profile string
+		name := rest[:len(rest)-len(strings.TrimLeft(rest, "abcdefghijklmnopqrstuvwxyz0123456789-_"))]
+		if strings.HasPrefix(rest[len(name):], ":") {
+			if _, ok := Profiles[name]; !ok {
+				return nil, nil, fmt.Errorf("dump filter for unknown profile %q", name)
+			}
+			profile, rest = name, rest[len(name)+1:]
+		}
+		var f DumpFilter
+		if f, rest, err = parseDumpFilter(rest); err != nil {
+			return nil, nil, err
+		}
+		if profile == "" {
+			all = append(all, f)
+		} else {
+			byProfile[profile] = append(byProfile[profile], f)
+		}
+		rest = strings.TrimSpace(rest)
+		if rest != "" && rest[0] != ';' {
+			return nil, nil, fmt.Errorf("dump filters: expected \";\" before %q", rest)
+		}
+		rest = strings.TrimPrefix(rest, ";")
+	}
+	return all, byProfile, nil
+}
+
+// parseDumpFilter parses the filter at the start of s, returning what follows
+// it.
+func parseDumpFilter(s string) (DumpFilter, string, error) {
+	name, arg, hasArg := s, "", false
+	if i := strings.IndexAny(s, "=;"); i >= 0 {
+		name, hasArg = s[:i], s[i] == '='
+		if hasArg {
+			arg = s[i+1:]
+		}
+		s = s[i:]
+	} else {
+		s = ""
+	}
+	name = strings.TrimSpace(name)
+	switch name {
+	case "strip-comments", "strip-set":
+		if hasArg {
+			return nil, "", fmt.Errorf("dump filter %s takes no argument", name)
+		}
+		if name == "strip-comments" {
+			return StripComments, s, nil
+		}
+		return StripSetLines, s, nil
+	case "search-path":
+		path, rest := arg, ""
+		if i := strings.IndexByte(arg, ';'); i >= 0 {
+			path, rest = arg[:i], arg[i:]
+		}
+		if strings.TrimSpace(path) == "" {
+			return nil, "", errors.New("dump filter search-path needs a schema list")
+		}
+		return RewriteSearchPath(strings.TrimSpace(path)), rest, nil
+	case "drop", "replace":
+		want := 1
+		if name == "replace" {
+			want = 2
+		}
+		parts, rest, err := delimited(arg, want)
+		if err != nil {
+			return nil, "", fmt.Errorf("dump filter %s: %w", name, err)
+		}
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			return nil, "", fmt.Errorf("dump filter %s: %w", name, err)
+		}
+		if name == "drop" {
+			return DropMatching(re), rest, nil
+		}
+		return ReplaceMatching(re, parts[1]), rest, nil
+	default:
+		return nil, "", fmt.Errorf("unknown dump filter %q (want strip-comments, strip-set, search-path, drop or replace)", name)
+	}
+}
+
+// delimited splits the n fields of s written between a delimiter, its first
+// character: n = 2 reads "/a/b/". It returns the fields and what follows them.
+func delimited(s string, n int) ([]string, string, error) {
+	if s == "" || s[0] == ' ' {
+		return nil, "", errors.New("missing delimited pattern")
+	}
+	delim, rest := s[:1], s[1:]
+	fields := make([]string, n)
+	for i := range fields {
+		field, after, ok := strings.Cut(rest, delim)
+		if !ok {
+			return nil, "", fmt.Errorf("unterminated pattern %q", s)
+		}
+		fields[i], rest = field, after
+	}
+	return fields, rest, nil
+}
+
+// FilterDump returns a reader of the plain-format dump r with its timestamp
+// comments stripped, as removeTimestampComments does, and every other line
+// passed through filters in order. It streams: the lines filtered are held one
+// at a time, and lines longer than filterBufferSize, like large COPY rows,
+// pass through in pieces. Being an io.Reader, it composes with hashing and
+// compression of the same stream. Dumpers honor DumpOptions.Filters with it.
+func FilterDump(r io.Reader, filters []DumpFilter) io.Reader {
+	return filterDump(r, filters, nil)
+}
+
+// filterDump is FilterDump, adding the time spent in filters to *spent unless
+// it is nil.
+func filterDump(r io.Reader, filters []DumpFilter, spent *time.Duration) *filterReader {
+	return &filterReader{r: bufio.NewReaderSize(r, filterBufferSize), filters: filters, spent: spent}
+}
+
+// filterReader is the io.Reader returned by FilterDump.
+type filterReader struct {
+	r       *bufio.Reader
+	filters []DumpFilter
+	kept    bool           // a line has been kept: the next kept line is preceded by "\n"
+	inCopy  bool           // inside COPY data, which filters do not see
+	long    int            // 0, or longPass or longDrop in the middle of a long line
+	out     []byte         // output not yet read
+	buf     []byte         // backing array of out
+	err     error          // sticky error of r, returned once everything before it is
+	spent   *time.Duration // time spent in filters, or nil
+}
+
+// States of filterReader.long.
+const (
+	longPass = 1 + iota // passing a long line through
+	longDrop            // dropping a long timestamp comment
+)
+
+// copyEnd is the line ending COPY data.
+var copyEnd = []byte(`\.`)
+
+func (f *filterReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(f.out) == 0 {
+			if f.err != nil {
+				break
+			}
+			f.next()
+			continue
+		}
+		c := copy(p[n:], f.out)
+		n += c
+		f.out = f.out[c:]
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, f.err
+}
+
+// next reads the next line, or piece of a long line, from r and sets out to
+// what it becomes.
+func (f *filterReader) next() {
+	chunk, err := f.r.ReadSlice('\n')
+	whole := err != bufio.ErrBufferFull
+	if whole && err != nil {
+		f.err = err
+	}
+	line, ended := bytes.CutSuffix(chunk, []byte("\n"))
+	if !whole {
+		line = chunk
+	}
+
+	if f.long != 0 {
+		if f.long == longPass {
+			f.out = append(f.buf[:0], line...)
+		}
+		if ended {
+			f.long = 0
+		}
+		return
+	}
+	// At EOF an empty chunk is the empty last line of input that is empty or
+	// ends in "\n", which is a line like any other.
+	if len(chunk) == 0 && f.err != io.EOF {
+		return
+	}
+	if isTimestampComment(line) {
+		if !whole {
+			f.long = longDrop
+		}
+		return
+	}
+	out, keep := line, true
+	switch {
+	case !whole:
+		f.long = longPass
+	case f.inCopy:
+		f.inCopy = !bytes.Equal(line, copyEnd)
+	default:
+		var start time.Time
+		if f.spent != nil && len(f.filters) > 0 {
+			start = time.Now()
+		}
+		for _, filter := range f.filters {
+			if out, keep = filter(out); !keep {
+				break
+			}
+		}
+		if !start.IsZero() {
+			*f.spent += time.Since(start)
+		}
+		f.inCopy = keep && bytes.HasPrefix(out, []byte("COPY ")) && bytes.HasSuffix(out, []byte(" FROM stdin;"))
+	}
+	if !keep {
+		return
+	}
+	f.buf = f.buf[:0]
+	if f.kept {
+		f.buf = append(f.buf, '\n')
+	}
+	f.buf = append(f.buf, out...)
+	f.out, f.kept = f.buf, true
+}
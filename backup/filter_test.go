@@ -0,0 +1,212 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestRemoveTimestampComments(t *testing.T) {
+	in := []byte("-- Started on 2026-05-27 10:00:00\n" +
+		"CREATE TABLE foo (id int);\n" +
+		"-- Completed on 2026-05-27 10:00:01\n" +
+		"INSERT INTO foo VALUES (1);")
+	want := "CREATE TABLE foo (id int);\nINSERT INTO foo VALUES (1);"
+
+	if got := string(removeTimestampComments(in)); got != want {
+		t.Errorf("removeTimestampComments() = %q, want %q", got, want)
+	}
+}
+
+func TestRemoveTimestampCommentsNoComments(t *testing.T) {
+	in := []byte("line one\nline two")
+	if got := string(removeTimestampComments(in)); got != "line one\nline two" {
+		t.Errorf("removeTimestampComments() altered content without timestamps: %q", got)
+	}
+}
+
+func TestRemoveTimestampCommentsEdges(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                                   "",
+		"\n":                                 "\n",
+		"-- Started on x":                    "",
+		"-- Started on x\n":                  "",
+		"\n-- Started on x\nSELECT 1;\n":     "\nSELECT 1;\n",
+		"a\n-- Completed on x":               "a",
+		"a\n\n-- Completed on x\n\nb":        "a\n\n\nb",
+		"-- Started on x\n-- Completed on y": "",
+	} {
+		if got := string(removeTimestampComments([]byte(in))); got != want {
+			t.Errorf("removeTimestampComments(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRemoveTimestampCommentsInPlace(t *testing.T) {
+	dump := []byte(strings.Repeat("-- Started on 2026-05-27 10:00:00\nINSERT INTO foo VALUES (1);\n", 1000))
+	allocs := testing.AllocsPerRun(10, func() {
+		in := dump[:len(dump):len(dump)]
+		_ = removeTimestampComments(in)
+	})
+	if allocs != 0 {
+		t.Errorf("removeTimestampComments allocated %v times, want 0", allocs)
+	}
+}
+
+// filterStream reads in through FilterDump without filters, wrapped by wrap.
+func filterStream(t *testing.T, in []byte, wrap func(io.Reader) io.Reader) []byte {
+	t.Helper()
+	out, err := io.ReadAll(wrap(FilterDump(bytes.NewReader(in), nil)))
+	if err != nil {
+		t.Fatalf("reading filter: %v", err)
+	}
+	return out
+}
+
+func TestFilterDumpMatchesRemove(t *testing.T) {
+	inputs := []string{
+		"", "\n", "\n\n", "-- Started on x", "-- Started on x\n", "-- Started on", "-- Start",
+		"\n-- Started on x\nSELECT 1;\n", "a\n-- Completed on x", "a\n\n-- Completed on x\n\nb",
+		"-- Started on x\n-- Completed on y", "-- PostgreSQL database dump\n-- Started on 2026\nSET x = 1;\n",
+		"a\n" + strings.Repeat("-", 200<<10) + "\n-- Completed on z\n", // a line longer than the buffer
+		"-- Started on " + strings.Repeat("x", 200<<10) + "\nkept",
+	}
+	rng := rand.New(rand.NewPCG(1, 2))
+	parts := []string{"-- Started on t", "-- Completed on t", "-- Started", "SELECT 1;", "", "--"}
+	for range 200 {
+		var b strings.Builder
+		for range rng.IntN(8) {
+			b.WriteString(parts[rng.IntN(len(parts))])
+			if rng.IntN(4) > 0 {
+				b.WriteByte('\n')
+			}
+		}
+		inputs = append(inputs, b.String())
+	}
+
+	for _, in := range inputs {
+		want := removeTimestampComments([]byte(in))
+		for name, wrap := range map[string]func(io.Reader) io.Reader{
+			"whole":    func(r io.Reader) io.Reader { return r },
+			"one byte": iotest.OneByteReader,
+			"half":     iotest.HalfReader,
+		} {
+			if got := filterStream(t, []byte(in), wrap); !bytes.Equal(got, want) {
+				t.Errorf("%s: filter(%.40q) = %.40q, want %.40q", name, in, got, want)
+			}
+		}
+	}
+}
+
+func TestFilterDumpErrors(t *testing.T) {
+	boom := io.ErrClosedPipe
+	r := FilterDump(io.MultiReader(strings.NewReader("SELECT 1;\n"), iotest.ErrReader(boom)), nil)
+	got, err := io.ReadAll(r)
+	if err != boom || string(got) != "SELECT 1;" {
+		t.Errorf("ReadAll = %q, %v; want the data before the error and the error", got, err)
+	}
+	if err := iotest.TestReader(FilterDump(strings.NewReader("a\n-- Started on x\nb\n"), nil), []byte("a\nb\n")); err != nil {
+		t.Error(err)
+	}
+}
+
+// filterSampleDump is a plain-format dump with settings, comments, a search_path
+// and COPY data that looks like SQL.
+const filterSampleDump = `--
+-- PostgreSQL database dump
+--
+
+-- Dumped from database version 16.2
+SET statement_timeout = 0;
+SELECT pg_catalog.set_config('search_path', '', false);
+--
+-- Name: users; Type: TABLE; Schema: public; Owner: admin
+--
+
+CREATE TABLE public.users (id int, note text);
+ALTER TABLE public.users OWNER TO admin;
+COPY public.users (id, note) FROM stdin;
+1	-- not a comment
+2	SET in data
+\.
+
+-- PostgreSQL database dump complete
+`
+
+func TestFilterDumpFilters(t *testing.T) {
+	filters, _, err := ParseDumpFilters(`strip-comments; strip-set; search-path=app, public; replace=|OWNER TO \w+;|OWNER TO app;|; drop=/^$/`)
+	if err != nil {
+		t.Fatalf("ParseDumpFilters: %v", err)
+	}
+	out, err := io.ReadAll(FilterDump(strings.NewReader(filterSampleDump), filters))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `-- PostgreSQL database dump
+-- Dumped from database version 16.2
+SELECT pg_catalog.set_config('search_path', 'app, public', false);
+-- Name: users; Type: TABLE; Schema: public; Owner: admin
+CREATE TABLE public.users (id int, note text);
+ALTER TABLE public.users OWNER TO app;
+COPY public.users (id, note) FROM stdin;
+1	-- not a comment
+2	SET in data
+\.
+-- PostgreSQL database dump complete`
+	if string(out) != want {
+		t.Errorf("filtered dump:\n%s\nwant:\n%s", out, want)
+	}
+	if info := parseDumpInfo(out); info.ServerVersion != "16.2" {
+		t.Errorf("filtered dump lost its version header: %+v", info)
+	}
+}
+
+func TestParseDumpFilters(t *testing.T) {
+	all, byProfile, err := ParseDumpFilters("strip-set ; schema-only:strip-comments;schema-only:drop=#a;b#")
+	if err != nil {
+		t.Fatalf("ParseDumpFilters: %v", err)
+	}
+	if len(all) != 1 || len(byProfile["schema-only"]) != 2 {
+		t.Fatalf("all = %d, by profile = %v", len(all), byProfile)
+	}
+	if _, keep := byProfile["schema-only"][1]([]byte("xa;by")); keep {
+		t.Error(`drop=#a;b# should drop lines matching "a;b"`)
+	}
+	for _, bad := range []string{
+		"strip-everything", "nosuchprofile:strip-set", "strip-set=1", "search-path=",
+		"drop=/unterminated", "drop=/(/", "replace=/a/", "strip-set strip-comments",
+	} {
+		if _, _, err := ParseDumpFilters(bad); err == nil {
+			t.Errorf("ParseDumpFilters(%q) should fail", bad)
+		}
+	}
+	if all, _, err := ParseDumpFilters("  "); err != nil || len(all) != 0 {
+		t.Errorf("empty list = %d filters, %v", len(all), err)
+	}
+}
+
+func TestRunAppliesProfileFilters(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	var got DumpOptions
+	h.dump = recordingDump([]byte("dump"), &got)
+	h.dumpOpts = DumpOptions{Filters: []DumpFilter{StripSetLines}}
+	h.profileDump = map[string]DumpOptions{"schema-only": {Filters: []DumpFilter{StripComments}}}
+
+	if _, err := h.Run(context.Background(), RunOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Filters) != 1 {
+		t.Errorf("full profile: %d filters, want the global one", len(got.Filters))
+	}
+	if _, err := h.Run(context.Background(), RunOptions{Profile: "schema-only"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Filters) != 2 || !got.SchemaOnly {
+		t.Errorf("schema-only profile: %d filters, want the global and its own", len(got.Filters))
+	}
+}
@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Fingerprint identifies the database a backup was taken from, beyond the
+// connection string that reached it: the cluster's system identifier, chosen
+// by initdb and kept by physical replicas, the database's OID within it, and
+// the cluster_name setting. A DATABASE_URL pointed at another server or
+// database yields another fingerprint even where the host and name are the
+// same.
+type Fingerprint struct {
+	SystemID    string `json:"system_identifier,omitempty"` // "" where pg_control_system() is not allowed
+	DatabaseOID string `json:"database_oid"`
+	Database    string `json:"database"`
+	Cluster     string `json:"cluster_name,omitempty"`
+}
+
+// String returns f as recorded in the fingerprint metadata of a backup:
+// "<system identifier>/<database OID>/<cluster name>", with characters S3
+// metadata cannot carry replaced by "_".
+func (f Fingerprint) String() string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, f.SystemID+"/"+f.DatabaseOID+"/"+f.Cluster)
+}
+
+// parseFingerprint parses the fingerprint metadata of a backup, reporting
+// false when s is not one.
+func parseFingerprint(s string) (Fingerprint, bool) {
+	parts := strings.SplitN(s, "/", 3)
+	if len(parts) != 3 || parts[1] == "" {
+		return Fingerprint{}, false
+	}
+	return Fingerprint{SystemID: parts[0], DatabaseOID: parts[1], Cluster: parts[2]}, true
+}
+
+// differs reports whether f and g identify different databases. A system
+// identifier or cluster name missing from either is not compared.
+func (f Fingerprint) differs(g Fingerprint) bool {
+	if f.SystemID != "" && g.SystemID != "" && f.SystemID != g.SystemID {
+		return true
+	}
+	if f.Cluster != "" && g.Cluster != "" && f.Cluster != g.Cluster {
+		return true
+	}
+	return f.DatabaseOID != g.DatabaseOID
+}
+
+// fingerprintQuery reads the Fingerprint of the connected database.
+// pg_control_system() needs PostgreSQL 9.6; where it may not be called,
+// fingerprintFallbackQuery reads the rest.
+const fingerprintQuery = `SELECT (SELECT system_identifier FROM pg_control_system()), d.oid, d.datname, current_setting('cluster_name')
+FROM pg_database d WHERE d.datname = current_database()`
+
+const fingerprintFallbackQuery = `SELECT '', d.oid, d.datname, current_setting('cluster_name')
+FROM pg_database d WHERE d.datname = current_database()`
+
+// fingerprint returns the Fingerprint of db.
+func (h *Handler) fingerprint(ctx context.Context, db DatabaseConfig) (Fingerprint, error) {
+	rows, err := h.query(ctx, db, fingerprintQuery)
+	if err != nil {
+		if rows, err = h.query(ctx, db, fingerprintFallbackQuery); err != nil {
+			return Fingerprint{}, err
+		}
+	}
+	if len(rows) != 1 || len(rows[0]) != 4 || rows[0][1] == "" {
+		return Fingerprint{}, fmt.Errorf("unexpected fingerprint rows %q", rows)
+	}
+	r := rows[0]
+	return Fingerprint{SystemID: r[0], DatabaseOID: r[1], Database: r[2], Cluster: r[3]}, nil
+}
+
+// checkFingerprint fingerprints the configured database for a run under
+// profile and returns ctx carrying the fingerprint, which uploads and
+// manifests record. When the most recent backup of the profile in its run
+// tier (see runTier) was taken from another database, the change is logged and notified as
+// backup.source_changed, and the previous fingerprint returned: the backups
+// of two databases are about to be mixed in one history. Failing to
+// fingerprint or to read the previous backup only logs a warning.
+func (h *Handler) checkFingerprint(ctx context.Context, profile Profile) (context.Context, string) {
+	fp, err := h.fingerprint(ctx, h.db)
+	if err != nil {
+		logf(ctx, "Warning: failed to fingerprint the database: %v", err)
+		return ctx, ""
+	}
+	ctx = withFingerprint(ctx, fp)
+	latest, err := h.mostRecentBackup(ctx, h.runTierPrefix(profile.Prefix))
+	if err != nil || latest == "" {
+		return ctx, ""
+	}
+	head, err := h.headObject(ctx, latest)
+	if err != nil {
+		logf(ctx, "Warning: failed to read the fingerprint of %s: %v", latest, err)
+		return ctx, ""
+	}
+	previous, ok := parseFingerprint(head.Metadata["fingerprint"])
+	if !ok || !previous.differs(fp) {
+		return ctx, ""
+	}
+	logf(ctx, "Warning: database fingerprint changed from %s (%s) to %s; DATABASE_URL may point at another database", previous, latest, fp)
+	h.notify(ctx, Notification{
+		Event:   "backup.source_changed",
+		Message: fmt.Sprintf("Backup (profile %s) of database %s is from another database than %s: fingerprint %s, was %s", profile.Name, h.db.Database, latest, fp, previous),
+		Fields:  map[string]string{"profile": profile.Name, "database": h.db.Database, "fingerprint": fp.String(), "previous": previous.String(), "previous_key": latest},
+	})
+	return ctx, previous.String()
+}
+
+// fingerprintKey is the context key under which a run's Fingerprint is
+// stored, so uploads and manifests can record it.
+type fingerprintKey struct{}
+
+func withFingerprint(ctx context.Context, fp Fingerprint) context.Context {
+	return context.WithValue(ctx, fingerprintKey{}, fp)
+}
+
+// fingerprintFrom returns the Fingerprint stored in ctx, if any.
+func fingerprintFrom(ctx context.Context) (Fingerprint, bool) {
+	fp, ok := ctx.Value(fingerprintKey{}).(Fingerprint)
+	return fp, ok
+}
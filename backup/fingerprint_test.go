@@ -0,0 +1,81 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunRecordsFingerprint(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.query = fingerprinted(staticQuery(nil))
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := f.objects[res.Key].metadata["fingerprint"]; got != "7301234567890123456/16384/main" {
+		t.Errorf("fingerprint metadata = %q", got)
+	}
+	m, err := h.readManifest(context.Background(), res.Key)
+	if err != nil || m == nil || m.Fingerprint == nil || m.Fingerprint.Database != "app" || m.Fingerprint.SystemID != "7301234567890123456" {
+		t.Errorf("manifest = %+v, %v; want the fingerprint recorded", m, err)
+	}
+	if res.Changed != "" {
+		t.Errorf("first run reported a source change from %q", res.Changed)
+	}
+}
+
+func TestRunWarnsOnFingerprintChange(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.query = fingerprinted(staticQuery(nil))
+	var notified []Notification
+	h.notifier = func(_ context.Context, n Notification) error {
+		notified = append(notified, n)
+		return nil
+	}
+	if _, err := h.Run(context.Background(), RunOptions{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res, err := h.Run(context.Background(), RunOptions{Force: true}); err != nil || res.Changed != "" {
+		t.Fatalf("same database: Run = %+v, %v", res, err)
+	}
+
+	h.query = staticQuery([][]string{{"7309999999999999999", "16384", "app", "main"}})
+	res, err := h.Run(context.Background(), RunOptions{Force: true})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Changed != "7301234567890123456/16384/main" {
+		t.Errorf("source_changed = %q, want the previous fingerprint", res.Changed)
+	}
+	if len(notified) != 1 || notified[0].Event != "backup.source_changed" || notified[0].Fields["fingerprint"] != "7309999999999999999/16384/main" {
+		t.Errorf("notifications = %+v, want one backup.source_changed", notified)
+	}
+}
+
+func TestFingerprintFallback(t *testing.T) {
+	h := newTestHandler(newFakeS3(), 7)
+	h.query = func(_ context.Context, _ DatabaseConfig, q string) ([][]string, error) {
+		if q == fingerprintQuery {
+			return nil, errors.New("ERROR:  permission denied for function pg_control_system")
+		}
+		return [][]string{{"", "16384", "app", ""}}, nil
+	}
+	fp, err := h.fingerprint(context.Background(), h.db)
+	if err != nil || fp.DatabaseOID != "16384" || fp.SystemID != "" {
+		t.Fatalf("fingerprint = %+v, %v", fp, err)
+	}
+	// Without a system identifier only the OID is compared.
+	if fp.differs(Fingerprint{SystemID: "73", DatabaseOID: "16384", Cluster: "main"}) {
+		t.Error("a fingerprint without system identifier should match on the OID")
+	}
+	if !fp.differs(Fingerprint{DatabaseOID: "16385"}) {
+		t.Error("another OID should differ")
+	}
+	if got, ok := parseFingerprint(fp.String()); !ok || got.DatabaseOID != "16384" {
+		t.Errorf("parseFingerprint(%q) = %+v, %t", fp.String(), got, ok)
+	}
+}
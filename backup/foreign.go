@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// foreignTableQuery lists the foreign tables of the database with the
+// foreign server each reads from.
+const foreignTableQuery = `SELECT n.nspname, c.relname, s.srvname
+FROM pg_catalog.pg_foreign_table ft
+JOIN pg_catalog.pg_class c ON c.oid = ft.ftrelid
+JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+JOIN pg_catalog.pg_foreign_server s ON s.oid = ft.ftserver
+ORDER BY 1, 2`
+
+// definesForeignTables reports whether the dump data defines a foreign
+// table, in any format: archives keep their definitions uncompressed.
+func definesForeignTables(data []byte) bool {
+	return bytes.Contains(data, []byte("CREATE FOREIGN TABLE "))
+}
+
+// foreignTable is a foreign table found in the catalog.
+type foreignTable struct {
+	name   string // quoted, schema-qualified name
+	server string
+}
+
+// foreignTables returns the foreign tables of the database, skipping those
+// in excluded schemas.
+func (h *Handler) foreignTables(ctx context.Context, excluded []string) ([]foreignTable, error) {
+	rows, err := h.query(ctx, h.db, foreignTableQuery)
+	if err != nil {
+		return nil, err
+	}
+	var tables []foreignTable
+	for _, row := range rows {
+		if len(row) != 3 {
+			return nil, fmt.Errorf("unexpected foreign table row %q", row)
+		}
+		if slices.Contains(excluded, row[0]) {
+			continue
+		}
+		tables = append(tables, foreignTable{name: quoteIdent(row[0]) + "." + quoteIdent(row[1]), server: row[2]})
+	}
+	return tables, nil
+}
+
+// reportForeignTables logs the foreign tables whose data the dump of opts
+// left out: all of them, as pg_dump does, but those of the servers matching
+// opts.ForeignData. Reading that data goes through the foreign data
+// wrappers to the remote systems, which slows the dump down and fails it
+// when they are unreachable. Runs that hold the dump in memory call it when
+// the dump defines foreign tables (see definesForeignTables), so databases
+// without any are not queried. A failed lookup is only logged.
+func (h *Handler) reportForeignTables(ctx context.Context, opts DumpOptions) {
+	tables, err := h.foreignTables(ctx, opts.ExcludeSchemas)
+	if err != nil {
+		logf(ctx, "Warning: failed to list foreign tables: %v", err)
+		return
+	}
+	servers := map[string]bool{}
+	var skipped []string
+	for _, t := range tables {
+		if !slices.ContainsFunc(opts.ForeignData, func(pattern string) bool {
+			ok, _ := path.Match(pattern, t.server)
+			return ok
+		}) {
+			skipped = append(skipped, t.name)
+			servers[t.server] = true
+		}
+	}
+	if len(skipped) == 0 {
+		return
+	}
+	names := make([]string, 0, len(servers))
+	for s := range servers {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+	logf(ctx, "Dumping %d foreign tables without their data (servers %s): %s", len(skipped), strings.Join(names, ", "), strings.Join(skipped, ", "))
+}
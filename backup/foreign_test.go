@@ -0,0 +1,42 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestRunReportsForeignTables(t *testing.T) {
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(prev)
+
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.dumpOpts = DumpOptions{ExcludeSchemas: []string{"archive"}, ForeignData: []string{"ware*"}}
+	var opts DumpOptions
+	h.dump = recordingDump([]byte("CREATE FOREIGN TABLE public.sales ();\n"), &opts)
+	h.query = func(_ context.Context, _ DatabaseConfig, q string) ([][]string, error) {
+		if strings.Contains(q, "pg_foreign_table") {
+			return [][]string{
+				{"archive", "old_orders", "legacy"},
+				{"public", "crm_contacts", "crm"},
+				{"public", "sales", "warehouse"},
+			}, nil
+		}
+		return nil, nil
+	}
+
+	if _, err := h.Run(context.Background(), RunOptions{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if want := `Dumping 1 foreign tables without their data (servers crm): "public"."crm_contacts"`; !strings.Contains(buf.String(), want) {
+		t.Errorf("log = %s, want %q", buf.String(), want)
+	}
+	if len(opts.ForeignData) != 1 || opts.ForeignData[0] != "ware*" {
+		t.Errorf("ForeignData = %q", opts.ForeignData)
+	}
+}
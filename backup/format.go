@@ -0,0 +1,290 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Dump formats (see DumpOptions.Format).
+const (
+	// FormatPlain is pg_dump's default SQL script, restored with psql.
+	FormatPlain = ""
+	// FormatCustom is pg_dump's custom-format archive (-Fc), compressed by
+	// pg_dump and restored with pg_restore, which can restore parts of it
+	// and in parallel.
+	FormatCustom = "custom"
+	// FormatDirectory is pg_dump's directory format (-Fd), the only one it
+	// dumps in parallel (DumpOptions.Jobs). The directory is stored as a tar
+	// (see writeDirectoryTar), which extracts to what pg_restore reads.
+	FormatDirectory = "directory"
+)
+
+// ParseDumpFormat parses a dump format name: "plain" (or ""), "custom" or
+// "directory".
+func ParseDumpFormat(s string) (string, error) {
+	switch s {
+	case "", "plain":
+		return FormatPlain, nil
+	case FormatCustom, FormatDirectory:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown dump format %q: want plain, custom or directory", s)
+	}
+}
+
+// archiveMagic starts every custom-format archive.
+var archiveMagic = []byte("PGDMP")
+
+// isArchive reports whether data starts a custom-format archive rather than a
+// plain script.
+func isArchive(data []byte) bool {
+	return bytes.HasPrefix(data, archiveMagic)
+}
+
+// tocName is the file of a directory-format dump holding its header and table
+// of contents, the first in its tar.
+const tocName = "toc.dat"
+
+// isDirectoryTar reports whether data starts the tar of a directory-format
+// dump written by writeDirectoryTar: a ustar header for tocName followed by an
+// archive header.
+func isDirectoryTar(data []byte) bool {
+	return len(data) > tarBlockSize && string(data[257:262]) == "ustar" &&
+		string(bytes.TrimRight(data[:100], "\x00")) == tocName && isArchive(data[tarBlockSize:])
+}
+
+// tarBlockSize is the size of a tar header.
+const tarBlockSize = 512
+
+// dumpFormat returns the format of the dump data: FormatCustom for an archive,
+// FormatDirectory for the tar of a directory, else FormatPlain.
+func dumpFormat(data []byte) string {
+	switch {
+	case isArchive(data):
+		return FormatCustom
+	case isDirectoryTar(data):
+		return FormatDirectory
+	}
+	return FormatPlain
+}
+
+// archiveHeaderSize is enough of an archive to hold its header up to the
+// version strings read by archiveInfo.
+const archiveHeaderSize = 1024
+
+// archiveHeader is what archiveInfo and clearArchiveTimestamp read from the
+// header of a custom-format archive, which pg_dump writes as: the magic, three
+// version bytes, the int and offset sizes, the format, the compression, the
+// creation time as seven ints, then the database name, server version and
+// pg_dump version as strings. An int is a sign byte followed by intSize
+// little-endian bytes; a string is its length as an int and its bytes.
+type archiveHeader struct {
+	created       [2]int // byte range of the creation time
+	serverVersion string
+	dumpVersion   string
+}
+
+// parseArchiveHeader parses the header of the archive starting data, reporting
+// false when data is not one, is truncated before the version strings, or is
+// older than archive version 1.10 (pg_dump 8.x).
+func parseArchiveHeader(data []byte) (archiveHeader, bool) {
+	var h archiveHeader
+	if !isArchive(data) || len(data) < 11 {
+		return h, false
+	}
+	major, minor, intSize := int(data[5]), int(data[6]), int(data[8])
+	if major != 1 || minor < 10 || intSize < 1 || intSize > 8 {
+		return h, false
+	}
+	off := 11
+	readInt := func() (int, bool) {
+		if off+1+intSize > len(data) {
+			return 0, false
+		}
+		v := 0
+		for i := intSize - 1; i >= 0; i-- {
+			v = v<<8 | int(data[off+1+i])
+		}
+		if data[off] != 0 {
+			v = -v
+		}
+		off += 1 + intSize
+		return v, true
+	}
+	readStr := func() (string, bool) {
+		n, ok := readInt()
+		if !ok || n > len(data)-off {
+			return "", false
+		}
+		if n <= 0 {
+			return "", true
+		}
+		s := string(data[off : off+n])
+		off += n
+		return s, true
+	}
+	// Archive version 1.15 (pg_dump 16) replaced the compression level with
+	// a one-byte algorithm.
+	if minor >= 15 {
+		off++
+	} else if _, ok := readInt(); !ok {
+		return h, false
+	}
+	h.created[0] = off
+	for range 7 {
+		if _, ok := readInt(); !ok {
+			return h, false
+		}
+	}
+	h.created[1] = off
+	var ok bool
+	if _, ok = readStr(); !ok { // database name
+		return h, false
+	}
+	if h.serverVersion, ok = readStr(); !ok {
+		return h, false
+	}
+	if h.dumpVersion, ok = readStr(); !ok {
+		return h, false
+	}
+	return h, true
+}
+
+// clearArchiveTimestamp zeroes, in place, the creation time recorded in the
+// header of the archive starting data, the custom-format counterpart of the
+// timestamp comments removeTimestampComments strips: without it no two dumps
+// of an unchanged database would be identical. pg_restore then lists the
+// archive as created on 1899-12-31. Data that is not an archive is left as it
+// is.
+func clearArchiveTimestamp(data []byte) {
+	if h, ok := parseArchiveHeader(data); ok {
+		clear(data[h.created[0]:h.created[1]])
+	}
+}
+
+// archiveInfo returns the DumpInfo recorded in the header of the archive, or
+// the tar of a directory, starting data. The extensions an archive creates are
+// in its table of contents, which is not read.
+func archiveInfo(data []byte) DumpInfo {
+	if isDirectoryTar(data) {
+		data = data[tarBlockSize:]
+	}
+	h, _ := parseArchiveHeader(data)
+	return DumpInfo{ServerVersion: h.serverVersion, DumpVersion: h.dumpVersion}
+}
+
+// stripArchiveTimestamp returns a reader of the archive r with its creation
+// time cleared (see clearArchiveTimestamp).
+func stripArchiveTimestamp(r io.Reader) (io.Reader, error) {
+	head := make([]byte, archiveHeaderSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	clearArchiveTimestamp(head)
+	return io.MultiReader(bytes.NewReader(head), r), nil
+}
+
+// writeDirectoryTar writes the directory-format dump in dir to w as a tar:
+// tocName first, with its creation time cleared (see clearArchiveTimestamp),
+// then the other files by name, all with the same mode and no modification
+// time. A dump of an unchanged database thus yields the same tar, and
+// deduplicates like the other formats.
+func writeDirectoryTar(w io.Writer, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := []string{tocName}
+	for _, e := range entries {
+		if e.Name() != tocName && e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		if err := addTarFile(tw, filepath.Join(dir, name), name == tocName); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// addTarFile adds the file at path to tw under its base name, clearing the
+// archive creation time of a table of contents.
+func addTarFile(tw *tar.Writer, path string, toc bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: filepath.Base(path), Mode: 0o600, Size: info.Size(), Format: tar.FormatUSTAR}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	var r io.Reader = f
+	if toc {
+		if r, err = stripArchiveTimestamp(f); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// readDirectoryTar unpacks the tar of a directory-format dump, as written by
+// writeDirectoryTar, into dir. Only regular files named without a directory
+// are accepted, so an entry cannot be written outside dir.
+func readDirectoryTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Name != filepath.Base(hdr.Name) || hdr.Name == ".." {
+			return fmt.Errorf("unexpected entry %q in dump directory", hdr.Name)
+		}
+		f, err := os.OpenFile(filepath.Join(dir, hdr.Name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// openScript is openObject for operations that read a backup as SQL. A
+// custom-format archive or the tar of a directory is rejected:
+// "pg_restore -f -" turns either into the script they expect.
+func (h *Handler) openScript(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, err := h.openObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(body)
+	if head, _ := r.Peek(tarBlockSize + len(archiveMagic)); dumpFormat(head) != FormatPlain {
+		_ = body.Close()
+		return nil, fmt.Errorf("%s is a %s-format dump, not a SQL script; convert it with pg_restore -f -", key, dumpFormat(head))
+	}
+	return readCloser{r, body}, nil
+}
@@ -0,0 +1,189 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sampleArchive returns a custom-format archive header, as pg_dump 16 writes
+// it, created at the given second, followed by body.
+func sampleArchive(second int, body string) []byte {
+	b := append([]byte("PGDMP"), 1, 15, 0, 4, 8, 1, 1) // version 1.15, intSize 4, offSize 8, custom, gzip
+	writeInt := func(v int) { b = append(b, 0, byte(v), byte(v>>8), byte(v>>16), byte(v>>24)) }
+	writeStr := func(s string) { writeInt(len(s)); b = append(b, s...) }
+	for _, v := range []int{second, 30, 4, 27, 4, 126, 0} {
+		writeInt(v)
+	}
+	writeStr("app")
+	writeStr("15.4")
+	writeStr("16.1")
+	return append(b, body...)
+}
+
+func TestParseDumpFormat(t *testing.T) {
+	for in, want := range map[string]string{"": FormatPlain, "plain": FormatPlain, "custom": FormatCustom, "directory": FormatDirectory} {
+		if got, err := ParseDumpFormat(in); err != nil || got != want {
+			t.Errorf("ParseDumpFormat(%q) = %q, %v", in, got, err)
+		}
+	}
+	if _, err := ParseDumpFormat("tar"); err == nil {
+		t.Error("expected error for an unsupported format")
+	}
+}
+
+func TestClearArchiveTimestamp(t *testing.T) {
+	a, b := sampleArchive(1, "toc"), sampleArchive(2, "toc")
+	clearArchiveTimestamp(a)
+	clearArchiveTimestamp(b)
+	if !bytes.Equal(a, b) {
+		t.Error("archives differing only in their creation time still differ")
+	}
+	if info := archiveInfo(a); info.ServerVersion != "15.4" || info.DumpVersion != "16.1" {
+		t.Errorf("archiveInfo = %+v", info)
+	}
+	if info := parseDumpInfo(a); info.ServerVersion != "15.4" {
+		t.Errorf("parseDumpInfo = %+v", info)
+	}
+
+	plain := []byte("-- Started on 2026-05-27\nSELECT 1;\n")
+	clearArchiveTimestamp(plain)
+	if string(plain) != "-- Started on 2026-05-27\nSELECT 1;\n" {
+		t.Errorf("plain dump changed: %q", plain)
+	}
+	if _, ok := parseArchiveHeader(a[:20]); ok {
+		t.Error("truncated header parsed")
+	}
+}
+
+func TestStripArchiveTimestamp(t *testing.T) {
+	body := strings.Repeat("x", 2*archiveHeaderSize)
+	r, err := stripArchiveTimestamp(bytes.NewReader(sampleArchive(7, body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	want := sampleArchive(7, body)
+	clearArchiveTimestamp(want)
+	if !bytes.Equal(got, want) {
+		t.Error("streamed archive differs from the one cleared in memory")
+	}
+}
+
+func TestRunCustomFormat(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.dump = staticDump(sampleArchive(1, "toc and data"))
+	ctx := context.Background()
+
+	res, err := h.Run(ctx, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := f.objects[res.Key]
+	if obj.metadata["format"] != FormatCustom || obj.metadata["server-version"] != "15.4" {
+		t.Errorf("metadata = %v", obj.metadata)
+	}
+	var m Manifest
+	if err := json.Unmarshal(f.objects[manifestKey(res.Key)].body, &m); err != nil || m.Format != FormatCustom {
+		t.Errorf("manifest format = %q, %v", m.Format, err)
+	}
+
+	// The next day's dump differs only in its creation time.
+	h.now = fixedClock(testNow.AddDate(0, 0, 1))
+	h.dump = staticDump(sampleArchive(2, "toc and data"))
+	if res, err := h.Run(ctx, RunOptions{}); err != nil || res.Action != "skipped" {
+		t.Errorf("unchanged run = %+v, %v; want skipped", res, err)
+	}
+
+	if _, err := h.Grep(ctx, res.Key, "data", GrepOptions{}); err == nil || !strings.Contains(err.Error(), "pg_restore") {
+		t.Errorf("grep of an archive: %v", err)
+	}
+}
+
+func TestWriteDirectoryTar(t *testing.T) {
+	tarOf := func(second int) []byte {
+		dir := t.TempDir()
+		for name, body := range map[string][]byte{
+			"toc.dat":   sampleArchive(second, "toc"),
+			"3.dat.gz":  []byte("events"),
+			"2.dat.gz":  []byte("users"),
+			"blobs.toc": []byte("none"),
+			"subdir/x":  nil,
+		} {
+			if body == nil {
+				_ = os.Mkdir(filepath.Join(dir, filepath.Dir(name)), 0o700)
+				continue
+			}
+			if err := os.WriteFile(filepath.Join(dir, name), body, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var b bytes.Buffer
+		if err := writeDirectoryTar(&b, dir); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	a := tarOf(1)
+	if !bytes.Equal(a, tarOf(2)) {
+		t.Error("tars of dumps differing only in their creation time differ")
+	}
+	if got := dumpFormat(a); got != FormatDirectory {
+		t.Errorf("dumpFormat = %q", got)
+	}
+	if info := parseDumpInfo(a); info.DumpVersion != "16.1" {
+		t.Errorf("parseDumpInfo = %+v", info)
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(a))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if got := strings.Join(names, " "); got != "toc.dat 2.dat.gz 3.dat.gz blobs.toc" {
+		t.Errorf("tar entries = %s", got)
+	}
+}
+
+func TestReadDirectoryTar(t *testing.T) {
+	src := t.TempDir()
+	for name, body := range map[string]string{"toc.dat": string(sampleArchive(1, "toc")), "2.dat.gz": "users"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b bytes.Buffer
+	if err := writeDirectoryTar(&b, src); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := readDirectoryTar(&b, dst); err != nil {
+		t.Fatalf("readDirectoryTar: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "2.dat.gz")); err != nil || string(got) != "users" {
+		t.Errorf("2.dat.gz = %q, %v", got, err)
+	}
+
+	var evil bytes.Buffer
+	tw := tar.NewWriter(&evil)
+	_ = tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 0o600, Size: 1})
+	_, _ = tw.Write([]byte("x"))
+	_ = tw.Close()
+	if err := readDirectoryTar(&evil, t.TempDir()); err == nil {
+		t.Error("an entry outside the directory should be rejected")
+	}
+}
@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// globalsPrefix holds the dumps of the server's global objects (see
+// Config.BackupGlobals), one per day they changed on.
+const globalsPrefix = "globals/"
+
+// GlobalsDumper dumps the global objects of db's server: its roles, their
+// memberships and settings, and its tablespaces, which a pg_dump of one
+// database leaves out. Role password hashes are left out unless
+// rolePasswords is set. The default implementation is PgDumpAllGlobals.
+type GlobalsDumper func(ctx context.Context, db DatabaseConfig, rolePasswords bool) ([]byte, error)
+
+// PgDumpAllGlobals is the default GlobalsDumper: it runs
+// "pg_dumpall --globals-only", connected to db's database, from the layer or
+// PATH as PgDump runs pg_dump.
+func PgDumpAllGlobals(ctx context.Context, db DatabaseConfig, rolePasswords bool) ([]byte, error) {
+	path, env, err := pgTool("pg_dumpall", db)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"--globals-only"}
+	if !rolePasswords {
+		args = append(args, "--no-role-passwords")
+	}
+	// pg_dumpall takes a connection string with -d; the database is -l.
+	args = append(args, connArgs(DatabaseConfig{Host: db.Host, Port: db.Port, User: db.User})...)
+	if db.Database != "" {
+		args = append(args, "-l", db.Database)
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	logf(ctx, "Executing pg_dumpall --globals-only...")
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pg_dumpall failed: %w\nstderr: %s", err, Redact(stderr.String()))
+	}
+	if stderr.Len() > 0 {
+		logf(ctx, "pg_dumpall stderr: %s", stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// globalsKey returns the key of the globals dump stored under prefix on the
+// day of t.
+func globalsKey(prefix string, t time.Time) string {
+	return prefix + globalsPrefix + t.Format("2006-01-02") + "-globals.sql"
+}
+
+// storeGlobals backs up the server's global objects after the run of result,
+// which is left partial when they cannot be: they are a companion of the
+// backups, not part of them.
+func (h *Handler) storeGlobals(ctx context.Context, prefix string, result *Result) {
+	key, err := h.backupGlobals(ctx, prefix)
+	if err != nil {
+		logf(ctx, "Warning: %v", err)
+		result.Status, result.GlobalsErr = "partial", err.Error()
+		return
+	}
+	result.Globals = key
+}
+
+// backupGlobals dumps the server's global objects and stores them under
+// prefix and globalsPrefix, as today's globals dump, unless the most recent
+// one there is identical; it returns the key of the dump that holds them.
+// Like backups, dumps are compared by checksum, so a server whose roles do
+// not change keeps one dump of them however often it is backed up. Globals
+// dumps are not pruned by retention.
+func (h *Handler) backupGlobals(ctx context.Context, prefix string) (string, error) {
+	raw, err := h.dumpGlobals(ctx, h.db, h.rolePasswords)
+	if err != nil {
+		return "", fmt.Errorf("failed to dump globals: %w", err)
+	}
+	data := removeTimestampComments(raw)
+	sum := checksum(data)
+	dir := prefix + globalsPrefix
+	latest, err := h.mostRecentBackup(ctx, dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+	if latest != "" && h.checksumMatches(ctx, latest, sum) {
+		logf(ctx, "Globals unchanged since %s", latest)
+		return latest, nil
+	}
+	key := globalsKey(prefix, h.now())
+	if err := h.upload(ctx, key, data, sum); err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	logf(ctx, "Globals uploaded: %s", key)
+	return key, nil
+}
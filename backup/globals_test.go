@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunStoresGlobals(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.globals = true
+	globals := []byte("CREATE ROLE app;\n-- Started on 2026-05-27 02:00:00 UTC\n")
+	var passwords bool
+	h.dumpGlobals = func(_ context.Context, _ DatabaseConfig, rolePasswords bool) ([]byte, error) {
+		passwords = rolePasswords
+		return bytes.Clone(globals), nil
+	}
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	const key = "globals/2026-05-27-globals.sql"
+	if res.Globals != key || res.Status != "ok" {
+		t.Fatalf("globals = %q, status %q", res.Globals, res.Status)
+	}
+	obj := f.objects[key]
+	if obj == nil || string(obj.body) != "CREATE ROLE app;\n" {
+		t.Fatalf("stored globals = %v", obj)
+	}
+	if obj.metadata["sha256"] != checksum(obj.body) {
+		t.Errorf("sha256 = %q", obj.metadata["sha256"])
+	}
+	if passwords {
+		t.Error("role passwords dumped without GlobalsRolePasswords")
+	}
+
+	// Unchanged globals are not stored again on a later day.
+	h.now = fixedClock(testNow.AddDate(0, 0, 1))
+	f.clock = f.clock.Add(24 * time.Hour)
+	if res, err = h.Run(context.Background(), RunOptions{Force: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Globals != key {
+		t.Errorf("globals = %q, want the matching %s", res.Globals, key)
+	}
+	if _, ok := f.objects["globals/2026-05-28-globals.sql"]; ok {
+		t.Error("unchanged globals stored again")
+	}
+
+	globals = []byte("CREATE ROLE app;\nCREATE ROLE reporting;\n")
+	if res, err = h.Run(context.Background(), RunOptions{Force: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Globals != "globals/2026-05-28-globals.sql" {
+		t.Errorf("changed globals = %q", res.Globals)
+	}
+
+	h.dumpGlobals = func(context.Context, DatabaseConfig, bool) ([]byte, error) {
+		return nil, errors.New("permission denied for table pg_authid")
+	}
+	if res, err = h.Run(context.Background(), RunOptions{Force: true}); err != nil {
+		t.Fatalf("Run failed with the globals: %v", err)
+	}
+	if res.Status != "partial" || res.GlobalsErr == "" || res.Globals != "" {
+		t.Errorf("status %q, globals %q, error %q", res.Status, res.Globals, res.GlobalsErr)
+	}
+}
@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// defaultGrepMax is the number of matches Grep reports when
+	// GrepOptions.Max is unset.
+	defaultGrepMax = 100
+	// maxGrepLine caps the text reported per match; the whole line is still
+	// searched.
+	maxGrepLine = 1024
+	// grepLineLimit is the longest dump line Grep can scan.
+	grepLineLimit = 64 << 20
+)
+
+// copyHeader matches the COPY statement that opens a table's data section in a
+// plain-format dump.
+var copyHeader = regexp.MustCompile(`^COPY (\S+) .*FROM stdin;$`)
+
+// GrepOptions configures a Grep call.
+type GrepOptions struct {
+	IgnoreCase bool // match case-insensitively
+	Max        int  // stop after this many matches; <= 0 means 100
+}
+
+// GrepMatch is one line of a backup that matched the pattern.
+type GrepMatch struct {
+	Line  int    `json:"line"`            // 1-based line number in the dump
+	Table string `json:"table,omitempty"` // table whose COPY data holds the line, if any
+	Text  string `json:"text"`            // the line, truncated to 1 KiB
+}
+
+// GrepResult summarizes a Grep call.
+type GrepResult struct {
+	Status       string      `json:"status"`        // always "ok" on success
+	RunID        string      `json:"run_id"`        // run identifier, also prefixed to log lines
+	Action       string      `json:"action"`        // always "grep"
+	Key          string      `json:"key"`           // backup that was searched
+	Pattern      string      `json:"pattern"`       // regular expression searched for
+	Matches      []GrepMatch `json:"matches"`       // matching lines, in dump order
+	Truncated    bool        `json:"truncated"`     // true when the search stopped at opts.Max
+	LinesScanned int         `json:"lines_scanned"` // lines read before the search ended
+	DurationMs   int64       `json:"duration_ms"`   // wall-clock time of the call
+}
+
+// Grep streams the backup stored at key and reports the lines matching the
+// regular expression pattern, answering questions such as "is this row in
+// last Tuesday's backup?" without downloading the dump to disk. Lines inside a
+// COPY data section are attributed to their table. Archived backups must be
+// thawed first.
+func (h *Handler) Grep(ctx context.Context, key, pattern string, opts GrepOptions) (*GrepResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	expr := pattern
+	if opts.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	max := opts.Max
+	if max <= 0 {
+		max = defaultGrepMax
+	}
+
+	body, err := h.openScript(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer func() { _ = body.Close() }()
+
+	result := &GrepResult{Status: "ok", RunID: runID, Action: "grep", Key: key, Pattern: pattern, Matches: []GrepMatch{}}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), grepLineLimit)
+	var table string
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		line := scanner.Text()
+		result.LinesScanned++
+		switch {
+		case table != "" && line == `\.`:
+			table = ""
+		case table == "":
+			if m := copyHeader.FindStringSubmatch(line); m != nil {
+				table = m[1]
+			}
+		}
+		if !re.MatchString(line) {
+			continue
+		}
+		if len(result.Matches) == max {
+			result.Truncated = true
+			break
+		}
+		match := GrepMatch{Line: result.LinesScanned, Text: truncateLine(line)}
+		if !strings.HasPrefix(line, "COPY ") {
+			match.Table = table
+		}
+		result.Matches = append(result.Matches, match)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	logf(ctx, "Grep %s: %d match(es) in %d lines", key, len(result.Matches), result.LinesScanned)
+	result.DurationMs = h.elapsed(start)
+	return result, nil
+}
+
+// truncateLine shortens line to maxGrepLine bytes, marking the cut.
+func truncateLine(line string) string {
+	if len(line) <= maxGrepLine {
+		return line
+	}
+	return line[:maxGrepLine] + "..."
+}
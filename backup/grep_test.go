@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const grepDump = `--
+-- PostgreSQL database dump
+--
+
+CREATE TABLE public.users (id integer, email text);
+
+COPY public.users (id, email) FROM stdin;
+1	alice@example.com
+2	bob@example.com
+\.
+
+COPY public.orders (id, note) FROM stdin;
+10	shipped to bob
+\.
+
+-- bob's trigger
+`
+
+func TestGrepAttributesMatchesToTables(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-26-backup.sql", []byte(grepDump), testNow)
+	h := newTestHandler(f, 7)
+
+	res, err := h.Grep(context.Background(), "daily/2026-05-26-backup.sql", "BOB", GrepOptions{IgnoreCase: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []GrepMatch{
+		{Line: 9, Table: "public.users", Text: "2\tbob@example.com"},
+		{Line: 13, Table: "public.orders", Text: "10\tshipped to bob"},
+		{Line: 16, Text: "-- bob's trigger"},
+	}
+	if len(res.Matches) != len(want) {
+		t.Fatalf("matches = %+v, want %+v", res.Matches, want)
+	}
+	for i := range want {
+		if res.Matches[i] != want[i] {
+			t.Errorf("match %d = %+v, want %+v", i, res.Matches[i], want[i])
+		}
+	}
+	if res.Truncated || res.LinesScanned != strings.Count(grepDump, "\n") {
+		t.Errorf("truncated=%v scanned=%d", res.Truncated, res.LinesScanned)
+	}
+}
+
+func TestGrepStopsAtMax(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/x.sql", []byte(grepDump), testNow)
+
+	res, err := newTestHandler(f, 7).Grep(context.Background(), "daily/x.sql", "example", GrepOptions{Max: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Matches) != 1 || !res.Truncated || res.LinesScanned != 9 {
+		t.Errorf("matches=%d truncated=%v scanned=%d, want 1/true/9", len(res.Matches), res.Truncated, res.LinesScanned)
+	}
+}
+
+func TestGrepErrors(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/x.sql", []byte(grepDump), testNow)
+	h := newTestHandler(f, 7)
+
+	if _, err := h.Grep(context.Background(), "daily/x.sql", "(", GrepOptions{}); err == nil {
+		t.Error("expected error for an invalid pattern")
+	}
+	if _, err := h.Grep(context.Background(), "daily/missing.sql", "x", GrepOptions{}); err == nil {
+		t.Error("expected error for a missing backup")
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	long := strings.Repeat("x", maxGrepLine+10)
+	if got := truncateLine(long); len(got) != maxGrepLine+3 || !strings.HasSuffix(got, "...") {
+		t.Errorf("truncateLine(long) has length %d", len(got))
+	}
+	if got := truncateLine("short"); got != "short" {
+		t.Errorf("truncateLine(short) = %q", got)
+	}
+}
@@ -0,0 +1,200 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// growthPrefix holds the growth reports of the bucket (see
+// Handler.GrowthReport), one per day, keyed by date so they sort by time.
+const growthPrefix = "reports/growth/"
+
+// growthHorizons are the days ahead each prefix's size is projected over.
+var growthHorizons = []int{30, 90, 365}
+
+// PrefixGrowth is what a GrowthReport says of the objects under one prefix.
+type PrefixGrowth struct {
+	Prefix string     `json:"prefix"`
+	Count  int        `json:"count"`            // objects, backups and their sidecars alike
+	Bytes  int64      `json:"bytes"`            // their stored size
+	Oldest *time.Time `json:"oldest,omitempty"` // last modified time of the oldest object
+	Newest *time.Time `json:"newest,omitempty"` // last modified time of the newest object
+	// BytesPerDay is how fast Bytes grew, or shrank, since the previous
+	// report, and Projected the size it reaches at that pace in each of
+	// growthHorizons days (e.g. "30d"); both are left out when there is no
+	// previous report to compare with.
+	BytesPerDay *int64           `json:"bytes_per_day,omitempty"`
+	Projected   map[string]int64 `json:"projected_bytes,omitempty"`
+}
+
+// GrowthReport is the per-prefix inventory of the bucket written by
+// Handler.GrowthReport: how many objects each prefix holds, how large they
+// are, how old, and how fast the prefix grows.
+type GrowthReport struct {
+	Status      string         `json:"status"` // "ok"
+	RunID       string         `json:"run_id"`
+	Action      string         `json:"action"` // always "growth"
+	Bucket      string         `json:"bucket"`
+	GeneratedAt time.Time      `json:"generated_at"`
+	Key         string         `json:"key"`                // where the report is stored
+	Previous    string         `json:"previous,omitempty"` // report the growth is measured against
+	Prefixes    []PrefixGrowth `json:"prefixes"`           // sorted by prefix
+	Total       PrefixGrowth   `json:"total"`              // the whole bucket
+	DurationMs  int64          `json:"duration_ms"`
+}
+
+// GrowthReport lists every object of the bucket and reports, for each
+// prefix (see growthPrefixOf), its object count, bytes and oldest and newest
+// objects, with its growth per day since the previous report and the size
+// that growth leads to in 30, 90 and 365 days, for capacity planning. The
+// report is stored under growthPrefix, replacing one of the same day, and
+// sent as a storage.growth notification. Schedule it, as the stack does
+// weekly, for the growth to span a useful period.
+func (h *Handler) GrowthReport(ctx context.Context) (*GrowthReport, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	objects, err := h.listObjects(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	report := &GrowthReport{
+		Status:      "ok",
+		RunID:       runID,
+		Action:      "growth",
+		Bucket:      h.bucket,
+		GeneratedAt: start.UTC(),
+		Key:         growthPrefix + start.UTC().Format("2006-01-02") + ".json",
+		Prefixes:    []PrefixGrowth{},
+	}
+
+	var previous *GrowthReport
+	byPrefix := map[string]*PrefixGrowth{}
+	for _, obj := range objects {
+		key := aws.ToString(obj.Key)
+		if strings.HasPrefix(key, growthPrefix) && key < report.Key && key > report.Previous {
+			report.Previous = key
+		}
+		prefix := growthPrefixOf(key)
+		p := byPrefix[prefix]
+		if p == nil {
+			p = &PrefixGrowth{Prefix: prefix}
+			byPrefix[prefix] = p
+		}
+		p.add(aws.ToInt64(obj.Size), aws.ToTime(obj.LastModified))
+		report.Total.add(aws.ToInt64(obj.Size), aws.ToTime(obj.LastModified))
+	}
+	if report.Previous != "" {
+		previous = &GrowthReport{}
+		if err := h.readJSON(ctx, report.Previous, previous); err != nil {
+			logf(ctx, "Warning: failed to read %s; reporting without growth: %v", report.Previous, err)
+			report.Previous, previous = "", nil
+		}
+	}
+
+	for _, p := range byPrefix {
+		report.Prefixes = append(report.Prefixes, *p)
+	}
+	sort.Slice(report.Prefixes, func(i, j int) bool { return report.Prefixes[i].Prefix < report.Prefixes[j].Prefix })
+	if previous != nil {
+		before := map[string]int64{}
+		for _, p := range previous.Prefixes {
+			before[p.Prefix] = p.Bytes
+		}
+		days := report.GeneratedAt.Sub(previous.GeneratedAt).Hours() / 24
+		for i := range report.Prefixes {
+			report.Prefixes[i].project(before[report.Prefixes[i].Prefix], days)
+		}
+		report.Total.project(previous.Total.Bytes, days)
+	}
+
+	report.DurationMs = h.elapsed(start)
+	if err := h.writeJSON(ctx, report.Key, report); err != nil {
+		return nil, fmt.Errorf("failed to store %s: %w", report.Key, err)
+	}
+	logf(ctx, "Growth report stored: s3://%s/%s", h.bucket, report.Key)
+	h.notify(ctx, growthNotification(report))
+	return report, nil
+}
+
+// growthPrefixOf returns the prefix a GrowthReport counts the object at key
+// under: the key up to its tier ("daily/", "tenants/acme/monthly/") when it
+// is in one, else its first path segment ("state/", "globals/"), or "" at
+// the root of the bucket.
+func growthPrefixOf(key string) string {
+	if i := strings.Index(key, "/"); i >= 0 {
+		for _, tier := range tierPrefixes {
+			if strings.HasPrefix(key, tier) {
+				return tier
+			}
+			if j := strings.Index(key, "/"+tier); j >= 0 {
+				return key[:j+1+len(tier)]
+			}
+		}
+		return key[:i+1]
+	}
+	return ""
+}
+
+// add counts an object of size bytes last modified at modified.
+func (p *PrefixGrowth) add(size int64, modified time.Time) {
+	p.Count++
+	p.Bytes += size
+	modified = modified.UTC()
+	if p.Oldest == nil || modified.Before(*p.Oldest) {
+		p.Oldest = aws.Time(modified)
+	}
+	if p.Newest == nil || modified.After(*p.Newest) {
+		p.Newest = aws.Time(modified)
+	}
+}
+
+// project sets the growth of p from its size of before bytes days ago, and
+// the sizes it reaches at that pace. A prefix new since then grew from 0.
+func (p *PrefixGrowth) project(before int64, days float64) {
+	if days <= 0 {
+		return
+	}
+	perDay := int64(float64(p.Bytes-before) / days)
+	p.BytesPerDay = &perDay
+	p.Projected = map[string]int64{}
+	for _, d := range growthHorizons {
+		p.Projected[strconv.Itoa(d)+"d"] = max(p.Bytes+perDay*int64(d), 0)
+	}
+}
+
+// growthNotification summarizes report, with the largest prefixes, for the
+// Notifier.
+func growthNotification(report *GrowthReport) Notification {
+	largest := append([]PrefixGrowth(nil), report.Prefixes...)
+	sort.SliceStable(largest, func(i, j int) bool { return largest[i].Bytes > largest[j].Bytes })
+	var top []string
+	for _, p := range largest[:min(len(largest), 5)] {
+		top = append(top, fmt.Sprintf("%s %s (%d objects)", p.Prefix, HumanizeSize(int(p.Bytes)), p.Count))
+	}
+	msg := fmt.Sprintf("Bucket %s holds %s in %d objects", report.Bucket, HumanizeSize(int(report.Total.Bytes)), report.Total.Count)
+	fields := map[string]string{
+		"bucket":  report.Bucket,
+		"bytes":   strconv.FormatInt(report.Total.Bytes, 10),
+		"objects": strconv.Itoa(report.Total.Count),
+		"report":  report.Key,
+	}
+	if t := report.Total; t.BytesPerDay != nil {
+		trend, rate := "growing", *t.BytesPerDay
+		if rate < 0 {
+			trend, rate = "shrinking", -rate
+		}
+		msg += fmt.Sprintf(", %s %s a day (%s in 90 days)", trend, HumanizeSize(int(rate)), HumanizeSize(int(t.Projected["90d"])))
+		fields["bytes_per_day"] = strconv.FormatInt(*t.BytesPerDay, 10)
+		fields["projected_90d"] = strconv.FormatInt(t.Projected["90d"], 10)
+	}
+	if len(top) > 0 {
+		msg += "; largest: " + strings.Join(top, ", ")
+	}
+	return Notification{Event: "storage.growth", Message: msg, Fields: fields}
+}
@@ -0,0 +1,100 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrowthReport(t *testing.T) {
+	f := newFakeS3()
+	now := time.Date(2026, 5, 27, 12, 0, 0, 0, time.UTC)
+	f.seed("daily/2026-05-20-backup.sql", make([]byte, 1000), now.AddDate(0, 0, -7))
+	f.seed("daily/2026-05-27-backup.sql", make([]byte, 1000), now)
+	f.seed("tenants/acme/monthly/2026-05-backup.sql", make([]byte, 300), now)
+	f.seed("state/schema.json", make([]byte, 20), now)
+	f.seed("notes.txt", make([]byte, 5), now)
+	var events []Notification
+	h := newTestHandler(f, 7)
+	h.notifier = func(_ context.Context, n Notification) error {
+		events = append(events, n)
+		return nil
+	}
+
+	res, err := h.GrowthReport(context.Background())
+	if err != nil {
+		t.Fatalf("GrowthReport: %v", err)
+	}
+	if res.Key != "reports/growth/2026-05-27.json" || res.Previous != "" {
+		t.Errorf("key = %q, previous = %q; want reports/growth/2026-05-27.json and none", res.Key, res.Previous)
+	}
+	want := map[string][2]int64{"": {1, 5}, "daily/": {2, 2000}, "state/": {1, 20}, "tenants/acme/monthly/": {1, 300}}
+	if len(res.Prefixes) != len(want) {
+		t.Fatalf("prefixes = %+v, want %v", res.Prefixes, want)
+	}
+	for _, p := range res.Prefixes {
+		if w := want[p.Prefix]; int64(p.Count) != w[0] || p.Bytes != w[1] {
+			t.Errorf("%q: count = %d, bytes = %d; want %d, %d", p.Prefix, p.Count, p.Bytes, w[0], w[1])
+		}
+		if p.BytesPerDay != nil {
+			t.Errorf("%q: growth reported without a previous report", p.Prefix)
+		}
+	}
+	if daily := res.Prefixes[1]; !daily.Oldest.Equal(now.AddDate(0, 0, -7)) || !daily.Newest.Equal(now) {
+		t.Errorf("daily/ oldest = %v, newest = %v", daily.Oldest, daily.Newest)
+	}
+	if res.Total.Count != 5 || res.Total.Bytes != 2325 {
+		t.Errorf("total = %+v, want 5 objects of 2325 bytes", res.Total)
+	}
+	var stored GrowthReport
+	if err := json.Unmarshal(f.objects[res.Key].body, &stored); err != nil || stored.Total.Bytes != 2325 {
+		t.Errorf("stored report = %+v (%v)", stored, err)
+	}
+	if len(events) != 1 || events[0].Event != "storage.growth" || events[0].Fields["bytes"] != "2325" {
+		t.Fatalf("notifications = %+v, want one storage.growth", events)
+	}
+
+	// A week later daily/ has grown by 7000 bytes and state/ is gone.
+	f.seed("daily/2026-06-03-backup.sql", make([]byte, 7000), now.AddDate(0, 0, 7))
+	delete(f.objects, "state/schema.json")
+	h.now = fixedClock(now.AddDate(0, 0, 7))
+	events = nil
+	res, err = h.GrowthReport(context.Background())
+	if err != nil {
+		t.Fatalf("GrowthReport: %v", err)
+	}
+	if res.Previous != "reports/growth/2026-05-27.json" {
+		t.Errorf("previous = %q, want the report of 2026-05-27", res.Previous)
+	}
+	for _, p := range res.Prefixes {
+		if p.Prefix != "daily/" {
+			continue
+		}
+		if p.BytesPerDay == nil || *p.BytesPerDay != 1000 || p.Projected["30d"] != 39000 {
+			t.Errorf("daily/ = %+v, want 1000 bytes a day and 39000 in 30 days", p)
+		}
+	}
+	if res.Total.BytesPerDay == nil {
+		t.Fatal("total growth missing")
+	}
+	if len(events) != 1 || events[0].Fields["bytes_per_day"] == "" || !strings.Contains(events[0].Message, "growing") {
+		t.Errorf("notifications = %+v, want growth in the message", events)
+	}
+}
+
+func TestGrowthPrefixOf(t *testing.T) {
+	for key, want := range map[string]string{
+		"daily/2026-05-27-backup.sql":             "daily/",
+		"schema-only/yearly/2026-backup.sql":      "schema-only/yearly/",
+		"tenants/acme/monthly/2026-05-backup.sql": "tenants/acme/monthly/",
+		"globals/2026-05-27-globals.sql":          "globals/",
+		"reports/growth/2026-05-27.json":          "reports/",
+		"notes.txt":                               "",
+	} {
+		if got := growthPrefixOf(key); got != want {
+			t.Errorf("growthPrefixOf(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Latest pointer modes (see Config.LatestPointer).
+const (
+	LatestNone = ""     // no pointer is maintained
+	LatestCopy = "copy" // latestCopyKey holds a server-side copy of the newest daily backup
+	LatestJSON = "json" // latestJSONKey holds a LatestPointer naming it
+)
+
+// Keys of the latest pointer, under each profile's prefix.
+const (
+	latestCopyKey = "latest/backup.sql"
+	latestJSONKey = "latest/backup.json"
+)
+
+// LatestPointer is the body of the LatestJSON pointer: where the newest daily
+// backup of a profile is and how to check it.
+type LatestPointer struct {
+	Key         string    `json:"key"`          // the daily backup
+	ManifestKey string    `json:"manifest_key"` // its manifest (see Manifest)
+	SHA256      string    `json:"sha256"`       // checksum of the dump
+	Size        int64     `json:"size"`         // size of the dump in bytes
+	RunID       string    `json:"run_id"`       // run that stored it
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// isLatestKey reports whether key is a latest pointer, at the bucket root or
+// under a profile prefix.
+func isLatestKey(key string) bool {
+	for _, name := range []string{latestCopyKey, latestJSONKey} {
+		if key == name || strings.HasSuffix(key, "/"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateLatest points the latest pointer under prefix at the daily backup just
+// uploaded to key, holding a dump of size bytes with checksum sum, and returns
+// the pointer's key. The copy keeps the backup's metadata, so it is read,
+// checked and decompressed like the backup itself; backups over maxCopySize
+// are copied in parts (see serverCopy).
+func (h *Handler) updateLatest(ctx context.Context, prefix, key string, size int64, sum string) (string, error) {
+	switch h.latestPointer {
+	case LatestCopy:
+		pointer := prefix + latestCopyKey
+		head, err := h.headObject(ctx, key)
+		if err != nil {
+			return "", fmt.Errorf("failed to copy %s to %s: %w", key, pointer, err)
+		}
+		input := &s3.CopyObjectInput{
+			Bucket:     aws.String(h.bucket),
+			Key:        aws.String(pointer),
+			CopySource: h.copySource(key),
+		}
+		h.encryption.applyToCopy(input)
+		if h.encryption.Cipher == CipherSSEC {
+			input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5 = h.encryption.customerKeyParams()
+		}
+		if err := h.serverCopy(ctx, input, key, aws.ToInt64(head.ContentLength)); err != nil {
+			return "", fmt.Errorf("failed to copy %s to %s: %w", key, pointer, err)
+		}
+		return pointer, nil
+	case LatestJSON:
+		pointer := prefix + latestJSONKey
+		if err := h.writeJSON(ctx, pointer, LatestPointer{
+			Key:         key,
+			ManifestKey: manifestKey(key),
+			SHA256:      sum,
+			Size:        size,
+			RunID:       RunID(ctx),
+			CreatedAt:   h.now().UTC(),
+		}); err != nil {
+			return "", fmt.Errorf("failed to write %s: %w", pointer, err)
+		}
+		return pointer, nil
+	default:
+		return "", nil
+	}
+}
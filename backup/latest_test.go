@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunUpdatesLatestCopy(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.latestPointer = LatestCopy
+	h.compression = Compression{CompressionZstd, 3}
+	h.dump = staticDump(compressibleDump)
+	ctx := context.Background()
+
+	res, err := h.Run(ctx, RunOptions{Profile: "schema-only"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Latest != "schema-only/latest/backup.sql" {
+		t.Fatalf("latest = %q", res.Latest)
+	}
+	if got := readAll(t, h, res.Latest); !bytes.Equal(got, compressibleDump) {
+		t.Error("the latest copy should read back as the dump")
+	}
+	if sum := f.objects[res.Latest].metadata["sha256"]; sum != checksum(compressibleDump) {
+		t.Errorf("latest copy sha256 = %q, want the backup's metadata", sum)
+	}
+	if rec, err := h.Reconcile(ctx, ReconcileOptions{}); err != nil || len(rec.Findings) != 0 {
+		t.Errorf("reconcile = %+v, %v; want the pointer ignored", rec, err)
+	}
+
+	// A skipped run leaves the pointer at the backup it matched.
+	h.now = fixedClock(testNow.AddDate(0, 0, 1))
+	if res, _ := h.Run(ctx, RunOptions{Profile: "schema-only"}); res == nil || res.Action != "skipped" || res.Latest != "" {
+		t.Errorf("unchanged run = %+v, want skipped without moving the pointer", res)
+	}
+}
+
+func TestLatestCopyInParts(t *testing.T) {
+	smallParts(t)
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.latestPointer = LatestCopy
+	dump := bytes.Repeat([]byte("INSERT INTO t VALUES (1);\n"), 200) // over maxCopySize
+	h.dump = staticDump(dump)
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil || res.Status != "ok" {
+		t.Fatalf("Run = %+v, %v; want the pointer copied", res, err)
+	}
+	if got := readAll(t, h, res.Latest); !bytes.Equal(got, dump) {
+		t.Error("the latest copy should read back as the dump")
+	}
+	if f.objects[res.Latest].metadata["sha256"] != checksum(dump) || f.completes != 1 {
+		t.Errorf("latest copy metadata = %v after %d multipart copies, want the backup's in one", f.objects[res.Latest].metadata, f.completes)
+	}
+}
+
+func TestRunUpdatesLatestJSON(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.latestPointer = LatestJSON
+	ctx := context.Background()
+
+	res, err := h.Run(ctx, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p LatestPointer
+	if err := h.readJSON(ctx, "latest/backup.json", &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Key != res.Key || p.ManifestKey != res.ManifestKey || p.RunID != res.RunID || p.SHA256 == "" {
+		t.Errorf("pointer = %+v, result = %+v", p, res)
+	}
+
+	h.now = fixedClock(testNow.AddDate(0, 0, 1))
+	h.dump = staticDump([]byte("changed"))
+	if res, err = h.Run(ctx, RunOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.readJSON(ctx, res.Latest, &p); err != nil || p.Key != res.Key {
+		t.Errorf("pointer = %+v, %v; want it moved to %s", p, err, res.Key)
+	}
+}
+
+func TestRunLatestFailure(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.latestPointer = LatestCopy
+	f.copyErr = errors.New("AccessDenied")
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("a failed pointer should not fail the run: %v", err)
+	}
+	if res.Status != "partial" || res.LatestErr == "" || res.Action != "created" {
+		t.Errorf("result = %+v, want a partial run that stored its backup", res)
+	}
+}
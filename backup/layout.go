@@ -0,0 +1,174 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Key layouts (see Config.KeyLayout).
+const (
+	// LayoutTiers stores backups as "<prefix><tier>/<date>-backup.sql", e.g.
+	// "daily/2024-06-15-backup.sql".
+	LayoutTiers = ""
+	// LayoutHive stores them under Hive-style partitions of the database
+	// name and date within each tier, e.g.
+	// "daily/db=app/year=2024/month=06/day=15/2024-06-15-backup.sql", so a
+	// tier can be an Athena table with partition projection.
+	LayoutHive = "hive"
+)
+
+// backupTiers are the tiers of a backup, with the date format of their key
+// names and the number of date partitions they have under LayoutHive.
+var backupTiers = map[string]struct {
+	layout     string
+	partitions int
+}{
+	"hourly":  {"2006-01-02T15", 4},
+	"daily":   {"2006-01-02", 3},
+	"monthly": {"2006-01", 2},
+	"yearly":  {"2006", 1},
+}
+
+// backupKey returns the key of the backup of tier ("hourly", "daily",
+// "monthly" or "yearly") taken at t, under prefix.
+func (h *Handler) backupKey(prefix, tier string, t time.Time) string {
+	name := t.Format(backupTiers[tier].layout) + "-backup.sql"
+	if h.keyLayout != LayoutHive {
+		return prefix + tier + "/" + name
+	}
+	parts := []string{"year=" + t.Format("2006"), "month=" + t.Format("01"), "day=" + t.Format("02"), "hour=" + t.Format("15")}
+	return fmt.Sprintf("%s%s/%s%s/%s", prefix, tier, h.databasePartition(), strings.Join(parts[:backupTiers[tier].partitions], "/"), name)
+}
+
+// gzipSuffix follows ".sql" in the key of a gzip-compressed backup, e.g.
+// "daily/2024-06-15-backup.sql.gz", so a download is ready for gunzip.
+const gzipSuffix = ".gz"
+
+// storedKey returns the key the backup backupKey names key is stored under
+// with Compression c: with gzipSuffix when c is gzip.
+func storedKey(key string, c Compression) string {
+	if c.Codec == CompressionGzip {
+		return plainKey(key) + gzipSuffix
+	}
+	return plainKey(key)
+}
+
+// plainKey returns the backup key as backupKey names it, without gzipSuffix.
+// Sidecars and retention dates go by it, whatever the backup's compression.
+func plainKey(key string) string {
+	return strings.TrimSuffix(key, gzipSuffix)
+}
+
+// findBackup returns the key the backup key names is stored under, with or
+// without gzipSuffix, or "" when there is none.
+func (h *Handler) findBackup(ctx context.Context, key string) (string, error) {
+	for _, k := range []string{plainKey(key), plainKey(key) + gzipSuffix} {
+		exists, err := h.objectExists(ctx, k)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return k, nil
+		}
+	}
+	return "", nil
+}
+
+// removeRenamed deletes the copy of the backup just stored at key kept under
+// its other name, as when the compression changed from or to gzip since a
+// backup of the same date was stored, so one date has one backup. Failures
+// are logged; the copy then ages out with retention.
+func (h *Handler) removeRenamed(ctx context.Context, key string) {
+	other := plainKey(key)
+	if other == key {
+		other += gzipSuffix
+	}
+	exists, err := h.objectExists(ctx, other)
+	if err == nil && exists {
+		_, err = h.s3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(h.bucket), Key: aws.String(other)})
+		if err == nil {
+			logf(ctx, "Removed %s, renamed to %s", other, key)
+		}
+	}
+	if err != nil {
+		logf(ctx, "Warning: failed to remove %s: %v", other, err)
+	}
+}
+
+// runTier returns the tier each run stores a backup in: "hourly" with
+// HourlyBackups, else "daily". The tiers above it are created when missing
+// (see periodicTiers).
+func (h *Handler) runTier() string {
+	if h.hourly {
+		return "hourly"
+	}
+	return "daily"
+}
+
+// periodicTiers returns the tiers a run creates when missing, capitalized for
+// its logs: those above runTier.
+func (h *Handler) periodicTiers() []string {
+	if h.hourly {
+		return []string{"Daily", "Monthly", "Yearly"}
+	}
+	return []string{"Monthly", "Yearly"}
+}
+
+// tierTitle returns tier capitalized, for logs.
+func tierTitle(tier string) string {
+	return strings.ToUpper(tier[:1]) + tier[1:]
+}
+
+// runTierPrefix returns the prefix under which the backups of the configured
+// database in runTier are stored, under prefix.
+func (h *Handler) runTierPrefix(prefix string) string {
+	if h.keyLayout != LayoutHive {
+		return prefix + h.runTier() + "/"
+	}
+	return prefix + h.runTier() + "/" + h.databasePartition()
+}
+
+// databasePartition returns the "db=<name>/" partition of the configured
+// database. Characters other than letters, digits, "-" and "_" in the name
+// become "_", so the value needs no escaping in a key or Athena query.
+func (h *Handler) databasePartition() string {
+	name := h.db.Database
+	if name == "" {
+		name = "default"
+	}
+	return "db=" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name) + "/"
+}
+
+// dailyName returns the file name of the daily backup key or sidecar whose
+// key under its tier prefix is name, in either layout, reporting false when
+// name is not in one of them.
+func dailyName(name string) (string, bool) {
+	return tierName("daily", name)
+}
+
+// tierName is dailyName for the backups of tier, reporting false for a tier
+// that does not exist.
+func tierName(tier, name string) (string, bool) {
+	t, ok := backupTiers[tier]
+	if !ok {
+		return "", false
+	}
+	if !strings.Contains(name, "/") {
+		return name, true
+	}
+	if !strings.HasPrefix(name, "db=") || strings.Count(name, "/") != 1+t.partitions {
+		return "", false
+	}
+	return path.Base(name), true
+}
@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRunHiveLayout(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.keyLayout = LayoutHive
+	h.db.Database = "app.main"
+	ctx := context.Background()
+
+	res, err := h.Run(ctx, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Key != "daily/db=app_main/year=2026/month=05/day=27/2026-05-27-backup.sql" {
+		t.Errorf("daily key = %q", res.Key)
+	}
+	for _, key := range []string{
+		"monthly/db=app_main/year=2026/month=05/2026-05-backup.sql",
+		"yearly/db=app_main/year=2026/2026-backup.sql",
+		"daily/db=app_main/year=2026/month=05/day=27/2026-05-27-backup.manifest.json",
+	} {
+		if _, ok := f.objects[key]; !ok {
+			t.Errorf("missing %s", key)
+		}
+	}
+
+	// The next day's unchanged dump matches the backup in its partition, and
+	// is pruned like any daily backup once out of retention.
+	h.now = fixedClock(testNow.AddDate(0, 0, 1))
+	if res, err := h.Run(ctx, RunOptions{}); err != nil || res.Action != "skipped" {
+		t.Errorf("unchanged run = %+v, %v; want skipped", res, err)
+	}
+	prune, err := h.Prune(ctx, PruneOptions{AsOf: testNow.AddDate(0, 0, 10), Simulate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prune.Decisions) == 0 {
+		t.Fatal("no prune decisions")
+	}
+	for _, d := range prune.Decisions {
+		if want := strings.HasPrefix(d.Key, "daily/"); (d.Action == PruneDelete) != want {
+			t.Errorf("%s: %s (%s)", d.Key, d.Action, d.Reason)
+		}
+	}
+}
+
+func TestDailyName(t *testing.T) {
+	for name, want := range map[string]string{
+		"2026-05-27-backup.sql": "2026-05-27-backup.sql",
+		"db=app/year=2026/month=05/day=27/2026-05-27-backup.manifest.json": "2026-05-27-backup.manifest.json",
+		"db=app/year=2026/month=05/2026-05-backup.sql":                     "",
+		"other/2026-05-27-backup.sql":                                      "",
+	} {
+		got, ok := dailyName(name)
+		if got != want || ok != (want != "") {
+			t.Errorf("dailyName(%q) = %q, %t", name, got, ok)
+		}
+	}
+}
+
+func TestHourlyHiveKey(t *testing.T) {
+	h := newTestHandler(newFakeS3(), 7)
+	h.keyLayout = LayoutHive
+	h.db.Database = "app"
+	key := h.backupKey("", "hourly", testNow)
+	if key != "hourly/db=app/year=2026/month=05/day=27/hour=12/2026-05-27T12-backup.sql" {
+		t.Errorf("hourly key = %q", key)
+	}
+	if name, ok := tierName("hourly", strings.TrimPrefix(key, "hourly/")); !ok || name != "2026-05-27T12-backup.sql" {
+		t.Errorf("tierName = %q, %t", name, ok)
+	}
+}
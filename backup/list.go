@@ -0,0 +1,130 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ListEntry describes one stored backup, from its object metadata and its
+// manifest.
+type ListEntry struct {
+	Key          string            `json:"key"`
+	LastModified time.Time         `json:"last_modified"`
+	Size         int64             `json:"size"`                     // dump size in bytes, before compression
+	StoredSize   int64             `json:"stored_size"`              // object size in bytes, as stored
+	SHA256       string            `json:"sha256,omitempty"`         // checksum of the dump; "" for backups stored before checksums were
+	StorageClass string            `json:"storage_class"`            // e.g. "STANDARD", "GLACIER"
+	Encryption   string            `json:"encryption"`               // one of the Cipher* constants
+	EncryptionID string            `json:"encryption_key,omitempty"` // key that protects the object (see EncryptionInfo.KeyID)
+	Compression  string            `json:"compression"`              // e.g. "zstd:3", or "none"
+	Labels       map[string]string `json:"labels,omitempty"`         // labels of the run that stored it (see Manifest.Labels)
+	Signature    string            `json:"signature,omitempty"`      // SignatureValid, SignatureUnsigned or SignatureInvalid when manifests are signed
+	Error        string            `json:"error,omitempty"`          // why the metadata or manifest could not be read
+}
+
+// ListResult summarizes a List call.
+type ListResult struct {
+	Status     string      `json:"status"`      // "ok", or "partial" when any entry could not be described
+	RunID      string      `json:"run_id"`      // run identifier, also prefixed to log lines
+	Action     string      `json:"action"`      // always "list"
+	Prefix     string      `json:"prefix"`      // prefix that was listed
+	Backups    []ListEntry `json:"backups"`     // newest first
+	DurationMs int64       `json:"duration_ms"` // wall-clock time of the call
+}
+
+// List returns the backups under prefix, newest first, each with its size,
+// checksum, storage class, encryption, compression, labels and, when
+// manifests are signed, whether its manifest verifies, so the right
+// one can be picked without inspecting objects one by one. An empty prefix
+// covers every tier and profile. Each backup costs a HeadObject and a read of
+// its manifest; one that cannot be described is still listed, with its Error
+// set.
+func (h *Handler) List(ctx context.Context, prefix string) (*ListResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	objects, err := h.listObjects(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	result := &ListResult{Status: "ok", RunID: runID, Action: "list", Prefix: prefix, Backups: []ListEntry{}}
+	for _, obj := range objects {
+		key := aws.ToString(obj.Key)
+		if isSidecarKey(key) || isLatestKey(key) || !isBackupKey(key) {
+			continue
+		}
+		entry := h.describeBackup(ctx, obj)
+		if entry.Error != "" {
+			logf(ctx, "Warning: failed to describe %s: %s", key, entry.Error)
+			result.Status = "partial"
+		}
+		result.Backups = append(result.Backups, entry)
+	}
+	sort.SliceStable(result.Backups, func(i, j int) bool {
+		return result.Backups[i].LastModified.After(result.Backups[j].LastModified)
+	})
+	result.DurationMs = h.elapsed(start)
+	return result, nil
+}
+
+// describeBackup returns the ListEntry for the listed backup obj. Fields the
+// listing carries are filled in even when the HEAD or manifest read fails.
+func (h *Handler) describeBackup(ctx context.Context, obj types.Object) ListEntry {
+	key := aws.ToString(obj.Key)
+	entry := ListEntry{
+		Key:          key,
+		LastModified: aws.ToTime(obj.LastModified),
+		Size:         aws.ToInt64(obj.Size),
+		StoredSize:   aws.ToInt64(obj.Size),
+		StorageClass: string(obj.StorageClass),
+	}
+	head, err := h.headObject(ctx, key)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	if head.ContentLength != nil {
+		entry.StoredSize = *head.ContentLength
+	}
+	if head.StorageClass != "" {
+		entry.StorageClass = string(head.StorageClass)
+	}
+	if entry.StorageClass == "" {
+		entry.StorageClass = string(types.StorageClassStandard)
+	}
+	entry.Size = uncompressedSize(head.Metadata, entry.StoredSize)
+	entry.SHA256 = head.Metadata["sha256"]
+	entry.Compression = compressionFromMetadata(head.Metadata).String()
+	info, err := encryptionFromMetadata(head.Metadata)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.Encryption, entry.EncryptionID = info.Cipher, info.KeyID
+
+	m, err := h.readManifest(ctx, key)
+	if errors.Is(err, errManifestSignature) {
+		entry.Signature = SignatureInvalid
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	if m == nil && h.signer != nil {
+		entry.Signature = SignatureUnsigned
+	}
+	if m != nil {
+		entry.Signature = m.signature
+		entry.Labels = m.Labels
+		if entry.SHA256 == "" {
+			entry.SHA256 = m.SHA256
+		}
+	}
+	return entry
+}
@@ -0,0 +1,64 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.compression = Compression{CompressionZstd, 3}
+	h.dump = staticDump(compressibleDump)
+	ctx := context.Background()
+
+	first, err := h.Run(ctx, RunOptions{Labels: map[string]string{"reason": "pre-migration"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.now = fixedClock(testNow.AddDate(0, 0, 1))
+	h.dump = staticDump([]byte("changed"))
+	second, err := h.Run(ctx, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := h.List(ctx, "daily/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != "ok" || len(res.Backups) != 2 {
+		t.Fatalf("result = %+v, want the two daily backups without their sidecars", res)
+	}
+	newest, oldest := res.Backups[0], res.Backups[1]
+	if newest.Key != second.Key || oldest.Key != first.Key {
+		t.Errorf("keys = %s, %s; want newest first", newest.Key, oldest.Key)
+	}
+	if oldest.Size != int64(len(compressibleDump)) || oldest.StoredSize >= oldest.Size {
+		t.Errorf("sizes = %d stored, %d dump; want the compressed and the dump size", oldest.StoredSize, oldest.Size)
+	}
+	if oldest.SHA256 != checksum(compressibleDump) || oldest.Compression != "zstd:3" || oldest.StorageClass != "STANDARD" || oldest.Encryption != CipherNone {
+		t.Errorf("entry = %+v", oldest)
+	}
+	if oldest.Labels["reason"] != "pre-migration" || newest.Labels != nil {
+		t.Errorf("labels = %v, %v; want the first run's only", oldest.Labels, newest.Labels)
+	}
+}
+
+func TestListHeadFailure(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.headErr = errors.New("AccessDenied")
+	list, err := h.List(context.Background(), "daily/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Status != "partial" || len(list.Backups) != 1 || list.Backups[0].Key != res.Key || list.Backups[0].Error == "" {
+		t.Errorf("result = %+v, want the backup listed with its error", list)
+	}
+}
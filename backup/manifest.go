@@ -0,0 +1,286 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// manifestSuffix replaces ".sql" (and any gzipSuffix) in a backup key to name
+// its manifest.
+const manifestSuffix = ".manifest.json"
+
+// manifestFormatVersion is the version of the Manifest layout written by this
+// package.
+const manifestFormatVersion = 1
+
+// defaultChunkSize is the span covered by each checksum in Manifest.Chunks.
+const defaultChunkSize = 8 << 20
+
+// Manifest describes a stored backup. It is written next to the backup (see
+// manifestKey) when the backup is uploaded.
+type Manifest struct {
+	FormatVersion int       `json:"format_version"` // manifestFormatVersion at write time
+	Key           string    `json:"key"`            // S3 key of the backup
+	RunID         string    `json:"run_id"`         // run that produced the backup
+	Profile       string    `json:"profile"`        // profile the run used
+	CreatedAt     time.Time `json:"created_at"`
+	Size          int64     `json:"size"`       // body size in bytes, before compression
+	SHA256        string    `json:"sha256"`     // checksum of the whole body, before compression
+	ChunkSize     int64     `json:"chunk_size"` // bytes covered by each entry of Chunks
+	// Chunks holds the SHA-256 of each consecutive ChunkSize slice of the
+	// body (the last may be shorter), so corruption can be localized and
+	// individual chunks re-verified with ranged GETs.
+	Chunks []string `json:"chunks"`
+	Source DumpInfo `json:"source"` // server the dump was taken from
+	// Fingerprint identifies the database the dump was taken from; nil
+	// when it could not be read.
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty"`
+	// ExtensionSteps is what restoring the backup needs for the extensions
+	// in Source that a plain dump does not restore correctly on its own.
+	ExtensionSteps []ExtensionSteps `json:"extension_steps,omitempty"`
+	Snapshot       string           `json:"snapshot,omitempty"` // storage-level snapshot taken by the same run (see Snapshotter)
+	Slices         []Slice          `json:"slices,omitempty"`   // data of sliced tables, stored next to the backup (see SliceSpec)
+	// Compression is the codec and level the body is stored with, e.g.
+	// "zstd:3"; "" when it is stored uncompressed.
+	Compression string `json:"compression,omitempty"`
+	// CompressionReference is the key of the dump the body was compressed
+	// against, which restoring it needs (see Config.CompressionReferenceDays).
+	CompressionReference string `json:"compression_reference,omitempty"`
+	// Format is FormatCustom for a custom-format archive, restored with
+	// pg_restore; "" for a plain SQL script.
+	Format string `json:"format,omitempty"`
+	// Labels are those of the run that stored the backup, such as the
+	// reason a queued Job gave for it.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// signature is the Signature state readManifest found, "" when
+	// manifests are not signed (see ManifestSigner).
+	signature string
+}
+
+// chunk returns the offset and length of chunk i of m.
+func (m *Manifest) chunk(i int) (offset, length int64) {
+	offset = int64(i) * m.ChunkSize
+	return offset, min(m.ChunkSize, m.Size-offset)
+}
+
+// chunkSums returns the SHA-256 of each consecutive chunkSize slice of data.
+func chunkSums(data []byte, chunkSize int64) []string {
+	sums := make([]string, 0, int64(len(data))/chunkSize+1)
+	for off := int64(0); off < int64(len(data)); off += chunkSize {
+		sums = append(sums, checksum(data[off:min(off+chunkSize, int64(len(data)))]))
+	}
+	return sums
+}
+
+// chunkHasher is an io.Writer that hashes its input both as a whole and in
+// consecutive chunks, so a streamed download can be compared with a Manifest.
+type chunkHasher struct {
+	size   int64
+	total  hash.Hash
+	chunk  hash.Hash
+	filled int64
+	sums   []string
+}
+
+func newChunkHasher(size int64) *chunkHasher {
+	return &chunkHasher{size: size, total: sha256.New(), chunk: sha256.New()}
+}
+
+func (c *chunkHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	_, _ = c.total.Write(p)
+	for len(p) > 0 {
+		take := min(int64(len(p)), c.size-c.filled)
+		_, _ = c.chunk.Write(p[:take])
+		c.filled += take
+		p = p[take:]
+		if c.filled == c.size {
+			c.flush()
+		}
+	}
+	return n, nil
+}
+
+func (c *chunkHasher) flush() {
+	c.sums = append(c.sums, hex.EncodeToString(c.chunk.Sum(nil)))
+	c.chunk.Reset()
+	c.filled = 0
+}
+
+// result returns the whole-body checksum and the chunk checksums.
+func (c *chunkHasher) result() (string, []string) {
+	if c.filled > 0 {
+		c.flush()
+	}
+	return hex.EncodeToString(c.total.Sum(nil)), c.sums
+}
+
+// downloadChunkSums downloads the object at key and returns the SHA-256 of its
+// body and of each consecutive chunkSize slice of it.
+func (h *Handler) downloadChunkSums(ctx context.Context, key string, chunkSize int64) (string, []string, error) {
+	body, err := h.openObject(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() { _ = body.Close() }()
+
+	hasher := newChunkHasher(chunkSize)
+	if _, err := copyPooled(hasher, body); err != nil {
+		return "", nil, err
+	}
+	sum, chunks := hasher.result()
+	return sum, chunks, nil
+}
+
+// manifestKey returns the key of the manifest stored with the backup at key,
+// e.g. "daily/2026-05-27-backup.manifest.json".
+func manifestKey(key string) string {
+	return strings.TrimSuffix(plainKey(key), ".sql") + manifestSuffix
+}
+
+// isSidecarKey reports whether key names a file stored alongside a backup (a
+// manifest, refresh script, migration state or table slice) rather than a
+// backup itself.
+func isSidecarKey(key string) bool {
+	return strings.HasSuffix(key, manifestSuffix) || strings.HasSuffix(key, refreshSuffix) || strings.HasSuffix(key, migrationsSuffix) || isSliceKey(key)
+}
+
+// sidecarBackupKey returns the key of the backup a sidecar key belongs to, as
+// plainKey names it, or key itself when it is not a sidecar.
+func sidecarBackupKey(key string) string {
+	if isSliceKey(key) {
+		return sliceBackupKey(key)
+	}
+	for _, suffix := range []string{manifestSuffix, refreshSuffix, migrationsSuffix} {
+		if base, ok := strings.CutSuffix(key, suffix); ok {
+			return base + ".sql"
+		}
+	}
+	return key
+}
+
+// writeManifest builds and stores the Manifest of the backup data uploaded to
+// key, stored with slices.
+func (h *Handler) writeManifest(ctx context.Context, key, profile string, data []byte, sum string, slices []Slice) error {
+	m := h.newManifest(ctx, key, profile, int64(len(data)), sum, chunkSums(data, defaultChunkSize), parseDumpInfo(data), slices)
+	m.Format = dumpFormat(data)
+	if c, ref := compressionOf(ctx, h.bucket, key); c.enabled() {
+		m.Compression, m.CompressionReference = c.String(), ref
+	}
+	return h.putManifest(ctx, m)
+}
+
+// newManifest returns the Manifest of a backup of size bytes stored at key,
+// with checksum sum, chunk checksums chunks (of defaultChunkSize) and the
+// source server source, stored with slices by the run in ctx.
+func (h *Handler) newManifest(ctx context.Context, key, profile string, size int64, sum string, chunks []string, source DumpInfo, slices []Slice) Manifest {
+	var fingerprint *Fingerprint
+	if fp, ok := fingerprintFrom(ctx); ok {
+		fingerprint = &fp
+	}
+	return Manifest{
+		FormatVersion:  manifestFormatVersion,
+		Key:            key,
+		RunID:          RunID(ctx),
+		Profile:        profile,
+		CreatedAt:      h.now().UTC(),
+		Size:           size,
+		SHA256:         sum,
+		ChunkSize:      defaultChunkSize,
+		Chunks:         chunks,
+		Source:         source,
+		Fingerprint:    fingerprint,
+		ExtensionSteps: restoreSteps(source.Extensions),
+		Snapshot:       snapshotID(ctx),
+		Slices:         slices,
+		Labels:         labelsFrom(ctx),
+	}
+}
+
+// putManifest stores m next to the backup it describes, signed when a
+// ManifestSigner is configured.
+func (h *Handler) putManifest(ctx context.Context, m Manifest) error {
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(h.bucket),
+		Key:         aws.String(manifestKey(m.Key)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+		Metadata:    map[string]string{"sha256": checksum(body)},
+	}
+	sig, err := h.signManifest(ctx, body)
+	if err != nil {
+		return fmt.Errorf("failed to sign manifest for %s: %w", m.Key, err)
+	}
+	if sig != "" {
+		input.Metadata[signatureMetadata] = sig
+	}
+	h.encryption.addMetadata(input.Metadata)
+	h.encryption.applyToPut(input)
+	if _, err := h.s3.PutObject(ctx, input); err != nil {
+		return fmt.Errorf("failed to upload manifest for %s: %w", m.Key, err)
+	}
+	return nil
+}
+
+// readManifest returns the Manifest stored with the backup at key, or nil when
+// the backup has none (it predates manifests). With a ManifestSigner
+// configured, it fails for a manifest whose signature does not verify, or
+// that was signed for another backup, and records in the Manifest whether it
+// was signed.
+func (h *Handler) readManifest(ctx context.Context, key string) (*Manifest, error) {
+	r, err := h.openObject(ctx, manifestKey(key))
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) || (err != nil && strings.Contains(err.Error(), "NoSuchKey")) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return nil, err
+	}
+	var sig string
+	if h.signer != nil {
+		head, err := h.headObject(ctx, manifestKey(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the signature of the manifest for %s: %w", key, err)
+		}
+		sig = head.Metadata[signatureMetadata]
+	}
+	signature, err := h.verifyManifest(ctx, body, sig)
+	if err != nil {
+		return nil, fmt.Errorf("manifest for %s: %w", key, err)
+	}
+
+	m := Manifest{signature: signature}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest for %s: %w", key, err)
+	}
+	if signature == SignatureValid && m.Key != key {
+		return nil, fmt.Errorf("manifest for %s was signed for %s", key, m.Key)
+	}
+	if m.FormatVersion > manifestFormatVersion {
+		return nil, fmt.Errorf("manifest for %s has format version %d; this build reads up to %d", key, m.FormatVersion, manifestFormatVersion)
+	}
+	return &m, nil
+}
@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// seedManifest stores a manifest for the backup body at key with the given
+// chunk size.
+func seedManifest(f *fakeS3, key string, body []byte, chunkSize int64) {
+	m := Manifest{
+		FormatVersion: manifestFormatVersion,
+		Key:           key,
+		Size:          int64(len(body)),
+		SHA256:        checksum(body),
+		ChunkSize:     chunkSize,
+		Chunks:        chunkSums(body, chunkSize),
+	}
+	data, _ := json.Marshal(m)
+	f.seed(manifestKey(key), data, testNow)
+}
+
+func TestChunkHasherMatchesChunkSums(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 25) // 250 bytes: 3 full chunks of 64 and a short one
+	h := newChunkHasher(64)
+	for _, part := range [][]byte{data[:10], data[10:100], data[100:]} {
+		_, _ = h.Write(part)
+	}
+	sum, chunks := h.result()
+	if sum != checksum(data) {
+		t.Errorf("whole-body sum = %s, want %s", sum, checksum(data))
+	}
+	if want := chunkSums(data, 64); !slices.Equal(chunks, want) || len(chunks) != 4 {
+		t.Errorf("chunks = %v, want %v", chunks, want)
+	}
+}
+
+func TestSidecarKeys(t *testing.T) {
+	for key, want := range map[string]string{
+		"daily/2026-05-27-backup.manifest.json": "daily/2026-05-27-backup.sql",
+		"daily/2026-05-27-backup.refresh.sql":   "daily/2026-05-27-backup.sql",
+		"daily/2026-05-27-backup.sql":           "daily/2026-05-27-backup.sql",
+	} {
+		if got := sidecarBackupKey(key); got != want {
+			t.Errorf("sidecarBackupKey(%q) = %q, want %q", key, got, want)
+		}
+		if isSidecarKey(key) != (key != want) {
+			t.Errorf("isSidecarKey(%q) = %v", key, isSidecarKey(key))
+		}
+	}
+}
+
+func TestRunWritesManifests(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.dump = staticDump([]byte(sampleDump))
+
+	res, err := h.Run(WithRunID(context.Background(), "run-7"), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.ManifestKey != "daily/2026-05-27-backup.manifest.json" {
+		t.Errorf("ManifestKey = %q", res.ManifestKey)
+	}
+	for _, key := range []string{res.Key, "monthly/2026-05-backup.sql", "yearly/2026-backup.sql"} {
+		m, err := h.readManifest(context.Background(), key)
+		if err != nil || m == nil {
+			t.Fatalf("readManifest(%s) = %v, %v", key, m, err)
+		}
+		if m.Key != key || m.RunID != "run-7" || m.Profile != "full" || m.SHA256 != checksum([]byte(sampleDump)) ||
+			m.Size != int64(len(sampleDump)) || len(m.Chunks) != 1 || m.Source.DumpVersion != "16.1" {
+			t.Errorf("manifest of %s = %+v", key, m)
+		}
+	}
+}
+
+func TestReadManifestMissingAndTooNew(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	if m, err := h.readManifest(context.Background(), "daily/legacy.sql"); m != nil || err != nil {
+		t.Errorf("missing manifest = %v, %v, want nil, nil", m, err)
+	}
+	f.seed(manifestKey("daily/new.sql"), []byte(`{"format_version": 99}`), testNow)
+	if _, err := h.readManifest(context.Background(), "daily/new.sql"); err == nil {
+		t.Error("expected an error for a newer manifest format")
+	}
+}
+
+func TestAuditLocalizesCorruptChunks(t *testing.T) {
+	body := []byte(strings.Repeat("a", 64) + strings.Repeat("b", 64) + strings.Repeat("c", 64))
+	corrupt := bytes.Clone(body)
+	corrupt[70] = 'X' // inside chunk 1
+
+	for _, tc := range []struct {
+		name    string
+		fullMax int64
+		method  string
+	}{
+		{"full", 1 << 20, AuditMethodFull},
+		{"ranged", 16, AuditMethodRanged},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeS3()
+			f.seed("daily/2026-05-26-backup.sql", body, testNow)
+			f.objects["daily/2026-05-26-backup.sql"].body = corrupt
+			seedManifest(f, "daily/2026-05-26-backup.sql", body, 64)
+			h := newTestHandler(f, 7)
+			h.auditFullMax = tc.fullMax
+
+			entry := h.auditObject(context.Background(), "daily/2026-05-26-backup.sql")
+			if entry.Method != tc.method || entry.State != AuditMismatch {
+				t.Errorf("method=%q state=%q, want %s mismatch", entry.Method, entry.State, tc.method)
+			}
+			if entry.ChunksChecked != 3 || !slices.Equal(entry.BadChunks, []int{1}) {
+				t.Errorf("checked=%d bad=%v, want 3 checked and chunk 1 bad", entry.ChunksChecked, entry.BadChunks)
+			}
+		})
+	}
+}
+
+func TestPruneDeletesManifestWithBackup(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-10-backup.sql", []byte("dump"), testNow)
+	seedManifest(f, "daily/2026-05-10-backup.sql", []byte("dump"), 64)
+	h := newTestHandler(f, 7)
+
+	if _, err := h.Prune(context.Background(), PruneOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.objects) != 0 {
+		t.Errorf("objects left after prune: %d, want the manifest deleted with its backup", len(f.objects))
+	}
+}
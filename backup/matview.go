@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// refreshSuffix replaces ".sql" (and any gzipSuffix) in a backup key to name
+// its refresh script.
+const refreshSuffix = ".refresh.sql"
+
+// matviewQuery lists materialized views in creation order, which respects
+// dependencies between them.
+const matviewQuery = `SELECT n.nspname, c.relname
+FROM pg_catalog.pg_class c
+JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'm'
+ORDER BY c.oid`
+
+// materializedViews returns the quoted, schema-qualified names of the
+// materialized views in the database, skipping those in excluded schemas.
+func (h *Handler) materializedViews(ctx context.Context, excluded []string) ([]string, error) {
+	rows, err := h.query(ctx, h.db, matviewQuery)
+	if err != nil {
+		return nil, err
+	}
+	var views []string
+	for _, row := range rows {
+		if len(row) != 2 {
+			return nil, fmt.Errorf("unexpected materialized view row %q", row)
+		}
+		if slices.Contains(excluded, row[0]) {
+			continue
+		}
+		views = append(views, quoteIdent(row[0])+"."+quoteIdent(row[1]))
+	}
+	return views, nil
+}
+
+// refreshScript returns a SQL script that repopulates views after a restore of
+// a dump taken without their data.
+func refreshScript(views []string) []byte {
+	var b bytes.Buffer
+	b.WriteString("-- Materialized views dumped without data by go-postgres-s3-backup.\n")
+	b.WriteString("-- Run after restoring the backup to repopulate them.\n\n")
+	for _, view := range views {
+		fmt.Fprintf(&b, "REFRESH MATERIALIZED VIEW %s;\n", view)
+	}
+	return b.Bytes()
+}
+
+// refreshKey returns the key of the refresh script stored with the backup at
+// key, e.g. "daily/2026-05-27-backup.refresh.sql".
+func refreshKey(key string) string {
+	return strings.TrimSuffix(plainKey(key), ".sql") + refreshSuffix
+}
+
+// quoteIdent quotes a PostgreSQL identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// uploadRefresh stores script as the refresh script of the backup at key. A nil
+// script stores nothing.
+func (h *Handler) uploadRefresh(ctx context.Context, key string, script []byte) error {
+	if script == nil {
+		return nil
+	}
+	if err := h.upload(ctx, refreshKey(key), script, checksum(script)); err != nil {
+		return fmt.Errorf("failed to upload refresh script for %s: %w", key, err)
+	}
+	return nil
+}
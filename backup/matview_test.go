@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// recordingDump returns a Dumper that yields body and records the options of
+// each call in *got.
+func recordingDump(body []byte, got *DumpOptions) Dumper {
+	return func(_ context.Context, _ DatabaseConfig, opts DumpOptions) ([]byte, error) {
+		*got = opts
+		return bytes.Clone(body), nil
+	}
+}
+
+func TestRunSkipsMatviewData(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	var opts DumpOptions
+	h.dump = recordingDump([]byte("dump"), &opts)
+	h.dumpOpts = DumpOptions{SkipMatviewData: true, ExcludeSchemas: []string{"auth"}}
+	h.query = staticQuery([][]string{{"public", "daily_totals"}, {"auth", "sessions_mv"}, {"public", `odd"name`}})
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := []string{`"public"."daily_totals"`, `"public"."odd""name"`}
+	if !slices.Equal(opts.ExcludeTableData, want) {
+		t.Errorf("ExcludeTableData = %q, want %q", opts.ExcludeTableData, want)
+	}
+	if res.RefreshKey != "daily/2026-05-27-backup.refresh.sql" {
+		t.Errorf("RefreshKey = %q", res.RefreshKey)
+	}
+	for _, key := range []string{res.RefreshKey, "monthly/2026-05-backup.refresh.sql", "yearly/2026-backup.refresh.sql"} {
+		obj, ok := f.objects[key]
+		if !ok {
+			t.Fatalf("refresh script %s not stored", key)
+		}
+		if !strings.Contains(string(obj.body), `REFRESH MATERIALIZED VIEW "public"."daily_totals";`) {
+			t.Errorf("%s = %q, want a refresh of public.daily_totals", key, obj.body)
+		}
+	}
+}
+
+func TestRunWithoutMatviewsStoresNoRefreshScript(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.dumpOpts = DumpOptions{SkipMatviewData: true}
+	h.query = staticQuery(nil)
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.RefreshKey != "" {
+		t.Errorf("RefreshKey = %q, want none", res.RefreshKey)
+	}
+	for key := range f.objects {
+		if strings.HasSuffix(key, refreshSuffix) {
+			t.Errorf("unexpected refresh script %s", key)
+		}
+	}
+}
+
+func TestRunMatviewQueryError(t *testing.T) {
+	h := newTestHandler(newFakeS3(), 7)
+	h.dumpOpts = DumpOptions{SkipMatviewData: true}
+	h.query = func(context.Context, DatabaseConfig, string) ([][]string, error) {
+		return nil, errors.New("connection refused")
+	}
+	if _, err := h.Run(context.Background(), RunOptions{}); err == nil {
+		t.Fatal("expected the catalog query error to fail the run")
+	}
+}
+
+func TestRefreshScriptIgnoredForDedupeAndPrunedWithBackup(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-10-backup.sql", []byte("dump"), testNow.AddDate(0, 0, -17))
+	f.seed("daily/2026-05-10-backup.refresh.sql", []byte("refresh"), testNow.AddDate(0, 0, -17).Add(1))
+	h := newTestHandler(f, 7)
+
+	if key, _ := h.mostRecentBackup(context.Background(), "daily/"); key != "daily/2026-05-10-backup.sql" {
+		t.Errorf("mostRecentBackup = %q, want the dump, not its refresh script", key)
+	}
+	res, err := h.Prune(context.Background(), PruneOptions{Simulate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Deleted != 2 {
+		t.Errorf("deleted = %d, want the backup and its refresh script", res.Deleted)
+	}
+}
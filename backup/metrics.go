@@ -0,0 +1,200 @@
+package backup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricPrefix namespaces the metrics written by WriteMetricsFile.
+const metricPrefix = "postgres_s3_backup_"
+
+// Metrics kept from the previous file when a run fails, so alerts on the age
+// of the last good backup keep working.
+const (
+	metricLastSuccess = metricPrefix + "last_success_timestamp_seconds"
+	metricLastSize    = metricPrefix + "last_backup_size_bytes"
+)
+
+// WriteMetricsFile records a run that started at start and ended at end in
+// path, an OpenMetrics textfile for the node_exporter textfile collector: the
+// run's timestamp, duration and success, the time it spent in each phase (see
+// Phases) and its S3 requests and retries by operation (see S3Stats), and the
+// time and dump size of the last successful run. res is the
+// run's Result and runErr its error. Values about the last success are
+// carried over from the existing file when the run failed. The file is
+// replaced atomically, so the collector never reads a partial write.
+func WriteMetricsFile(path string, res *Result, runErr error, start, end time.Time) error {
+	previous, err := readMetrics(path)
+	if err != nil {
+		return fmt.Errorf("failed to read metrics file: %w", err)
+	}
+
+	succeeded := "0"
+	lastSuccess, size := previous[metricLastSuccess], previous[metricLastSize]
+	if runErr == nil && res != nil {
+		succeeded = "1"
+		lastSuccess = formatSeconds(end)
+		size = strconv.Itoa(res.SizeBytes)
+	}
+
+	var b strings.Builder
+	gauge := gaugeWriter(&b)
+	gauge(metricPrefix+"last_run_timestamp_seconds", "seconds", "Time the last backup run ended.", formatSeconds(end))
+	gauge(metricPrefix+"last_run_duration_seconds", "seconds", "Wall-clock duration of the last backup run.", strconv.FormatFloat(end.Sub(start).Seconds(), 'f', 3, 64))
+	gauge(metricPrefix+"last_run_success", "", "1 if the last backup run succeeded, 0 if it failed.", succeeded)
+	gauge(metricLastSuccess, "seconds", "Time the last successful backup run ended.", lastSuccess)
+	gauge(metricLastSize, "bytes", "Dump size of the last successful backup run.", size)
+	if res != nil {
+		name := metricPrefix + "last_run_phase_duration_seconds"
+		fmt.Fprintf(&b, "# TYPE %s gauge\n# UNIT %s seconds\n# HELP %s Time the last backup run spent in each phase.\n", name, name, name)
+		res.Phases.each(func(phase string, ms int64) {
+			fmt.Fprintf(&b, "%s{phase=%q} %s\n", name, phase, strconv.FormatFloat(float64(ms)/1000, 'f', 3, 64))
+		})
+	}
+	if res != nil && len(res.S3) > 0 {
+		ops := sortedOperations(res.S3)
+		for _, m := range []struct {
+			name, help string
+			value      func(S3Counts) int
+		}{
+			{"requests", "S3 requests of the last backup run, by operation.", func(c S3Counts) int { return c.Requests }},
+			{"retries", "S3 attempts of the last backup run that failed and were retried.", func(c S3Counts) int { return c.Retries }},
+			{"throttles", "Retried S3 attempts of the last backup run that were throttled.", func(c S3Counts) int { return c.Throttles }},
+			{"gave_up", "S3 requests of the last backup run that ran out of attempts.", func(c S3Counts) int { return c.GaveUp }},
+		} {
+			name := metricPrefix + "last_run_s3_" + m.name
+			fmt.Fprintf(&b, "# TYPE %s gauge\n# HELP %s %s\n", name, name, m.help)
+			for _, op := range ops {
+				fmt.Fprintf(&b, "%s{operation=%q} %d\n", name, op, m.value(res.S3[op]))
+			}
+		}
+	}
+	b.WriteString("# EOF\n")
+	return replaceFile(path, b.String())
+}
+
+// Metrics of WriteRestoreMetricsFile kept from the previous file when a
+// restore fails.
+const (
+	metricRestoreDuration = metricPrefix + "last_restore_duration_seconds"
+	metricRestoreBytes    = metricPrefix + "last_restore_bytes"
+	metricRestoreRows     = metricPrefix + "last_restore_rows"
+	metricRestoreRTOMet   = metricPrefix + "last_restore_rto_met"
+)
+
+// WriteRestoreMetricsFile records in path, as WriteMetricsFile does for a
+// backup run, a restore that ended at end: its timestamp and success and,
+// for the last successful restore, the recovery time, the bytes and rows
+// loaded and whether it met the recovery time objective, with the objective
+// itself. res is the Restore's result and runErr its error. Give restores a
+// file of their own.
+func WriteRestoreMetricsFile(path string, res *RestoreResult, runErr error, end time.Time) error {
+	previous, err := readMetrics(path)
+	if err != nil {
+		return fmt.Errorf("failed to read metrics file: %w", err)
+	}
+	succeeded := "0"
+	duration, size, rows, met := previous[metricRestoreDuration], previous[metricRestoreBytes], previous[metricRestoreRows], previous[metricRestoreRTOMet]
+	objective := previous[metricPrefix+"rto_objective_seconds"]
+	if runErr == nil && res != nil {
+		succeeded = "1"
+		duration = strconv.FormatFloat(float64(res.DurationMs)/1000, 'f', 3, 64)
+		size, rows = strconv.FormatInt(res.Bytes, 10), strconv.FormatInt(res.Rows, 10)
+		met, objective = "", ""
+		if res.RTOMet != nil {
+			met = "0"
+			if *res.RTOMet {
+				met = "1"
+			}
+			objective = strconv.FormatFloat(float64(res.RTOObjectiveMs)/1000, 'f', 3, 64)
+		}
+	}
+
+	var b strings.Builder
+	gauge := gaugeWriter(&b)
+	gauge(metricPrefix+"last_restore_timestamp_seconds", "seconds", "Time the last restore ended.", formatSeconds(end))
+	gauge(metricPrefix+"last_restore_success", "", "1 if the last restore succeeded, 0 if it failed.", succeeded)
+	gauge(metricRestoreDuration, "seconds", "Recovery time of the last successful restore.", duration)
+	gauge(metricRestoreBytes, "bytes", "Dump bytes loaded by the last successful restore.", size)
+	gauge(metricRestoreRows, "", "Rows loaded by the last successful restore.", rows)
+	gauge(metricPrefix+"rto_objective_seconds", "seconds", "Recovery time objective restores are measured against.", objective)
+	gauge(metricRestoreRTOMet, "", "1 if the last successful restore met the recovery time objective, 0 if not.", met)
+	b.WriteString("# EOF\n")
+	return replaceFile(path, b.String())
+}
+
+// gaugeWriter returns a function writing a gauge sample, with its metadata,
+// to b; gauges without a value are left out.
+func gaugeWriter(b *strings.Builder) func(name, unit, help, value string) {
+	return func(name, unit, help, value string) {
+		if value == "" {
+			return
+		}
+		fmt.Fprintf(b, "# TYPE %s gauge\n", name)
+		if unit != "" {
+			fmt.Fprintf(b, "# UNIT %s %s\n", name, unit)
+		}
+		fmt.Fprintf(b, "# HELP %s %s\n%s %s\n", name, help, name, value)
+	}
+}
+
+// replaceFile replaces the metrics file at path with content atomically, so
+// the collector never reads a partial write.
+func replaceFile(path, content string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.WriteString(content); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	return nil
+}
+
+// readMetrics returns the sample values in the textfile at path by metric
+// name; a missing file has none.
+func readMetrics(path string) (map[string]string, error) {
+	values := map[string]string{}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, value, ok := strings.Cut(line, " "); ok {
+			values[name] = value
+		}
+	}
+	return values, scanner.Err()
+}
+
+// formatSeconds renders t as Unix seconds with millisecond precision.
+func formatSeconds(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', 3, 64)
+}
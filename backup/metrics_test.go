@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetricsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.prom")
+	start := time.Date(2026, 5, 27, 3, 0, 0, 0, time.UTC)
+	end := start.Add(1500 * time.Millisecond)
+
+	res := &Result{SizeBytes: 4096, S3: map[string]S3Counts{"PutObject": {Requests: 3, Retries: 2, Throttles: 1}}}
+	if err := WriteMetricsFile(path, res, nil, start, end); err != nil {
+		t.Fatalf("WriteMetricsFile: %v", err)
+	}
+	got := readFile(t, path)
+	for _, want := range []string{
+		"postgres_s3_backup_last_run_timestamp_seconds 1779850801.500\n",
+		"postgres_s3_backup_last_run_duration_seconds 1.500\n",
+		"postgres_s3_backup_last_run_success 1\n",
+		"postgres_s3_backup_last_success_timestamp_seconds 1779850801.500\n",
+		"# UNIT postgres_s3_backup_last_backup_size_bytes bytes\n",
+		"postgres_s3_backup_last_backup_size_bytes 4096\n",
+		"postgres_s3_backup_last_run_s3_requests{operation=\"PutObject\"} 3\n",
+		"postgres_s3_backup_last_run_s3_retries{operation=\"PutObject\"} 2\n",
+		"postgres_s3_backup_last_run_s3_throttles{operation=\"PutObject\"} 1\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics file lacks %q:\n%s", want, got)
+		}
+	}
+	if !strings.HasSuffix(got, "# EOF\n") {
+		t.Error("metrics file should end with # EOF")
+	}
+
+	// A failed run keeps the last success's time and size.
+	if err := WriteMetricsFile(path, nil, errors.New("boom"), end.Add(time.Hour), end.Add(time.Hour+time.Second)); err != nil {
+		t.Fatalf("WriteMetricsFile: %v", err)
+	}
+	got = readFile(t, path)
+	for _, want := range []string{
+		"postgres_s3_backup_last_run_success 0\n",
+		"postgres_s3_backup_last_success_timestamp_seconds 1779850801.500\n",
+		"postgres_s3_backup_last_backup_size_bytes 4096\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics file after a failure lacks %q:\n%s", want, got)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the metrics file", len(entries))
+	}
+}
+
+func TestWriteMetricsFileFirstRunFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.prom")
+	now := time.Now()
+	if err := WriteMetricsFile(path, nil, errors.New("boom"), now, now); err != nil {
+		t.Fatalf("WriteMetricsFile: %v", err)
+	}
+	if got := readFile(t, path); strings.Contains(got, "last_success") || strings.Contains(got, "size_bytes") {
+		t.Errorf("metrics file without a success should not report one:\n%s", got)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
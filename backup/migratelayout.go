@@ -0,0 +1,301 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Layout migration states reported in MigrateLayoutEntry.State.
+const (
+	MigrateLayoutDone     = "migrated" // moved, with its sidecars, to its key under the configured layout
+	MigrateLayoutConflict = "conflict" // skipped: another backup of its date is stored under the configured layout
+	MigrateLayoutArchived = "archived" // skipped: archived objects cannot be copied until thawed
+	MigrateLayoutFailed   = "error"    // a copy, its check or a delete failed
+)
+
+// MigrateLayoutOptions selects the backups MigrateLayout moves.
+type MigrateLayoutOptions struct {
+	Prefix string // only move keys under this prefix; "" means every tier and profile
+	// Database names the partition the backups move to; "" means the
+	// configured database's (see databasePartition). Backups RunDatabases
+	// stored under "<name>/" belong in the partition of <name>.
+	Database string
+}
+
+// MigrateLayoutEntry is the outcome for one stored backup.
+type MigrateLayoutEntry struct {
+	Key      string   `json:"key"`                // key of the backup in the tier layout
+	NewKey   string   `json:"new_key"`            // its key under the configured layout
+	State    string   `json:"state"`              // one of the MigrateLayout* states
+	Sidecars []string `json:"sidecars,omitempty"` // manifest, slices and scripts moved with it, by new key
+	Error    string   `json:"error,omitempty"`
+}
+
+// MigrateLayoutResult summarizes a MigrateLayout call.
+type MigrateLayoutResult struct {
+	Status     string               `json:"status"`      // "ok", or "partial" when any backup failed
+	RunID      string               `json:"run_id"`      // run identifier, also prefixed to log lines
+	Action     string               `json:"action"`      // always "migrate-layout"
+	Layout     string               `json:"layout"`      // layout the backups were moved to
+	Migrated   int                  `json:"migrated"`    // backups moved by this call
+	Skipped    int                  `json:"skipped"`     // backups left in place as conflicts or archived
+	Failed     int                  `json:"failed"`      // backups that could not be moved
+	Entries    []MigrateLayoutEntry `json:"entries"`     // per-backup outcomes
+	DurationMs int64                `json:"duration_ms"` // wall-clock time of the call
+}
+
+// MigrateLayout moves the backups stored under the tier layout
+// ("<prefix><tier>/<date>-backup.sql") to the keys the configured
+// Config.KeyLayout gives them, so adopting a layout keeps their history in
+// reach of deduplication, latest and as-of lookups. Each backup and its
+// sidecars are copied server-side as they are, with their metadata, storage
+// class and encryption, and each copy is checked against its source's size
+// and checksum. The manifest is rewritten to name the new keys, and the
+// latest pointers of LatestJSON naming a moved backup are pointed at its new
+// key. Only once every copy checks out are the old keys deleted, the backup
+// first. A backup whose new key holds another backup, such as one stored
+// since the switch, is left in place, as is an archived one; a move that
+// failed halfway is finished by calling MigrateLayout again.
+//
+// Like Rekey, backups are moved oldest first so their relative LastModified
+// order survives the copy.
+func (h *Handler) MigrateLayout(ctx context.Context, opts MigrateLayoutOptions) (*MigrateLayoutResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	if h.keyLayout == LayoutTiers {
+		return nil, invalidInput(errors.New("migrate-layout moves backups out of the tier layout; set KEY_LAYOUT to the layout to move them to"))
+	}
+	target := h
+	if opts.Database != "" {
+		other := *h
+		other.db.Database = opts.Database
+		target = &other
+	}
+
+	var objects []types.Object
+	var err error
+	if opts.Prefix == "" {
+		objects, err = h.listBackups(ctx)
+	} else {
+		objects, err = h.listObjects(ctx, opts.Prefix)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	var backups []types.Object
+	sidecars := map[string][]string{} // by the plain key of their backup
+	for _, obj := range objects {
+		key := aws.ToString(obj.Key)
+		if isSidecarKey(key) {
+			sidecars[sidecarBackupKey(key)] = append(sidecars[sidecarBackupKey(key)], key)
+		} else if _, _, _, ok := tierLayoutKey(key); ok {
+			backups = append(backups, obj)
+		}
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return aws.ToTime(backups[i].LastModified).Before(aws.ToTime(backups[j].LastModified))
+	})
+
+	result := &MigrateLayoutResult{Status: "ok", RunID: runID, Action: "migrate-layout", Layout: h.keyLayout, Entries: []MigrateLayoutEntry{}}
+	moved := map[string]string{}
+	for _, obj := range backups {
+		key := aws.ToString(obj.Key)
+		entry := target.migrateBackup(ctx, key, sidecars[plainKey(key)])
+		logf(ctx, "Migrate %s: %s", entry.Key, entry.State)
+		switch entry.State {
+		case MigrateLayoutDone:
+			result.Migrated++
+			moved[key] = entry.NewKey
+		case MigrateLayoutFailed:
+			result.Failed++
+			result.Status = "partial"
+		default:
+			result.Skipped++
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+	h.repointLatest(ctx, moved)
+	logf(ctx, "Migrated %d backup(s) to the %s layout, %d skipped, %d failed", result.Migrated, h.keyLayout, result.Skipped, result.Failed)
+	result.DurationMs = h.elapsed(start)
+	return result, nil
+}
+
+// tierLayoutKey parses the key of a backup stored under the tier layout,
+// with or without gzipSuffix, into its profile prefix, tier and date,
+// reporting false for any other key.
+func tierLayoutKey(key string) (prefix, tier string, t time.Time, ok bool) {
+	dir, name := path.Split(plainKey(key))
+	tier = path.Base(dir)
+	spec, known := backupTiers[tier]
+	date, found := strings.CutSuffix(name, "-backup.sql")
+	if !known || !found {
+		return "", "", time.Time{}, false
+	}
+	t, err := time.Parse(spec.layout, date)
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+	return strings.TrimSuffix(dir, tier+"/"), tier, t, true
+}
+
+// migrateBackup moves the backup at key, a tier layout key, and sidecars to
+// the keys the configured layout gives them (see MigrateLayout).
+func (h *Handler) migrateBackup(ctx context.Context, key string, sidecars []string) MigrateLayoutEntry {
+	prefix, tier, t, _ := tierLayoutKey(key)
+	plain := h.backupKey(prefix, tier, t)
+	entry := MigrateLayoutEntry{Key: key, NewKey: plain + strings.TrimPrefix(key, plainKey(key))}
+	fail := func(err error) MigrateLayoutEntry {
+		entry.State, entry.Error = MigrateLayoutFailed, err.Error()
+		return entry
+	}
+
+	// Everything moved is read first, so nothing is copied for a backup
+	// that cannot be moved whole.
+	oldBase, newBase := strings.TrimSuffix(plainKey(key), ".sql"), strings.TrimSuffix(plain, ".sql")
+	var manifest string
+	moves := []string{key}
+	for _, k := range sidecars {
+		if strings.HasSuffix(k, manifestSuffix) {
+			manifest = k
+		} else {
+			moves = append(moves, k)
+		}
+	}
+	heads := make([]*s3.HeadObjectOutput, len(moves))
+	for i, src := range moves {
+		head, err := h.headObject(ctx, src)
+		if err != nil {
+			return fail(fmt.Errorf("failed to read %s: %w", src, err))
+		}
+		if isArchivedClass(head.StorageClass) {
+			entry.State = MigrateLayoutArchived
+			return entry
+		}
+		heads[i] = head
+	}
+	existing, err := h.findBackup(ctx, plain)
+	if err != nil {
+		return fail(fmt.Errorf("failed to check %s: %w", plain, err))
+	}
+	if existing != "" {
+		// Only the copy an earlier, unfinished move made is overwritten.
+		prior, err := h.headObject(ctx, existing)
+		if err != nil {
+			return fail(fmt.Errorf("failed to read %s: %w", existing, err))
+		}
+		if sum := heads[0].Metadata["sha256"]; existing != entry.NewKey || sum == "" || prior.Metadata["sha256"] != sum {
+			entry.State = MigrateLayoutConflict
+			return entry
+		}
+	}
+
+	for i, src := range moves {
+		dst := newBase + strings.TrimPrefix(src, oldBase)
+		if err := h.moveCopy(ctx, src, dst, heads[i]); err != nil {
+			return fail(fmt.Errorf("failed to copy %s to %s: %w", src, dst, err))
+		}
+		if i > 0 {
+			entry.Sidecars = append(entry.Sidecars, dst)
+		}
+	}
+	if manifest != "" {
+		m, err := h.readManifest(ctx, key)
+		if err == nil && m == nil {
+			err = errors.New("it is gone")
+		}
+		if err != nil {
+			return fail(fmt.Errorf("failed to read the manifest of %s: %w", key, err))
+		}
+		m.Key, m.Slices = entry.NewKey, slicesFor(entry.NewKey, m.Slices)
+		if err := h.putManifest(ctx, *m); err != nil {
+			return fail(err)
+		}
+		entry.Sidecars = append(entry.Sidecars, manifestKey(entry.NewKey))
+		moves = append(moves, manifest)
+	}
+
+	// A delete that fails after the backup's leaves sidecars that reconcile
+	// reports as orphaned, not a backup without its manifest.
+	for _, old := range moves {
+		if _, err := h.s3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(h.bucket), Key: aws.String(old)}); err != nil {
+			return fail(fmt.Errorf("copied, but failed to delete %s: %w", old, err))
+		}
+	}
+	entry.State = MigrateLayoutDone
+	return entry
+}
+
+// moveCopy copies the object at src, whose HEAD is head, to dst server-side
+// as it is, with its metadata, content headers, storage class and
+// encryption, and checks that dst then has the size and checksum of src.
+func (h *Handler) moveCopy(ctx context.Context, src, dst string, head *s3.HeadObjectOutput) error {
+	input := &s3.CopyObjectInput{
+		Bucket:             aws.String(h.bucket),
+		Key:                aws.String(dst),
+		CopySource:         h.copySource(src),
+		ContentType:        head.ContentType,
+		ContentEncoding:    head.ContentEncoding,
+		ContentDisposition: head.ContentDisposition,
+		CacheControl:       head.CacheControl,
+		Metadata:           head.Metadata,
+		MetadataDirective:  types.MetadataDirectiveReplace,
+		StorageClass:       types.StorageClass(head.StorageClass),
+	}
+	h.keepEncryption(input, head)
+	if err := h.serverCopy(ctx, input, src, aws.ToInt64(head.ContentLength)); err != nil {
+		return err
+	}
+	copied, err := h.headObject(ctx, dst)
+	if err != nil {
+		return fmt.Errorf("failed to check the copy: %w", err)
+	}
+	if size, sum := aws.ToInt64(copied.ContentLength), copied.Metadata["sha256"]; size != aws.ToInt64(head.ContentLength) || sum != head.Metadata["sha256"] {
+		return fmt.Errorf("the copy has %d bytes with checksum %q, want %d with %q", size, sum, aws.ToInt64(head.ContentLength), head.Metadata["sha256"])
+	}
+	return nil
+}
+
+// repointLatest points each LatestJSON pointer that names a backup in moved,
+// by its old key, at its new key. Failures are logged; the next run points
+// them at its own backup anyway. A LatestCopy pointer names no key.
+func (h *Handler) repointLatest(ctx context.Context, moved map[string]string) {
+	prefixes := map[string]bool{}
+	for old := range moved {
+		prefix, _, _, _ := tierLayoutKey(old)
+		prefixes[prefix] = true
+	}
+	for prefix := range prefixes {
+		key := prefix + latestJSONKey
+		body, err := h.openObject(ctx, key)
+		if err != nil {
+			continue // no pointer
+		}
+		var p LatestPointer
+		err = json.NewDecoder(body).Decode(&p)
+		_ = body.Close()
+		if err != nil {
+			logf(ctx, "Warning: ignoring unreadable latest pointer %s: %v", key, err)
+			continue
+		}
+		newKey, ok := moved[p.Key]
+		if !ok {
+			continue
+		}
+		p.Key, p.ManifestKey = newKey, manifestKey(newKey)
+		if err := h.writeJSON(ctx, key, p); err != nil {
+			logf(ctx, "Warning: failed to point %s at %s: %v", key, newKey, err)
+			continue
+		}
+		logf(ctx, "Pointed %s at %s", key, newKey)
+	}
+}
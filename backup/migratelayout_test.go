@@ -0,0 +1,130 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestMigrateLayout(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.db.Database = "app"
+	ctx := context.Background()
+	old := testNow.AddDate(0, 0, -7)
+
+	if _, err := h.MigrateLayout(ctx, MigrateLayoutOptions{}); err == nil {
+		t.Error("MigrateLayout under the tier layout succeeded")
+	}
+	h.keyLayout = LayoutHive
+
+	// A daily backup with its slice, refresh script and manifest, a gzip
+	// monthly backup of a profile, and a date already stored under the new
+	// layout by a run since the switch.
+	f.seed("daily/2026-05-20-backup.sql", []byte("dump 20"), old)
+	f.seed("daily/2026-05-20-backup.slice-public.events-0000.sql", []byte("slice"), old)
+	f.seed("daily/2026-05-20-backup.refresh.sql", []byte("REFRESH"), old)
+	slice := Slice{Table: "public.events", Column: "id", Part: 0, Key: "daily/2026-05-20-backup.slice-public.events-0000.sql"}
+	if err := h.putManifest(ctx, Manifest{Key: "daily/2026-05-20-backup.sql", SHA256: checksum([]byte("dump 20")), Slices: []Slice{slice}}); err != nil {
+		t.Fatal(err)
+	}
+	f.seed("schema-only/monthly/2026-04-backup.sql.gz", []byte("gzip"), old.AddDate(0, -1, 0))
+	f.seed("daily/2026-05-21-backup.sql", []byte("dump 21"), old)
+	f.seed("daily/db=app/year=2026/month=05/day=21/2026-05-21-backup.sql", []byte("newer dump 21"), testNow)
+	h.latestPointer = LatestJSON
+	if err := h.writeJSON(ctx, latestJSONKey, LatestPointer{Key: "daily/2026-05-20-backup.sql"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := h.MigrateLayout(ctx, MigrateLayoutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != "ok" || res.Migrated != 2 || res.Skipped != 1 || res.Failed != 0 {
+		t.Fatalf("result = %+v", res)
+	}
+	for from, to := range map[string]string{
+		"daily/2026-05-20-backup.sql":                          "daily/db=app/year=2026/month=05/day=20/2026-05-20-backup.sql",
+		"daily/2026-05-20-backup.slice-public.events-0000.sql": "daily/db=app/year=2026/month=05/day=20/2026-05-20-backup.slice-public.events-0000.sql",
+		"daily/2026-05-20-backup.refresh.sql":                  "daily/db=app/year=2026/month=05/day=20/2026-05-20-backup.refresh.sql",
+		"daily/2026-05-20-backup.manifest.json":                "daily/db=app/year=2026/month=05/day=20/2026-05-20-backup.manifest.json",
+		"schema-only/monthly/2026-04-backup.sql.gz":            "schema-only/monthly/db=app/year=2026/month=04/2026-04-backup.sql.gz",
+	} {
+		if _, ok := f.objects[from]; ok {
+			t.Errorf("%s left behind", from)
+		}
+		if _, ok := f.objects[to]; !ok {
+			t.Errorf("%s not moved to %s", from, to)
+		}
+	}
+	moved := f.objects["daily/db=app/year=2026/month=05/day=20/2026-05-20-backup.sql"]
+	if moved == nil || string(moved.body) != "dump 20" || moved.metadata["sha256"] != checksum([]byte("dump 20")) {
+		t.Errorf("moved backup = %+v", moved)
+	}
+	if f.objects["daily/2026-05-21-backup.sql"] == nil || string(f.objects["daily/db=app/year=2026/month=05/day=21/2026-05-21-backup.sql"].body) != "newer dump 21" {
+		t.Error("a conflicting backup was moved over the newer one")
+	}
+
+	newKey := "daily/db=app/year=2026/month=05/day=20/2026-05-20-backup.sql"
+	m, err := h.readManifest(ctx, newKey)
+	if err != nil || m == nil {
+		t.Fatalf("manifest = %+v, %v", m, err)
+	}
+	if m.Key != newKey || len(m.Slices) != 1 || m.Slices[0].Key != "daily/db=app/year=2026/month=05/day=20/2026-05-20-backup.slice-public.events-0000.sql" {
+		t.Errorf("manifest names %s with slices %+v", m.Key, m.Slices)
+	}
+	body, err := h.openObject(ctx, latestJSONKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(body)
+	var p LatestPointer
+	if err := json.Unmarshal(raw, &p); err != nil || p.Key != newKey || p.ManifestKey != manifestKey(newKey) {
+		t.Errorf("latest pointer = %s, %v", raw, err)
+	}
+
+	// Backups of another database move to its partition.
+	f.seed("orders/daily/2026-05-20-backup.sql", []byte("orders"), old)
+	if res, err := h.MigrateLayout(ctx, MigrateLayoutOptions{Prefix: "orders/", Database: "orders"}); err != nil || res.Migrated != 1 {
+		t.Fatalf("orders: %+v, %v", res, err)
+	}
+	if _, ok := f.objects["orders/daily/db=orders/year=2026/month=05/day=20/2026-05-20-backup.sql"]; !ok {
+		t.Error("orders backup not moved to its partition")
+	}
+
+	// A failed copy deletes nothing.
+	f.seed("daily/2026-05-22-backup.sql", []byte("dump 22"), old)
+	f.copyErr = errors.New("AccessDenied")
+	res, err = h.MigrateLayout(ctx, MigrateLayoutOptions{Prefix: "daily/"})
+	if err != nil || res.Status != "partial" || res.Failed != 1 {
+		t.Fatalf("failed copy: %+v, %v", res, err)
+	}
+	if _, ok := f.objects["daily/2026-05-22-backup.sql"]; !ok {
+		t.Error("backup deleted although its copy failed")
+	}
+}
+
+func TestTierLayoutKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"daily/2026-05-27-backup.sql":                                  "daily 2026-05-27",
+		"schema-only/hourly/2026-05-27T13-backup.sql.gz":               "hourly 2026-05-27T13 schema-only/",
+		"yearly/2026-backup.sql":                                       "yearly 2026",
+		"daily/db=app/year=2026/month=05/day=27/2026-05-27-backup.sql": "",
+		"latest/backup.sql":                                            "",
+		"daily/notes.sql":                                              "",
+	} {
+		prefix, tier, at, ok := tierLayoutKey(key)
+		got := ""
+		if ok {
+			got = tier + " " + at.Format(backupTiers[tier].layout)
+			if prefix != "" {
+				got += " " + prefix
+			}
+		}
+		if got != want {
+			t.Errorf("tierLayoutKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// migrationsSuffix replaces ".sql" (and any gzipSuffix) in a backup key to
+// name its migration state (see MigrationState).
+const migrationsSuffix = ".migrations.json"
+
+// MigrationTablesAuto, as the only entry of Config.MigrationTables, records
+// the tables of the migration tools listed in migrationToolTables.
+const MigrationTablesAuto = "auto"
+
+// migrationToolTables names the tables in which common migration tools
+// record the migrations applied, in any schema, and the tools.
+var migrationToolTables = map[string]string{
+	"schema_migrations":      "rails, golang-migrate, dbmate or supabase",
+	"flyway_schema_history":  "flyway",
+	"goose_db_version":       "goose",
+	"_prisma_migrations":     "prisma",
+	"alembic_version":        "alembic",
+	"knex_migrations":        "knex",
+	"__EFMigrationsHistory":  "entity framework",
+	"django_migrations":      "django",
+	"atlas_schema_revisions": "atlas",
+}
+
+// MigrationState is what a backup records of the database's migration
+// tables, stored next to it (e.g. "daily/2026-05-27-backup.migrations.json")
+// whether or not the tables are in the dump, so after a restore the
+// migrations the data corresponds to can be told to the application's
+// migration tool.
+type MigrationState struct {
+	Tables []MigrationTable `json:"tables"`
+}
+
+// MigrationTable is the content of one migration table.
+type MigrationTable struct {
+	Table string            `json:"table"`          // schema-qualified name
+	Tool  string            `json:"tool,omitempty"` // migration tool known to use a table of that name
+	Rows  []json.RawMessage `json:"rows"`           // each row as a JSON object of its columns
+}
+
+// migrationTablesQuery lists the tables named %s (a list of literals).
+const migrationTablesQuery = `SELECT n.nspname, c.relname
+FROM pg_catalog.pg_class c
+JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r', 'p') AND c.relname IN (%s)
+ORDER BY 1, 2`
+
+// migrationsKey returns the key of the migration state stored with the
+// backup at key.
+func migrationsKey(key string) string {
+	return strings.TrimSuffix(plainKey(key), ".sql") + migrationsSuffix
+}
+
+// migrationsCtxKey is the context key under which a run's MigrationState is
+// stored, so every backup the run stores gets it.
+type migrationsCtxKey struct{}
+
+func withMigrations(ctx context.Context, state *MigrationState) context.Context {
+	return context.WithValue(ctx, migrationsCtxKey{}, state)
+}
+
+// migrationsFrom returns the MigrationState stored in ctx, or nil.
+func migrationsFrom(ctx context.Context) *MigrationState {
+	state, _ := ctx.Value(migrationsCtxKey{}).(*MigrationState)
+	return state
+}
+
+// readMigrations returns the MigrationState of the Handler's migration
+// tables, or nil when it records none or none exist. Configured tables are
+// "schema.table" names; MigrationTablesAuto finds the tables of
+// migrationToolTables.
+func (h *Handler) readMigrations(ctx context.Context) (*MigrationState, error) {
+	if len(h.migrations) == 0 {
+		return nil, nil
+	}
+	var tables [][2]string
+	if len(h.migrations) == 1 && h.migrations[0] == MigrationTablesAuto {
+		names := make([]string, 0, len(migrationToolTables))
+		for name := range migrationToolTables {
+			names = append(names, quoteLiteral(name))
+		}
+		sort.Strings(names)
+		rows, err := h.query(ctx, h.db, fmt.Sprintf(migrationTablesQuery, strings.Join(names, ", ")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to find migration tables: %w", err)
+		}
+		for _, row := range rows {
+			if len(row) != 2 {
+				return nil, fmt.Errorf("unexpected migration table row %q", row)
+			}
+			tables = append(tables, [2]string{row[0], row[1]})
+		}
+	} else {
+		for _, name := range h.migrations {
+			schema, table, ok := strings.Cut(name, ".")
+			if !ok {
+				schema, table = "public", name
+			}
+			tables = append(tables, [2]string{schema, table})
+		}
+	}
+	if len(tables) == 0 {
+		return nil, nil
+	}
+
+	state := &MigrationState{}
+	for _, t := range tables {
+		name := t[0] + "." + t[1]
+		rows, err := h.query(ctx, h.db, fmt.Sprintf("SELECT row_to_json(t)::text FROM %s.%s t ORDER BY 1", quoteIdent(t[0]), quoteIdent(t[1])))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration table %s: %w", name, err)
+		}
+		mt := MigrationTable{Table: name, Tool: migrationToolTables[t[1]], Rows: []json.RawMessage{}}
+		for _, row := range rows {
+			mt.Rows = append(mt.Rows, json.RawMessage(row[0]))
+		}
+		state.Tables = append(state.Tables, mt)
+	}
+	return state, nil
+}
+
+// uploadMigrations stores the MigrationState of the run, if any, as the
+// migration state of the backup at key.
+func (h *Handler) uploadMigrations(ctx context.Context, key string) error {
+	state := migrationsFrom(ctx)
+	if state == nil {
+		return nil
+	}
+	if err := h.writeJSON(ctx, migrationsKey(key), state); err != nil {
+		return fmt.Errorf("failed to upload migration state for %s: %w", key, err)
+	}
+	return nil
+}
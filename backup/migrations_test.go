@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// migrationsQuery returns a Querier that finds one migration table with two
+// rows, whose read fails with err.
+func migrationsQuery(err error) Querier {
+	return func(_ context.Context, _ DatabaseConfig, q string) ([][]string, error) {
+		switch {
+		case strings.Contains(q, "c.relname IN ("):
+			return [][]string{{"supabase_migrations", "schema_migrations"}}, nil
+		case strings.HasPrefix(q, `SELECT row_to_json(t)::text FROM "supabase_migrations"."schema_migrations"`):
+			return [][]string{{`{"version":"20260501120000"}`}, {`{"version":"20260520093000"}`}}, err
+		}
+		return nil, nil
+	}
+}
+
+func TestRunStoresMigrationState(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.migrations = []string{MigrationTablesAuto}
+	h.query = migrationsQuery(nil)
+	h.dumpOpts = DumpOptions{ExcludeSchemas: []string{"supabase_migrations"}}
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Migrations != "daily/2026-05-27-backup.migrations.json" {
+		t.Fatalf("Migrations = %q", res.Migrations)
+	}
+	for _, key := range []string{res.Migrations, "monthly/2026-05-backup.migrations.json", "yearly/2026-backup.migrations.json"} {
+		obj, ok := f.objects[key]
+		if !ok {
+			t.Fatalf("migration state %s not stored", key)
+		}
+		var state MigrationState
+		if err := json.Unmarshal(obj.body, &state); err != nil {
+			t.Fatal(err)
+		}
+		if len(state.Tables) != 1 || state.Tables[0].Table != "supabase_migrations.schema_migrations" || len(state.Tables[0].Rows) != 2 || state.Tables[0].Tool == "" {
+			t.Errorf("%s = %s", key, obj.body)
+		}
+	}
+	if !isSidecarKey(res.Migrations) || sidecarBackupKey(res.Migrations) != res.Key {
+		t.Errorf("%s is not a sidecar of %s", res.Migrations, res.Key)
+	}
+
+	var calls []restoreCall
+	h.restore = recordingRestorer(&calls, func(string) RestoreStats { return RestoreStats{} })
+	restored, err := h.Restore(context.Background(), res.Key, RestoreOptions{Target: restoreTarget})
+	if err != nil || restored.Migrations != res.Migrations {
+		t.Errorf("Restore = %+v, %v; want the migration state reported", restored, err)
+	}
+}
+
+func TestRunMigrationStateErrorIsNonFatal(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.migrations = []string{"public.schema_migrations"}
+	h.query = func(_ context.Context, _ DatabaseConfig, q string) ([][]string, error) {
+		if strings.Contains(q, "row_to_json") {
+			return nil, errors.New(`relation "public.schema_migrations" does not exist`)
+		}
+		return nil, nil
+	}
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Action != "created" || res.Migrations != "" {
+		t.Errorf("result = %+v, want a backup without migration state", res)
+	}
+	if _, ok := f.objects["daily/2026-05-27-backup.migrations.json"]; ok {
+		t.Error("migration state stored despite the failed query")
+	}
+}
@@ -0,0 +1,341 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	// streamPartSize is the size of each part of a streamed upload (see
+	// multipartWriter), unless a memory budget lowers it. With S3's limit
+	// of 10,000 parts it bounds a streamed backup to about 312 GiB, stored.
+	streamPartSize = 32 << 20
+	// maxCopySize is the largest object a single CopyObject can copy;
+	// larger ones are copied in parts of copyPartSize.
+	maxCopySize  int64 = 5 << 30
+	copyPartSize int64 = 512 << 20
+)
+
+// multipartWriter is an io.Writer that uploads what is written to it to key
+// as a multipart upload, in parts of the Handler's part size (streamPartSize
+// unless a memory budget lowers it). Memory stays at one part more than
+// upload at once, whatever the size of the object: one fills while the
+// others upload, one at a time unless a memory budget allows more (see
+// limitsFor). Output that never fills a part is stored with a single
+// PutObject on Close. The first failure is returned by every later call;
+// abort releases the parts of an upload that is not completed.
+type multipartWriter struct {
+	ctx      context.Context
+	h        *Handler
+	key      string
+	metadata map[string]string
+	partSize int
+	uploads  int // parts uploading at once
+
+	uploadID *string
+	buf      []byte
+	spare    [][]byte // buffers of uploaded parts, for reuse
+	parts    []types.CompletedPart
+	inflight []chan partResult // parts uploading, oldest first
+	written  int64             // bytes written so far
+	err      error
+}
+
+// partResult is the outcome of uploading one part from buf.
+type partResult struct {
+	part types.CompletedPart
+	buf  []byte
+	err  error
+}
+
+// newMultipartWriter returns a multipartWriter storing to key with metadata
+// and the Handler's encryption.
+func (h *Handler) newMultipartWriter(ctx context.Context, key string, metadata map[string]string) *multipartWriter {
+	return &multipartWriter{ctx: ctx, h: h, key: key, metadata: metadata, partSize: h.limits.part(), uploads: h.limits.uploads()}
+}
+
+func (w *multipartWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && w.err == nil {
+		if w.buf == nil {
+			w.buf = w.newBuffer()
+		}
+		take := min(len(p), w.partSize-len(w.buf))
+		w.buf = append(w.buf, p[:take]...)
+		w.written += int64(take)
+		p = p[take:]
+		if len(w.buf) == w.partSize {
+			w.err = w.flush()
+		}
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return n, nil
+}
+
+// newBuffer returns an empty part buffer, reusing that of an uploaded part
+// when there is one.
+func (w *multipartWriter) newBuffer() []byte {
+	if n := len(w.spare); n > 0 {
+		b := w.spare[n-1]
+		w.spare = w.spare[:n-1]
+		return b[:0]
+	}
+	return make([]byte, 0, w.partSize)
+}
+
+// flush starts the upload of the buffered part, once one of those uploading
+// is done if as many as may are.
+func (w *multipartWriter) flush() error {
+	if w.uploadID == nil {
+		input := &s3.CreateMultipartUploadInput{
+			Bucket:   aws.String(w.h.bucket),
+			Key:      aws.String(w.key),
+			Metadata: w.metadata,
+		}
+		w.h.encryption.applyToCreate(input)
+		resp, err := w.h.s3.CreateMultipartUpload(w.ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to start the upload of %s: %w", w.key, err)
+		}
+		w.uploadID = resp.UploadId
+	}
+	if len(w.inflight) == w.uploads {
+		if err := w.waitOldest(); err != nil {
+			return err
+		}
+	}
+	number := int32(len(w.parts) + len(w.inflight) + 1)
+	buf := w.buf
+	input := &s3.UploadPartInput{
+		Bucket:     aws.String(w.h.bucket),
+		Key:        aws.String(w.key),
+		UploadId:   w.uploadID,
+		PartNumber: aws.Int32(number),
+		Body:       bytes.NewReader(buf),
+	}
+	if w.h.encryption.Cipher == CipherSSEC {
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = w.h.encryption.customerKeyParams()
+	}
+	done := make(chan partResult, 1)
+	w.inflight = append(w.inflight, done)
+	go func() {
+		resp, err := w.h.s3.UploadPart(w.ctx, input)
+		if err != nil {
+			done <- partResult{buf: buf, err: fmt.Errorf("failed to upload part %d of %s: %w", number, w.key, err)}
+			return
+		}
+		done <- partResult{part: types.CompletedPart{ETag: resp.ETag, PartNumber: aws.Int32(number)}, buf: buf}
+	}()
+	w.buf = nil
+	return nil
+}
+
+// waitOldest waits for the oldest part uploading.
+func (w *multipartWriter) waitOldest() error {
+	r := <-w.inflight[0]
+	w.inflight = w.inflight[1:]
+	w.spare = append(w.spare, r.buf)
+	if r.err != nil {
+		return r.err
+	}
+	w.parts = append(w.parts, r.part)
+	return nil
+}
+
+// wait waits for every part uploading, returning the first failure.
+func (w *multipartWriter) wait() error {
+	var first error
+	for len(w.inflight) > 0 {
+		if err := w.waitOldest(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Close uploads what is buffered and completes the upload.
+func (w *multipartWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.uploadID == nil {
+		input := &s3.PutObjectInput{
+			Bucket:   aws.String(w.h.bucket),
+			Key:      aws.String(w.key),
+			Body:     bytes.NewReader(w.buf),
+			Metadata: w.metadata,
+		}
+		w.h.encryption.applyToPut(input)
+		_, w.err = w.h.s3.PutObject(w.ctx, input)
+		return w.err
+	}
+	if len(w.buf) > 0 {
+		if w.err = w.flush(); w.err != nil {
+			return w.err
+		}
+	}
+	if w.err = w.wait(); w.err != nil {
+		return w.err
+	}
+	w.err = w.h.completeUpload(w.ctx, w.key, w.uploadID, w.parts)
+	return w.err
+}
+
+// abort waits for the parts uploading and aborts the upload, whose parts S3
+// would otherwise keep (and bill for) until a lifecycle rule removes them.
+func (w *multipartWriter) abort() {
+	_ = w.wait()
+	w.h.abortUpload(w.ctx, w.key, w.uploadID)
+	w.uploadID = nil
+}
+
+// completeUpload completes the multipart upload id of key with parts.
+func (h *Handler) completeUpload(ctx context.Context, key string, id *string, parts []types.CompletedPart) error {
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(h.bucket),
+		Key:             aws.String(key),
+		UploadId:        id,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}
+	if h.encryption.Cipher == CipherSSEC {
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = h.encryption.customerKeyParams()
+	}
+	if _, err := h.s3.CompleteMultipartUpload(ctx, input); err != nil {
+		return fmt.Errorf("failed to complete the upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+// abortUpload aborts the multipart upload id of key, if any. A failure is
+// logged: the bucket's lifecycle rule removes the parts eventually.
+func (h *Handler) abortUpload(ctx context.Context, key string, id *string) {
+	if id == nil {
+		return
+	}
+	if _, err := h.s3.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(h.bucket),
+		Key:      aws.String(key),
+		UploadId: id,
+	}); err != nil {
+		logf(ctx, "Warning: failed to abort the upload of %s: %v", key, err)
+	}
+}
+
+// copySource returns the CopySource naming key in the Handler's bucket. S3
+// URL-decodes the header, so each segment of the key is escaped; a label or
+// name with a space or "%" would otherwise name another object, or none.
+func (h *Handler) copySource(key string) *string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return aws.String(h.bucket + "/" + strings.Join(segments, "/"))
+}
+
+// copyObject copies the dump stored at src, of size bytes with Compression c,
+// to dst server-side, replacing its metadata and content headers (for the
+// format in metadata) and encrypting it the way new backups are (see
+// serverCopy).
+func (h *Handler) copyObject(ctx context.Context, src, dst string, size int64, metadata map[string]string, c Compression) error {
+	contentType, encoding, disposition := contentHeaders(dst, metadata["format"], c)
+	input := &s3.CopyObjectInput{
+		Bucket:             aws.String(h.bucket),
+		Key:                aws.String(dst),
+		CopySource:         h.copySource(src),
+		MetadataDirective:  types.MetadataDirectiveReplace,
+		Metadata:           metadata,
+		ContentType:        aws.String(contentType),
+		ContentDisposition: aws.String(disposition),
+	}
+	if h.cacheControl != "" {
+		input.CacheControl = aws.String(h.cacheControl)
+	}
+	if encoding != "" {
+		input.ContentEncoding = aws.String(encoding)
+	}
+	h.encryption.applyToCopy(input)
+	if h.encryption.Cipher == CipherSSEC {
+		input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5 = h.encryption.customerKeyParams()
+	}
+	return h.serverCopy(ctx, input, src, size)
+}
+
+// serverCopy runs input, a server-side copy of the object at src of size
+// bytes, as a single CopyObject or, for objects over maxCopySize, which
+// CopyObject rejects, as a multipart upload of UploadPartCopy parts with the
+// metadata, content headers, storage class and encryption input sets. A
+// multipart copy takes nothing from its source, so unless input replaces the
+// metadata, that of src is read and set on the copy as CopyObject would.
+func (h *Handler) serverCopy(ctx context.Context, input *s3.CopyObjectInput, src string, size int64) error {
+	if size <= maxCopySize {
+		_, err := h.s3.CopyObject(ctx, input)
+		return err
+	}
+
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		Metadata:             input.Metadata,
+		ContentType:          input.ContentType,
+		ContentEncoding:      input.ContentEncoding,
+		ContentDisposition:   input.ContentDisposition,
+		CacheControl:         input.CacheControl,
+		StorageClass:         input.StorageClass,
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+	}
+	if input.MetadataDirective != types.MetadataDirectiveReplace {
+		head, err := h.headObject(ctx, src)
+		if err != nil {
+			return err
+		}
+		create.Metadata, create.ContentType, create.ContentEncoding = head.Metadata, head.ContentType, head.ContentEncoding
+		create.ContentDisposition, create.CacheControl = head.ContentDisposition, head.CacheControl
+	}
+	resp, err := h.s3.CreateMultipartUpload(ctx, create)
+	if err != nil {
+		return err
+	}
+	dst := aws.ToString(input.Key)
+	var parts []types.CompletedPart
+	for off := int64(0); off < size; off += copyPartSize {
+		number := int32(len(parts) + 1)
+		part, err := h.s3.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:                         input.Bucket,
+			Key:                            input.Key,
+			CopySource:                     input.CopySource,
+			CopySourceRange:                aws.String("bytes=" + strconv.FormatInt(off, 10) + "-" + strconv.FormatInt(min(off+copyPartSize, size)-1, 10)),
+			UploadId:                       resp.UploadId,
+			PartNumber:                     aws.Int32(number),
+			SSECustomerAlgorithm:           input.SSECustomerAlgorithm,
+			SSECustomerKey:                 input.SSECustomerKey,
+			SSECustomerKeyMD5:              input.SSECustomerKeyMD5,
+			CopySourceSSECustomerAlgorithm: input.CopySourceSSECustomerAlgorithm,
+			CopySourceSSECustomerKey:       input.CopySourceSSECustomerKey,
+			CopySourceSSECustomerKeyMD5:    input.CopySourceSSECustomerKeyMD5,
+		})
+		if err != nil {
+			h.abortUpload(ctx, dst, resp.UploadId)
+			return fmt.Errorf("failed to copy part %d: %w", number, err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: aws.Int32(number)})
+	}
+	if err := h.completeUpload(ctx, dst, resp.UploadId, parts); err != nil {
+		h.abortUpload(ctx, dst, resp.UploadId)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// smallParts shrinks streamed upload parts and the single-copy limit, so
+// tests exercise multipart uploads and copies with small objects.
+func smallParts(t *testing.T) {
+	oldPart, oldMax, oldCopy := streamPartSize, maxCopySize, copyPartSize
+	streamPartSize, maxCopySize, copyPartSize = 1<<10, 2<<10, 1<<10
+	t.Cleanup(func() { streamPartSize, maxCopySize, copyPartSize = oldPart, oldMax, oldCopy })
+}
+
+func TestMultipartWriter(t *testing.T) {
+	smallParts(t)
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	body := bytes.Repeat([]byte("0123456789"), 250) // 2.5 parts
+
+	w := h.newMultipartWriter(context.Background(), "state/uploads/run.sql", map[string]string{"run-id": "run"})
+	for off := 0; off < len(body); off += 300 {
+		if _, err := w.Write(body[off:min(off+300, len(body))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	obj := f.objects["state/uploads/run.sql"]
+	if obj == nil || !bytes.Equal(obj.body, body) || obj.metadata["run-id"] != "run" {
+		t.Fatalf("object = %+v, want the body written", obj)
+	}
+	if f.parts != 3 || f.completes != 1 || f.puts != 0 || !strings.HasSuffix(obj.etag, `-3"`) {
+		t.Errorf("%d parts, %d completes, %d puts, ETag %s; want one upload of 3 parts", f.parts, f.completes, f.puts, obj.etag)
+	}
+}
+
+func TestMultipartWriterConcurrentParts(t *testing.T) {
+	smallParts(t)
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.limits = memoryLimits{partSize: 1 << 10, partUploads: 3}
+	body := bytes.Repeat([]byte("0123456789"), 1000) // 9.8 parts
+
+	w := h.newMultipartWriter(context.Background(), "state/uploads/run.sql", nil)
+	if _, err := w.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if obj := f.objects["state/uploads/run.sql"]; obj == nil || !bytes.Equal(obj.body, body) {
+		t.Fatal("object does not hold the body written, in order")
+	}
+	if f.parts != 10 || f.maxParts > 3 || f.maxParts < 2 {
+		t.Errorf("%d parts, up to %d at once; want 10, at most 3 at once", f.parts, f.maxParts)
+	}
+	if len(w.spare) > 4 {
+		t.Errorf("%d part buffers allocated; want one more than the uploads at once", len(w.spare))
+	}
+}
+
+func TestMultipartWriterSinglePart(t *testing.T) {
+	smallParts(t)
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	w := h.newMultipartWriter(context.Background(), "small.sql", nil)
+	if _, err := w.Write([]byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f.puts != 1 || f.parts != 0 || string(f.objects["small.sql"].body) != "short" {
+		t.Errorf("%d puts, %d parts; want a single PutObject", f.puts, f.parts)
+	}
+}
+
+func TestMultipartWriterAbort(t *testing.T) {
+	smallParts(t)
+	f := newFakeS3()
+	f.partErr = errors.New("SlowDown")
+	h := newTestHandler(f, 7)
+	w := h.newMultipartWriter(context.Background(), "failed.sql", nil)
+
+	_, err := w.Write(bytes.Repeat([]byte("x"), 3<<10))
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "SlowDown") {
+		t.Fatalf("err = %v, want the part failure", err)
+	}
+	w.abort()
+	if f.aborts != 1 || len(f.uploads) != 0 || f.objects["failed.sql"] != nil {
+		t.Errorf("%d aborts, %d uploads left; want the upload aborted", f.aborts, len(f.uploads))
+	}
+}
+
+func TestCopyObjectInParts(t *testing.T) {
+	smallParts(t)
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	body := bytes.Repeat([]byte("abc"), 1500) // over maxCopySize
+	f.seed("state/uploads/run.sql", body, testNow)
+
+	md := map[string]string{"sha256": checksum(body)}
+	if err := h.copyObject(context.Background(), "state/uploads/run.sql", "daily/2026-05-27-backup.sql", int64(len(body)), md, Compression{}); err != nil {
+		t.Fatal(err)
+	}
+	obj := f.objects["daily/2026-05-27-backup.sql"]
+	if obj == nil || !bytes.Equal(obj.body, body) || obj.metadata["sha256"] != checksum(body) {
+		t.Fatalf("copy = %+v, want the source with the new metadata", obj)
+	}
+	if f.copies != 0 || f.parts != 5 || f.completes != 1 {
+		t.Errorf("%d copies, %d part copies; want UploadPartCopy in 5 parts", f.copies, f.parts)
+	}
+}
+
+func TestServerCopyKeepsSourceMetadata(t *testing.T) {
+	smallParts(t)
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	body := bytes.Repeat([]byte("abc"), 1500) // over maxCopySize
+	f.seed("daily/2026-05-27-backup.slice-public.events-0000.sql", body, testNow)
+
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(h.bucket),
+		Key:        aws.String("daily/2026-05-28-backup.slice-public.events-0000.sql"),
+		CopySource: h.copySource("daily/2026-05-27-backup.slice-public.events-0000.sql"),
+	}
+	if err := h.serverCopy(context.Background(), input, "daily/2026-05-27-backup.slice-public.events-0000.sql", int64(len(body))); err != nil {
+		t.Fatal(err)
+	}
+	obj := f.objects["daily/2026-05-28-backup.slice-public.events-0000.sql"]
+	if obj == nil || !bytes.Equal(obj.body, body) || obj.metadata["sha256"] != checksum(body) {
+		t.Fatalf("copy = %+v, want the source with its metadata", obj)
+	}
+	if f.copies != 0 || f.completes != 1 {
+		t.Errorf("%d copies, %d multipart copies; want UploadPartCopy", f.copies, f.completes)
+	}
+}
+
+func TestCopySourceEscapesKey(t *testing.T) {
+	smallParts(t)
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	src := "tenants/acme corp/daily/2026-05-27-backup 100%.sql"
+	if got := aws.ToString(h.copySource(src)); got != "test-bucket/tenants/acme%20corp/daily/2026-05-27-backup%20100%25.sql" {
+		t.Errorf("copySource = %q", got)
+	}
+	for _, body := range [][]byte{[]byte("small"), bytes.Repeat([]byte("abc"), 1500)} {
+		f.seed(src, body, testNow)
+		if err := h.copyObject(context.Background(), src, "daily/2026-05-27-backup.sql", int64(len(body)), nil, Compression{}); err != nil {
+			t.Fatalf("copyObject of %d bytes: %v", len(body), err)
+		}
+		if obj := f.objects["daily/2026-05-27-backup.sql"]; obj == nil || !bytes.Equal(obj.body, body) {
+			t.Errorf("copy of %d bytes does not hold the source", len(body))
+		}
+	}
+}
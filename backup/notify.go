@@ -0,0 +1,193 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification describes something an operator should hear about, such as an
+// archived backup becoming retrievable.
+type Notification struct {
+	Event   string            `json:"event"`            // machine-readable event name, e.g. "thaw.available"
+	RunID   string            `json:"run_id,omitempty"` // run that raised the notification; filled in by the Handler
+	Message string            `json:"message"`          // human-readable summary
+	Fields  map[string]string `json:"fields,omitempty"` // event-specific details (keys, states, ...)
+}
+
+// Notifier delivers a Notification. Implementations should honor ctx; a failed
+// delivery is logged by the Handler and never fails the operation it reports.
+type Notifier func(ctx context.Context, n Notification) error
+
+// WebhookNotifier returns a Notifier that POSTs each Notification as JSON to
+// url. A nil client means http.DefaultClient. Webhook URLs often embed a
+// token, so url is registered with RegisterSecret.
+func WebhookNotifier(url string, client *http.Client) Notifier {
+	RegisterSecret(url)
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context, n Notification) error {
+		return postWebhook(ctx, client, webhook{URL: url}, n)
+	}
+}
+
+// webhook is where a Notification is delivered: a URL and an optional bearer
+// token.
+type webhook struct {
+	URL   string `json:"url"`
+	Token string `json:"token,omitempty"`
+}
+
+// webhookError is a delivery the webhook answered with a failure status.
+type webhookError struct{ status int }
+
+func (e webhookError) Error() string { return fmt.Sprintf("webhook returned status %d", e.status) }
+
+// revoked reports whether the status suggests the webhook's URL or token has
+// been rotated away.
+func (e webhookError) revoked() bool {
+	switch e.status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// postWebhook POSTs n as JSON to w.
+func postWebhook(ctx context.Context, client *http.Client, w webhook, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= 300 {
+		return webhookError{resp.StatusCode}
+	}
+	return nil
+}
+
+// RotatingWebhookNotifier returns a Notifier like WebhookNotifier whose
+// webhook is the secret secretID, read with fetch, so rotating the webhook
+// needs no redeploy. The secret is either the URL or a JSON object
+// {"url": ..., "token": ...}, the token being sent as a bearer token. It is
+// read on first use and again once refresh has passed (never, when refresh is
+// 0), and at once when the webhook answers 401, 403, 404 or 410, the delivery
+// being retried with the new value if it changed. A failed refresh keeps the
+// previous value. Values read are registered with RegisterSecret.
+func RotatingWebhookNotifier(fetch SecretFetcher, secretID string, refresh time.Duration, client *http.Client) Notifier {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var (
+		mu      sync.Mutex
+		current webhook
+		fetched time.Time
+	)
+	// load returns the webhook, reading the secret when it is missing,
+	// stale or force is set.
+	load := func(ctx context.Context, force bool) (webhook, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		stale := refresh > 0 && time.Since(fetched) >= refresh
+		if current.URL != "" && !stale && !force {
+			return current, nil
+		}
+		value, err := fetch(ctx, secretID)
+		if err == nil {
+			var w webhook
+			w, err = parseWebhook(value)
+			if err == nil {
+				RegisterSecret(w.URL, w.Token)
+				current, fetched = w, time.Now()
+				return current, nil
+			}
+		}
+		if current.URL == "" {
+			return webhook{}, fmt.Errorf("failed to read webhook secret: %w", err)
+		}
+		logf(ctx, "Warning: failed to refresh webhook secret, keeping the previous value: %v", err)
+		return current, nil
+	}
+	return func(ctx context.Context, n Notification) error {
+		w, err := load(ctx, false)
+		if err != nil {
+			return err
+		}
+		err = postWebhook(ctx, client, w, n)
+		var status webhookError
+		if !errors.As(err, &status) || !status.revoked() {
+			return err
+		}
+		fresh, ferr := load(ctx, true)
+		if ferr != nil || fresh == w {
+			return err
+		}
+		return postWebhook(ctx, client, fresh, n)
+	}
+}
+
+// parseWebhook parses the value of a webhook secret (see
+// RotatingWebhookNotifier).
+func parseWebhook(value string) (webhook, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "{") {
+		if value == "" {
+			return webhook{}, errors.New("webhook secret is empty")
+		}
+		return webhook{URL: value}, nil
+	}
+	var w webhook
+	if err := json.Unmarshal([]byte(value), &w); err != nil {
+		return webhook{}, fmt.Errorf("invalid webhook secret: %w", err)
+	}
+	if w.URL == "" {
+		return webhook{}, errors.New(`webhook secret has no "url"`)
+	}
+	return w, nil
+}
+
+// notify sends n through the configured Notifier, if any, tagged with the run
+// identifier in ctx and with secrets redacted from its message and fields.
+// Repeated failures are suppressed within the configured window (see
+// suppressRepeat). Delivery failures are logged instead of returned.
+func (h *Handler) notify(ctx context.Context, n Notification) {
+	if h.notifier == nil {
+		return
+	}
+	if n.RunID == "" {
+		n.RunID = RunID(ctx)
+	}
+	n.Message = Redact(n.Message)
+	if n.Fields != nil {
+		fields := make(map[string]string, len(n.Fields))
+		for k, v := range n.Fields {
+			fields[k] = Redact(v)
+		}
+		n.Fields = fields
+	}
+	if h.suppressRepeat(ctx, &n) {
+		return
+	}
+	if err := h.notifier(ctx, n); err != nil {
+		logf(ctx, "Warning: failed to send %s notification: %v", n.Event, err)
+	}
+}
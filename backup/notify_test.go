@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var got Notification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("content-type = %q", ct)
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	n := Notification{Event: "thaw.available", Message: "ready", Fields: map[string]string{"key": "k"}}
+	if err := WebhookNotifier(srv.URL, nil)(context.Background(), n); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Event != n.Event || got.Fields["key"] != "k" {
+		t.Errorf("webhook received %+v, want %+v", got, n)
+	}
+}
+
+func TestWebhookNotifierErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	if err := WebhookNotifier(srv.URL, nil)(context.Background(), Notification{Event: "x"}); err == nil {
+		t.Fatal("expected error for 500 response, got nil")
+	}
+}
+
+func TestNotifyFailureIsNonFatal(t *testing.T) {
+	h := newTestHandler(newFakeS3(), 7)
+	h.notify(context.Background(), Notification{Event: "noop"}) // nil notifier
+
+	h.notifier = func(context.Context, Notification) error { return errors.New("down") }
+	h.notify(context.Background(), Notification{Event: "x"}) // logged, not returned
+}
+
+func TestRotatingWebhookNotifier(t *testing.T) {
+	var hits []string
+	valid := map[string]bool{"/new": true, "/token": true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.Path+" "+r.Header.Get("Authorization"))
+		if !valid[r.URL.Path] {
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer srv.Close()
+
+	secret, fetches := srv.URL+"/old", 0
+	fetch := func(_ context.Context, id string) (string, error) {
+		if id != "webhook" {
+			t.Errorf("fetched %q", id)
+		}
+		fetches++
+		return secret, nil
+	}
+	notify := RotatingWebhookNotifier(fetch, "webhook", time.Hour, nil)
+	ctx := context.Background()
+
+	// The cached URL was rotated away: the 410 re-reads the secret and the
+	// delivery is retried against the new URL.
+	if err := notify(ctx, Notification{Event: "x"}); err == nil {
+		t.Fatal("expected error before rotation")
+	}
+	secret = srv.URL + "/new"
+	if err := notify(ctx, Notification{Event: "x"}); err != nil {
+		t.Fatalf("after rotation: %v", err)
+	}
+	if err := notify(ctx, Notification{Event: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 3 {
+		t.Errorf("fetches = %d, want 3 (first use and one per 410)", fetches)
+	}
+
+	// With a short refresh interval every delivery re-reads the secret;
+	// JSON values carry a bearer token.
+	secret = `{"url": "` + srv.URL + `/token", "token": "rotated-token"}`
+	notify = RotatingWebhookNotifier(fetch, "webhook", time.Nanosecond, nil)
+	if err := notify(ctx, Notification{Event: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if last := hits[len(hits)-1]; last != "/token Bearer rotated-token" {
+		t.Errorf("last request = %q", last)
+	}
+	if got := Redact("rotated-token"); got == "rotated-token" {
+		t.Error("token not registered as a secret")
+	}
+
+	// A failed refresh keeps the value already read.
+	fetch = func(context.Context, string) (string, error) { return "", errors.New("throttled") }
+	notify = RotatingWebhookNotifier(fetch, "webhook", time.Nanosecond, nil)
+	if err := notify(ctx, Notification{Event: "x"}); err == nil {
+		t.Error("expected error without any readable secret")
+	}
+}
+
+func TestParseWebhook(t *testing.T) {
+	for value, want := range map[string]webhook{
+		" https://hooks.example.com/a\n":                    {URL: "https://hooks.example.com/a"},
+		`{"url":"https://hooks.example.com/b","token":"t"}`: {URL: "https://hooks.example.com/b", Token: "t"},
+	} {
+		if got, err := parseWebhook(value); err != nil || got != want {
+			t.Errorf("parseWebhook(%q) = %+v, %v", value, got, err)
+		}
+	}
+	for _, value := range []string{"", `{"token":"t"}`, `{"url":`} {
+		if _, err := parseWebhook(value); err == nil {
+			t.Errorf("parseWebhook(%q): expected error", value)
+		}
+	}
+}
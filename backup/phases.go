@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Phases breaks the duration of a backup run down by what it was doing, in
+// milliseconds, so a slow run shows where its time went. Work nested in
+// another phase, like filters applied while the dump streams in or the
+// compression of the first upload, is counted in its own phase only.
+type Phases struct {
+	Connect  int64 `json:"connect_ms"`  // conflict check, catalog queries and the wait for a dump token, before pg_dump starts
+	Dump     int64 `json:"dump_ms"`     // reading the dump, and dumping and storing its slices
+	Filter   int64 `json:"filter_ms"`   // DumpFilters and the stripping of timestamp comments
+	Compress int64 `json:"compress_ms"` // choosing the compression, loading its reference and compressing the dump
+	Hash     int64 `json:"hash_ms"`     // checksumming the dump and comparing it with earlier backups
+	Upload   int64 `json:"upload_ms"`   // storing backups, their sidecars and replicas, and the snapshot request
+	Cleanup  int64 `json:"cleanup_ms"`  // retention and the removal of redundant slices
+}
+
+// phase indexes the durations of a phaseTimer.
+type phase int
+
+const (
+	phaseConnect phase = iota
+	phaseDump
+	phaseFilter
+	phaseCompress
+	phaseHash
+	phaseUpload
+	phaseCleanup
+	numPhases
+)
+
+// phaseNames names each phase in logs and metrics.
+var phaseNames = [numPhases]string{"connect", "dump", "filter", "compress", "hash", "upload", "cleanup"}
+
+// each calls fn with the name and duration of every phase, in run order.
+func (p Phases) each(fn func(name string, ms int64)) {
+	for i, ms := range []int64{p.Connect, p.Dump, p.Filter, p.Compress, p.Hash, p.Upload, p.Cleanup} {
+		fn(phaseNames[i], ms)
+	}
+}
+
+// phaseTimer attributes the time of a run to its phases: each call to done
+// ends a phase at the current time.
+type phaseTimer struct {
+	now   func() time.Time
+	mark  time.Time
+	spent [numPhases]time.Duration
+}
+
+func (h *Handler) startPhases(start time.Time) *phaseTimer {
+	return &phaseTimer{now: h.now, mark: start}
+}
+
+// done adds the time since the previous phase ended to p.
+func (t *phaseTimer) done(p phase) {
+	now := t.now()
+	t.spent[p] += now.Sub(t.mark)
+	t.mark = now
+}
+
+// move counts d, already counted in from, in to instead, for work timed
+// separately inside another phase.
+func (t *phaseTimer) move(d time.Duration, from, to phase) {
+	d = min(d, t.spent[from])
+	t.spent[from] -= d
+	t.spent[to] += d
+}
+
+// finish logs the phases and returns them for the Result.
+func (t *phaseTimer) finish(ctx context.Context) Phases {
+	ms := func(p phase) int64 { return t.spent[p].Milliseconds() }
+	p := Phases{
+		Connect:  ms(phaseConnect),
+		Dump:     ms(phaseDump),
+		Filter:   ms(phaseFilter),
+		Compress: ms(phaseCompress),
+		Hash:     ms(phaseHash),
+		Upload:   ms(phaseUpload),
+		Cleanup:  ms(phaseCleanup),
+	}
+	var parts []string
+	p.each(func(name string, ms int64) { parts = append(parts, fmt.Sprintf("%s %dms", name, ms)) })
+	logf(ctx, "Backup phases: %s", strings.Join(parts, ", "))
+	return p
+}
+
+// filterTimeKey is the context key under which Run passes its Dumper the
+// counter of time spent in DumpFilters while the dump streams in.
+type filterTimeKey struct{}
+
+func withFilterTime(ctx context.Context, spent *time.Duration) context.Context {
+	return context.WithValue(ctx, filterTimeKey{}, spent)
+}
+
+// filterTimeFrom returns the filter time counter stored in ctx, or nil.
+func filterTimeFrom(ctx context.Context) *time.Duration {
+	spent, _ := ctx.Value(filterTimeKey{}).(*time.Duration)
+	return spent
+}
@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunReportsPhases(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	clock := time.Date(2026, 5, 27, 12, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return clock }
+	h.throttle = func(context.Context, string) (func(), error) {
+		clock = clock.Add(500 * time.Millisecond) // waiting for a token
+		return func() {}, nil
+	}
+	h.dump = func(ctx context.Context, _ DatabaseConfig, _ DumpOptions) ([]byte, error) {
+		clock = clock.Add(3 * time.Second)
+		*filterTimeFrom(ctx) += time.Second // a third of it in filters
+		return []byte("dump"), nil
+	}
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if want := (Phases{Connect: 500, Dump: 2000, Filter: 1000}); res.Phases != want {
+		t.Errorf("phases = %+v, want %+v", res.Phases, want)
+	}
+	raw, _ := json.Marshal(res)
+	if !strings.Contains(string(raw), `"phases":{"connect_ms":500,"dump_ms":2000,"filter_ms":1000,`) {
+		t.Errorf("result JSON = %s", raw)
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.prom")
+	if err := WriteMetricsFile(path, res, nil, clock, clock); err != nil {
+		t.Fatalf("WriteMetricsFile: %v", err)
+	}
+	if got := readFile(t, path); !strings.Contains(got, `postgres_s3_backup_last_run_phase_duration_seconds{phase="dump"} 2.000`+"\n") {
+		t.Errorf("metrics file lacks the dump phase:\n%s", got)
+	}
+}
+
+func TestFilterDumpTime(t *testing.T) {
+	var spent time.Duration
+	slow := func(line []byte) ([]byte, bool) {
+		time.Sleep(time.Millisecond)
+		return line, true
+	}
+	r := filterDump(strings.NewReader("SET a = 1;\nCOPY t FROM stdin;\n1\n\\.\n"), []DumpFilter{slow}, &spent)
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if spent < 3*time.Millisecond {
+		t.Errorf("filter time = %s, want the three SQL lines timed", spent)
+	}
+}
@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Plan is a named sequence of actions run by one invocation, so each
+// EventBridge rule can pass {"plan": "<name>"} and one function serves many
+// schedules: a nightly full backup, an hourly schema-only one, a weekly
+// forced backup followed by an audit. Steps are Invocation payloads, run in
+// order; a failing step stops the plan.
+type Plan []Invocation
+
+// ParsePlans parses a BACKUP_PLANS setting: a JSON object mapping plan names
+// to their steps, e.g.
+//
+//	{"weekly-verified": [{"action": "backup", "force": true}, {"action": "audit", "sample": 10}]}
+//
+// Unknown fields, unknown actions, empty plans and steps naming a plan are
+// rejected.
+func ParsePlans(s string) (map[string]Plan, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	var plans map[string]Plan
+	if err := dec.Decode(&plans); err != nil {
+		return nil, fmt.Errorf("invalid plans: %w", err)
+	}
+	for name, plan := range plans {
+		if len(plan) == 0 {
+			return nil, fmt.Errorf("plan %q has no steps", name)
+		}
+		for i, step := range plan {
+			if err := step.validateStep(); err != nil {
+				return nil, fmt.Errorf("plan %q step %d: %w", name, i+1, err)
+			}
+		}
+	}
+	return plans, nil
+}
+
+// validateStep reports why inv cannot be a step of a Plan.
+func (inv Invocation) validateStep() error {
+	if inv.Plan != "" {
+		return errors.New("steps cannot run another plan")
+	}
+	switch inv.Action {
+	case "", "backup", "tenants", "thaw", "audit", "rekey", "reconcile", "prune":
+		return nil
+	default:
+		return fmt.Errorf("unknown action %q", inv.Action)
+	}
+}
+
+// PlanStep is the outcome of one step of a Plan.
+type PlanStep struct {
+	Action string `json:"action"`           // the step's action ("backup" when it names none)
+	Result any    `json:"result,omitempty"` // what the action returns, e.g. a *Result for a backup
+	Error  string `json:"error,omitempty"`  // why the step failed
+}
+
+// PlanResult summarizes the run of a Plan.
+type PlanResult struct {
+	Status     string     `json:"status"`      // "ok", or "failed" when a step failed
+	RunID      string     `json:"run_id"`      // run identifier, shared by every step
+	Action     string     `json:"action"`      // always "plan"
+	Plan       string     `json:"plan"`        // name of the plan
+	Steps      []PlanStep `json:"steps"`       // steps run, in order; the last one failed when Status is "failed"
+	DurationMs int64      `json:"duration_ms"` // wall-clock time of the call
+}
+
+// planNames returns the configured plan names, sorted, for error messages.
+func (h *Handler) planNames() string {
+	names := make([]string, 0, len(h.plans))
+	for name := range h.plans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// runPlan runs the steps of the configured plan called name through invoke,
+// stopping at the first that fails. The returned error, if any, is that
+// step's, and the result lists every step run.
+func (e *EventHandler) runPlan(ctx context.Context, name string) (*PlanResult, error) {
+	h := e.handler
+	start := h.now()
+	plan, ok := h.plans[name]
+	if !ok {
+		return nil, invalidInput(fmt.Errorf("unknown plan %q (configured: %s)", name, h.planNames()))
+	}
+	logf(ctx, "Running plan %s (%d steps)", name, len(plan))
+
+	result := &PlanResult{Status: "ok", RunID: RunID(ctx), Action: "plan", Plan: name, Steps: []PlanStep{}}
+	for i, step := range plan {
+		action := step.Action
+		if action == "" {
+			action = "backup"
+		}
+		out, err := e.invoke(ctx, step)
+		if err != nil {
+			result.Status = "failed"
+			result.Steps = append(result.Steps, PlanStep{Action: action, Error: Redact(err.Error())})
+			result.DurationMs = h.elapsed(start)
+			logf(ctx, "Plan %s stopped at step %d (%s): %v", name, i+1, action, err)
+			return result, fmt.Errorf("plan %s step %d (%s): %w", name, i+1, action, err)
+		}
+		result.Steps = append(result.Steps, PlanStep{Action: action, Result: out})
+	}
+	result.DurationMs = h.elapsed(start)
+	return result, nil
+}
@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParsePlans(t *testing.T) {
+	plans, err := ParsePlans(`{
+		"nightly-full": [{"profile": "full"}],
+		"weekly-verified": [{"action": "backup", "force": true}, {"action": "audit", "sample": 10}]
+	}`)
+	if err != nil {
+		t.Fatalf("ParsePlans: %v", err)
+	}
+	if weekly := plans["weekly-verified"]; len(plans) != 2 || len(weekly) != 2 || !weekly[0].Force || weekly[1].Action != "audit" || weekly[1].Sample != 10 {
+		t.Errorf("plans = %+v", plans)
+	}
+	if plans, err := ParsePlans(" "); plans != nil || err != nil {
+		t.Errorf("empty setting = %v, %v; want no plans", plans, err)
+	}
+	for _, bad := range []string{
+		`[]`,
+		`{"empty": []}`,
+		`{"typo": [{"actoin": "audit"}]}`,
+		`{"unknown": [{"action": "explode"}]}`,
+		`{"nested": [{"plan": "other"}]}`,
+	} {
+		if _, err := ParsePlans(bad); err == nil {
+			t.Errorf("ParsePlans(%s) should fail", bad)
+		}
+	}
+}
+
+func TestDispatchPlan(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.dump = staticDump([]byte("-- PostgreSQL database dump\nplan-data\n-- PostgreSQL database dump complete\n"))
+	h.plans = map[string]Plan{"weekly-verified": {{Force: true}, {Action: "audit", Sample: 5}}}
+	e := NewEventHandler(h, "")
+
+	out, err := e.Dispatch(context.Background(), json.RawMessage(`{"plan":"weekly-verified"}`))
+	if err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	res, ok := out.(*PlanResult)
+	if !ok {
+		t.Fatalf("output = %T, want *PlanResult", out)
+	}
+	if res.Status != "ok" || len(res.Steps) != 2 || res.Steps[0].Action != "backup" || res.Steps[1].Action != "audit" {
+		t.Fatalf("result = %+v", res)
+	}
+	backup := res.Steps[0].Result.(*Result)
+	audit := res.Steps[1].Result.(*AuditResult)
+	if backup.RunID != res.RunID || audit.RunID != res.RunID || res.RunID == "" {
+		t.Errorf("run ids %q, %q and %q should be the plan's", backup.RunID, audit.RunID, res.RunID)
+	}
+	if _, ok := f.objects[backup.Key]; !ok || audit.Sampled == 0 {
+		t.Errorf("backup %+v not stored or not audited (%+v)", backup, audit)
+	}
+}
+
+func TestDispatchPlanStopsAtFailure(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.plans = map[string]Plan{"nightly": {{Action: "thaw"}, {}}}
+	e := NewEventHandler(h, "")
+
+	res, err := e.runPlan(context.Background(), "nightly")
+	if err == nil || !strings.Contains(err.Error(), "step 1 (thaw)") {
+		t.Fatalf("err = %v, want step 1 to fail", err)
+	}
+	if res.Status != "failed" || len(res.Steps) != 1 || res.Steps[0].Error == "" || res.Steps[0].Result != nil || len(f.objects) != 0 {
+		t.Errorf("result = %+v with %d objects, want only the failed thaw", res, len(f.objects))
+	}
+	if _, err := e.Dispatch(context.Background(), json.RawMessage(`{"plan":"nightly"}`)); err == nil {
+		t.Error("Dispatch should fail with the step")
+	}
+}
+
+func TestDispatchPlanInvalid(t *testing.T) {
+	h := newTestHandler(newFakeS3(), 7)
+	h.plans = map[string]Plan{"nightly": {{}}}
+	e := NewEventHandler(h, "")
+
+	_, err := e.Dispatch(context.Background(), json.RawMessage(`{"plan":"hourly"}`))
+	if err == nil || !strings.Contains(err.Error(), "configured: nightly") {
+		t.Errorf("unknown plan: %v, want the configured plans listed", err)
+	}
+	if _, err := e.Dispatch(context.Background(), json.RawMessage(`{"plan":"nightly","action":"audit"}`)); err == nil {
+		t.Error("a plan with an action should fail")
+	}
+}
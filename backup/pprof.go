@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"runtime/pprof"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// profilePrefix holds the pprof profiles of invocations that ask for them
+// (see Invocation.Pprof), one directory per run ID.
+const profilePrefix = statePrefix + "profiles/"
+
+// startProfiles starts a CPU profile of the invocation of ctx. The function
+// it returns stops it and stores it with a heap profile taken then, as
+// cpu.pprof and heap.pprof under profilePrefix and the run ID, for
+// "go tool pprof". The heap profile also holds what the invocation allocated
+// (-sample_index=alloc_space). A profile that cannot be taken or stored is
+// logged and never fails the invocation.
+func (h *Handler) startProfiles(ctx context.Context) func() {
+	var cpu bytes.Buffer
+	cpuErr := pprof.StartCPUProfile(&cpu)
+	if cpuErr != nil {
+		// Only one CPU profile runs at a time in a process.
+		logf(ctx, "Warning: failed to start the CPU profile: %v", cpuErr)
+	}
+	return func() {
+		dir := profilePrefix + RunID(ctx) + "/"
+		if cpuErr == nil {
+			pprof.StopCPUProfile()
+			h.putProfile(ctx, dir+"cpu.pprof", cpu.Bytes())
+		}
+		// A GC first makes the heap profile current.
+		runtime.GC()
+		var heap bytes.Buffer
+		if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+			logf(ctx, "Warning: failed to write the heap profile: %v", err)
+			return
+		}
+		h.putProfile(ctx, dir+"heap.pprof", heap.Bytes())
+	}
+}
+
+// putProfile stores the profile data at key.
+func (h *Handler) putProfile(ctx context.Context, key string, data []byte) {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(h.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/octet-stream"),
+		Metadata:    map[string]string{},
+	}
+	h.encryption.addMetadata(input.Metadata)
+	h.encryption.applyToPut(input)
+	if _, err := h.s3.PutObject(ctx, input); err != nil {
+		logf(ctx, "Warning: failed to store profile %s: %v", key, err)
+		return
+	}
+	logf(ctx, "Profile stored: s3://%s/%s", h.bucket, key)
+}
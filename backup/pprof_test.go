@@ -0,0 +1,45 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDispatchPprof(t *testing.T) {
+	f := newFakeS3()
+	e := eventHandler(f, "secret", staticDump([]byte("profiled")))
+	if _, err := e.Dispatch(context.Background(), json.RawMessage(`{"pprof":true}`)); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	var profiles []string
+	for key, obj := range f.objects {
+		if strings.HasPrefix(key, profilePrefix) {
+			profiles = append(profiles, key)
+			if len(obj.body) == 0 {
+				t.Errorf("%s is empty", key)
+			}
+		}
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("profiles = %v, want cpu.pprof and heap.pprof", profiles)
+	}
+	for _, key := range profiles {
+		if !strings.HasSuffix(key, "/cpu.pprof") && !strings.HasSuffix(key, "/heap.pprof") {
+			t.Errorf("unexpected profile %s", key)
+		}
+	}
+
+	// Without the flag nothing is profiled.
+	f = newFakeS3()
+	e = eventHandler(f, "secret", staticDump([]byte("profiled")))
+	if _, err := e.Dispatch(context.Background(), json.RawMessage(`{}`)); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	for key := range f.objects {
+		if strings.HasPrefix(key, profilePrefix) {
+			t.Errorf("unrequested profile %s", key)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultProfile is the profile used when a run names none.
+const DefaultProfile = "full"
+
+// Profile bundles what a backup run dumps, where it is stored, and how long
+// its daily backups are kept, so different kinds of backups can share one
+// deployment. Backups of a profile with a Prefix live under their own
+// "<prefix>daily/", "<prefix>monthly/" and "<prefix>yearly/" keys and are
+// deduplicated and pruned independently of other profiles.
+type Profile struct {
+	Name          string
+	Dump          DumpOptions // merged into the Handler's DumpOptions
+	Prefix        string      // key prefix ahead of the tier prefixes; "" stores at the bucket root
+	RetentionDays int         // daily backups kept; <= 0 means the Handler's RetentionDays
+}
+
+// Profiles are the built-in profiles, selectable by name per run.
+var Profiles = map[string]Profile{
+	"full": {
+		Name: "full",
+	},
+	"schema-only": {
+		Name:   "schema-only",
+		Dump:   DumpOptions{SchemaOnly: true},
+		Prefix: "schema-only/",
+	},
+	"analytics-export": {
+		Name:          "analytics-export",
+		Dump:          DumpOptions{DataOnly: true},
+		Prefix:        "analytics-export/",
+		RetentionDays: 3,
+	},
+	"pre-deploy": {
+		Name:          "pre-deploy",
+		Prefix:        "pre-deploy/",
+		RetentionDays: 30,
+	},
+}
+
+// LookupProfile returns the built-in profile called name; "" means
+// DefaultProfile.
+func LookupProfile(name string) (Profile, error) {
+	if name == "" {
+		name = DefaultProfile
+	}
+	p, ok := Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(Profiles))
+		for n := range Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Profile{}, fmt.Errorf("unknown profile %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookupProfile(t *testing.T) {
+	if p, err := LookupProfile(""); err != nil || p.Name != DefaultProfile {
+		t.Errorf("empty name: got %q err=%v, want %q", p.Name, err, DefaultProfile)
+	}
+	if p, err := LookupProfile("schema-only"); err != nil || !p.Dump.SchemaOnly || p.Prefix != "schema-only/" {
+		t.Errorf("schema-only: got %+v err=%v", p, err)
+	}
+	if _, err := LookupProfile("nightly"); err == nil || !strings.Contains(err.Error(), "available") {
+		t.Errorf("unknown profile: err = %v, want list of available profiles", err)
+	}
+}
+
+func TestRunWithProfile(t *testing.T) {
+	f := newFakeS3()
+	// A root-level daily with identical content must not dedupe the profile run.
+	f.seed("daily/"+testDate+"-backup.sql", []byte("ddl"), testNow.Add(-time.Hour))
+	f.seed("pre-deploy/daily/2026-05-01-backup.sql", []byte("old"), testNow.Add(-600*time.Hour)) // within 30 days
+	var got DumpOptions
+	dump := func(_ context.Context, _ DatabaseConfig, opts DumpOptions) ([]byte, error) {
+		got = opts
+		return []byte("ddl"), nil
+	}
+	h := runHandler(t, f, dump, 7)
+	h.dumpOpts = DumpOptions{ExcludeSchemas: []string{"auth"}}
+
+	res, err := h.Run(context.Background(), RunOptions{Profile: "pre-deploy"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Profile != "pre-deploy" || res.Key != "pre-deploy/daily/"+testDate+"-backup.sql" || res.Action != "created" {
+		t.Errorf("profile=%q key=%q action=%q", res.Profile, res.Key, res.Action)
+	}
+	for _, key := range []string{"pre-deploy/monthly/2026-05-backup.sql", "pre-deploy/yearly/2026-backup.sql"} {
+		if _, ok := f.objects[key]; !ok {
+			t.Errorf("expected %s to be created", key)
+		}
+	}
+	if _, ok := f.objects["pre-deploy/daily/2026-05-01-backup.sql"]; !ok {
+		t.Error("profile retention (30 days) should keep a 26-day-old backup")
+	}
+	if len(got.ExcludeSchemas) != 1 || got.ExcludeSchemas[0] != "auth" {
+		t.Errorf("base dump options not passed through: %+v", got)
+	}
+}
+
+func TestRunUnknownProfile(t *testing.T) {
+	h := runHandler(t, newFakeS3(), staticDump([]byte("x")), 7)
+	if _, err := h.Run(context.Background(), RunOptions{Profile: "nope"}); err == nil {
+		t.Fatal("expected error for unknown profile, got nil")
+	}
+}
+
+func TestPgDumpArgsDataOnlyOmitsClean(t *testing.T) {
+	args := strings.Join(pgDumpArgs(DatabaseConfig{}, DumpOptions{DataOnly: true}), " ")
+	if !strings.Contains(args, "--data-only") || strings.Contains(args, "--clean") {
+		t.Errorf("data-only args = %s", args)
+	}
+	args = strings.Join(pgDumpArgs(DatabaseConfig{}, DumpOptions{SchemaOnly: true}), " ")
+	if !strings.Contains(args, "--schema-only --clean --if-exists") {
+		t.Errorf("schema-only args = %s", args)
+	}
+}
+
+func TestIsBackupKey(t *testing.T) {
+	for key, want := range map[string]bool{
+		"daily/2026-05-27-backup.sql":            true,
+		"schema-only/monthly/2026-05-backup.sql": true,
+		"yearly/2026-backup.sql":                 true,
+		"notes/readme.txt":                       false,
+		"dailyish/2026-05-27-backup.sql":         false,
+	} {
+		if got := isBackupKey(key); got != want {
+			t.Errorf("isBackupKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
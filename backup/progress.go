@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultProgressInterval is how often a Restore reports its progress when
+// Config.RestoreProgressInterval is not set.
+const defaultProgressInterval = time.Minute
+
+// progressCheckBytes is how many dump bytes a Restore reads between looks at
+// the clock.
+const progressCheckBytes = 64 << 10
+
+// RestoreProgress is how far a Restore is through the dump it loads, as
+// logged every Config.RestoreProgressInterval and passed to
+// RestoreOptions.Progress.
+type RestoreProgress struct {
+	Key   string `json:"key"`
+	Bytes int64  `json:"bytes"`           // dump bytes loaded so far
+	Total int64  `json:"total,omitempty"` // size of the dump, when its manifest or metadata records it
+	// Entry is the TOC entry being restored, e.g. "TABLE DATA
+	// public.users", when the restore's output names one.
+	Entry   string        `json:"entry,omitempty"`
+	Elapsed time.Duration `json:"elapsed"`
+	// ETA is the time left at the rate so far, when Total is known.
+	ETA time.Duration `json:"eta,omitempty"`
+}
+
+// Percent returns how much of the dump is loaded, from 0 to 100, or -1 when
+// its size is not known.
+func (p RestoreProgress) Percent() int {
+	if p.Total <= 0 {
+		return -1
+	}
+	return int(min(p.Bytes*100/p.Total, 100))
+}
+
+// progressTracker follows the progress of one Restore, reporting it each
+// interval as dump bytes are read (see read) and TOC entries start (see
+// entry). Entries are reported from the output of psql or pg_restore, read
+// concurrently with the dump.
+type progressTracker struct {
+	h        *Handler
+	ctx      context.Context
+	key      string
+	total    int64
+	start    time.Time
+	callback func(RestoreProgress)
+
+	mu        sync.Mutex
+	bytes     int64
+	unchecked int // bytes read since the clock was last looked at
+	current   string
+	last      time.Time // of the last report
+	milestone int       // last quarter of the dump notified
+}
+
+// newProgressTracker returns the progressTracker of a Restore of the dump at
+// key, of total bytes (0 when unknown), started at start.
+func (h *Handler) newProgressTracker(ctx context.Context, key string, total int64, start time.Time, callback func(RestoreProgress)) *progressTracker {
+	return &progressTracker{h: h, ctx: ctx, key: key, total: total, start: start, callback: callback, last: start}
+}
+
+// reader returns r counting the dump bytes read through it.
+func (t *progressTracker) reader(r io.Reader) io.Reader {
+	return progressReader{r: r, t: t}
+}
+
+// read counts n dump bytes loaded.
+func (t *progressTracker) read(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bytes += int64(n)
+	if t.unchecked += n; t.unchecked >= progressCheckBytes {
+		t.unchecked = 0
+		t.maybeReport()
+	}
+}
+
+// entry records that the TOC entry named entry started.
+func (t *progressTracker) entry(entry string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.current = entry
+	t.maybeReport()
+}
+
+// maybeReport reports the progress once the interval has passed since the
+// last report. t.mu is held.
+func (t *progressTracker) maybeReport() {
+	now := t.h.now()
+	if now.Sub(t.last) < t.h.progressEvery {
+		return
+	}
+	t.last = now
+	p := RestoreProgress{Key: t.key, Bytes: t.bytes, Total: t.total, Entry: t.current, Elapsed: now.Sub(t.start)}
+	if t.total > 0 && t.bytes > 0 && t.bytes < t.total {
+		p.ETA = time.Duration(float64(p.Elapsed) * float64(t.total-t.bytes) / float64(t.bytes)).Round(time.Second)
+	}
+	logf(t.ctx, "%s", p)
+	if t.callback != nil {
+		t.callback(p)
+	}
+	// A notification for each quarter of a large restore; the logs have
+	// the rest.
+	if quarter := p.Percent() / 25; quarter > t.milestone && quarter < 4 {
+		t.milestone = quarter
+		t.h.notify(t.ctx, Notification{
+			Event:   "restore.progress",
+			Message: "Restore progress: " + p.String(),
+			Fields: map[string]string{
+				"key":        t.key,
+				"bytes":      strconv.FormatInt(p.Bytes, 10),
+				"total":      strconv.FormatInt(p.Total, 10),
+				"entry":      p.Entry,
+				"elapsed_ms": strconv.FormatInt(p.Elapsed.Milliseconds(), 10),
+				"eta_ms":     strconv.FormatInt(p.ETA.Milliseconds(), 10),
+			},
+		})
+	}
+}
+
+// String describes p for logs, e.g. "Restoring daily/2026-05-27-backup.sql:
+// 1.00 GB of 4.00 GB (25%) in 10m0s, TABLE DATA public.events; about 30m0s
+// left".
+func (p RestoreProgress) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Restoring %s: %s", p.Key, HumanizeSize(int(p.Bytes)))
+	if pct := p.Percent(); pct >= 0 {
+		fmt.Fprintf(&b, " of %s (%d%%)", HumanizeSize(int(p.Total)), pct)
+	}
+	fmt.Fprintf(&b, " in %s", p.Elapsed.Round(time.Second))
+	if p.Entry != "" {
+		fmt.Fprintf(&b, ", %s", p.Entry)
+	}
+	if p.ETA > 0 {
+		fmt.Fprintf(&b, "; about %s left", p.ETA)
+	}
+	return b.String()
+}
+
+// progressReader is an io.Reader counting what is read through it into a
+// progressTracker.
+type progressReader struct {
+	r io.Reader
+	t *progressTracker
+}
+
+func (p progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.t.read(n)
+	return n, err
+}
+
+// tocPrefix starts the comment pg_dump writes before each TOC entry of a
+// plain script, e.g. "-- Name: users; Type: TABLE; Schema: public; Owner:
+// app", or "-- Data for Name: users; ..." before its data.
+var tocPrefix = []byte("-- ")
+
+// maxTOCLine bounds the comment lines tocWatcher reads; longer lines are not
+// TOC comments.
+const maxTOCLine = 1024
+
+// tocWatcher is an io.Writer passing the TOC entry of each TOC comment of the
+// plain script written to it to fn (see tocComment), and its name, type and
+// schema to object when set. Other lines are skipped as they are written,
+// without being copied, so watching a script costs little more than scanning
+// it for newlines.
+type tocWatcher struct {
+	fn       func(entry string)
+	object   func(name, typ, schema string)
+	line     []byte // the start of the line being written
+	skipping bool   // the line being written is not a TOC comment
+}
+
+func (w *tocWatcher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		chunk := p
+		if i >= 0 {
+			chunk = p[:i]
+		}
+		if !w.skipping {
+			start := append(w.line, chunk[:min(len(chunk), max(len(tocPrefix)-len(w.line), 0))]...)
+			w.skipping = !bytes.HasPrefix(start, tocPrefix) && !bytes.HasPrefix(tocPrefix, start) || len(w.line)+len(chunk) > maxTOCLine
+		}
+		if w.skipping {
+			w.line = w.line[:0]
+		} else {
+			w.line = append(w.line, chunk...)
+		}
+		if i < 0 {
+			return n, nil
+		}
+		if !w.skipping {
+			if m := tocHeader.FindStringSubmatch(string(w.line)); m != nil {
+				if w.fn != nil {
+					w.fn(tocComment(m))
+				}
+				if w.object != nil {
+					w.object(m[1], m[2], m[3])
+				}
+			}
+		}
+		w.line, w.skipping, p = w.line[:0], false, p[i+1:]
+	}
+	return n, nil
+}
+
+// tocComment returns the TOC entry of a pg_dump object header, matched by
+// tocHeader, as "<type> <schema>.<name>", e.g. "TABLE DATA public.users", or
+// without the schema for objects outside one.
+func tocComment(m []string) string {
+	if m[3] == "-" {
+		return m[2] + " " + m[1]
+	}
+	return m[2] + " " + m[3] + "." + m[1]
+}
@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestRestoreReportsProgress(t *testing.T) {
+	f := newFakeS3()
+	key := "daily/2026-05-27-backup.sql"
+	dump := "--\n-- Name: users; Type: TABLE; Schema: public; Owner: app\n--\n\nCREATE TABLE public.users ();\n" +
+		"--\n-- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: app\n--\n\nCOPY public.users FROM stdin;\n" +
+		strings.Repeat("1\talice\n", 80000) + "\\.\n" // 640 KB
+	f.seed(key, []byte(dump), time.Time{})
+	manifest, _ := json.Marshal(Manifest{Key: key, Size: int64(len(dump))})
+	f.seed(manifestKey(key), manifest, time.Time{})
+
+	var events []Notification
+	h := newTestHandler(f, 7)
+	h.notifier = func(_ context.Context, n Notification) error {
+		events = append(events, n)
+		return nil
+	}
+	clock := testNow
+	h.now = func() time.Time {
+		clock = clock.Add(time.Minute)
+		return clock
+	}
+	// Read a line at a time, as psql does, watching for TOC comments.
+	h.restore = func(_ context.Context, _ DatabaseConfig, _ string, r io.Reader, opts RestoreOptions) (RestoreStats, error) {
+		_, err := io.Copy(io.Discard, io.TeeReader(iotest.OneByteReader(r), &tocWatcher{fn: opts.onEntry}))
+		return RestoreStats{}, err
+	}
+
+	var reports []RestoreProgress
+	if _, err := h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget, Progress: func(p RestoreProgress) { reports = append(reports, p) }}); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if len(reports) < 2 {
+		t.Fatalf("got %d progress reports, want several", len(reports))
+	}
+	last := reports[len(reports)-1]
+	if last.Key != key || last.Total != int64(len(dump)) || last.Entry != "TABLE DATA public.users" || last.Bytes <= reports[0].Bytes {
+		t.Errorf("last report = %+v", last)
+	}
+	if mid := reports[len(reports)/2]; mid.ETA <= 0 || mid.Percent() <= 0 || mid.Percent() >= 100 {
+		t.Errorf("report %+v should project the time left", mid)
+	}
+	var quarters []string
+	for _, n := range events {
+		if n.Event == "restore.progress" {
+			quarters = append(quarters, n.Fields["bytes"])
+		}
+	}
+	if len(quarters) != 3 {
+		t.Errorf("%d restore.progress notifications, want one for each of 25%%, 50%% and 75%%", len(quarters))
+	}
+}
+
+func TestTOCWatcher(t *testing.T) {
+	var entries []string
+	w := &tocWatcher{fn: func(e string) { entries = append(entries, e) }}
+	script := "--\n-- Name: users; Type: TABLE; Schema: public; Owner: app\n" +
+		"-- Name: pgcrypto; Type: EXTENSION; Schema: -; Owner: -\n" +
+		"COPY x FROM stdin;\n" +
+		strings.Repeat("x", 2*maxTOCLine) + "\n" +
+		"-- " + strings.Repeat("x", 2*maxTOCLine) + "\n" +
+		"-- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: app\n"
+	// Written a few bytes at a time, so lines span writes.
+	for s := script; s != ""; {
+		n := min(len(s), 7)
+		_, _ = w.Write([]byte(s[:n]))
+		s = s[n:]
+	}
+	want := []string{"TABLE public.users", "EXTENSION pgcrypto", "TABLE DATA public.users"}
+	if strings.Join(entries, "|") != strings.Join(want, "|") {
+		t.Errorf("entries = %q, want %q", entries, want)
+	}
+}
+
+func TestRestoreProgressString(t *testing.T) {
+	p := RestoreProgress{Key: "daily/2026-05-27-backup.sql", Bytes: 1 << 30, Total: 4 << 30, Entry: "TABLE DATA public.events", Elapsed: 10 * time.Minute, ETA: 30 * time.Minute}
+	if got, want := p.String(), "Restoring daily/2026-05-27-backup.sql: 1.00 GB of 4.00 GB (25%) in 10m0s, TABLE DATA public.events; about 30m0s left"; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+	p = RestoreProgress{Key: "daily/2026-05-27-backup.sql", Bytes: 2048, Elapsed: time.Second}
+	if got := p.String(); got != "Restoring daily/2026-05-27-backup.sql: 2.00 KB in 1s" {
+		t.Errorf("without a size, String = %q", got)
+	}
+}
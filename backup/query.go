@@ -0,0 +1,56 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// fieldSeparator separates columns in Psql output; the ASCII unit separator
+// does not occur in identifiers or catalog values.
+const fieldSeparator = "\x1f"
+
+// Querier runs a SQL query against the database and returns its rows as text
+// columns. Queries are read-only but for the masking rules of a staging
+// refresh (see MaskRule), run against the target. The default implementation
+// is Psql; tests inject their own.
+type Querier func(ctx context.Context, db DatabaseConfig, query string) ([][]string, error)
+
+// Psql runs query through the psql binary (resolved like pg_dump, see PgDump)
+// in unaligned, tuples-only mode. It is the default Querier used by New.
+func Psql(ctx context.Context, db DatabaseConfig, query string) ([][]string, error) {
+	psqlPath, env, err := pgTool("psql", db)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, psqlPath, append(connArgs(db),
+		"--no-psqlrc",
+		"--no-align",
+		"--tuples-only",
+		"--field-separator="+fieldSeparator,
+		"-v", "ON_ERROR_STOP=1",
+		"-c", query,
+	)...)
+	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("psql failed: %w\nstderr: %s", err, Redact(stderr.String()))
+	}
+	return parseRows(stdout.String()), nil
+}
+
+// parseRows splits unaligned psql output into rows and columns.
+func parseRows(out string) [][]string {
+	var rows [][]string
+	for _, line := range strings.Split(strings.TrimRight(out, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		rows = append(rows, strings.Split(line, fieldSeparator))
+	}
+	return rows
+}
@@ -0,0 +1,17 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRows(t *testing.T) {
+	got := parseRows("public\x1fmv_a\nsales\x1fmv b\n\n")
+	want := [][]string{{"public", "mv_a"}, {"sales", "mv b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRows = %q, want %q", got, want)
+	}
+	if rows := parseRows(""); rows != nil {
+		t.Errorf("parseRows(\"\") = %q, want nil", rows)
+	}
+}
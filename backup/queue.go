@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Job is a backup requested through the job queue, one per SQS message body,
+// so other services can ask for a backup when they need one ("before this
+// tenant's migration") rather than wait for the schedule:
+//
+//	{"database": "orders", "profile": "pre-deploy", "labels": {"reason": "migration-0042"}}
+type Job struct {
+	// Database names a database on the configured server; "" means the
+	// configured one. Backups of another database are stored under
+	// "databases/<name>/", each keeping its own tiers and retention.
+	Database string            `json:"database,omitempty"`
+	Profile  string            `json:"profile,omitempty"` // backup profile; "" means the configured default
+	Labels   map[string]string `json:"labels,omitempty"`  // recorded in the result and the manifests of the backups stored
+	Force    bool              `json:"force,omitempty"`   // store the backup even if it matches an older one
+}
+
+// maxJobLabels bounds the labels of a Job or Invocation, which are copied
+// into every manifest.
+const maxJobLabels = 16
+
+// databaseName matches the database names a Job may target: plain
+// identifiers, which are also safe as a key prefix.
+var databaseName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$-]{0,62}$`)
+
+// labelName matches the keys of Job.Labels.
+var labelName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,62}$`)
+
+// ParseJob parses the body of a job queue message. Unknown fields are
+// rejected, like the settings, so a misspelled field fails the job instead of
+// being ignored.
+func ParseJob(body string) (Job, error) {
+	dec := json.NewDecoder(strings.NewReader(body))
+	dec.DisallowUnknownFields()
+	var job Job
+	if err := dec.Decode(&job); err != nil {
+		return Job{}, fmt.Errorf("invalid job: %w", err)
+	}
+	if err := job.validate(); err != nil {
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// validate reports why job cannot run.
+func (job Job) validate() error {
+	if job.Database != "" && !databaseName.MatchString(job.Database) {
+		return fmt.Errorf("invalid database name %q", job.Database)
+	}
+	if job.Profile != "" {
+		if _, err := LookupProfile(job.Profile); err != nil {
+			return err
+		}
+	}
+	return validateLabels(job.Labels)
+}
+
+// validateLabels reports why labels cannot be recorded with a run.
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxJobLabels {
+		return fmt.Errorf("job has %d labels, at most %d are allowed", len(labels), maxJobLabels)
+	}
+	for k, v := range labels {
+		if !labelName.MatchString(k) {
+			return fmt.Errorf("invalid label name %q", k)
+		}
+		if len(v) > 256 {
+			return fmt.Errorf("label %s is longer than 256 bytes", k)
+		}
+	}
+	return nil
+}
+
+// databasePrefix is the key prefix of the backups of a database other than
+// the configured one.
+func databasePrefix(name string) string {
+	return "databases/" + name + "/"
+}
+
+// errJobDeferred is returned by RunJob when a conflicting operation made the
+// run skip, so the queue delivers the job again later.
+var errJobDeferred = errors.New("backup skipped while a conflicting operation runs")
+
+// RunJob runs the backup job describes, like Run. A job skipped under the
+// conflict policy fails with the skipped result, so that a queued job is
+// retried once the conflicting operation is over instead of being dropped.
+func (h *Handler) RunJob(ctx context.Context, job Job) (*Result, error) {
+	if err := job.validate(); err != nil {
+		return nil, err
+	}
+	target, opts := h, RunOptions{Profile: job.Profile, Force: job.Force, Labels: job.Labels}
+	if job.Database != "" && job.Database != h.db.Database {
+		other := *h
+		other.db.Database = job.Database
+		target, opts.Prefix = &other, databasePrefix(job.Database)
+	}
+	res, err := target.Run(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	res.Database = job.Database
+	if len(res.Conflicts) > 0 {
+		return res, fmt.Errorf("%w: %s", errJobDeferred, res.Conflicts[0])
+	}
+	return res, nil
+}
+
+// labelsKey is the context key under which a run's labels are passed to the
+// manifests it writes.
+type labelsKey struct{}
+
+func withLabels(ctx context.Context, labels map[string]string) context.Context {
+	return context.WithValue(ctx, labelsKey{}, labels)
+}
+
+// labelsFrom returns the labels stored in ctx, or nil.
+func labelsFrom(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(labelsKey{}).(map[string]string)
+	return labels
+}
+
+// isSQSEvent reports whether ev holds messages delivered by SQS.
+func isSQSEvent(ev events.SQSEvent) bool {
+	return len(ev.Records) > 0 && ev.Records[0].EventSource == "aws:sqs"
+}
+
+// handleSQS runs the job of each message in turn, each under its own run
+// identifier, and reports the messages whose job failed so that SQS delivers
+// only those again (the event source mapping must enable
+// ReportBatchItemFailures). Retries are safe: a job that already stored its
+// backup finds it unchanged and skips. Malformed jobs fail like any other and
+// end in the dead-letter queue once their retries run out.
+func (e *EventHandler) handleSQS(ctx context.Context, ev events.SQSEvent) events.SQSEventResponse {
+	resp := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+	for _, msg := range ev.Records {
+		ctx := WithRunID(ctx, NewRunID())
+		logf(ctx, "Running job from message %s (receive count %s)", msg.MessageId, msg.Attributes["ApproximateReceiveCount"])
+		job, err := ParseJob(msg.Body)
+		if err == nil {
+			var res *Result
+			if res, err = e.handler.RunJob(ctx, job); err == nil {
+				logf(ctx, "Job from message %s done: %s %s", msg.MessageId, res.Action, res.Key)
+				continue
+			}
+		}
+		logf(ctx, "Job from message %s failed: %v", msg.MessageId, err)
+		resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: msg.MessageId})
+	}
+	return resp
+}
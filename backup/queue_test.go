@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestParseJob(t *testing.T) {
+	job, err := ParseJob(`{"database":"orders","profile":"pre-deploy","labels":{"reason":"migration-0042"},"force":true}`)
+	if err != nil {
+		t.Fatalf("ParseJob: %v", err)
+	}
+	if job.Database != "orders" || job.Profile != "pre-deploy" || job.Labels["reason"] != "migration-0042" || !job.Force {
+		t.Errorf("job = %+v", job)
+	}
+	for _, bad := range []string{
+		``,
+		`not json`,
+		`{"databse":"orders"}`,
+		`{"database":"../orders"}`,
+		`{"profile":"hourly"}`,
+		`{"labels":{"Reason":"x"}}`,
+	} {
+		if _, err := ParseJob(bad); err == nil {
+			t.Errorf("ParseJob(%q) should fail", bad)
+		}
+	}
+}
+
+func sqsEvent(bodies ...string) json.RawMessage {
+	var ev events.SQSEvent
+	for i, body := range bodies {
+		ev.Records = append(ev.Records, events.SQSMessage{MessageId: string(rune('a' + i)), Body: body, EventSource: "aws:sqs"})
+	}
+	raw, _ := json.Marshal(ev)
+	return raw
+}
+
+func TestDispatchSQSJobs(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.db.Database = "app"
+	var dumped []string
+	h.dump = func(_ context.Context, db DatabaseConfig, _ DumpOptions) ([]byte, error) {
+		dumped = append(dumped, db.Database)
+		return []byte("-- dump of " + db.Database + "\n"), nil
+	}
+	e := NewEventHandler(h, "")
+
+	out, err := e.Dispatch(context.Background(), sqsEvent(
+		`{}`,
+		`{"database":"orders","labels":{"reason":"migration-0042"}}`,
+		`{"database":"orders","profil":"full"}`,
+	))
+	if err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	resp := out.(events.SQSEventResponse)
+	if len(resp.BatchItemFailures) != 1 || resp.BatchItemFailures[0].ItemIdentifier != "c" {
+		t.Errorf("failures = %+v, want only the malformed message", resp.BatchItemFailures)
+	}
+	if len(dumped) != 2 || dumped[0] != "app" || dumped[1] != "orders" {
+		t.Errorf("dumped %v, want app then orders", dumped)
+	}
+	if _, ok := f.objects["daily/2026-05-27-backup.sql"]; !ok {
+		t.Error("the configured database should be backed up at the bucket root")
+	}
+	m, err := h.readManifest(context.Background(), "databases/orders/daily/2026-05-27-backup.sql")
+	if err != nil || m.Labels["reason"] != "migration-0042" {
+		t.Errorf("orders manifest = %+v, %v; want its labels", m, err)
+	}
+	if _, ok := f.objects["databases/orders/monthly/2026-05-backup.sql"]; !ok {
+		t.Error("orders should keep its own monthly backups")
+	}
+}
+
+func TestRunJobRetriesFailures(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.conflictPolicy = ConflictSkip
+	h.query = staticQuery([][]string{vacuumRow})
+
+	res, err := h.RunJob(context.Background(), Job{Labels: map[string]string{"reason": "deploy"}})
+	if !errors.Is(err, errJobDeferred) || res == nil || res.Action != "skipped" || res.Labels["reason"] != "deploy" {
+		t.Errorf("RunJob = %+v, %v; want a deferred skip", res, err)
+	}
+
+	h.query = staticQuery(nil)
+	h.dump = failingDump(errors.New("connection refused"))
+	e := NewEventHandler(h, "")
+	out, err := e.Dispatch(context.Background(), sqsEvent(`{}`))
+	if err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	if failures := out.(events.SQSEventResponse).BatchItemFailures; len(failures) != 1 {
+		t.Errorf("failures = %+v, want the failed dump retried", failures)
+	}
+
+	h.dump = staticDump([]byte("dump"))
+	for range 2 { // a redelivered job finds its backup already stored
+		if res, err := h.RunJob(context.Background(), Job{}); err != nil {
+			t.Fatalf("RunJob: %v", err)
+		} else if !bytes.Equal(f.objects[res.Key].body, []byte("dump")) {
+			t.Errorf("job stored %q", f.objects[res.Key].body)
+		}
+	}
+}
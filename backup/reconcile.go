@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Problems reported in ReconcileFinding.Problem.
+const (
+	ReconcileMissingManifest = "missing-manifest" // backup without a manifest next to it
+	ReconcileOrphanedSidecar = "orphaned-sidecar" // manifest or refresh script whose backup is gone
+	ReconcileUnknown         = "unknown-object"   // object that is neither a backup nor a sidecar
+)
+
+// ReconcileOptions configures a Reconcile call.
+type ReconcileOptions struct {
+	Prefix        string // limit the check to keys under this prefix; "" means the whole bucket
+	DeleteOrphans bool   // delete orphaned sidecars instead of only reporting them
+}
+
+// ReconcileFinding is one object whose bookkeeping is inconsistent.
+type ReconcileFinding struct {
+	Key     string `json:"key"`
+	Problem string `json:"problem"`           // one of the Reconcile* problems
+	Deleted bool   `json:"deleted,omitempty"` // removed because of ReconcileOptions.DeleteOrphans
+	Error   string `json:"error,omitempty"`   // why the deletion failed
+}
+
+// ReconcileResult summarizes a Reconcile call.
+type ReconcileResult struct {
+	Status     string             `json:"status"`      // "ok", or "mismatch" when there are findings
+	RunID      string             `json:"run_id"`      // run identifier, also prefixed to log lines
+	Action     string             `json:"action"`      // always "reconcile"
+	Prefix     string             `json:"prefix"`      // prefix that was checked
+	Objects    int                `json:"objects"`     // objects listed
+	Backups    int                `json:"backups"`     // backups among them
+	Findings   []ReconcileFinding `json:"findings"`    // inconsistencies, sorted by key
+	DurationMs int64              `json:"duration_ms"` // wall-clock time of the call
+}
+
+// Reconcile lists the bucket and checks that every backup has its manifest
+// and every sidecar (manifest or refresh script) still has its backup, and
+// flags objects that are neither, such as stray uploads. Manifests are this
+// tool's record of what it stored, so over years of lifecycle rules, manual
+// deletions and restores the listing and the manifests can drift apart.
+// Backups written before manifests existed are reported as missing their
+// manifest. Only keys are compared: use Audit to check contents.
+//
+// With opts.DeleteOrphans, orphaned sidecars are deleted; other findings are
+// only reported. Findings are also sent as a "reconcile.mismatch"
+// notification.
+func (h *Handler) Reconcile(ctx context.Context, opts ReconcileOptions) (*ReconcileResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	objects, err := h.listObjects(ctx, opts.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	keys := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		keys[aws.ToString(obj.Key)] = true
+	}
+	result := &ReconcileResult{Status: "ok", RunID: runID, Action: "reconcile", Prefix: opts.Prefix, Objects: len(objects), Findings: []ReconcileFinding{}}
+	for key := range keys {
+		switch {
+		case strings.HasPrefix(key, auditLogPrefix), strings.HasPrefix(key, restoreLogPrefix), strings.HasPrefix(key, statePrefix), strings.HasPrefix(key, growthPrefix), isLatestKey(key):
+			// Audit and restore history, cached state, growth reports and
+			// latest pointers, not backup bookkeeping.
+		case !isBackupKey(key) || (!isSidecarKey(key) && !strings.HasSuffix(plainKey(key), ".sql")):
+			result.Findings = append(result.Findings, ReconcileFinding{Key: key, Problem: ReconcileUnknown})
+		case isSidecarKey(key):
+			if backup := sidecarBackupKey(key); !keys[backup] && !keys[backup+gzipSuffix] {
+				result.Findings = append(result.Findings, h.orphanedSidecar(ctx, key, opts.DeleteOrphans))
+			}
+		default:
+			result.Backups++
+			if !keys[manifestKey(key)] {
+				result.Findings = append(result.Findings, ReconcileFinding{Key: key, Problem: ReconcileMissingManifest})
+			}
+		}
+	}
+	sort.Slice(result.Findings, func(i, j int) bool { return result.Findings[i].Key < result.Findings[j].Key })
+
+	logf(ctx, "Reconciled %d objects (%d backups): %d finding(s)", result.Objects, result.Backups, len(result.Findings))
+	if len(result.Findings) > 0 {
+		result.Status = "mismatch"
+		counts := map[string]int{}
+		for _, f := range result.Findings {
+			counts[f.Problem]++
+		}
+		h.notify(ctx, Notification{
+			Event: "reconcile.mismatch",
+			Message: fmt.Sprintf("Reconcile found %d backup(s) without a manifest, %d orphaned sidecar(s) and %d unknown object(s)",
+				counts[ReconcileMissingManifest], counts[ReconcileOrphanedSidecar], counts[ReconcileUnknown]),
+			Fields: map[string]string{
+				"missing_manifests": strconv.Itoa(counts[ReconcileMissingManifest]),
+				"orphaned_sidecars": strconv.Itoa(counts[ReconcileOrphanedSidecar]),
+				"unknown_objects":   strconv.Itoa(counts[ReconcileUnknown]),
+			},
+		})
+	}
+	result.DurationMs = h.elapsed(start)
+	return result, nil
+}
+
+// orphanedSidecar reports the sidecar at key, deleting it first when del is
+// set.
+func (h *Handler) orphanedSidecar(ctx context.Context, key string, del bool) ReconcileFinding {
+	f := ReconcileFinding{Key: key, Problem: ReconcileOrphanedSidecar}
+	if !del {
+		return f
+	}
+	if _, err := h.s3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(h.bucket), Key: aws.String(key)}); err != nil {
+		f.Error = err.Error()
+		logf(ctx, "Warning: failed to delete orphaned sidecar %s: %v", key, err)
+		return f
+	}
+	f.Deleted = true
+	logf(ctx, "Deleted orphaned sidecar %s", key)
+	return f
+}
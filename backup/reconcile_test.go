@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReconcile(t *testing.T) {
+	f := newFakeS3()
+	now := time.Now()
+	for _, key := range []string{
+		"daily/2026-05-26-backup.sql",
+		"daily/2026-05-26-backup.manifest.json",
+		"daily/2026-05-27-backup.sql", // written before manifests existed
+		"daily/2026-05-20-backup.manifest.json",
+		"monthly/2026-04-backup.refresh.sql",
+		"schema-only/yearly/2026-backup.sql",
+		"schema-only/yearly/2026-backup.manifest.json",
+		"daily/notes.txt",
+		"exports/users.csv",
+		"audit-log/2026-05-27T030000Z-run.json", // audit history, not a finding
+	} {
+		f.seed(key, []byte("x"), now)
+	}
+	var events []Notification
+	h := newTestHandler(f, 7)
+	h.notifier = func(_ context.Context, n Notification) error {
+		events = append(events, n)
+		return nil
+	}
+
+	res, err := h.Reconcile(context.Background(), ReconcileOptions{})
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	want := []ReconcileFinding{
+		{Key: "daily/2026-05-20-backup.manifest.json", Problem: ReconcileOrphanedSidecar},
+		{Key: "daily/2026-05-27-backup.sql", Problem: ReconcileMissingManifest},
+		{Key: "daily/notes.txt", Problem: ReconcileUnknown},
+		{Key: "exports/users.csv", Problem: ReconcileUnknown},
+		{Key: "monthly/2026-04-backup.refresh.sql", Problem: ReconcileOrphanedSidecar},
+	}
+	if len(res.Findings) != len(want) {
+		t.Fatalf("findings = %+v, want %+v", res.Findings, want)
+	}
+	for i := range want {
+		if res.Findings[i] != want[i] {
+			t.Errorf("finding %d = %+v, want %+v", i, res.Findings[i], want[i])
+		}
+	}
+	if res.Status != "mismatch" || res.Objects != 10 || res.Backups != 3 {
+		t.Errorf("status = %q, objects = %d, backups = %d; want mismatch, 10, 3", res.Status, res.Objects, res.Backups)
+	}
+	if len(events) != 1 || events[0].Event != "reconcile.mismatch" || events[0].Fields["orphaned_sidecars"] != "2" {
+		t.Errorf("notifications = %+v, want one reconcile.mismatch with 2 orphaned sidecars", events)
+	}
+	if _, ok := f.objects["monthly/2026-04-backup.refresh.sql"]; !ok {
+		t.Error("orphans should only be reported without DeleteOrphans")
+	}
+}
+
+func TestReconcileDeletesOrphans(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-20-backup.manifest.json", []byte("{}"), time.Now())
+	f.seed("daily/2026-05-26-backup.sql", []byte("x"), time.Now())
+	f.seed("daily/2026-05-26-backup.manifest.json", []byte("{}"), time.Now())
+	h := newTestHandler(f, 7)
+
+	res, err := h.Reconcile(context.Background(), ReconcileOptions{Prefix: "daily/", DeleteOrphans: true})
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if len(res.Findings) != 1 || !res.Findings[0].Deleted {
+		t.Fatalf("findings = %+v, want the orphaned manifest deleted", res.Findings)
+	}
+	if _, ok := f.objects["daily/2026-05-20-backup.manifest.json"]; ok {
+		t.Error("orphaned manifest still exists")
+	}
+	if _, ok := f.objects["daily/2026-05-26-backup.manifest.json"]; !ok {
+		t.Error("a manifest with its backup was deleted")
+	}
+
+	res, err = h.Reconcile(context.Background(), ReconcileOptions{Prefix: "daily/"})
+	if err != nil || res.Status != "ok" || len(res.Findings) != 0 {
+		t.Errorf("second pass = %+v, %v; want ok with no findings", res, err)
+	}
+}
@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestRedact(t *testing.T) {
+	RegisterSecret("hunter2!", "abc")
+	tests := []struct{ in, want string }{
+		{"pg_dump: password hunter2! rejected", "pg_dump: password [REDACTED] rejected"},
+		{"url hunter2%21 encoded", "url [REDACTED] encoded"},
+		{`parse "postgres://app:pw@db.example.com:5432/app": invalid port`, `parse "postgres://[REDACTED]@db.example.com:5432/app": invalid port`},
+		{"s3://AKIA:SECRET@bucket?region=auto", "s3://[REDACTED]@bucket?region=auto"},
+		{"host=db user=app password='a b' dbname=app", "host=db user=app password=[REDACTED] dbname=app"},
+		{"PGPASSWORD=xyz pg_dump", "PGPASSWORD=[REDACTED] pg_dump"},
+		{"x-api-key: k123", "x-api-key: [REDACTED]"},
+		// Too short to register: left alone.
+		{"abc", "abc"},
+		{`FATAL: password authentication failed for user "app"`, `FATAL: password authentication failed for user "app"`},
+		{"https://example.com/path", "https://example.com/path"},
+	}
+	for _, tt := range tests {
+		if got := Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLogfRedacts(t *testing.T) {
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(prev)
+	RegisterSecret("logf-secret-value")
+
+	logf(context.Background(), "connecting with %s", "logf-secret-value")
+	if out := buf.String(); strings.Contains(out, "logf-secret-value") || !strings.Contains(out, redacted) {
+		t.Errorf("log output %q should have the secret redacted", out)
+	}
+}
+
+func TestNotifyRedacts(t *testing.T) {
+	h := New(Config{S3: newFakeS3(), Bucket: "b", Database: DatabaseConfig{Password: "notify-db-pass"}})
+	var got Notification
+	h.notifier = func(_ context.Context, n Notification) error {
+		got = n
+		return nil
+	}
+	fields := map[string]string{"error": "auth failed for notify-db-pass"}
+	h.notify(context.Background(), Notification{Event: "x", Message: "password=notify-db-pass", Fields: fields})
+
+	if strings.Contains(got.Message, "notify-db-pass") || strings.Contains(got.Fields["error"], "notify-db-pass") {
+		t.Errorf("notification %+v leaks the database password", got)
+	}
+	if fields["error"] != "auth failed for notify-db-pass" {
+		t.Error("notify should not modify the caller's fields")
+	}
+}
+
+func TestDispatchRedactsErrors(t *testing.T) {
+	dumpErr := errors.New("pg_dump failed: connection to postgres://app:dispatch-pw@db/app refused")
+	e := eventHandler(newFakeS3(), "dispatch-api-key", failingDump(dumpErr))
+
+	_, err := e.Dispatch(context.Background(), json.RawMessage(`{}`))
+	if err == nil || strings.Contains(err.Error(), "dispatch-pw") {
+		t.Fatalf("Dispatch error = %v, want one with the password redacted", err)
+	}
+	if !errors.Is(err, dumpErr) {
+		t.Error("redacted error should still wrap the dump error")
+	}
+
+	raw, _ := json.Marshal(httpRequest(map[string]string{"x-api-key": "dispatch-api-key"}, nil))
+	out, _ := e.Dispatch(context.Background(), raw)
+	if body := out.(events.APIGatewayV2HTTPResponse).Body; strings.Contains(body, "dispatch-pw") {
+		t.Errorf("HTTP error body %s leaks the password", body)
+	}
+}
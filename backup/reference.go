@@ -0,0 +1,231 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+// referencePrefix is where the reference dumps daily backups are compressed
+// against are kept (see Config.CompressionReferenceDays), with a state object
+// per profile prefix recording which one is current.
+const referencePrefix = statePrefix + "compression-references/"
+
+// referenceMaxSize is the largest dump compressed against a reference. The
+// encoder keeps the reference and the dump in its window, and finds little of
+// a reference much larger than this anyway; larger dumps are compressed on
+// their own.
+const referenceMaxSize = 256 << 20
+
+// referenceCompression is how backups compressed against a reference are
+// stored: only zstd's best encoder searches the whole reference for matches.
+var referenceCompression = Compression{Codec: CompressionZstd, Level: 11}
+
+// referenceState is the state object of the references of one profile prefix.
+type referenceState struct {
+	Current *referenceEntry  `json:"current,omitempty"`
+	Retired []referenceEntry `json:"retired,omitempty"` // replaced references still named by a daily backup
+}
+
+// referenceEntry is one stored reference dump.
+type referenceEntry struct {
+	Key     string    `json:"key"`
+	SHA256  string    `json:"sha256"`
+	Created time.Time `json:"created"`
+}
+
+// compressionRef is the reference a run's daily backup is compressed against.
+type compressionRef struct {
+	key  string // object holding the reference dump
+	data []byte
+}
+
+// referenceStateKey is the key of the state object of the references of the
+// backups under prefix.
+func referenceStateKey(prefix string) string {
+	return referencePrefix + prefix + "state.json"
+}
+
+// compress appends data compressed against r to dst. The window spans the
+// whole reference, so matches anywhere in it are found. Frames carry no
+// dictionary id, as zstd's command line gives a raw reference none; the key
+// of the reference, named by its checksum, is what ties the two together.
+func (r *compressionRef) compress(dst, data []byte) ([]byte, error) {
+	window := min(max(1<<bits.Len(uint(len(r.data)+len(data))), zstd.MinWindowSize), zstd.MaxWindowSize)
+	enc, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(referenceCompression.Level)),
+		zstd.WithEncoderDictRaw(0, r.data),
+		zstd.WithWindowSize(window),
+		zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = enc.Close() }()
+	return enc.EncodeAll(data, dst), nil
+}
+
+// useReference sets d up to compress the daily backup at dailyKey, holding
+// data, against the current reference of the backups under prefix. A missing
+// reference, or one created CompressionReferenceDays or more ago, is replaced
+// by data itself, stored under referencePrefix with d's own compression; the
+// daily backup then shrinks to almost nothing. Replaced references are
+// deleted once no daily backup under prefix is compressed against them.
+func (h *Handler) useReference(ctx context.Context, d *compressedDump, prefix, dailyKey string, data []byte, sum string) error {
+	stateKey := referenceStateKey(prefix)
+	var st referenceState
+	if err := h.readJSON(ctx, stateKey, &st); err != nil {
+		return fmt.Errorf("failed to read %s: %w", stateKey, err)
+	}
+
+	now := h.now()
+	var ref *compressionRef
+	changed := false
+	if cur := st.Current; cur != nil && now.Sub(cur.Created) < time.Duration(h.referenceDays)*24*time.Hour {
+		body, err := h.readReference(ctx, cur.Key)
+		if err != nil {
+			return err
+		}
+		ref = &compressionRef{key: cur.Key, data: body}
+	} else {
+		key := referencePrefix + prefix + sum + ".sql"
+		if err := h.upload(ctx, key, data, sum); err != nil {
+			return fmt.Errorf("failed to store compression reference: %w", err)
+		}
+		logf(ctx, "Stored compression reference %s", key)
+		if cur != nil && cur.Key != key {
+			st.Retired = append(st.Retired, *cur)
+		}
+		st.Current = &referenceEntry{Key: key, SHA256: sum, Created: now.UTC()}
+		ref = &compressionRef{key: key, data: data}
+		changed = true
+	}
+	if n := len(st.Retired); n > 0 {
+		st.Retired = h.pruneReferences(ctx, prefix, st.Retired)
+		changed = changed || len(st.Retired) != n
+	}
+	if changed {
+		if err := h.writeJSON(ctx, stateKey, st); err != nil {
+			return fmt.Errorf("failed to write %s: %w", stateKey, err)
+		}
+	}
+	d.ref, d.refBucket, d.refFor = ref, h.bucket, dailyKey
+	return nil
+}
+
+// pruneReferences deletes the retired references no backup in the run tier
+// under prefix (see runTier), nor its latest pointer copy, names in its
+// metadata, and returns those it kept. Backups of the other tiers and
+// replicated ones are never compressed against a reference.
+func (h *Handler) pruneReferences(ctx context.Context, prefix string, retired []referenceEntry) []referenceEntry {
+	objects, err := h.listObjects(ctx, prefix+h.runTier()+"/")
+	if err == nil {
+		var latest []types.Object
+		latest, err = h.listObjects(ctx, prefix+latestCopyKey)
+		objects = append(objects, latest...)
+	}
+	if err != nil {
+		logf(ctx, "Warning: failed to list %s backups, keeping retired compression references: %v", h.runTier(), err)
+		return retired
+	}
+	inUse := map[string]bool{}
+	for _, obj := range objects {
+		key := aws.ToString(obj.Key)
+		if isSidecarKey(key) {
+			continue
+		}
+		head, err := h.headObject(ctx, key)
+		if err != nil {
+			logf(ctx, "Warning: failed to read %s, keeping retired compression references: %v", key, err)
+			return retired
+		}
+		if ref := head.Metadata["compression-reference"]; ref != "" {
+			inUse[ref] = true
+		}
+	}
+
+	var kept []referenceEntry
+	for _, old := range retired {
+		if inUse[old.Key] {
+			kept = append(kept, old)
+			continue
+		}
+		if _, err := h.s3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(h.bucket), Key: aws.String(old.Key)}); err != nil {
+			logf(ctx, "Warning: failed to delete compression reference %s: %v", old.Key, err)
+			kept = append(kept, old)
+			continue
+		}
+		logf(ctx, "Deleted compression reference %s", old.Key)
+	}
+	return kept
+}
+
+// readReference returns the reference dump stored at key, checked against its
+// recorded checksum.
+func (h *Handler) readReference(ctx context.Context, key string) ([]byte, error) {
+	head, err := h.headObject(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compression reference %s: %w", key, err)
+	}
+	body, err := h.openObject(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compression reference %s: %w", key, err)
+	}
+	defer func() { _ = body.Close() }()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compression reference %s: %w", key, err)
+	}
+	if checksum(data) != head.Metadata["sha256"] {
+		return nil, fmt.Errorf("compression reference %s does not match its checksum", key)
+	}
+	return data, nil
+}
+
+// decompressObject wraps body with the decompressor for the Compression
+// recorded in md, loading the reference it names, if any.
+func (h *Handler) decompressObject(ctx context.Context, body io.Reader, md map[string]string) (io.ReadCloser, error) {
+	key := md["compression-reference"]
+	if key == "" {
+		return decompressBody(body, md)
+	}
+	ref, err := h.readReference(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(body,
+		zstd.WithDecoderDictRaw(0, ref),
+		zstd.WithDecoderMaxWindow(zstd.MaxWindowSize),
+		zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+// readJSON decodes the JSON object at key into v, leaving v alone when there
+// is no such object.
+func (h *Handler) readJSON(ctx context.Context, key string, v any) error {
+	body, err := h.openObject(ctx, key)
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) || (err != nil && strings.Contains(err.Error(), "NoSuchKey")) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = body.Close() }()
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// evolvingDump is a dump of varied rows, the same every day, with a few rows
+// of day n appended, so consecutive days differ slightly.
+func evolvingDump(n int) []byte {
+	var b bytes.Buffer
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range 10000 {
+		fmt.Fprintf(&b, "INSERT INTO public.events VALUES (%d, '%x');\n", i, rng.Uint64())
+	}
+	for i := range 50 {
+		fmt.Fprintf(&b, "INSERT INTO public.orders VALUES (%d, %d, 'day %d');\n", n, i, n)
+	}
+	return b.Bytes()
+}
+
+func readAll(t *testing.T, h *Handler, key string) []byte {
+	t.Helper()
+	body, err := h.openObject(context.Background(), key)
+	if err != nil {
+		t.Fatalf("openObject(%s): %v", key, err)
+	}
+	defer func() { _ = body.Close() }()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("read %s: %v", key, err)
+	}
+	return data
+}
+
+func TestRunCompressesAgainstReference(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.compression = Compression{CompressionZstd, 3}
+	h.referenceDays = 7
+	ctx := context.Background()
+
+	run := func(day int) *Result {
+		t.Helper()
+		h.now = fixedClock(testNow.AddDate(0, 0, day))
+		h.dump = staticDump(evolvingDump(day))
+		res, err := h.Run(ctx, RunOptions{})
+		if err != nil {
+			t.Fatalf("Run on day %d: %v", day, err)
+		}
+		if got := readAll(t, h, res.Key); !bytes.Equal(got, evolvingDump(day)) {
+			t.Fatalf("day %d: openObject did not return the dump", day)
+		}
+		return res
+	}
+
+	first := run(0)
+	firstRef := first.Reference
+	if !strings.HasPrefix(firstRef, referencePrefix) || f.objects[firstRef] == nil {
+		t.Fatalf("reference = %q, want one stored under %s", firstRef, referencePrefix)
+	}
+	if got := f.objects[first.Key].metadata["compression-reference"]; got != firstRef {
+		t.Errorf("daily backup names reference %q, want %q", got, firstRef)
+	}
+	if md := f.objects["monthly/2026-05-backup.sql"].metadata; md["compression-reference"] != "" || md["compression-level"] != "3" {
+		t.Errorf("monthly backup metadata = %v, want it compressed on its own", md)
+	}
+	if m, _ := h.readManifest(ctx, first.Key); m == nil || m.CompressionReference != firstRef || m.Compression != referenceCompression.String() {
+		t.Errorf("manifest = %+v", m)
+	}
+
+	second := run(1)
+	plain, _ := h.compression.compress(nil, evolvingDump(1), 0)
+	if stored := len(f.objects[second.Key].body); second.Reference != firstRef || stored*10 > len(plain) {
+		t.Errorf("day 1 stored %d bytes against %q; %d compressed on its own", stored, second.Reference, len(plain))
+	}
+
+	// Past CompressionReferenceDays the day's dump becomes the reference;
+	// the old one stays while day 1's backup, not yet pruned, names it.
+	rotated := run(8)
+	if rotated.Reference == firstRef || f.objects[rotated.Reference] == nil {
+		t.Fatalf("reference after rotation = %q", rotated.Reference)
+	}
+	if f.objects[firstRef] == nil {
+		t.Fatal("a retired reference still named by a daily backup was deleted")
+	}
+	run(9)
+	if f.objects[firstRef] != nil {
+		t.Error("the retired reference should be deleted once no daily backup names it")
+	}
+}
+
+func TestRunWithoutReference(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.compression = Compression{CompressionZstd, 3}
+	h.referenceDays = 7
+	h.dump = staticDump(evolvingDump(0))
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(f.objects, res.Reference)
+
+	h.now = fixedClock(testNow.AddDate(0, 0, 1))
+	h.dump = staticDump(evolvingDump(1))
+	res, err = h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("a missing reference should not fail the run: %v", err)
+	}
+	if md := f.objects[res.Key].metadata; res.Reference != "" || md["compression-reference"] != "" || md["compression-level"] != "3" {
+		t.Errorf("reference %q, metadata %v; want the backup compressed on its own", res.Reference, md)
+	}
+}
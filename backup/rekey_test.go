@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const newKey = "arn:aws:kms:us-west-1:123:key/new"
+
+func rekeyHandler(f *fakeS3) *Handler {
+	h := New(Config{S3: f, Bucket: "b", KMSKeyID: newKey, Dump: staticDump([]byte("x"))})
+	h.now = fixedClock(testNow)
+	return h
+}
+
+func TestRekeyCopiesUnderNewKey(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-26-backup.sql", []byte("a"), testNow)
+	f.objects["daily/2026-05-26-backup.sql"].metadata["key-id"] = "arn:aws:kms:us-west-1:123:key/old"
+	f.objects["yearly/2025-backup.sql"] = archivedObject(types.StorageClassDeepArchive, nil)
+	f.objects["monthly/2026-05-backup.sql"] = &fakeObject{
+		body:     []byte("b"),
+		metadata: map[string]string{"sha256": checksum([]byte("b")), "cipher": CipherAWSKMS, "key-id": newKey},
+		sse:      types.ServerSideEncryptionAwsKms,
+	}
+	h := rekeyHandler(f)
+
+	res, err := h.Rekey(context.Background(), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Rekeyed != 1 || res.Failed != 0 || res.Status != "ok" {
+		t.Errorf("rekeyed=%d failed=%d status=%q, want 1/0/ok", res.Rekeyed, res.Failed, res.Status)
+	}
+	states := map[string]string{}
+	for _, e := range res.Entries {
+		states[e.Key] = e.State
+	}
+	want := map[string]string{
+		"daily/2026-05-26-backup.sql": RekeyDone,
+		"monthly/2026-05-backup.sql":  RekeyCurrent,
+		"yearly/2025-backup.sql":      RekeyArchived,
+	}
+	for k, v := range want {
+		if states[k] != v {
+			t.Errorf("%s: state = %q, want %q", k, states[k], v)
+		}
+	}
+
+	md := f.objects["daily/2026-05-26-backup.sql"].metadata
+	if md["key-id"] != newKey || md["sha256"] != checksum([]byte("a")) {
+		t.Errorf("metadata not rewritten correctly: %v", md)
+	}
+	if f.lastCopy.ServerSideEncryption != types.ServerSideEncryptionAwsKms {
+		t.Errorf("copy SSE = %q, want aws:kms", f.lastCopy.ServerSideEncryption)
+	}
+}
+
+func TestRekeyRequiresKMS(t *testing.T) {
+	if _, err := newTestHandler(newFakeS3(), 7).Rekey(context.Background(), ""); err == nil {
+		t.Fatal("expected error without a KMS key, got nil")
+	}
+}
+
+func TestRekeyCopyFailureIsPartial(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-26-backup.sql", []byte("a"), testNow)
+	f.copyErr = errors.New("AccessDenied")
+
+	res, err := rekeyHandler(f).Rekey(context.Background(), "daily/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Status != "partial" || res.Failed != 1 {
+		t.Errorf("status=%q failed=%d, want partial/1", res.Status, res.Failed)
+	}
+}
+
+func TestRekeyMovesBackupsToSSEC(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-26-backup.sql", []byte("a"), testNow)
+	h := New(Config{S3: f, Bucket: "b", SSECustomerKey: testCustomerKey, Dump: staticDump([]byte("x"))})
+	h.now = fixedClock(testNow)
+	ctx := context.Background()
+
+	res, err := h.Rekey(ctx, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Rekeyed != 1 || res.KeyID != h.encryption.KeyID {
+		t.Errorf("rekeyed=%d key=%q, want 1/%q", res.Rekeyed, res.KeyID, h.encryption.KeyID)
+	}
+	if obj := f.objects["daily/2026-05-26-backup.sql"]; obj.customerKey != h.encryption.KeyID || obj.metadata["cipher"] != CipherSSEC {
+		t.Errorf("object not under the customer key: %+v", obj)
+	}
+
+	// A second pass finds the backup current, reading it with the key.
+	res, err = h.Rekey(ctx, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Rekeyed != 0 || res.Entries[0].State != RekeyCurrent {
+		t.Errorf("second pass = %+v, want the backup current", res.Entries)
+	}
+}
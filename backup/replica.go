@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Replica states reported in ReplicaResult.Status.
+const (
+	ReplicaOK     = "ok"
+	ReplicaFailed = "failed"
+)
+
+// Replica is a secondary destination that receives a copy of every backup a
+// run stores: a bucket in another region or account, or any S3-compatible
+// service such as Google Cloud Storage (through its XML API) or Cloudflare R2.
+// Together with the primary bucket this lets one run keep copies on separate
+// media and sites.
+type Replica struct {
+	Name   string // label used in results, logs and notifications; "" means Bucket
+	S3     S3API  // client for the destination (required)
+	Bucket string // destination bucket (required)
+}
+
+// ReplicaResult reports how one replica fared in a run.
+type ReplicaResult struct {
+	Name   string   `json:"name"`
+	Bucket string   `json:"bucket"`
+	Status string   `json:"status"`          // ReplicaOK or ReplicaFailed
+	Keys   []string `json:"keys"`            // backups copied, in the order written
+	Error  string   `json:"error,omitempty"` // first failure, when Status is ReplicaFailed
+}
+
+// forReplica returns a copy of h that writes to r instead of the primary
+// bucket. Provider-specific encryption settings (KMS key IDs, SSE-C keys) do
+// not carry over, so replicas rely on their destination's default encryption.
+func (h *Handler) forReplica(r Replica) *Handler {
+	c := *h
+	c.s3 = r.S3
+	c.bucket = r.Bucket
+	c.encryption = encryptionFor("", nil)
+	return &c
+}
+
+// replicate copies the backups at keys (all holding data), with their
+// sidecars and the slices stored with them in the primary bucket, to every
+// configured replica in parallel. A failing replica stops
+// at its first error; it never affects the primary copy or the other
+// replicas, and it catches up on the next run that stores a backup.
+func (h *Handler) replicate(ctx context.Context, keys []string, profile string, data []byte, sum string, refresh []byte, slices []Slice) []ReplicaResult {
+	results := make([]ReplicaResult, len(h.replicas))
+	var wg sync.WaitGroup
+	for i, r := range h.replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = h.forReplica(r).replicateTo(ctx, r, h, keys, profile, data, sum, refresh, slices)
+		}()
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, res := range results {
+		if res.Status == ReplicaOK {
+			logf(ctx, "Replicated %d backup(s) to %s", len(res.Keys), res.Name)
+			continue
+		}
+		logf(ctx, "Warning: replication to %s failed: %s", res.Name, res.Error)
+		failed = append(failed, res.Name)
+	}
+	if len(failed) > 0 {
+		h.notify(ctx, Notification{
+			Event:   "backup.replica_failed",
+			Message: fmt.Sprintf("Backup (profile %s) could not be copied to %d replica(s): %s", profile, len(failed), strings.Join(failed, ", ")),
+			Fields:  map[string]string{"profile": profile, "replicas": strings.Join(failed, ",")},
+		})
+	}
+	return results
+}
+
+// replicateTo writes keys and their sidecars through h, a Handler returned by
+// forReplica for r. Slices are read back from src, the primary, one at a time.
+func (h *Handler) replicateTo(ctx context.Context, r Replica, src *Handler, keys []string, profile string, data []byte, sum string, refresh []byte, slices []Slice) ReplicaResult {
+	res := ReplicaResult{Name: r.Name, Bucket: r.Bucket, Status: ReplicaOK, Keys: []string{}}
+	if res.Name == "" {
+		res.Name = r.Bucket
+	}
+	for _, key := range keys {
+		copied, err := h.replicateSlices(ctx, src, key, slices)
+		if err == nil {
+			err = h.upload(ctx, key, data, sum)
+		}
+		if err == nil {
+			err = h.storeSidecars(ctx, key, profile, data, sum, refresh, copied)
+		}
+		if err != nil {
+			res.Status, res.Error = ReplicaFailed, fmt.Sprintf("%s: %v", key, err)
+			return res
+		}
+		res.Keys = append(res.Keys, key)
+	}
+	return res
+}
+
+// replicateSlices writes slices, read from src, next to the backup at key and
+// returns them under their names there.
+func (h *Handler) replicateSlices(ctx context.Context, src *Handler, key string, slices []Slice) ([]Slice, error) {
+	copied := slicesFor(key, slices)
+	for i, s := range slices {
+		body, err := src.openObject(ctx, s.Key)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(body)
+		_ = body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := h.upload(ctx, copied[i].Key, data, s.SHA256); err != nil {
+			return nil, err
+		}
+	}
+	return copied, nil
+}
@@ -0,0 +1,100 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func replicaHandler(primary *fakeS3, replicas ...Replica) *Handler {
+	h := New(Config{
+		S3:             primary,
+		Bucket:         "test-bucket",
+		KMSKeyID:       "arn:aws:kms:us-west-1:123:key/abc",
+		Dump:           staticDump([]byte("dump")),
+		Query:          staticQuery(nil),
+		Replicas:       replicas,
+		Notify:         func(context.Context, Notification) error { return nil },
+		ConflictPolicy: ConflictIgnore,
+	})
+	h.now = fixedClock(testNow)
+	return h
+}
+
+func TestRunCopiesBackupsToReplicas(t *testing.T) {
+	primary, gcs := newFakeS3(), newFakeS3()
+	h := replicaHandler(primary, Replica{Name: "gcs", S3: gcs, Bucket: "offsite"})
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Status != "ok" || len(res.Replicas) != 1 {
+		t.Fatalf("status=%q replicas=%+v", res.Status, res.Replicas)
+	}
+	r := res.Replicas[0]
+	if r.Name != "gcs" || r.Status != ReplicaOK || len(r.Keys) != 3 {
+		t.Errorf("replica result = %+v, want ok with daily, monthly and yearly", r)
+	}
+	for key, obj := range primary.objects {
+		copied, ok := gcs.objects[key]
+		if !ok {
+			t.Errorf("%s missing from replica", key)
+			continue
+		}
+		if key == res.Key && string(copied.body) != string(obj.body) {
+			t.Errorf("%s: replica body = %q, want %q", key, copied.body, obj.body)
+		}
+	}
+	if md := gcs.objects[res.Key].metadata; md["cipher"] != CipherNone || md["run-id"] != res.RunID {
+		t.Errorf("replica metadata = %v, want the bucket default encryption and the run id", md)
+	}
+}
+
+func TestRunReportsFailedReplicaAsPartial(t *testing.T) {
+	primary, good, bad := newFakeS3(), newFakeS3(), newFakeS3()
+	bad.putErr = errors.New("AccessDenied")
+	var events []string
+	h := replicaHandler(primary, Replica{S3: good, Bucket: "good"}, Replica{Name: "bad", S3: bad, Bucket: "bad-bucket"})
+	h.notifier = func(_ context.Context, n Notification) error {
+		events = append(events, n.Event)
+		return nil
+	}
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Status != "partial" || res.Action != "created" {
+		t.Errorf("status=%q action=%q, want partial/created", res.Status, res.Action)
+	}
+	if res.Replicas[0].Name != "good" || res.Replicas[0].Status != ReplicaOK {
+		t.Errorf("good replica = %+v", res.Replicas[0])
+	}
+	if r := res.Replicas[1]; r.Status != ReplicaFailed || r.Error == "" || len(r.Keys) != 0 {
+		t.Errorf("bad replica = %+v", r)
+	}
+	if len(events) != 1 || events[0] != "backup.replica_failed" {
+		t.Errorf("events = %v, want one backup.replica_failed", events)
+	}
+	if _, ok := primary.objects[res.Key]; !ok {
+		t.Error("primary backup missing")
+	}
+}
+
+func TestRunSkipsReplicasWhenNothingStored(t *testing.T) {
+	primary, replica := newFakeS3(), newFakeS3()
+	h := replicaHandler(primary, Replica{S3: replica, Bucket: "r"})
+	if _, err := h.Run(context.Background(), RunOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	puts := replica.puts
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Action != "skipped" || res.Replicas != nil || replica.puts != puts {
+		t.Errorf("action=%q replicas=%v puts %d -> %d, want nothing replicated", res.Action, res.Replicas, puts, replica.puts)
+	}
+}
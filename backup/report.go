@@ -0,0 +1,324 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// reportFormatVersion is the version of the Report layout written by this
+// package.
+const reportFormatVersion = 1
+
+// ReportOptions configures a Report call.
+type ReportOptions struct {
+	From       time.Time          // include backups last modified at or after From; zero means no lower bound
+	To         time.Time          // include backups last modified before To; zero means no upper bound
+	SigningKey ed25519.PrivateKey // signs the report; nil leaves it unsigned
+}
+
+// ReportVerification is one audit of a reported backup.
+type ReportVerification struct {
+	RunID  string    `json:"run_id"` // run of the Audit call
+	At     time.Time `json:"at"`     // when the audit started
+	State  string    `json:"state"`  // one of the Audit* states
+	Method string    `json:"method,omitempty"`
+}
+
+// ReportBackup describes one stored backup in a Report.
+type ReportBackup struct {
+	Key          string     `json:"key"`
+	VersionID    string     `json:"version_id,omitempty"` // S3 version of the object, when the bucket is versioned
+	Modified     time.Time  `json:"last_modified"`
+	Size         int64      `json:"size"`
+	StorageClass string     `json:"storage_class,omitempty"`
+	SHA256       string     `json:"sha256,omitempty"`                   // checksum recorded at upload time
+	LockMode     string     `json:"object_lock_mode,omitempty"`         // GOVERNANCE or COMPLIANCE; "" without Object Lock
+	RetainUntil  *time.Time `json:"object_lock_retain_until,omitempty"` // end of the Object Lock retention period
+	LegalHold    bool       `json:"object_lock_legal_hold,omitempty"`   // an Object Lock legal hold is in place
+	// Verifications lists every recorded Audit of the backup, oldest first.
+	Verifications []ReportVerification `json:"verifications"`
+	Error         string               `json:"error,omitempty"` // why the object could not be inspected
+}
+
+// locked reports whether b cannot currently be deleted or overwritten.
+func (b ReportBackup) locked(at time.Time) bool {
+	return b.LegalHold || (b.RetainUntil != nil && b.RetainUntil.After(at))
+}
+
+// Report is the evidence produced by Handler.Report: every backup in a period
+// with its checksum, Object Lock status and verification history, optionally
+// signed so it can be handed to auditors.
+type Report struct {
+	FormatVersion int            `json:"format_version"` // reportFormatVersion at write time
+	Status        string         `json:"status"`         // "ok", or "failed" when a backup's latest verification failed
+	RunID         string         `json:"run_id"`         // run identifier, also prefixed to log lines
+	Action        string         `json:"action"`         // always "report"
+	Bucket        string         `json:"bucket"`
+	GeneratedAt   time.Time      `json:"generated_at"`
+	From          *time.Time     `json:"from,omitempty"`       // start of the period, inclusive
+	To            *time.Time     `json:"to,omitempty"`         // end of the period, exclusive
+	Backups       []ReportBackup `json:"backups"`              // sorted by key
+	Locked        int            `json:"locked"`               // backups under Object Lock retention or legal hold
+	Verified      int            `json:"verified"`             // backups audited at least once
+	Failed        int            `json:"failed"`               // backups whose latest audit was "mismatch" or "truncated"
+	DurationMs    int64          `json:"duration_ms"`          // wall-clock time of the call
+	PublicKey     string         `json:"public_key,omitempty"` // base64 Ed25519 public key of the signer
+	Signature     string         `json:"signature,omitempty"`  // base64 Ed25519 signature; see VerifyReport
+}
+
+// Report lists the backups last modified in the period given by opts, with
+// the checksum recorded at upload, the version, Object Lock mode, retention
+// date and legal hold reported by S3, and every verification recorded by
+// Audit. With opts.SigningKey the report is signed over its JSON form, which
+// VerifyReport checks. Reading Object Lock settings needs the
+// s3:GetObjectRetention and s3:GetObjectLegalHold permissions; without them S3
+// omits them and backups show as unlocked.
+func (h *Handler) Report(ctx context.Context, opts ReportOptions) (*Report, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	objects, err := h.listBackups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	records, err := h.readAuditRecords(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit records: %w", err)
+	}
+	history := map[string][]ReportVerification{}
+	for _, rec := range records {
+		for _, e := range rec.Entries {
+			history[e.Key] = append(history[e.Key], ReportVerification{RunID: rec.RunID, At: rec.At, State: e.State, Method: e.Method})
+		}
+	}
+
+	report := &Report{
+		FormatVersion: reportFormatVersion,
+		Status:        "ok",
+		RunID:         runID,
+		Action:        "report",
+		Bucket:        h.bucket,
+		GeneratedAt:   start.UTC(),
+		Backups:       []ReportBackup{},
+	}
+	if !opts.From.IsZero() {
+		report.From = aws.Time(opts.From.UTC())
+	}
+	if !opts.To.IsZero() {
+		report.To = aws.Time(opts.To.UTC())
+	}
+	for _, obj := range objects {
+		key, modified := aws.ToString(obj.Key), aws.ToTime(obj.LastModified)
+		if isSidecarKey(key) || modified.Before(opts.From) || (!opts.To.IsZero() && !modified.Before(opts.To)) {
+			continue
+		}
+		b := h.reportBackup(ctx, key, modified)
+		b.Verifications = history[key]
+		if b.Verifications == nil {
+			b.Verifications = []ReportVerification{}
+		}
+		report.Backups = append(report.Backups, b)
+	}
+	sort.Slice(report.Backups, func(i, j int) bool { return report.Backups[i].Key < report.Backups[j].Key })
+
+	for _, b := range report.Backups {
+		if b.locked(report.GeneratedAt) {
+			report.Locked++
+		}
+		if n := len(b.Verifications); n > 0 {
+			report.Verified++
+			if state := b.Verifications[n-1].State; state == AuditMismatch || state == AuditTruncated {
+				report.Failed++
+			}
+		}
+	}
+	if report.Failed > 0 {
+		report.Status = "failed"
+	}
+	logf(ctx, "Report covers %d backups: %d locked, %d verified, %d failed", len(report.Backups), report.Locked, report.Verified, report.Failed)
+	report.DurationMs = h.elapsed(start)
+
+	if opts.SigningKey != nil {
+		if err := report.sign(opts.SigningKey); err != nil {
+			return nil, fmt.Errorf("failed to sign report: %w", err)
+		}
+	}
+	return report, nil
+}
+
+// reportBackup describes the backup at key from its metadata. A HeadObject
+// failure is recorded in the entry rather than failing the report.
+func (h *Handler) reportBackup(ctx context.Context, key string, modified time.Time) ReportBackup {
+	b := ReportBackup{Key: key, Modified: modified.UTC()}
+	head, err := h.headObject(ctx, key)
+	if err != nil {
+		b.Error = err.Error()
+		logf(ctx, "Warning: cannot inspect %s: %v", key, err)
+		return b
+	}
+	b.VersionID = aws.ToString(head.VersionId)
+	b.Size = aws.ToInt64(head.ContentLength)
+	b.StorageClass = string(head.StorageClass)
+	b.SHA256 = head.Metadata["sha256"]
+	b.LockMode = string(head.ObjectLockMode)
+	if head.ObjectLockRetainUntilDate != nil {
+		b.RetainUntil = aws.Time(head.ObjectLockRetainUntilDate.UTC())
+	}
+	b.LegalHold = head.ObjectLockLegalHoldStatus == types.ObjectLockLegalHoldStatusOn
+	return b
+}
+
+// signedBytes returns the bytes r's signature covers: its JSON encoding
+// without the signature itself.
+func (r Report) signedBytes() ([]byte, error) {
+	r.Signature = ""
+	return json.Marshal(r)
+}
+
+// sign records key's public half in r and signs it.
+func (r *Report) sign(key ed25519.PrivateKey) error {
+	r.PublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	msg, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, msg))
+	return nil
+}
+
+// VerifyReport parses a report in its JSON form and checks its signature
+// against the public key it carries. A valid signature proves the report is
+// unchanged since it was signed; callers must still check that PublicKey is
+// the key the operator published.
+func VerifyReport(data []byte) (*Report, error) {
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid report: %w", err)
+	}
+	if r.FormatVersion > reportFormatVersion {
+		return nil, fmt.Errorf("report format version %d is newer than this tool supports (%d)", r.FormatVersion, reportFormatVersion)
+	}
+	if r.Signature == "" {
+		return nil, errors.New("report is not signed")
+	}
+	pub, err := base64.StdEncoding.DecodeString(r.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("report has an invalid public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return nil, errors.New("report has an invalid signature")
+	}
+	msg, err := r.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(pub, msg, sig) {
+		return nil, errors.New("report signature does not match its contents")
+	}
+	return &r, nil
+}
+
+// ParseSigningKey decodes a base64 Ed25519 private key, given either as its
+// 32-byte seed (as printed by `openssl rand -base64 32`) or in the 64-byte
+// form, and registers it as a secret.
+func ParseSigningKey(s string) (ed25519.PrivateKey, error) {
+	RegisterSecret(s)
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.New("signing key is not valid base64")
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("signing key is %d bytes, want a %d-byte seed or %d-byte private key", len(raw), ed25519.SeedSize, ed25519.PrivateKeySize)
+}
+
+// WriteText writes r in human-readable form to w. The signature printed at
+// the end covers the JSON form, not this text.
+func (r *Report) WriteText(w io.Writer) error {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "Backup immutability report")
+	fmt.Fprintf(&b, "Bucket:     %s\n", r.Bucket)
+	fmt.Fprintf(&b, "Period:     %s to %s\n", reportBound(r.From, "the first backup"), reportBound(r.To, "now"))
+	fmt.Fprintf(&b, "Generated:  %s [run %s]\n", r.GeneratedAt.Format(time.RFC3339), r.RunID)
+	fmt.Fprintf(&b, "Backups:    %d (%d under Object Lock, %d verified, %d failed verification)\n", len(r.Backups), r.Locked, r.Verified, r.Failed)
+
+	for _, bk := range r.Backups {
+		fmt.Fprintf(&b, "\n%s\n", bk.Key)
+		if bk.Error != "" {
+			fmt.Fprintf(&b, "  error        %s\n", bk.Error)
+			continue
+		}
+		if bk.VersionID != "" {
+			fmt.Fprintf(&b, "  version      %s\n", bk.VersionID)
+		}
+		fmt.Fprintf(&b, "  modified     %s\n", bk.Modified.Format(time.RFC3339))
+		fmt.Fprintf(&b, "  size         %s\n", HumanizeSize(int(bk.Size)))
+		fmt.Fprintf(&b, "  sha256       %s\n", orNone(bk.SHA256))
+		fmt.Fprintf(&b, "  object lock  %s\n", lockSummary(bk))
+		if len(bk.Verifications) == 0 {
+			fmt.Fprintln(&b, "  verified     never")
+		}
+		for _, v := range bk.Verifications {
+			fmt.Fprintf(&b, "  verified     %s %s (%s) [run %s]\n", v.At.Format(time.RFC3339), v.State, orNone(v.Method), v.RunID)
+		}
+	}
+
+	if r.Signature == "" {
+		fmt.Fprintln(&b, "\nUnsigned.")
+	} else {
+		fmt.Fprintf(&b, "\nSigned with Ed25519 public key %s\nSignature %s\n", r.PublicKey, r.Signature)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// reportBound formats a period bound, or returns open for an unbounded one.
+func reportBound(t *time.Time, open string) string {
+	if t == nil {
+		return open
+	}
+	return t.Format(time.RFC3339)
+}
+
+// lockSummary describes b's Object Lock status in a line.
+func lockSummary(bk ReportBackup) string {
+	var parts []string
+	if bk.LockMode != "" {
+		until := "without a retention date"
+		if bk.RetainUntil != nil {
+			until = "until " + bk.RetainUntil.Format(time.RFC3339)
+		}
+		parts = append(parts, bk.LockMode+" "+until)
+	}
+	if bk.LegalHold {
+		parts = append(parts, "legal hold")
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// orNone returns s, or "none" when it is empty.
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
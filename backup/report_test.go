@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// reportFixture is a bucket with a locked and an unlocked daily backup, an
+// older monthly backup and one recorded audit.
+func reportFixture(t *testing.T) (*fakeS3, *Handler) {
+	t.Helper()
+	f := newFakeS3()
+	f.seed("daily/2026-05-26-backup.sql", []byte("locked"), testNow.Add(-24*time.Hour))
+	f.seed("daily/2026-05-26-backup.manifest.json", []byte("{}"), testNow.Add(-24*time.Hour))
+	f.seed("daily/2026-05-27-backup.sql", []byte("unlocked"), testNow)
+	f.seed("monthly/2026-04-backup.sql", []byte("older"), testNow.AddDate(0, -1, 0))
+	locked := f.objects["daily/2026-05-26-backup.sql"]
+	locked.versionID = "v1"
+	locked.lockMode = types.ObjectLockModeCompliance
+	locked.retainUntil = aws.Time(testNow.AddDate(1, 0, 0))
+	locked.legalHold = types.ObjectLockLegalHoldStatusOn
+
+	h := newTestHandler(f, 7)
+	if err := h.writeAuditRecord(context.Background(), auditRecord{RunID: "audit-1", At: testNow.Add(-time.Hour), Entries: []AuditEntry{
+		{Key: "daily/2026-05-26-backup.sql", State: AuditOK, Method: AuditMethodFull},
+		{Key: "monthly/2026-04-backup.sql", State: AuditMismatch, Method: AuditMethodFull},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	return f, h
+}
+
+func TestReport(t *testing.T) {
+	_, h := reportFixture(t)
+
+	r, err := h.Report(context.Background(), ReportOptions{})
+	if err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	if len(r.Backups) != 3 || r.Locked != 1 || r.Verified != 2 || r.Failed != 1 || r.Status != "failed" || r.Action != "report" {
+		t.Fatalf("report = %+v, want 3 backups, 1 locked, 2 verified, 1 failed", r)
+	}
+	b := r.Backups[0]
+	if b.Key != "daily/2026-05-26-backup.sql" || b.VersionID != "v1" || b.LockMode != "COMPLIANCE" || !b.LegalHold ||
+		b.RetainUntil == nil || b.SHA256 != checksum([]byte("locked")) || b.Size != 6 {
+		t.Errorf("locked backup = %+v", b)
+	}
+	if len(b.Verifications) != 1 || b.Verifications[0].RunID != "audit-1" || b.Verifications[0].State != AuditOK {
+		t.Errorf("verifications = %+v, want the recorded audit", b.Verifications)
+	}
+	if r.Backups[1].Verifications == nil || len(r.Backups[1].Verifications) != 0 {
+		t.Errorf("unaudited backup verifications = %#v, want an empty list", r.Backups[1].Verifications)
+	}
+	if r.Signature != "" {
+		t.Error("report without a signing key should be unsigned")
+	}
+}
+
+func TestReportPeriod(t *testing.T) {
+	_, h := reportFixture(t)
+
+	r, err := h.Report(context.Background(), ReportOptions{From: testNow.AddDate(0, 0, -7), To: testNow})
+	if err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	if len(r.Backups) != 1 || r.Backups[0].Key != "daily/2026-05-26-backup.sql" {
+		t.Errorf("backups = %+v, want only the one modified inside the period", r.Backups)
+	}
+	if r.From == nil || r.To == nil || !r.To.Equal(testNow) {
+		t.Errorf("period = %v..%v", r.From, r.To)
+	}
+}
+
+func TestReportSignature(t *testing.T) {
+	_, h := reportFixture(t)
+	seed := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+	key, err := ParseSigningKey(base64.StdEncoding.EncodeToString(seed))
+	if err != nil {
+		t.Fatalf("ParseSigningKey: %v", err)
+	}
+
+	r, err := h.Report(context.Background(), ReportOptions{SigningKey: key})
+	if err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	data, _ := json.MarshalIndent(r, "", "  ")
+	got, err := VerifyReport(data)
+	if err != nil {
+		t.Fatalf("VerifyReport: %v", err)
+	}
+	if got.PublicKey != base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)) || len(got.Backups) != 3 {
+		t.Errorf("verified report = %+v", got)
+	}
+
+	tampered := bytes.Replace(data, []byte(`"state": "mismatch"`), []byte(`"state": "ok"`), 1)
+	if _, err := VerifyReport(tampered); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("VerifyReport(tampered) = %v, want a signature mismatch", err)
+	}
+	r.Signature = ""
+	unsigned, _ := json.Marshal(r)
+	if _, err := VerifyReport(unsigned); err == nil {
+		t.Error("VerifyReport should reject an unsigned report")
+	}
+}
+
+func TestParseSigningKey(t *testing.T) {
+	full := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	if key, err := ParseSigningKey(base64.StdEncoding.EncodeToString(full)); err != nil || !key.Equal(full) {
+		t.Errorf("64-byte key: %v", err)
+	}
+	for _, bad := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseSigningKey(bad); err == nil {
+			t.Errorf("ParseSigningKey(%q) should fail", bad)
+		}
+	}
+}
+
+func TestReportWriteText(t *testing.T) {
+	_, h := reportFixture(t)
+	r, err := h.Report(context.Background(), ReportOptions{})
+	if err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"Backups:    3 (1 under Object Lock, 2 verified, 1 failed verification)",
+		"object lock  COMPLIANCE until 2027-05-27T12:00:00Z, legal hold",
+		"verified     2026-05-27T11:00:00Z ok (full) [run audit-1]",
+		"verified     never",
+		"Unsigned.",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("text report missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// BackupQuery selects a stored backup by tier and time rather than by key,
+// for restores such as "the latest monthly backup" (see ResolveBackup).
+type BackupQuery struct {
+	Prefix string    // profile or tenant prefix, e.g. "tenants/acme/"; "" means the default profile
+	Tier   string    // "hourly", "daily", "monthly" or "yearly"; "" means any
+	AsOf   time.Time // select the newest backup stored at or before this time; zero means the newest
+}
+
+// tierOrder is the order in which ResolveBackup prefers tiers holding
+// backups stored at the same time, as a daily backup and its monthly copy.
+var tierOrder = []string{"hourly", "daily", "monthly", "yearly"}
+
+// ResolveBackup returns the key of the newest backup q selects, going by
+// when each was stored. Keys are listed under each tier and parsed as
+// backupKey names them, in either layout, so sidecars and other objects are
+// never selected.
+func (h *Handler) ResolveBackup(ctx context.Context, q BackupQuery) (string, error) {
+	if _, ok := backupTiers[q.Tier]; q.Tier != "" && !ok {
+		return "", invalidInput(fmt.Errorf("unknown tier %q", q.Tier))
+	}
+	var best string
+	var bestTime time.Time
+	for _, tier := range tierOrder {
+		if q.Tier != "" && tier != q.Tier {
+			continue
+		}
+		objects, err := h.listObjects(ctx, q.Prefix+tier+"/")
+		if err != nil {
+			return "", fmt.Errorf("failed to list %s%s/: %w", q.Prefix, tier, err)
+		}
+		for _, obj := range objects {
+			key, stored := aws.ToString(obj.Key), aws.ToTime(obj.LastModified)
+			name, ok := tierName(tier, strings.TrimPrefix(key, q.Prefix+tier+"/"))
+			if !ok || isSidecarKey(key) || !q.AsOf.IsZero() && stored.After(q.AsOf) {
+				continue
+			}
+			if _, err := time.Parse(backupTiers[tier].layout, strings.TrimSuffix(plainKey(name), "-backup.sql")); err != nil {
+				continue
+			}
+			if best == "" || stored.After(bestTime) {
+				best, bestTime = key, stored
+			}
+		}
+	}
+	if best == "" {
+		return "", invalidInput(fmt.Errorf("found no %s", q))
+	}
+	logf(ctx, "Resolved the %s to %s, stored %s", q, best, bestTime.UTC().Format(time.RFC3339))
+	return best, nil
+}
+
+// String describes q for logs, e.g. "latest monthly backup under
+// tenants/acme/ as of 2026-05-20T23:59:59Z".
+func (q BackupQuery) String() string {
+	s := "latest backup"
+	if q.Tier != "" {
+		s = "latest " + q.Tier + " backup"
+	}
+	if q.Prefix != "" {
+		s += " under " + q.Prefix
+	}
+	if !q.AsOf.IsZero() {
+		s += " as of " + q.AsOf.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// ParseAsOf parses the time a BackupQuery selects backups as of: an RFC 3339
+// timestamp, or a date (YYYY-MM-DD), meaning the end of that day in UTC so
+// the day's own backups are included.
+func ParseAsOf(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	day, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("want a date (YYYY-MM-DD) or an RFC 3339 time, got %q", s)
+	}
+	return day.Add(24*time.Hour - time.Second), nil
+}
@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestResolveBackup(t *testing.T) {
+	f := newFakeS3()
+	day := func(d int) time.Time { return time.Date(2026, 5, d, 3, 0, 0, 0, time.UTC) }
+	f.seed("daily/2026-05-25-backup.sql", []byte("dump"), day(25))
+	f.seed("daily/2026-05-26-backup.sql.gz", []byte("dump"), day(26))
+	f.seed(manifestKey("daily/2026-05-26-backup.sql"), []byte("{}"), day(27)) // sidecars are never picked
+	f.seed("daily/notes.txt", []byte("stray"), day(27))
+	f.seed("monthly/2026-04-backup.sql", []byte("dump"), day(1).AddDate(0, -1, 0))
+	f.seed("monthly/2026-05-backup.sql", []byte("dump"), day(25)) // copied with the daily backup of the 25th
+	f.seed("tenants/acme/daily/2026-05-20-backup.sql", []byte("dump"), day(20))
+	h := newTestHandler(f, 7)
+
+	for _, c := range []struct {
+		q    BackupQuery
+		want string
+	}{
+		{BackupQuery{}, "daily/2026-05-26-backup.sql.gz"},
+		{BackupQuery{Tier: "monthly"}, "monthly/2026-05-backup.sql"},
+		{BackupQuery{AsOf: day(25)}, "daily/2026-05-25-backup.sql"}, // before its monthly copy
+		{BackupQuery{Tier: "monthly", AsOf: day(24)}, "monthly/2026-04-backup.sql"},
+		{BackupQuery{Prefix: "tenants/acme/"}, "tenants/acme/daily/2026-05-20-backup.sql"},
+	} {
+		got, err := h.ResolveBackup(context.Background(), c.q)
+		if err != nil || got != c.want {
+			t.Errorf("ResolveBackup(%s) = %q, %v; want %q", c.q, got, err, c.want)
+		}
+	}
+	for _, q := range []BackupQuery{{Tier: "weekly"}, {Tier: "yearly"}, {AsOf: day(1).AddDate(0, -2, 0)}} {
+		if key, err := h.ResolveBackup(context.Background(), q); err == nil || failureClass(err) != ClassInvalid {
+			t.Errorf("ResolveBackup(%s) = %q, %v; want an invalid input error", q, key, err)
+		}
+	}
+}
+
+func TestParseAsOf(t *testing.T) {
+	for in, want := range map[string]time.Time{
+		"2026-05-20":                time.Date(2026, 5, 20, 23, 59, 59, 0, time.UTC),
+		"2026-05-20T14:00:00+02:00": time.Date(2026, 5, 20, 12, 0, 0, 0, time.UTC),
+	} {
+		if got, err := ParseAsOf(in); err != nil || !got.Equal(want) {
+			t.Errorf("ParseAsOf(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseAsOf("yesterday"); err == nil {
+		t.Error("ParseAsOf(yesterday) should fail")
+	}
+}
+
+func TestDispatchRestoreLatest(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-26-backup.sql", []byte("daily"), testNow.AddDate(0, 0, -1))
+	f.seed("monthly/2026-05-backup.sql", []byte("monthly"), testNow.AddDate(0, 0, -2))
+	var calls []restoreCall
+	e := eventHandler(f, "", staticDump([]byte("dump")))
+	e.handler.restore = recordingRestorer(&calls, func(string) RestoreStats { return RestoreStats{} })
+
+	out, err := e.Dispatch(context.Background(), json.RawMessage(`{"action":"restore","latest_tier":"monthly","target":"postgres://app@staging/app"}`))
+	if err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	if res := out.(*RestoreResult); res.Key != "monthly/2026-05-backup.sql" || len(calls) != 1 || calls[0].body != "monthly" {
+		t.Errorf("result = %+v, calls = %+v", res, calls)
+	}
+	if _, err := e.Dispatch(context.Background(), json.RawMessage(`{"action":"restore","key":"daily/2026-05-26-backup.sql","latest":true,"target":"postgres://app@staging/app"}`)); err == nil || failureClass(err) != ClassInvalid {
+		t.Errorf("key and latest: err = %v, want an invalid input error", err)
+	}
+}
@@ -0,0 +1,840 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RestoreOptions configures Restore.
+type RestoreOptions struct {
+	Target DatabaseConfig // database restored into (required); never the one backed up
+	// Jobs is the number of tables pg_restore loads at once from a
+	// directory- or custom-format backup, each over its own connection; 0
+	// means Config.RestoreJobs, and 1 loads one at a time. A custom-format
+	// archive is then downloaded to WorkDir first, since pg_restore needs
+	// to seek in it. Plain scripts are loaded in one session.
+	Jobs int
+	// ExitOnError stops the restore at the first failing statement; by
+	// default failures are counted and the restore goes on, as psql and
+	// pg_restore do.
+	ExitOnError bool
+	// SingleTransaction loads each script or archive in one transaction,
+	// so that a failing statement rolls it back; it implies ExitOnError
+	// and cannot be combined with Jobs, or with Schema, which has a
+	// transaction of its own.
+	SingleTransaction bool
+	// DisableTriggers keeps triggers and foreign keys from firing while
+	// data is loaded into tables that have them already, as table slices
+	// are, and the data section of a restore by Sections: psql runs with
+	// session_replication_role set to replica, and pg_restore with
+	// --disable-triggers. It needs a superuser as Target's user.
+	DisableTriggers bool
+	// WorkDir is where a directory-format backup is unpacked, or a
+	// custom-format one downloaded for Jobs, for pg_restore; "" means the
+	// dump's DumpOptions.WorkDir.
+	WorkDir string
+	// AllowDifferentSource restores a backup whose database name differs
+	// from Target's, or that was not taken from the database the Handler
+	// backs up (see sourceMismatch), which is otherwise refused.
+	AllowDifferentSource bool
+	// AllowUnsigned restores a backup whose manifest is unsigned or
+	// missing, which is otherwise refused when manifests are signed (see
+	// ManifestSigner); backups stored before signing was enabled need it.
+	AllowUnsigned bool
+	// Confirm is the name of Target's database, typed back by whoever
+	// asked for the restore. A restore into a database Config.RestoreTargets
+	// does not match is refused without it, and any restore with another
+	// name, so a restore meant for one database cannot drop another.
+	Confirm string
+	// CreateTarget creates Target's database before restoring into it,
+	// connected to the "postgres" database of its server, and refuses to
+	// restore when it exists already. It is copied from CreateTemplate
+	// when set, and owned by CreateOwner when set, else by Target's user.
+	CreateTarget   bool
+	CreateTemplate string
+	CreateOwner    string
+	// Schema restores only that schema, from a backup of it alone such as
+	// a tenant's of TenantRegistry.Schemas, into Target as it exists: the
+	// schema is dropped and recreated in one transaction, and the rest of
+	// the database is left alone (see checkSchemaRestore). The database
+	// backed up can then be the target, with Confirm. Extension steps are
+	// not run.
+	Schema string
+	// DryRun reads the backup as a restore would, decrypted and
+	// decompressed, checks that it is complete and lists the objects it
+	// would create, without connecting to Target or restoring anything.
+	// The Restorer reads the dump with DryRun set (see scanScript).
+	DryRun bool
+	// Sections restores a custom- or directory-format archive one section
+	// at a time, pre-data, data and post-data, each read from the bucket
+	// again, and records each section and table slice restored in the
+	// bucket (see restoreCheckpoint). A restore that fails, while building
+	// the indexes of post-data say, is then resumed with Resume, which
+	// skips what was recorded instead of loading the data again; Resume
+	// implies Sections. The extensions' steps and the materialized view
+	// refresh run again.
+	Sections bool
+	Resume   bool
+	// Progress, when set, is called with the restore's progress every
+	// Config.RestoreProgressInterval, as it is logged.
+	Progress func(RestoreProgress)
+
+	// onEntry is called by the Restorer with each TOC entry it starts
+	// restoring (see progressTracker.entry).
+	onEntry func(entry string)
+	// section, when set, is the one section of an archive the Restorer
+	// restores, as pg_restore --section names it.
+	section string
+}
+
+// RestoreStats is what a Restorer reports of one script or archive.
+type RestoreStats struct {
+	Tables int   `json:"tables"` // tables whose data was loaded
+	Rows   int64 `json:"rows"`   // rows loaded by COPY and INSERT; not counted when pg_restore loads the backup itself
+	Errors int   `json:"errors"` // statements that failed
+	// FirstErrors are the messages of the first maxRestoreErrors failures,
+	// redacted.
+	FirstErrors []string `json:"first_errors,omitempty"`
+}
+
+// add adds the counts of other to s.
+func (s *RestoreStats) add(other RestoreStats) {
+	s.Tables += other.Tables
+	s.Rows += other.Rows
+	s.Errors += other.Errors
+	for _, msg := range other.FirstErrors {
+		if len(s.FirstErrors) < maxRestoreErrors {
+			s.FirstErrors = append(s.FirstErrors, msg)
+		}
+	}
+}
+
+// maxRestoreErrors bounds RestoreStats.FirstErrors.
+const maxRestoreErrors = 5
+
+// Restorer loads a dump of the given format (FormatPlain for any SQL script)
+// read from r into db. Failing statements are counted unless
+// opts.ExitOnError, which makes the first one fail the restore. With
+// opts.DryRun it reads the dump through without connecting to db. The
+// default implementation is PgRestore; tests inject their own.
+type Restorer func(ctx context.Context, db DatabaseConfig, format string, r io.Reader, opts RestoreOptions) (RestoreStats, error)
+
+// RestoreResult summarizes a Restore call.
+type RestoreResult struct {
+	Status  string `json:"status"` // "ok", or "partial" when statements or checks failed or the restore was not recorded
+	RunID   string `json:"run_id"` // run identifier, also prefixed to log lines
+	Action  string `json:"action"` // always "restore"
+	Key     string `json:"key"`    // backup restored
+	Target  string `json:"target"` // host:port/database restored into
+	Format  string `json:"format,omitempty"`
+	Scripts int    `json:"scripts"` // scripts run besides the backup: slices, extension steps and the matview refresh
+	// Mismatch is why the backup's source differs from the target, when
+	// it was restored with AllowDifferentSource.
+	Mismatch string `json:"source_mismatch,omitempty"`
+	// Signature is the Signature state of the backup's manifest when
+	// manifests are signed: "valid", or "unsigned" with AllowUnsigned.
+	Signature string `json:"signature,omitempty"`
+	// Migrations is the migration state stored with the backup (see
+	// MigrationState), for reconciling the target with the application's
+	// migration tool; it is not applied.
+	Migrations string `json:"migrations_key,omitempty"`
+	// Created says the target database was created for the restore (see
+	// RestoreOptions.CreateTarget).
+	Created bool `json:"created,omitempty"`
+	// Schema is the one schema restored (see RestoreOptions.Schema).
+	Schema string `json:"schema,omitempty"`
+	// Resumed are the steps skipped, restored by an earlier restore that
+	// failed (see RestoreOptions.Resume).
+	Resumed []string `json:"resumed_steps,omitempty"`
+	// DryRun says nothing was restored (see RestoreOptions.DryRun). The
+	// backup then holds ObjectCount objects, the first maxDryRunObjects of
+	// them listed in Objects, as "<type> <schema>.<name>", and would take
+	// about EstimatedMs to restore at the rate of the latest restores.
+	DryRun      bool     `json:"dry_run,omitempty"`
+	Objects     []string `json:"objects,omitempty"`
+	ObjectCount int      `json:"object_count,omitempty"`
+	EstimatedMs int64    `json:"estimated_ms,omitempty"`
+	// Checks are the results of Config.RestoreChecks, run once the
+	// backup is loaded; ChecksFailed of them did not pass.
+	Checks       []RestoreCheckResult `json:"checks,omitempty"`
+	ChecksFailed int                  `json:"checks_failed,omitempty"`
+	RestoreStats
+	Bytes      int64 `json:"bytes"`       // dump and script bytes loaded
+	DurationMs int64 `json:"duration_ms"` // wall-clock time of the call, the recovery time
+	// RTOObjectiveMs and RTOMet say whether the restore met
+	// Config.RTOObjective, when one is set.
+	RTOObjectiveMs int64 `json:"rto_objective_ms,omitempty"`
+	RTOMet         *bool `json:"rto_met,omitempty"`
+	// Record is where the restore's RestoreRecord is stored, or RecordErr
+	// why it could not be.
+	Record    string `json:"record_key,omitempty"`
+	RecordErr string `json:"record_error,omitempty"`
+}
+
+// Restore loads the backup stored at key into opts.Target, streaming it from
+// the bucket without holding it in memory: plain scripts through psql,
+// custom-format archives through pg_restore into psql, and directory-format
+// backups unpacked to disk and loaded by pg_restore with opts.Jobs, as
+// custom-format ones are when opts.Jobs is set. For the backups whose
+// manifest lists them, the extensions' pre-restore steps run first (in the
+// same session as a plain script), and the table slices, the extensions'
+// post-restore steps and the materialized view refresh script run after it,
+// in that order. Restoring into the database the Handler backs up is
+// refused, since the dump drops what it recreates, and so is restoring into
+// one Config.RestoreTargets does not match, unless its name is given as
+// opts.Confirm. So is restoring a backup of another database than the
+// target's name or the Handler's source, unless opts.AllowDifferentSource
+// (see sourceMismatch). The configured RestoreChecks run last. With
+// opts.CreateTarget, the target database is created first (see
+// createDatabase). When manifests are signed, a manifest whose signature
+// does not verify fails the restore, and an unsigned or missing one is
+// refused unless opts.AllowUnsigned. Progress through the dump is logged as
+// it loads (see progressTracker), and each completed restore is recorded
+// with its recovery time (see recordRestore). opts.DryRun only reads the
+// backup through. With opts.Schema, only that schema is restored (see
+// checkSchemaRestore), into the database backed up too once confirmed. With
+// opts.Sections, an archive is restored section by section, each step
+// completed checkpointed so that opts.Resume goes on after it.
+func (h *Handler) Restore(ctx context.Context, key string, opts RestoreOptions) (*RestoreResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	target := opts.Target
+	switch {
+	case key == "" || !isBackupKey(key) || isSidecarKey(key):
+		return nil, invalidInput(fmt.Errorf("%q is not a backup key", key))
+	case target.Host == "":
+		return nil, invalidInput(errors.New("restore needs a target database"))
+	case sameDatabase(target, h.db) && (opts.Schema == "" || opts.Confirm == ""):
+		if opts.Schema != "" {
+			return nil, invalidInput(fmt.Errorf("refusing to restore schema %s into %s, the database backed up, unless its name is confirmed (-confirm %s, or confirm when invoked)", opts.Schema, connName(target), target.Database))
+		}
+		return nil, invalidInput(fmt.Errorf("refusing to restore into %s, the database backed up", connName(target)))
+	case opts.Schema != "" && opts.CreateTarget:
+		return nil, invalidInput(errors.New("a schema is restored into an existing database, not one created for it"))
+	case opts.SingleTransaction && opts.Jobs > 1:
+		return nil, invalidInput(errors.New("a restore in a single transaction loads one table at a time, not with jobs"))
+	case opts.SingleTransaction && opts.Schema != "":
+		return nil, invalidInput(errors.New("a schema is restored in a transaction of its own, not with single transaction"))
+	case opts.Confirm != "" && opts.Confirm != target.Database:
+		return nil, invalidInput(fmt.Errorf("refusing to restore into %s: confirmed database %q is not %q", connName(target), opts.Confirm, target.Database))
+	case h.restoreTargets != nil && !h.restoreTargets.MatchString(target.Database) && opts.Confirm == "":
+		return nil, invalidInput(fmt.Errorf("refusing to restore into %s: %q does not match RESTORE_TARGETS; confirm its name (-confirm %s, or confirm when invoked) to restore into it anyway", connName(target), target.Database, target.Database))
+	}
+	RegisterSecret(target.Password)
+	target = h.targetConn(target)
+	opts.WorkDir = cmp.Or(opts.WorkDir, h.dumpOpts.WorkDir)
+	if opts.SingleTransaction {
+		opts.ExitOnError = true
+	} else {
+		opts.Jobs = cmp.Or(opts.Jobs, h.restoreJobs)
+	}
+
+	manifest, err := h.readManifest(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		manifest = &Manifest{}
+		if h.signer != nil {
+			manifest.signature = SignatureUnsigned
+		}
+	}
+	if manifest.signature == SignatureUnsigned {
+		if !opts.AllowUnsigned {
+			return nil, invalidInput(fmt.Errorf("refusing to restore %s: its manifest is unsigned or missing; allow unsigned manifests (-allow-unsigned, or allow_unsigned when invoked) to restore it anyway", key))
+		}
+		logf(ctx, "Warning: restoring %s although its manifest is unsigned", key)
+	}
+	mismatch, err := h.sourceMismatch(ctx, key, manifest, target)
+	if err != nil {
+		return nil, err
+	}
+	if mismatch != "" {
+		if !opts.AllowDifferentSource {
+			return nil, invalidInput(fmt.Errorf("refusing to restore %s into %s: %s; allow a different source (-allow-different-source, or allow_different_source when invoked) to restore it anyway", key, connName(target), mismatch))
+		}
+		logf(ctx, "Warning: restoring %s although %s", key, mismatch)
+	}
+	if opts.Schema != "" {
+		if err := h.checkSchemaRestore(ctx, key, opts.Schema); err != nil {
+			return nil, err
+		}
+		// Any failed statement rolls the schema back.
+		opts.ExitOnError = true
+	}
+	var ck *restoreCheckpoint
+	if (opts.Sections || opts.Resume) && !opts.DryRun {
+		if ck, err = h.openCheckpoint(ctx, key, target, opts.Resume); err != nil {
+			return nil, err
+		}
+	}
+	body, err := h.openObject(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer func() { _ = body.Close() }()
+	r := bufio.NewReader(body)
+	head, _ := r.Peek(tarBlockSize + len(archiveMagic))
+	format := dumpFormat(head)
+	if ck != nil && format != FormatCustom && format != FormatDirectory {
+		return nil, invalidInput(fmt.Errorf("%s is a SQL script; only custom- and directory-format archives are restored by section", key))
+	}
+	// A resumed restore's database was created by the restore it resumes.
+	created := opts.CreateTarget && !opts.DryRun && (ck == nil || !ck.stored)
+	if created {
+		if err := h.createDatabase(ctx, target, opts.CreateTemplate, opts.CreateOwner); err != nil {
+			return nil, err
+		}
+	}
+	total := manifest.Size
+	if ck != nil {
+		total = 0
+		for _, section := range restoreSections {
+			if !ck.done(section) {
+				total += manifest.Size
+			}
+		}
+	}
+	progress := h.newProgressTracker(ctx, key, total, start, opts.Progress)
+	opts.onEntry = progress.entry
+
+	result := &RestoreResult{Status: "ok", RunID: runID, Action: "restore", Key: key, Target: connName(target), Format: format, Mismatch: mismatch, Signature: manifest.signature, Created: created, Schema: opts.Schema, DryRun: opts.DryRun}
+	if opts.DryRun {
+		opts.onEntry = func(entry string) {
+			progress.entry(entry)
+			if result.ObjectCount++; len(result.Objects) < maxDryRunObjects {
+				result.Objects = append(result.Objects, entry)
+			}
+		}
+	}
+	restore := func(what, format string, r io.Reader) error {
+		counter := &countingReader{r: r}
+		stats, err := h.restore(ctx, target, format, counter, opts)
+		result.add(stats)
+		result.Bytes += counter.n
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", what, err)
+		}
+		return nil
+	}
+
+	var pre, post []string
+	for _, s := range manifest.ExtensionSteps {
+		if opts.Schema == "" {
+			pre = append(pre, s.PreRestore...)
+			post = append(post, s.PostRestore...)
+		}
+	}
+	if opts.DryRun {
+		logf(ctx, "Dry run: reading %s (%s format) as a restore into %s would", key, cmp.Or(format, "plain"), result.Target)
+	} else {
+		logf(ctx, "Restoring %s (%s format) into %s", key, cmp.Or(format, "plain"), result.Target)
+	}
+	dump := progress.reader(r)
+	tail := &tailWriter{}
+	if opts.DryRun && format == FormatPlain {
+		dump = io.TeeReader(dump, tail)
+	}
+	if opts.Schema != "" {
+		before, after := schemaRestoreScripts(opts.Schema)
+		dump = io.MultiReader(strings.NewReader(before), dump, strings.NewReader(after))
+		logf(ctx, "Restoring only schema %s, dropped and recreated", opts.Schema)
+	}
+	if len(pre) > 0 {
+		if format == FormatPlain {
+			dump = io.MultiReader(strings.NewReader(strings.Join(pre, "\n")+"\n"), dump)
+		} else if err := restore("the pre-restore steps", FormatPlain, strings.NewReader(strings.Join(pre, "\n")+"\n")); err != nil {
+			return nil, err
+		}
+		result.Scripts++
+	}
+	if ck != nil {
+		if err := h.restoreBySection(ctx, key, format, dump, progress, ck, &opts, restore); err != nil {
+			return nil, err
+		}
+	} else if err := restore(key, format, dump); err != nil {
+		return nil, err
+	}
+	if opts.DryRun && format == FormatPlain && !tail.complete() {
+		return nil, fmt.Errorf("%s is incomplete: it does not end with pg_dump's completion footer", key)
+	}
+
+	for _, s := range manifest.Slices {
+		if ck.skip(ctx, s.Key) {
+			continue
+		}
+		if err := h.restoreObject(ctx, s.Key, restore); err != nil {
+			return nil, ck.failed(err)
+		}
+		ck.completed(ctx, s.Key)
+		result.Scripts++
+	}
+	if len(post) > 0 {
+		if err := restore("the post-restore steps", FormatPlain, strings.NewReader(strings.Join(post, "\n")+"\n")); err != nil {
+			return nil, ck.failed(err)
+		}
+		result.Scripts++
+	}
+	if exists, err := h.objectExists(ctx, refreshKey(key)); err != nil {
+		return nil, err
+	} else if exists {
+		if err := h.restoreObject(ctx, refreshKey(key), restore); err != nil {
+			return nil, ck.failed(err)
+		}
+		result.Scripts++
+	}
+	if exists, err := h.objectExists(ctx, migrationsKey(key)); err != nil {
+		return nil, err
+	} else if exists {
+		result.Migrations = migrationsKey(key)
+		logf(ctx, "Migration state of %s: %s", key, result.Migrations)
+	}
+
+	if opts.DryRun {
+		result.DurationMs = h.elapsed(start)
+		result.EstimatedMs = h.estimateRestore(ctx, result.Bytes).Milliseconds()
+		logf(ctx, "Dry run of %s: %d objects, %d tables, %s; a restore would take about %s", key, result.ObjectCount, result.Tables, HumanizeSize(int(result.Bytes)), time.Duration(result.EstimatedMs)*time.Millisecond)
+		return result, nil
+	}
+	if ck != nil {
+		result.Resumed = ck.skipped
+		ck.finish(ctx)
+	}
+	result.Checks, result.ChecksFailed = h.runChecks(ctx, target)
+
+	if result.Errors > 0 || result.ChecksFailed > 0 {
+		result.Status = "partial"
+	}
+	result.DurationMs = h.elapsed(start)
+	logf(ctx, "Restored %s into %s: %d tables, %d rows, %d errors", key, result.Target, result.Tables, result.Rows, result.Errors)
+	h.recordRestore(ctx, start, result)
+	return result, nil
+}
+
+// sourceMismatch returns why the backup at key, described by m, looks like it
+// belongs to another environment than target, or "" when it does not:
+//
+//   - the database it was taken from, as its Fingerprint or else its
+//     source-id metadata records it, has another name than target's;
+//   - its Fingerprint differs from that of the database the Handler backs
+//     up, so it was not taken from that database as it stands today.
+//
+// Backups that record neither are not checked, and neither is the second
+// point when the Handler's database cannot be fingerprinted, as during the
+// outage that may have called for the restore.
+func (h *Handler) sourceMismatch(ctx context.Context, key string, m *Manifest, target DatabaseConfig) (string, error) {
+	name := ""
+	if m.Fingerprint != nil {
+		name = m.Fingerprint.Database
+	} else {
+		head, err := h.headObject(ctx, key)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		if id := head.Metadata["source-id"]; id != "" {
+			name = id[strings.LastIndex(id, "/")+1:]
+		}
+	}
+	if name != "" && name != target.Database {
+		return fmt.Sprintf("it is a backup of database %s, not %s", name, target.Database), nil
+	}
+	if m.Fingerprint == nil {
+		return "", nil
+	}
+	current, err := h.fingerprint(ctx, h.db)
+	if err != nil {
+		logf(ctx, "Warning: not comparing %s with the source database: %v", key, err)
+		return "", nil
+	}
+	if m.Fingerprint.differs(current) {
+		return fmt.Sprintf("it was taken from fingerprint %s, and the source database is now %s", m.Fingerprint, current), nil
+	}
+	return "", nil
+}
+
+// createDatabase creates the database of target, from template and owned by
+// owner when they are set, connected to the "postgres" database of its
+// server as its user. A database that exists already is refused, to keep a
+// restore meant for a new database from dropping the objects of another.
+func (h *Handler) createDatabase(ctx context.Context, target DatabaseConfig, template, owner string) error {
+	exists, err := h.databaseExists(ctx, target)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return invalidInput(fmt.Errorf("refusing to create %s: it exists already", connName(target)))
+	}
+	stmt := "CREATE DATABASE " + quoteIdent(target.Database)
+	if template != "" {
+		stmt += " TEMPLATE " + quoteIdent(template)
+	}
+	if owner != "" {
+		stmt += " OWNER " + quoteIdent(owner)
+	}
+	if err := h.maintenance(ctx, target, stmt+";\n"); err != nil {
+		return fmt.Errorf("failed to create database %s: %w", target.Database, err)
+	}
+	logf(ctx, "Created database %s", connName(target))
+	return nil
+}
+
+// databaseExists reports whether the database of target exists on its
+// server.
+func (h *Handler) databaseExists(ctx context.Context, target DatabaseConfig) (bool, error) {
+	rows, err := h.query(ctx, maintenanceDB(target), "SELECT 1 FROM pg_catalog.pg_database WHERE datname = "+quoteLiteral(target.Database))
+	if err != nil {
+		return false, fmt.Errorf("failed to look for database %s: %w", target.Database, err)
+	}
+	return len(rows) > 0, nil
+}
+
+// maintenance runs script, statements such as CREATE DATABASE that act on
+// databases rather than in one, connected to the "postgres" database of
+// target's server as its user; the first statement that fails stops it.
+func (h *Handler) maintenance(ctx context.Context, target DatabaseConfig, script string) error {
+	stats, err := h.restore(ctx, maintenanceDB(target), FormatPlain, strings.NewReader(script), RestoreOptions{ExitOnError: true})
+	if err == nil && stats.Errors > 0 {
+		err = errors.New(strings.Join(stats.FirstErrors, "; "))
+	}
+	return err
+}
+
+// maintenanceDB returns target connected to the "postgres" database of its
+// server.
+func maintenanceDB(target DatabaseConfig) DatabaseConfig {
+	target.Database = "postgres"
+	return target
+}
+
+// targetConn returns target connected to the way the source is: with its
+// application name, pgpass file and connect timeout unless target sets them.
+func (h *Handler) targetConn(target DatabaseConfig) DatabaseConfig {
+	target.ApplicationName = cmp.Or(target.ApplicationName, h.db.ApplicationName)
+	target.PassFile = cmp.Or(target.PassFile, h.db.PassFile)
+	target.ConnectTimeout = cmp.Or(target.ConnectTimeout, h.db.ConnectTimeout)
+	return target
+}
+
+// restoreObject restores the SQL script stored at key with restore.
+func (h *Handler) restoreObject(ctx context.Context, key string, restore func(what, format string, r io.Reader) error) error {
+	body, err := h.openObject(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer func() { _ = body.Close() }()
+	return restore(key, FormatPlain, body)
+}
+
+// sameDatabase reports whether a and b name the same database on the same
+// server, as far as their connection parameters tell.
+func sameDatabase(a, b DatabaseConfig) bool {
+	return sameServer(a, b) && a.Database == b.Database
+}
+
+// sameServer reports whether a and b connect to the same host and port.
+func sameServer(a, b DatabaseConfig) bool {
+	return strings.EqualFold(a.Host, b.Host) && cmp.Or(a.Port, "5432") == cmp.Or(b.Port, "5432")
+}
+
+// connName returns db as host:port/database, without credentials.
+func connName(db DatabaseConfig) string {
+	return db.Host + ":" + cmp.Or(db.Port, "5432") + "/" + db.Database
+}
+
+// PgRestore is the default Restorer used by New. A plain script is run by
+// psql; a custom-format archive is turned into one by pg_restore and run the
+// same way, so both report rows. A directory-format backup is unpacked under
+// opts.WorkDir and loaded by pg_restore, in parallel with opts.Jobs, and so
+// is a custom-format archive with opts.Jobs, downloaded there first. With
+// opts.DryRun, the script, or the one pg_restore makes of an archive or
+// directory, is read by scanScript instead of psql. The binaries are
+// resolved like pg_dump (see PgDump).
+func PgRestore(ctx context.Context, db DatabaseConfig, format string, r io.Reader, opts RestoreOptions) (RestoreStats, error) {
+	switch format {
+	case FormatPlain:
+		if opts.DryRun {
+			return scanScript(ctx, db, r, opts)
+		}
+		return psqlRestore(ctx, db, r, opts)
+	case FormatCustom:
+		if opts.Jobs > 1 && !opts.DryRun {
+			return pgRestoreArchive(ctx, db, r, opts)
+		}
+		return pgRestoreScript(ctx, db, r, opts)
+	case FormatDirectory:
+		return pgRestoreDirectory(ctx, db, r, opts)
+	default:
+		return RestoreStats{}, fmt.Errorf("cannot restore %s-format dumps", format)
+	}
+}
+
+// psqlRestore runs the script r through psql, counting the rows reported by
+// its command tags and the errors it prints.
+func psqlRestore(ctx context.Context, db DatabaseConfig, r io.Reader, opts RestoreOptions) (RestoreStats, error) {
+	psqlPath, env, err := pgTool("psql", db)
+	if err != nil {
+		return RestoreStats{}, err
+	}
+	stopOnError := "0"
+	if opts.ExitOnError {
+		stopOnError = "1"
+	}
+	args := append(connArgs(db), "--no-psqlrc", "-v", "ON_ERROR_STOP="+stopOnError)
+	if opts.SingleTransaction {
+		args = append(args, "--single-transaction")
+	}
+	if opts.DisableTriggers {
+		r = io.MultiReader(strings.NewReader("SET session_replication_role = replica;\n"), r)
+	}
+	cmd := exec.CommandContext(ctx, psqlPath, args...)
+	cmd.Env = env
+	cmd.Stdin = r
+	if opts.onEntry != nil {
+		cmd.Stdin = io.TeeReader(r, &tocWatcher{fn: opts.onEntry})
+	}
+	var counter restoreCounter
+	cmd.Stdout = counter.writer(counter.countTag)
+	cmd.Stderr = counter.writer(counter.countError)
+	err = cmd.Run()
+	counter.flush()
+	if err != nil {
+		return counter.stats, fmt.Errorf("psql failed: %w", err)
+	}
+	return counter.stats, nil
+}
+
+// pgRestoreScript pipes the script pg_restore makes of the archive r, or of
+// the dump that source arguments name, into psqlRestore, or scanScript with
+// opts.DryRun.
+func pgRestoreScript(ctx context.Context, db DatabaseConfig, r io.Reader, opts RestoreOptions, source ...string) (RestoreStats, error) {
+	pgRestorePath, env, err := pgTool("pg_restore", db)
+	if err != nil {
+		return RestoreStats{}, err
+	}
+	args := []string{"--file=-", "--no-owner", "--no-privileges"}
+	if opts.section != "" {
+		args = append(args, "--section="+opts.section)
+	}
+	cmd := exec.CommandContext(ctx, pgRestorePath, append(args, source...)...)
+	cmd.Env = env
+	if r != nil {
+		cmd.Stdin = r
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	script, err := cmd.StdoutPipe()
+	if err != nil {
+		return RestoreStats{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return RestoreStats{}, fmt.Errorf("pg_restore failed: %w", err)
+	}
+	load := psqlRestore
+	if opts.DryRun {
+		load = scanScript
+	}
+	stats, psqlErr := load(ctx, db, script, opts)
+	// psql may stop reading first; pg_restore then fails writing to the pipe.
+	_, _ = io.Copy(io.Discard, script)
+	if err := cmd.Wait(); err != nil {
+		return stats, fmt.Errorf("pg_restore failed: %w\nstderr: %s", err, Redact(stderr.String()))
+	}
+	return stats, psqlErr
+}
+
+// pgRestoreDirectory unpacks the tar of a directory-format dump and loads it
+// with pgRestoreFile.
+func pgRestoreDirectory(ctx context.Context, db DatabaseConfig, r io.Reader, opts RestoreOptions) (RestoreStats, error) {
+	dir, err := os.MkdirTemp(opts.WorkDir, "pg_restore-")
+	if err != nil {
+		return RestoreStats{}, fmt.Errorf("failed to create restore directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	if err := readDirectoryTar(r, dir); err != nil {
+		return RestoreStats{}, fmt.Errorf("failed to unpack dump directory: %w", err)
+	}
+
+	if opts.DryRun {
+		return pgRestoreScript(ctx, db, nil, opts, "--format=directory", dir)
+	}
+	return pgRestoreFile(ctx, db, opts, "--format=directory", dir)
+}
+
+// pgRestoreArchive downloads the custom-format archive r under opts.WorkDir,
+// where pg_restore can seek in it as its parallel restore needs to, and
+// loads it with pgRestoreFile.
+func pgRestoreArchive(ctx context.Context, db DatabaseConfig, r io.Reader, opts RestoreOptions) (RestoreStats, error) {
+	dir, err := os.MkdirTemp(opts.WorkDir, "pg_restore-")
+	if err != nil {
+		return RestoreStats{}, fmt.Errorf("failed to create restore directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	file, err := os.OpenFile(filepath.Join(dir, "archive.dump"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return RestoreStats{}, fmt.Errorf("failed to create restore file: %w", err)
+	}
+	_, err = io.Copy(file, r)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return RestoreStats{}, fmt.Errorf("failed to download archive: %w", err)
+	}
+	return pgRestoreFile(ctx, db, opts, "--format=custom", file.Name())
+}
+
+// pgRestoreFile loads the dump on disk that source arguments name with
+// pg_restore connected to db, in parallel with opts.Jobs, counting the
+// tables it loads and the errors it prints.
+func pgRestoreFile(ctx context.Context, db DatabaseConfig, opts RestoreOptions, source ...string) (RestoreStats, error) {
+	pgRestorePath, env, err := pgTool("pg_restore", db)
+	if err != nil {
+		return RestoreStats{}, err
+	}
+	args := append(connArgs(db), "--no-owner", "--no-privileges", "--verbose")
+	if opts.Jobs > 1 {
+		args = append(args, fmt.Sprintf("--jobs=%d", opts.Jobs))
+	}
+	if opts.ExitOnError {
+		args = append(args, "--exit-on-error")
+	}
+	if opts.SingleTransaction {
+		args = append(args, "--single-transaction")
+	}
+	if opts.DisableTriggers {
+		args = append(args, "--disable-triggers")
+	}
+	if opts.section != "" {
+		args = append(args, "--section="+opts.section)
+	}
+	cmd := exec.CommandContext(ctx, pgRestorePath, append(args, source...)...)
+	cmd.Env = env
+	counter := restoreCounter{entry: opts.onEntry}
+	cmd.Stderr = counter.writer(counter.countVerbose)
+	err = cmd.Run()
+	counter.flush()
+	// pg_restore exits 1 when it went on past errors; they are counted.
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && !opts.ExitOnError && counter.stats.Errors > 0) {
+		return counter.stats, fmt.Errorf("pg_restore failed: %w", err)
+	}
+	return counter.stats, nil
+}
+
+var (
+	// rowTag matches the command tags psql prints for statements that load
+	// rows, e.g. "COPY 42" and "INSERT 0 1".
+	rowTag = regexp.MustCompile(`^(COPY|INSERT \d+) (\d+)$`)
+	// restoringTable matches pg_restore's verbose line for each table whose
+	// data it loads.
+	restoringTable = regexp.MustCompile(`^pg_restore: processing data for table `)
+	// restoringEntry matches pg_restore's verbose line for each TOC entry it
+	// restores, e.g. `pg_restore: creating INDEX "public.users_pkey"`.
+	restoringEntry = regexp.MustCompile(`^pg_restore: (?:creating ([A-Z][A-Z ]*)|processing data for table) "(.+)"$`)
+)
+
+// restoreCounter accumulates RestoreStats from the output of psql and
+// pg_restore, read line by line by the writers it returns. The stdout and
+// stderr of one command are written concurrently.
+type restoreCounter struct {
+	mu      sync.Mutex
+	stats   RestoreStats
+	writers []*lineWriter
+	entry   func(entry string) // when set, called with each TOC entry pg_restore starts
+}
+
+// writer returns an io.Writer passing each complete line written to it to
+// count.
+func (c *restoreCounter) writer(count func(line string)) io.Writer {
+	w := &lineWriter{fn: func(line string) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		count(line)
+	}}
+	c.writers = append(c.writers, w)
+	return w
+}
+
+// flush counts the unterminated last line of each writer.
+func (c *restoreCounter) flush() {
+	for _, w := range c.writers {
+		w.flush()
+	}
+}
+
+// countTag counts the rows of a psql command tag.
+func (c *restoreCounter) countTag(line string) {
+	m := rowTag.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	n, _ := strconv.ParseInt(m[2], 10, 64)
+	c.stats.Rows += n
+	if m[1] == "COPY" {
+		c.stats.Tables++
+	}
+}
+
+// countError counts an error psql or pg_restore printed.
+func (c *restoreCounter) countError(line string) {
+	if !strings.Contains(line, "ERROR:") {
+		return
+	}
+	c.stats.Errors++
+	if len(c.stats.FirstErrors) < maxRestoreErrors {
+		c.stats.FirstErrors = append(c.stats.FirstErrors, Redact(line))
+	}
+}
+
+// countVerbose counts the tables and errors in pg_restore's verbose output.
+func (c *restoreCounter) countVerbose(line string) {
+	if restoringTable.MatchString(line) {
+		c.stats.Tables++
+	}
+	if m := restoringEntry.FindStringSubmatch(line); m != nil && c.entry != nil {
+		c.entry(cmp.Or(m[1], "TABLE DATA") + " " + m[2])
+	}
+	c.countError(line)
+}
+
+// lineWriter is an io.Writer calling fn with each line written to it, without
+// its newline.
+type lineWriter struct {
+	fn      func(line string)
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, p...)
+			return n, nil
+		}
+		w.fn(string(append(w.partial, p[:i]...)))
+		w.partial = w.partial[:0]
+		p = p[i+1:]
+	}
+}
+
+// flush passes an unterminated last line to fn.
+func (w *lineWriter) flush() {
+	if len(w.partial) > 0 {
+		w.fn(string(w.partial))
+		w.partial = nil
+	}
+}
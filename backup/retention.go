@@ -0,0 +1,291 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Retention decisions reported in PruneDecision.Action.
+const (
+	PruneKeep   = "keep"
+	PruneDelete = "delete"
+)
+
+// PruneDecision is the retention outcome for one stored backup.
+type PruneDecision struct {
+	Key    string `json:"key"`
+	Action string `json:"action"`          // PruneKeep or PruneDelete
+	Reason string `json:"reason"`          // why the policy keeps or deletes it
+	Error  string `json:"error,omitempty"` // set when the deletion failed
+}
+
+// RetentionPolicy is how long the backups of each tier are kept under a
+// prefix. A tier whose limit is not positive is never pruned.
+type RetentionPolicy struct {
+	Hourly  int // hours of hourly backups kept (see Config.HourlyBackups)
+	Daily   int // days of daily backups kept
+	Monthly int // months of monthly backups kept, the current one included
+	Yearly  int // years of yearly backups kept, the current one included
+}
+
+// cutoff returns the limit of tier under p, the unit it counts in, and the
+// earliest date a backup of tier may carry as of asOf to be kept. A limit that
+// is not positive means the tier is kept whole.
+func (p RetentionPolicy) cutoff(tier string, asOf time.Time) (limit int, unit string, earliest time.Time) {
+	y, m, _ := asOf.Date()
+	switch tier {
+	case "hourly":
+		return p.Hourly, "hours", asOf.Truncate(time.Hour).Add(time.Duration(1-p.Hourly) * time.Hour)
+	case "daily":
+		return p.Daily, "days", asOf.AddDate(0, 0, -p.Daily)
+	case "monthly":
+		return p.Monthly, "months", time.Date(y, m, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1-p.Monthly, 0)
+	default:
+		return p.Yearly, "years", time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(1-p.Yearly, 0, 0)
+	}
+}
+
+// RetentionExemption keeps backups labeled a certain way (see
+// RunOptions.Labels) for a number of days after they were stored, in any
+// tier, even where the retention policy would delete them sooner.
+type RetentionExemption struct {
+	// Label is "key=value" to match that label exactly, or a bare name
+	// matching a label with that key or that value, e.g. "pre-migration"
+	// for a backup labeled reason=pre-migration.
+	Label string
+	Days  int // days after the backup was stored that it is kept for
+}
+
+// ParseRetentionExemptions parses a RETENTION_EXEMPTIONS setting: a
+// comma-separated list of "<label>:<days>" entries, such as
+// "reason=pre-migration:365,legal-hold:3650".
+func ParseRetentionExemptions(s string) ([]RetentionExemption, error) {
+	var exemptions []RetentionExemption
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("retention exemption %q: want <label>:<days>", entry)
+		}
+		days, err := strconv.Atoi(entry[i+1:])
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("retention exemption %q: want a positive number of days", entry)
+		}
+		exemptions = append(exemptions, RetentionExemption{Label: strings.TrimSpace(entry[:i]), Days: days})
+	}
+	return exemptions, nil
+}
+
+// matches reports whether labels carry the label of e.
+func (e RetentionExemption) matches(labels map[string]string) bool {
+	if key, value, ok := strings.Cut(e.Label, "="); ok {
+		v, set := labels[key]
+		return set && v == value
+	}
+	for key, value := range labels {
+		if key == e.Label || value == e.Label {
+			return true
+		}
+	}
+	return false
+}
+
+// PruneOptions configures a Prune call.
+type PruneOptions struct {
+	Profile  string    // profile whose backups are evaluated; "" means the default profile
+	AsOf     time.Time // evaluate the policy as of this time; zero means now
+	Simulate bool      // report decisions without deleting anything
+}
+
+// PruneResult summarizes a Prune call.
+type PruneResult struct {
+	Status     string          `json:"status"`      // "ok", or "partial" when a deletion failed
+	RunID      string          `json:"run_id"`      // run identifier, also prefixed to log lines
+	Action     string          `json:"action"`      // always "prune"
+	Profile    string          `json:"profile"`     // profile that was evaluated
+	Simulated  bool            `json:"simulated"`   // true when nothing was deleted on purpose
+	AsOf       string          `json:"as_of"`       // date the policy was evaluated at (YYYY-MM-DD)
+	Kept       int             `json:"kept"`        // backups the policy keeps
+	Deleted    int             `json:"deleted"`     // backups deleted (or, simulated, that would be)
+	Decisions  []PruneDecision `json:"decisions"`   // per-backup outcomes, sorted by key
+	DurationMs int64           `json:"duration_ms"` // wall-clock time of the call
+}
+
+// Prune applies the retention policy of a profile to its stored backups, or
+// with opts.Simulate only reports which ones the policy would keep and delete.
+// opts.AsOf evaluates the policy at another date, so a policy change can be
+// reviewed before it destroys data.
+func (h *Handler) Prune(ctx context.Context, opts PruneOptions) (*PruneResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	name := opts.Profile
+	if name == "" {
+		name = h.profile
+	}
+	profile, err := LookupProfile(name)
+	if err != nil {
+		return nil, err
+	}
+	asOf := opts.AsOf
+	if asOf.IsZero() {
+		asOf = h.now()
+	}
+
+	decisions, err := h.applyRetention(ctx, profile.Prefix, h.profileRetention(profile), asOf, opts.Simulate)
+	if err != nil {
+		return nil, err
+	}
+	result := &PruneResult{
+		Status:    "ok",
+		RunID:     runID,
+		Action:    "prune",
+		Profile:   profile.Name,
+		Simulated: opts.Simulate,
+		AsOf:      asOf.Format("2006-01-02"),
+		Decisions: decisions,
+	}
+	for _, d := range decisions {
+		switch {
+		case d.Error != "":
+			result.Status = "partial"
+			result.Kept++
+		case d.Action == PruneDelete:
+			result.Deleted++
+		default:
+			result.Kept++
+		}
+	}
+	result.DurationMs = h.elapsed(start)
+	return result, nil
+}
+
+// profileRetention returns the retention policy for profile: the Handler's,
+// with the profile's daily retention when it sets one.
+func (h *Handler) profileRetention(profile Profile) RetentionPolicy {
+	policy := h.retention
+	if profile.RetentionDays > 0 {
+		policy.Daily = profile.RetentionDays
+	}
+	return policy
+}
+
+// applyRetention evaluates the retention policy for every backup under prefix
+// as of asOf, with the Handler's RetentionExemptions, and, unless simulate is
+// set, deletes the backups it rejects.
+// Deletion failures are recorded on the decision and logged, not returned.
+func (h *Handler) applyRetention(ctx context.Context, prefix string, policy RetentionPolicy, asOf time.Time, simulate bool) ([]PruneDecision, error) {
+	var objects []types.Object
+	for _, tier := range tierPrefixes {
+		listed, err := h.listObjects(ctx, prefix+tier)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s backups: %w", strings.TrimSuffix(tier, "/"), err)
+		}
+		objects = append(objects, listed...)
+	}
+
+	decisions := planRetention(ctx, objects, prefix, policy, asOf)
+	if len(h.exemptions) > 0 {
+		h.exemptByLabel(ctx, decisions, asOf)
+	}
+	if simulate {
+		return decisions, nil
+	}
+	for i, d := range decisions {
+		if d.Action != PruneDelete {
+			continue
+		}
+		if _, err := h.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(h.bucket),
+			Key:    aws.String(d.Key),
+		}); err != nil {
+			logf(ctx, "Warning: failed to delete old backup %s: %v", d.Key, err)
+			decisions[i].Error = err.Error()
+		} else {
+			logf(ctx, "Deleted old backup: %s", d.Key)
+		}
+	}
+	return decisions, nil
+}
+
+// exemptByLabel keeps, as of asOf, the backups decisions would delete whose
+// manifest labels match a RetentionExemption still in force, with their
+// sidecars. Only backups about to be deleted have their manifest read; one
+// whose manifest cannot be read is kept, as it might be exempt.
+func (h *Handler) exemptByLabel(ctx context.Context, decisions []PruneDecision, asOf time.Time) {
+	reasons := map[string]string{} // why each exempt backup is kept
+	for _, d := range decisions {
+		if d.Action != PruneDelete || isSidecarKey(d.Key) {
+			continue
+		}
+		m, err := h.readManifest(ctx, d.Key)
+		if err != nil {
+			logf(ctx, "Warning: keeping %s, whose labels cannot be read: %v", d.Key, err)
+			reasons[plainKey(d.Key)] = "labels unreadable; kept in case an exemption applies"
+			continue
+		}
+		if m == nil {
+			continue
+		}
+		for _, e := range h.exemptions {
+			if e.matches(m.Labels) && asOf.Before(m.CreatedAt.AddDate(0, 0, e.Days)) {
+				reasons[plainKey(d.Key)] = fmt.Sprintf("labeled %s; exempt for %d days", e.Label, e.Days)
+				break
+			}
+		}
+	}
+	for i, d := range decisions {
+		if reason, ok := reasons[plainKey(sidecarBackupKey(d.Key))]; ok && d.Action == PruneDelete {
+			decisions[i].Action, decisions[i].Reason = PruneKeep, reason
+		}
+	}
+}
+
+// planRetention decides, as of asOf, which of objects (backups under prefix)
+// policy keeps: a backup dated within its tier's limit is kept and an older
+// one deleted (see RetentionPolicy.cutoff). Keys are expected in the form
+// "<prefix><tier>/<date>-backup.sql", with the date as the tier names it
+// (YYYY-MM-DDTHH, YYYY-MM-DD, YYYY-MM or YYYY), or in its LayoutHive
+// partitions; sidecar
+// files follow their backup, and unparseable keys are kept.
+func planRetention(ctx context.Context, objects []types.Object, prefix string, policy RetentionPolicy, asOf time.Time) []PruneDecision {
+	decisions := make([]PruneDecision, 0, len(objects))
+	for _, obj := range objects {
+		key := aws.ToString(obj.Key)
+		d := PruneDecision{Key: key, Action: PruneKeep}
+		tier, name, _ := strings.Cut(strings.TrimPrefix(key, prefix), "/")
+		limit, unit, earliest := policy.cutoff(tier, asOf)
+		name, inLayout := tierName(tier, name)
+		switch {
+		case !inLayout:
+			d.Reason = "not a backup key"
+		case limit <= 0:
+			d.Reason = tier + " backups are not pruned"
+		default:
+			backupDate, err := time.Parse(backupTiers[tier].layout, strings.TrimSuffix(plainKey(sidecarBackupKey(name)), "-backup.sql"))
+			switch {
+			case err != nil:
+				logf(ctx, "Warning: failed to parse date from key %s: %v", key, err)
+				d.Reason = "unparseable date"
+			case backupDate.Before(earliest):
+				d.Action = PruneDelete
+				d.Reason = fmt.Sprintf("older than %d %s", limit, unit)
+			default:
+				d.Reason = fmt.Sprintf("within %d %s", limit, unit)
+			}
+		}
+		decisions = append(decisions, d)
+	}
+	sort.Slice(decisions, func(i, j int) bool { return decisions[i].Key < decisions[j].Key })
+	return decisions
+}
@@ -0,0 +1,230 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// seedRetentionFixture stores daily backups 1, 5 and 10 days before testNow
+// plus a monthly backup that retention never touches.
+func seedRetentionFixture(f *fakeS3) {
+	for _, days := range []int{1, 5, 10} {
+		date := testNow.AddDate(0, 0, -days).Format("2006-01-02")
+		f.seed("daily/"+date+"-backup.sql", []byte(date), testNow)
+	}
+	f.seed("monthly/2026-01-backup.sql", []byte("monthly"), testNow)
+}
+
+func TestPlanRetention(t *testing.T) {
+	f := newFakeS3()
+	seedRetentionFixture(f)
+	f.seed("daily/not-a-date-backup.sql", []byte("x"), testNow)
+	f.seed("daily/2026-05-18-backup.sql.gz", []byte("x"), testNow)
+	f.seed("daily/2026-05-23-backup.sql.gz", []byte("x"), testNow)
+	h := newTestHandler(f, 7)
+
+	objects, err := h.listObjects(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"daily/2026-05-17-backup.sql":    PruneDelete,
+		"daily/2026-05-18-backup.sql.gz": PruneDelete,
+		"daily/2026-05-22-backup.sql":    PruneKeep,
+		"daily/2026-05-23-backup.sql.gz": PruneKeep,
+		"daily/2026-05-26-backup.sql":    PruneKeep,
+		"daily/not-a-date-backup.sql":    PruneKeep,
+		"monthly/2026-01-backup.sql":     PruneKeep,
+	}
+	decisions := planRetention(context.Background(), objects, "", RetentionPolicy{Daily: 7}, testNow)
+	if len(decisions) != len(want) {
+		t.Fatalf("got %d decisions, want %d: %+v", len(decisions), len(want), decisions)
+	}
+	for i, d := range decisions {
+		if i > 0 && decisions[i-1].Key > d.Key {
+			t.Errorf("decisions not sorted by key: %q before %q", decisions[i-1].Key, d.Key)
+		}
+		if d.Action != want[d.Key] {
+			t.Errorf("%s: action = %q (%s), want %q", d.Key, d.Action, d.Reason, want[d.Key])
+		}
+	}
+}
+
+func TestPlanRetentionTiers(t *testing.T) {
+	f := newFakeS3()
+	for _, key := range []string{
+		"monthly/2025-05-backup.sql",
+		"monthly/2025-05-backup.manifest.json",
+		"monthly/2025-06-backup.sql",
+		"monthly/db=app/year=2025/month=04/2025-04-backup.sql",
+		"yearly/2021-backup.sql",
+		"yearly/2022-backup.sql",
+		"yearly/2026-backup.sql",
+	} {
+		f.seed(key, []byte("x"), testNow)
+	}
+	h := newTestHandler(f, 7)
+	objects, err := h.listObjects(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"monthly/2025-05-backup.sql":                           PruneDelete,
+		"monthly/2025-05-backup.manifest.json":                 PruneDelete,
+		"monthly/2025-06-backup.sql":                           PruneKeep,
+		"monthly/db=app/year=2025/month=04/2025-04-backup.sql": PruneDelete,
+		"yearly/2021-backup.sql":                               PruneDelete,
+		"yearly/2022-backup.sql":                               PruneKeep,
+		"yearly/2026-backup.sql":                               PruneKeep,
+	}
+	for _, d := range planRetention(context.Background(), objects, "", RetentionPolicy{Daily: 7, Monthly: 12, Yearly: 5}, testNow) {
+		if d.Action != want[d.Key] {
+			t.Errorf("%s: action = %q (%s), want %q", d.Key, d.Action, d.Reason, want[d.Key])
+		}
+	}
+	for _, d := range planRetention(context.Background(), objects, "", RetentionPolicy{Daily: 7}, testNow) {
+		if d.Action != PruneKeep {
+			t.Errorf("%s: %q (%s) without monthly or yearly limits", d.Key, d.Action, d.Reason)
+		}
+	}
+}
+
+func TestPruneSimulateDeletesNothing(t *testing.T) {
+	f := newFakeS3()
+	seedRetentionFixture(f)
+	h := newTestHandler(f, 7)
+
+	res, err := h.Prune(context.Background(), PruneOptions{Simulate: true})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if !res.Simulated || res.Deleted != 1 || res.Kept != 3 {
+		t.Errorf("result = %+v, want simulated with 1 deletion and 3 kept", res)
+	}
+	if len(f.objects) != 4 {
+		t.Errorf("simulation removed objects: %d left, want 4", len(f.objects))
+	}
+}
+
+func TestPruneDeletes(t *testing.T) {
+	f := newFakeS3()
+	seedRetentionFixture(f)
+	h := newTestHandler(f, 7)
+
+	res, err := h.Prune(context.Background(), PruneOptions{})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if res.Status != "ok" || res.Deleted != 1 {
+		t.Errorf("result = %+v, want ok with 1 deletion", res)
+	}
+	if _, ok := f.objects["daily/2026-05-17-backup.sql"]; ok {
+		t.Error("10-day-old daily backup should have been deleted")
+	}
+}
+
+func TestPruneAsOf(t *testing.T) {
+	f := newFakeS3()
+	seedRetentionFixture(f)
+	h := newTestHandler(f, 7)
+
+	// Two weeks from now only the monthly backup survives.
+	res, err := h.Prune(context.Background(), PruneOptions{Simulate: true, AsOf: testNow.AddDate(0, 0, 14)})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if res.AsOf != "2026-06-10" || res.Deleted != 3 || res.Kept != 1 {
+		t.Errorf("result = %+v, want as_of 2026-06-10 with 3 deletions and 1 kept", res)
+	}
+}
+
+func TestPruneDeleteErrorIsPartial(t *testing.T) {
+	f := newFakeS3()
+	seedRetentionFixture(f)
+	f.deleteErr = errors.New("access denied")
+	h := newTestHandler(f, 7)
+
+	res, err := h.Prune(context.Background(), PruneOptions{})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if res.Status != "partial" || res.Deleted != 0 {
+		t.Errorf("result = %+v, want partial with 0 deletions", res)
+	}
+	for _, d := range res.Decisions {
+		if d.Action == PruneDelete && d.Error == "" {
+			t.Errorf("%s: failed deletion should record its error", d.Key)
+		}
+	}
+}
+
+func TestPruneUnknownProfile(t *testing.T) {
+	h := newTestHandler(newFakeS3(), 7)
+	if _, err := h.Prune(context.Background(), PruneOptions{Profile: "nope"}); err == nil {
+		t.Fatal("expected an error for an unknown profile")
+	}
+}
+
+func TestPruneListError(t *testing.T) {
+	f := newFakeS3()
+	f.listErr = errors.New("boom")
+	h := newTestHandler(f, 7)
+	if _, err := h.Prune(context.Background(), PruneOptions{Simulate: true}); err == nil {
+		t.Fatal("expected list error to fail the prune")
+	}
+}
+
+func TestParseRetentionExemptions(t *testing.T) {
+	got, err := ParseRetentionExemptions("reason=pre-migration:365, legal-hold:3650")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RetentionExemption{{"reason=pre-migration", 365}, {"legal-hold", 3650}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	for _, bad := range []string{"pre-migration", ":30", "legal-hold:0", "legal-hold:1y"} {
+		if _, err := ParseRetentionExemptions(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestPruneLabelExemption(t *testing.T) {
+	f := newFakeS3()
+	seedRetentionFixture(f)
+	h := newTestHandler(f, 7)
+	h.exemptions = []RetentionExemption{{Label: "pre-migration", Days: 365}, {Label: "ticket=OPS-1", Days: 5}}
+	ctx := context.Background()
+	old := "daily/2026-05-17-backup.sql"
+	for key, labels := range map[string]map[string]string{
+		old:                           {"reason": "pre-migration"},
+		"daily/2026-05-16-backup.sql": {"ticket": "OPS-1"}, // exemption over
+		"daily/2026-05-15-backup.sql": {"reason": "routine"},
+	} {
+		if key != old {
+			f.seed(key, []byte(key), testNow)
+		}
+		if err := h.putManifest(ctx, Manifest{FormatVersion: manifestFormatVersion, Key: key, CreatedAt: testNow.AddDate(0, 0, -10), Labels: labels}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := h.Prune(ctx, PruneOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range res.Decisions {
+		exempt := d.Key == old || d.Key == manifestKey(old)
+		if (d.Action == PruneKeep) != exempt && strings.HasPrefix(d.Key, "daily/2026-05-1") {
+			t.Errorf("%s: %s (%s)", d.Key, d.Action, d.Reason)
+		}
+	}
+	if _, ok := f.objects[manifestKey(old)]; !ok || f.objects[old] == nil {
+		t.Error("the exempt backup or its manifest was deleted")
+	}
+}
@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// restoreLogPrefix is where each Restore records how long it took and how
+// much it loaded, so recovery times can be followed as the database grows.
+const restoreLogPrefix = "restore-log/"
+
+// RestoreRecord is the object a Restore stores under restoreLogPrefix: the
+// recovery time it achieved, against the objective when one is set.
+type RestoreRecord struct {
+	RunID        string    `json:"run_id"`
+	At           time.Time `json:"at"` // when the restore started
+	Key          string    `json:"key"`
+	Target       string    `json:"target"`
+	Format       string    `json:"format,omitempty"`
+	Bytes        int64     `json:"bytes"` // dump and script bytes loaded
+	Tables       int       `json:"tables"`
+	Rows         int64     `json:"rows"`
+	Errors       int       `json:"errors"`
+	ChecksFailed int       `json:"checks_failed,omitempty"` // RestoreChecks that did not pass
+	DurationMs   int64     `json:"duration_ms"`
+	ObjectiveMs  int64     `json:"rto_objective_ms,omitempty"`
+	Met          *bool     `json:"rto_met,omitempty"`
+}
+
+// restoreRecordKey returns the key of the record of the restore run runID
+// started at, e.g. "restore-log/2026-05-27T030000Z-<run>.json"; keys sort by
+// time.
+func restoreRecordKey(at time.Time, runID string) string {
+	return restoreLogPrefix + at.UTC().Format("2006-01-02T150405Z") + "-" + runID + ".json"
+}
+
+// recordRestore measures result, of a Restore started at start, against the
+// Handler's RTO objective, if any, and stores it as a RestoreRecord. A
+// restore slower than the objective sends a restore.rto_exceeded
+// notification. A record that cannot be stored makes the restore partial.
+func (h *Handler) recordRestore(ctx context.Context, start time.Time, result *RestoreResult) {
+	took := time.Duration(result.DurationMs) * time.Millisecond
+	if h.rtoObjective > 0 {
+		met := took <= h.rtoObjective
+		result.RTOObjectiveMs, result.RTOMet = h.rtoObjective.Milliseconds(), &met
+	}
+	rec := RestoreRecord{
+		RunID:        result.RunID,
+		At:           start.UTC(),
+		Key:          result.Key,
+		Target:       result.Target,
+		Format:       result.Format,
+		Bytes:        result.Bytes,
+		Tables:       result.Tables,
+		Rows:         result.Rows,
+		Errors:       result.Errors,
+		ChecksFailed: result.ChecksFailed,
+		DurationMs:   result.DurationMs,
+		ObjectiveMs:  result.RTOObjectiveMs,
+		Met:          result.RTOMet,
+	}
+	key := restoreRecordKey(start, result.RunID)
+	if err := h.writeJSON(ctx, key, rec); err != nil {
+		logf(ctx, "Warning: failed to record restore: %v", err)
+		result.Status, result.RecordErr = "partial", err.Error()
+	} else {
+		result.Record = key
+	}
+
+	msg := fmt.Sprintf("Recovery time: %s of %s restored in %s", HumanizeSize(int(result.Bytes)), result.Key, took)
+	if result.RTOMet == nil {
+		logf(ctx, "%s", msg)
+		return
+	}
+	logf(ctx, "%s (objective %s)", msg, h.rtoObjective)
+	if !*result.RTOMet {
+		h.notify(ctx, Notification{
+			Event:   "restore.rto_exceeded",
+			Message: fmt.Sprintf("Restore of %s into %s took %s, over the recovery time objective of %s", result.Key, result.Target, took, h.rtoObjective),
+			Fields: map[string]string{
+				"key":              result.Key,
+				"target":           result.Target,
+				"bytes":            strconv.FormatInt(result.Bytes, 10),
+				"duration_ms":      strconv.FormatInt(result.DurationMs, 10),
+				"rto_objective_ms": strconv.FormatInt(result.RTOObjectiveMs, 10),
+			},
+		})
+	}
+}
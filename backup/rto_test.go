@@ -0,0 +1,100 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreRecordsRecoveryTime(t *testing.T) {
+	f := newFakeS3()
+	key := "daily/2026-05-27-backup.sql"
+	f.seed(key, []byte("CREATE TABLE users ();\n"), time.Time{})
+	var calls []restoreCall
+	var events []Notification
+	h := newTestHandler(f, 7)
+	h.restore = recordingRestorer(&calls, func(string) RestoreStats { return RestoreStats{Tables: 1, Rows: 42} })
+	h.notifier = func(_ context.Context, n Notification) error {
+		events = append(events, n)
+		return nil
+	}
+	h.rtoObjective = 5 * time.Minute
+	clock := testNow
+	h.now = func() time.Time {
+		clock = clock.Add(4 * time.Minute) // so the restore takes 4 minutes
+		return clock
+	}
+
+	res, err := h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if res.Bytes != 23 || res.DurationMs != (4*time.Minute).Milliseconds() || res.RTOMet == nil || !*res.RTOMet {
+		t.Errorf("bytes = %d, duration = %dms, met = %v; want 23 bytes in 4m, met", res.Bytes, res.DurationMs, res.RTOMet)
+	}
+	if !strings.HasPrefix(res.Record, restoreLogPrefix) || !strings.HasSuffix(res.Record, res.RunID+".json") {
+		t.Fatalf("record = %q", res.Record)
+	}
+	var rec RestoreRecord
+	if err := json.Unmarshal(f.objects[res.Record].body, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Key != key || rec.Bytes != 23 || rec.Rows != 42 || rec.ObjectiveMs != (5*time.Minute).Milliseconds() || rec.Met == nil || !*rec.Met {
+		t.Errorf("record = %+v", rec)
+	}
+	if len(events) != 0 {
+		t.Errorf("notifications = %+v, want none within the objective", events)
+	}
+
+	h.rtoObjective = time.Minute
+	res, err = h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if res.RTOMet == nil || *res.RTOMet {
+		t.Errorf("met = %v, want the objective missed", res.RTOMet)
+	}
+	if len(events) != 1 || events[0].Event != "restore.rto_exceeded" || events[0].Fields["rto_objective_ms"] != "60000" {
+		t.Errorf("notifications = %+v, want one restore.rto_exceeded", events)
+	}
+
+	f.putErr = errors.New("simulated failure")
+	res, err = h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget})
+	if err != nil || res.Status != "partial" || res.RecordErr == "" {
+		t.Errorf("Restore = %+v, %v; want partial when the record cannot be stored", res, err)
+	}
+}
+
+func TestWriteRestoreMetricsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "restore.prom")
+	met := true
+	res := &RestoreResult{RestoreStats: RestoreStats{Rows: 42}, Bytes: 2048, DurationMs: 90500, RTOObjectiveMs: 300000, RTOMet: &met}
+	if err := WriteRestoreMetricsFile(path, res, nil, testNow); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteRestoreMetricsFile(path, nil, errors.New("simulated failure"), testNow.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"postgres_s3_backup_last_restore_success 0\n",
+		"postgres_s3_backup_last_restore_duration_seconds 90.500\n",
+		"postgres_s3_backup_last_restore_bytes 2048\n",
+		"postgres_s3_backup_last_restore_rows 42\n",
+		"postgres_s3_backup_rto_objective_seconds 300.000\n",
+		"postgres_s3_backup_last_restore_rto_met 1\n",
+		"# EOF\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("metrics file lacks %q:\n%s", want, data)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+)
+
+// runIDKey is the context key under which the run identifier is stored.
+type runIDKey struct{}
+
+// NewRunID returns a random RFC 4122 version 4 UUID identifying one run.
+func NewRunID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:]) // crypto/rand.Read never returns an error
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// WithRunID returns a copy of ctx carrying id as the run identifier. Operations
+// started with the returned context log, tag and report under id.
+func WithRunID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, id)
+}
+
+// RunID returns the run identifier carried by ctx, or "" when there is none.
+func RunID(ctx context.Context) string {
+	id, _ := ctx.Value(runIDKey{}).(string)
+	return id
+}
+
+// startRun returns ctx with a run identifier, generating one unless ctx
+// already carries one, along with that identifier.
+func startRun(ctx context.Context) (context.Context, string) {
+	if id := RunID(ctx); id != "" {
+		return ctx, id
+	}
+	id := NewRunID()
+	return WithRunID(ctx, id), id
+}
+
+// logf logs like log.Printf, prefixed with the run identifier in ctx if any,
+// with secrets redacted (see Redact).
+func logf(ctx context.Context, format string, args ...any) {
+	if id := RunID(ctx); id != "" {
+		format = "[run " + id + "] " + format
+	}
+	log.Print(Redact(fmt.Sprintf(format, args...)))
+}
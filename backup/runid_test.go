@@ -0,0 +1,79 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+var uuidV4 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewRunID(t *testing.T) {
+	a, b := NewRunID(), NewRunID()
+	if !uuidV4.MatchString(a) {
+		t.Errorf("NewRunID() = %q, want a version 4 UUID", a)
+	}
+	if a == b {
+		t.Errorf("NewRunID returned %q twice", a)
+	}
+}
+
+func TestStartRunKeepsExistingID(t *testing.T) {
+	ctx, id := startRun(WithRunID(context.Background(), "given"))
+	if id != "given" || RunID(ctx) != "given" {
+		t.Errorf("startRun replaced an existing run id with %q", id)
+	}
+	if _, id := startRun(context.Background()); id == "" {
+		t.Error("startRun should generate a run id when ctx has none")
+	}
+}
+
+func TestRunRecordsRunID(t *testing.T) {
+	f := newFakeS3()
+	var notified []Notification
+	h := newTestHandler(f, 7)
+	h.notifier = func(_ context.Context, n Notification) error {
+		notified = append(notified, n)
+		return nil
+	}
+
+	res, err := h.Run(WithRunID(context.Background(), "run-1"), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.RunID != "run-1" {
+		t.Errorf("result run_id = %q, want run-1", res.RunID)
+	}
+	for _, key := range []string{res.Key, "monthly/2026-05-backup.sql", "yearly/2026-backup.sql"} {
+		if got := f.objects[key].metadata["run-id"]; got != "run-1" {
+			t.Errorf("%s run-id metadata = %q, want run-1", key, got)
+		}
+	}
+
+	h.notify(WithRunID(context.Background(), "run-2"), Notification{Event: "x"})
+	if len(notified) != 1 || notified[0].RunID != "run-2" {
+		t.Errorf("notifications = %+v, want one tagged run-2", notified)
+	}
+}
+
+func TestDispatchErrorCarriesRunID(t *testing.T) {
+	e := eventHandler(newFakeS3(), "secret", failingDump(errors.New("boom")))
+
+	_, err := e.Dispatch(WithRunID(context.Background(), "run-3"), json.RawMessage(`{}`))
+	if err == nil || !strings.Contains(err.Error(), "run run-3") {
+		t.Errorf("error = %v, want it to name run run-3", err)
+	}
+
+	raw, _ := json.Marshal(httpRequest(map[string]string{"x-api-key": "secret"}, nil))
+	out, _ := e.Dispatch(WithRunID(context.Background(), "run-4"), raw)
+	var body map[string]string
+	_ = json.Unmarshal([]byte(out.(events.APIGatewayV2HTTPResponse).Body), &body)
+	if body["run_id"] != "run-4" {
+		t.Errorf("error body = %v, want run_id run-4", body)
+	}
+}
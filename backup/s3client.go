@@ -0,0 +1,251 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// S3Tuning sets the retries and time limits of S3 requests, per operation
+// (e.g. "PutObject") or for all of them. Apply it to a client with Options.
+type S3Tuning struct {
+	MaxAttempts map[string]int           // attempts per operation, retries included; "" is the default, else the SDK's 3
+	Timeouts    map[string]time.Duration // time limit per operation, retries included; "" is the default, else none
+}
+
+// ParseS3Tuning parses the S3_MAX_ATTEMPTS and S3_TIMEOUTS settings: comma-
+// separated values, each either bare, the default, or "Operation=value", such
+// as "5,PutObject=8" and "30s,GetObject=10m".
+func ParseS3Tuning(maxAttempts, timeouts string) (S3Tuning, error) {
+	var t S3Tuning
+	err := parseOperationValues(maxAttempts, func(op, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid attempts %q for %s: want a positive number", v, operationName(op))
+		}
+		if t.MaxAttempts == nil {
+			t.MaxAttempts = map[string]int{}
+		}
+		t.MaxAttempts[op] = n
+		return nil
+	})
+	if err != nil {
+		return t, err
+	}
+	err = parseOperationValues(timeouts, func(op, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q for %s: want a positive duration such as 30s", v, operationName(op))
+		}
+		if t.Timeouts == nil {
+			t.Timeouts = map[string]time.Duration{}
+		}
+		t.Timeouts[op] = d
+		return nil
+	})
+	return t, err
+}
+
+// parseOperationValues calls set with each operation and value in s.
+func parseOperationValues(s string, set func(op, v string) error) error {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		op, v, ok := strings.Cut(entry, "=")
+		if !ok {
+			op, v = "", entry
+		}
+		if err := set(strings.TrimSpace(op), strings.TrimSpace(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func operationName(op string) string {
+	if op == "" {
+		return "the default"
+	}
+	return op
+}
+
+// lookup returns the value for op in m, or the default.
+func lookup[V any](m map[string]V, op string) (V, bool) {
+	if v, ok := m[op]; ok {
+		return v, true
+	}
+	v, ok := m[""]
+	return v, ok
+}
+
+// Options applies t to a client and records, for the run in each request's
+// context (see S3Stats), how many attempts it took and how many were
+// throttled; every retry is also logged. Use it as an s3.NewFromConfig
+// option.
+func (t S3Tuning) Options(o *s3.Options) {
+	if n, ok := t.MaxAttempts[""]; ok {
+		o.RetryMaxAttempts = n
+	}
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		op := stack.ID()
+		if n, ok := t.MaxAttempts[op]; ok {
+			// o is the client's options, their retryer resolved by now.
+			retryer := retry.AddWithMaxAttempts(o.Retryer, n)
+			if _, err := stack.Finalize.Swap((&retry.Attempt{}).ID(), retry.NewAttemptMiddleware(retryer, smithyhttp.RequestCloner)); err != nil {
+				return err
+			}
+		}
+		if d, ok := lookup(t.Timeouts, op); ok {
+			if err := stack.Initialize.Add(operationTimeout(d), middleware.Before); err != nil {
+				return err
+			}
+		}
+		return stack.Initialize.Add(recordAttempts(op), middleware.Before)
+	})
+}
+
+// operationTimeout bounds an operation, its retries included, by d. The body
+// of a GetObject response is read under the same limit.
+func operationTimeout(d time.Duration) middleware.InitializeMiddleware {
+	return middleware.InitializeMiddlewareFunc("OperationTimeout", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		out, md, err := next.HandleInitialize(ctx, in)
+		if get, ok := out.Result.(*s3.GetObjectOutput); ok && err == nil {
+			body := get.Body
+			get.Body = readCloser{body, closerFunc(func() error {
+				defer cancel()
+				return body.Close()
+			})}
+			return out, md, err
+		}
+		cancel()
+		return out, md, err
+	})
+}
+
+// recordAttempts counts the attempts of each call of op and logs its retries.
+func recordAttempts(op string) middleware.InitializeMiddleware {
+	return middleware.InitializeMiddlewareFunc("RecordAttempts", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		out, md, err := next.HandleInitialize(ctx, in)
+		results, _ := retry.GetAttemptResults(md)
+		counts := S3Counts{Requests: 1}
+		for i, a := range results.Results {
+			if !a.Retried {
+				if a.Err != nil && a.Retryable {
+					counts.GaveUp++ // out of attempts
+				}
+				continue
+			}
+			counts.Retries++
+			throttled := isThrottle(a.Err)
+			if throttled {
+				counts.Throttles++
+			}
+			logf(ctx, "S3 retry: operation=%s attempt=%d throttled=%t error=%q", op, i+1, throttled, a.Err)
+		}
+		if s := s3StatsFrom(ctx); s != nil {
+			s.add(op, counts)
+		}
+		return out, md, err
+	})
+}
+
+// isThrottle reports whether err is S3 asking for fewer requests. Besides the
+// SDK's throttling error codes, that is any 503 response: S3 answers 503 Slow
+// Down, which HEAD responses return without a body to carry the code.
+func isThrottle(err error) bool {
+	var status interface{ HTTPStatusCode() int }
+	if errors.As(err, &status) && status.HTTPStatusCode() == http.StatusServiceUnavailable {
+		return true
+	}
+	return retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err).Bool()
+}
+
+// S3Counts counts the S3 requests of one operation.
+type S3Counts struct {
+	Requests  int `json:"requests"`  // calls made, each one or more attempts
+	Retries   int `json:"retries"`   // attempts that failed and were retried
+	Throttles int `json:"throttles"` // retried attempts S3 throttled (e.g. 503 SlowDown)
+	GaveUp    int `json:"gave_up"`   // calls that ran out of attempts on an error that could be retried
+}
+
+// S3Stats collects the S3Counts of a run by operation, for requests made
+// through a client set up with S3Tuning.Options.
+type S3Stats struct {
+	mu  sync.Mutex
+	ops map[string]S3Counts
+}
+
+func (s *S3Stats) add(op string, c S3Counts) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ops == nil {
+		s.ops = map[string]S3Counts{}
+	}
+	sum := s.ops[op]
+	sum.Requests += c.Requests
+	sum.Retries += c.Retries
+	sum.Throttles += c.Throttles
+	sum.GaveUp += c.GaveUp
+	s.ops[op] = sum
+}
+
+// counts returns a copy of the counts by operation, logging their totals when
+// any request was retried.
+func (s *S3Stats) counts(ctx context.Context) map[string]S3Counts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ops) == 0 {
+		return nil
+	}
+	var total S3Counts
+	out := make(map[string]S3Counts, len(s.ops))
+	for op, c := range s.ops {
+		out[op] = c
+		total.Requests += c.Requests
+		total.Retries += c.Retries
+		total.Throttles += c.Throttles
+		total.GaveUp += c.GaveUp
+	}
+	if total.Retries > 0 || total.GaveUp > 0 {
+		logf(ctx, "S3 requests: requests=%d retries=%d throttles=%d gave_up=%d", total.Requests, total.Retries, total.Throttles, total.GaveUp)
+	}
+	return out
+}
+
+// s3StatsKey is the context key under which a run's S3Stats are stored.
+type s3StatsKey struct{}
+
+func withS3Stats(ctx context.Context) (context.Context, *S3Stats) {
+	s := &S3Stats{}
+	return context.WithValue(ctx, s3StatsKey{}, s), s
+}
+
+// s3StatsFrom returns the S3Stats stored in ctx, or nil.
+func s3StatsFrom(ctx context.Context) *S3Stats {
+	s, _ := ctx.Value(s3StatsKey{}).(*S3Stats)
+	return s
+}
+
+// sortedOperations returns the operations of counts in order.
+func sortedOperations(counts map[string]S3Counts) []string {
+	ops := make([]string, 0, len(counts))
+	for op := range counts {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	return ops
+}
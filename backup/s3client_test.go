@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestParseS3Tuning(t *testing.T) {
+	got, err := ParseS3Tuning("5, PutObject=8", "30s,GetObject=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MaxAttempts[""] != 5 || got.MaxAttempts["PutObject"] != 8 || got.Timeouts[""] != 30*time.Second || got.Timeouts["GetObject"] != 10*time.Minute {
+		t.Errorf("ParseS3Tuning = %+v", got)
+	}
+	if got, err := ParseS3Tuning("", ""); err != nil || got.MaxAttempts != nil || got.Timeouts != nil {
+		t.Errorf("empty settings = %+v, %v; want no tuning", got, err)
+	}
+	for _, bad := range [][2]string{{"0", ""}, {"PutObject=x", ""}, {"", "GetObject=-1s"}, {"", "soon"}} {
+		if _, err := ParseS3Tuning(bad[0], bad[1]); err == nil {
+			t.Errorf("ParseS3Tuning(%q, %q) should fail", bad[0], bad[1])
+		}
+	}
+}
+
+// throttlingServer answers each request with 503 SlowDown until failures
+// have been sent, then with an empty object after delay.
+func throttlingServer(t *testing.T, failures int32, delay time.Duration) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+		w.Header().Set("Content-Length", "0")
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func tunedClient(srv *httptest.Server, tuning S3Tuning) *s3.Client {
+	return s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+		Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+		}),
+	}, tuning.Options)
+}
+
+func TestS3TuningCountsRetries(t *testing.T) {
+	srv, _ := throttlingServer(t, 2, 0)
+	client := tunedClient(srv, S3Tuning{})
+	ctx, stats := withS3Stats(context.Background())
+	if _, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("b"), Key: aws.String("k")}); err != nil {
+		t.Fatalf("HeadObject should succeed on its third attempt: %v", err)
+	}
+	if got := stats.counts(ctx)["HeadObject"]; got != (S3Counts{Requests: 1, Retries: 2, Throttles: 2}) {
+		t.Errorf("counts = %+v", got)
+	}
+}
+
+func TestS3TuningMaxAttempts(t *testing.T) {
+	srv, calls := throttlingServer(t, 1, 0)
+	client := tunedClient(srv, S3Tuning{MaxAttempts: map[string]int{"HeadObject": 1}})
+	ctx, stats := withS3Stats(context.Background())
+	if _, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("b"), Key: aws.String("k")}); err == nil {
+		t.Fatal("a single attempt should fail")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d attempts, want 1", n)
+	}
+	if got := stats.counts(ctx)["HeadObject"]; got != (S3Counts{Requests: 1, GaveUp: 1}) {
+		t.Errorf("counts = %+v", got)
+	}
+
+	// Other operations keep the default attempts.
+	if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("b"), Key: aws.String("k")}); err != nil {
+		t.Errorf("DeleteObject: %v", err)
+	}
+}
+
+func TestS3TuningTimeouts(t *testing.T) {
+	srv, _ := throttlingServer(t, 0, time.Second)
+	client := tunedClient(srv, S3Tuning{Timeouts: map[string]time.Duration{"HeadObject": 50 * time.Millisecond}})
+	start := time.Now()
+	if _, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("b"), Key: aws.String("k")}); err == nil {
+		t.Fatal("HeadObject should time out")
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("HeadObject took %s despite its 50ms timeout", took)
+	}
+}
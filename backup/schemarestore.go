@@ -0,0 +1,54 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// schemaRestoreScripts returns the statements a Restore with
+// RestoreOptions.Schema runs before and after the dump of schema: in one
+// transaction, the schema is dropped with what it contains and recreated by
+// the dump, so a failing statement leaves the tenant as it was.
+func schemaRestoreScripts(schema string) (before, after string) {
+	return "BEGIN;\nDROP SCHEMA IF EXISTS " + quoteIdent(schema) + " CASCADE;\n", "COMMIT;\n"
+}
+
+// checkSchemaRestore returns why the backup stored at key cannot be restored
+// as schema alone (see RestoreOptions.Schema), or nil. It reads the backup,
+// which must be a plain script, through once: every object it creates must
+// be schema itself, its comment or grants, or in it, as in the dumps of
+// TenantRegistry.Schemas, so restoring it touches no other schema.
+func (h *Handler) checkSchemaRestore(ctx context.Context, key, schema string) error {
+	if schema == "public" || schema == "information_schema" || strings.HasPrefix(schema, "pg_") {
+		return invalidInput(fmt.Errorf("refusing to restore schema %s on its own", schema))
+	}
+	body, err := h.openScript(ctx, key)
+	if err != nil {
+		return invalidInput(fmt.Errorf("cannot restore schema %s: %w", schema, err))
+	}
+	defer func() { _ = body.Close() }()
+
+	created, foreign := false, ""
+	w := &tocWatcher{object: func(name, typ, in string) {
+		switch {
+		case in == schema:
+		case in == "-" && typ == "SCHEMA" && name == schema:
+			created = true
+		case in == "-" && name == "SCHEMA "+dumpIdent(schema):
+		case foreign == "":
+			foreign = tocComment([]string{"", name, typ, in})
+		}
+	}}
+	if _, err := io.Copy(w, body); err != nil {
+		return fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	switch {
+	case foreign != "":
+		return invalidInput(fmt.Errorf("refusing to restore schema %s from %s: it also restores %s", schema, key, foreign))
+	case !created:
+		return invalidInput(fmt.Errorf("refusing to restore schema %s from %s: it does not create the schema", schema, key))
+	}
+	return nil
+}
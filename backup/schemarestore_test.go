@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tenantSchemaDump is the plain dump of schema tenant_acme alone, as
+// pg_dump -n writes it.
+const tenantSchemaDump = "SET statement_timeout = 0;\n" +
+	"--\n-- Name: tenant_acme; Type: SCHEMA; Schema: -; Owner: app\n--\n\nCREATE SCHEMA tenant_acme;\n" +
+	"--\n-- Name: SCHEMA tenant_acme; Type: COMMENT; Schema: -; Owner: app\n--\n\nCOMMENT ON SCHEMA tenant_acme IS 'acme';\n" +
+	"--\n-- Name: users; Type: TABLE; Schema: tenant_acme; Owner: app\n--\n\nCREATE TABLE tenant_acme.users ();\n" +
+	"--\n-- Data for Name: users; Type: TABLE DATA; Schema: tenant_acme; Owner: app\n--\n\nCOPY tenant_acme.users FROM stdin;\n\\.\n"
+
+func TestRestoreSchema(t *testing.T) {
+	f := newFakeS3()
+	key := "tenants/tenant_acme/daily/2026-05-27-backup.sql"
+	f.seed(key, []byte(tenantSchemaDump), time.Time{})
+	manifest, _ := json.Marshal(Manifest{Key: key, ExtensionSteps: restoreSteps([]string{"timescaledb"})})
+	f.seed(manifestKey(key), manifest, time.Time{})
+	var calls []restoreCall
+	var exitOnError bool
+	h := newTestHandler(f, 7)
+	h.db.Database = "app"
+	record := recordingRestorer(&calls, func(string) RestoreStats { return RestoreStats{} })
+	h.restore = func(ctx context.Context, db DatabaseConfig, format string, r io.Reader, opts RestoreOptions) (RestoreStats, error) {
+		exitOnError = opts.ExitOnError
+		return record(ctx, db, format, r, opts)
+	}
+
+	res, err := h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget, Schema: "tenant_acme"})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	want := "BEGIN;\nDROP SCHEMA IF EXISTS \"tenant_acme\" CASCADE;\n" + tenantSchemaDump + "COMMIT;\n"
+	if len(calls) != 1 || calls[0].body != want || !exitOnError {
+		t.Errorf("calls = %+v (exit on error %v), want only the dump in a transaction dropping the schema", calls, exitOnError)
+	}
+	if res.Schema != "tenant_acme" {
+		t.Errorf("result = %+v", res)
+	}
+
+	// The database backed up needs its name confirmed.
+	source := DatabaseConfig{Host: "localhost", Database: "app"}
+	calls = nil
+	if _, err := h.Restore(context.Background(), key, RestoreOptions{Target: source, Schema: "tenant_acme"}); err == nil || failureClass(err) != ClassInvalid || len(calls) != 0 {
+		t.Errorf("unconfirmed source: Restore = %v after %d scripts, want a refusal", err, len(calls))
+	}
+	if _, err := h.Restore(context.Background(), key, RestoreOptions{Target: source, Schema: "tenant_acme", Confirm: "app"}); err != nil || len(calls) != 1 {
+		t.Errorf("confirmed source: Restore = %v after %d scripts", err, len(calls))
+	}
+}
+
+func TestRestoreSchemaRejects(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.restore = func(context.Context, DatabaseConfig, string, io.Reader, RestoreOptions) (RestoreStats, error) {
+		t.Error("nothing should be restored")
+		return RestoreStats{}, nil
+	}
+	for name, c := range map[string]struct {
+		dump, schema, want string
+	}{
+		"other schema":  {tenantSchemaDump + "--\n-- Name: orders; Type: TABLE; Schema: public; Owner: app\n--\n", "tenant_acme", "also restores TABLE public.orders"},
+		"extension":     {tenantSchemaDump + "--\n-- Name: pgcrypto; Type: EXTENSION; Schema: -; Owner: -\n--\n", "tenant_acme", "also restores EXTENSION pgcrypto"},
+		"wrong schema":  {tenantSchemaDump, "tenant_other", "also restores SCHEMA tenant_acme"},
+		"no schema":     {"--\n-- Name: users; Type: TABLE; Schema: tenant_acme; Owner: app\n--\n", "tenant_acme", "does not create the schema"},
+		"public":        {tenantSchemaDump, "public", "on its own"},
+		"system schema": {tenantSchemaDump, "pg_catalog", "on its own"},
+		"archive":       {string(sampleArchive(0, "toc")), "tenant_acme", "not a SQL script"},
+	} {
+		key := "tenants/t/daily/2026-05-27-backup.sql"
+		f.seed(key, []byte(c.dump), time.Time{})
+		_, err := h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget, Schema: c.schema})
+		if err == nil || failureClass(err) != ClassInvalid || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: err = %v, want an invalid input error naming %q", name, err, c.want)
+		}
+	}
+}
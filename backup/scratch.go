@@ -0,0 +1,40 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// scratchSchemaQuery lists the schemas matching any of the LIKE conditions
+// %s, leaving out the system ones.
+const scratchSchemaQuery = `SELECT nspname FROM pg_catalog.pg_namespace
+WHERE (%s) AND nspname NOT LIKE 'pg\_%%' AND nspname <> 'information_schema'
+ORDER BY nspname`
+
+// scratchSchemas returns the schemas of the database matching the globs of
+// Config.ScratchSchemas, which runs leave out of the dump. They are looked
+// up in the catalog, rather than passed to pg_dump as patterns, so
+// everything else that honors DumpOptions.ExcludeSchemas, such as the
+// materialized views skipped, sees them as well.
+func (h *Handler) scratchSchemas(ctx context.Context) ([]string, error) {
+	if len(h.scratch) == 0 {
+		return nil, nil
+	}
+	conds := make([]string, len(h.scratch))
+	for i, glob := range h.scratch {
+		conds[i] = fmt.Sprintf(`nspname LIKE %s ESCAPE '\'`, quoteLiteral(globToLike(glob)))
+	}
+	rows, err := h.query(ctx, h.db, fmt.Sprintf(scratchSchemaQuery, strings.Join(conds, " OR ")))
+	if err != nil {
+		return nil, err
+	}
+	var schemas []string
+	for _, row := range rows {
+		if len(row) != 1 {
+			return nil, fmt.Errorf("unexpected schema row %q", row)
+		}
+		schemas = append(schemas, row[0])
+	}
+	return schemas, nil
+}
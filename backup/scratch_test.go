@@ -0,0 +1,41 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRunSkipsScratchSchemas(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.scratch = []string{"tmp_*", "scratch"}
+	h.dumpOpts = DumpOptions{ExcludeSchemas: []string{"auth"}}
+	var opts DumpOptions
+	h.dump = recordingDump([]byte("dump"), &opts)
+	var lookup string
+	h.query = func(_ context.Context, _ DatabaseConfig, q string) ([][]string, error) {
+		if strings.Contains(q, "pg_namespace") {
+			lookup = q
+			return [][]string{{"scratch"}, {"tmp_import"}}, nil
+		}
+		return nil, nil
+	}
+
+	if _, err := h.Run(context.Background(), RunOptions{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !strings.Contains(lookup, `nspname LIKE 'tmp\_%' ESCAPE '\' OR nspname LIKE 'scratch' ESCAPE '\'`) {
+		t.Errorf("schema lookup = %s", lookup)
+	}
+	if want := []string{"auth", "scratch", "tmp_import"}; !slices.Equal(opts.ExcludeSchemas, want) {
+		t.Errorf("ExcludeSchemas = %q, want %q", opts.ExcludeSchemas, want)
+	}
+
+	h.query = func(context.Context, DatabaseConfig, string) ([][]string, error) { return nil, errors.New("down") }
+	if _, err := h.Run(context.Background(), RunOptions{Force: true}); err == nil {
+		t.Error("Run succeeded without listing the scratch schemas")
+	}
+}
@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// SecretFetcher returns the current value of the secret id.
+type SecretFetcher func(ctx context.Context, id string) (string, error)
+
+// SecretsManager returns a SecretFetcher that reads the SecretString of
+// secrets from AWS Secrets Manager with cfg's credentials and region, calling
+// GetSecretValue over its JSON API (cfg.BaseEndpoint, when set, replaces the
+// regional endpoint). id is a secret name or ARN.
+func SecretsManager(cfg aws.Config) SecretFetcher {
+	call := awsJSONAPI(cfg, "secretsmanager")
+	return func(ctx context.Context, id string) (string, error) {
+		var out struct{ SecretString *string }
+		if err := call(ctx, "secretsmanager.GetSecretValue", map[string]string{"SecretId": id}, &out); err != nil {
+			return "", fmt.Errorf("failed to read secret %s: %w", id, err)
+		}
+		if out.SecretString == nil {
+			return "", fmt.Errorf("secret %s has no string value", id)
+		}
+		return *out.SecretString, nil
+	}
+}
+
+// awsJSONAPI returns a function calling operations of the AWS JSON 1.1 API of
+// service, such as "secretsmanager" or "kms", with cfg's credentials and
+// region: it sends in as the JSON body of a signed request for the operation
+// target (its X-Amz-Target header) and decodes the response into out. The endpoint is the service's regional one
+// unless cfg.BaseEndpoint is set. An error response is returned as its code
+// and message.
+func awsJSONAPI(cfg aws.Config, service string) func(ctx context.Context, target string, in, out any) error {
+	endpoint := "https://" + service + "." + cfg.Region + ".amazonaws.com/"
+	if cfg.BaseEndpoint != nil {
+		endpoint = aws.ToString(cfg.BaseEndpoint)
+	}
+	var client aws.HTTPClient = http.DefaultClient
+	if cfg.HTTPClient != nil {
+		client = cfg.HTTPClient
+	}
+	signer := v4.NewSigner()
+	return func(ctx context.Context, target string, in, out any) error {
+		body, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+		req.Header.Set("X-Amz-Target", target)
+		creds, err := cfg.Credentials.Retrieve(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve credentials: %w", err)
+		}
+		hash := sha256.Sum256(body)
+		if err := signer.SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), service, cfg.Region, time.Now()); err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= 300 {
+			var e struct {
+				Type    string `json:"__type"`
+				Message string `json:"message"`
+			}
+			_ = json.Unmarshal(data, &e)
+			// __type is "<namespace>#<code>" or just the code.
+			code := e.Type[strings.LastIndex(e.Type, "#")+1:]
+			if code == "" {
+				code = fmt.Sprintf("status %d", resp.StatusCode)
+			}
+			return fmt.Errorf("%s: %s", code, e.Message)
+		}
+		return json.Unmarshal(data, out)
+	}
+}
@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestSecretsManager(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "secretsmanager.GetSecretValue" {
+			t.Errorf("target = %q", target)
+		}
+		if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "/us-west-1/secretsmanager/aws4_request") {
+			t.Errorf("authorization = %q", auth)
+		}
+		var in struct{ SecretId string }
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		if in.SecretId != "webhook" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"com.amazonaws.secretsmanager#ResourceNotFoundException","message":"Secrets Manager can't find the specified secret."}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"Name":"webhook","SecretString":"https://hooks.example.com/x"}`))
+	}))
+	defer srv.Close()
+
+	fetch := SecretsManager(aws.Config{
+		Region:       "us-west-1",
+		BaseEndpoint: aws.String(srv.URL),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+	})
+	ctx := context.Background()
+	if v, err := fetch(ctx, "webhook"); err != nil || v != "https://hooks.example.com/x" {
+		t.Errorf("fetch = %q, %v", v, err)
+	}
+	if _, err := fetch(ctx, "missing"); err == nil || !strings.Contains(err.Error(), "ResourceNotFoundException") {
+		t.Errorf("missing secret: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// restoreSections are the sections of an archive, as pg_restore --section
+// names them, in the order RestoreOptions.Sections restores them.
+var restoreSections = []string{"pre-data", "data", "post-data"}
+
+// checkpointPrefix holds the checkpoints of restores by section (see
+// restoreCheckpoint), one object per backup and target.
+const checkpointPrefix = statePrefix + "restores/"
+
+// restoreCheckpoint is what is kept about a restore by section while it runs:
+// the steps completed so far, sections and table slices, in order. It is
+// stored under checkpointPrefix after each step and deleted once the restore
+// completes, so a restore that fails leaves it for RestoreOptions.Resume.
+type restoreCheckpoint struct {
+	Key       string    `json:"key"`
+	Target    string    `json:"target"`
+	Completed []string  `json:"completed"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	h       *Handler
+	path    string
+	stored  bool     // whether path holds the checkpoint
+	skipped []string // steps skipped, completed by an earlier restore
+}
+
+// checkpointKey returns where the checkpoint of the restore of key into
+// target is stored.
+func checkpointKey(key string, target DatabaseConfig) string {
+	return checkpointPrefix + checksum([]byte(key + "\n" + connName(target)))[:16] + ".json"
+}
+
+// openCheckpoint returns the checkpoint of a restore of key into target by
+// section: a new one, or with resume the one an earlier restore that failed
+// left, which must exist.
+func (h *Handler) openCheckpoint(ctx context.Context, key string, target DatabaseConfig, resume bool) (*restoreCheckpoint, error) {
+	ck := &restoreCheckpoint{Key: key, Target: connName(target), h: h, path: checkpointKey(key, target)}
+	if !resume {
+		return ck, nil
+	}
+	if err := h.readJSON(ctx, ck.path, ck); err != nil {
+		return nil, fmt.Errorf("failed to read the restore checkpoint: %w", err)
+	}
+	if len(ck.Completed) == 0 {
+		return nil, invalidInput(fmt.Errorf("found no interrupted restore of %s into %s to resume", key, ck.Target))
+	}
+	ck.stored = true
+	logf(ctx, "Resuming the restore of %s into %s after %s, completed %s", key, ck.Target, strings.Join(ck.Completed, ", "), ck.UpdatedAt.UTC().Format(time.RFC3339))
+	return ck, nil
+}
+
+// done reports whether step was completed by an earlier restore. A nil
+// checkpoint has none.
+func (ck *restoreCheckpoint) done(step string) bool {
+	if ck == nil {
+		return false
+	}
+	for _, s := range ck.Completed {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// skip reports whether step was completed by an earlier restore, recording
+// that it is skipped.
+func (ck *restoreCheckpoint) skip(ctx context.Context, step string) bool {
+	if !ck.done(step) {
+		return false
+	}
+	ck.skipped = append(ck.skipped, step)
+	logf(ctx, "Skipping %s, restored before", step)
+	return true
+}
+
+// completed records that step was restored. A checkpoint that cannot be
+// stored only means a failure later in the restore cannot be resumed from
+// it, so it is logged and the restore goes on.
+func (ck *restoreCheckpoint) completed(ctx context.Context, step string) {
+	if ck == nil {
+		return
+	}
+	ck.Completed = append(ck.Completed, step)
+	ck.UpdatedAt = ck.h.now().UTC()
+	if err := ck.h.writeJSON(ctx, ck.path, ck); err != nil {
+		logf(ctx, "Warning: failed to store the restore checkpoint %s: %v", ck.path, err)
+		return
+	}
+	ck.stored = true
+}
+
+// failed returns err, the failure of a step, saying how to go on after the
+// steps completed when there are any.
+func (ck *restoreCheckpoint) failed(err error) error {
+	if ck == nil || !ck.stored {
+		return err
+	}
+	return fmt.Errorf("%w; %s are restored, resume (-resume, or resume when invoked) to go on after them", err, strings.Join(ck.Completed, ", "))
+}
+
+// finish deletes the checkpoint of a restore that completed.
+func (ck *restoreCheckpoint) finish(ctx context.Context) {
+	if ck == nil || !ck.stored {
+		return
+	}
+	if _, err := ck.h.s3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(ck.h.bucket), Key: aws.String(ck.path)}); err != nil {
+		logf(ctx, "Warning: failed to delete the restore checkpoint %s: %v", ck.path, err)
+	}
+}
+
+// restoreBySection restores the archive at key one section at a time with
+// restore, skipping those ck records as done. The first section restored
+// reads dump; the others read the archive from the bucket again, through
+// progress. opts is the RestoreOptions restore passes to the Restorer.
+func (h *Handler) restoreBySection(ctx context.Context, key, format string, dump io.Reader, progress *progressTracker, ck *restoreCheckpoint, opts *RestoreOptions, restore func(what, format string, r io.Reader) error) error {
+	defer func() { opts.section = "" }()
+	for _, section := range restoreSections {
+		if ck.skip(ctx, section) {
+			continue
+		}
+		if dump == nil {
+			body, err := h.openObject(ctx, key)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", key, err)
+			}
+			defer func() { _ = body.Close() }()
+			dump = progress.reader(body)
+		}
+		logf(ctx, "Restoring the %s section of %s", section, key)
+		opts.section = section
+		if err := restore(key+" ("+section+")", format, dump); err != nil {
+			return ck.failed(err)
+		}
+		ck.completed(ctx, section)
+		dump = nil
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreSectionsResume(t *testing.T) {
+	f := newFakeS3()
+	key := "daily/2026-05-27-backup.sql"
+	sliceKey := "daily/2026-05-27-backup.slice-public.events-0000.sql"
+	archive := sampleArchive(0, "toc")
+	f.seed(key, archive, time.Time{})
+	f.seed(sliceKey, []byte("COPY public.events FROM stdin;\n\\.\n"), time.Time{})
+	manifest, _ := json.Marshal(Manifest{Key: key, Slices: []Slice{{Table: "public.events", Key: sliceKey}}})
+	f.seed(manifestKey(key), manifest, time.Time{})
+
+	var restored []string
+	failSlice := true
+	h := newTestHandler(f, 7)
+	h.restore = func(_ context.Context, _ DatabaseConfig, format string, r io.Reader, opts RestoreOptions) (RestoreStats, error) {
+		body, _ := io.ReadAll(r)
+		if opts.section != "" && string(body) != string(archive) {
+			t.Errorf("section %s read %d bytes, want the whole archive", opts.section, len(body))
+		}
+		if strings.HasPrefix(string(body), "COPY public.events") {
+			if failSlice {
+				return RestoreStats{}, errors.New("connection lost")
+			}
+			restored = append(restored, "slice")
+			return RestoreStats{}, nil
+		}
+		restored = append(restored, opts.section)
+		return RestoreStats{}, nil
+	}
+
+	_, err := h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget, Sections: true})
+	if err == nil || !strings.Contains(err.Error(), "pre-data, data, post-data are restored") {
+		t.Fatalf("Restore = %v, want the slice failure naming the sections restored", err)
+	}
+	if strings.Join(restored, "|") != "pre-data|data|post-data" {
+		t.Errorf("restored %q", restored)
+	}
+	if _, ok := f.objects[checkpointKey(key, restoreTarget)]; !ok {
+		t.Fatal("no checkpoint stored")
+	}
+
+	restored, failSlice = nil, false
+	res, err := h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget, Resume: true})
+	if err != nil {
+		t.Fatalf("resumed Restore: %v", err)
+	}
+	if strings.Join(restored, "|") != "slice" || strings.Join(res.Resumed, "|") != "pre-data|data|post-data" {
+		t.Errorf("resumed: restored %q, skipped %q", restored, res.Resumed)
+	}
+	if _, ok := f.objects[checkpointKey(key, restoreTarget)]; ok {
+		t.Error("checkpoint kept after the restore completed")
+	}
+
+	if _, err := h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget, Resume: true}); err == nil || failureClass(err) != ClassInvalid {
+		t.Errorf("nothing to resume: err = %v, want an invalid input error", err)
+	}
+	f.seed(key, []byte("CREATE TABLE users ();\n"), time.Time{})
+	if _, err := h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget, Sections: true}); err == nil || failureClass(err) != ClassInvalid {
+		t.Errorf("plain script by section: err = %v, want an invalid input error", err)
+	}
+}
@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// ManifestSigner returns the MAC of digest, the SHA-256 of a manifest as
+// stored. A MAC is deterministic, so a manifest is verified by signing it
+// again: whoever can write to the bucket but not use the key cannot produce
+// a manifest that verifies, and so cannot point a restore at other slices or
+// extension steps than the run recorded. The implementations are HMACSigner
+// and KMSSigner.
+type ManifestSigner func(ctx context.Context, digest []byte) ([]byte, error)
+
+// signatureMetadata is the metadata key of a manifest's signature, its MAC
+// in base64.
+const signatureMetadata = "signature"
+
+// Signature states of a manifest read with a ManifestSigner configured (see
+// ListEntry.Signature).
+const (
+	SignatureValid    = "valid"
+	SignatureUnsigned = "unsigned" // written without signing, or before manifests were signed
+	SignatureInvalid  = "invalid"
+)
+
+// HMACSigner returns a ManifestSigner computing HMAC-SHA256 with key.
+func HMACSigner(key []byte) ManifestSigner {
+	return func(_ context.Context, digest []byte) ([]byte, error) {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(digest)
+		return mac.Sum(nil), nil
+	}
+}
+
+// ParseManifestKey decodes a base64 HMAC manifest signing key of at least 32
+// bytes, such as one from "openssl rand -base64 32".
+func ParseManifestKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest key: %w", err)
+	}
+	if len(key) < 32 {
+		return nil, fmt.Errorf("invalid manifest key: got %d bytes, want at least 32", len(key))
+	}
+	return key, nil
+}
+
+// KMSSigner returns a ManifestSigner computing HMAC_SHA_256 with the KMS HMAC
+// key keyID (an ID, ARN or alias) by calling GenerateMac with cfg's
+// credentials and region (cfg.BaseEndpoint, when set, replaces the regional
+// endpoint). The key never leaves KMS; signing needs kms:GenerateMac on it.
+func KMSSigner(cfg aws.Config, keyID string) ManifestSigner {
+	call := awsJSONAPI(cfg, "kms")
+	return func(ctx context.Context, digest []byte) ([]byte, error) {
+		in := struct {
+			KeyId        string
+			MacAlgorithm string
+			Message      []byte
+		}{keyID, "HMAC_SHA_256", digest}
+		var out struct{ Mac []byte }
+		if err := call(ctx, "TrentService.GenerateMac", in, &out); err != nil {
+			return nil, fmt.Errorf("failed to sign with %s: %w", keyID, err)
+		}
+		if len(out.Mac) == 0 {
+			return nil, fmt.Errorf("failed to sign with %s: no MAC returned", keyID)
+		}
+		return out.Mac, nil
+	}
+}
+
+// signManifest returns the signature metadata of the manifest body, or ""
+// when manifests are not signed.
+func (h *Handler) signManifest(ctx context.Context, body []byte) (string, error) {
+	if h.signer == nil {
+		return "", nil
+	}
+	digest := sha256.Sum256(body)
+	mac, err := h.signer(ctx, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(mac), nil
+}
+
+// errManifestSignature reports a manifest whose signature does not match it.
+var errManifestSignature = errors.New("signature does not match; the manifest was modified or signed with another key")
+
+// verifyManifest returns the Signature state of the manifest body stored
+// with signature metadata sig, failing with errManifestSignature when it is
+// SignatureInvalid. It is "" when manifests are not signed.
+func (h *Handler) verifyManifest(ctx context.Context, body []byte, sig string) (string, error) {
+	switch {
+	case h.signer == nil:
+		return "", nil
+	case sig == "":
+		return SignatureUnsigned, nil
+	}
+	want, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return SignatureInvalid, errManifestSignature
+	}
+	digest := sha256.Sum256(body)
+	mac, err := h.signer(ctx, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to verify the signature: %w", err)
+	}
+	if !hmac.Equal(mac, want) {
+		return SignatureInvalid, errManifestSignature
+	}
+	return SignatureValid, nil
+}
@@ -0,0 +1,126 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+var testManifestKey = bytes.Repeat([]byte{0x5a}, 32)
+
+func TestManifestSigning(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.signer = HMACSigner(testManifestKey)
+	var calls []restoreCall
+	h.restore = recordingRestorer(&calls, func(string) RestoreStats { return RestoreStats{} })
+	ctx := context.Background()
+
+	res, err := h.Run(ctx, RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if f.objects[res.ManifestKey].metadata["signature"] == "" {
+		t.Fatal("manifest stored without a signature")
+	}
+	restored, err := h.Restore(ctx, res.Key, RestoreOptions{Target: restoreTarget})
+	if err != nil || restored.Signature != SignatureValid {
+		t.Fatalf("Restore = %+v, %v; want a valid signature", restored, err)
+	}
+	list, err := h.List(ctx, "daily/")
+	if err != nil || len(list.Backups) != 1 || list.Backups[0].Signature != SignatureValid {
+		t.Fatalf("List = %+v, %v", list, err)
+	}
+
+	// A manifest pointing the restore at an extra script no longer verifies.
+	obj := f.objects[res.ManifestKey]
+	var m Manifest
+	_ = json.Unmarshal(obj.body, &m)
+	m.Slices = []Slice{{Table: "public.users", Key: "daily/evil.sql"}}
+	obj.body, _ = json.MarshalIndent(m, "", "  ")
+	if _, err := h.Restore(ctx, res.Key, RestoreOptions{Target: restoreTarget, AllowUnsigned: true}); !errors.Is(err, errManifestSignature) {
+		t.Errorf("tampered manifest: Restore error = %v", err)
+	}
+	if list, _ := h.List(ctx, "daily/"); list.Backups[0].Signature != SignatureInvalid || list.Backups[0].Error == "" {
+		t.Errorf("tampered manifest: entry = %+v", list.Backups[0])
+	}
+
+	// A manifest signed for another backup is rejected as well.
+	other := "daily/2026-05-20-backup.sql"
+	f.seed(other, f.objects[res.Key].body, testNow)
+	m.Key, m.Slices = res.Key, nil
+	body, _ := json.MarshalIndent(m, "", "  ")
+	sig, _ := h.signManifest(ctx, body)
+	f.seed(manifestKey(other), body, testNow)
+	f.objects[manifestKey(other)].metadata = map[string]string{"signature": sig}
+	if _, err := h.Restore(ctx, other, RestoreOptions{Target: restoreTarget}); err == nil || !strings.Contains(err.Error(), "signed for "+res.Key) {
+		t.Errorf("manifest of another backup: Restore error = %v", err)
+	}
+
+	// Unsigned manifests are only restored when allowed.
+	delete(f.objects[manifestKey(other)].metadata, "signature")
+	if _, err := h.Restore(ctx, other, RestoreOptions{Target: restoreTarget}); failureClass(err) != ClassInvalid {
+		t.Errorf("unsigned manifest: Restore error = %v, want it refused", err)
+	}
+	restored, err = h.Restore(ctx, other, RestoreOptions{Target: restoreTarget, AllowUnsigned: true})
+	if err != nil || restored.Signature != SignatureUnsigned {
+		t.Errorf("unsigned manifest allowed: Restore = %+v, %v", restored, err)
+	}
+}
+
+func TestKMSSigner(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "TrentService.GenerateMac" {
+			t.Errorf("target = %q", target)
+		}
+		var in struct {
+			KeyId, MacAlgorithm string
+			Message             []byte
+		}
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		if in.KeyId != "alias/manifests" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"NotFoundException","message":"Alias is not found."}`))
+			return
+		}
+		if in.MacAlgorithm != "HMAC_SHA_256" || len(in.Message) != 32 {
+			t.Errorf("request = %+v", in)
+		}
+		mac, _ := HMACSigner(testManifestKey)(r.Context(), in.Message)
+		_ = json.NewEncoder(w).Encode(map[string]string{"Mac": base64.StdEncoding.EncodeToString(mac), "KeyId": in.KeyId})
+	}))
+	defer srv.Close()
+
+	cfg := aws.Config{
+		Region:       "us-west-1",
+		BaseEndpoint: aws.String(srv.URL),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+	}
+	h := newTestHandler(newFakeS3(), 7)
+	h.signer = KMSSigner(cfg, "alias/manifests")
+	ctx := context.Background()
+	sig, err := h.signManifest(ctx, []byte(`{"key":"daily/2026-05-27-backup.sql"}`))
+	if err != nil {
+		t.Fatalf("signManifest: %v", err)
+	}
+	// KMS computes the same HMAC as a local key would.
+	h.signer = HMACSigner(testManifestKey)
+	if state, err := h.verifyManifest(ctx, []byte(`{"key":"daily/2026-05-27-backup.sql"}`), sig); err != nil || state != SignatureValid {
+		t.Errorf("verifyManifest = %q, %v", state, err)
+	}
+
+	missing := KMSSigner(cfg, "alias/other")
+	if _, err := missing(ctx, make([]byte, 32)); err == nil || !strings.Contains(err.Error(), "NotFoundException") {
+		t.Errorf("missing key: %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// sliceMarker sits between a backup's key (without ".sql") and the table and
+// part of each of its slices, e.g.
+// "daily/2026-05-27-backup.slice-public.events-0003.sql".
+const sliceMarker = ".slice-"
+
+// SliceSpec asks for a large table's data to be dumped in ranges of one of its
+// columns instead of as part of the main dump. Each range is stored as its own
+// object next to the backup, so no single pg_dump has to hold, or finish
+// within the time budget with, the whole table.
+type SliceSpec struct {
+	Table  string // schema-qualified table, e.g. "public.events"
+	Column string // integer, numeric, date or timestamp column the ranges are taken over
+	Step   string // width of each range: a number for numeric columns, an interval such as "1 month" otherwise
+}
+
+// Slice is one stored range of a sliced table, as recorded in the backup's
+// Manifest. Slices are plain psql scripts holding a COPY of their rows; restore
+// them, in order, after the backup itself.
+type Slice struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	Part   int    `json:"part"`           // position among the table's slices, from 0
+	From   string `json:"from,omitempty"` // inclusive lower bound; "" for the first slice, which also holds NULLs
+	To     string `json:"to,omitempty"`   // exclusive upper bound; "" for the last slice
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// TableCopier runs a COPY ... TO STDOUT of query and returns its output, in
+// COPY's text format. The default implementation is PsqlCopy; tests inject
+// their own.
+type TableCopier func(ctx context.Context, db DatabaseConfig, query string) ([]byte, error)
+
+// PsqlCopy exports the rows of query through psql's COPY (query) TO STDOUT. It
+// is the default TableCopier used by New.
+func PsqlCopy(ctx context.Context, db DatabaseConfig, query string) ([]byte, error) {
+	psqlPath, env, err := pgTool("psql", db)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, psqlPath, append(connArgs(db),
+		"--no-psqlrc",
+		"-v", "ON_ERROR_STOP=1",
+		"-c", "COPY ("+query+") TO STDOUT",
+	)...)
+	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("psql failed: %w\nstderr: %s", err, Redact(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// slicePlan is a table to slice and the lower bounds of its ranges.
+type slicePlan struct {
+	spec   SliceSpec
+	table  string   // spec.Table, quoted
+	column string   // spec.Column, quoted
+	bounds []string // ascending; empty when the table has no rows
+}
+
+// planSlices returns a plan for every table in opts.Slices of at least
+// opts.SliceMinSize bytes, including indexes and TOAST data; smaller tables are
+// left to the main dump.
+func (h *Handler) planSlices(ctx context.Context, opts DumpOptions) ([]slicePlan, error) {
+	var plans []slicePlan
+	for _, spec := range opts.Slices {
+		p := slicePlan{spec: spec, table: quoteQualified(spec.Table), column: quoteIdent(spec.Column)}
+		if opts.SliceMinSize > 0 {
+			rows, err := h.query(ctx, h.db, fmt.Sprintf("SELECT pg_total_relation_size(%s::regclass)", quoteLiteral(p.table)))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", spec.Table, err)
+			}
+			if len(rows) != 1 || len(rows[0]) != 1 {
+				return nil, fmt.Errorf("%s: unexpected size row %q", spec.Table, rows)
+			}
+			size, err := strconv.ParseInt(rows[0][0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid size %q", spec.Table, rows[0][0])
+			}
+			if size < opts.SliceMinSize {
+				logf(ctx, "Not slicing %s: %s is below the threshold", spec.Table, HumanizeSize(int(size)))
+				continue
+			}
+		}
+		rows, err := h.query(ctx, h.db, fmt.Sprintf("SELECT b FROM generate_series((SELECT min(%[1]s) FROM %[2]s), (SELECT max(%[1]s) FROM %[2]s), %[3]s) AS b",
+			p.column, p.table, sliceStep(spec.Step)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.Table, err)
+		}
+		for _, row := range rows {
+			p.bounds = append(p.bounds, row[0])
+		}
+		plans = append(plans, p)
+	}
+	return plans, nil
+}
+
+// sliceStep renders step as the step argument of generate_series: numbers as
+// they are, anything else as an interval.
+func sliceStep(step string) string {
+	if _, err := strconv.ParseFloat(step, 64); err == nil {
+		return step
+	}
+	return "interval " + quoteLiteral(step)
+}
+
+// ranges returns the lower and upper bound of each of p's slices ("" where
+// unbounded): the first slice reaches down to, and also holds, NULLs and the
+// last is open-ended, so rows inserted while the slices are dumped still fall
+// in one.
+func (p slicePlan) ranges() [][2]string {
+	if len(p.bounds) <= 1 {
+		return [][2]string{{"", ""}}
+	}
+	ranges := make([][2]string, len(p.bounds))
+	for i := range p.bounds {
+		if i > 0 {
+			ranges[i][0] = p.bounds[i]
+		}
+		if i+1 < len(p.bounds) {
+			ranges[i][1] = p.bounds[i+1]
+		}
+	}
+	return ranges
+}
+
+// sliceQuery returns the query selecting the rows of p between from and to.
+func (p slicePlan) sliceQuery(from, to string) string {
+	var conds []string
+	if from != "" {
+		conds = append(conds, fmt.Sprintf("%s >= %s", p.column, quoteLiteral(from)))
+	}
+	if to != "" {
+		cond := fmt.Sprintf("%s < %s", p.column, quoteLiteral(to))
+		if from == "" {
+			cond = fmt.Sprintf("(%s OR %s IS NULL)", cond, p.column)
+		}
+		conds = append(conds, cond)
+	}
+	query := "SELECT * FROM " + p.table
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	return query
+}
+
+// dumpSlices exports every slice of plans and stores it next to the backup at
+// key, jobs at a time (one for jobs <= 1), holding one slice per job in
+// memory. Once a slice fails no other is started, and the errors of those
+// already under way are joined to its.
+func (h *Handler) dumpSlices(ctx context.Context, key string, plans []slicePlan, jobs int) ([]Slice, error) {
+	type task struct {
+		plan     slicePlan
+		part     int
+		from, to string
+	}
+	var tasks []task
+	for _, p := range plans {
+		for part, r := range p.ranges() {
+			tasks = append(tasks, task{p, part, r[0], r[1]})
+		}
+	}
+	slices := make([]Slice, len(tasks))
+	errs := make([]error, len(tasks))
+	next := make(chan int)
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for range min(max(jobs, 1), len(tasks)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				t := tasks[i]
+				if slices[i], errs[i] = h.dumpSlice(ctx, key, t.plan, t.part, t.from, t.to); errs[i] != nil {
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	for i := range tasks {
+		if failed.Load() {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	for _, p := range plans {
+		logf(ctx, "Dumped %s in %d slices", p.spec.Table, len(p.ranges()))
+	}
+	return slices, nil
+}
+
+// dumpSlice exports the rows of p between from and to as slice part of its
+// table and stores it next to the backup at key.
+func (h *Handler) dumpSlice(ctx context.Context, key string, p slicePlan, part int, from, to string) (Slice, error) {
+	query := p.sliceQuery(from, to)
+	rows, err := h.copyTable(ctx, h.db, query)
+	if err != nil {
+		return Slice{}, fmt.Errorf("failed to dump slice %d of %s: %w", part, p.spec.Table, err)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "-- Slice %d of %s dumped by go-postgres-s3-backup: %s\n", part, p.spec.Table, query)
+	fmt.Fprintf(&b, "COPY %s FROM stdin;\n", p.table)
+	b.Write(rows)
+	b.WriteString("\\.\n")
+	data := b.Bytes()
+
+	s := Slice{Table: p.spec.Table, Column: p.spec.Column, Part: part, From: from, To: to, Size: int64(len(data)), SHA256: checksum(data)}
+	s.Key = sliceKey(key, s)
+	if err := h.upload(ctx, s.Key, data, s.SHA256); err != nil {
+		return Slice{}, fmt.Errorf("failed to upload slice %s: %w", s.Key, err)
+	}
+	return s, nil
+}
+
+// sliceKey returns the key of slice s of the backup at key. Characters
+// outside letters, digits, "." and "_" in the table name become "_".
+func sliceKey(key string, s Slice) string {
+	table := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s.Table)
+	return fmt.Sprintf("%s%s%s-%04d.sql", strings.TrimSuffix(plainKey(key), ".sql"), sliceMarker, table, s.Part)
+}
+
+// isSliceKey reports whether key names a slice of a backup.
+func isSliceKey(key string) bool {
+	return strings.Contains(key[strings.LastIndex(key, "/")+1:], sliceMarker) && strings.HasSuffix(key, ".sql")
+}
+
+// sliceBackupKey returns the key of the backup the slice at key belongs to.
+func sliceBackupKey(key string) string {
+	dir := strings.LastIndex(key, "/") + 1
+	return key[:dir+strings.Index(key[dir:], sliceMarker)] + ".sql"
+}
+
+// slicesFor returns slices renamed for the backup at key.
+func slicesFor(key string, slices []Slice) []Slice {
+	out := make([]Slice, len(slices))
+	for i, s := range slices {
+		s.Key = sliceKey(key, s)
+		out[i] = s
+	}
+	return out
+}
+
+// copySlices copies slices server-side to the names they take next to the
+// backup at key and returns them under those names.
+func (h *Handler) copySlices(ctx context.Context, key string, slices []Slice) ([]Slice, error) {
+	copied := slicesFor(key, slices)
+	for i, s := range slices {
+		if s.Key == copied[i].Key {
+			continue
+		}
+		input := &s3.CopyObjectInput{
+			Bucket:     aws.String(h.bucket),
+			Key:        aws.String(copied[i].Key),
+			CopySource: h.copySource(s.Key),
+		}
+		h.encryption.applyToCopy(input)
+		if h.encryption.Cipher == CipherSSEC {
+			input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5 = h.encryption.customerKeyParams()
+		}
+		if err := h.serverCopy(ctx, input, s.Key, s.Size); err != nil {
+			return nil, fmt.Errorf("failed to copy slice %s: %w", s.Key, err)
+		}
+	}
+	return copied, nil
+}
+
+// deleteSlices removes slices, which turned out to duplicate an older
+// backup's. Failures are only logged; reconcile reports what is left.
+func (h *Handler) deleteSlices(ctx context.Context, slices []Slice) {
+	for _, s := range slices {
+		if _, err := h.s3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(h.bucket), Key: aws.String(s.Key)}); err != nil {
+			logf(ctx, "Warning: failed to delete redundant slice %s: %v", s.Key, err)
+		}
+	}
+}
+
+// slicesMatch reports whether the backup at key was stored with slices
+// identical to slices. Without slices there is nothing to compare.
+func (h *Handler) slicesMatch(ctx context.Context, key string, slices []Slice) bool {
+	if len(slices) == 0 {
+		return true
+	}
+	m, err := h.readManifest(ctx, key)
+	if err != nil || m == nil || len(m.Slices) != len(slices) {
+		return false
+	}
+	for i, s := range m.Slices {
+		if s.Table != slices[i].Table || s.From != slices[i].From || s.To != slices[i].To || s.SHA256 != slices[i].SHA256 {
+			return false
+		}
+	}
+	return true
+}
+
+// quoteQualified quotes each dot-separated part of a schema-qualified name.
+func quoteQualified(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = quoteIdent(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// quoteLiteral quotes a PostgreSQL string literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,220 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sliceHandler returns a Handler that slices public.events by id in steps of
+// 10 over bounds 1, 11 and 21, exporting rows through a copier that echoes
+// each query, prefixed with *rows.
+func sliceHandler(f *fakeS3, rows *string, queries *[]string) *Handler {
+	h := newTestHandler(f, 7)
+	h.dumpOpts = DumpOptions{Slices: []SliceSpec{{Table: "public.events", Column: "id", Step: "10"}}}
+	h.query = fingerprinted(func(_ context.Context, _ DatabaseConfig, q string) ([][]string, error) {
+		*queries = append(*queries, q)
+		return [][]string{{"1"}, {"11"}, {"21"}}, nil
+	})
+	h.copyTable = func(_ context.Context, _ DatabaseConfig, q string) ([]byte, error) {
+		return []byte(*rows + "\t" + q + "\n"), nil
+	}
+	return h
+}
+
+func TestRunDumpsSlices(t *testing.T) {
+	f := newFakeS3()
+	rows, queries := "v1", []string{}
+	h := sliceHandler(f, &rows, &queries)
+	var opts DumpOptions
+	h.dump = recordingDump([]byte("dump"), &opts)
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !slices.Equal(opts.ExcludeTableData, []string{`"public"."events"`}) {
+		t.Errorf("ExcludeTableData = %q, want the sliced table", opts.ExcludeTableData)
+	}
+	if len(queries) != 1 || queries[0] != `SELECT b FROM generate_series((SELECT min("id") FROM "public"."events"), (SELECT max("id") FROM "public"."events"), 10) AS b` {
+		t.Errorf("queries = %q", queries)
+	}
+
+	m, err := h.readManifest(context.Background(), res.Key)
+	if err != nil || m == nil || len(m.Slices) != 3 {
+		t.Fatalf("manifest = %+v, %v; want 3 slices", m, err)
+	}
+	wantQueries := []string{
+		`SELECT * FROM "public"."events" WHERE ("id" < '11' OR "id" IS NULL)`,
+		`SELECT * FROM "public"."events" WHERE "id" >= '11' AND "id" < '21'`,
+		`SELECT * FROM "public"."events" WHERE "id" >= '21'`,
+	}
+	for i, s := range m.Slices {
+		if s.Key != sliceKey(res.Key, s) || s.Part != i {
+			t.Errorf("slice %d = %+v", i, s)
+		}
+		obj, ok := f.objects[s.Key]
+		if !ok {
+			t.Fatalf("slice %s not stored", s.Key)
+		}
+		body := string(obj.body)
+		if !strings.Contains(body, `COPY "public"."events" FROM stdin;`) || !strings.Contains(body, wantQueries[i]) || !strings.HasSuffix(body, "\\.\n") {
+			t.Errorf("slice %d body = %q", i, body)
+		}
+		if checksum(obj.body) != s.SHA256 {
+			t.Errorf("slice %d checksum mismatch", i)
+		}
+	}
+	for _, key := range []string{"monthly/2026-05-backup.sql", "yearly/2026-backup.sql"} {
+		pm, _ := h.readManifest(context.Background(), key)
+		if pm == nil || len(pm.Slices) != 3 {
+			t.Fatalf("%s manifest = %+v, want 3 slices", key, pm)
+		}
+		if copied, ok := f.objects[pm.Slices[2].Key]; !ok || checksum(copied.body) != m.Slices[2].SHA256 {
+			t.Errorf("%s: slice not copied to %s", key, pm.Slices[2].Key)
+		}
+	}
+}
+
+func TestRunComparesSlices(t *testing.T) {
+	f := newFakeS3()
+	rows, queries := "v1", []string{}
+	h := sliceHandler(f, &rows, &queries)
+	if _, err := h.Run(context.Background(), RunOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.now = fixedClock(testNow.AddDate(0, 0, 1))
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "skipped" {
+		t.Errorf("unchanged slices: action = %q, want skipped", res.Action)
+	}
+	for key := range f.objects {
+		if strings.HasPrefix(key, "daily/2026-05-28-backup") {
+			t.Errorf("%s left behind by a skipped run", key)
+		}
+	}
+
+	rows = "v2" // only the sliced table changed
+	res, err = h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "created" || res.Reason != "content changed" {
+		t.Errorf("changed slices: action = %q (%s), want created", res.Action, res.Reason)
+	}
+}
+
+func TestDumpSlicesInParallel(t *testing.T) {
+	f := newFakeS3()
+	rows, queries := "v1", []string{}
+	h := sliceHandler(f, &rows, &queries)
+	plans, err := h.planSlices(context.Background(), h.dumpOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// copier counts the slices dumped at once, failing the queries fail matches.
+	var mu sync.Mutex
+	running, most := 0, 0
+	copier := func(fail func(q string) bool) TableCopier {
+		return func(_ context.Context, _ DatabaseConfig, q string) ([]byte, error) {
+			mu.Lock()
+			running++
+			most = max(most, running)
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if fail(q) {
+				return nil, errors.New("rows unavailable")
+			}
+			return []byte("row\n"), nil
+		}
+	}
+
+	h.copyTable = copier(func(q string) bool { return !strings.Contains(q, "AND") }) // the first and last slices
+	_, err = h.dumpSlices(context.Background(), "daily/2026-05-27-backup.sql", plans, 3)
+	if err == nil || !strings.Contains(err.Error(), "slice 0 of public.events") || !strings.Contains(err.Error(), "slice 2 of public.events") {
+		t.Errorf("err = %v, want the errors of slices 0 and 2", err)
+	}
+	if most != 3 {
+		t.Errorf("%d slices dumped at once, want 3", most)
+	}
+
+	h.copyTable, most = copier(func(string) bool { return false }), 0
+	got, err := h.dumpSlices(context.Background(), "daily/2026-05-27-backup.sql", plans, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if most != 2 {
+		t.Errorf("%d slices dumped at once, want 2", most)
+	}
+	for i, s := range got {
+		if s.Part != i || f.objects[s.Key] == nil {
+			t.Errorf("slice %d = %+v, want part %d stored", i, s, i)
+		}
+	}
+}
+
+func TestPlanSlicesSkipsSmallTables(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.query = staticQuery([][]string{{"1024"}})
+
+	plans, err := h.planSlices(context.Background(), DumpOptions{
+		Slices:       []SliceSpec{{Table: "public.events", Column: "created_at", Step: "1 month"}},
+		SliceMinSize: 1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 0 {
+		t.Errorf("plans = %+v, want none below the threshold", plans)
+	}
+	if got := sliceStep("1 month"); got != "interval '1 month'" {
+		t.Errorf("sliceStep = %q", got)
+	}
+}
+
+func TestSliceKeys(t *testing.T) {
+	key := sliceKey("schema-only/daily/2026-05-27-backup.sql", Slice{Table: `public.odd"name`, Part: 12})
+	if key != "schema-only/daily/2026-05-27-backup.slice-public.odd_name-0012.sql" {
+		t.Errorf("sliceKey = %q", key)
+	}
+	if !isSidecarKey(key) || sidecarBackupKey(key) != "schema-only/daily/2026-05-27-backup.sql" {
+		t.Errorf("slice key %q should be a sidecar of its backup, got %q", key, sidecarBackupKey(key))
+	}
+	if isSliceKey("daily/2026-05-27-backup.sql") {
+		t.Error("a backup is not a slice")
+	}
+}
+
+func TestRunReplicatesSlices(t *testing.T) {
+	primary, offsite := newFakeS3(), newFakeS3()
+	rows, queries := "v1", []string{}
+	h := sliceHandler(primary, &rows, &queries)
+	h.replicas = []Replica{{Name: "offsite", S3: offsite, Bucket: "offsite"}}
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != "ok" {
+		t.Fatalf("replicas = %+v", res.Replicas)
+	}
+	for key := range primary.objects {
+		if isSliceKey(key) {
+			if _, ok := offsite.objects[key]; !ok {
+				t.Errorf("slice %s missing from replica", key)
+			}
+		}
+	}
+}
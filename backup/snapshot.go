@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+)
+
+// Snapshotter starts a storage-level snapshot of the database, named id, and
+// returns the identifier the provider reports for it (for RDS, the snapshot
+// ARN). It returns once the snapshot is requested; it does not wait for the
+// snapshot to complete.
+type Snapshotter func(ctx context.Context, id string) (string, error)
+
+// RDSAPI is the subset of the RDS client used by RDSSnapshotter, so tests can
+// supply a fake.
+type RDSAPI interface {
+	CreateDBSnapshot(ctx context.Context, params *rds.CreateDBSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBSnapshotOutput, error)
+	CreateDBClusterSnapshot(ctx context.Context, params *rds.CreateDBClusterSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBClusterSnapshotOutput, error)
+}
+
+// RDSSnapshotter returns a Snapshotter that snapshots an Aurora cluster when
+// clusterID is set, and the RDS instance instanceID otherwise. Snapshots are
+// tagged with the run identifier.
+func RDSSnapshotter(client RDSAPI, instanceID, clusterID string) Snapshotter {
+	return func(ctx context.Context, id string) (string, error) {
+		tags := []types.Tag{{Key: aws.String("created-by"), Value: aws.String("go-postgres-s3-backup")}}
+		if runID := RunID(ctx); runID != "" {
+			tags = append(tags, types.Tag{Key: aws.String("run-id"), Value: aws.String(runID)})
+		}
+		if clusterID != "" {
+			out, err := client.CreateDBClusterSnapshot(ctx, &rds.CreateDBClusterSnapshotInput{
+				DBClusterIdentifier:         aws.String(clusterID),
+				DBClusterSnapshotIdentifier: aws.String(id),
+				Tags:                        tags,
+			})
+			if err != nil {
+				return "", err
+			}
+			if out.DBClusterSnapshot == nil {
+				return id, nil
+			}
+			return aws.ToString(out.DBClusterSnapshot.DBClusterSnapshotArn), nil
+		}
+		out, err := client.CreateDBSnapshot(ctx, &rds.CreateDBSnapshotInput{
+			DBInstanceIdentifier: aws.String(instanceID),
+			DBSnapshotIdentifier: aws.String(id),
+			Tags:                 tags,
+		})
+		if err != nil {
+			return "", err
+		}
+		if out.DBSnapshot == nil {
+			return id, nil
+		}
+		return aws.ToString(out.DBSnapshot.DBSnapshotArn), nil
+	}
+}
+
+// snapshotIDKey is the context key under which a run's snapshot identifier is
+// stored, so uploads and manifests can record it.
+type snapshotIDKey struct{}
+
+func withSnapshotID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, snapshotIDKey{}, id)
+}
+
+// snapshotID returns the snapshot identifier stored in ctx, or "".
+func snapshotID(ctx context.Context) string {
+	id, _ := ctx.Value(snapshotIDKey{}).(string)
+	return id
+}
+
+// snapshotName returns the identifier requested for profile's snapshot at now,
+// e.g. "psb-full-20260527-030000". RDS identifiers hold only letters, digits
+// and single hyphens, so other characters in the profile name become hyphens.
+func snapshotName(profile string, now time.Time) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(profile) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	name := strings.Trim(b.String(), "-")
+	if name == "" {
+		name = "backup"
+	}
+	return "psb-" + name + "-" + now.UTC().Format("20060102-150405")
+}
+
+// takeSnapshot requests a storage-level snapshot alongside the backup being
+// stored for profile. A failure is logged and notified but never fails the
+// run: the logical backup is still stored.
+func (h *Handler) takeSnapshot(ctx context.Context, profile string, now time.Time) (string, error) {
+	id, err := h.snapshot(ctx, snapshotName(profile, now))
+	if err == nil && id == "" {
+		err = errors.New("snapshot returned no identifier")
+	}
+	if err != nil {
+		logf(ctx, "Warning: database snapshot failed: %v", err)
+		h.notify(ctx, Notification{
+			Event:   "backup.snapshot_failed",
+			Message: fmt.Sprintf("Backup (profile %s) was stored, but the database snapshot failed: %v", profile, err),
+			Fields:  map[string]string{"profile": profile, "error": err.Error()},
+		})
+		return "", err
+	}
+	logf(ctx, "Database snapshot requested: %s", id)
+	return id, nil
+}
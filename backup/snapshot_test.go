@@ -0,0 +1,120 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+)
+
+// fakeRDS records snapshot requests.
+type fakeRDS struct {
+	instance, cluster []string // requested snapshot identifiers
+	tags              []types.Tag
+	err               error
+}
+
+func (f *fakeRDS) CreateDBSnapshot(_ context.Context, params *rds.CreateDBSnapshotInput, _ ...func(*rds.Options)) (*rds.CreateDBSnapshotOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.instance = append(f.instance, aws.ToString(params.DBSnapshotIdentifier))
+	f.tags = params.Tags
+	arn := "arn:aws:rds:us-west-1:123:snapshot:" + aws.ToString(params.DBSnapshotIdentifier)
+	return &rds.CreateDBSnapshotOutput{DBSnapshot: &types.DBSnapshot{DBSnapshotArn: aws.String(arn)}}, nil
+}
+
+func (f *fakeRDS) CreateDBClusterSnapshot(_ context.Context, params *rds.CreateDBClusterSnapshotInput, _ ...func(*rds.Options)) (*rds.CreateDBClusterSnapshotOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.cluster = append(f.cluster, aws.ToString(params.DBClusterSnapshotIdentifier))
+	arn := "arn:aws:rds:us-west-1:123:cluster-snapshot:" + aws.ToString(params.DBClusterSnapshotIdentifier)
+	return &rds.CreateDBClusterSnapshotOutput{DBClusterSnapshot: &types.DBClusterSnapshot{DBClusterSnapshotArn: aws.String(arn)}}, nil
+}
+
+func TestRunRecordsSnapshot(t *testing.T) {
+	f, r := newFakeS3(), &fakeRDS{}
+	h := newTestHandler(f, 7)
+	h.snapshot = RDSSnapshotter(r, "prod-db", "")
+
+	res, err := h.Run(WithRunID(context.Background(), "run-1"), RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := "arn:aws:rds:us-west-1:123:snapshot:psb-full-20260527-120000"
+	if res.Status != "ok" || res.Snapshot != want {
+		t.Errorf("status = %q, snapshot = %q, want ok and %s", res.Status, res.Snapshot, want)
+	}
+	if len(r.instance) != 1 || len(r.cluster) != 0 {
+		t.Errorf("snapshots requested: instance %v, cluster %v; want one instance snapshot", r.instance, r.cluster)
+	}
+	if len(r.tags) != 2 || aws.ToString(r.tags[1].Value) != "run-1" {
+		t.Errorf("snapshot tags = %+v, want created-by and run-id", r.tags)
+	}
+	for _, key := range []string{res.Key, "monthly/2026-05-backup.sql", "yearly/2026-backup.sql"} {
+		if got := f.objects[key].metadata["snapshot-id"]; got != want {
+			t.Errorf("%s snapshot-id metadata = %q, want %q", key, got, want)
+		}
+	}
+	var m Manifest
+	if err := json.Unmarshal(f.objects[res.ManifestKey].body, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Snapshot != want {
+		t.Errorf("manifest snapshot = %q, want %q", m.Snapshot, want)
+	}
+
+	// An unchanged dump stores nothing, so no snapshot is requested.
+	if _, err := h.Run(context.Background(), RunOptions{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(r.instance) != 1 {
+		t.Errorf("an unchanged run requested a snapshot: %v", r.instance)
+	}
+}
+
+func TestRunSnapshotFailureIsPartial(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.snapshot = RDSSnapshotter(&fakeRDS{err: errors.New("SnapshotQuotaExceeded")}, "", "prod-cluster")
+	var events []string
+	h.notifier = func(_ context.Context, n Notification) error {
+		events = append(events, n.Event)
+		return nil
+	}
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("a failed snapshot should not fail the run: %v", err)
+	}
+	if res.Status != "partial" || res.SnapshotErr == "" || res.Action != "created" {
+		t.Errorf("result = %+v, want a created, partial run with the snapshot error", res)
+	}
+	if _, ok := f.objects[res.Key].metadata["snapshot-id"]; ok {
+		t.Error("backup should not record a snapshot that failed")
+	}
+	if len(events) != 1 || events[0] != "backup.snapshot_failed" {
+		t.Errorf("events = %v, want backup.snapshot_failed", events)
+	}
+}
+
+func TestSnapshotName(t *testing.T) {
+	now := time.Date(2026, 5, 27, 3, 4, 5, 0, time.UTC)
+	tests := map[string]string{
+		"full":        "psb-full-20260527-030405",
+		"Schema_Only": "psb-schema-only-20260527-030405",
+		"pre--deploy": "psb-pre-deploy-20260527-030405",
+		"__":          "psb-backup-20260527-030405",
+	}
+	for profile, want := range tests {
+		if got := snapshotName(profile, now); got != want {
+			t.Errorf("snapshotName(%q) = %q, want %q", profile, got, want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MaskRule is an anonymization rule RefreshStaging applies once a production
+// backup is restored into staging: the columns of Table named in Set are set
+// to their SQL expressions, in the rows Where selects, or all of them.
+type MaskRule struct {
+	Name  string            `json:"name"`
+	Table string            `json:"table"`           // schema-qualified, e.g. public.users
+	Set   map[string]string `json:"set"`             // column to SQL expression, e.g. "'user' || id || '@example.invalid'"
+	Where string            `json:"where,omitempty"` // SQL condition; "" masks every row
+}
+
+// MaskResult is the outcome of one MaskRule.
+type MaskResult struct {
+	Name  string `json:"name"`
+	Rows  int64  `json:"rows"`            // rows masked
+	Error string `json:"error,omitempty"` // why the rule failed
+}
+
+// ParseMaskRules parses a STAGING_MASK_RULES setting: a JSON array of rules,
+// e.g.
+//
+//	[{"name": "emails", "table": "public.users", "set": {"email": "'user' || id || '@example.invalid'", "phone": "NULL"}},
+//	 {"name": "card notes", "table": "billing.cards", "set": {"note": "''"}, "where": "note <> ''"}]
+//
+// Unknown fields, and rules without a name, table or column, are rejected.
+func ParseMaskRules(s string) ([]MaskRule, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	var rules []MaskRule
+	if err := dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("invalid masking rules: %w", err)
+	}
+	seen := map[string]bool{}
+	for i, r := range rules {
+		switch {
+		case r.Name == "" || r.Table == "" || len(r.Set) == 0:
+			return nil, fmt.Errorf("masking rule %d needs a name, a table and columns to set", i+1)
+		case seen[r.Name]:
+			return nil, fmt.Errorf("masking rule %q is defined twice", r.Name)
+		}
+		for column, expr := range r.Set {
+			if column == "" || strings.TrimSpace(expr) == "" {
+				return nil, fmt.Errorf("masking rule %q: every column needs a name and an expression", r.Name)
+			}
+		}
+		seen[r.Name] = true
+	}
+	return rules, nil
+}
+
+// StagingRefreshResult summarizes a RefreshStaging call.
+type StagingRefreshResult struct {
+	Status  string         `json:"status"` // "ok", or "failed" when the restore was partial or a masking rule failed
+	RunID   string         `json:"run_id"`
+	Action  string         `json:"action"` // always "refresh-staging"
+	Key     string         `json:"key"`    // backup restored
+	Target  string         `json:"target"` // host:port/database refreshed
+	Restore *RestoreResult `json:"restore"`
+	// Masks are the results of the masking rules, in order; RowsMasked
+	// counts the rows they masked, and MasksFailed the rules that failed.
+	Masks       []MaskResult `json:"masks"`
+	RowsMasked  int64        `json:"rows_masked"`
+	MasksFailed int          `json:"masks_failed,omitempty"`
+	DurationMs  int64        `json:"duration_ms"`
+}
+
+// Suffixes of the databases a refresh works in, next to the staging
+// database: the backup is restored and masked under stagingRefreshSuffix,
+// and the database it replaces is renamed with stagingPreviousSuffix until
+// it is dropped. maxDatabaseName is the longest name Postgres keeps whole.
+const (
+	stagingRefreshSuffix  = "_refresh"
+	stagingPreviousSuffix = "_previous"
+	maxDatabaseName       = 63
+)
+
+// RefreshStaging restores the latest backup of Config.StagingTier into
+// Config.StagingTarget (see ResolveTarget), anonymized by Config.MaskRules.
+// The backup is restored into a database created for it next to the target,
+// named with stagingRefreshSuffix, and the rules are applied to it in order;
+// only a restore with status "ok" whose rules all succeeded is renamed into
+// the target's place (see swapDatabase). Staging thus never serves unmasked
+// data: on any failure the new database is dropped, the target is left as it
+// was, and a failed rule sends a staging.mask_failed notification. A backup
+// of the database the Handler backs up is restored under another name, so
+// the source check is relaxed; RESTORE_TARGETS still applies to the target.
+// Refreshing without rules is refused.
+func (h *Handler) RefreshStaging(ctx context.Context) (*StagingRefreshResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	switch {
+	case h.stagingTarget == "":
+		return nil, invalidInput(errors.New("refresh-staging needs STAGING_TARGET"))
+	case len(h.maskRules) == 0:
+		return nil, invalidInput(errors.New("refusing to refresh staging without STAGING_MASK_RULES: it would hold production data unmasked"))
+	}
+	key, err := h.ResolveBackup(ctx, BackupQuery{Tier: h.stagingTier})
+	if err != nil {
+		return nil, err
+	}
+	target, err := h.ResolveTarget(ctx, h.stagingTarget)
+	if err != nil {
+		return nil, err
+	}
+	target = h.targetConn(target)
+	switch {
+	case sameDatabase(target, h.db):
+		return nil, invalidInput(fmt.Errorf("refusing to refresh %s, the database backed up", connName(target)))
+	case h.restoreTargets != nil && !h.restoreTargets.MatchString(target.Database):
+		return nil, invalidInput(fmt.Errorf("refusing to refresh %s: %q does not match RESTORE_TARGETS", connName(target), target.Database))
+	case len(target.Database)+max(len(stagingRefreshSuffix), len(stagingPreviousSuffix)) > maxDatabaseName:
+		return nil, invalidInput(fmt.Errorf("refusing to refresh %s: its name leaves no room for the suffix of the database restored next to it", connName(target)))
+	}
+	work := target
+	work.Database += stagingRefreshSuffix
+	// A refresh that failed may have left its database behind.
+	if err := h.maintenance(ctx, work, "DROP DATABASE IF EXISTS "+quoteIdent(work.Database)+";\n"); err != nil {
+		return nil, fmt.Errorf("failed to drop %s: %w", connName(work), err)
+	}
+	discard := func() {
+		if err := h.maintenance(ctx, work, "DROP DATABASE IF EXISTS "+quoteIdent(work.Database)+";\n"); err != nil {
+			logf(ctx, "Warning: failed to drop %s: %v", connName(work), err)
+		}
+	}
+	restored, err := h.Restore(ctx, key, RestoreOptions{Target: work, CreateTarget: true, Confirm: work.Database, AllowDifferentSource: true})
+	if err != nil {
+		discard()
+		return nil, err
+	}
+
+	result := &StagingRefreshResult{Status: "ok", RunID: runID, Action: "refresh-staging", Key: key, Target: connName(target), Restore: restored}
+	fail := func(err error) (*StagingRefreshResult, error) {
+		discard()
+		result.Status = "failed"
+		result.DurationMs = h.elapsed(start)
+		return result, err
+	}
+	if restored.Status != "ok" {
+		return fail(fmt.Errorf("refusing to refresh %s from %s: the restore was %s, with %d errors and %d checks failed", result.Target, key, restored.Status, restored.Errors, restored.ChecksFailed))
+	}
+	var failed []string
+	for _, rule := range h.maskRules {
+		res := h.mask(ctx, work, rule)
+		if res.Error != "" {
+			logf(ctx, "Masking rule %s failed: %s", rule.Name, res.Error)
+			failed = append(failed, rule.Name)
+		} else {
+			logf(ctx, "Masking rule %s masked %d rows of %s", rule.Name, res.Rows, rule.Table)
+		}
+		result.RowsMasked += res.Rows
+		result.Masks = append(result.Masks, res)
+	}
+	result.MasksFailed = len(failed)
+	if len(failed) > 0 {
+		h.notify(ctx, Notification{
+			Event:   "staging.mask_failed",
+			Message: fmt.Sprintf("Staging %s was not refreshed from %s: masking rule(s) %s failed; it was left as it was", result.Target, key, strings.Join(failed, ", ")),
+			Fields: map[string]string{
+				"key":          key,
+				"target":       result.Target,
+				"failed_rules": strings.Join(failed, ","),
+				"rows_masked":  strconv.FormatInt(result.RowsMasked, 10),
+			},
+		})
+		return fail(fmt.Errorf("refusing to refresh %s: masking rule(s) %s failed", result.Target, strings.Join(failed, ", ")))
+	}
+	if err := h.swapDatabase(ctx, work, target); err != nil {
+		return fail(err)
+	}
+	result.DurationMs = h.elapsed(start)
+	logf(ctx, "Refreshed staging %s from %s: %d rows masked by %d rule(s)", result.Target, key, result.RowsMasked, len(result.Masks))
+	return result, nil
+}
+
+// swapDatabase puts the database of work, restored and masked, in the place
+// of target's: the sessions connected to target are ended, target is renamed
+// with stagingPreviousSuffix and work to target's name in one transaction,
+// and the previous database is then dropped; failing to drop it only logs a
+// warning. A target that does not exist yet is simply taken by work.
+func (h *Handler) swapDatabase(ctx context.Context, work, target DatabaseConfig) error {
+	exists, err := h.databaseExists(ctx, target)
+	if err != nil {
+		return err
+	}
+	name, previous := quoteIdent(target.Database), quoteIdent(target.Database+stagingPreviousSuffix)
+	var script strings.Builder
+	script.WriteString("DROP DATABASE IF EXISTS " + previous + ";\n")
+	if exists {
+		script.WriteString("SELECT pg_catalog.pg_terminate_backend(pid) FROM pg_catalog.pg_stat_activity WHERE datname = " + quoteLiteral(target.Database) + " AND pid <> pg_catalog.pg_backend_pid();\n")
+	}
+	script.WriteString("BEGIN;\n")
+	if exists {
+		script.WriteString("ALTER DATABASE " + name + " RENAME TO " + previous + ";\n")
+	}
+	script.WriteString("ALTER DATABASE " + quoteIdent(work.Database) + " RENAME TO " + name + ";\nCOMMIT;\n")
+	if err := h.maintenance(ctx, target, script.String()); err != nil {
+		return fmt.Errorf("failed to swap %s into the place of %s: %w", work.Database, connName(target), err)
+	}
+	logf(ctx, "Swapped %s into the place of %s", work.Database, connName(target))
+	// Staging is refreshed by now; the next refresh drops what is left.
+	if exists {
+		if err := h.maintenance(ctx, target, "DROP DATABASE "+previous+";\n"); err != nil {
+			logf(ctx, "Warning: failed to drop the previous %s: %v", connName(target), err)
+		}
+	}
+	return nil
+}
+
+// mask applies rule to db, in one statement counting the rows it updates.
+func (h *Handler) mask(ctx context.Context, db DatabaseConfig, rule MaskRule) MaskResult {
+	res := MaskResult{Name: rule.Name}
+	columns := make([]string, 0, len(rule.Set))
+	for column := range rule.Set {
+		columns = append(columns, column)
+	}
+	slices.Sort(columns)
+	set := make([]string, len(columns))
+	for i, column := range columns {
+		set[i] = quoteIdent(column) + " = " + rule.Set[column]
+	}
+	stmt := "UPDATE " + quoteQualified(rule.Table) + " SET " + strings.Join(set, ", ")
+	if rule.Where != "" {
+		stmt += " WHERE " + rule.Where
+	}
+	rows, err := h.query(ctx, db, "WITH masked AS ("+stmt+" RETURNING 1) SELECT count(*) FROM masked")
+	if err == nil && (len(rows) != 1 || len(rows[0]) != 1) {
+		err = fmt.Errorf("returned %d rows, want the count", len(rows))
+	}
+	if err == nil {
+		res.Rows, err = strconv.ParseInt(rows[0][0], 10, 64)
+	}
+	if err != nil {
+		res.Error = Redact(err.Error())
+	}
+	return res
+}
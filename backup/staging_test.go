@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// fakeServer is a database server for RefreshStaging: the databases it holds,
+// each with the last script restored into it, changed by the statements run
+// against its "postgres" database.
+type fakeServer map[string]string
+
+var serverStmt = regexp.MustCompile(`(CREATE|DROP) DATABASE (?:IF EXISTS )?"([^"]+)"|ALTER DATABASE "([^"]+)" RENAME TO "([^"]+)"`)
+
+func (s fakeServer) restorer(partial func(body string) bool) Restorer {
+	return func(_ context.Context, db DatabaseConfig, _ string, r io.Reader, _ RestoreOptions) (RestoreStats, error) {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return RestoreStats{}, err
+		}
+		if db.Database != "postgres" {
+			s[db.Database] += string(body)
+			if partial(string(body)) {
+				return RestoreStats{Errors: 1, FirstErrors: []string{"ERROR:  relation exists"}}, nil
+			}
+			return RestoreStats{}, nil
+		}
+		for _, m := range serverStmt.FindAllStringSubmatch(string(body), -1) {
+			switch {
+			case m[1] == "CREATE":
+				s[m[2]] = ""
+			case m[1] == "DROP":
+				delete(s, m[2])
+			default:
+				s[m[4]] = s[m[3]]
+				delete(s, m[3])
+			}
+		}
+		return RestoreStats{}, nil
+	}
+}
+
+func TestRefreshStaging(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-26-backup.sql", []byte("old"), testNow.AddDate(0, 0, -2))
+	f.seed("daily/2026-05-27-backup.sql", []byte("CREATE TABLE users ();\n"), testNow.AddDate(0, 0, -1))
+	server := fakeServer{"app_staging": "stale"}
+	partial := false
+	var masked []string
+	var events []Notification
+	h := newTestHandler(f, 7)
+	h.db.Database = "app"
+	h.restore = server.restorer(func(string) bool { return partial })
+	h.query = func(_ context.Context, db DatabaseConfig, query string) ([][]string, error) {
+		if db.Host != "staging" {
+			t.Errorf("query against %s, want the staging server", connName(db))
+		}
+		if name, ok := strings.CutPrefix(query, "SELECT 1 FROM pg_catalog.pg_database WHERE datname = "); ok {
+			if _, exists := server[strings.Trim(name, "'")]; exists {
+				return [][]string{{"1"}}, nil
+			}
+			return nil, nil
+		}
+		if db.Database != "app_staging_refresh" {
+			t.Errorf("masking rule run against %s, want the database restored next to staging", db.Database)
+		}
+		masked = append(masked, query)
+		if strings.Contains(query, "billing") {
+			return nil, errors.New(`ERROR:  relation "billing.cards" does not exist`)
+		}
+		return [][]string{{"3"}}, nil
+	}
+	h.notifier = func(_ context.Context, n Notification) error {
+		events = append(events, n)
+		return nil
+	}
+
+	if _, err := h.RefreshStaging(context.Background()); err == nil || failureClass(err) != ClassInvalid {
+		t.Errorf("no target: err = %v, want an invalid input error", err)
+	}
+	h.stagingTarget = "postgresql://app@staging/app_staging"
+	if _, err := h.RefreshStaging(context.Background()); err == nil || failureClass(err) != ClassInvalid || server["app_staging"] != "stale" {
+		t.Errorf("no rules: err = %v, staging holds %q; want a refusal before restoring", err, server["app_staging"])
+	}
+
+	h.maskRules = []MaskRule{{Name: "emails", Table: "public.users", Set: map[string]string{"phone": "NULL", "email": "'user' || id || '@example.invalid'"}, Where: "email IS NOT NULL"}}
+	h.restoreTargets = regexp.MustCompile(`app_prod`)
+	if _, err := h.RefreshStaging(context.Background()); err == nil || failureClass(err) != ClassInvalid {
+		t.Errorf("staging outside RESTORE_TARGETS: err = %v, want an invalid input error", err)
+	}
+	h.restoreTargets = regexp.MustCompile(`app_staging`)
+
+	// A failed rule, or a partial restore, leaves staging as it was.
+	h.maskRules = append(h.maskRules, MaskRule{Name: "cards", Table: "billing.cards", Set: map[string]string{"note": "''"}})
+	res, err := h.RefreshStaging(context.Background())
+	if err == nil || res == nil || res.Status != "failed" || res.MasksFailed != 1 || res.RowsMasked != 3 || !strings.Contains(res.Masks[1].Error, "does not exist") {
+		t.Errorf("failed rule: result = %+v, err = %v", res, err)
+	}
+	if len(events) != 1 || events[0].Event != "staging.mask_failed" || events[0].Fields["failed_rules"] != "cards" {
+		t.Errorf("notifications = %+v, want one staging.mask_failed", events)
+	}
+	if len(server) != 1 || server["app_staging"] != "stale" {
+		t.Errorf("after a failed rule the server holds %v, want staging untouched", server)
+	}
+	h.maskRules, masked, partial = h.maskRules[:1], nil, true
+	if res, err := h.RefreshStaging(context.Background()); err == nil || res == nil || res.Status != "failed" || len(masked) != 0 || len(server) != 1 || server["app_staging"] != "stale" {
+		t.Errorf("partial restore: result = %+v, err = %v, %d rules run, server %v; want staging untouched", res, err, len(masked), server)
+	}
+
+	partial = false
+	res, err = h.RefreshStaging(context.Background())
+	if err != nil {
+		t.Fatalf("RefreshStaging: %v", err)
+	}
+	if res.Key != "daily/2026-05-27-backup.sql" || res.Target != "staging:5432/app_staging" || res.Restore.Target != "staging:5432/app_staging_refresh" {
+		t.Errorf("result = %+v, want the latest backup restored next to staging", res)
+	}
+	want := `WITH masked AS (UPDATE "public"."users" SET "email" = 'user' || id || '@example.invalid', "phone" = NULL WHERE email IS NOT NULL RETURNING 1) SELECT count(*) FROM masked`
+	if len(masked) != 1 || masked[0] != want {
+		t.Errorf("queries = %q, want %q", masked, want)
+	}
+	if res.Status != "ok" || res.RowsMasked != 3 || len(res.Masks) != 1 || res.Masks[0].Rows != 3 || len(events) != 1 {
+		t.Errorf("result = %+v, notifications = %+v", res, events)
+	}
+	if len(server) != 1 || server["app_staging"] != "CREATE TABLE users ();\n" {
+		t.Errorf("server holds %v, want only staging, refreshed", server)
+	}
+}
+
+func TestParseMaskRules(t *testing.T) {
+	rules, err := ParseMaskRules(`[{"name": "emails", "table": "public.users", "set": {"email": "md5(email)"}, "where": "id > 0"}]`)
+	if err != nil || len(rules) != 1 || rules[0].Set["email"] != "md5(email)" || rules[0].Where != "id > 0" {
+		t.Errorf("ParseMaskRules = %+v, %v", rules, err)
+	}
+	for _, s := range []string{
+		`[{"name": "emails", "table": "public.users", "set": {}}]`,
+		`[{"name": "emails", "set": {"email": "NULL"}}]`,
+		`[{"name": "emails", "table": "public.users", "set": {"email": " "}}]`,
+		`[{"name": "a", "table": "t", "set": {"c": "NULL"}}, {"name": "a", "table": "u", "set": {"c": "NULL"}}]`,
+		`[{"name": "a", "table": "t", "set": {"c": "NULL"}, "columns": ["c"]}]`,
+	} {
+		if _, err := ParseMaskRules(s); err == nil {
+			t.Errorf("ParseMaskRules(%s) should fail", s)
+		}
+	}
+}
@@ -2,14 +2,16 @@ package backup
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"path"
 	"strings"
-	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -24,6 +26,13 @@ type S3API interface {
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
 	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
 }
 
 // checksum returns the hex-encoded SHA-256 of data.
@@ -32,20 +41,20 @@ func checksum(data []byte) string {
 	return hex.EncodeToString(sum[:])
 }
 
-// mostRecentBackup returns the key of the most recently modified object under
-// prefix, or "" when none exist.
+// mostRecentBackup returns the key of the most recently modified backup under
+// prefix, ignoring sidecar files, or "" when none exist.
 func (h *Handler) mostRecentBackup(ctx context.Context, prefix string) (string, error) {
-	resp, err := h.s3.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-		Bucket: aws.String(h.bucket),
-		Prefix: aws.String(prefix),
-	})
+	objects, err := h.listObjects(ctx, prefix)
 	if err != nil {
 		return "", err
 	}
 
 	var mostRecent types.Object
 	var found bool
-	for _, obj := range resp.Contents {
+	for _, obj := range objects {
+		if isSidecarKey(aws.ToString(obj.Key)) {
+			continue
+		}
 		if !found || obj.LastModified.After(*mostRecent.LastModified) {
 			mostRecent = obj
 			found = true
@@ -57,63 +66,331 @@ func (h *Handler) mostRecentBackup(ctx context.Context, prefix string) (string,
 	return "", nil
 }
 
+// listObjects returns every object under prefix, following pagination.
+func (h *Handler) listObjects(ctx context.Context, prefix string) ([]types.Object, error) {
+	var objects []types.Object
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(h.bucket),
+		Prefix: aws.String(prefix),
+	}
+	for {
+		resp, err := h.s3.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, resp.Contents...)
+		if !aws.ToBool(resp.IsTruncated) || resp.NextContinuationToken == nil {
+			return objects, nil
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
+}
+
+// listBackups returns every backup object in the bucket, across tiers and
+// profile prefixes.
+func (h *Handler) listBackups(ctx context.Context) ([]types.Object, error) {
+	objects, err := h.listObjects(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	backups := objects[:0]
+	for _, obj := range objects {
+		if isBackupKey(aws.ToString(obj.Key)) {
+			backups = append(backups, obj)
+		}
+	}
+	return backups, nil
+}
+
 // objectChecksum returns the SHA-256 of the object at key, preferring the value
 // stored in object metadata and falling back to downloading and hashing the
-// body for objects written before checksums were recorded.
+// body for objects written before checksums were recorded. The checksum of a
+// downloaded object is cached (see checksumCache), so an unchanged legacy
+// backup is downloaded once rather than by every run it stays the latest for.
 func (h *Handler) objectChecksum(ctx context.Context, key string) (string, error) {
-	resp, err := h.s3.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(h.bucket),
-		Key:    aws.String(key),
-	})
+	resp, err := h.headObject(ctx, key)
 	if err != nil {
 		return "", err
 	}
+	return h.headChecksum(ctx, key, resp)
+}
 
-	if sum, ok := resp.Metadata["sha256"]; ok {
+// headChecksum is objectChecksum for the object at key described by head.
+func (h *Handler) headChecksum(ctx context.Context, key string, head *s3.HeadObjectOutput) (string, error) {
+	if sum, ok := head.Metadata["sha256"]; ok {
 		return sum, nil
 	}
+	etag := aws.ToString(head.ETag)
+	if sum := h.cachedChecksum(ctx, key, etag); sum != "" {
+		return sum, nil
+	}
+	sum, err := h.downloadChecksum(ctx, key)
+	if err == nil && etag != "" {
+		h.cacheChecksum(ctx, checksumCache{Key: key, ETag: etag, SHA256: sum})
+	}
+	return sum, err
+}
 
-	getResp, err := h.s3.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(h.bucket),
-		Key:    aws.String(key),
-	})
+// statePrefix holds what is kept about the bucket's backups rather than
+// backups: the checksum cache and compression references.
+const statePrefix = "state/"
+
+// checksumCachePrefix is where the checksums of backups without one in their
+// metadata are kept: a state object per directory of backups (e.g.
+// "state/checksums/schema-only/daily.json") holds the last one downloaded.
+const checksumCachePrefix = statePrefix + "checksums/"
+
+// checksumCache is the state object of a directory of backups. The checksum
+// is only trusted while the object at Key still has ETag, so an overwritten
+// backup is hashed again.
+type checksumCache struct {
+	Key    string `json:"key"`
+	ETag   string `json:"etag"`
+	SHA256 string `json:"sha256"`
+}
+
+// checksumCacheKey is the key of the state object caching the checksum of key.
+func checksumCacheKey(key string) string {
+	return checksumCachePrefix + path.Dir(key) + ".json"
+}
+
+// cachedChecksum returns the cached checksum of the object at key with etag,
+// or "" when there is none.
+func (h *Handler) cachedChecksum(ctx context.Context, key, etag string) string {
+	if etag == "" {
+		return ""
+	}
+	body, err := h.openObject(ctx, checksumCacheKey(key))
+	if err != nil {
+		return "" // not cached yet
+	}
+	defer func() { _ = body.Close() }()
+	var c checksumCache
+	if err := json.NewDecoder(body).Decode(&c); err != nil {
+		logf(ctx, "Warning: ignoring unreadable checksum cache %s: %v", checksumCacheKey(key), err)
+		return ""
+	}
+	if c.Key != key || c.ETag != etag {
+		return ""
+	}
+	return c.SHA256
+}
+
+// cacheChecksum stores c as the checksum cache of its directory. A failure
+// only costs the next run another download.
+func (h *Handler) cacheChecksum(ctx context.Context, c checksumCache) {
+	if err := h.writeJSON(ctx, checksumCacheKey(c.Key), c); err != nil {
+		logf(ctx, "Warning: failed to cache the checksum of %s: %v", c.Key, err)
+	}
+}
+
+// writeJSON stores v as a JSON state object at key, encrypted like backups.
+func (h *Handler) writeJSON(ctx context.Context, key string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(h.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+		Metadata:    map[string]string{"sha256": checksum(body)},
+	}
+	h.encryption.addMetadata(input.Metadata)
+	h.encryption.applyToPut(input)
+	_, err = h.s3.PutObject(ctx, input)
+	return err
+}
+
+// downloadChecksum downloads the object at key and returns the SHA-256 of its
+// body.
+func (h *Handler) downloadChecksum(ctx context.Context, key string) (string, error) {
+	body, err := h.openObject(ctx, key)
 	if err != nil {
 		return "", err
 	}
-	defer func() { _ = getResp.Body.Close() }()
+	defer func() { _ = body.Close() }()
 
 	hash := sha256.New()
-	if _, err := io.Copy(hash, getResp.Body); err != nil {
+	if _, err := copyPooled(hash, body); err != nil {
 		return "", err
 	}
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// objectMatches reports whether the object at key exists and its checksum
-// equals the given checksum.
-func (h *Handler) objectMatches(ctx context.Context, key, sum string) bool {
-	existing, err := h.objectChecksum(ctx, key)
+// readRange returns length bytes of the object at key starting at offset,
+// decrypted like openObject. Compressed objects cannot be read by range.
+func (h *Handler) readRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	resp, err := h.getObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(h.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, archivedError(key, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if compressionFromMetadata(resp.Metadata).enabled() {
+		return nil, fmt.Errorf("cannot read a range of %s: it is stored compressed", key)
+	}
+	plain, err := decryptBody(resp.Body, resp.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt %s: %w", key, err)
+	}
+	return io.ReadAll(plain)
+}
+
+// objectMatches reports whether the object at key exists and holds data,
+// whose checksum is sum. An object of another size, or, short of a recorded
+// checksum, another ETag (see etagDiffers), is told apart without hashing.
+func (h *Handler) objectMatches(ctx context.Context, key string, data []byte, sum string) bool {
+	head, err := h.headObject(ctx, key)
+	if err != nil {
+		return false
+	}
+	if uncompressedSize(head.Metadata, aws.ToInt64(head.ContentLength)) != int64(len(data)) {
+		return false
+	}
+	if _, ok := head.Metadata["sha256"]; !ok && etagDiffers(head, data) {
+		return false
+	}
+	existing, err := h.headChecksum(ctx, key, head)
 	return err == nil && existing == sum
 }
 
-// upload writes data to key, recording its checksum in object metadata.
+// etagDiffers reports whether the ETag of the object described by head shows
+// that it does not hold data. Only the ETag of a single-part upload stored
+// uncompressed, without encryption or with SSE-S3, is the MD5 of its body; any
+// other ETag says nothing.
+func etagDiffers(head *s3.HeadObjectOutput, data []byte) bool {
+	etag := strings.Trim(aws.ToString(head.ETag), `"`)
+	switch {
+	case etag == "" || strings.Contains(etag, "-"):
+		return false // multipart
+	case head.ServerSideEncryption != "" && head.ServerSideEncryption != types.ServerSideEncryptionAes256:
+		return false
+	case head.SSECustomerKeyMD5 != nil || aws.ToString(head.ContentEncoding) != "" || compressionFromMetadata(head.Metadata).enabled():
+		return false
+	}
+	sum := md5.Sum(data)
+	return etag != hex.EncodeToString(sum[:])
+}
+
+// upload writes data to key, recording its checksum, encryption scheme, source
+// server (see DumpInfo), the database it backs up (see sourceID) and the run
+// that produced it in object metadata. The
+// run's dump is stored compressed when the run chose a Compression, against a
+// reference for the daily backup set up with one (see useReference); sum is
+// always that of data as given.
 func (h *Handler) upload(ctx context.Context, key string, data []byte, sum string) error {
-	_, err := h.s3.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(h.bucket),
-		Key:         aws.String(key),
-		Body:        bytes.NewReader(data),
-		ContentType: aws.String("application/sql"),
-		Metadata:    map[string]string{"sha256": sum},
-	})
+	metadata := map[string]string{"sha256": sum}
+	body, stored := data, Compression{}
+	if d := compressedDumpFrom(ctx); d != nil {
+		compressed, c, err := d.bodyFor(h.bucket, key, data)
+		if err != nil {
+			return fmt.Errorf("failed to compress %s: %w", key, err)
+		}
+		if compressed != nil {
+			body, stored = compressed, c
+			c.addMetadata(metadata, len(data))
+			if d.referenced(h.bucket, key) {
+				metadata["compression-reference"] = d.ref.key
+			}
+		}
+	}
+	if id := RunID(ctx); id != "" {
+		metadata["run-id"] = id
+	}
+	if id := snapshotID(ctx); id != "" {
+		metadata["snapshot-id"] = id
+	}
+	metadata["source-id"] = h.sourceID()
+	if fp, ok := fingerprintFrom(ctx); ok {
+		metadata["fingerprint"] = fp.String()
+	}
+	h.encryption.addMetadata(metadata)
+	parseDumpInfo(data).addMetadata(metadata)
+	if format := dumpFormat(data); format != FormatPlain {
+		metadata["format"] = format
+	}
+	contentType, encoding, disposition := contentHeaders(key, metadata["format"], stored)
+	input := &s3.PutObjectInput{
+		Bucket:             aws.String(h.bucket),
+		Key:                aws.String(key),
+		Body:               bytes.NewReader(body),
+		ContentType:        aws.String(contentType),
+		ContentDisposition: aws.String(disposition),
+		Metadata:           metadata,
+	}
+	if encoding != "" {
+		input.ContentEncoding = aws.String(encoding)
+	}
+	if h.cacheControl != "" {
+		input.CacheControl = aws.String(h.cacheControl)
+	}
+	h.encryption.applyToPut(input)
+	_, err := h.s3.PutObject(ctx, input)
 	return err
 }
 
+// copyBackup copies the backup at src, whose HEAD is head, to dst
+// server-side. The copy keeps the metadata of src but for what describes
+// the run that stored it: its run, snapshot and fingerprint are this run's,
+// and it is encrypted the way new backups are.
+func (h *Handler) copyBackup(ctx context.Context, src, dst string, head *s3.HeadObjectOutput) error {
+	metadata := make(map[string]string, len(head.Metadata)+2)
+	for k, v := range head.Metadata {
+		metadata[k] = v
+	}
+	delete(metadata, "snapshot-id")
+	delete(metadata, "key-id")
+	if id := RunID(ctx); id != "" {
+		metadata["run-id"] = id
+	}
+	if id := snapshotID(ctx); id != "" {
+		metadata["snapshot-id"] = id
+	}
+	if fp, ok := fingerprintFrom(ctx); ok {
+		metadata["fingerprint"] = fp.String()
+	}
+	h.encryption.addMetadata(metadata)
+	return h.copyObject(ctx, src, dst, aws.ToInt64(head.ContentLength), metadata, compressionFromMetadata(head.Metadata))
+}
+
+// contentHeaders returns the Content-Type, Content-Encoding and
+// Content-Disposition of the dump of format stored at key with Compression c.
+// A custom-format archive, which pg_dump compresses itself, is saved as e.g.
+// "2026-05-27-backup.dump" for pg_restore, and a directory as
+// "2026-05-27-backup.tar"; their keys keep the ".sql" of every backup key. A
+// gzip body, whose key ends in gzipSuffix, is sent with Content-Encoding gzip,
+// which browsers and HTTP clients decode on download, so its disposition
+// names the decoded file. A zstd body is labelled as the compressed file it
+// is, with no Content-Encoding, since few clients decode it (and none, for a
+// body compressed against a reference): a download through a presigned URL
+// saves e.g. "2026-05-27-backup.sql.zst" for zstd -d. Encryption needs no
+// header, as every supported cipher is reversed by S3 before the body is sent.
+func contentHeaders(key, format string, c Compression) (contentType, encoding, disposition string) {
+	name := plainKey(path.Base(key))
+	contentType = "application/sql"
+	switch format {
+	case FormatCustom:
+		contentType, name = "application/octet-stream", strings.TrimSuffix(name, ".sql")+".dump"
+	case FormatDirectory:
+		contentType, name = "application/x-tar", strings.TrimSuffix(name, ".sql")+".tar"
+	}
+	switch c.Codec {
+	case CompressionGzip:
+		encoding = "gzip"
+	case CompressionZstd:
+		contentType, name = "application/zstd", name+".zst"
+	}
+	return contentType, encoding, fmt.Sprintf("attachment; filename=%q", name)
+}
+
 // objectExists reports whether key exists in the bucket.
 func (h *Handler) objectExists(ctx context.Context, key string) (bool, error) {
-	_, err := h.s3.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(h.bucket),
-		Key:    aws.String(key),
-	})
+	_, err := h.headObject(ctx, key)
 	if err != nil {
 		if strings.Contains(err.Error(), "NotFound") {
 			return false, nil
@@ -123,14 +400,44 @@ func (h *Handler) objectExists(ctx context.Context, key string) (bool, error) {
 	return true, nil
 }
 
-// uploadIfMissing writes data to key only when it does not already exist,
-// returning whether it created the object.
+// sourceID identifies the database the Handler backs up, as recorded in the
+// source-id metadata of what it stores: the configured ServerID, or else the
+// host and port, followed by the database name.
+func (h *Handler) sourceID() string {
+	return cmp.Or(h.serverID, h.db.Host+":"+cmp.Or(h.db.Port, "5432")) + "/" + h.db.Database
+}
+
+// checkCollision fails with a prefix collision when key, which a run is
+// about to overwrite, holds a backup of another database with a checksum
+// other than sum, as when two deployments share a prefix. Objects stored
+// before source-id was recorded are overwritten as before.
+func (h *Handler) checkCollision(ctx context.Context, key, sum string) error {
+	head, err := h.headObject(ctx, key)
+	if err != nil {
+		if strings.Contains(err.Error(), "NotFound") {
+			return nil
+		}
+		return fmt.Errorf("failed to check %s: %w", key, err)
+	}
+	other := head.Metadata["source-id"]
+	if other == "" || other == h.sourceID() {
+		return nil
+	}
+	if existing, err := h.headChecksum(ctx, key, head); err == nil && existing == sum {
+		return nil
+	}
+	return invalidInput(fmt.Errorf("prefix collision: %s holds a backup of %s, not of %s; give each database its own prefix, or set BACKUP_SERVER_ID if the server moved", key, other, h.sourceID()))
+}
+
+// uploadIfMissing writes data to key only when the backup it names does not
+// already exist under either name (see findBackup), returning whether it
+// created the object.
 func (h *Handler) uploadIfMissing(ctx context.Context, key string, data []byte, sum string) (bool, error) {
-	exists, err := h.objectExists(ctx, key)
+	existing, err := h.findBackup(ctx, key)
 	if err != nil {
 		return false, fmt.Errorf("failed to check %s: %w", key, err)
 	}
-	if exists {
+	if existing != "" {
 		return false, nil
 	}
 	if err := h.upload(ctx, key, data, sum); err != nil {
@@ -138,42 +445,3 @@ func (h *Handler) uploadIfMissing(ctx context.Context, key string, data []byte,
 	}
 	return true, nil
 }
-
-// cleanupOldDailyBackups deletes daily backups older than the retention window.
-// Keys are expected in the form "daily/YYYY-MM-DD-backup.sql"; unparseable keys
-// are left untouched.
-func (h *Handler) cleanupOldDailyBackups(ctx context.Context) error {
-	resp, err := h.s3.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-		Bucket: aws.String(h.bucket),
-		Prefix: aws.String("daily/"),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to list daily backups: %w", err)
-	}
-
-	cutoff := h.now().AddDate(0, 0, -h.retentionDays)
-	for _, obj := range resp.Contents {
-		parts := strings.Split(*obj.Key, "/")
-		if len(parts) != 2 {
-			continue
-		}
-		datePart := strings.TrimSuffix(parts[1], "-backup.sql")
-		backupDate, err := time.Parse("2006-01-02", datePart)
-		if err != nil {
-			log.Printf("Warning: failed to parse date from key %s: %v", *obj.Key, err)
-			continue
-		}
-		if !backupDate.Before(cutoff) {
-			continue
-		}
-		if _, err := h.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
-			Bucket: aws.String(h.bucket),
-			Key:    obj.Key,
-		}); err != nil {
-			log.Printf("Warning: failed to delete old backup %s: %v", *obj.Key, err)
-		} else {
-			log.Printf("Deleted old daily backup: %s", *obj.Key)
-		}
-	}
-	return nil
-}
@@ -3,8 +3,13 @@ package backup
 import (
 	"context"
 	"errors"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 func newTestHandler(s3 S3API, retention int) *Handler {
@@ -14,6 +19,7 @@ func newTestHandler(s3 S3API, retention int) *Handler {
 		Database:      DatabaseConfig{Host: "localhost"},
 		RetentionDays: retention,
 		Dump:          staticDump([]byte("dump")),
+		Query:         staticQuery(nil),
 	})
 	h.now = fixedClock(time.Date(2026, 5, 27, 12, 0, 0, 0, time.UTC))
 	return h
@@ -50,6 +56,67 @@ func TestObjectChecksumDownloadFallback(t *testing.T) {
 	}
 }
 
+func TestObjectChecksumCache(t *testing.T) {
+	f := newFakeS3()
+	body := []byte("legacy backup")
+	f.objects["daily/y.sql"] = &fakeObject{body: body, metadata: map[string]string{}}
+	h := newTestHandler(f, 7)
+	ctx := context.Background()
+
+	if got, err := h.objectChecksum(ctx, "daily/y.sql"); err != nil || got != checksum(body) {
+		t.Fatalf("objectChecksum = %q, %v", got, err)
+	}
+	if _, ok := f.objects["state/checksums/daily.json"]; !ok {
+		t.Fatal("the downloaded checksum should be cached")
+	}
+	gets := f.fullGets
+	if got, err := h.objectChecksum(ctx, "daily/y.sql"); err != nil || got != checksum(body) {
+		t.Fatalf("cached objectChecksum = %q, %v", got, err)
+	}
+	if f.fullGets != gets+1 {
+		t.Errorf("%d reads, want only the cache's", f.fullGets-gets)
+	}
+
+	// An overwritten backup is hashed again.
+	body = []byte("rewritten legacy backup")
+	f.objects["daily/y.sql"].body = body
+	if got, err := h.objectChecksum(ctx, "daily/y.sql"); err != nil || got != checksum(body) {
+		t.Errorf("objectChecksum after a rewrite = %q, %v; want the new checksum", got, err)
+	}
+
+	if res, err := h.Reconcile(ctx, ReconcileOptions{}); err != nil || len(res.Findings) != 1 || res.Findings[0].Key != "daily/y.sql" {
+		t.Errorf("reconcile = %+v, %v; want the cache left out", res, err)
+	}
+}
+
+func TestObjectMatchesFastPath(t *testing.T) {
+	f := newFakeS3()
+	f.objects["daily/legacy.sql"] = &fakeObject{body: []byte("legacy-dump"), metadata: map[string]string{}}
+	h := newTestHandler(f, 7)
+	ctx := context.Background()
+
+	for _, data := range [][]byte{[]byte("longer dump"), []byte("legacy-DUMP")} {
+		if h.objectMatches(ctx, "daily/legacy.sql", data, checksum(data)) {
+			t.Errorf("%q should not match", data)
+		}
+	}
+	if f.fullGets != 0 {
+		t.Errorf("%d downloads, want the size and ETag to tell the dumps apart", f.fullGets)
+	}
+	data := []byte("legacy-dump")
+	if !h.objectMatches(ctx, "daily/legacy.sql", data, checksum(data)) {
+		t.Error("the same dump should match")
+	}
+
+	// The ETag of an SSE-KMS object is not its MD5.
+	if etagDiffers(&s3.HeadObjectOutput{ETag: aws.String(`"0"`), ServerSideEncryption: types.ServerSideEncryptionAwsKms}, data) {
+		t.Error("an SSE-KMS ETag should not rule out a match")
+	}
+	if etagDiffers(&s3.HeadObjectOutput{ETag: aws.String(`"0-2"`)}, data) {
+		t.Error("a multipart ETag should not rule out a match")
+	}
+}
+
 func TestObjectExists(t *testing.T) {
 	f := newFakeS3()
 	f.seed("daily/present.sql", []byte("x"), time.Now())
@@ -104,6 +171,21 @@ func TestMostRecentBackup(t *testing.T) {
 	}
 }
 
+func TestMostRecentBackupPaginates(t *testing.T) {
+	f := newFakeS3()
+	f.pageSize = 2
+	base := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i, key := range []string{"daily/a.sql", "daily/b.sql", "daily/c.sql", "daily/d.sql", "daily/e.sql"} {
+		f.seed(key, []byte(key), base.Add(time.Duration(i)*time.Hour))
+	}
+	h := newTestHandler(f, 7)
+
+	got, err := h.mostRecentBackup(context.Background(), "daily/")
+	if err != nil || got != "daily/e.sql" {
+		t.Errorf("mostRecentBackup = %q, %v; want daily/e.sql from the last page", got, err)
+	}
+}
+
 func TestMostRecentBackupEmpty(t *testing.T) {
 	h := newTestHandler(newFakeS3(), 7)
 	got, err := h.mostRecentBackup(context.Background(), "daily/")
@@ -111,3 +193,101 @@ func TestMostRecentBackupEmpty(t *testing.T) {
 		t.Errorf("empty bucket: got=%q err=%v, want empty/nil", got, err)
 	}
 }
+
+func TestUploadContentHeaders(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.cacheControl = "private, no-store"
+	if err := h.upload(context.Background(), "daily/2026-05-27-backup.sql", []byte("dump"), checksum([]byte("dump"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := aws.ToString(f.lastPut.ContentType); got != "application/sql" {
+		t.Errorf("ContentType = %q", got)
+	}
+	if got := aws.ToString(f.lastPut.ContentDisposition); got != `attachment; filename="2026-05-27-backup.sql"` {
+		t.Errorf("ContentDisposition = %q", got)
+	}
+	if got := aws.ToString(f.lastPut.CacheControl); got != "private, no-store" {
+		t.Errorf("CacheControl = %q", got)
+	}
+	if f.lastPut.ContentEncoding != nil {
+		t.Errorf("ContentEncoding = %q, want none", aws.ToString(f.lastPut.ContentEncoding))
+	}
+
+	ctx := withCompressedDump(context.Background(), &compressedDump{Compression: Compression{CompressionGzip, 6}, data: compressibleDump})
+	if err := h.upload(ctx, "daily/2026-05-27-backup.sql.gz", compressibleDump, checksum(compressibleDump)); err != nil {
+		t.Fatal(err)
+	}
+	if got := aws.ToString(f.lastPut.ContentEncoding); got != "gzip" {
+		t.Errorf("gzip ContentEncoding = %q", got)
+	}
+	if got := aws.ToString(f.lastPut.ContentDisposition); got != `attachment; filename="2026-05-27-backup.sql"` {
+		t.Errorf("gzip ContentDisposition = %q, want the decoded name", got)
+	}
+}
+
+func TestContentHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		format                      string
+		c                           Compression
+		contentType, encoding, name string
+	}{
+		{FormatPlain, Compression{}, "application/sql", "", "2026-05-27-backup.sql"},
+		{FormatPlain, Compression{CompressionGzip, 6}, "application/sql", "gzip", "2026-05-27-backup.sql"},
+		{FormatPlain, Compression{CompressionZstd, 3}, "application/zstd", "", "2026-05-27-backup.sql.zst"},
+		{FormatCustom, Compression{}, "application/octet-stream", "", "2026-05-27-backup.dump"},
+		{FormatDirectory, Compression{}, "application/x-tar", "", "2026-05-27-backup.tar"},
+	} {
+		key := storedKey("schema-only/daily/2026-05-27-backup.sql", tc.c)
+		contentType, encoding, disposition := contentHeaders(key, tc.format, tc.c)
+		if contentType != tc.contentType || encoding != tc.encoding || disposition != `attachment; filename="`+tc.name+`"` {
+			t.Errorf("contentHeaders(%s) = %q, %q, %q", tc.c, contentType, encoding, disposition)
+		}
+	}
+}
+
+func TestCheckCollision(t *testing.T) {
+	f := newFakeS3()
+	a := newTestHandler(f, 7)
+	a.db.Database = "orders"
+	if _, err := a.Run(context.Background(), RunOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	daily := "daily/2026-05-27-backup.sql"
+	if got := f.objects[daily].metadata["source-id"]; got != "localhost:5432/orders" {
+		t.Fatalf("source-id = %q", got)
+	}
+
+	for name, streamed := range map[string]bool{"buffered": false, "streamed": true} {
+		b := newTestHandler(f, 7)
+		b.db.Database = "billing"
+		b.dump = staticDump([]byte("billing dump"))
+		b.streamUploads = streamed
+		b.streamDump = staticStream([]byte("billing dump"), nil)
+		_, err := b.Run(context.Background(), RunOptions{Force: true})
+		if err == nil || !strings.Contains(err.Error(), "prefix collision") || failureClass(err) != ClassInvalid {
+			t.Errorf("%s: err = %v, want a prefix collision", name, err)
+		}
+		if string(f.objects[daily].body) != "dump" {
+			t.Fatalf("%s: the other database's backup was overwritten", name)
+		}
+	}
+
+	// The same database under a configured server name is another identity.
+	c := newTestHandler(f, 7)
+	c.db.Database = "orders"
+	c.serverID = "orders-primary"
+	c.dump = staticDump([]byte("changed"))
+	if _, err := c.Run(context.Background(), RunOptions{Force: true}); err == nil {
+		t.Error("a changed identity should collide")
+	}
+
+	// Backups without a source-id are overwritten as before.
+	delete(f.objects[daily].metadata, "source-id")
+	if _, err := c.Run(context.Background(), RunOptions{Force: true}); err != nil {
+		t.Fatalf("legacy backup: %v", err)
+	}
+	if got := f.objects[daily].metadata["source-id"]; got != "orders-primary/orders" {
+		t.Errorf("source-id = %q", got)
+	}
+}
@@ -0,0 +1,361 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// stagingPrefix holds the dumps of streamed runs while they decide where
+// the dump is stored (see runStreamed).
+const stagingPrefix = statePrefix + "uploads/"
+
+// errStreamFallback marks the failure of a streamed upload that Run retries
+// buffered (see Config.StreamFallbackMax).
+var errStreamFallback = errors.New("streamed upload failed")
+
+// streamedRun is what Run has settled before the dump of a streamed run.
+type streamedRun struct {
+	profile  Profile
+	opts     RunOptions
+	dumpOpts DumpOptions
+	refresh  []byte
+	changed  string // see Result.Changed
+	plans    []slicePlan
+	timer    *phaseTimer
+	stats    *S3Stats
+	start    time.Time
+	release  func() // returns the throttle token
+}
+
+// runStreamed is Run for a Handler with StreamUploads. The dump is never
+// held in memory: StreamDump writes it through hashing and compression into
+// a multipart upload to a staging object under stagingPrefix, one part
+// uploading while the next fills. Once the checksum is known the run decides
+// as Run does; each backup it stores is then a server-side copy of the
+// staging object with the metadata of an uploaded backup, and the staging
+// object is deleted. An unchanged dump is thus uploaded, but only stored as
+// the backups of a month or year without one. Compression references are
+// not used. Streaming overlaps dumping, compressing and uploading, all
+// counted in the dump phase. Run keeps runs with table slices or replicas,
+// which need the dump in memory, on the buffered path. An upload that fails
+// for a dump within StreamFallbackMax, by the previous backup and what was
+// dumped before the failure, returns errStreamFallback, the throttle token
+// still held, for Run to dump again buffered. A first run never falls back.
+func (h *Handler) runStreamed(ctx context.Context, runID string, r streamedRun) (*Result, error) {
+	if h.referenceDays > 0 {
+		logf(ctx, "Streamed uploads are compressed without a reference")
+	}
+	profile := r.profile
+	mostRecent, err := h.mostRecentBackup(ctx, h.runTierPrefix(profile.Prefix))
+	if err != nil {
+		logf(ctx, "Warning: couldn't find most recent backup: %v", err)
+	}
+	// Auto compression projects its sample over the size of the previous
+	// dump, the best guess there is before this one ends; so does the
+	// buffered fallback.
+	estimate, previous := int64(compressionSampleSize), int64(0)
+	if (h.compression.Codec == CompressionAuto || h.streamFallback > 0) && mostRecent != "" {
+		if head, err := h.headObject(ctx, mostRecent); err == nil {
+			previous = uncompressedSize(head.Metadata, aws.ToInt64(head.ContentLength))
+			estimate = previous
+		}
+	}
+
+	staging := stagingPrefix + runID + ".sql"
+	sink := &streamSink{
+		h:      h,
+		ctx:    ctx,
+		key:    staging,
+		hasher: newChunkHasher(defaultChunkSize),
+		choose: func(sample []byte) Compression { return h.chooseCompressionSized(ctx, sample, int(estimate)) },
+	}
+	if h.compression.Codec == CompressionAuto {
+		sink.hold = compressionSampleSize
+	}
+	var filtered time.Duration
+	err = h.streamDump(withFilterTime(ctx, &filtered), h.db, r.dumpOpts, sink)
+	if err == nil {
+		err = sink.Close()
+	}
+	if err != nil {
+		sink.abort()
+		// Without a previous backup the size of the database is unknown,
+		// and dumping it again into memory could exhaust it.
+		if sink.uploadErr != nil && h.streamFallback > 0 && previous > 0 && max(previous, sink.size) <= h.streamFallback {
+			return nil, fmt.Errorf("%w: %w", errStreamFallback, sink.uploadErr)
+		}
+		return nil, failedIn(phaseDump, fmt.Errorf("failed to create backup: %w", err))
+	}
+	defer h.deleteStaging(ctx, staging)
+	r.release()
+	r.timer.done(phaseDump)
+	r.timer.move(filtered, phaseDump, phaseFilter)
+	sum, chunks := sink.hasher.result()
+	size := sink.size
+	logf(ctx, "Backup streamed, size: %d bytes", size)
+
+	now := h.now()
+	dailyKey := storedKey(h.backupKey(profile.Prefix, h.runTier(), now), sink.compression)
+	result := &Result{
+		Status:    "ok",
+		RunID:     runID,
+		Profile:   profile.Name,
+		Labels:    r.opts.Labels,
+		Changed:   r.changed,
+		Key:       dailyKey,
+		Size:      HumanizeSize(int(size)),
+		SizeBytes: int(size),
+	}
+	finish := func() (*Result, error) {
+		result.Phases = r.timer.finish(ctx)
+		result.S3 = r.stats.counts(ctx)
+		result.DurationMs = h.elapsed(r.start)
+		return result, nil
+	}
+
+	upload, reason := h.decideStreamedUpload(ctx, mostRecent, dailyKey, sum, r.opts.Force)
+	result.Reason = reason
+	r.timer.done(phaseHash)
+	if !upload {
+		logf(ctx, "Skipping %s backup upload: %s", h.runTier(), reason)
+		result.Action = "skipped"
+	}
+
+	// A skipped run takes no snapshot, but still stores a new month's or
+	// year's backup from the staging object.
+	if h.snapshot != nil && (upload || r.opts.ReplacePeriodic) {
+		if id, err := h.takeSnapshot(ctx, profile.Name, now); err != nil {
+			result.Status, result.SnapshotErr = "partial", err.Error()
+		} else {
+			result.Snapshot = id
+			ctx = withSnapshotID(ctx, id)
+		}
+	}
+
+	c, source := sink.compression, sink.info.result()
+	metadata := map[string]string{"sha256": sum}
+	if c.enabled() {
+		result.Compression = c.String()
+		c.addMetadata(metadata, int(size))
+	}
+	if id := snapshotID(ctx); id != "" {
+		metadata["snapshot-id"] = id
+	}
+	metadata["run-id"] = runID
+	metadata["source-id"] = h.sourceID()
+	if fp, ok := fingerprintFrom(ctx); ok {
+		metadata["fingerprint"] = fp.String()
+	}
+	h.encryption.addMetadata(metadata)
+	source.addMetadata(metadata)
+	format := sink.info.format()
+	if format != FormatPlain {
+		metadata["format"] = format
+	}
+	manifest := h.newManifest(ctx, "", profile.Name, size, sum, chunks, source, nil)
+	manifest.Format = format
+	if c.enabled() {
+		manifest.Compression = c.String()
+	}
+	store := func(key string) error {
+		if err := h.checkCollision(ctx, key, sum); err != nil {
+			return err
+		}
+		if err := h.copyObject(ctx, staging, key, sink.stored(), metadata, c); err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %w", staging, key, err)
+		}
+		h.removeRenamed(ctx, key)
+		m := manifest
+		m.Key = key
+		if err := h.putManifest(ctx, m); err != nil {
+			return err
+		}
+		if err := h.uploadRefresh(ctx, key, r.refresh); err != nil {
+			return err
+		}
+		return h.uploadMigrations(ctx, key)
+	}
+
+	if upload {
+		if err := store(dailyKey); err != nil {
+			return nil, failedIn(phaseUpload, fmt.Errorf("failed to upload %s backup: %w", h.runTier(), err))
+		}
+		logf(ctx, "%s backup uploaded: %s", tierTitle(h.runTier()), dailyKey)
+		result.Action = "created"
+		result.ManifestKey = manifestKey(dailyKey)
+		if r.refresh != nil {
+			result.RefreshKey = refreshKey(dailyKey)
+		}
+		if migrationsFrom(ctx) != nil {
+			result.Migrations = migrationsKey(dailyKey)
+		}
+		if pointer, err := h.updateLatest(ctx, profile.Prefix, dailyKey, size, sum); err != nil {
+			logf(ctx, "Warning: %v", err)
+			result.Status, result.LatestErr = "partial", err.Error()
+		} else {
+			result.Latest = pointer
+		}
+	}
+	for _, tier := range h.periodicTiers() {
+		key := storedKey(h.backupKey(profile.Prefix, strings.ToLower(tier), now), c)
+		verb := "replaced"
+		if !r.opts.ReplacePeriodic {
+			existing, err := h.findBackup(ctx, key)
+			if err != nil {
+				return nil, failedIn(phaseUpload, fmt.Errorf("failed to check %s: %w", key, err))
+			}
+			if existing != "" {
+				continue
+			}
+			verb = "created"
+		}
+		if err := store(key); err != nil {
+			return nil, failedIn(phaseUpload, err)
+		}
+		logf(ctx, "%s backup %s: %s", tier, verb, key)
+	}
+	r.timer.done(phaseUpload)
+	if !upload && !r.opts.ReplacePeriodic {
+		r.timer.done(phaseCleanup)
+		return finish()
+	}
+
+	if _, err := h.applyRetention(ctx, profile.Prefix, h.profileRetention(profile), now, false); err != nil {
+		logf(ctx, "Warning: failed to clean up old backups: %v", err)
+	}
+	r.timer.done(phaseCleanup)
+
+	logf(ctx, "Backup process completed successfully")
+	return finish()
+}
+
+// decideStreamedUpload is decideDailyUpload for a streamed dump with
+// checksum sum, given the most recent daily backup.
+func (h *Handler) decideStreamedUpload(ctx context.Context, mostRecent, dailyKey, sum string, force bool) (upload bool, reason string) {
+	if mostRecent == "" || !h.checksumMatches(ctx, mostRecent, sum) {
+		return true, "content changed"
+	}
+	if !force {
+		return false, "unchanged"
+	}
+	if today, err := h.findBackup(ctx, dailyKey); err == nil && today != "" && h.checksumMatches(ctx, today, sum) {
+		return false, "today's backup already identical"
+	}
+	return true, "forced; matched an older backup"
+}
+
+// checksumMatches reports whether the object at key exists and has checksum
+// sum (see objectChecksum).
+func (h *Handler) checksumMatches(ctx context.Context, key, sum string) bool {
+	existing, err := h.objectChecksum(ctx, key)
+	return err == nil && existing == sum
+}
+
+// deleteStaging deletes the staging object of a streamed run. One left
+// behind is removed by the bucket's lifecycle rule for stagingPrefix.
+func (h *Handler) deleteStaging(ctx context.Context, key string) {
+	if _, err := h.s3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(h.bucket), Key: aws.String(key)}); err != nil {
+		logf(ctx, "Warning: failed to delete %s: %v", key, err)
+	}
+}
+
+// streamSink is the io.Writer a streamed dump is written to. It hashes the
+// dump (see chunkHasher), reads its DumpInfo, and compresses it into a
+// multipartWriter. The first hold bytes are held back until choose has picked
+// the Compression from them.
+type streamSink struct {
+	h      *Handler
+	ctx    context.Context
+	key    string
+	choose func(sample []byte) Compression
+	hold   int // compressionSampleSize under CompressionAuto, else 0
+	hasher *chunkHasher
+	info   dumpInfoScanner
+	size   int64 // dump bytes written
+
+	// uploadErr is the first error of the compressor or the upload, as
+	// opposed to one of the dump.
+	uploadErr error
+
+	sample      []byte
+	compression Compression
+	out         io.WriteCloser // compressor into mw, nil until the Compression is chosen
+	mw          *multipartWriter
+}
+
+func (s *streamSink) Write(p []byte) (int, error) {
+	_, _ = s.hasher.Write(p)
+	_, _ = s.info.Write(p)
+	s.size += int64(len(p))
+	if s.out == nil {
+		s.sample = append(s.sample, p...)
+		if len(s.sample) < s.hold {
+			return len(p), nil
+		}
+		return len(p), s.failed(s.begin())
+	}
+	if _, err := s.out.Write(p); err != nil {
+		return 0, s.failed(err)
+	}
+	return len(p), nil
+}
+
+// failed records err, when not nil, as the sink's uploadErr and returns it.
+func (s *streamSink) failed(err error) error {
+	if err != nil && s.uploadErr == nil {
+		s.uploadErr = err
+	}
+	return err
+}
+
+// begin chooses the Compression and starts the upload with the sample.
+func (s *streamSink) begin() error {
+	s.compression = s.choose(s.sample)
+	metadata := map[string]string{}
+	if id := RunID(s.ctx); id != "" {
+		metadata["run-id"] = id
+	}
+	s.h.encryption.addMetadata(metadata)
+	s.mw = s.h.newMultipartWriter(s.ctx, s.key, metadata)
+	out, err := s.compression.writer(s.mw, s.h.limits.zstdWindow)
+	if err != nil {
+		return err
+	}
+	s.out = out
+	sample := s.sample
+	s.sample = nil
+	_, err = out.Write(sample)
+	return err
+}
+
+// Close flushes the compressor and completes the upload.
+func (s *streamSink) Close() error {
+	if s.out == nil {
+		if err := s.begin(); err != nil {
+			return s.failed(err)
+		}
+	}
+	if err := s.out.Close(); err != nil {
+		return s.failed(err)
+	}
+	return s.failed(s.mw.Close())
+}
+
+// abort aborts the upload, if one was started.
+func (s *streamSink) abort() {
+	if s.mw != nil {
+		s.mw.abort()
+	}
+}
+
+// stored returns the size of the uploaded object.
+func (s *streamSink) stored() int64 {
+	return s.mw.written
+}
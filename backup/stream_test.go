@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// staticStream returns a StreamDumper that writes body in small pieces, then
+// fails with err unless it is nil.
+func staticStream(body []byte, err error) StreamDumper {
+	return func(_ context.Context, _ DatabaseConfig, _ DumpOptions, w io.Writer) error {
+		for off := 0; off < len(body); off += 4096 {
+			if _, err := w.Write(body[off:min(off+4096, len(body))]); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+}
+
+// stagingKeys returns the keys left under stagingPrefix.
+func stagingKeys(f *fakeS3) []string {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, stagingPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestRunStreamed(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.streamUploads = true
+	h.compression = Compression{CompressionZstd, 3}
+	dump := append([]byte(sampleDump), compressibleDump...)
+	h.streamDump = staticStream(dump, nil)
+	h.dump = failingDump(errors.New("buffered dump used"))
+	ctx := context.Background()
+
+	res, err := h.Run(ctx, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "created" || res.SizeBytes != len(dump) || res.Compression != "zstd:3" {
+		t.Fatalf("result = %+v", res)
+	}
+	for _, key := range []string{res.Key, "monthly/2026-05-backup.sql", "yearly/2026-backup.sql"} {
+		obj := f.objects[key]
+		if obj == nil {
+			t.Fatalf("missing %s", key)
+		}
+		if obj.metadata["sha256"] != checksum(dump) || obj.metadata["compression"] != CompressionZstd || obj.metadata["extensions"] != "pgcrypto,uuid-ossp" {
+			t.Errorf("%s metadata = %v", key, obj.metadata)
+		}
+		if len(obj.body) >= len(dump) || !bytes.Equal(readAll(t, h, key), dump) {
+			t.Errorf("%s does not hold the compressed dump", key)
+		}
+	}
+	m, err := h.readManifest(ctx, res.Key)
+	if err != nil || m == nil {
+		t.Fatalf("manifest = %v, %v", m, err)
+	}
+	if m.SHA256 != checksum(dump) || m.Size != int64(len(dump)) || len(m.Chunks) != len(chunkSums(dump, defaultChunkSize)) || m.Compression != "zstd:3" || m.Source.ServerVersion == "" {
+		t.Errorf("manifest = %+v", m)
+	}
+	if keys := stagingKeys(f); len(keys) != 0 {
+		t.Errorf("staging objects left: %v", keys)
+	}
+
+	// An unchanged dump is uploaded to stage it, but not stored again.
+	h.now = fixedClock(testNow.AddDate(0, 0, 1))
+	next, err := h.Run(ctx, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Action != "skipped" || next.Reason != "unchanged" || f.objects[next.Key] != nil {
+		t.Errorf("unchanged run = %+v; want skipped", next)
+	}
+	if keys := stagingKeys(f); len(keys) != 0 {
+		t.Errorf("staging objects left: %v", keys)
+	}
+
+	// Unchanged into June, it still stores June's monthly backup.
+	h.now = fixedClock(testNow.AddDate(0, 0, 5))
+	june, err := h.Run(ctx, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if june.Action != "skipped" || f.objects[june.Key] != nil {
+		t.Errorf("unchanged run in June = %+v; want skipped", june)
+	}
+	if obj := f.objects["monthly/2026-06-backup.sql"]; obj == nil || !bytes.Equal(readAll(t, h, "monthly/2026-06-backup.sql"), dump) {
+		t.Error("June's monthly backup not stored")
+	}
+}
+
+func TestRunStreamedMultipart(t *testing.T) {
+	smallParts(t)
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.streamUploads = true
+	dump := bytes.Repeat([]byte("INSERT INTO t VALUES (1);\n"), 2000)
+	h.streamDump = staticStream(dump, nil)
+
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readAll(t, h, res.Key), dump) || f.objects[res.Key].metadata["sha256"] != checksum(dump) {
+		t.Errorf("daily backup does not hold the dump")
+	}
+	// The staging upload, then a copy in parts for each tier.
+	if f.completes != 4 || f.copies != 0 || len(f.uploads) != 0 {
+		t.Errorf("%d completes, %d copies, %d uploads left; want multipart uploads and copies", f.completes, f.copies, len(f.uploads))
+	}
+}
+
+func TestRunStreamedDumpFailure(t *testing.T) {
+	smallParts(t)
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.streamUploads = true
+	h.streamDump = staticStream(bytes.Repeat([]byte("x"), 4<<10), errors.New("connection lost"))
+
+	if _, err := h.Run(context.Background(), RunOptions{}); err == nil || !strings.Contains(err.Error(), "connection lost") {
+		t.Fatalf("err = %v, want the dump failure", err)
+	}
+	if f.aborts != 1 || len(f.uploads) != 0 || len(f.objects) != 0 {
+		t.Errorf("%d aborts, %d uploads, %d objects; want the upload aborted and nothing stored", f.aborts, len(f.uploads), len(f.objects))
+	}
+}
+
+func TestRunStreamedBuffersReplicas(t *testing.T) {
+	f := newFakeS3()
+	dr := newFakeS3()
+	h := runHandler(t, f, staticDump([]byte(sampleDump)), 7)
+	h.streamUploads = true
+	h.streamDump = staticStream(nil, errors.New("streamed dump used"))
+	h.replicas = []Replica{{Name: "dr", S3: dr, Bucket: "dr"}}
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil || res.Action != "created" {
+		t.Fatalf("Run = %+v, %v; want the run buffered", res, err)
+	}
+	if dr.objects[res.Key] == nil || len(stagingKeys(f)) != 0 {
+		t.Errorf("replica holds %s: %v; want it copied without staging", res.Key, dr.objects[res.Key] != nil)
+	}
+}
+
+func TestRunStreamedFallsBackToBuffered(t *testing.T) {
+	smallParts(t)
+	f := newFakeS3()
+	dump := bytes.Repeat([]byte("INSERT INTO t VALUES (1);\n"), 400)
+	h := runHandler(t, f, staticDump(dump), 7)
+	h.streamUploads = true
+	h.streamDump = staticStream(dump, nil)
+	f.partErr = errors.New("simulated failure")
+	if _, err := h.Run(context.Background(), RunOptions{}); err == nil {
+		t.Fatal("a failed streamed upload should fail the run without a fallback")
+	}
+
+	h.streamFallback = 100 // less than the part that failed
+	if _, err := h.Run(context.Background(), RunOptions{}); err == nil {
+		t.Fatal("a dump over StreamFallbackMax should not fall back")
+	}
+
+	h.streamFallback = 1 << 20
+	if _, err := h.Run(context.Background(), RunOptions{}); err == nil {
+		t.Fatal("a first run, of a database of unknown size, should not fall back")
+	}
+
+	f.seed("daily/"+testNow.AddDate(0, 0, -1).Format("2006-01-02")+"-backup.sql", bytes.Repeat([]byte("INSERT INTO t VALUES (2);\n"), 400), testNow.AddDate(0, 0, -1))
+	res, err := h.Run(context.Background(), RunOptions{})
+	if err != nil || res.Action != "created" {
+		t.Fatalf("Run = %+v, %v; want the run retried buffered", res, err)
+	}
+	if !bytes.Equal(readAll(t, h, res.Key), dump) || len(f.uploads) != 0 || len(stagingKeys(f)) != 0 {
+		t.Errorf("daily backup does not hold the dump, or uploads are left behind")
+	}
+}
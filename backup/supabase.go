@@ -0,0 +1,39 @@
+package backup
+
+// SupabaseSchema is a schema that Supabase creates and manages on behalf of a
+// project, together with why it is safe to leave out of an application backup.
+type SupabaseSchema struct {
+	Name   string
+	Reason string
+}
+
+// SupabaseSchemas lists the Supabase-managed schemas excluded in Supabase mode.
+// They belong to the platform's own services, are recreated when a project is
+// provisioned, and in several cases (pgsodium, vault) hold data that is only
+// meaningful with the original project's keys. Restoring them over a fresh
+// project conflicts with the objects Supabase already created there.
+var SupabaseSchemas = []SupabaseSchema{
+	{"auth", "GoTrue users, sessions and identities; back it up separately if users cannot simply sign up again"},
+	{"storage", "Storage API bucket/object metadata; the files themselves live outside the database"},
+	{"realtime", "Realtime service subscriptions and messages"},
+	{"_realtime", "Realtime tenant configuration (self-hosted)"},
+	{"supabase_functions", "database webhook plumbing managed by the platform"},
+	{"supabase_migrations", "Supabase CLI migration history, rebuilt by `supabase db push`"},
+	{"extensions", "extension objects installed and upgraded by the platform"},
+	{"graphql", "pg_graphql internals"},
+	{"graphql_public", "pg_graphql entry points"},
+	{"pgbouncer", "connection pooler auth helper"},
+	{"pgsodium", "pgsodium key material tied to the project's root key"},
+	{"pgsodium_masks", "pgsodium generated decryption views"},
+	{"vault", "Supabase Vault secrets, encrypted with the project's root key"},
+}
+
+// SupabaseExcludeSchemas returns the names in SupabaseSchemas, suitable for
+// DumpOptions.ExcludeSchemas.
+func SupabaseExcludeSchemas() []string {
+	names := make([]string, len(SupabaseSchemas))
+	for i, s := range SupabaseSchemas {
+		names[i] = s.Name
+	}
+	return names
+}
@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// suppressPrefix holds the state of recent failure notifications (see
+// suppressRepeat), one object per class of failure.
+const suppressPrefix = statePrefix + "notifications/"
+
+// suppressState is what is kept about a class of failure notifications: when
+// one was last sent, and how many have been suppressed since.
+type suppressState struct {
+	Event      string    `json:"event"`
+	Database   string    `json:"database"`
+	LastSent   time.Time `json:"last_sent"`
+	Suppressed int       `json:"suppressed"`
+	FirstSince time.Time `json:"first_suppressed,omitempty"` // first suppressed since LastSent
+	LastSince  time.Time `json:"last_suppressed,omitempty"`  // latest suppressed since LastSent
+}
+
+// errorNoise matches the parts of an error that change between occurrences of
+// the same failure: quoted names, long hex strings (IDs, hashes) and numbers
+// (counts, addresses, ports, durations).
+var errorNoise = regexp.MustCompile(`"[^"]*"|'[^']*'|\b[0-9a-fA-F-]{8,}\b|\d+`)
+
+// errorClass returns what identifies the failure n reports: its event and its
+// error (or message) with errorNoise masked, so "connection refused" from
+// 10.0.0.1 and from 10.0.0.2, or after 3 and 4 retries, is one class.
+func errorClass(n Notification) string {
+	detail := n.Message
+	if e := n.Fields["error"]; e != "" {
+		detail = e
+	}
+	return n.Event + "\n" + errorNoise.ReplaceAllString(detail, "#")
+}
+
+// isFailure reports whether event names a failure, such as backup.failed or
+// backup.replica_failed.
+func isFailure(event string) bool {
+	return strings.HasSuffix(event, "failed")
+}
+
+// suppressRepeat reports whether n, a failure notification, repeats one of the
+// same class (see errorClass) about the same database sent less than the
+// Handler's notifyWindow ago, and should not be sent. Suppressed
+// notifications are counted in the bucket; the next one of the class sent
+// once the window has passed carries the count and the times of the first and
+// last in its fields and message, so a flapping database pages once per
+// window with a summary of the rest. State that cannot be read or written
+// never suppresses a notification.
+func (h *Handler) suppressRepeat(ctx context.Context, n *Notification) bool {
+	if h.notifyWindow <= 0 || !isFailure(n.Event) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(h.bucket + "\n" + h.db.Host + "/" + h.db.Database + "\n" + errorClass(*n)))
+	key := suppressPrefix + hex.EncodeToString(sum[:8]) + ".json"
+	now := h.now().UTC()
+
+	var state suppressState
+	if body, err := h.openObject(ctx, key); err == nil {
+		err = json.NewDecoder(body).Decode(&state)
+		_ = body.Close()
+		if err != nil {
+			logf(ctx, "Warning: ignoring unreadable notification state %s: %v", key, err)
+			state = suppressState{}
+		}
+	}
+	if !state.LastSent.IsZero() && now.Sub(state.LastSent) < h.notifyWindow {
+		if state.Suppressed == 0 {
+			state.FirstSince = now
+		}
+		state.Suppressed++
+		state.LastSince = now
+		if err := h.writeJSON(ctx, key, state); err != nil {
+			logf(ctx, "Warning: failed to record suppressed notification: %v", err)
+			return false
+		}
+		logf(ctx, "Suppressed %s notification: %d similar since %s", n.Event, state.Suppressed, state.LastSent.Format(time.RFC3339))
+		return true
+	}
+
+	if state.Suppressed > 0 {
+		n.Message += fmt.Sprintf(" (%d similar notification(s) suppressed between %s and %s)",
+			state.Suppressed, state.FirstSince.Format(time.RFC3339), state.LastSince.Format(time.RFC3339))
+		fields := make(map[string]string, len(n.Fields)+3)
+		for k, v := range n.Fields {
+			fields[k] = v
+		}
+		fields["suppressed"] = strconv.Itoa(state.Suppressed)
+		fields["first_suppressed"] = state.FirstSince.Format(time.RFC3339)
+		fields["last_suppressed"] = state.LastSince.Format(time.RFC3339)
+		n.Fields = fields
+	}
+	state = suppressState{Event: n.Event, Database: h.db.Database, LastSent: now}
+	if err := h.writeJSON(ctx, key, state); err != nil {
+		logf(ctx, "Warning: failed to record sent notification: %v", err)
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSuppressRepeatedFailures(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	var sent []Notification
+	h.notifier = func(_ context.Context, n Notification) error {
+		sent = append(sent, n)
+		return nil
+	}
+	h.notifyWindow = 6 * time.Hour
+	ctx := context.Background()
+
+	// A flapping database fails hourly, from changing addresses.
+	for i := range 8 {
+		h.now = fixedClock(testNow.Add(time.Duration(i) * time.Hour))
+		h.dump = failingDump(errors.New("dial tcp 10.0.0." + string(rune('1'+i)) + ":5432: connect: connection refused"))
+		if _, err := h.Run(ctx, RunOptions{}); err == nil {
+			t.Fatal("expected run to fail")
+		}
+	}
+	if len(sent) != 2 {
+		t.Fatalf("sent %d notifications, want 2: %+v", len(sent), sent)
+	}
+	if sent[0].Event != "backup.failed" || sent[0].Fields["database"] != h.db.Database {
+		t.Errorf("first notification = %+v", sent[0])
+	}
+	if got := sent[1].Fields["suppressed"]; got != "5" {
+		t.Errorf("suppressed = %q, want 5 (hours 1-5)", got)
+	}
+	if !strings.Contains(sent[1].Message, "5 similar notification(s) suppressed") {
+		t.Errorf("message = %q", sent[1].Message)
+	}
+
+	// Another class of failure, and events that are not failures, are sent.
+	h.dump = failingDump(errors.New("permission denied for table users"))
+	_, _ = h.Run(ctx, RunOptions{})
+	h.notify(ctx, Notification{Event: "thaw.available"})
+	h.notify(ctx, Notification{Event: "thaw.available"})
+	if len(sent) != 5 {
+		t.Errorf("sent %d notifications, want 5", len(sent))
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	same := [][2]string{
+		{"pg_dump failed: exit status 1 after 30s", "pg_dump failed: exit status 1 after 45s"},
+		{`relation "users" does not exist`, `relation "orders" does not exist`},
+		{"snapshot 3f2a9c1e-0b7d-4e55-9d1c-2b7e8f6a4c10 failed", "snapshot 9d1c2b7e-8f6a-4c10-3f2a-9c1e0b7d4e55 failed"},
+	}
+	for _, p := range same {
+		a := errorClass(Notification{Event: "backup.failed", Fields: map[string]string{"error": p[0]}})
+		b := errorClass(Notification{Event: "backup.failed", Fields: map[string]string{"error": p[1]}})
+		if a != b {
+			t.Errorf("%q and %q differ: %q, %q", p[0], p[1], a, b)
+		}
+	}
+	if errorClass(Notification{Event: "backup.failed", Message: "connection refused"}) == errorClass(Notification{Event: "backup.failed", Message: "permission denied"}) {
+		t.Error("different errors share a class")
+	}
+}
@@ -0,0 +1,51 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ResolveTarget returns the database a restore's target names: a connection
+// string, the ARN of a Secrets Manager secret holding one or the RDS-style
+// JSON SecretsManagerDatabase reads, or one of Config.RestoreAliases, which
+// stands for either, or for a secret by name. Secrets are read when the
+// restore runs, so the credentials stay out of the invocation and its
+// history. "" returns no database, which Restore refuses.
+func (h *Handler) ResolveTarget(ctx context.Context, target string) (DatabaseConfig, error) {
+	value, alias := h.restoreAliases[target]
+	if !alias {
+		value = target
+	}
+	switch {
+	case target == "":
+		return DatabaseConfig{}, nil
+	case strings.Contains(value, "://"):
+		db, err := ParseDatabaseURL(value)
+		if err != nil {
+			return DatabaseConfig{}, invalidInput(fmt.Errorf("invalid target %s: %w", target, err))
+		}
+		return db, nil
+	case !alias && !strings.HasPrefix(value, "arn:"):
+		names := make([]string, 0, len(h.restoreAliases))
+		for name := range h.restoreAliases {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return DatabaseConfig{}, invalidInput(fmt.Errorf("unknown restore target %q: want a connection string, a secret ARN or one of RESTORE_TARGET_ALIASES (%s)", target, strings.Join(names, ", ")))
+	case h.secrets == nil:
+		return DatabaseConfig{}, errors.New("restore targets cannot be read from secrets: no SecretFetcher is configured")
+	}
+	secret, err := h.secrets(ctx, value)
+	if err == nil {
+		var db DatabaseConfig
+		if db, err = parseDatabaseSecret(secret, DatabaseConfig{}); err == nil {
+			RegisterSecret(db.Password)
+			logf(ctx, "Read restore target %s from its secret: %s", target, connName(db))
+			return db, nil
+		}
+	}
+	return DatabaseConfig{}, fmt.Errorf("failed to read restore target %s: %w", target, err)
+}
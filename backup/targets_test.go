@@ -0,0 +1,45 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestResolveTarget(t *testing.T) {
+	const arn = "arn:aws:secretsmanager:us-west-1:123456789012:secret:staging-AbCdEf"
+	h := newTestHandler(newFakeS3(), 7)
+	h.restoreAliases = map[string]string{"staging": arn, "scratch": "postgresql://u@scratch/app", "rds": "restore/rds"}
+	h.secrets = func(_ context.Context, id string) (string, error) {
+		switch id {
+		case arn:
+			return `{"username": "app", "password": "s3cr3t-target", "host": "staging-db", "port": 5433, "dbname": "app"}`, nil
+		case "restore/rds":
+			return "postgresql://rds:pw@rds-db/app", nil
+		}
+		return "", errors.New("ResourceNotFoundException")
+	}
+
+	for target, want := range map[string]string{
+		"staging":                   "staging-db:5433/app",
+		arn:                         "staging-db:5433/app",
+		"scratch":                   "scratch:5432/app",
+		"rds":                       "rds-db:5432/app",
+		"postgresql://u@direct/app": "direct:5432/app",
+	} {
+		db, err := h.ResolveTarget(context.Background(), target)
+		if err != nil || connName(db) != want {
+			t.Errorf("ResolveTarget(%s) = %s, %v; want %s", target, connName(db), err, want)
+		}
+	}
+	if got := Redact("password s3cr3t-target"); strings.Contains(got, "s3cr3t-target") {
+		t.Errorf("the secret's password is not redacted: %s", got)
+	}
+	if _, err := h.ResolveTarget(context.Background(), "prod"); err == nil || failureClass(err) != ClassInvalid || !strings.Contains(err.Error(), "rds, scratch, staging") {
+		t.Errorf("unknown alias: err = %v, want an invalid input error listing the aliases", err)
+	}
+	if _, err := h.ResolveTarget(context.Background(), arn+"x"); err == nil || !strings.Contains(err.Error(), "ResourceNotFoundException") {
+		t.Errorf("missing secret: err = %v", err)
+	}
+}
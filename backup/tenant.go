@@ -0,0 +1,191 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TenantRegistry locates the tenants whose data is backed up separately: each
+// RunTenants call reads them afresh, so a tenant added to the registry is
+// included in the next run without any configuration change.
+type TenantRegistry struct {
+	// Query lists the tenants, one row each of
+	//
+	//	tenant id, database, schema
+	//
+	// where an empty (or NULL) database means the configured one and a
+	// schema, if any, limits the tenant's dump to that schema, for tenants
+	// sharing a database.
+	Query string
+	// Database is the control database Query runs against; without a Host
+	// it is the database backed up (Config.Database).
+	Database DatabaseConfig
+	// Schemas, used instead of Query, is a glob ("tenant_*", where "?"
+	// matches one character) for single-database applications that keep
+	// each tenant in a schema: every schema of the database backed up whose
+	// name matches is a tenant of its own, named after the schema, and is
+	// dumped alone (pg_dump -n), so it can be restored without touching the
+	// others. Objects outside the tenant schemas are in none of their dumps.
+	Schemas string
+}
+
+// enabled reports whether r lists any tenants.
+func (r TenantRegistry) enabled() bool {
+	return r.Query != "" || r.Schemas != ""
+}
+
+// Tenant is one row of the TenantRegistry.
+type Tenant struct {
+	ID       string `json:"tenant"`
+	Database string `json:"database,omitempty"` // "" means the configured database
+	Schema   string `json:"schema,omitempty"`   // dump only this schema
+}
+
+// tenantPrefix is the key prefix of the backups of tenant id.
+func tenantPrefix(id string) string {
+	return "tenants/" + id + "/"
+}
+
+// tenantID matches the tenant ids that are safe as a key prefix.
+var tenantID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// TenantResult is the outcome of one tenant's backup.
+type TenantResult struct {
+	Tenant
+	Result *Result `json:"result,omitempty"` // the tenant's backup run, unless it failed
+	Error  string  `json:"error,omitempty"`  // why the tenant's backup failed
+}
+
+// TenantsResult summarizes a RunTenants call.
+type TenantsResult struct {
+	Status     string         `json:"status"`      // "ok", "partial" when some tenants failed, or "failed" when all did
+	RunID      string         `json:"run_id"`      // run identifier, shared by every tenant's backup
+	Action     string         `json:"action"`      // always "tenants"
+	Tenants    []TenantResult `json:"tenants"`     // per-tenant outcomes, in registry order
+	Failed     int            `json:"failed"`      // tenants whose backup failed
+	DurationMs int64          `json:"duration_ms"` // wall-clock time of the call
+}
+
+// RunTenants lists the tenants of the TenantRegistry and backs up each in turn
+// with opts, like Run, under the prefix "tenants/<id>/", where the tenant keeps
+// its own tiers, retention and manifests (labelled with its id). A tenant whose
+// backup fails does not stop the others; it is reported in the result and by
+// a tenants.failed notification.
+func (h *Handler) RunTenants(ctx context.Context, opts RunOptions) (*TenantsResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	if !h.tenants.enabled() {
+		return nil, errors.New("no tenant registry is configured")
+	}
+	tenants, err := h.listTenants(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the tenant registry: %w", err)
+	}
+	logf(ctx, "Backing up %d tenants", len(tenants))
+
+	result := &TenantsResult{Status: "ok", RunID: runID, Action: "tenants", Tenants: []TenantResult{}}
+	var failed []string
+	for _, t := range tenants {
+		entry := TenantResult{Tenant: t}
+		if entry.Result, err = h.runTenant(ctx, t, opts); err != nil {
+			entry.Error = err.Error()
+			failed = append(failed, t.ID)
+			logf(ctx, "Tenant %s failed: %v", t.ID, err)
+		}
+		result.Tenants = append(result.Tenants, entry)
+	}
+	if len(failed) > 0 {
+		result.Failed = len(failed)
+		result.Status = "partial"
+		if len(failed) == len(tenants) {
+			result.Status = "failed"
+		}
+		h.notify(ctx, Notification{
+			Event:   "tenants.failed",
+			Message: fmt.Sprintf("Backups of %d of %d tenant(s) failed: %s", len(failed), len(tenants), strings.Join(failed, ", ")),
+			Fields:  map[string]string{"failed": strconv.Itoa(len(failed)), "tenants": strings.Join(failed, ",")},
+		})
+	}
+	result.DurationMs = h.elapsed(start)
+	return result, nil
+}
+
+// tenantSchemaQuery lists the schemas matching a LIKE pattern, leaving out
+// the system ones.
+const tenantSchemaQuery = `SELECT nspname FROM pg_catalog.pg_namespace
+WHERE nspname LIKE %s ESCAPE '\' AND nspname NOT LIKE 'pg\_%%' AND nspname <> 'information_schema'
+ORDER BY nspname`
+
+// listTenants reads the tenants from the registry query, or from the catalog
+// under TenantRegistry.Schemas, and validates them.
+func (h *Handler) listTenants(ctx context.Context) ([]Tenant, error) {
+	var rows [][]string
+	var err error
+	if h.tenants.Schemas != "" {
+		rows, err = h.query(ctx, h.db, fmt.Sprintf(tenantSchemaQuery, quoteLiteral(globToLike(h.tenants.Schemas))))
+	} else {
+		rows, err = h.query(ctx, h.tenants.Database, h.tenants.Query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tenants := make([]Tenant, 0, len(rows))
+	seen := map[string]bool{}
+	for i, row := range rows {
+		var t Tenant
+		switch {
+		case h.tenants.Schemas != "" && len(row) == 1:
+			if slices.Contains(h.dumpOpts.ExcludeSchemas, row[0]) {
+				continue
+			}
+			t = Tenant{ID: row[0], Schema: row[0]}
+		case h.tenants.Schemas == "" && (len(row) == 2 || len(row) == 3):
+			t = Tenant{ID: row[0], Database: row[1]}
+			if len(row) == 3 {
+				t.Schema = row[2]
+			}
+		default:
+			return nil, fmt.Errorf("unexpected registry row %q", row)
+		}
+		switch {
+		case !tenantID.MatchString(t.ID):
+			return nil, fmt.Errorf("row %d: invalid tenant id %q", i+1, t.ID)
+		case seen[t.ID]:
+			return nil, fmt.Errorf("row %d: duplicate tenant id %q", i+1, t.ID)
+		case t.Database != "" && !databaseName.MatchString(t.Database):
+			return nil, fmt.Errorf("tenant %s: invalid database name %q", t.ID, t.Database)
+		}
+		seen[t.ID] = true
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// globToLike translates a glob, where "*" matches any run of characters and
+// "?" any one, to a LIKE pattern escaped with "\".
+func globToLike(glob string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "*", "%", "?", "_").Replace(glob)
+}
+
+// runTenant backs up t with opts from a copy of h pointed at its database and
+// schema. A failure is left to the tenants.failed notification of RunTenants.
+func (h *Handler) runTenant(ctx context.Context, t Tenant, opts RunOptions) (*Result, error) {
+	other := *h
+	if t.Database != "" {
+		other.db.Database = t.Database
+	}
+	if t.Schema != "" {
+		other.dumpOpts = h.dumpOpts.merge(DumpOptions{Schemas: []string{t.Schema}})
+	}
+	labels := map[string]string{"tenant": t.ID}
+	for k, v := range opts.Labels {
+		labels[k] = v
+	}
+	opts.Prefix, opts.Labels = tenantPrefix(t.ID), labels
+	return other.run(ctx, RunID(ctx), opts)
+}
@@ -0,0 +1,130 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRunTenants(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.db.Database = "app"
+	h.tenants = TenantRegistry{Query: "SELECT id, db, schema FROM tenants", Database: DatabaseConfig{Host: "control", Database: "registry"}}
+	var registryDB string
+	h.query = fingerprinted(func(_ context.Context, db DatabaseConfig, query string) ([][]string, error) {
+		registryDB = db.Host + "/" + db.Database
+		return [][]string{{"acme", "acme_db", ""}, {"globex", "", "globex"}, {"initech", "", "missing"}}, nil
+	})
+	var dumped []string
+	h.dump = func(_ context.Context, db DatabaseConfig, opts DumpOptions) ([]byte, error) {
+		target := db.Database + "/" + strings.Join(opts.Schemas, ",")
+		dumped = append(dumped, target)
+		if target == "app/missing" {
+			return nil, errors.New("pg_dump: error: no matching schemas were found")
+		}
+		return []byte("-- dump of " + target + "\n"), nil
+	}
+	var notified []Notification
+	h.notifier = func(_ context.Context, n Notification) error {
+		notified = append(notified, n)
+		return nil
+	}
+
+	res, err := h.RunTenants(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("RunTenants: %v", err)
+	}
+	if registryDB != "control/registry" {
+		t.Errorf("registry read from %s, want the control database", registryDB)
+	}
+	if strings.Join(dumped, " ") != "acme_db/ app/globex app/missing" {
+		t.Errorf("dumped %v", dumped)
+	}
+	if res.Status != "partial" || res.Failed != 1 || len(res.Tenants) != 3 || res.Tenants[2].Error == "" || res.Tenants[2].Result != nil {
+		t.Fatalf("result = %+v", res)
+	}
+	if len(notified) != 1 || notified[0].Event != "tenants.failed" || notified[0].Fields["tenants"] != "initech" {
+		t.Errorf("notifications = %+v", notified)
+	}
+	for _, id := range []string{"acme", "globex"} {
+		key := "tenants/" + id + "/daily/2026-05-27-backup.sql"
+		if m, err := h.readManifest(context.Background(), key); err != nil || m.Labels["tenant"] != id {
+			t.Errorf("%s manifest = %+v, %v; want it labelled with the tenant", key, m, err)
+		}
+		if _, ok := f.objects["tenants/"+id+"/yearly/2026-backup.sql"]; !ok {
+			t.Errorf("tenant %s should keep its own yearly backup", id)
+		}
+	}
+}
+
+func TestRunTenantsRejectsBadRegistry(t *testing.T) {
+	h := newTestHandler(newFakeS3(), 7)
+	if _, err := h.RunTenants(context.Background(), RunOptions{}); err == nil {
+		t.Error("RunTenants without a registry should fail")
+	}
+	h.tenants.Query = "SELECT 1"
+	for _, rows := range [][][]string{
+		{{"acme"}},
+		{{"../acme", ""}},
+		{{"acme", ""}, {"acme", "other"}},
+		{{"acme", "bad/db"}},
+	} {
+		h.query = staticQuery(rows)
+		if _, err := h.RunTenants(context.Background(), RunOptions{}); err == nil {
+			t.Errorf("registry rows %q should be rejected", rows)
+		}
+	}
+}
+
+func TestDispatchTenants(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.tenants.Query = "SELECT id, NULL FROM tenants"
+	h.query = staticQuery([][]string{{"acme", ""}})
+	e := NewEventHandler(h, "")
+
+	out, err := e.Dispatch(context.Background(), json.RawMessage(`{"action":"tenants","force":true}`))
+	if err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	if res := out.(*TenantsResult); res.Status != "ok" || len(res.Tenants) != 1 || res.Tenants[0].Result.Key != "tenants/acme/daily/2026-05-27-backup.sql" {
+		t.Errorf("result = %+v", res)
+	}
+}
+
+func TestRunTenantsPerSchema(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	h.tenants.Schemas = "tenant_*"
+	h.dumpOpts.ExcludeSchemas = []string{"tenant_internal"}
+	var query string
+	h.query = fingerprinted(func(_ context.Context, _ DatabaseConfig, q string) ([][]string, error) {
+		query = q
+		return [][]string{{"tenant_a"}, {"tenant_b"}, {"tenant_internal"}}, nil
+	})
+	var schemas []string
+	h.dump = func(_ context.Context, _ DatabaseConfig, opts DumpOptions) ([]byte, error) {
+		schemas = append(schemas, opts.Schemas...)
+		return []byte("-- schema " + strings.Join(opts.Schemas, ",") + "\n"), nil
+	}
+
+	res, err := h.RunTenants(context.Background(), RunOptions{})
+	if err != nil {
+		t.Fatalf("RunTenants: %v", err)
+	}
+	if !strings.Contains(query, `LIKE 'tenant\_%' ESCAPE`) {
+		t.Errorf("schema query = %s", query)
+	}
+	if strings.Join(schemas, " ") != "tenant_a tenant_b" || len(res.Tenants) != 2 || res.Tenants[1].Schema != "tenant_b" {
+		t.Errorf("dumped schemas %v, result %+v", schemas, res)
+	}
+	if string(f.objects["tenants/tenant_a/daily/2026-05-27-backup.sql"].body) != "-- schema tenant_a\n" {
+		t.Error("tenant_a should be stored alone under its prefix")
+	}
+	if got := globToLike(`t?_50%*`); got != `t_\_50\%%` {
+		t.Errorf("globToLike = %s", got)
+	}
+}
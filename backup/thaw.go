@@ -0,0 +1,188 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// Thaw states reported in ThawResult.State.
+const (
+	ThawNotArchived = "not-archived" // object is directly readable; nothing to do
+	ThawRequested   = "requested"    // a restore request was issued by this call
+	ThawInProgress  = "in-progress"  // a restore is already underway
+	ThawAvailable   = "available"    // a restored copy can be downloaded
+)
+
+// ThawOptions configures a Thaw call.
+type ThawOptions struct {
+	Days         int           // days to keep the restored copy; <= 0 means 7
+	Tier         string        // "Standard", "Bulk" or "Expedited"; "" means Standard
+	Wait         bool          // poll until the copy is available or ctx is done
+	PollInterval time.Duration // delay between polls when Wait is set; <= 0 means 30s
+}
+
+// ThawResult summarizes a Thaw call.
+type ThawResult struct {
+	Status       string `json:"status"`            // always "ok" on success
+	RunID        string `json:"run_id"`            // run identifier, also prefixed to log lines
+	Action       string `json:"action"`            // always "thaw"
+	Key          string `json:"key"`               // S3 key that was checked
+	StorageClass string `json:"storage_class"`     // storage class of the object
+	State        string `json:"state"`             // one of the Thaw* states
+	Expiry       string `json:"expiry,omitempty"`  // when a restored copy expires, as reported by S3
+	DurationMs   int64  `json:"duration_ms"`       // wall-clock time of the call
+	Message      string `json:"message,omitempty"` // operator hint for the current state
+}
+
+// Thaw makes an archived (GLACIER or DEEP_ARCHIVE) backup retrievable. It
+// issues a RestoreObject request when none is pending and reports the restore
+// state; invoking it again polls that state. With opts.Wait it keeps polling
+// until the restored copy is available or ctx is done. A notification is sent
+// whenever the object is found to be retrievable.
+func (h *Handler) Thaw(ctx context.Context, key string, opts ThawOptions) (*ThawResult, error) {
+	ctx, runID := startRun(ctx)
+	start := h.now()
+	if key == "" {
+		return nil, errors.New("thaw requires a key")
+	}
+	days := opts.Days
+	if days <= 0 {
+		days = 7
+	}
+	tier := types.TierStandard
+	if opts.Tier != "" {
+		tier = types.Tier(opts.Tier)
+	}
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	result := &ThawResult{Status: "ok", RunID: runID, Action: "thaw", Key: key}
+	head, err := h.headObject(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check %s: %w", key, err)
+	}
+	result.StorageClass = string(head.StorageClass)
+
+	if !isArchivedClass(head.StorageClass) {
+		result.State = ThawNotArchived
+		result.DurationMs = h.elapsed(start)
+		return result, nil
+	}
+
+	result.State, result.Expiry = parseRestoreHeader(head.Restore)
+	if result.State == "" {
+		result.State, err = h.requestRestore(ctx, key, days, tier)
+		if err != nil {
+			return nil, err
+		}
+	}
+	logf(ctx, "Thaw %s (%s): %s", key, result.StorageClass, result.State)
+
+	for opts.Wait && result.State != ThawAvailable {
+		select {
+		case <-ctx.Done():
+			result.Message = "stopped waiting: " + ctx.Err().Error()
+			result.DurationMs = h.elapsed(start)
+			return result, nil
+		case <-time.After(interval):
+		}
+		head, err := h.headObject(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to poll %s: %w", key, err)
+		}
+		if state, expiry := parseRestoreHeader(head.Restore); state != "" {
+			result.State, result.Expiry = state, expiry
+		}
+	}
+
+	switch result.State {
+	case ThawAvailable:
+		result.Message = "restored copy is ready to download"
+		h.notify(ctx, Notification{
+			Event:   "thaw.available",
+			Message: fmt.Sprintf("Archived backup %s is retrievable until %s", key, result.Expiry),
+			Fields:  map[string]string{"key": key, "storage_class": result.StorageClass, "expiry": result.Expiry},
+		})
+	default:
+		result.Message = "restore pending; invoke thaw again to poll its status"
+	}
+	result.DurationMs = h.elapsed(start)
+	return result, nil
+}
+
+// requestRestore issues a RestoreObject request for key, treating an already
+// running restore as in progress.
+func (h *Handler) requestRestore(ctx context.Context, key string, days int, tier types.Tier) (string, error) {
+	_, err := h.s3.RestoreObject(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(h.bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &types.RestoreRequest{
+			Days:                 aws.Int32(int32(days)),
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: tier},
+		},
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "RestoreAlreadyInProgress" {
+		return ThawInProgress, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to request restore of %s: %w", key, err)
+	}
+	return ThawRequested, nil
+}
+
+// isArchivedClass reports whether objects in class must be restored before
+// they can be read. GLACIER_IR is readable directly and is not included.
+func isArchivedClass(class types.StorageClass) bool {
+	return class == types.StorageClassGlacier || class == types.StorageClassDeepArchive
+}
+
+// parseRestoreHeader interprets the x-amz-restore header returned by
+// HeadObject, e.g. `ongoing-request="false", expiry-date="Fri, 21 Dec 2012
+// 00:00:00 GMT"`. It returns "" when no restore has been requested.
+func parseRestoreHeader(restore *string) (state, expiry string) {
+	if restore == nil || *restore == "" {
+		return "", ""
+	}
+	v := *restore
+	if strings.Contains(v, `ongoing-request="true"`) {
+		return ThawInProgress, ""
+	}
+	if i := strings.Index(v, `expiry-date="`); i >= 0 {
+		rest := v[i+len(`expiry-date="`):]
+		if j := strings.Index(rest, `"`); j >= 0 {
+			expiry = rest[:j]
+		}
+	}
+	return ThawAvailable, expiry
+}
+
+// isInvalidObjectState reports whether err is S3's InvalidObjectState error,
+// returned when reading an archived object that has not been restored.
+func isInvalidObjectState(err error) bool {
+	var ios *types.InvalidObjectState
+	if errors.As(err, &ios) {
+		return true
+	}
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidObjectState"
+}
+
+// archivedError turns an InvalidObjectState error for key into an actionable
+// message pointing at the thaw action; other errors are returned unchanged.
+func archivedError(key string, err error) error {
+	if !isInvalidObjectState(err) {
+		return err
+	}
+	return fmt.Errorf("%s is archived and must be restored first (invoke the thaw action): %w", key, err)
+}
@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func archivedObject(class types.StorageClass, restore *string) *fakeObject {
+	return &fakeObject{
+		body:         []byte("archived"),
+		metadata:     map[string]string{},
+		storageClass: class,
+		restore:      restore,
+	}
+}
+
+func TestThawRequestsRestore(t *testing.T) {
+	f := newFakeS3()
+	f.objects["monthly/2026-01-backup.sql"] = archivedObject(types.StorageClassGlacier, nil)
+	h := newTestHandler(f, 7)
+
+	res, err := h.Thaw(context.Background(), "monthly/2026-01-backup.sql", ThawOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.State != ThawRequested || f.restores != 1 {
+		t.Errorf("state=%q restores=%d, want requested/1", res.State, f.restores)
+	}
+}
+
+func TestThawReportsPendingAndAvailable(t *testing.T) {
+	tests := []struct {
+		name       string
+		restore    string
+		wantState  string
+		wantExpiry string
+	}{
+		{"pending", `ongoing-request="true"`, ThawInProgress, ""},
+		{"available", `ongoing-request="false", expiry-date="Fri, 21 Dec 2026 00:00:00 GMT"`, ThawAvailable, "Fri, 21 Dec 2026 00:00:00 GMT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeS3()
+			f.objects["yearly/2025-backup.sql"] = archivedObject(types.StorageClassDeepArchive, aws.String(tt.restore))
+			h := newTestHandler(f, 7)
+			var notified []Notification
+			h.notifier = func(_ context.Context, n Notification) error {
+				notified = append(notified, n)
+				return nil
+			}
+
+			res, err := h.Thaw(context.Background(), "yearly/2025-backup.sql", ThawOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.State != tt.wantState || res.Expiry != tt.wantExpiry {
+				t.Errorf("state=%q expiry=%q, want %q/%q", res.State, res.Expiry, tt.wantState, tt.wantExpiry)
+			}
+			if f.restores != 0 {
+				t.Errorf("expected no new restore request, got %d", f.restores)
+			}
+			if wantNotified := tt.wantState == ThawAvailable; (len(notified) == 1) != wantNotified {
+				t.Errorf("notifications = %d, want notified=%v", len(notified), wantNotified)
+			}
+		})
+	}
+}
+
+func TestThawNotArchived(t *testing.T) {
+	f := newFakeS3()
+	f.seed("daily/2026-05-27-backup.sql", []byte("x"), testNow)
+	h := newTestHandler(f, 7)
+
+	res, err := h.Thaw(context.Background(), "daily/2026-05-27-backup.sql", ThawOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.State != ThawNotArchived || f.restores != 0 {
+		t.Errorf("state=%q restores=%d, want not-archived/0", res.State, f.restores)
+	}
+}
+
+func TestThawWaitStopsOnContextDone(t *testing.T) {
+	f := newFakeS3()
+	f.objects["monthly/2026-01-backup.sql"] = archivedObject(types.StorageClassGlacier, nil)
+	h := newTestHandler(f, 7)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	res, err := h.Thaw(ctx, "monthly/2026-01-backup.sql", ThawOptions{Wait: true, PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.State != ThawInProgress || !strings.HasPrefix(res.Message, "stopped waiting") {
+		t.Errorf("state=%q message=%q, want in-progress/stopped waiting", res.State, res.Message)
+	}
+}
+
+func TestThawErrors(t *testing.T) {
+	h := newTestHandler(newFakeS3(), 7)
+	if _, err := h.Thaw(context.Background(), "", ThawOptions{}); err == nil {
+		t.Error("expected error for empty key, got nil")
+	}
+	if _, err := h.Thaw(context.Background(), "monthly/missing.sql", ThawOptions{}); err == nil {
+		t.Error("expected error for missing object, got nil")
+	}
+
+	f := newFakeS3()
+	f.objects["monthly/2026-01-backup.sql"] = archivedObject(types.StorageClassGlacier, nil)
+	f.restoreErr = errors.New("AccessDenied")
+	h = newTestHandler(f, 7)
+	if _, err := h.Thaw(context.Background(), "monthly/2026-01-backup.sql", ThawOptions{}); err == nil {
+		t.Error("expected error when RestoreObject fails, got nil")
+	}
+}
+
+func TestObjectChecksumArchived(t *testing.T) {
+	f := newFakeS3()
+	// Legacy object without a sha256 entry that has moved to Glacier.
+	f.objects["monthly/2025-01-backup.sql"] = archivedObject(types.StorageClassGlacier, nil)
+	h := newTestHandler(f, 7)
+
+	_, err := h.objectChecksum(context.Background(), "monthly/2025-01-backup.sql")
+	if err == nil || !strings.Contains(err.Error(), "thaw") {
+		t.Fatalf("expected actionable archived error, got %v", err)
+	}
+	if !isInvalidObjectState(err) {
+		t.Error("archived error should still wrap InvalidObjectState")
+	}
+}
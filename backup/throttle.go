@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DumpThrottle admits a dump against the database server host, blocking until
+// the server has room for another dump, and returns the func that gives the
+// room back once the dump has finished. Run holds it while the dump and its
+// slices are read, so backups scheduled close together (several plans, or
+// the tenants of one server) never open more dump sessions at once than the
+// server was given tokens for.
+type DumpThrottle func(ctx context.Context, host string) (release func(), err error)
+
+// DynamoDBAPI is the subset of the DynamoDB client used by DynamoDBThrottle,
+// so tests can supply a fake.
+type DynamoDBAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+// Timing of DynamoDBThrottle, variables so tests can shorten them.
+var (
+	tokenPoll  = 5 * time.Second // between attempts while every token is taken
+	tokenLease = 6 * time.Hour   // lifetime of a token taken without a deadline
+)
+
+// DynamoDBThrottle returns a DumpThrottle that hands out limit tokens per host
+// from table, whose items are keyed by "host" (string) and "slot" (number).
+// A token is an item written only if its slot is free, so concurrent
+// invocations, in this function or any other sharing the table, cannot take
+// the same one. Tokens expire with the invocation's deadline (or after
+// tokenLease), which frees those of a function killed mid-dump; the
+// "expires_at" attribute can also serve as the table's TTL. A dump that finds
+// every token taken waits up to wait for one, then fails.
+func DynamoDBThrottle(client DynamoDBAPI, table string, limit int, wait time.Duration) DumpThrottle {
+	return func(ctx context.Context, host string) (func(), error) {
+		owner := NewRunID()
+		expires := time.Now().Add(tokenLease)
+		if deadline, ok := ctx.Deadline(); ok {
+			expires = deadline
+		}
+		giveUp := time.Now().Add(wait)
+		for {
+			slot, err := takeToken(ctx, client, table, host, owner, expires, limit)
+			if err != nil {
+				return nil, fmt.Errorf("failed to take a dump token: %w", err)
+			}
+			if slot >= 0 {
+				logf(ctx, "Took dump token %d of %d for %s", slot+1, limit, host)
+				return func() { releaseToken(ctx, client, table, host, owner, slot) }, nil
+			}
+			if !time.Now().Add(tokenPoll).Before(giveUp) {
+				return nil, fmt.Errorf("all %d dump tokens for %s are taken (waited %s)", limit, host, wait)
+			}
+			logf(ctx, "All %d dump tokens for %s are taken, waiting", limit, host)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(tokenPoll):
+			}
+		}
+	}
+}
+
+// tokenKey is the DynamoDB key of a token.
+func tokenKey(host string, slot int) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"host": &types.AttributeValueMemberS{Value: host},
+		"slot": &types.AttributeValueMemberN{Value: strconv.Itoa(slot)},
+	}
+}
+
+// takeToken tries each of the limit slots of host, starting at a random one so
+// that waiting invocations spread out, and returns the slot it took, or -1
+// when all are taken.
+func takeToken(ctx context.Context, client DynamoDBAPI, table, host, owner string, expires time.Time, limit int) (int, error) {
+	first := rand.IntN(limit)
+	for i := range limit {
+		slot := (first + i) % limit
+		item := tokenKey(host, slot)
+		item["owner"] = &types.AttributeValueMemberS{Value: owner}
+		item["run_id"] = &types.AttributeValueMemberS{Value: RunID(ctx)}
+		item["expires_at"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(expires.Unix(), 10)}
+		_, err := client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                 aws.String(table),
+			Item:                      item,
+			ConditionExpression:       aws.String("attribute_not_exists(#host) OR #expires < :now"),
+			ExpressionAttributeNames:  map[string]string{"#host": "host", "#expires": "expires_at"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)}},
+		})
+		var taken *types.ConditionalCheckFailedException
+		switch {
+		case err == nil:
+			return slot, nil
+		case !errors.As(err, &taken):
+			return -1, err
+		}
+	}
+	return -1, nil
+}
+
+// releaseToken deletes the token owner holds, unless it expired and was taken
+// by someone else. It runs even when ctx is done, as a run that timed out
+// still holds its token.
+func releaseToken(ctx context.Context, client DynamoDBAPI, table, host, owner string, slot int) {
+	rctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	_, err := client.DeleteItem(rctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(table),
+		Key:                       tokenKey(host, slot),
+		ConditionExpression:       aws.String("#owner = :owner"),
+		ExpressionAttributeNames:  map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":owner": &types.AttributeValueMemberS{Value: owner}},
+	})
+	var taken *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &taken) {
+		logf(ctx, "Warning: failed to release dump token %d for %s: %v", slot+1, host, err)
+	}
+}
+
+// throttleHost identifies the server of db for a DumpThrottle.
+func throttleHost(db DatabaseConfig) string {
+	port := db.Port
+	if port == "" {
+		port = "5432"
+	}
+	return db.Host + ":" + port
+}
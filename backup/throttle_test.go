@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeDynamoDB stores token items and evaluates the conditions
+// DynamoDBThrottle writes them with.
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]types.AttributeValue // by host/slot
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{items: map[string]map[string]types.AttributeValue{}}
+}
+
+func attr(item map[string]types.AttributeValue, name string) string {
+	switch v := item[name].(type) {
+	case *types.AttributeValueMemberS:
+		return v.Value
+	case *types.AttributeValueMemberN:
+		return v.Value
+	}
+	return ""
+}
+
+func (f *fakeDynamoDB) PutItem(_ context.Context, params *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := attr(params.Item, "host") + "/" + attr(params.Item, "slot")
+	if old, ok := f.items[id]; ok {
+		expires, _ := strconv.ParseInt(attr(old, "expires_at"), 10, 64)
+		now, _ := strconv.ParseInt(attr(params.ExpressionAttributeValues, ":now"), 10, 64)
+		if expires >= now {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+	}
+	f.items[id] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItem(_ context.Context, params *dynamodb.DeleteItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := attr(params.Key, "host") + "/" + attr(params.Key, "slot")
+	if attr(f.items[id], "owner") != attr(params.ExpressionAttributeValues, ":owner") {
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	delete(f.items, id)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func shortTokenPoll(t *testing.T) {
+	old := tokenPoll
+	tokenPoll = 10 * time.Millisecond
+	t.Cleanup(func() { tokenPoll = old })
+}
+
+func TestDynamoDBThrottle(t *testing.T) {
+	shortTokenPoll(t)
+	db := newFakeDynamoDB()
+	throttle := DynamoDBThrottle(db, "tokens", 2, 50*time.Millisecond)
+	ctx := context.Background()
+
+	first, err := throttle(ctx, "db:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := throttle(ctx, "db:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := throttle(ctx, "db:5432"); err == nil {
+		t.Fatal("a third dump should wait, then fail, while both tokens are taken")
+	}
+	if release, err := throttle(ctx, "other:5432"); err != nil {
+		t.Errorf("another server has its own tokens: %v", err)
+	} else {
+		release()
+	}
+
+	// A waiting dump takes the token released meanwhile.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		first()
+	}()
+	third, err := throttle(ctx, "db:5432")
+	if err != nil {
+		t.Fatalf("a released token should be taken: %v", err)
+	}
+	second()
+	third()
+	if len(db.items) != 0 {
+		t.Errorf("%d tokens left after every release", len(db.items))
+	}
+}
+
+func TestDynamoDBThrottleExpiredToken(t *testing.T) {
+	db := newFakeDynamoDB()
+	throttle := DynamoDBThrottle(db, "tokens", 1, 0)
+	// The invocation holding the token was killed at its deadline.
+	dead, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Minute))
+	defer cancel()
+	stale, err := throttle(dead, "db:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := throttle(context.Background(), "db:5432")
+	if err != nil {
+		t.Fatalf("an expired token should be taken over: %v", err)
+	}
+	stale() // the killed run's late release leaves the new holder's token alone
+	if len(db.items) != 1 {
+		t.Error("a stale release should not delete the token taken over")
+	}
+	release()
+}
+
+func TestRunHoldsDumpToken(t *testing.T) {
+	f := newFakeS3()
+	h := newTestHandler(f, 7)
+	var events []string
+	h.throttle = func(_ context.Context, host string) (func(), error) {
+		events = append(events, "take "+host)
+		return func() { events = append(events, "release") }, nil
+	}
+	h.dump = func(context.Context, DatabaseConfig, DumpOptions) ([]byte, error) {
+		events = append(events, "dump")
+		return []byte("dump"), nil
+	}
+	if _, err := h.Run(context.Background(), RunOptions{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(events) != 3 || events[0] != "take localhost:5432" || events[1] != "dump" || events[2] != "release" {
+		t.Errorf("events = %v, want the token taken around the dump and released once", events)
+	}
+
+	h.throttle = func(context.Context, string) (func(), error) { return nil, errors.New("all 1 dump tokens are taken") }
+	if _, err := h.Run(context.Background(), RunOptions{Force: true}); err == nil {
+		t.Error("Run should fail without a token")
+	}
+}
@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RestoreCheck is a query run against the target after each Restore, so a
+// restore that loaded without errors but lost data is not reported as fine.
+// The query returns one value. It passes when the value is at least Min, if
+// set, as for row counts, or else equals Expect ("t" by default), as for
+// invariants written as boolean expressions.
+type RestoreCheck struct {
+	Name   string `json:"name"`
+	SQL    string `json:"sql"`
+	Min    *int64 `json:"min,omitempty"`
+	Expect string `json:"expect,omitempty"`
+}
+
+// RestoreCheckResult is the outcome of one RestoreCheck.
+type RestoreCheckResult struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"` // what the query returned
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"` // why the query failed
+}
+
+// ParseRestoreChecks parses a RESTORE_CHECKS setting: a JSON array of
+// checks, e.g.
+//
+//	[{"name": "users", "sql": "SELECT count(*) FROM public.users", "min": 1000},
+//	 {"name": "no orphan orders", "sql": "SELECT NOT EXISTS (SELECT 1 FROM orders o LEFT JOIN users u ON u.id = o.user_id WHERE u.id IS NULL)"}]
+//
+// Unknown fields, and checks without a name or query or with both min and
+// expect, are rejected.
+func ParseRestoreChecks(s string) ([]RestoreCheck, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	var checks []RestoreCheck
+	if err := dec.Decode(&checks); err != nil {
+		return nil, fmt.Errorf("invalid restore checks: %w", err)
+	}
+	seen := map[string]bool{}
+	for i, c := range checks {
+		switch {
+		case c.Name == "" || strings.TrimSpace(c.SQL) == "":
+			return nil, fmt.Errorf("restore check %d needs a name and sql", i+1)
+		case c.Min != nil && c.Expect != "":
+			return nil, fmt.Errorf("restore check %q: min and expect are mutually exclusive", c.Name)
+		case seen[c.Name]:
+			return nil, fmt.Errorf("restore check %q is defined twice", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return checks, nil
+}
+
+// runChecks runs the configured RestoreChecks against db, logging and
+// returning their results and how many failed.
+func (h *Handler) runChecks(ctx context.Context, db DatabaseConfig) ([]RestoreCheckResult, int) {
+	var results []RestoreCheckResult
+	failed := 0
+	for _, c := range h.restoreChecks {
+		res := h.check(ctx, db, c)
+		switch {
+		case res.Error != "":
+			logf(ctx, "Restore check %s failed: %s", c.Name, res.Error)
+		case !res.OK:
+			logf(ctx, "Restore check %s failed: got %s", c.Name, res.Value)
+		}
+		if !res.OK {
+			failed++
+		}
+		results = append(results, res)
+	}
+	return results, failed
+}
+
+// check runs c against db.
+func (h *Handler) check(ctx context.Context, db DatabaseConfig, c RestoreCheck) RestoreCheckResult {
+	res := RestoreCheckResult{Name: c.Name}
+	rows, err := h.query(ctx, db, c.SQL)
+	if err == nil && (len(rows) != 1 || len(rows[0]) != 1) {
+		err = fmt.Errorf("returned %d rows, want one value", len(rows))
+	}
+	if err != nil {
+		res.Error = Redact(err.Error())
+		return res
+	}
+	res.Value = rows[0][0]
+	if c.Min == nil {
+		res.OK = res.Value == cmp.Or(c.Expect, "t")
+		return res
+	}
+	n, err := strconv.ParseInt(res.Value, 10, 64)
+	if err != nil {
+		res.Error = "not a number"
+		return res
+	}
+	res.OK = n >= *c.Min
+	return res
+}
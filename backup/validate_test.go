@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRestoreChecks(t *testing.T) {
+	checks, err := ParseRestoreChecks(`[
+		{"name": "users", "sql": "SELECT count(*) FROM users", "min": 1000},
+		{"name": "currency", "sql": "SELECT DISTINCT currency FROM prices", "expect": "EUR"}
+	]`)
+	if err != nil {
+		t.Fatalf("ParseRestoreChecks: %v", err)
+	}
+	if len(checks) != 2 || checks[0].Min == nil || *checks[0].Min != 1000 || checks[1].Expect != "EUR" {
+		t.Errorf("checks = %+v", checks)
+	}
+	if checks, err := ParseRestoreChecks(" "); checks != nil || err != nil {
+		t.Errorf("empty setting = %v, %v; want no checks", checks, err)
+	}
+	for _, bad := range []string{
+		`{}`,
+		`[{"name": "nosql"}]`,
+		`[{"sql": "SELECT true"}]`,
+		`[{"name": "both", "sql": "SELECT 1", "min": 1, "expect": "1"}]`,
+		`[{"name": "twice", "sql": "SELECT true"}, {"name": "twice", "sql": "SELECT true"}]`,
+		`[{"name": "typo", "sql": "SELECT 1", "minimum": 1}]`,
+	} {
+		if _, err := ParseRestoreChecks(bad); err == nil {
+			t.Errorf("ParseRestoreChecks(%s) should fail", bad)
+		}
+	}
+}
+
+func TestRestoreRunsChecks(t *testing.T) {
+	f := newFakeS3()
+	key := "daily/2026-05-27-backup.sql"
+	f.seed(key, []byte("CREATE TABLE users ();\n"), time.Time{})
+	var calls []restoreCall
+	h := newTestHandler(f, 7)
+	h.restore = recordingRestorer(&calls, func(string) RestoreStats { return RestoreStats{} })
+	h.restoreChecks, _ = ParseRestoreChecks(`[
+		{"name": "users", "sql": "SELECT count(*) FROM users", "min": 1000},
+		{"name": "orders", "sql": "SELECT count(*) FROM orders", "min": 1000},
+		{"name": "no orphans", "sql": "SELECT NOT EXISTS (SELECT 1 FROM orphans)"},
+		{"name": "broken", "sql": "SELECT nope"}
+	]`)
+	answers := map[string][][]string{
+		"SELECT count(*) FROM users":                {{"1200"}},
+		"SELECT count(*) FROM orders":               {{"12"}},
+		"SELECT NOT EXISTS (SELECT 1 FROM orphans)": {{"t"}},
+	}
+	var queried []string
+	h.query = func(_ context.Context, db DatabaseConfig, q string) ([][]string, error) {
+		queried = append(queried, db.Database)
+		if rows, ok := answers[q]; ok {
+			return rows, nil
+		}
+		return nil, errors.New(`psql failed: ERROR:  column "nope" does not exist`)
+	}
+
+	res, err := h.Restore(context.Background(), key, RestoreOptions{Target: restoreTarget})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	var got []string
+	for _, c := range res.Checks {
+		got = append(got, c.Name+"="+c.Value+":"+map[bool]string{true: "ok", false: "failed"}[c.OK])
+	}
+	if want := "users=1200:ok orders=12:failed no orphans=t:ok broken=:failed"; strings.Join(got, " ") != want {
+		t.Errorf("checks = %q, want %q", got, want)
+	}
+	if res.Status != "partial" || res.ChecksFailed != 2 || !strings.Contains(res.Checks[3].Error, "does not exist") {
+		t.Errorf("result = %+v", res)
+	}
+	if strings.Join(queried, ",") != "app,app,app,app" {
+		t.Errorf("checks ran against %q, want the target", queried)
+	}
+	var rec RestoreRecord
+	if err := json.Unmarshal(f.objects[res.Record].body, &rec); err != nil || rec.ChecksFailed != 2 {
+		t.Errorf("record = %+v, %v", rec, err)
+	}
+}
@@ -0,0 +1,1047 @@
+// Command backup is the command-line interface to go-postgres-s3-backup. It
+// reads the same configuration as the Lambda function, optionally from a
+// config file (-config) and with per-key overrides (-set KEY=VALUE, which take
+// precedence over everything else), and runs backup operations from a
+// workstation, CI job or cron:
+//
+//	backup [-config file] [-set KEY=VALUE]... <command> [flags]
+//
+//	backup run [-profile name] [-force [-replace-periodic]]
+//	backup prune [-profile name] [-simulate] [-as-of YYYY-MM-DD]
+//	backup list [-prefix p]
+//	backup grep [-i] [-max n] <key> <pattern>
+//	backup extract-table [-o file] <key> <table>
+//	backup diff <keyA> <keyB>
+//	backup restore [-jobs n] [-exit-on-error] [-single-transaction] [-disable-triggers] [-allow-different-source] [-allow-unsigned] [-confirm db] [-create-target [-template db] [-owner role]] [-schema name] [-dry-run] [-sections | -resume] <key> <target>
+//	backup restore [flags] {-latest | -latest-monthly | -as-of time} [-prefix p] <target>
+//	backup restore -interactive [flags] [<key> [<target>]]
+//	backup refresh-staging
+//	backup reconcile [-prefix p] [-delete-orphans]
+//	backup backfill-checksums [-prefix p]
+//	backup migrate-layout [-prefix p] [-database name]
+//	backup report [-from YYYY-MM-DD] [-to YYYY-MM-DD] [-o file]
+//	backup report -verify file
+//	backup growth
+//	backup bench [-size-mb n] [-keep]
+//	backup version
+//
+// Every command accepts -output json, which prints the operation's result
+// (or {"status": "error", ...} on failure) as a JSON object on stdout instead
+// of text, for scripts and other automation.
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicobistolfi/go-postgres-s3-backup/backup"
+	"github.com/nicobistolfi/go-postgres-s3-backup/internal/envconfig"
+)
+
+// Build information, set via -ldflags at release time by GoReleaser.
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+const usage = `usage: backup [-config file] [-set KEY=VALUE]... <command> [flags]
+
+Commands:
+  run      dump the database and store the backup
+  tenants  back up every tenant listed in the tenant registry
+  databases
+           back up every database of DATABASE_URLS or DISCOVER_DATABASES
+  prune    apply (or -simulate) the retention policy
+  list     list stored backups with their size, checksum, storage class,
+           encryption and labels
+  grep     search a stored backup for a regular expression
+  extract-table
+           write one table's DDL and data from a stored backup
+  diff     summarize how two stored backups differ
+  restore  load a stored backup into another database
+  refresh-staging
+           restore the latest backup into STAGING_TARGET and mask it
+  reconcile
+           check that every backup has its manifest and no sidecar is orphaned
+  backfill-checksums
+           record the SHA-256 of backups stored before checksums were
+  migrate-layout
+           move backups from the tier layout to the KEY_LAYOUT one
+  report   write a signed report of backups, Object Lock and verifications
+  growth   store and send a per-prefix report of the bucket's size and growth
+  bench    back up generated data and report the throughput of each phase
+  version  print build information
+
+Settings are read, from highest to lowest precedence, from -set, PSB_-prefixed
+environment variables, plain environment variables, the -config file (default
+$BACKUP_CONFIG_FILE) and .env.
+
+Every command accepts -output json to print its result as JSON on stdout.
+Run "backup <command> -h" for the flags of a command.
+`
+
+// sources are the configuration sources given before the command.
+var sources envconfig.Options
+
+// setFlag collects repeated -set KEY=VALUE flags.
+type setFlag map[string]string
+
+func (f setFlag) String() string { return "" }
+
+func (f setFlag) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("want KEY=VALUE, got %q", v)
+	}
+	f[key] = value
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+	global := flag.NewFlagSet("backup", flag.ExitOnError)
+	global.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	sources.Set = setFlag{}
+	global.StringVar(&sources.File, "config", "", "config file of KEY=VALUE lines")
+	global.Var(setFlag(sources.Set), "set", "override a setting (KEY=VALUE, repeatable)")
+	_ = global.Parse(os.Args[1:])
+	if global.NArg() < 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// A run ID assigned up front is reported with errors, too.
+	ctx := backup.WithRunID(context.Background(), backup.NewRunID())
+	var err error
+	switch cmd, args := global.Arg(0), global.Args()[1:]; cmd {
+	case "run":
+		err = runCmd(ctx, args)
+	case "tenants":
+		err = tenantsCmd(ctx, args)
+	case "databases":
+		err = databasesCmd(ctx, args)
+	case "prune":
+		err = pruneCmd(ctx, args)
+	case "list":
+		err = listCmd(ctx, args)
+	case "grep":
+		err = grepCmd(ctx, args)
+	case "extract-table":
+		err = extractTableCmd(ctx, args)
+	case "diff":
+		err = diffCmd(ctx, args)
+	case "restore":
+		err = restoreCmd(ctx, args)
+	case "refresh-staging":
+		err = refreshStagingCmd(ctx, args)
+	case "reconcile":
+		err = reconcileCmd(ctx, args)
+	case "backfill-checksums":
+		err = backfillChecksumsCmd(ctx, args)
+	case "migrate-layout":
+		err = migrateLayoutCmd(ctx, args)
+	case "report":
+		err = reportCmd(ctx, args)
+	case "growth":
+		err = growthCmd(ctx, args)
+	case "bench":
+		err = benchCmd(ctx, args)
+	case "version":
+		err = versionCmd(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		msg := backup.Redact(err.Error())
+		if format == "json" {
+			_ = printJSON(map[string]string{"status": "error", "error": msg, "run_id": backup.RunID(ctx)})
+			os.Exit(1)
+		}
+		log.Fatalf("backup %s: %s", global.Arg(0), msg)
+	}
+}
+
+// format is the -output format of the command being run.
+var format = "text"
+
+// parseFlags adds -output to fs and parses args, exiting on an unknown
+// format.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	fs.StringVar(&format, "output", "text", "output format: text or json")
+	_ = fs.Parse(args)
+	if format != "text" && format != "json" {
+		fmt.Fprintf(fs.Output(), "invalid -output %q: want text or json\n", format)
+		os.Exit(2)
+	}
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func versionCmd(args []string) error {
+	parseFlags(flag.NewFlagSet("version", flag.ExitOnError), args)
+	if format == "json" {
+		return printJSON(map[string]string{"version": version, "commit": commit, "date": date})
+	}
+	fmt.Printf("go-postgres-s3-backup %s (commit %s, built %s)\n", version, commit, date)
+	return nil
+}
+
+// handler builds a backup.Handler from the configuration sources.
+func handler(ctx context.Context, needDatabase bool) (*backup.Handler, error) {
+	settings, err := envconfig.Resolve(sources)
+	if err != nil {
+		return nil, err
+	}
+	return newHandler(ctx, settings, needDatabase)
+}
+
+// newHandler builds a backup.Handler from already resolved settings.
+func newHandler(ctx context.Context, settings *envconfig.Settings, needDatabase bool) (*backup.Handler, error) {
+	cfg, err := settings.BackupConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if needDatabase {
+		if err := settings.RequireDatabase(); err != nil {
+			return nil, err
+		}
+	}
+	cfg.Version = version
+	h := backup.New(cfg)
+	if needDatabase {
+		if err := h.RefreshDatabase(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func runCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	profile := fs.String("profile", "", "backup profile (default BACKUP_PROFILE or full)")
+	force := fs.Bool("force", false, "store today's backup even if it matches an older one")
+	replacePeriodic := fs.Bool("replace-periodic", false, "with -force, also overwrite this month's and year's backups")
+	parseFlags(fs, args)
+
+	settings, err := envconfig.Resolve(sources)
+	if err != nil {
+		return err
+	}
+	h, err := newHandler(ctx, settings, true)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	res, err := h.Run(ctx, backup.RunOptions{Force: *force, Profile: *profile, ReplacePeriodic: *replacePeriodic})
+	if path := settings.Get("METRICS_TEXTFILE"); path != "" {
+		if werr := backup.WriteMetricsFile(path, res, err, start, time.Now()); werr != nil {
+			log.Printf("Warning: %v", werr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	fmt.Printf("%s %s (%s, %s) in %dms [run %s]\n", res.Action, res.Key, res.Reason, res.Size, res.DurationMs, res.RunID)
+	for _, r := range res.Replicas {
+		if r.Status == backup.ReplicaOK {
+			fmt.Printf("  replica %s (%s): %d backup(s) copied\n", r.Name, r.Bucket, len(r.Keys))
+		} else {
+			fmt.Printf("  replica %s (%s): %s: %s\n", r.Name, r.Bucket, r.Status, r.Error)
+		}
+	}
+	return nil
+}
+
+func tenantsCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("tenants", flag.ExitOnError)
+	profile := fs.String("profile", "", "backup profile (default BACKUP_PROFILE or full)")
+	force := fs.Bool("force", false, "store each tenant's backup even if it matches an older one")
+	parseFlags(fs, args)
+
+	h, err := handler(ctx, true)
+	if err != nil {
+		return err
+	}
+	res, err := h.RunTenants(ctx, backup.RunOptions{Force: *force, Profile: *profile})
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	for _, t := range res.Tenants {
+		if t.Error != "" {
+			fmt.Printf("%-24s failed: %s\n", t.ID, t.Error)
+		} else {
+			fmt.Printf("%-24s %s %s (%s)\n", t.ID, t.Result.Action, t.Result.Key, t.Result.Size)
+		}
+	}
+	fmt.Printf("\n%d tenant(s), %d failed [run %s]\n", len(res.Tenants), res.Failed, res.RunID)
+	if res.Failed > 0 {
+		return fmt.Errorf("%d tenant backup(s) failed", res.Failed)
+	}
+	return nil
+}
+
+func databasesCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("databases", flag.ExitOnError)
+	profile := fs.String("profile", "", "backup profile (default BACKUP_PROFILE or full)")
+	force := fs.Bool("force", false, "store each database's backup even if it matches an older one")
+	parseFlags(fs, args)
+
+	h, err := handler(ctx, true)
+	if err != nil {
+		return err
+	}
+	res, err := h.RunDatabases(ctx, backup.RunOptions{Force: *force, Profile: *profile})
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	for _, d := range res.Databases {
+		if d.Error != "" {
+			fmt.Printf("%-24s failed: %s\n", d.Database, d.Error)
+		} else {
+			fmt.Printf("%-24s %s %s (%s)\n", d.Database, d.Result.Action, d.Result.Key, d.Result.Size)
+		}
+	}
+	fmt.Printf("\n%d database(s), %d failed [run %s]\n", len(res.Databases), res.Failed, res.RunID)
+	if res.Failed > 0 {
+		return fmt.Errorf("%d database backup(s) failed", res.Failed)
+	}
+	return nil
+}
+
+func pruneCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	profile := fs.String("profile", "", "backup profile (default BACKUP_PROFILE or full)")
+	simulate := fs.Bool("simulate", false, "report what would be kept or deleted without deleting")
+	asOf := fs.String("as-of", "", "evaluate the policy at this date (YYYY-MM-DD) instead of today")
+	parseFlags(fs, args)
+
+	opts := backup.PruneOptions{Profile: *profile, Simulate: *simulate}
+	if *asOf != "" {
+		t, err := time.Parse("2006-01-02", *asOf)
+		if err != nil {
+			return fmt.Errorf("invalid -as-of %q: %w", *asOf, err)
+		}
+		opts.AsOf = t
+	}
+
+	h, err := handler(ctx, false)
+	if err != nil {
+		return err
+	}
+	res, err := h.Prune(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	for _, d := range res.Decisions {
+		line := fmt.Sprintf("%-6s %s (%s)", d.Action, d.Key, d.Reason)
+		if d.Error != "" {
+			line += ": delete failed: " + d.Error
+		}
+		fmt.Println(line)
+	}
+	verb := "deleted"
+	if res.Simulated {
+		verb = "would delete"
+	}
+	fmt.Printf("\nProfile %s as of %s: keep %d, %s %d [run %s]\n", res.Profile, res.AsOf, res.Kept, verb, res.Deleted, res.RunID)
+	return nil
+}
+
+func listCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "only list keys under this prefix, e.g. daily/")
+	parseFlags(fs, args)
+
+	h, err := handler(ctx, false)
+	if err != nil {
+		return err
+	}
+	res, err := h.List(ctx, *prefix)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	for _, b := range res.Backups {
+		if b.Error != "" {
+			fmt.Printf("%s  %s: %s\n", b.LastModified.Format(time.RFC3339), b.Key, b.Error)
+			continue
+		}
+		sum := b.SHA256
+		if len(sum) > 12 {
+			sum = sum[:12]
+		}
+		line := fmt.Sprintf("%s  %-40s %10s %-12s %-8s %-7s %s", b.LastModified.Format(time.RFC3339), b.Key,
+			backup.HumanizeSize(int(b.Size)), b.StorageClass, b.Encryption, b.Compression, sum)
+		if len(b.Labels) > 0 {
+			labels := make([]string, 0, len(b.Labels))
+			for k, v := range b.Labels {
+				labels = append(labels, k+"="+v)
+			}
+			sort.Strings(labels)
+			line += "  " + strings.Join(labels, ",")
+		}
+		if b.Signature == backup.SignatureUnsigned {
+			line += "  unsigned"
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("\n%d backup(s) [run %s]\n", len(res.Backups), res.RunID)
+	return nil
+}
+
+func grepCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("grep", flag.ExitOnError)
+	ignoreCase := fs.Bool("i", false, "match case-insensitively")
+	max := fs.Int("max", 0, "stop after this many matches (default 100)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: backup grep [-i] [-max n] <key> <pattern>")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	h, err := handler(ctx, false)
+	if err != nil {
+		return err
+	}
+	res, err := h.Grep(ctx, fs.Arg(0), fs.Arg(1), backup.GrepOptions{IgnoreCase: *ignoreCase, Max: *max})
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	for _, m := range res.Matches {
+		if m.Table != "" {
+			fmt.Printf("%d [%s]: %s\n", m.Line, m.Table, m.Text)
+		} else {
+			fmt.Printf("%d: %s\n", m.Line, m.Text)
+		}
+	}
+	more := ""
+	if res.Truncated {
+		more = " (stopped at -max; more may exist)"
+	}
+	fmt.Printf("\n%d match(es) in %d lines of %s%s [run %s]\n", len(res.Matches), res.LinesScanned, res.Key, more, res.RunID)
+	return nil
+}
+
+func extractTableCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("extract-table", flag.ExitOnError)
+	output := fs.String("o", "", "write the script to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: backup extract-table [-o file] <key> <table>")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if format == "json" && *output == "" {
+		return errors.New("-output json needs -o, as the script itself goes to stdout")
+	}
+
+	h, err := handler(ctx, false)
+	if err != nil {
+		return err
+	}
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	res, err := h.ExtractTable(ctx, fs.Arg(0), fs.Arg(1), out)
+	if *output != "" {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	fmt.Fprintf(os.Stderr, "extracted %s from %s: %d entries, %d rows [run %s]\n", res.Table, res.Key, res.Entries, res.Rows, res.RunID)
+	return nil
+}
+
+func restoreCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	jobs := fs.Int("jobs", 0, "tables loaded at once from a directory- or custom-format backup; 0 means RESTORE_JOBS")
+	exitOnError := fs.Bool("exit-on-error", false, "stop at the first failing statement")
+	singleTransaction := fs.Bool("single-transaction", false, "load each script or archive in one transaction, rolled back by the first failing statement")
+	disableTriggers := fs.Bool("disable-triggers", false, "keep triggers and foreign keys from firing as data is loaded into existing tables; needs a superuser")
+	allowDifferent := fs.Bool("allow-different-source", false, "restore a backup of another database than the target's or the configured one")
+	allowUnsigned := fs.Bool("allow-unsigned", false, "restore a backup whose manifest is unsigned while manifests are signed")
+	confirm := fs.String("confirm", "", "the target database's name, needed to restore into one RESTORE_TARGETS does not match")
+	createTarget := fs.Bool("create-target", false, "create the target database, which must not exist, before restoring into it")
+	template := fs.String("template", "", "with -create-target, the template database to create the target from")
+	owner := fs.String("owner", "", "with -create-target, the role owning the target database; default the target's user")
+	schema := fs.String("schema", "", "restore only this schema, from a backup of it alone, dropping and recreating it in the existing target")
+	dryRun := fs.Bool("dry-run", false, "read and check the backup and list what it would create, without touching the target")
+	sections := fs.Bool("sections", false, "restore an archive one section at a time, recording each so a failed restore can be resumed")
+	resume := fs.Bool("resume", false, "resume a restore by section that failed, after the sections and slices it restored")
+	latest := fs.Bool("latest", false, "restore the newest backup, of any tier, instead of naming its key")
+	latestMonthly := fs.Bool("latest-monthly", false, "restore the newest monthly backup instead of naming its key")
+	asOf := fs.String("as-of", "", "restore the newest backup stored by this time (RFC 3339) or date (YYYY-MM-DD, through its end in UTC)")
+	prefix := fs.String("prefix", "", "with -latest, -latest-monthly or -as-of, the profile or tenant prefix to pick from, e.g. tenants/acme/")
+	interactive := fs.Bool("interactive", false, "pick the backup and the target at prompts, and confirm a summary before restoring")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: backup restore [-jobs n] [-exit-on-error] [-single-transaction] [-disable-triggers] [-allow-different-source] [-allow-unsigned] [-confirm db] [-create-target [-template db] [-owner role]] [-schema name] [-dry-run] [-sections | -resume] <key> <target>")
+		fmt.Fprintln(fs.Output(), "       backup restore [flags] {-latest | -latest-monthly | -as-of time} [-prefix p] <target>")
+		fmt.Fprintln(fs.Output(), "       backup restore -interactive [flags] [<key> [<target>]]")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	resolve := *latest || *latestMonthly || *asOf != ""
+	key, target := fs.Arg(0), fs.Arg(1)
+	if resolve {
+		key, target = "", fs.Arg(0)
+	}
+	if n := fs.NArg(); resolve && (n > 1 || !*interactive && n != 1) || !resolve && (n > 2 || !*interactive && n != 2) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	settings, err := envconfig.Resolve(sources)
+	if err != nil {
+		return err
+	}
+	h, err := newHandler(ctx, settings, false)
+	if err != nil {
+		return err
+	}
+	if resolve {
+		q := backup.BackupQuery{Prefix: *prefix}
+		if *latestMonthly {
+			q.Tier = "monthly"
+		}
+		if *asOf != "" {
+			if q.AsOf, err = backup.ParseAsOf(*asOf); err != nil {
+				return fmt.Errorf("invalid -as-of: %w", err)
+			}
+		}
+		if key, err = h.ResolveBackup(ctx, q); err != nil {
+			return err
+		}
+	}
+	opts := backup.RestoreOptions{Jobs: *jobs, ExitOnError: *exitOnError, SingleTransaction: *singleTransaction, DisableTriggers: *disableTriggers, AllowDifferentSource: *allowDifferent, AllowUnsigned: *allowUnsigned, Confirm: *confirm, CreateTarget: *createTarget, CreateTemplate: *template, CreateOwner: *owner, Schema: *schema, DryRun: *dryRun, Sections: *sections, Resume: *resume}
+	if *interactive {
+		w := &restoreWizard{h: h, in: bufio.NewReader(os.Stdin), out: os.Stderr}
+		if key, err = w.run(ctx, key, target, &opts); err != nil {
+			return err
+		}
+	} else if opts.Target, err = h.ResolveTarget(ctx, target); err != nil {
+		return err
+	}
+	res, err := h.Restore(ctx, key, opts)
+	if path := settings.Get("RESTORE_METRICS_TEXTFILE"); path != "" {
+		if werr := backup.WriteRestoreMetricsFile(path, res, err, time.Now()); werr != nil {
+			log.Printf("Warning: %v", werr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	if res.DryRun {
+		fmt.Printf("dry run of %s into %s: %d objects, %d tables, %s [run %s]\n", res.Key, res.Target, res.ObjectCount, res.Tables, backup.HumanizeSize(int(res.Bytes)), res.RunID)
+		for _, o := range res.Objects {
+			fmt.Printf("  %s\n", o)
+		}
+		if res.ObjectCount > len(res.Objects) {
+			fmt.Printf("  ... and %d more\n", res.ObjectCount-len(res.Objects))
+		}
+		if res.EstimatedMs > 0 {
+			fmt.Printf("  a restore would take about %s\n", time.Duration(res.EstimatedMs)*time.Millisecond)
+		}
+		return nil
+	}
+	fmt.Printf("restored %s into %s: %d tables, %d rows, %d errors [run %s]\n", res.Key, res.Target, res.Tables, res.Rows, res.Errors, res.RunID)
+	rto := fmt.Sprintf("  recovery time %s for %s", time.Duration(res.DurationMs)*time.Millisecond, backup.HumanizeSize(int(res.Bytes)))
+	if res.RTOMet != nil {
+		verdict := "met"
+		if !*res.RTOMet {
+			verdict = "exceeded"
+		}
+		rto += fmt.Sprintf(", objective of %s %s", time.Duration(res.RTOObjectiveMs)*time.Millisecond, verdict)
+	}
+	fmt.Println(rto)
+	if res.Mismatch != "" {
+		fmt.Printf("  although %s\n", res.Mismatch)
+	}
+	if len(res.Resumed) > 0 {
+		fmt.Printf("  resumed after %s\n", strings.Join(res.Resumed, ", "))
+	}
+	for _, msg := range res.FirstErrors {
+		fmt.Printf("  %s\n", msg)
+	}
+	for _, c := range res.Checks {
+		verdict := "ok"
+		if !c.OK {
+			verdict = "FAILED"
+		}
+		fmt.Printf("  check %s: %s %s%s\n", c.Name, verdict, c.Value, c.Error)
+	}
+	return nil
+}
+
+// restoreWizard asks, for backup restore -interactive, which backup to
+// restore and into which database, and has the operator confirm a summary of
+// both by typing the target database's name, so a restore at 2 AM does not
+// land on the wrong server.
+type restoreWizard struct {
+	h   *backup.Handler
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// wizardChoices is how many backups of a tier the wizard offers.
+const wizardChoices = 20
+
+// run returns the backup to restore, key when given, else as picked at the
+// prompts, and sets the target of opts, from targetRef when given (see
+// backup.Handler.ResolveTarget), confirmed.
+func (w *restoreWizard) run(ctx context.Context, key, targetRef string, opts *backup.RestoreOptions) (string, error) {
+	var picked *backup.ListEntry
+	if key == "" {
+		var err error
+		if picked, err = w.pickBackup(ctx); err != nil {
+			return "", err
+		}
+		key = picked.Key
+	}
+	if targetRef == "" {
+		targetRef = w.ask("Target database (URL, secret ARN or alias): ", "")
+	}
+	target, err := w.h.ResolveTarget(ctx, targetRef)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(w.out, "\nAbout to restore\n  backup   %s\n", key)
+	if picked != nil {
+		fmt.Fprintf(w.out, "           stored %s, %s, compression %s\n", picked.LastModified.Format(time.RFC3339), backup.HumanizeSize(int(picked.Size)), picked.Compression)
+	}
+	fmt.Fprintf(w.out, "  into     %s:%s/%s as %s\n", target.Host, cmp.Or(target.Port, "5432"), target.Database, cmp.Or(target.User, "the default user"))
+	if opts.CreateTarget {
+		fmt.Fprintln(w.out, "  a new database, created for the restore.")
+	} else {
+		fmt.Fprintln(w.out, "  which drops and recreates every object the backup contains in that database.")
+	}
+	if opts.AllowDifferentSource {
+		fmt.Fprintln(w.out, "  The source checks are off (-allow-different-source).")
+	}
+	if got := w.ask(fmt.Sprintf("Type the target database name (%s) to restore: ", target.Database), ""); got != target.Database {
+		return "", errors.New("restore not confirmed")
+	}
+	opts.Target, opts.Confirm = target, target.Database
+	return key, nil
+}
+
+// pickBackup asks for a tier and then for one of its newest backups, by
+// number or date.
+func (w *restoreWizard) pickBackup(ctx context.Context) (*backup.ListEntry, error) {
+	tier := w.ask("Tier (hourly, daily, monthly, yearly) [daily]: ", "daily")
+	res, err := w.h.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var backups []backup.ListEntry
+	for _, b := range res.Backups {
+		if b.Error == "" && (strings.HasPrefix(b.Key, tier+"/") || strings.Contains(b.Key, "/"+tier+"/")) && len(backups) < wizardChoices {
+			backups = append(backups, b)
+		}
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no %s backups found", tier)
+	}
+	for i, b := range backups {
+		fmt.Fprintf(w.out, "%3d  %s  %-50s %10s\n", i+1, b.LastModified.Format("2006-01-02 15:04"), b.Key, backup.HumanizeSize(int(b.Size)))
+	}
+	choice := w.ask("Backup, by number or date (YYYY-MM-DD) [1]: ", "1")
+	if n, err := strconv.Atoi(choice); err == nil {
+		if n < 1 || n > len(backups) {
+			return nil, fmt.Errorf("no backup numbered %d", n)
+		}
+		return &backups[n-1], nil
+	}
+	for i, b := range backups {
+		if strings.Contains(path.Base(b.Key), choice) {
+			return &backups[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no %s backup of %s among the newest %d", tier, choice, len(backups))
+}
+
+// ask prompts for a line of input, returning def for an empty one.
+func (w *restoreWizard) ask(prompt, def string) string {
+	fmt.Fprint(w.out, prompt)
+	line, _ := w.in.ReadString('\n')
+	return cmp.Or(strings.TrimSpace(line), def)
+}
+
+func benchCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	sizeMB := fs.Int("size-mb", 100, "size of the generated data, in MB")
+	keep := fs.Bool("keep", false, "keep the generated schema and the benchmark's backups")
+	parseFlags(fs, args)
+
+	h, err := handler(ctx, true)
+	if err != nil {
+		return err
+	}
+	res, err := h.Bench(ctx, backup.BenchOptions{Size: int64(*sizeMB) << 20, Keep: *keep})
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	fmt.Printf("%d rows generated in schema %s in %dms; backed up to %s (%s) [run %s]\n",
+		res.Rows, res.Schema, res.GenerateMs, res.Run.Key, res.Run.Size, res.RunID)
+	for _, p := range res.Throughput {
+		fmt.Printf("  %-9s %7dms %9.1f MB/s\n", p.Phase, p.Ms, p.MBPerSec)
+	}
+	if res.PeakMemory > 0 {
+		fmt.Printf("  peak memory %s\n", backup.HumanizeSize(int(res.PeakMemory)))
+	}
+	if res.CleanupErr != "" {
+		fmt.Printf("  %s\n", res.CleanupErr)
+	}
+	return nil
+}
+
+func diffCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: backup diff <keyA> <keyB>")
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	h, err := handler(ctx, false)
+	if err != nil {
+		return err
+	}
+	res, err := h.Diff(ctx, fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	for _, o := range res.Added {
+		fmt.Printf("+ %s\n", o)
+	}
+	for _, o := range res.Removed {
+		fmt.Printf("- %s\n", o)
+	}
+	for _, o := range res.Changed {
+		fmt.Printf("~ %s\n", o)
+	}
+	if len(res.Tables) > 0 {
+		fmt.Println("\nRows per table:")
+		for _, t := range res.Tables {
+			fmt.Printf("  %-40s %10d -> %-10d (%+d)\n", t.Table, t.RowsA, t.RowsB, t.Delta)
+		}
+	}
+	fmt.Printf("\n%s (%s) -> %s (%s): %d added, %d removed, %d changed [run %s]\n",
+		res.KeyA, backup.HumanizeSize(int(res.SizeA)), res.KeyB, backup.HumanizeSize(int(res.SizeB)),
+		len(res.Added), len(res.Removed), len(res.Changed), res.RunID)
+	return nil
+}
+
+func refreshStagingCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("refresh-staging", flag.ExitOnError)
+	parseFlags(fs, args)
+
+	h, err := handler(ctx, false)
+	if err != nil {
+		return err
+	}
+	res, err := h.RefreshStaging(ctx)
+	if res == nil || format == "json" && err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	verb := "refreshed"
+	if res.Status != "ok" {
+		verb = "did not refresh"
+	}
+	fmt.Printf("%s %s from %s: %d rows masked [run %s]\n", verb, res.Target, res.Key, res.RowsMasked, res.RunID)
+	for _, m := range res.Masks {
+		if m.Error != "" {
+			fmt.Printf("  %-24s FAILED %s\n", m.Name, m.Error)
+		} else {
+			fmt.Printf("  %-24s %d rows\n", m.Name, m.Rows)
+		}
+	}
+	return err
+}
+
+func reconcileCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "only check keys under this prefix")
+	deleteOrphans := fs.Bool("delete-orphans", false, "delete manifests and refresh scripts whose backup is gone")
+	parseFlags(fs, args)
+
+	h, err := handler(ctx, false)
+	if err != nil {
+		return err
+	}
+	res, err := h.Reconcile(ctx, backup.ReconcileOptions{Prefix: *prefix, DeleteOrphans: *deleteOrphans})
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	for _, f := range res.Findings {
+		line := fmt.Sprintf("%-16s %s", f.Problem, f.Key)
+		switch {
+		case f.Deleted:
+			line += " (deleted)"
+		case f.Error != "":
+			line += ": delete failed: " + f.Error
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("\n%d objects, %d backups: %d finding(s) [run %s]\n", res.Objects, res.Backups, len(res.Findings), res.RunID)
+	return nil
+}
+
+func backfillChecksumsCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("backfill-checksums", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "only backfill keys under this prefix")
+	parseFlags(fs, args)
+
+	h, err := handler(ctx, false)
+	if err != nil {
+		return err
+	}
+	res, err := h.BackfillChecksums(ctx, *prefix)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	for _, e := range res.Entries {
+		switch e.State {
+		case backup.BackfillDone:
+			fmt.Printf("%-10s %s (%s)\n", e.State, e.Key, e.Method)
+		case backup.BackfillFailed:
+			fmt.Printf("%-10s %s: %s\n", e.State, e.Key, e.Error)
+		default:
+			fmt.Printf("%-10s %s\n", e.State, e.Key)
+		}
+	}
+	fmt.Printf("\n%d backfilled, %d failed [run %s]\n", res.Backfilled, res.Failed, res.RunID)
+	if res.Failed > 0 {
+		return fmt.Errorf("%d backup(s) could not be backfilled", res.Failed)
+	}
+	return nil
+}
+
+func migrateLayoutCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("migrate-layout", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "only move keys under this prefix")
+	database := fs.String("database", "", "database whose partition the backups move to (default: the configured one)")
+	parseFlags(fs, args)
+
+	h, err := handler(ctx, false)
+	if err != nil {
+		return err
+	}
+	res, err := h.MigrateLayout(ctx, backup.MigrateLayoutOptions{Prefix: *prefix, Database: *database})
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	for _, e := range res.Entries {
+		switch e.State {
+		case backup.MigrateLayoutFailed:
+			fmt.Printf("%-9s %s: %s\n", e.State, e.Key, e.Error)
+		default:
+			fmt.Printf("%-9s %s -> %s\n", e.State, e.Key, e.NewKey)
+		}
+	}
+	fmt.Printf("\n%d migrated, %d skipped, %d failed [run %s]\n", res.Migrated, res.Skipped, res.Failed, res.RunID)
+	if res.Failed > 0 {
+		return fmt.Errorf("%d backup(s) could not be migrated", res.Failed)
+	}
+	return nil
+}
+
+func reportCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	from := fs.String("from", "", "first day (YYYY-MM-DD) of the period; default the first backup")
+	to := fs.String("to", "", "last day (YYYY-MM-DD) of the period, inclusive; default today")
+	output := fs.String("o", "", "write the report to this file instead of stdout")
+	verify := fs.String("verify", "", "check the signature of this JSON report instead of writing one")
+	parseFlags(fs, args)
+	if *verify != "" {
+		return verifyReport(*verify)
+	}
+
+	var opts backup.ReportOptions
+	if *from != "" {
+		t, err := time.Parse("2006-01-02", *from)
+		if err != nil {
+			return fmt.Errorf("invalid -from %q: %w", *from, err)
+		}
+		opts.From = t
+	}
+	if *to != "" {
+		t, err := time.Parse("2006-01-02", *to)
+		if err != nil {
+			return fmt.Errorf("invalid -to %q: %w", *to, err)
+		}
+		opts.To = t.AddDate(0, 0, 1) // through the end of that day
+	}
+
+	settings, err := envconfig.Resolve(sources)
+	if err != nil {
+		return err
+	}
+	if key := settings.Get("REPORT_SIGNING_KEY"); key != "" {
+		if opts.SigningKey, err = backup.ParseSigningKey(key); err != nil {
+			return fmt.Errorf("invalid REPORT_SIGNING_KEY: %w", err)
+		}
+	} else {
+		log.Print("Warning: REPORT_SIGNING_KEY is not set; the report is unsigned")
+	}
+	h, err := newHandler(ctx, settings, false)
+	if err != nil {
+		return err
+	}
+	res, err := h.Report(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	if format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(res)
+	} else {
+		err = res.WriteText(out)
+	}
+	if *output != "" {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "wrote report of %d backups to %s [run %s]\n", len(res.Backups), *output, res.RunID)
+		}
+	}
+	return err
+}
+
+// growthCmd stores the bucket growth report and prints it by prefix.
+func growthCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("growth", flag.ExitOnError)
+	parseFlags(fs, args)
+
+	h, err := handler(ctx, false)
+	if err != nil {
+		return err
+	}
+	res, err := h.GrowthReport(ctx)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(res)
+	}
+	total := res.Total
+	total.Prefix = "total"
+	for _, p := range append(res.Prefixes, total) {
+		if p.Prefix == "" {
+			p.Prefix = "(root)"
+		}
+		line := fmt.Sprintf("%-28s %8d objects %10s", p.Prefix, p.Count, backup.HumanizeSize(int(p.Bytes)))
+		if p.BytesPerDay != nil {
+			line += fmt.Sprintf("  %+d B/day, %s in 90 days", *p.BytesPerDay, backup.HumanizeSize(int(p.Projected["90d"])))
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("\nstored at %s [run %s]\n", res.Key, res.RunID)
+	return nil
+}
+
+// verifyReport checks the signature of the JSON report at path.
+func verifyReport(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	r, err := backup.VerifyReport(data)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(map[string]any{"status": "ok", "public_key": r.PublicKey, "run_id": r.RunID, "backups": len(r.Backups)})
+	}
+	fmt.Printf("signature OK: report of %d backups generated %s [run %s]\nsigned with Ed25519 public key %s\n",
+		len(r.Backups), r.GeneratedAt.Format(time.RFC3339), r.RunID, r.PublicKey)
+	return nil
+}
@@ -0,0 +1,627 @@
+// Package envconfig builds a backup.Config from environment variables, config
+// files and command-line overrides (see Resolve for the precedence). It is
+// shared by the Lambda entry point and the backup CLI so that both read
+// configuration the same way.
+package envconfig
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/nicobistolfi/go-postgres-s3-backup/backup"
+)
+
+// BackupConfig builds a backup.Config with an S3 client from the default AWS
+// configuration chain. BACKUP_BUCKET is required; DATABASE_URL is parsed when
+// set, and defaults to the first of DATABASE_URLS. DATABASE_SECRET_ARN reads
+// the database from Secrets Manager instead, over DATABASE_URL (see
+// RequireDatabase for commands that dump).
+func (s *Settings) BackupConfig(ctx context.Context) (backup.Config, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return backup.Config{}, fmt.Errorf("unable to load SDK config: %w", err)
+	}
+
+	bucket := s.Get("BACKUP_BUCKET")
+	if bucket == "" {
+		return backup.Config{}, errors.New("BACKUP_BUCKET not set")
+	}
+
+	var db backup.DatabaseConfig
+	if dbURL := s.Get("DATABASE_URL"); dbURL != "" {
+		if db, err = backup.ParseDatabaseURL(dbURL); err != nil {
+			return backup.Config{}, fmt.Errorf("failed to parse DATABASE_URL: %w", err)
+		}
+	}
+
+	if name := s.Get("PG_APPLICATION_NAME"); name != "" {
+		db.ApplicationName = name
+	}
+	if settings := s.sessionSettings(); len(settings) > 0 {
+		db.Options = backup.SessionOptions(settings)
+	}
+	db.PassFile = s.Get("PG_PASSFILE")
+	if timeout := s.duration("PG_CONNECT_TIMEOUT"); timeout > 0 {
+		db.ConnectTimeout = timeout
+	}
+
+	databases, err := s.databases(db)
+	if err != nil {
+		return backup.Config{}, err
+	}
+	if s.Get("DATABASE_URL") == "" && len(databases) > 0 {
+		db = databases[0]
+	}
+	discover, err := s.boolean("DISCOVER_DATABASES")
+	if err != nil {
+		return backup.Config{}, err
+	}
+	databaseOrder, err := backup.ParseDatabaseOrder(s.Get("DATABASE_ORDER"), s.Get("DATABASE_DEPENDENCIES"), s.Get("DATABASE_TIME_BUDGETS"))
+	if err != nil {
+		return backup.Config{}, fmt.Errorf("failed to parse DATABASE_ORDER, DATABASE_DEPENDENCIES or DATABASE_TIME_BUDGETS: %w", err)
+	}
+	var dbSource backup.DatabaseSource
+	if secret := s.Get("DATABASE_SECRET_ARN"); secret != "" {
+		refresh := s.duration("DATABASE_SECRET_REFRESH")
+		if refresh == 0 {
+			refresh = 5 * time.Minute
+		}
+		dbSource = backup.SecretsManagerDatabase(backup.SecretsManager(awsCfg), secret, refresh, db)
+	}
+
+	tenants, err := s.tenantRegistry(db)
+	if err != nil {
+		return backup.Config{}, err
+	}
+
+	var customerKey []byte
+	if v := s.Get("SSE_C_KEY"); v != "" {
+		if s.Get("KMS_KEY_ID") != "" {
+			return backup.Config{}, errors.New("KMS_KEY_ID and SSE_C_KEY are mutually exclusive")
+		}
+		if customerKey, err = backup.ParseCustomerKey(v); err != nil {
+			return backup.Config{}, fmt.Errorf("failed to parse SSE_C_KEY: %w", err)
+		}
+	}
+
+	compression, err := backup.ParseCompression(s.Get("COMPRESSION"))
+	if err != nil {
+		return backup.Config{}, fmt.Errorf("failed to parse COMPRESSION: %w", err)
+	}
+
+	dumpOpts, err := s.dumpOptions()
+	if err != nil {
+		return backup.Config{}, err
+	}
+	if dumpOpts.Format, err = backup.ParseDumpFormat(s.Get("BACKUP_FORMAT")); err != nil {
+		return backup.Config{}, fmt.Errorf("failed to parse BACKUP_FORMAT: %w", err)
+	}
+	filters, profileFilters, err := backup.ParseDumpFilters(s.Get("DUMP_FILTERS"))
+	if err != nil {
+		return backup.Config{}, fmt.Errorf("failed to parse DUMP_FILTERS: %w", err)
+	}
+	dumpOpts.Filters = filters
+	var profileDump map[string]backup.DumpOptions
+	for name, fs := range profileFilters {
+		if profileDump == nil {
+			profileDump = map[string]backup.DumpOptions{}
+		}
+		profileDump[name] = backup.DumpOptions{Filters: fs}
+	}
+
+	exemptions, err := backup.ParseRetentionExemptions(s.Get("RETENTION_EXEMPTIONS"))
+	if err != nil {
+		return backup.Config{}, fmt.Errorf("failed to parse RETENTION_EXEMPTIONS: %w", err)
+	}
+
+	var restoreTargets *regexp.Regexp
+	if v := s.Get("RESTORE_TARGETS"); v != "" {
+		if restoreTargets, err = regexp.Compile("^(?:" + v + ")$"); err != nil {
+			return backup.Config{}, fmt.Errorf("failed to parse RESTORE_TARGETS: %w", err)
+		}
+	}
+
+	restoreChecks, err := backup.ParseRestoreChecks(s.Get("RESTORE_CHECKS"))
+	if err != nil {
+		return backup.Config{}, fmt.Errorf("failed to parse RESTORE_CHECKS: %w", err)
+	}
+	restoreAliases, err := s.restoreAliases()
+	if err != nil {
+		return backup.Config{}, err
+	}
+	maskRules, err := backup.ParseMaskRules(s.Get("STAGING_MASK_RULES"))
+	if err != nil {
+		return backup.Config{}, fmt.Errorf("failed to parse STAGING_MASK_RULES: %w", err)
+	}
+
+	plans, err := backup.ParsePlans(s.Get("BACKUP_PLANS"))
+	if err != nil {
+		return backup.Config{}, fmt.Errorf("failed to parse BACKUP_PLANS: %w", err)
+	}
+
+	tuning, err := backup.ParseS3Tuning(s.Get("S3_MAX_ATTEMPTS"), s.Get("S3_TIMEOUTS"))
+	if err != nil {
+		return backup.Config{}, fmt.Errorf("failed to parse S3_MAX_ATTEMPTS or S3_TIMEOUTS: %w", err)
+	}
+
+	targets, err := s.replicas(awsCfg, tuning)
+	if err != nil {
+		return backup.Config{}, err
+	}
+
+	var snapshot backup.Snapshotter
+	if instance, cluster := s.Get("RDS_SNAPSHOT_INSTANCE"), s.Get("RDS_SNAPSHOT_CLUSTER"); instance != "" || cluster != "" {
+		snapshot = backup.RDSSnapshotter(rds.NewFromConfig(awsCfg), instance, cluster)
+	}
+
+	var throttle backup.DumpThrottle
+	if v := s.Get("DUMP_CONCURRENCY"); v != "" && v != "0" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return backup.Config{}, fmt.Errorf("invalid DUMP_CONCURRENCY %q: want a number of concurrent dumps", v)
+		}
+		table := s.Get("DUMP_TOKEN_TABLE")
+		if table == "" {
+			return backup.Config{}, errors.New("DUMP_CONCURRENCY requires DUMP_TOKEN_TABLE")
+		}
+		wait := s.duration("DUMP_TOKEN_WAIT")
+		if wait == 0 {
+			wait = 2 * time.Minute
+		}
+		throttle = backup.DynamoDBThrottle(dynamodb.NewFromConfig(awsCfg), table, limit, wait)
+	}
+
+	streamUploads, errStream := s.boolean("STREAM_UPLOADS")
+	hourly, errHourly := s.boolean("HOURLY_BACKUPS")
+	globals, errGlobals := s.boolean("BACKUP_GLOBALS")
+	rolePasswords, errPasswords := s.boolean("GLOBALS_ROLE_PASSWORDS")
+	if err := errors.Join(errStream, errHourly, errGlobals, errPasswords); err != nil {
+		return backup.Config{}, err
+	}
+
+	var notify backup.Notifier
+	if url := s.Get("NOTIFY_WEBHOOK_URL"); url != "" {
+		notify = backup.WebhookNotifier(url, nil)
+	}
+	if secret := s.Get("NOTIFY_WEBHOOK_SECRET"); secret != "" {
+		if notify != nil {
+			return backup.Config{}, errors.New("NOTIFY_WEBHOOK_URL and NOTIFY_WEBHOOK_SECRET are mutually exclusive")
+		}
+		refresh := s.duration("NOTIFY_WEBHOOK_REFRESH")
+		if refresh == 0 {
+			refresh = 5 * time.Minute
+		}
+		notify = backup.RotatingWebhookNotifier(backup.SecretsManager(awsCfg), secret, refresh, nil)
+	}
+
+	budget := s.memoryBudget()
+	if _, set := os.LookupEnv("GOMEMLIMIT"); budget > 0 && !set {
+		// The garbage collector works harder near the budget instead of
+		// letting the heap grow past it.
+		debug.SetMemoryLimit(budget)
+	}
+
+	var signer backup.ManifestSigner
+	if v := s.Get("MANIFEST_SIGNING_KEY"); v != "" {
+		if s.Get("MANIFEST_SIGNING_KMS_KEY") != "" {
+			return backup.Config{}, errors.New("MANIFEST_SIGNING_KEY and MANIFEST_SIGNING_KMS_KEY are mutually exclusive")
+		}
+		key, err := backup.ParseManifestKey(v)
+		if err != nil {
+			return backup.Config{}, fmt.Errorf("failed to parse MANIFEST_SIGNING_KEY: %w", err)
+		}
+		backup.RegisterSecret(v)
+		signer = backup.HMACSigner(key)
+	}
+	if keyID := s.Get("MANIFEST_SIGNING_KMS_KEY"); keyID != "" {
+		signer = backup.KMSSigner(awsCfg, keyID)
+	}
+
+	return backup.Config{
+		S3:             s3.NewFromConfig(awsCfg, tuning.Options),
+		Bucket:         bucket,
+		Database:       db,
+		DatabaseSource: dbSource,
+		RetentionDays:  s.positiveInt("RETENTION_DAILY", s.positiveInt("DAILY_BACKUP_RETENTION_DAYS", 7)),
+		Notify:         notify,
+		AuditSample:    s.positiveInt("AUDIT_SAMPLE_SIZE", 3),
+		AuditFullMax:   int64(s.positiveInt("AUDIT_FULL_MAX_MB", 1024)) << 20,
+		KMSKeyID:       s.Get("KMS_KEY_ID"),
+		SSECustomerKey: customerKey,
+		DumpOptions:    dumpOpts,
+		Profile:        s.Get("BACKUP_PROFILE"),
+		ConflictPolicy: s.conflictPolicy(),
+		LatestPointer:  s.latestPointer(),
+		CacheControl:   s.Get("CACHE_CONTROL"),
+		ServerID:       s.Get("BACKUP_SERVER_ID"),
+		KeyLayout:      s.keyLayout(),
+		StreamUploads:  streamUploads,
+		ConflictDelay:  s.duration("CONFLICT_MAX_DELAY"),
+		Replicas:       targets,
+		Snapshot:       snapshot,
+		Compression:    compression,
+		ProfileDump:    profileDump,
+		Plans:          plans,
+		Tenants:        tenants,
+		Throttle:       throttle,
+
+		CompressionReferenceDays: s.positiveInt("COMPRESSION_REFERENCE_DAYS", 0),
+		HourlyBackups:            hourly,
+		RetentionHours:           s.positiveInt("RETENTION_HOURLY", 48),
+		RetentionMonths:          s.positiveInt("RETENTION_MONTHLY", 0),
+		RetentionYears:           s.positiveInt("RETENTION_YEARLY", 0),
+		RetentionExemptions:      exemptions,
+		NotifyDedupWindow:        s.duration("NOTIFY_DEDUP_WINDOW"),
+		ManifestSigner:           signer,
+		MemoryBudget:             budget,
+		MigrationTables:          s.csvList("MIGRATION_TABLES"),
+		ScratchSchemas:           s.csvList("SCRATCH_SCHEMAS"),
+		BackupGlobals:            globals,
+		Databases:                databases,
+		DiscoverDatabases:        discover,
+		DatabaseOrder:            databaseOrder,
+		RTOObjective:             s.duration("RTO_OBJECTIVE"),
+		GlobalsRolePasswords:     rolePasswords,
+		StreamFallbackMax:        int64(s.positiveInt("STREAM_FALLBACK_MAX_MB", 0)) << 20,
+		RestoreProgressInterval:  s.duration("RESTORE_PROGRESS_INTERVAL"),
+		RestoreTargets:           restoreTargets,
+		RestoreChecks:            restoreChecks,
+		RestoreJobs:              s.positiveInt("RESTORE_JOBS", 0),
+		RestoreAliases:           restoreAliases,
+		Secrets:                  backup.SecretsManager(awsCfg),
+		StagingTarget:            s.Get("STAGING_TARGET"),
+		StagingTier:              s.Get("STAGING_TIER"),
+		MaskRules:                maskRules,
+	}, nil
+}
+
+// latestPointer reads LATEST_POINTER, warning about and ignoring invalid
+// values.
+func (s *Settings) latestPointer() string {
+	switch v := s.Get("LATEST_POINTER"); v {
+	case backup.LatestNone, backup.LatestCopy, backup.LatestJSON:
+		return v
+	default:
+		log.Printf("Warning: invalid LATEST_POINTER value %q, not keeping a latest pointer", v)
+		return backup.LatestNone
+	}
+}
+
+// keyLayout reads KEY_LAYOUT, warning about and ignoring invalid values.
+func (s *Settings) keyLayout() string {
+	switch v := s.Get("KEY_LAYOUT"); v {
+	case backup.LayoutTiers, backup.LayoutHive:
+		return v
+	default:
+		log.Printf("Warning: invalid KEY_LAYOUT value %q, using the default layout", v)
+		return backup.LayoutTiers
+	}
+}
+
+// tenantRegistry reads TENANT_REGISTRY_QUERY and TENANT_REGISTRY_URL, or
+// TENANT_SCHEMAS. The
+// control database defaults to db's session settings and shares its pgpass
+// file; without a URL it is db.
+func (s *Settings) tenantRegistry(db backup.DatabaseConfig) (backup.TenantRegistry, error) {
+	registry := backup.TenantRegistry{Query: s.Get("TENANT_REGISTRY_QUERY"), Schemas: s.Get("TENANT_SCHEMAS")}
+	if registry.Query != "" && registry.Schemas != "" {
+		return registry, errors.New("TENANT_REGISTRY_QUERY and TENANT_SCHEMAS are mutually exclusive")
+	}
+	controlURL := s.Get("TENANT_REGISTRY_URL")
+	if controlURL == "" {
+		return registry, nil
+	}
+	if registry.Query == "" {
+		return registry, errors.New("TENANT_REGISTRY_URL requires TENANT_REGISTRY_QUERY")
+	}
+	control, err := backup.ParseDatabaseURL(controlURL)
+	if err != nil {
+		return registry, fmt.Errorf("failed to parse TENANT_REGISTRY_URL: %w", err)
+	}
+	control.ApplicationName = cmp.Or(control.ApplicationName, db.ApplicationName)
+	control.Options = cmp.Or(control.Options, db.Options)
+	control.ConnectTimeout = cmp.Or(control.ConnectTimeout, db.ConnectTimeout)
+	control.PassFile = db.PassFile
+	registry.Database = control
+	return registry, nil
+}
+
+// databases reads DATABASE_URLS, a comma-separated list or a JSON array of
+// connection strings. Like the tenant control database, each defaults to
+// db's session settings and shares its pgpass file.
+func (s *Settings) databases(db backup.DatabaseConfig) ([]backup.DatabaseConfig, error) {
+	v := strings.TrimSpace(s.Get("DATABASE_URLS"))
+	urls := s.csvList("DATABASE_URLS")
+	if strings.HasPrefix(v, "[") {
+		urls = nil
+		if err := json.Unmarshal([]byte(v), &urls); err != nil {
+			return nil, fmt.Errorf("failed to parse DATABASE_URLS: %w", err)
+		}
+	}
+	var out []backup.DatabaseConfig
+	for i, u := range urls {
+		other, err := backup.ParseDatabaseURL(u)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse DATABASE_URLS entry %d: %w", i+1, err)
+		}
+		other.ApplicationName = cmp.Or(other.ApplicationName, db.ApplicationName)
+		other.Options = cmp.Or(other.Options, db.Options)
+		other.ConnectTimeout = cmp.Or(other.ConnectTimeout, db.ConnectTimeout)
+		other.PassFile = db.PassFile
+		out = append(out, other)
+	}
+	return out, nil
+}
+
+// RequireDatabase reports an error when none of DATABASE_URL, DATABASE_URLS
+// and DATABASE_SECRET_ARN is set, for commands that need to connect to the
+// database.
+func (s *Settings) RequireDatabase() error {
+	if s.Get("DATABASE_URL") == "" && s.Get("DATABASE_URLS") == "" && s.Get("DATABASE_SECRET_ARN") == "" {
+		return errors.New("DATABASE_URL, DATABASE_URLS or DATABASE_SECRET_ARN not set")
+	}
+	return nil
+}
+
+// positiveInt reads the named environment variable as a positive integer,
+// returning def when it is unset or invalid.
+func (s *Settings) positiveInt(name string, def int) int {
+	v := s.Get(name)
+	if v == "" {
+		return def
+	}
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return n
+	}
+	log.Printf("Warning: invalid %s value %q, using default %d", name, v, def)
+	return def
+}
+
+// boolean reads the named environment variable as a boolean, false when it
+// is unset. A value strconv.ParseBool rejects is an error rather than false,
+// so a typo does not silently turn a setting off.
+func (s *Settings) boolean(name string) (bool, error) {
+	v := s.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: want true or false", name, v)
+	}
+	return b, nil
+}
+
+// memoryBudget reads MEMORY_BUDGET_MB as bytes; unset or 0 means none.
+func (s *Settings) memoryBudget() int64 {
+	if v := s.Get("MEMORY_BUDGET_MB"); v == "0" {
+		return 0
+	}
+	return int64(s.positiveInt("MEMORY_BUDGET_MB", 0)) << 20
+}
+
+// dumpOptions builds pg_dump options from the environment. SUPABASE_MODE=true
+// excludes the Supabase-managed schemas, or the comma-separated
+// SUPABASE_EXCLUDE_SCHEMAS list when set; SKIP_MATVIEW_DATA=true leaves
+// materialized views unpopulated, SKIP_UNLOGGED_DATA=true unlogged tables
+// empty, DUMP_LOCK_WAIT_TIMEOUT (a duration such as
+// "30s") bounds how long pg_dump waits for table locks, SLICE_TABLES with
+// SLICE_MIN_SIZE_MB select tables dumped in slices, SLICE_JOBS at a time,
+// and DUMP_JOBS and DUMP_WORK_DIR set the parallelism and location of
+// directory-format dumps.
+// PG_INCLUDE_SCHEMAS, PG_EXCLUDE_SCHEMAS, PG_INCLUDE_TABLES and
+// PG_EXCLUDE_TABLES, comma-separated, select what is dumped; the excluded
+// schemas add to those of Supabase mode. The tables of PG_EXCLUDE_TABLE_DATA
+// are dumped without their rows, and the foreign tables of the servers of
+// PG_INCLUDE_FOREIGN_DATA with theirs.
+func (s *Settings) dumpOptions() (backup.DumpOptions, error) {
+	var opts backup.DumpOptions
+	matviews, errMatviews := s.boolean("SKIP_MATVIEW_DATA")
+	unlogged, errUnlogged := s.boolean("SKIP_UNLOGGED_DATA")
+	supabase, errSupabase := s.boolean("SUPABASE_MODE")
+	if err := errors.Join(errMatviews, errUnlogged, errSupabase); err != nil {
+		return opts, err
+	}
+	opts.Schemas = s.csvList("PG_INCLUDE_SCHEMAS")
+	opts.Tables = s.csvList("PG_INCLUDE_TABLES")
+	opts.ExcludeTables = s.csvList("PG_EXCLUDE_TABLES")
+	opts.ExcludeTableData = s.csvList("PG_EXCLUDE_TABLE_DATA")
+	opts.ForeignData = s.csvList("PG_INCLUDE_FOREIGN_DATA")
+	opts.SkipMatviewData, opts.SkipUnlogged = matviews, unlogged
+	opts.LockWaitTimeout = s.duration("DUMP_LOCK_WAIT_TIMEOUT")
+	opts.Slices = s.sliceSpecs()
+	opts.SliceMinSize = int64(s.positiveInt("SLICE_MIN_SIZE_MB", 0)) << 20
+	opts.SliceJobs = s.positiveInt("SLICE_JOBS", 0)
+	opts.Jobs = s.positiveInt("DUMP_JOBS", 0)
+	opts.WorkDir = s.Get("DUMP_WORK_DIR")
+	if supabase {
+		opts.ExcludeSchemas = backup.SupabaseExcludeSchemas()
+		if custom := s.csvList("SUPABASE_EXCLUDE_SCHEMAS"); len(custom) > 0 {
+			opts.ExcludeSchemas = custom
+		}
+	}
+	opts.ExcludeSchemas = append(opts.ExcludeSchemas, s.csvList("PG_EXCLUDE_SCHEMAS")...)
+	return opts, nil
+}
+
+// conflictPolicy reads CONFLICT_POLICY ("skip" or "delay"); unset or invalid
+// values disable the conflict check.
+func (s *Settings) conflictPolicy() string {
+	switch v := s.Get("CONFLICT_POLICY"); v {
+	case backup.ConflictIgnore, backup.ConflictSkip, backup.ConflictDelay:
+		return v
+	default:
+		log.Printf("Warning: invalid CONFLICT_POLICY value %q, not checking for conflicts", v)
+		return backup.ConflictIgnore
+	}
+}
+
+// duration reads the named environment variable as a positive Go duration
+// (e.g. "30s"), returning 0 when it is unset or invalid.
+func (s *Settings) duration(name string) time.Duration {
+	v := s.Get(name)
+	if v == "" {
+		return 0
+	}
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		return d
+	}
+	log.Printf("Warning: invalid %s value %q, using the default", name, v)
+	return 0
+}
+
+// sessionSettings reads PG_SESSION_SETTINGS, a comma-separated list of
+// name=value server settings (e.g. "work_mem=64MB,backend_flush_after=0")
+// applied to the backup's database sessions. Malformed entries are skipped.
+func (s *Settings) sessionSettings() map[string]string {
+	settings := map[string]string{}
+	for _, entry := range s.csvList("PG_SESSION_SETTINGS") {
+		name, value, ok := strings.Cut(entry, "=")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			log.Printf("Warning: ignoring malformed PG_SESSION_SETTINGS entry %q", entry)
+			continue
+		}
+		settings[name] = strings.TrimSpace(value)
+	}
+	return settings
+}
+
+// restoreAliases reads RESTORE_TARGET_ALIASES, a comma-separated list of
+// name=target entries, or a JSON object of them for connection strings
+// whose parameters hold commas. Each target is a connection string or a
+// Secrets Manager secret name or ARN (see backup.Handler.ResolveTarget).
+func (s *Settings) restoreAliases() (map[string]string, error) {
+	v := strings.TrimSpace(s.Get("RESTORE_TARGET_ALIASES"))
+	aliases := map[string]string{}
+	if strings.HasPrefix(v, "{") {
+		if err := json.Unmarshal([]byte(v), &aliases); err != nil {
+			return nil, fmt.Errorf("failed to parse RESTORE_TARGET_ALIASES: %w", err)
+		}
+		return aliases, nil
+	}
+	for _, entry := range s.csvList("RESTORE_TARGET_ALIASES") {
+		name, target, ok := strings.Cut(entry, "=")
+		if name, target = strings.TrimSpace(name), strings.TrimSpace(target); !ok || name == "" || target == "" {
+			return nil, fmt.Errorf("failed to parse RESTORE_TARGET_ALIASES: want name=target, got %q", entry)
+		}
+		aliases[name] = target
+	}
+	return aliases, nil
+}
+
+// sliceSpecs reads SLICE_TABLES, a comma-separated list of table:column:step
+// entries (e.g. "public.events:created_at:1 month,public.logs:id:1000000").
+// Malformed entries are skipped.
+func (s *Settings) sliceSpecs() []backup.SliceSpec {
+	var specs []backup.SliceSpec
+	for _, entry := range s.csvList("SLICE_TABLES") {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" || strings.TrimSpace(parts[2]) == "" {
+			log.Printf("Warning: ignoring malformed SLICE_TABLES entry %q", entry)
+			continue
+		}
+		specs = append(specs, backup.SliceSpec{Table: strings.TrimSpace(parts[0]), Column: strings.TrimSpace(parts[1]), Step: strings.TrimSpace(parts[2])})
+	}
+	return specs
+}
+
+// csvList reads the named environment variable as a comma-separated list,
+// dropping empty entries.
+func (s *Settings) csvList(name string) []string {
+	var out []string
+	for _, v := range strings.Split(s.Get(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// replicaSpec is one parsed BACKUP_REPLICAS entry.
+type replicaSpec struct {
+	name            string
+	bucket          string
+	endpoint        string // "" means AWS S3
+	region          string // "" means the default region
+	accessKeyID     string // static credentials; "" means the default chain
+	secretAccessKey string
+}
+
+// parseReplica parses an entry of the form
+// s3://[ACCESS_KEY_ID:SECRET@]bucket[?endpoint=URL&region=R&name=N].
+func parseReplica(raw string) (replicaSpec, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return replicaSpec{}, err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return replicaSpec{}, errors.New("want s3://bucket")
+	}
+	q := u.Query()
+	spec := replicaSpec{
+		name:     q.Get("name"),
+		bucket:   u.Host,
+		endpoint: q.Get("endpoint"),
+		region:   q.Get("region"),
+	}
+	if spec.name == "" {
+		spec.name = spec.bucket
+	}
+	if u.User != nil {
+		spec.accessKeyID = u.User.Username()
+		spec.secretAccessKey, _ = u.User.Password()
+		if spec.accessKeyID == "" || spec.secretAccessKey == "" {
+			return replicaSpec{}, errors.New("credentials need both an access key ID and a secret")
+		}
+	}
+	return spec, nil
+}
+
+// replicas reads BACKUP_REPLICAS, a comma-separated list of secondary
+// destinations (see parseReplica), building a client for each from awsCfg.
+// An endpoint selects an S3-compatible service, e.g.
+// s3://KEY:SECRET@bucket?endpoint=https://storage.googleapis.com&region=auto
+// for Google Cloud Storage with HMAC keys.
+func (s *Settings) replicas(awsCfg aws.Config, tuning backup.S3Tuning) ([]backup.Replica, error) {
+	var out []backup.Replica
+	for _, raw := range s.csvList("BACKUP_REPLICAS") {
+		spec, err := parseReplica(raw)
+		if err != nil {
+			// The entry may hold credentials: report its position, not its text.
+			return nil, fmt.Errorf("invalid BACKUP_REPLICAS entry %d: %w", len(out)+1, err)
+		}
+		backup.RegisterSecret(spec.secretAccessKey)
+		client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+			if spec.endpoint != "" {
+				o.BaseEndpoint = aws.String(spec.endpoint)
+				o.UsePathStyle = true
+			}
+			if spec.region != "" {
+				o.Region = spec.region
+			}
+			if spec.accessKeyID != "" {
+				o.Credentials = credentials.NewStaticCredentialsProvider(spec.accessKeyID, spec.secretAccessKey, "")
+			}
+		}, tuning.Options)
+		out = append(out, backup.Replica{Name: spec.name, S3: client, Bucket: spec.bucket})
+	}
+	return out, nil
+}
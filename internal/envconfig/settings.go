@@ -0,0 +1,278 @@
+package envconfig
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// Prefix is the optional prefix of environment variables read by this
+// package: PSB_BACKUP_BUCKET is read as BACKUP_BUCKET and takes precedence
+// over it, which keeps the settings apart from other tools' variables.
+const Prefix = "PSB_"
+
+// ConfigFileVar names the environment variable that points at a config file
+// when Options.File is empty.
+const ConfigFileVar = "BACKUP_CONFIG_FILE"
+
+// knownKeys lists every setting this package reads.
+var knownKeys = []string{
+	"API_KEY",
+	"AUDIT_FULL_MAX_MB",
+	"AUDIT_SAMPLE_SIZE",
+	"BACKUP_BUCKET",
+	"BACKUP_FORMAT",
+	"BACKUP_GLOBALS",
+	"BACKUP_PLANS",
+	"BACKUP_PROFILE",
+	"BACKUP_REPLICAS",
+	"BACKUP_SERVER_ID",
+	"CACHE_CONTROL",
+	"COMPRESSION",
+	"COMPRESSION_REFERENCE_DAYS",
+	"CONFLICT_MAX_DELAY",
+	"CONFLICT_POLICY",
+	"DAILY_BACKUP_RETENTION_DAYS",
+	"DATABASE_DEPENDENCIES",
+	"DATABASE_ORDER",
+	"DATABASE_SECRET_ARN",
+	"DATABASE_SECRET_REFRESH",
+	"DATABASE_TIME_BUDGETS",
+	"DATABASE_URL",
+	"DATABASE_URLS",
+	"DISCOVER_DATABASES",
+	"DUMP_CONCURRENCY",
+	"DUMP_FILTERS",
+	"DUMP_JOBS",
+	"DUMP_LOCK_WAIT_TIMEOUT",
+	"DUMP_TOKEN_TABLE",
+	"DUMP_TOKEN_WAIT",
+	"DUMP_WORK_DIR",
+	"GLOBALS_ROLE_PASSWORDS",
+	"HOURLY_BACKUPS",
+	"KEY_LAYOUT",
+	"KMS_KEY_ID",
+	"LATEST_POINTER",
+	"MANIFEST_SIGNING_KEY",
+	"MANIFEST_SIGNING_KMS_KEY",
+	"MEMORY_BUDGET_MB",
+	"METRICS_TEXTFILE",
+	"MIGRATION_TABLES",
+	"NOTIFY_DEDUP_WINDOW",
+	"NOTIFY_WEBHOOK_REFRESH",
+	"NOTIFY_WEBHOOK_SECRET",
+	"NOTIFY_WEBHOOK_URL",
+	"PG_APPLICATION_NAME",
+	"PG_CONNECT_TIMEOUT",
+	"PG_EXCLUDE_SCHEMAS",
+	"PG_EXCLUDE_TABLES",
+	"PG_EXCLUDE_TABLE_DATA",
+	"PG_INCLUDE_FOREIGN_DATA",
+	"PG_INCLUDE_SCHEMAS",
+	"PG_INCLUDE_TABLES",
+	"PG_PASSFILE",
+	"PG_SESSION_SETTINGS",
+	"RDS_SNAPSHOT_CLUSTER",
+	"RDS_SNAPSHOT_INSTANCE",
+	"REPORT_SIGNING_KEY",
+	"RESTORE_CHECKS",
+	"RESTORE_JOBS",
+	"RESTORE_METRICS_TEXTFILE",
+	"RESTORE_PROGRESS_INTERVAL",
+	"RESTORE_TARGETS",
+	"RESTORE_TARGET_ALIASES",
+	"RETENTION_DAILY",
+	"RETENTION_EXEMPTIONS",
+	"RETENTION_HOURLY",
+	"RETENTION_MONTHLY",
+	"RETENTION_YEARLY",
+	"RTO_OBJECTIVE",
+	"S3_MAX_ATTEMPTS",
+	"S3_TIMEOUTS",
+	"SCRATCH_SCHEMAS",
+	"SKIP_MATVIEW_DATA",
+	"SKIP_UNLOGGED_DATA",
+	"SLICE_JOBS",
+	"SLICE_MIN_SIZE_MB",
+	"SLICE_TABLES",
+	"SSE_C_KEY",
+	"STAGING_MASK_RULES",
+	"STAGING_TARGET",
+	"STAGING_TIER",
+	"STREAM_FALLBACK_MAX_MB",
+	"STREAM_UPLOADS",
+	"SUPABASE_EXCLUDE_SCHEMAS",
+	"SUPABASE_MODE",
+	"TENANT_REGISTRY_QUERY",
+	"TENANT_REGISTRY_URL",
+	"TENANT_SCHEMAS",
+}
+
+// Options selects the configuration sources read besides the process
+// environment.
+type Options struct {
+	File string            // config file of KEY=VALUE lines; "" means $BACKUP_CONFIG_FILE, if set
+	Set  map[string]string // command-line overrides, e.g. from -set KEY=VALUE
+}
+
+// Settings holds configuration resolved from every source. From highest to
+// lowest precedence: Options.Set, PSB_-prefixed environment variables, plain
+// environment variables, the config file, and a .env file in the working
+// directory.
+type Settings struct {
+	layers []map[string]string // highest precedence first
+}
+
+// Resolve reads every source in opts. Unknown keys on the command line, in the
+// config file or behind the PSB_ prefix are errors that suggest the closest
+// known key; in .env, which other tools share, near misses only log a warning.
+func Resolve(opts Options) (*Settings, error) {
+	dotenv, err := godotenv.Read()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read .env: %w", err)
+	}
+	for key := range dotenv {
+		if !isKnown(key) && !isPassthrough(key) {
+			if s := suggest(key); s != "" {
+				log.Printf("Warning: .env sets unknown key %s (did you mean %s?)", key, s)
+			}
+		}
+	}
+
+	file := opts.File
+	if file == "" {
+		file = os.Getenv(Prefix + ConfigFileVar)
+	}
+	if file == "" {
+		file = os.Getenv(ConfigFileVar)
+	}
+	var fromFile map[string]string
+	if file != "" {
+		if fromFile, err = godotenv.Read(file); err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := checkKeys(fromFile, "config file "+file); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkKeys(opts.Set, "command line"); err != nil {
+		return nil, err
+	}
+
+	prefixed := map[string]string{}
+	plain := map[string]string{}
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		if name, ok := strings.CutPrefix(key, Prefix); ok && name != ConfigFileVar {
+			prefixed[name] = value
+		}
+		switch {
+		case isKnown(key):
+			plain[key] = value
+		case !strings.HasPrefix(key, Prefix) && !isPassthrough(key):
+			if s := suggest(key); s != "" {
+				log.Printf("Warning: ignoring environment variable %s (did you mean %s?)", key, s)
+			}
+		}
+	}
+	if err := checkKeys(prefixed, "environment ("+Prefix+" prefix)"); err != nil {
+		return nil, err
+	}
+
+	// Keys for the AWS SDK and libpq only work from the process environment.
+	// Command-line values replace it; file values only fill gaps.
+	for key, value := range opts.Set {
+		if isPassthrough(key) {
+			_ = os.Setenv(key, value)
+		}
+	}
+	for _, layer := range []map[string]string{fromFile, dotenv} {
+		for key, value := range layer {
+			if _, set := os.LookupEnv(key); isPassthrough(key) && !set {
+				_ = os.Setenv(key, value)
+			}
+		}
+	}
+	return &Settings{layers: []map[string]string{opts.Set, prefixed, plain, fromFile, dotenv}}, nil
+}
+
+// Get returns the value of key from the highest-precedence source that sets
+// it, or "".
+func (s *Settings) Get(key string) string {
+	for _, layer := range s.layers {
+		if v, ok := layer[key]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// checkKeys reports the first unknown key in values, which came from source.
+func checkKeys(values map[string]string, source string) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if !isKnown(key) && !isPassthrough(key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	msg := fmt.Sprintf("unknown setting %s in %s", keys[0], source)
+	if s := suggest(keys[0]); s != "" {
+		msg += fmt.Sprintf(" (did you mean %s?)", s)
+	}
+	return errors.New(msg)
+}
+
+func isKnown(key string) bool {
+	i := sort.SearchStrings(knownKeys, key)
+	return i < len(knownKeys) && knownKeys[i] == key
+}
+
+// isPassthrough reports whether key is meant for the AWS SDK (AWS_*) or the
+// PostgreSQL client tools (PGHOST, PGSSLMODE, ...). Found in a config or .env
+// file or on the command line, such keys are exported to the process
+// environment instead of being rejected as unknown.
+func isPassthrough(key string) bool {
+	return strings.HasPrefix(key, "AWS_") || (strings.HasPrefix(key, "PG") && !strings.HasPrefix(key, "PG_"))
+}
+
+// suggest returns the known key closest to key, or "" when none is close
+// enough to be a likely typo.
+func suggest(key string) string {
+	best, bestDist := "", 3
+	for _, k := range knownKeys {
+		if d := editDistance(strings.ToUpper(key), k); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,83 @@
+package envconfig
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolvePrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backup.env")
+	if err := os.WriteFile(file, []byte("BACKUP_BUCKET=from-file\nBACKUP_PROFILE=from-file\nKMS_KEY_ID=from-file\nAUDIT_SAMPLE_SIZE=9\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BACKUP_BUCKET", "from-env")
+	t.Setenv("BACKUP_PROFILE", "from-env")
+	t.Setenv("PSB_BACKUP_PROFILE", "from-prefixed-env")
+	t.Setenv("PSB_"+ConfigFileVar, file)
+
+	s, err := Resolve(Options{Set: map[string]string{"KMS_KEY_ID": "from-flag"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for key, want := range map[string]string{
+		"KMS_KEY_ID":        "from-flag",
+		"BACKUP_PROFILE":    "from-prefixed-env",
+		"BACKUP_BUCKET":     "from-env",
+		"AUDIT_SAMPLE_SIZE": "9",
+		"DATABASE_URL":      "",
+	} {
+		if got := s.Get(key); got != want {
+			t.Errorf("Get(%s) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestResolveRejectsUnknownKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backup.env")
+	if err := os.WriteFile(file, []byte("BACKUP_BUCKET=b\nDAILY_BACKUP_RETENTON_DAYS=30\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Resolve(Options{File: file})
+	if err == nil || !strings.Contains(err.Error(), "DAILY_BACKUP_RETENTON_DAYS") || !strings.Contains(err.Error(), "did you mean DAILY_BACKUP_RETENTION_DAYS") {
+		t.Errorf("config file typo: err = %v", err)
+	}
+
+	if _, err := Resolve(Options{Set: map[string]string{"BUCKET": "b"}}); err == nil {
+		t.Error("expected an unknown command-line key to be rejected")
+	}
+
+	t.Setenv("PSB_KMS_KEYID", "k")
+	if _, err := Resolve(Options{}); err == nil || !strings.Contains(err.Error(), "did you mean KMS_KEY_ID") {
+		t.Errorf("prefixed env typo: err = %v", err)
+	}
+}
+
+func TestResolveExportsClientSettings(t *testing.T) {
+	t.Setenv("PGCONNECT_TIMEOUT", "")
+	os.Unsetenv("PGCONNECT_TIMEOUT")
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	if _, err := Resolve(Options{Set: map[string]string{"PGCONNECT_TIMEOUT": "5", "AWS_REGION": "us-east-2"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := os.Getenv("PGCONNECT_TIMEOUT"); got != "5" {
+		t.Errorf("PGCONNECT_TIMEOUT = %q, want 5", got)
+	}
+	if got := os.Getenv("AWS_REGION"); got != "us-east-2" {
+		t.Errorf("AWS_REGION = %q, want the command-line value", got)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	for key, want := range map[string]string{
+		"BACKUP_BUKET":   "BACKUP_BUCKET",
+		"kms_key_id":     "KMS_KEY_ID",
+		"SOMETHING_ELSE": "",
+	} {
+		if got := suggest(key); got != want {
+			t.Errorf("suggest(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
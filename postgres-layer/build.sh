@@ -47,6 +47,7 @@ if command -v docker >/dev/null 2>&1; then
         
         # Copy binaries
         cp /tmp/usr/pgsql-17/bin/pg_dump /workspace/opt/bin/
+        cp /tmp/usr/pgsql-17/bin/pg_dumpall /workspace/opt/bin/
         cp /tmp/usr/pgsql-17/bin/pg_restore /workspace/opt/bin/
         cp /tmp/usr/pgsql-17/bin/psql /workspace/opt/bin/
         